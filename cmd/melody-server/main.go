@@ -0,0 +1,56 @@
+// Command melody-server exposes the melody filter and templating over HTTP, so melody
+// can run as a sidecar for services without Go or Rust toolchains.
+//
+// Endpoints:
+//
+//	POST /v1/render        renders a cmd3 or cmd4 prompt
+//	POST /v1/parse/stream  streams filter outputs for decoded tokens, as NDJSON or SSE
+//
+// See server.go for the request and response formats.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           newHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("melody-server listening on %s", *addr)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	case <-ctx.Done():
+		log.Print("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Fatalf("shutdown: %v", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/conformance"
+)
+
+// maxRenderBodyBytes bounds the size of a render request
+const maxRenderBodyBytes = 16 << 20
+
+// RenderRequest is the body of POST /v1/render. Options are decoded as
+// melody.RenderCmd3Options or melody.RenderCmd4Options depending on the format.
+type RenderRequest struct {
+	// Format is "cmd3" or "cmd4"
+	Format  string          `json:"format"`
+	Options json.RawMessage `json:"options"`
+}
+
+// RenderResponse is the body of a successful POST /v1/render
+type RenderResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+// StreamConfig is the first line of a POST /v1/parse/stream body. It uses the option
+// names of the conformance corpus, e.g. {"options": ["cmd3"]}, and any chunks it holds
+// are written before the chunks of the following lines.
+type StreamConfig = conformance.Input
+
+// StreamChunk is a line of a POST /v1/parse/stream body after the config, holding the
+// decoded text of a token
+type StreamChunk struct {
+	Text string `json:"text"`
+}
+
+// errorResponse is the body of a failed request, or the last line of a stream that
+// failed after it started
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/render", handleRender)
+	mux.HandleFunc("POST /v1/parse/stream", handleParseStream)
+	return mux
+}
+
+func handleRender(w http.ResponseWriter, r *http.Request) {
+	var req RenderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRenderBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	var (
+		prompt string
+		err    error
+	)
+	switch req.Format {
+	case "cmd3":
+		var opts melody.RenderCmd3Options
+		if err := json.Unmarshal(req.Options, &opts); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cmd3 options: %w", err))
+			return
+		}
+		prompt, err = melody.RenderCMD3(opts)
+	case "cmd4":
+		var opts melody.RenderCmd4Options
+		if err := json.Unmarshal(req.Options, &opts); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cmd4 options: %w", err))
+			return
+		}
+		prompt, err = melody.RenderCMD4(opts)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q, expected cmd3 or cmd4", req.Format))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(RenderResponse{Prompt: prompt})
+}
+
+// handleParseStream reads a StreamConfig followed by StreamChunk lines and writes the
+// filter outputs of every chunk as soon as they are produced, as NDJSON, or as
+// server-sent events if the client accepts text/event-stream. Outputs use the
+// language-neutral conformance.Output encoding.
+func handleParseStream(w http.ResponseWriter, r *http.Request) {
+	// Outputs are written while the body is still being read
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+
+	dec := json.NewDecoder(r.Body)
+	var cfg StreamConfig
+	if err := dec.Decode(&cfg); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid stream config: %w", err))
+		return
+	}
+	opts, err := cfg.FilterOptions()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	f, err := melody.TryNewFilter(opts...)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	write := func(v any) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if sse {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", b)
+		}
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	writeOutputs := func(outputs []melody.FilterOutput, err error) error {
+		for _, o := range outputs {
+			if werr := write(conformance.FromFilterOutput(o)); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			_ = write(errorResponse{Error: err.Error()})
+		}
+		return err
+	}
+
+	chunks := cfg.Chunks
+	for {
+		for _, text := range chunks {
+			if err := writeOutputs(f.WriteDecoded(text, nil)); err != nil {
+				return
+			}
+		}
+
+		var chunk StreamChunk
+		err := dec.Decode(&chunk)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			_ = write(errorResponse{Error: fmt.Sprintf("invalid stream chunk: %v", err)})
+			return
+		}
+		chunks = []string{chunk.Text}
+	}
+	_ = writeOutputs(f.FlushPartials())
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
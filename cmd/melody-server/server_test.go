@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/conformance"
+)
+
+func TestParseStream(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	body := `{"options": ["cmd3"]}
+{"text": "<|START_RESPONSE|>"}
+{"text": "Hello"}
+{"text": " world"}
+{"text": "<|END_RESPONSE|>"}
+`
+	for _, tt := range []struct {
+		name   string
+		accept string
+		prefix string
+	}{
+		{name: "ndjson"},
+		{name: "sse", accept: "text/event-stream", prefix: "data: "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/parse/stream", strings.NewReader(body))
+			require.NoError(t, err)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var text string
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				line, ok := strings.CutPrefix(scanner.Text(), tt.prefix)
+				if !ok || line == "" {
+					continue
+				}
+				var out conformance.Output
+				require.NoError(t, json.Unmarshal([]byte(line), &out))
+				text += out.Text
+			}
+			require.NoError(t, scanner.Err())
+			require.Equal(t, "Hello world", text)
+		})
+	}
+}
+
+func TestParseStream_InvalidConfig(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/v1/parse/stream", "application/x-ndjson", strings.NewReader(`{"options": ["cmd5"]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var body errorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Contains(t, body.Error, "cmd5")
+}
+
+func TestRender_UnknownFormat(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/v1/render", "application/json", strings.NewReader(`{"format": "cmd5", "options": {}}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
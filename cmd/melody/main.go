@@ -0,0 +1,69 @@
+// Command melody renders prompts, parses completions and tokenizes text from the
+// command line, so model outputs can be debugged without writing Go.
+//
+// Usage:
+//
+//	melody render [-format cmd3|cmd4] [file]
+//	melody parse [-options cmd3,stream_tool_actions] [-tokenizer path] [file]
+//	melody tokenize -tokenizer path [file]
+//
+// Every subcommand reads its input from file, or from stdin if no file is given.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `usage: melody <command> [flags] [file]
+
+commands:
+  render    render a prompt from messages or render options JSON
+  parse     parse a completion and print the filter outputs as JSON
+  tokenize  print the token ids and tokens of a text
+
+Run 'melody <command> -h' for the flags of a command.
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	// the flag set has already printed the usage of the command
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, "melody:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", usage)
+	}
+	switch args[0] {
+	case "render":
+		return runRender(args[1:], stdin, stdout)
+	case "parse":
+		return runParse(args[1:], stdin, stdout)
+	case "tokenize":
+		return runTokenize(args[1:], stdin, stdout)
+	case "-h", "-help", "--help", "help":
+		_, err := io.WriteString(stdout, usage)
+		return err
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// readInput reads the file named by the only positional argument, or stdin if there is none
+func readInput(args []string, stdin io.Reader) ([]byte, error) {
+	switch len(args) {
+	case 0:
+		return io.ReadAll(stdin)
+	case 1:
+		return os.ReadFile(args[0])
+	default:
+		return nil, fmt.Errorf("expected at most one input file, got %d", len(args))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/conformance"
+)
+
+func TestRun_Parse(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	completion := "<|START_THINKING|>Plan<|END_THINKING|><|START_RESPONSE|>Hello<|END_RESPONSE|>"
+	require.NoError(t, run([]string{"parse", "-options", "cmd3"}, strings.NewReader(completion), &stdout))
+
+	var outputs []conformance.Output
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &outputs))
+	var thinking, text string
+	for _, o := range outputs {
+		if o.IsReasoning {
+			thinking += o.Text
+		} else {
+			text += o.Text
+		}
+	}
+	require.Equal(t, "Plan", thinking)
+	require.Equal(t, "Hello", text)
+}
+
+func TestRun_Errors(t *testing.T) {
+	t.Parallel()
+
+	for _, args := range [][]string{
+		nil,
+		{"unknown"},
+		{"parse", "-options", "cmd5"},
+		{"render", "-format", "cmd5"},
+		{"tokenize"},
+	} {
+		require.Error(t, run(args, strings.NewReader("[]"), &bytes.Buffer{}), "args %q", args)
+	}
+}
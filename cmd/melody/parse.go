@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"strings"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/conformance"
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
+// runParse runs a completion through a filter and prints its outputs as a JSON array
+// in the conformance.Output encoding. The completion is written one character at a
+// time, or one token at a time if a tokenizer is given.
+func runParse(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	options := fs.String("options", "cmd3", "comma separated filter option names, e.g. cmd3,stream_tool_actions")
+	tokenizerPath := fs.String("tokenizer", "", "tokenizer JSON file used to split the completion into tokens")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	input, err := readInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	cfg := conformance.Input{}
+	if *options != "" {
+		cfg.Options = strings.Split(*options, ",")
+	}
+	if *tokenizerPath == "" {
+		for _, r := range string(input) {
+			cfg.Chunks = append(cfg.Chunks, string(r))
+		}
+	} else {
+		cfg.Chunks, err = tokenChunks(*tokenizerPath, string(input))
+		if err != nil {
+			return err
+		}
+	}
+
+	outputs, err := conformance.Execute(cfg)
+	if err != nil {
+		return err
+	}
+	if outputs == nil {
+		outputs = []conformance.Output{}
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(outputs)
+}
+
+// tokenChunks splits text into the decoded text of its tokens
+func tokenChunks(tokenizerPath, text string) ([]string, error) {
+	tk, err := tokenizers.FromFile(tokenizerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer tk.Close()
+
+	ids, _ := tk.Encode(text, false)
+	d := melody.NewDetokenizer(tk, melody.WithSpecialTokensKept())
+	var chunks []string
+	for _, id := range ids {
+		delta, err := d.Write(id)
+		if err != nil {
+			return nil, err
+		}
+		if delta != "" {
+			chunks = append(chunks, delta)
+		}
+	}
+	delta, err := d.Flush()
+	if err != nil {
+		return nil, err
+	}
+	if delta != "" {
+		chunks = append(chunks, delta)
+	}
+	return chunks, nil
+}
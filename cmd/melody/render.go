@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+// runRender renders a prompt. The input is either render options JSON of the format,
+// or a JSON array of messages which is rendered with the default options.
+func runRender(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	format := fs.String("format", "cmd3", "prompt format, cmd3 or cmd4")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	input, err := readInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	// A bare array of messages is shorthand for {"messages": [...]}
+	if trimmed := bytes.TrimSpace(input); len(trimmed) > 0 && trimmed[0] == '[' {
+		input, err = json.Marshal(map[string]json.RawMessage{"messages": trimmed})
+		if err != nil {
+			return err
+		}
+	}
+
+	var prompt string
+	switch *format {
+	case "cmd3":
+		var opts melody.RenderCmd3Options
+		if err := json.Unmarshal(input, &opts); err != nil {
+			return fmt.Errorf("invalid cmd3 options: %w", err)
+		}
+		prompt, err = melody.RenderCMD3(opts)
+	case "cmd4":
+		var opts melody.RenderCmd4Options
+		if err := json.Unmarshal(input, &opts); err != nil {
+			return fmt.Errorf("invalid cmd4 options: %w", err)
+		}
+		prompt, err = melody.RenderCMD4(opts)
+	default:
+		return fmt.Errorf("unknown format %q, expected cmd3 or cmd4", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, prompt)
+	return err
+}
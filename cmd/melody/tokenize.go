@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
+// tokenizeOutput is the JSON printed by the tokenize command
+type tokenizeOutput struct {
+	IDs    []uint32 `json:"ids"`
+	Tokens []string `json:"tokens"`
+}
+
+// runTokenize prints the token ids and tokens of a text as JSON
+func runTokenize(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("tokenize", flag.ContinueOnError)
+	tokenizerPath := fs.String("tokenizer", "", "tokenizer JSON file (required)")
+	addSpecialTokens := fs.Bool("add-special-tokens", false, "add the special tokens of the tokenizer, e.g. BOS")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tokenizerPath == "" {
+		return errors.New("-tokenizer is required")
+	}
+	input, err := readInput(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	tk, err := tokenizers.FromFile(*tokenizerPath)
+	if err != nil {
+		return err
+	}
+	defer tk.Close()
+
+	ids, tokens := tk.Encode(string(input), *addSpecialTokens)
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tokenizeOutput{IDs: ids, Tokens: tokens})
+}
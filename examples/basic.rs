@@ -18,10 +18,8 @@ fn main() {
 
         // Simulate citation text
         let citation_text = "Hello World!";
-        let logprobs = parsing::types::TokenIDsWithLogProb {
-            token_ids: vec![1, 2, 3],
-            logprobs: vec![0.1, 0.2, 0.3],
-        };
+        let logprobs =
+            parsing::types::TokenIDsWithLogProb::from_tokens(vec![1, 2, 3], vec![0.1, 0.2, 0.3]);
 
         let outputs = filter.write_decoded(citation_text, logprobs);
         for output in outputs {
@@ -46,10 +44,8 @@ fn main() {
 
         // Simulate citation text
         let citation_text = "Hello <co: 1>world</co: 1>!";
-        let logprobs = parsing::types::TokenIDsWithLogProb {
-            token_ids: vec![1, 2, 3],
-            logprobs: vec![0.1, 0.2, 0.3],
-        };
+        let logprobs =
+            parsing::types::TokenIDsWithLogProb::from_tokens(vec![1, 2, 3], vec![0.1, 0.2, 0.3]);
 
         let outputs = filter.write_decoded(citation_text, logprobs);
         for output in outputs {
@@ -73,10 +69,7 @@ fn main() {
         let mut filter = parsing::new_filter(options);
 
         let search_text = "Search: machine learning";
-        let logprobs = parsing::types::TokenIDsWithLogProb {
-            token_ids: vec![5, 6],
-            logprobs: vec![0.5, 0.6],
-        };
+        let logprobs = parsing::types::TokenIDsWithLogProb::from_tokens(vec![5, 6], vec![0.5, 0.6]);
 
         let outputs = filter.write_decoded(search_text, logprobs);
         for output in outputs {
@@ -0,0 +1,202 @@
+// Package agent runs the multi-hop loop of a model using tools: the prompt is rendered,
+// the completion is parsed into tool calls, the results of the tools are appended to the
+// conversation and the prompt is rendered again, until the model replies without tool
+// calls. A Session owns the messages of the conversation across the hops:
+//
+//	s := agent.NewSession(opts, agent.WithMaxHops(4))
+//	for {
+//		render, err := s.Next()
+//		if err != nil {
+//			return err
+//		}
+//		outputs := generate(render) // parsed with melody.HandleMultiHopCmd3
+//		calls := s.AppendOutputs(outputs)
+//		if len(calls) == 0 {
+//			break
+//		}
+//		for _, call := range calls {
+//			if err := s.AddToolResults(call.ID, run(call)...); err != nil {
+//				return err
+//			}
+//		}
+//	}
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/export"
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// DefaultMaxHops is the number of hops of a session created without WithMaxHops
+const DefaultMaxHops = 10
+
+// sessionStateVersion is the version of the encoding of a saved Session. It changes
+// whenever a field is renamed or removed.
+const sessionStateVersion = 1
+
+// ErrHopLimit is returned by Session.Next once the session used all its hops
+var ErrHopLimit = errors.New("agent: hop limit reached")
+
+// Option configures a Session
+type Option func(*Session)
+
+// WithMaxHops sets the number of times the prompt can be rendered again with the results
+// of tool calls. A limit of 0 or less leaves the number of hops unlimited.
+func WithMaxHops(n int) Option {
+	return func(s *Session) {
+		s.maxHops = n
+	}
+}
+
+// Session is a conversation with a model using tools. It is not safe for concurrent use.
+type Session struct {
+	opts     melody.RenderCmd3Options
+	maxHops  int
+	messages []melody.Message
+	// hops is the number of renders with the results of tool calls, and hopAt the number of
+	// messages at the last of them
+	hops  int
+	hopAt int
+	// pending are the IDs of the tool calls of the last turn without results
+	pending []string
+}
+
+// sessionState is the encoding of the state of a Session
+type sessionState struct {
+	Version  int              `json:"version"`
+	Messages []melody.Message `json:"messages"`
+	Hops     int              `json:"hops,omitempty"`
+	HopAt    int              `json:"hop_at,omitempty"`
+	Pending  []string         `json:"pending,omitempty"`
+}
+
+// NewSession returns a session rendering the prompts of opts, starting with the messages
+// of opts
+func NewSession(opts melody.RenderCmd3Options, options ...Option) *Session {
+	s := &Session{opts: opts, maxHops: DefaultMaxHops, messages: slices.Clone(opts.Messages)}
+	for _, o := range options {
+		o(s)
+	}
+	return s
+}
+
+// Messages returns the messages of the conversation
+func (s *Session) Messages() []melody.Message {
+	return slices.Clone(s.messages)
+}
+
+// Hops returns the number of times the prompt was rendered with the results of tool calls
+func (s *Session) Hops() int {
+	return s.hops
+}
+
+// Pending returns the IDs of the tool calls of the last turn that have no results yet
+func (s *Session) Pending() []string {
+	return slices.Clone(s.pending)
+}
+
+// AddUserMessage appends a user message with text to the conversation
+func (s *Session) AddUserMessage(text string) {
+	s.messages = append(s.messages, melody.Message{
+		Role:    melody.RoleUser,
+		Content: []melody.Content{{Type: melody.ContentText, Text: text}},
+	})
+	s.pending = nil
+}
+
+// Next returns the options rendering the prompt of the next turn of the model. It fails
+// if tool calls of the last turn have no results, and with ErrHopLimit if the prompt would
+// be rendered with tool results more times than the hop limit. Rendering the same tool
+// results again counts a single hop.
+func (s *Session) Next() (melody.RenderCmd3Options, error) {
+	if len(s.pending) > 0 {
+		return melody.RenderCmd3Options{}, fmt.Errorf("agent: no results for the tool calls %q", s.pending)
+	}
+	if n := len(s.messages); n > 0 && n != s.hopAt && s.messages[n-1].Role == melody.RoleTool {
+		if s.maxHops > 0 && s.hops >= s.maxHops {
+			return melody.RenderCmd3Options{}, ErrHopLimit
+		}
+		s.hops, s.hopAt = s.hops+1, n
+	}
+	opts := s.opts
+	opts.Messages = slices.Clone(s.messages)
+	return opts, nil
+}
+
+// AppendOutputs appends the turn of the model parsed into outputs to the conversation and
+// returns its tool calls, whose results must be added before the next turn. Tool calls
+// without an ID are given the ID "<turn>_<index>", turn being the index of the message of
+// the turn in the conversation, so that the IDs are unique in the session.
+func (s *Session) AppendOutputs(outputs []melody.FilterOutput) []melody.ToolCall {
+	turn := export.FromFilterOutputs(outputs)
+	msg := melody.Message{Role: melody.RoleChatbot, Citations: turn.Citations}
+	if turn.Reasoning != "" {
+		msg.Content = append(msg.Content, melody.Content{Type: melody.ContentThinking, Thinking: turn.Reasoning})
+	}
+	if turn.Text != "" {
+		msg.Content = append(msg.Content, melody.Content{Type: melody.ContentText, Text: turn.Text})
+	}
+	s.pending = nil
+	for i := range turn.ToolCalls {
+		tc := &turn.ToolCalls[i]
+		if tc.ID == "" {
+			tc.ID = fmt.Sprintf("%d_%d", len(s.messages), i)
+		}
+		s.pending = append(s.pending, tc.ID)
+	}
+	msg.ToolCalls = turn.ToolCalls
+	s.messages = append(s.messages, msg)
+	return slices.Clone(turn.ToolCalls)
+}
+
+// AddToolResults appends the results of the pending tool call with the given ID to the
+// conversation, one document per result
+func (s *Session) AddToolResults(id string, results ...orderedjson.Object) error {
+	i := slices.Index(s.pending, id)
+	if i < 0 {
+		return fmt.Errorf("agent: no pending tool call with ID %q", id)
+	}
+	s.pending = slices.Delete(s.pending, i, i+1)
+
+	msg := melody.Message{Role: melody.RoleTool, ToolCallID: id}
+	for _, r := range results {
+		msg.Content = append(msg.Content, melody.Content{Type: melody.ContentDocument, Document: r})
+	}
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// SaveState returns the state of the session: its messages, hops and pending tool calls.
+// A session created with RestoreSession from the state resumes the conversation, e.g. on
+// another instance of a service.
+func (s *Session) SaveState() ([]byte, error) {
+	return json.Marshal(sessionState{
+		Version:  sessionStateVersion,
+		Messages: s.messages,
+		Hops:     s.hops,
+		HopAt:    s.hopAt,
+		Pending:  s.pending,
+	})
+}
+
+// RestoreSession creates a session that resumes the conversation of a session saved with
+// SaveState. The options must be those of the saved session, the state only holds the
+// conversation; the messages of opts are ignored.
+func RestoreSession(state []byte, opts melody.RenderCmd3Options, options ...Option) (*Session, error) {
+	var st sessionState
+	if err := json.Unmarshal(state, &st); err != nil {
+		return nil, fmt.Errorf("invalid session state: %w", err)
+	}
+	if st.Version > sessionStateVersion {
+		return nil, fmt.Errorf("unsupported session state version %d, the latest is %d", st.Version, sessionStateVersion)
+	}
+	s := NewSession(opts, options...)
+	s.messages, s.hops, s.hopAt, s.pending = st.Messages, st.Hops, st.HopAt, st.Pending
+	return s, nil
+}
@@ -0,0 +1,162 @@
+package agent_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/agent"
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// parse returns the outputs of the cmd3 completion written in chunks
+func parse(t *testing.T, chunks ...string) []melody.FilterOutput {
+	t.Helper()
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions())
+	var outputs []melody.FilterOutput
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		outputs = append(outputs, out...)
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	return append(outputs, out...)
+}
+
+func weatherCall(t *testing.T) []melody.FilterOutput {
+	t.Helper()
+	return parse(t,
+		"<|START_THINKING|>", "I will check the weather.", "<|END_THINKING|>",
+		"<|START_ACTION|>", `[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome"}}]`, "<|END_ACTION|>",
+	)
+}
+
+func weatherResult() orderedjson.Object {
+	return orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{Key: "forecast", Value: "sunny"}))
+}
+
+func newSession(options ...agent.Option) *agent.Session {
+	return agent.NewSession(melody.RenderCmd3Options{
+		Messages: []melody.Message{{
+			Role:    melody.RoleUser,
+			Content: []melody.Content{{Type: melody.ContentText, Text: "What is the weather in Rome?"}},
+		}},
+		AvailableTools: []melody.Tool{{Name: "get_weather", Description: "Gets the weather"}},
+	}, options...)
+}
+
+func TestSession_Loop(t *testing.T) {
+	t.Parallel()
+
+	s := newSession()
+	opts, err := s.Next()
+	require.NoError(t, err)
+	require.Len(t, opts.Messages, 1)
+	require.Len(t, opts.AvailableTools, 1)
+
+	calls := s.AppendOutputs(weatherCall(t))
+	require.Equal(t, []melody.ToolCall{{ID: "0", Name: "get_weather", Parameters: `{"city": "Rome"}`}}, calls)
+	require.Equal(t, []string{"0"}, s.Pending())
+	_, err = s.Next()
+	require.ErrorContains(t, err, "no results")
+	require.ErrorContains(t, s.AddToolResults("1", weatherResult()), "no pending tool call")
+	require.NoError(t, s.AddToolResults("0", weatherResult()))
+
+	opts, err = s.Next()
+	require.NoError(t, err)
+	require.Equal(t, 1, s.Hops())
+	require.Len(t, opts.Messages, 3)
+	require.Equal(t, melody.Message{
+		Role:      melody.RoleChatbot,
+		Content:   []melody.Content{{Type: melody.ContentThinking, Thinking: "I will check the weather."}},
+		ToolCalls: calls,
+	}, opts.Messages[1])
+	require.Equal(t, melody.Message{
+		Role:       melody.RoleTool,
+		ToolCallID: "0",
+		Content:    []melody.Content{{Type: melody.ContentDocument, Document: weatherResult()}},
+	}, opts.Messages[2])
+	_, err = melody.RenderCMD3(opts)
+	require.NoError(t, err)
+
+	calls = s.AppendOutputs(parse(t, "<|START_RESPONSE|>", "It is sunny.", "<|END_RESPONSE|>"))
+	require.Empty(t, calls)
+	require.Empty(t, s.Pending())
+	require.Equal(t, []melody.Content{{Type: melody.ContentText, Text: "It is sunny."}}, s.Messages()[3].Content)
+}
+
+func TestSession_HopLimit(t *testing.T) {
+	t.Parallel()
+
+	s := newSession(agent.WithMaxHops(1))
+	for hop := range 3 {
+		_, err := s.Next()
+		if hop == 2 {
+			require.ErrorIs(t, err, agent.ErrHopLimit)
+			break
+		}
+		require.NoError(t, err)
+		s.AppendOutputs(weatherCall(t))
+		require.NoError(t, s.AddToolResults("0", weatherResult()))
+	}
+}
+
+func TestSession_SaveState(t *testing.T) {
+	t.Parallel()
+
+	s := newSession()
+	_, err := s.Next()
+	require.NoError(t, err)
+	s.AppendOutputs(weatherCall(t))
+
+	state, err := s.SaveState()
+	require.NoError(t, err)
+	restored, err := agent.RestoreSession(state, melody.RenderCmd3Options{})
+	require.NoError(t, err)
+	require.Equal(t, s.Messages(), restored.Messages())
+	require.Equal(t, []string{"0"}, restored.Pending())
+
+	require.NoError(t, restored.AddToolResults("0", weatherResult()))
+	_, err = restored.Next()
+	require.NoError(t, err)
+	require.Equal(t, 1, restored.Hops())
+
+	_, err = agent.RestoreSession([]byte(`{"version": 99}`), melody.RenderCmd3Options{})
+	require.ErrorContains(t, err, "unsupported session state version 99")
+}
+
+func TestSession_NextRepeated(t *testing.T) {
+	t.Parallel()
+
+	s := newSession(agent.WithMaxHops(1))
+	_, err := s.Next()
+	require.NoError(t, err)
+	s.AppendOutputs(weatherCall(t))
+	require.NoError(t, s.AddToolResults("0", weatherResult()))
+
+	// A retried render of the same tool results is not another hop
+	for range 3 {
+		_, err = s.Next()
+		require.NoError(t, err)
+		require.Equal(t, 1, s.Hops())
+	}
+}
+
+func TestSession_ToolCallIDs(t *testing.T) {
+	t.Parallel()
+
+	call := func() []melody.FilterOutput {
+		return parse(t, "<|START_ACTION|>", `[{"tool_call_id": "", "tool_name": "get_weather", "parameters": {"city": "Rome"}}]`, "<|END_ACTION|>")
+	}
+	s := newSession()
+	calls := s.AppendOutputs(call())
+	require.Len(t, calls, 1)
+	require.Equal(t, "1_0", calls[0].ID)
+	require.NoError(t, s.AddToolResults("1_0", weatherResult()))
+
+	calls = s.AppendOutputs(call())
+	require.Len(t, calls, 1)
+	require.Equal(t, "3_0", calls[0].ID)
+}
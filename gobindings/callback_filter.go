@@ -0,0 +1,88 @@
+package gobindings
+
+// CallbackFilter is a filter that passes its outputs to a callback rather than returning
+// them. The callback runs synchronously on the goroutine writing to the filter, before the
+// write returns, so serving paths can forward every output without a channel between the
+// parser and the writer of the response. Like SyncFilter it is not safe for concurrent use.
+type CallbackFilter struct {
+	filter   Filter
+	onOutput func(FilterOutput)
+}
+
+// NewCallbackFilter creates a filter with the options of NewFilter that calls onOutput for
+// every output, in order. It returns nil when NewFilter would.
+func NewCallbackFilter(onOutput func(FilterOutput), options ...FilterOption) *CallbackFilter {
+	f := NewFilter(options...)
+	if f == nil {
+		return nil
+	}
+	return &CallbackFilter{filter: f, onOutput: onOutput}
+}
+
+// WriteDecoded writes a decoded token string to the filter
+func (c *CallbackFilter) WriteDecoded(decodedToken string, logprob *TokenIDsWithLogProb) error {
+	return c.emit(c.filter.WriteDecoded(decodedToken, logprob))
+}
+
+// WriteDecodedBatch writes several decoded token strings to the filter at once
+func (c *CallbackFilter) WriteDecodedBatch(decodedTokens []string, logprobs []TokenIDsWithLogProb) error {
+	return c.emit(c.filter.WriteDecodedBatch(decodedTokens, logprobs))
+}
+
+// WriteToken writes a token ID to the filter, decoded by the tokenizer set with WithTokenizer
+func (c *CallbackFilter) WriteToken(id uint32, logprob *float32) error {
+	return c.emit(c.filter.WriteToken(id, logprob))
+}
+
+// FlushPartials flushes any partial outputs
+func (c *CallbackFilter) FlushPartials() error {
+	return c.emit(c.filter.FlushPartials())
+}
+
+// SaveState returns the parsing state of the filter, see RestoreFilter
+func (c *CallbackFilter) SaveState() ([]byte, error) {
+	return c.filter.SaveState()
+}
+
+// Rollback rewinds the filter to its state before the last n tokens written, see
+// WithRollbackWindow
+func (c *CallbackFilter) Rollback(n int) error {
+	return c.filter.Rollback(n)
+}
+
+// RequestSoftStop asks the filter to end the stream at the next sentence boundary, see
+// SyncFilter.RequestSoftStop
+func (c *CallbackFilter) RequestSoftStop() {
+	c.filter.RequestSoftStop()
+}
+
+// Resume marks a retry of the upstream stream, see SyncFilter.Resume
+func (c *CallbackFilter) Resume() {
+	c.filter.Resume()
+}
+
+// CurrentMode returns the mode the filter parses the next text in, see
+// SyncFilter.CurrentMode
+func (c *CallbackFilter) CurrentMode() FilterMode {
+	return c.filter.CurrentMode()
+}
+
+// Idle returns a channel closed once the timeout of WithIdleTimeout elapses after a write,
+// see SyncFilter.Idle
+func (c *CallbackFilter) Idle() <-chan struct{} {
+	return c.filter.Idle()
+}
+
+// CheckIdle fails the stream if the timeout of WithIdleTimeout elapsed since the last
+// write, see SyncFilter.CheckIdle
+func (c *CallbackFilter) CheckIdle() error {
+	return c.emit(c.filter.CheckIdle())
+}
+
+// emit passes the outputs of a write to the callback, including those returned with an error
+func (c *CallbackFilter) emit(outputs []FilterOutput, err error) error {
+	for _, o := range outputs {
+		c.onOutput(o)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package gobindings
+
+import "math"
+
+// citationLogprobs are the logprobs of the text of the response or of a thinking block of
+// the reasoning by span, see WithCitationConfidence. Its length and spans are in the
+// citation index unit.
+type citationLogprobs struct {
+	Reasoning bool          `json:"reasoning,omitempty"`
+	PlanIndex uint          `json:"plan_index,omitempty"`
+	Length    int           `json:"length"`
+	Spans     []logprobSpan `json:"spans,omitempty"`
+	// Pending are the logprobs of the outputs without text since the last span, counted
+	// with the next text
+	Pending []float32 `json:"pending,omitempty"`
+}
+
+// logprobSpan is a span [Start, End) of the text with the logprobs of the tokens written
+// with it
+type logprobSpan struct {
+	Start    int       `json:"start"`
+	End      int       `json:"end"`
+	Logprobs []float32 `json:"logprobs"`
+}
+
+// scoreCitations records the logprobs of the text of the outputs and sets the confidence
+// of their citations, see WithCitationConfidence. It reads the outputs before the output
+// transformer, whose citation indices count the text of the filter.
+func (f *SyncFilter) scoreCitations(outputs []FilterOutput) {
+	if f.citationConfidence == nil {
+		return
+	}
+	for i := range outputs {
+		o := &outputs[i]
+		if o.IsEcho {
+			continue
+		}
+		// The logprobs of an output with citations but no text are those of the end of the
+		// citation markup, they count with the citations
+		var markup []float32
+		switch {
+		case o.Text == "" && len(o.Citations) > 0:
+			markup = o.Logprobs.Logprobs
+		case o.Text != "" || len(o.Logprobs.Logprobs) > 0:
+			f.citationLogprobs(o.IsReasoning, o.PlanIndex).write(o.Text, o.Logprobs.Logprobs, f.citationIndexUnit)
+		}
+		for j := range o.Citations {
+			c := &o.Citations[j]
+			l := f.citationLogprobs(c.IsThinking, o.PlanIndex)
+			if confidence, ok := l.confidence(int(c.StartIndex), int(c.EndIndex), markup, *f.citationConfidence); ok {
+				c.Confidence = &confidence
+			}
+		}
+	}
+}
+
+// citationLogprobs returns the logprobs of the response or of a thinking block, the
+// response starting after the response prefix
+func (f *SyncFilter) citationLogprobs(reasoning bool, plan uint) *citationLogprobs {
+	if !reasoning {
+		plan = 0
+	}
+	for i := range f.citationLogprobsByText {
+		if l := &f.citationLogprobsByText[i]; l.Reasoning == reasoning && l.PlanIndex == plan {
+			return l
+		}
+	}
+	l := citationLogprobs{Reasoning: reasoning, PlanIndex: plan}
+	if !reasoning {
+		l.Length = textUnits(f.responsePrefix, f.citationIndexUnit)
+	}
+	f.citationLogprobsByText = append(f.citationLogprobsByText, l)
+	return &f.citationLogprobsByText[len(f.citationLogprobsByText)-1]
+}
+
+// write appends text and the logprobs written with it
+func (l *citationLogprobs) write(text string, logprobs []float32, unit CitationIndexUnit) {
+	if text == "" {
+		l.Pending = append(l.Pending, logprobs...)
+		return
+	}
+	start := l.Length
+	l.Length += textUnits(text, unit)
+	logprobs = append(l.Pending, logprobs...)
+	l.Pending = nil
+	if len(logprobs) > 0 {
+		l.Spans = append(l.Spans, logprobSpan{Start: start, End: l.Length, Logprobs: logprobs})
+	}
+}
+
+// confidence aggregates the logprobs of the spans overlapping [start, end) and extra into
+// a probability. It reports false if there are none.
+func (l *citationLogprobs) confidence(start, end int, extra []float32, agg CitationConfidence) (float64, bool) {
+	n, sum, least := 0, 0.0, math.Inf(1)
+	add := func(logprobs []float32) {
+		for _, lp := range logprobs {
+			n++
+			sum += float64(lp)
+			least = min(least, float64(lp))
+		}
+	}
+	for _, s := range l.Spans {
+		if s.Start < end && s.End > start {
+			add(s.Logprobs)
+		}
+	}
+	add(extra)
+	if n == 0 {
+		return 0, false
+	}
+	if agg == CitationConfidenceMin {
+		return math.Exp(least), true
+	}
+	return math.Exp(sum / float64(n)), true
+}
@@ -0,0 +1,133 @@
+package gobindings
+
+import (
+	"fmt"
+	"slices"
+	"unicode/utf16"
+)
+
+// emittedText is the text the filter emitted in the response or in a thinking block of the
+// reasoning, whose citation indices it checks, see WithCitationValidation
+type emittedText struct {
+	Reasoning bool   `json:"reasoning,omitempty"`
+	PlanIndex uint   `json:"plan_index,omitempty"`
+	Text      string `json:"text"`
+}
+
+// validateCitations checks that the indices of the citations of the outputs slice the text
+// emitted so far to the text of the citation, see WithCitationValidation. The invalid
+// citations are dropped from their output and reported by an output following it. It
+// reads the outputs after the output transformer, as they are emitted.
+func (f *SyncFilter) validateCitations(outputs []FilterOutput) []FilterOutput {
+	if !f.citationValidation {
+		return outputs
+	}
+	for i := 0; i < len(outputs); i++ {
+		o := &outputs[i]
+		if o.IsEcho {
+			continue
+		}
+		if o.Text != "" {
+			t := f.emittedText(o.IsReasoning, o.PlanIndex)
+			t.Text += o.Text
+		}
+		var invalid []InvalidCitation
+		o.Citations = slices.DeleteFunc(o.Citations, func(c FilterCitation) bool {
+			reason := f.emittedText(c.IsThinking, o.PlanIndex).check(c, f.citationIndexUnit)
+			if reason == "" {
+				return false
+			}
+			f.logger.Warn("dropped a citation with invalid indices",
+				Field{Key: "text", Value: c.Text}, Field{Key: "reason", Value: reason})
+			invalid = append(invalid, InvalidCitation{Citation: c, Reason: reason})
+			return true
+		})
+		if len(o.Citations) == 0 {
+			o.Citations = nil
+		}
+		if len(invalid) > 0 {
+			outputs = slices.Insert(outputs, i+1, FilterOutput{InvalidCitations: invalid})
+			i++
+		}
+	}
+	return outputs
+}
+
+// emittedText returns the text of the response or of a thinking block, the response
+// starting with the response prefix
+func (f *SyncFilter) emittedText(reasoning bool, plan uint) *emittedText {
+	if !reasoning {
+		plan = 0
+	}
+	for i := range f.emitted {
+		if t := &f.emitted[i]; t.Reasoning == reasoning && t.PlanIndex == plan {
+			return t
+		}
+	}
+	t := emittedText{Reasoning: reasoning, PlanIndex: plan}
+	if !reasoning {
+		t.Text = f.responsePrefix
+	}
+	f.emitted = append(f.emitted, t)
+	return &f.emitted[len(f.emitted)-1]
+}
+
+// check returns why the indices of c do not slice the text to the text of c, or "" if they
+// do. Indices in graphemes are only checked against the length of the text, at most its
+// number of runes.
+func (t *emittedText) check(c FilterCitation, unit CitationIndexUnit) string {
+	start, end := int(c.StartIndex), int(c.EndIndex)
+	if unit == CitationIndexGraphemes {
+		if n := textUnits(t.Text, unit); start > end || end > n {
+			return fmt.Sprintf("indices [%d, %d) are out of the %d graphemes of the text", start, end, n)
+		}
+		return ""
+	}
+	text, ok := sliceUnits(t.Text, start, end, unit)
+	switch {
+	case !ok:
+		return fmt.Sprintf("indices [%d, %d) are out of the %d units of the text", start, end, textUnits(t.Text, unit))
+	case text != c.Text:
+		return fmt.Sprintf("indices [%d, %d) slice %q from the text", start, end, text)
+	}
+	return ""
+}
+
+// sliceUnits returns s[start:end] with the indices in the citation index unit. It reports
+// false if they are out of s, not ordered, or split a character.
+func sliceUnits(s string, start, end int, unit CitationIndexUnit) (string, bool) {
+	if start > end {
+		return "", false
+	}
+	if unit == CitationIndexBytes {
+		if end > len(s) {
+			return "", false
+		}
+		return s[start:end], true
+	}
+	startByte, endByte, n := -1, -1, 0
+	for i, r := range s {
+		if n == start {
+			startByte = i
+		}
+		if n == end {
+			endByte = i
+			break
+		}
+		if unit == CitationIndexUTF16 {
+			n += utf16.RuneLen(r)
+		} else {
+			n++
+		}
+	}
+	if endByte < 0 && n == end {
+		endByte = len(s)
+		if n == start {
+			startByte = len(s)
+		}
+	}
+	if startByte < 0 || endByte < 0 {
+		return "", false
+	}
+	return s[startByte:endByte], true
+}
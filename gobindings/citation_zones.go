@@ -0,0 +1,238 @@
+package gobindings
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ZoneKind is a kind of markdown span citations are not emitted in, see
+// WithCitationExclusionZones
+type ZoneKind int
+
+const (
+	// ZoneCodeFence is a fenced code block, from its opening fence line to its closing one
+	ZoneCodeFence ZoneKind = iota
+	// ZoneInlineCode is a code span between backticks, which ends with its line
+	ZoneInlineCode
+	// ZoneMath is LaTeX math between $ or \( \), which ends with its line, or between $$ or
+	// \[ \], which may span lines. A $ followed by a space or a digit does not start math,
+	// so amounts of money are not math.
+	ZoneMath
+)
+
+// zoneSpan is a zone of a text, [Start, End) in citation index units
+type zoneSpan struct {
+	Kind  ZoneKind `json:"kind"`
+	Start int      `json:"start"`
+	End   int      `json:"end"`
+}
+
+// zoneTracker follows the zones of the text of the response or of a thinking block of the
+// reasoning, see WithCitationExclusionZones
+type zoneTracker struct {
+	Reasoning bool `json:"reasoning,omitempty"`
+	PlanIndex uint `json:"plan_index,omitempty"`
+	// Line is the start of the line being written, and LineStart its index
+	Line      string `json:"line,omitempty"`
+	LineStart int    `json:"line_start,omitempty"`
+	// Open is the zone open at the start of Line, if Close, the delimiter ending it, is set
+	Open  zoneSpan `json:"open"`
+	Close string   `json:"close,omitempty"`
+	// Spans are the zones ended before Line
+	Spans []zoneSpan `json:"spans,omitempty"`
+}
+
+// clone returns a copy of t that reads on independently
+func (t zoneTracker) clone() zoneTracker {
+	// The spans are only appended to, a clipped slice keeps those read so far
+	t.Spans = slices.Clip(t.Spans)
+	return t
+}
+
+// write reads text
+func (t *zoneTracker) write(text string, unit CitationIndexUnit) {
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		line := t.Line + text[:i+1]
+		t.readLine(line, unit)
+		t.LineStart += textUnits(line, unit)
+		t.Line, text = "", text[i+1:]
+	}
+	t.Line += text
+}
+
+// zones returns the zones of the text read, the zone open at its end ending at math.MaxInt.
+// The line being written is read as if it ended there.
+func (t *zoneTracker) zones(unit CitationIndexUnit) []zoneSpan {
+	s := t.clone()
+	if s.Line != "" {
+		s.readLine(s.Line, unit)
+	}
+	if s.Close != "" {
+		open := s.Open
+		open.End = math.MaxInt
+		s.Spans = append(s.Spans, open)
+	}
+	return s.Spans
+}
+
+// readLine reads a line starting at t.LineStart, complete if it ends with a newline
+func (t *zoneTracker) readLine(line string, unit CitationIndexUnit) {
+	pos := t.LineStart
+	if t.Close != "" && t.Open.Kind == ZoneCodeFence {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) >= len(t.Close) && strings.Trim(trimmed, t.Close[:1]) == "" {
+			t.end(pos + textUnits(line, unit))
+		}
+		return
+	}
+	if t.Close == "" {
+		if m := markdownFence.FindStringSubmatch(line); m != nil {
+			t.Open, t.Close = zoneSpan{Kind: ZoneCodeFence, Start: pos}, m[1]
+			return
+		}
+	}
+
+	for i := 0; i < len(line); {
+		rest := line[i:]
+		_, n := utf8.DecodeRuneInString(rest)
+		var open ZoneKind
+		var delim string
+		ends := false
+		switch {
+		case t.Close != "" && t.Open.Kind == ZoneInlineCode:
+			// Code spans end at a run of as many backticks, and have no escapes
+			if rest[0] == '`' {
+				n = backtickRun(rest)
+				ends = rest[:n] == t.Close
+			}
+		case t.Close != "":
+			switch {
+			case strings.HasPrefix(rest, t.Close) && (t.Close != "$" || closesMath(line, i)):
+				n, ends = len(t.Close), true
+			case rest[0] == '\\' && len(rest) > 1:
+				_, m := utf8.DecodeRuneInString(rest[1:])
+				n = 1 + m
+			}
+		case rest[0] == '`':
+			n = backtickRun(rest)
+			open, delim = ZoneInlineCode, rest[:n]
+		case strings.HasPrefix(rest, "$$"):
+			n, open, delim = 2, ZoneMath, "$$"
+		case rest[0] == '$' && opensMath(rest):
+			open, delim = ZoneMath, "$"
+		case strings.HasPrefix(rest, `\(`):
+			n, open, delim = 2, ZoneMath, `\)`
+		case strings.HasPrefix(rest, `\[`):
+			n, open, delim = 2, ZoneMath, `\]`
+		case rest[0] == '\\' && len(rest) > 1:
+			_, m := utf8.DecodeRuneInString(rest[1:])
+			n = 1 + m
+		}
+		if delim != "" {
+			t.Open, t.Close = zoneSpan{Kind: open, Start: pos}, delim
+		}
+		pos += textUnits(rest[:n], unit)
+		if ends {
+			t.end(pos)
+		}
+		i += n
+	}
+
+	// Inline zones end with their line
+	if strings.HasSuffix(line, "\n") && t.Close != "" && t.Close != "$$" && t.Close != `\]` {
+		t.end(pos)
+	}
+}
+
+// end ends the open zone at end
+func (t *zoneTracker) end(end int) {
+	span := t.Open
+	span.End = end
+	t.Spans = append(t.Spans, span)
+	t.Open, t.Close = zoneSpan{}, ""
+}
+
+// backtickRun returns the number of backticks s starts with
+func backtickRun(s string) int {
+	n := 0
+	for n < len(s) && s[n] == '`' {
+		n++
+	}
+	return n
+}
+
+// opensMath reports whether the $ s starts with opens inline math: it is followed by
+// neither a space nor a digit
+func opensMath(s string) bool {
+	return len(s) > 1 && !strings.ContainsRune(" \t\n", rune(s[1])) && (s[1] < '0' || s[1] > '9')
+}
+
+// closesMath reports whether the $ at line[i] closes inline math: it follows a character
+// other than a space and is not followed by a digit
+func closesMath(line string, i int) bool {
+	if i == 0 || strings.ContainsRune(" \t", rune(line[i-1])) {
+		return false
+	}
+	return i+1 >= len(line) || line[i+1] < '0' || line[i+1] > '9'
+}
+
+// excludeCitations drops the citations starting or ending inside a zone of the kinds of
+// WithCitationExclusionZones, whose tags the filter has stripped from the text
+func (f *SyncFilter) excludeCitations(outputs []FilterOutput) {
+	if len(f.citationExclusionZones) == 0 {
+		return
+	}
+	for i := range outputs {
+		o := &outputs[i]
+		if o.IsEcho {
+			continue
+		}
+		if o.Text != "" {
+			f.zoneTracker(o.IsReasoning, o.PlanIndex).write(o.Text, f.citationIndexUnit)
+		}
+		if len(o.Citations) == 0 {
+			continue
+		}
+		o.Citations = slices.DeleteFunc(o.Citations, func(c FilterCitation) bool {
+			for _, z := range f.zoneTracker(c.IsThinking, o.PlanIndex).zones(f.citationIndexUnit) {
+				if !slices.Contains(f.citationExclusionZones, z.Kind) {
+					continue
+				}
+				start, end := int(c.StartIndex), int(c.EndIndex)
+				if (z.Start < start && start < z.End) || (z.Start < end && end < z.End) {
+					f.logger.Debug("dropped a citation in an excluded zone", Field{Key: "text", Value: c.Text})
+					return true
+				}
+			}
+			return false
+		})
+		if len(o.Citations) == 0 {
+			o.Citations = nil
+		}
+	}
+}
+
+// zoneTracker returns the tracker of the zones of the response or of a thinking block, the
+// response starting with the response prefix
+func (f *SyncFilter) zoneTracker(reasoning bool, plan uint) *zoneTracker {
+	if !reasoning {
+		plan = 0
+	}
+	for i := range f.zones {
+		if t := &f.zones[i]; t.Reasoning == reasoning && t.PlanIndex == plan {
+			return t
+		}
+	}
+	t := zoneTracker{Reasoning: reasoning, PlanIndex: plan}
+	if !reasoning {
+		t.write(f.responsePrefix, f.citationIndexUnit)
+	}
+	f.zones = append(f.zones, t)
+	return &f.zones[len(f.zones)-1]
+}
@@ -0,0 +1,293 @@
+// Package conformance runs a shared corpus of filter cases against the melody filter
+// bindings and reports where the outputs diverge from the expected outputs.
+//
+// The corpus lives in the testdata directory of this package. Each case is a directory
+// containing an input.json (filter options and decoded chunks) and an output.json (the
+// expected filter outputs). The same corpus is run against the Rust filter by its unit
+// tests, so any drift between the implementations shows up as a failing case on one side.
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+// Input is the filter configuration and token stream for a single case
+type Input struct {
+	// Options are the names of the filter options to apply, e.g. "cmd3"
+	Options        []string `json:"options"`
+	InclusiveStops []string `json:"inclusive_stops,omitempty"`
+	ExclusiveStops []string `json:"exclusive_stops,omitempty"`
+	// Chunks are the decoded token strings written to the filter, in order
+	Chunks []string `json:"chunks"`
+}
+
+// Case is a single conformance case loaded from the corpus
+type Case struct {
+	Name  string
+	Input Input
+	Want  []Output
+}
+
+// Output is the language-neutral form of a melody.FilterOutput. Logprobs are not
+// compared since the corpus is written as decoded text rather than token ids.
+type Output struct {
+	Text          string         `json:"text,omitempty"`
+	SearchQuery   *SearchQuery   `json:"search_query,omitempty"`
+	Citations     []Citation     `json:"citations,omitempty"`
+	ToolCallDelta *ToolCallDelta `json:"tool_call_delta,omitempty"`
+	IsPostAnswer  bool           `json:"is_post_answer,omitempty"`
+	IsReasoning   bool           `json:"is_reasoning,omitempty"`
+	PlanIndex     uint           `json:"plan_index,omitempty"`
+	// RelevantDocIndices and CitedDocIndices are empty rather than nil for a line of "None"
+	RelevantDocIndices []uint `json:"relevant_doc_indices,omitzero"`
+	CitedDocIndices    []uint `json:"cited_doc_indices,omitzero"`
+}
+
+// SearchQuery is the language-neutral form of a melody.FilterSearchQueryDelta
+type SearchQuery struct {
+	Index uint   `json:"index"`
+	Text  string `json:"text"`
+}
+
+// ToolCallDelta is the language-neutral form of a melody.FilterToolCallDelta
+type ToolCallDelta struct {
+	Index         uint           `json:"index"`
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	ParamDelta    *ToolParameter `json:"param_delta,omitempty"`
+	RawParamDelta string         `json:"raw_param_delta"`
+}
+
+// ToolParameter is the language-neutral form of a melody.FilterToolParameter
+type ToolParameter struct {
+	Name       string `json:"name"`
+	ValueDelta string `json:"value_delta"`
+}
+
+// Citation is the language-neutral form of a melody.FilterCitation
+type Citation struct {
+	StartIndex uint     `json:"start_index"`
+	EndIndex   uint     `json:"end_index"`
+	Text       string   `json:"text"`
+	Sources    []Source `json:"sources"`
+	IsThinking bool     `json:"is_thinking"`
+}
+
+// Source is a melody.Source, whose JSON form is already language-neutral
+type Source = melody.Source
+
+// Divergence describes an output that differs from the expected output of a case.
+// Got or Want is nil when one side produced fewer outputs than the other.
+type Divergence struct {
+	Case  string
+	Index int
+	Got   *Output
+	Want  *Output
+}
+
+func (d Divergence) String() string {
+	got, _ := json.Marshal(d.Got)
+	want, _ := json.Marshal(d.Want)
+	return fmt.Sprintf("%s: output %d: got %s, want %s", d.Case, d.Index, got, want)
+}
+
+// Load reads every case in the corpus directory dir
+func Load(dir string) ([]Case, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []Case
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		c, err := LoadCase(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// LoadCase reads a single case from its directory
+func LoadCase(dir string) (Case, error) {
+	c := Case{Name: filepath.Base(dir)}
+
+	input, err := os.ReadFile(filepath.Join(dir, "input.json"))
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(input, &c.Input); err != nil {
+		return c, fmt.Errorf("%s: invalid input.json: %w", c.Name, err)
+	}
+
+	output, err := os.ReadFile(filepath.Join(dir, "output.json"))
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(output, &c.Want); err != nil {
+		return c, fmt.Errorf("%s: invalid output.json: %w", c.Name, err)
+	}
+
+	return c, nil
+}
+
+// FilterOptions converts the option names of the input to melody filter options
+func (in Input) FilterOptions() ([]melody.FilterOption, error) {
+	var opts []melody.FilterOption
+	for _, name := range in.Options {
+		opt, ok := namedOptions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter option %q", name)
+		}
+		opts = append(opts, opt())
+	}
+	if len(in.InclusiveStops) > 0 {
+		opts = append(opts, melody.WithInclusiveStops(in.InclusiveStops))
+	}
+	if len(in.ExclusiveStops) > 0 {
+		opts = append(opts, melody.WithExclusiveStops(in.ExclusiveStops))
+	}
+	return opts, nil
+}
+
+var namedOptions = map[string]func() melody.FilterOption{
+	"cmd3":                       melody.HandleMultiHopCmd3,
+	"cmd4":                       melody.HandleMultiHopCmd4,
+	"rag":                        melody.HandleRAG,
+	"search_query":               melody.HandleSearchQuery,
+	"multi_hop":                  melody.HandleMultiHop,
+	"llama3_chat":                melody.HandleLlama3Chat,
+	"stream_tool_actions":        melody.StreamToolActions,
+	"stream_non_grounded_answer": melody.StreamNonGroundedAnswer,
+	"stream_processed_params":    melody.StreamProcessedParams,
+	"stream_document_selections": melody.StreamDocumentSelections,
+	"citation_merging":           melody.WithCitationMerging,
+	"left_trimmed":               melody.WithLeftTrimmed,
+	"right_trimmed":              melody.WithRightTrimmed,
+}
+
+// Execute runs the input through a new filter and returns its outputs
+func Execute(in Input) ([]Output, error) {
+	opts, err := in.FilterOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := melody.TryNewFilter(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []melody.FilterOutput
+	for _, chunk := range in.Chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, out...)
+	}
+	out, err := f.FlushPartials()
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, out...)
+
+	res := make([]Output, len(outputs))
+	for i, o := range outputs {
+		res[i] = FromFilterOutput(o)
+	}
+	return res, nil
+}
+
+// Compare returns a divergence for every output of got that differs from the case
+func Compare(c Case, got []Output) []Divergence {
+	var divs []Divergence
+	for i := 0; i < max(len(got), len(c.Want)); i++ {
+		d := Divergence{Case: c.Name, Index: i}
+		if i < len(got) {
+			d.Got = &got[i]
+		}
+		if i < len(c.Want) {
+			d.Want = &c.Want[i]
+		}
+		if d.Got == nil || d.Want == nil || !reflect.DeepEqual(*d.Got, *d.Want) {
+			divs = append(divs, d)
+		}
+	}
+	return divs
+}
+
+// Run executes a case and returns its divergences
+func Run(c Case) ([]Divergence, error) {
+	got, err := Execute(c.Input)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Name, err)
+	}
+	return Compare(c, got), nil
+}
+
+// FromFilterOutput converts a melody.FilterOutput to its language-neutral form
+func FromFilterOutput(o melody.FilterOutput) Output {
+	out := Output{
+		Text:               o.Text,
+		IsPostAnswer:       o.IsPostAnswer,
+		IsReasoning:        o.IsReasoning,
+		PlanIndex:          o.PlanIndex,
+		RelevantDocIndices: o.RelevantDocIndices,
+		CitedDocIndices:    o.CitedDocIndices,
+	}
+
+	if o.SearchQuery != nil {
+		out.SearchQuery = &SearchQuery{
+			Index: o.SearchQuery.Index,
+			Text:  o.SearchQuery.Text,
+		}
+	}
+
+	for _, c := range o.Citations {
+		cit := Citation{
+			StartIndex: c.StartIndex,
+			EndIndex:   c.EndIndex,
+			Text:       c.Text,
+			Sources:    []Source{},
+			IsThinking: c.IsThinking,
+		}
+		for _, s := range c.Sources {
+			src := Source{
+				ToolCallIndex:     s.ToolCallIndex,
+				ToolResultIndices: []uint{},
+				SourceName:        s.SourceName,
+			}
+			src.ToolResultIndices = append(src.ToolResultIndices, s.ToolResultIndices...)
+			cit.Sources = append(cit.Sources, src)
+		}
+		out.Citations = append(out.Citations, cit)
+	}
+
+	if o.ToolCallDelta != nil {
+		out.ToolCallDelta = &ToolCallDelta{
+			Index:         o.ToolCallDelta.Index,
+			ID:            o.ToolCallDelta.ID,
+			Name:          o.ToolCallDelta.Name,
+			RawParamDelta: o.ToolCallDelta.RawParamDelta,
+		}
+		if o.ToolCallDelta.ParamDelta != nil {
+			out.ToolCallDelta.ParamDelta = &ToolParameter{
+				Name:       o.ToolCallDelta.ParamDelta.Name,
+				ValueDelta: o.ToolCallDelta.ParamDelta.ValueDelta,
+			}
+		}
+	}
+
+	return out
+}
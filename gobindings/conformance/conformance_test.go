@@ -0,0 +1,79 @@
+package conformance
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "regenerate output.json for every corpus case")
+
+// corpusDir is the directory of the corpus, relative to the package the tests run in
+const corpusDir = "testdata"
+
+func TestConformance_Corpus(t *testing.T) {
+	t.Parallel()
+
+	dir := corpusDir
+	if *update {
+		updateCorpus(t, dir)
+	}
+
+	cases, err := Load(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, cases)
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			divs, err := Run(c)
+			require.NoError(t, err)
+			for _, d := range divs {
+				t.Error(d.String())
+			}
+		})
+	}
+}
+
+func TestConformance_Compare(t *testing.T) {
+	t.Parallel()
+
+	c := Case{
+		Name: "compare",
+		Want: []Output{{Text: "foo"}, {Text: "bar"}},
+	}
+	require.Empty(t, Compare(c, []Output{{Text: "foo"}, {Text: "bar"}}))
+
+	divs := Compare(c, []Output{{Text: "foo"}, {Text: "baz"}, {Text: "qux"}})
+	require.Len(t, divs, 2)
+	require.Equal(t, 1, divs[0].Index)
+	require.Equal(t, "baz", divs[0].Got.Text)
+	require.Equal(t, "bar", divs[0].Want.Text)
+	require.Equal(t, 2, divs[1].Index)
+	require.Nil(t, divs[1].Want)
+}
+
+// updateCorpus rewrites the expected outputs of the corpus from the current filter
+func updateCorpus(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name(), "input.json"))
+		require.NoError(t, err)
+		var in Input
+		require.NoError(t, json.Unmarshal(raw, &in))
+		got, err := Execute(in)
+		require.NoError(t, err)
+		out, err := json.MarshalIndent(got, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, entry.Name(), "output.json"), append(out, '\n'), 0o644))
+	}
+}
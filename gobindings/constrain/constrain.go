@@ -0,0 +1,212 @@
+// Package constrain computes the tokens a model may generate next so that its output
+// matches a JSON schema, for sampling engines that support token masks.
+//
+// A Grammar is built once from a schema, or from the tools of a request, and a tokenizer.
+// Every generation then starts its own State, asks for the AllowedTokens before sampling
+// and Accepts the sampled token:
+//
+//	g, err := constrain.New(schema, tokenizer, constrain.WithEOSTokens(eos))
+//	state := g.Start()
+//	for !state.Finished() {
+//		token := sample(logits, g.AllowedTokens(state))
+//		if err := g.Accept(state, token); err != nil {
+//			return err
+//		}
+//	}
+//
+// The output is compact JSON: no whitespace is allowed between tokens, and the properties
+// of an object appear in the order of the schema, optional ones may be left out. Properties
+// of schemas nested in arrays, e.g. in anyOf, are sorted by name since their order is lost
+// when they are decoded. Tokens are matched by the text they decode to on their own.
+package constrain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// Option configures a Grammar
+type Option func(*Grammar)
+
+// WithEOSTokens sets the tokens that end a generation, they are allowed once the output is
+// a complete value
+func WithEOSTokens(ids ...int64) Option {
+	return func(g *Grammar) {
+		g.eos = append(g.eos, ids...)
+	}
+}
+
+// Grammar is a compiled schema with the vocabulary of a tokenizer. It is safe for
+// concurrent use, each generation has its own State.
+type Grammar struct {
+	root   *node
+	eos    []int64
+	tokens []string
+	vocab  *trieNode
+}
+
+// State is the position of a generation in a Grammar
+type State struct {
+	// stacks are the positions the output so far may be at
+	stacks   []stack
+	finished bool
+}
+
+// Finished reports whether an EOS token was accepted
+func (s *State) Finished() bool {
+	return s.finished
+}
+
+// New builds the Grammar of a JSON schema
+func New(schema []byte, decoder melody.TokenDecoder, opts ...Option) (*Grammar, error) {
+	obj := orderedjson.New()
+	if err := obj.UnmarshalJSON(schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	root, err := compile(obj)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return newGrammar(root, decoder, opts), nil
+}
+
+// NewForTools builds the Grammar of a list of tool calls to the tools, in the JSON format
+// of Command 3 and 4 actions: [{"tool_call_id": "0", "tool_name": "...", "parameters": {...}}]
+// where the parameters match the schema of the named tool.
+func NewForTools(tools []melody.Tool, decoder melody.TokenDecoder, opts ...Option) (*Grammar, error) {
+	if len(tools) == 0 {
+		return nil, errors.New("no tools")
+	}
+	call := &node{kind: kindAnyOf}
+	for _, t := range tools {
+		params := anyNode
+		if t.Parameters.Len() > 0 {
+			var err error
+			if params, err = compile(t.Parameters); err != nil {
+				return nil, fmt.Errorf("tool %q: %w", t.Name, err)
+			}
+		}
+		name, err := literalNode([]any{t.Name})
+		if err != nil {
+			return nil, err
+		}
+		call.anyOf = append(call.anyOf, &node{kind: kindObject, props: []property{
+			{key: []byte(`"tool_call_id"`), value: stringNode, required: true},
+			{key: []byte(`"tool_name"`), value: name, required: true},
+			{key: []byte(`"parameters"`), value: params, required: true},
+		}})
+	}
+	return newGrammar(&node{kind: kindArray, items: call}, decoder, opts), nil
+}
+
+func newGrammar(root *node, decoder melody.TokenDecoder, opts []Option) *Grammar {
+	g := &Grammar{root: root, vocab: &trieNode{}}
+	for _, opt := range opts {
+		opt(g)
+	}
+	size := decoder.VocabSize()
+	g.tokens = make([]string, size)
+	for id := range size {
+		// Special tokens decode to nothing and are never allowed
+		text := decoder.Decode([]uint32{id}, true)
+		g.tokens[id] = text
+		if text != "" {
+			g.vocab.insert(text, int64(id))
+		}
+	}
+	return g
+}
+
+// Start returns the State of a new generation
+func (g *Grammar) Start() *State {
+	return &State{stacks: []stack{{{n: g.root}}}}
+}
+
+// AllowedTokens returns the sorted tokens that may be generated next in s
+func (g *Grammar) AllowedTokens(s *State) []int64 {
+	if s.finished {
+		return nil
+	}
+	var allowed []int64
+	var walk func(t *trieNode, stacks []stack)
+	walk = func(t *trieNode, stacks []stack) {
+		for _, c := range t.children {
+			next := feed(stacks, c.b)
+			if len(next) == 0 {
+				continue
+			}
+			allowed = append(allowed, c.node.tokens...)
+			walk(c.node, next)
+		}
+	}
+	walk(g.vocab, s.stacks)
+	if canEnd(s.stacks) {
+		allowed = append(allowed, g.eos...)
+	}
+	slices.Sort(allowed)
+	return allowed
+}
+
+// Accept advances s past a generated token. It fails if the token is not allowed, leaving
+// s unchanged.
+func (g *Grammar) Accept(s *State, token int64) error {
+	if s.finished {
+		return fmt.Errorf("token %d after the end of the generation", token)
+	}
+	if slices.Contains(g.eos, token) {
+		if !canEnd(s.stacks) {
+			return errors.New("end of generation before the output is complete")
+		}
+		s.finished = true
+		return nil
+	}
+	if token < 0 || token >= int64(len(g.tokens)) || g.tokens[token] == "" {
+		return fmt.Errorf("token %d is not allowed", token)
+	}
+
+	stacks := s.stacks
+	text := g.tokens[token]
+	for i := range len(text) {
+		if stacks = feed(stacks, text[i]); len(stacks) == 0 {
+			return fmt.Errorf("token %d (%q) is not allowed", token, text)
+		}
+	}
+	s.stacks = stacks
+	return nil
+}
+
+func canEnd(stacks []stack) bool {
+	return slices.ContainsFunc(stacks, stack.canEnd)
+}
+
+// trieNode is a node of the trie of the vocabulary, so the tokens sharing a prefix are
+// matched together
+type trieNode struct {
+	children []trieEdge
+	// tokens are the tokens whose text ends at this node
+	tokens []int64
+}
+
+type trieEdge struct {
+	b    byte
+	node *trieNode
+}
+
+func (t *trieNode) insert(text string, id int64) {
+	cur := t
+	for i := range len(text) {
+		b := text[i]
+		idx, found := slices.BinarySearchFunc(cur.children, b, func(e trieEdge, b byte) int {
+			return int(e.b) - int(b)
+		})
+		if !found {
+			cur.children = slices.Insert(cur.children, idx, trieEdge{b: b, node: &trieNode{}})
+		}
+		cur = cur.children[idx].node
+	}
+	cur.tokens = append(cur.tokens, id)
+}
@@ -0,0 +1,145 @@
+package constrain
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// vocab is a tokenizer whose token i decodes to vocab[i], empty tokens are special
+type vocab []string
+
+func (v vocab) Decode(ids []uint32, skipSpecialTokens bool) string {
+	var s string
+	for _, id := range ids {
+		s += v[id]
+	}
+	return s
+}
+
+func (v vocab) VocabSize() uint32 { return uint32(len(v)) }
+
+func (v vocab) ids(tokens ...string) []int64 {
+	var ids []int64
+	for _, t := range tokens {
+		ids = append(ids, int64(slices.Index(v, t)))
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+var testVocab = vocab{
+	"", "{", "}", "[", "]", ",", ":", `"`, `"city`, `"Rome"`, `":`, `"days"`, `"units"`, "Rome", ` `,
+	"1", "2", "0", ".", "5", "-", "true", "null", `\`, "n", `"C"`, `"F"`, `"K"`, `{"`,
+}
+
+// generate accepts the tokens and returns the tokens allowed after each of them
+func generate(t *testing.T, g *Grammar, tokens ...string) *State {
+	t.Helper()
+	state := g.Start()
+	for _, tok := range tokens {
+		id := int64(slices.Index(testVocab, tok))
+		require.Contains(t, g.AllowedTokens(state), id, "token %q", tok)
+		require.NoError(t, g.Accept(state, id), "token %q", tok)
+	}
+	return state
+}
+
+func TestGrammar_Schema(t *testing.T) {
+	t.Parallel()
+
+	schema := `{
+		"type": "object",
+		"properties": {
+			"city": {"type": "string"},
+			"days": {"type": "integer"},
+			"units": {"enum": ["C", "F"]}
+		},
+		"required": ["city", "units"]
+	}`
+	g, err := New([]byte(schema), testVocab, WithEOSTokens(0))
+	require.NoError(t, err)
+
+	state := g.Start()
+	require.Equal(t, testVocab.ids("{", `{"`), g.AllowedTokens(state))
+
+	// city is required so it must come first
+	state = generate(t, g, `{"`)
+	require.Empty(t, g.AllowedTokens(state))
+
+	state = generate(t, g, "{", `"city`, `":`, `"`, "Rome", `\`, "n", `"`, ",")
+	// days is optional, units is required
+	require.Equal(t, testVocab.ids(`"`, `"days"`, `"units"`), g.AllowedTokens(state))
+
+	state = generate(t, g, "{", `"city`, `":`, `"`, "Rome", `"`, ",", `"days"`, ":", "1", "2")
+	require.Equal(t, testVocab.ids("1", "2", "0", "5", ","), g.AllowedTokens(state))
+	require.Error(t, g.Accept(state, testVocab.ids(".")[0]))
+
+	state = generate(t, g, "{", `"city`, `":`, `"`, "Rome", `"`, ",", `"units"`, ":")
+	require.Equal(t, testVocab.ids(`"`, `"C"`, `"F"`), g.AllowedTokens(state))
+	state = generate(t, g, "{", `"city`, `":`, `"`, "Rome", `"`, ",", `"units"`, ":", `"F"`)
+	require.Equal(t, testVocab.ids("}"), g.AllowedTokens(state))
+
+	state = generate(t, g, "{", `"city`, `":`, `"`, "Rome", `"`, ",", `"units"`, ":", `"F"`, "}")
+	require.Equal(t, []int64{0}, g.AllowedTokens(state))
+	require.NoError(t, g.Accept(state, 0))
+	require.True(t, state.Finished())
+	require.Empty(t, g.AllowedTokens(state))
+}
+
+func TestGrammar_Numbers(t *testing.T) {
+	t.Parallel()
+
+	g, err := New([]byte(`{"type": "number"}`), testVocab, WithEOSTokens(0))
+	require.NoError(t, err)
+
+	require.Equal(t, testVocab.ids("1", "2", "0", "5", "-"), g.AllowedTokens(g.Start()))
+	// A number may end at the end of input but not after a dot
+	require.Equal(t, testVocab.ids("", ".", "0", "1", "2", "5"), g.AllowedTokens(generate(t, g, "-", "1")))
+	require.Equal(t, testVocab.ids("1", "2", "0", "5"), g.AllowedTokens(generate(t, g, "0", ".")))
+	require.Equal(t, testVocab.ids("", "."), g.AllowedTokens(generate(t, g, "0")))
+}
+
+func TestGrammar_Tools(t *testing.T) {
+	t.Parallel()
+
+	tools := []melody.Tool{{
+		Name: "Rome",
+		Parameters: orderedjson.New(orderedjson.WithInitialData(
+			orderedjson.Pair{Key: "type", Value: "object"},
+			orderedjson.Pair{Key: "properties", Value: orderedjson.New(orderedjson.WithInitialData(
+				orderedjson.Pair{Key: "days", Value: map[string]any{"type": "array", "items": map[string]any{"type": "integer"}}},
+			))},
+		)),
+	}}
+	vocab := append(slices.Clone(testVocab), `"tool_call_id"`, `"tool_name"`, `"parameters"`)
+	g, err := NewForTools(tools, vocab, WithEOSTokens(0))
+	require.NoError(t, err)
+
+	state := g.Start()
+	for _, tok := range []string{"[", "{", `"tool_call_id"`, ":", `"`, "0", `"`, ",", `"tool_name"`, ":", `"`, "Rome", `"`, ",", `"parameters"`, ":", "{", `"days"`, ":", "[", "1", ",", "2", "]", "}", "}", "]"} {
+		id := int64(slices.Index(vocab, tok))
+		require.Contains(t, g.AllowedTokens(state), id, "token %q", tok)
+		require.NoError(t, g.Accept(state, id), "token %q", tok)
+	}
+	require.NoError(t, g.Accept(state, 0))
+
+	_, err = NewForTools(nil, vocab)
+	require.Error(t, err)
+}
+
+func TestGrammar_AnyValue(t *testing.T) {
+	t.Parallel()
+
+	g, err := New([]byte(`{}`), testVocab, WithEOSTokens(0))
+	require.NoError(t, err)
+	state := generate(t, g, "[", "true", ",", "null", ",", "{", `"`, "Rome", `"`, ":", "[", "]", "}", "]")
+	require.NoError(t, g.Accept(state, 0))
+
+	// Whitespace is never allowed
+	require.NotContains(t, g.AllowedTokens(g.Start()), testVocab.ids(" ")[0])
+}
@@ -0,0 +1,353 @@
+package constrain
+
+// phase is the position of a frame in the value it matches
+type phase int
+
+const (
+	phaseStart phase = iota
+	phaseInLiteral
+	phaseInString
+	phaseEscape
+	// phaseUnicode reads the hex digits of a \u escape, off counts them
+	phaseUnicode
+	// phaseNumber reads a number, i holds its numState
+	phaseNumber
+	// phaseKeyOrClose is after the '{' of an object, phaseKey after a ','
+	phaseKeyOrClose
+	phaseKey
+	// phaseInKey reads the key of property i, off is the offset in it. In a free object
+	// the key is read by a child string frame.
+	phaseInKey
+	phaseColon
+	// phaseValue waits for the value of an object or the item of an array to be read by a
+	// child frame
+	phaseValue
+	phaseCommaOrClose
+	// phaseItemOrClose is after the '[' of an array, phaseItem after a ','
+	phaseItemOrClose
+	phaseItem
+)
+
+// numState is the state of the number being read
+type numState int
+
+const (
+	numMinus numState = iota
+	numZero
+	numInt
+	numDot
+	numFrac
+	numExp
+	numExpSign
+	numExpDigits
+)
+
+// frame is the position in a node of the schema
+type frame struct {
+	n     *node
+	phase phase
+	// i is the literal, the property or the numState, off the offset in a literal or key
+	i, off int
+	// next is the index of the first property of an object that may still appear
+	next int
+}
+
+// stack is the path of frames from the root to the innermost value being read, an empty
+// stack is a complete value. Stacks are never modified, every step copies them.
+type stack []frame
+
+func (st stack) with(f frame) stack {
+	res := make(stack, len(st))
+	copy(res, st)
+	res[len(res)-1] = f
+	return res
+}
+
+func (st stack) push(parent, child frame) stack {
+	res := make(stack, len(st), len(st)+1)
+	copy(res, st)
+	res[len(res)-1] = parent
+	return append(res, child)
+}
+
+// pop returns the stack after the value of the top frame is complete
+func (st stack) pop() stack {
+	res := make(stack, len(st)-1)
+	copy(res, st)
+	if len(res) == 0 {
+		return res
+	}
+	parent := &res[len(res)-1]
+	switch parent.phase {
+	case phaseInKey:
+		parent.phase = phaseColon
+	case phaseValue:
+		parent.phase = phaseCommaOrClose
+	}
+	return res
+}
+
+// canEnd reports whether the stack is a complete value, numbers end at the end of input
+func (st stack) canEnd() bool {
+	for len(st) > 0 {
+		top := st[len(st)-1]
+		if top.phase != phaseNumber || !numAccepting(numState(top.i)) {
+			return false
+		}
+		st = st.pop()
+	}
+	return true
+}
+
+// step feeds b to st and appends every resulting stack to out
+func step(st stack, b byte, out []stack) []stack {
+	if len(st) == 0 {
+		return out
+	}
+	top := st[len(st)-1]
+	n := top.n
+
+	switch top.phase {
+	case phaseStart:
+		return start(st, top, b, out)
+
+	case phaseInLiteral:
+		lit := n.literals[top.i]
+		if lit[top.off] != b {
+			return out
+		}
+		top.off++
+		if top.off == len(lit) {
+			return append(out, st.with(top).pop())
+		}
+		return append(out, st.with(top))
+
+	case phaseInString:
+		switch {
+		case b == '"':
+			return append(out, st.pop())
+		case b == '\\':
+			top.phase = phaseEscape
+			return append(out, st.with(top))
+		case b < 0x20:
+			return out
+		}
+		return append(out, st)
+
+	case phaseEscape:
+		switch b {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			top.phase = phaseInString
+		case 'u':
+			top.phase, top.off = phaseUnicode, 0
+		default:
+			return out
+		}
+		return append(out, st.with(top))
+
+	case phaseUnicode:
+		if !isHex(b) {
+			return out
+		}
+		top.off++
+		if top.off == 4 {
+			top.phase = phaseInString
+		}
+		return append(out, st.with(top))
+
+	case phaseNumber:
+		state := numState(top.i)
+		if next, ok := numNext(state, b, n.kind == kindInteger); ok {
+			top.i = int(next)
+			out = append(out, st.with(top))
+		}
+		// A complete number ends at the first byte that is not part of it
+		if numAccepting(state) {
+			out = step(st.pop(), b, out)
+		}
+		return out
+
+	case phaseKeyOrClose, phaseKey:
+		if b == '}' && top.phase == phaseKeyOrClose && canClose(top) {
+			return append(out, st.pop())
+		}
+		if b != '"' {
+			return out
+		}
+		if len(n.props) == 0 {
+			top.phase = phaseInKey
+			return append(out, st.push(top, frame{n: stringNode, phase: phaseInString}))
+		}
+		for j := top.next; j < len(n.props); j++ {
+			f := top
+			f.phase, f.i, f.off = phaseInKey, j, 1
+			out = append(out, st.with(f))
+			if n.props[j].required {
+				break
+			}
+		}
+		return out
+
+	case phaseInKey:
+		key := n.props[top.i].key
+		if key[top.off] != b {
+			return out
+		}
+		top.off++
+		if top.off == len(key) {
+			top.phase, top.next = phaseColon, top.i+1
+		}
+		return append(out, st.with(top))
+
+	case phaseColon:
+		if b != ':' {
+			return out
+		}
+		value := anyNode
+		if len(n.props) > 0 {
+			value = n.props[top.i].value
+		}
+		top.phase = phaseValue
+		return append(out, st.push(top, frame{n: value}))
+
+	case phaseCommaOrClose:
+		switch {
+		case b == ',' && n.kind == kindArray:
+			top.phase = phaseItem
+			return append(out, st.with(top))
+		case b == ',' && (len(n.props) == 0 || top.next < len(n.props)):
+			top.phase = phaseKey
+			return append(out, st.with(top))
+		case b == ']' && n.kind == kindArray:
+			return append(out, st.pop())
+		case b == '}' && n.kind == kindObject && canClose(top):
+			return append(out, st.pop())
+		}
+		return out
+
+	case phaseItemOrClose, phaseItem:
+		if b == ']' && top.phase == phaseItemOrClose {
+			return append(out, st.pop())
+		}
+		top.phase = phaseValue
+		return step(st.push(top, frame{n: n.items}), b, out)
+	}
+	return out
+}
+
+// start feeds the first byte of the value of top
+func start(st stack, top frame, b byte, out []stack) []stack {
+	n := top.n
+	switch n.kind {
+	case kindAnyOf:
+		for _, alt := range n.anyOf {
+			out = step(st.with(frame{n: alt}), b, out)
+		}
+	case kindLiteral:
+		for i, lit := range n.literals {
+			if lit[0] != b {
+				continue
+			}
+			f := frame{n: n, phase: phaseInLiteral, i: i, off: 1}
+			if len(lit) == 1 {
+				out = append(out, st.with(f).pop())
+			} else {
+				out = append(out, st.with(f))
+			}
+		}
+	case kindString:
+		if b == '"' {
+			out = append(out, st.with(frame{n: n, phase: phaseInString}))
+		}
+	case kindNumber, kindInteger:
+		var state numState
+		switch {
+		case b == '-':
+			state = numMinus
+		case b == '0':
+			state = numZero
+		case b >= '1' && b <= '9':
+			state = numInt
+		default:
+			return out
+		}
+		out = append(out, st.with(frame{n: n, phase: phaseNumber, i: int(state)}))
+	case kindObject:
+		if b == '{' {
+			out = append(out, st.with(frame{n: n, phase: phaseKeyOrClose}))
+		}
+	case kindArray:
+		if b == '[' {
+			out = append(out, st.with(frame{n: n, phase: phaseItemOrClose}))
+		}
+	}
+	return out
+}
+
+// canClose reports whether an object may end, i.e. it has no required property left
+func canClose(f frame) bool {
+	for _, p := range f.n.props[f.next:] {
+		if p.required {
+			return false
+		}
+	}
+	return true
+}
+
+func numNext(s numState, b byte, integer bool) (numState, bool) {
+	digit := b >= '0' && b <= '9'
+	switch s {
+	case numMinus:
+		switch {
+		case b == '0':
+			return numZero, true
+		case digit:
+			return numInt, true
+		}
+	case numZero, numInt:
+		switch {
+		case digit && s == numInt:
+			return numInt, true
+		case b == '.' && !integer:
+			return numDot, true
+		case (b == 'e' || b == 'E') && !integer:
+			return numExp, true
+		}
+	case numDot, numFrac:
+		switch {
+		case digit:
+			return numFrac, true
+		case (b == 'e' || b == 'E') && s == numFrac:
+			return numExp, true
+		}
+	case numExp:
+		switch {
+		case b == '+' || b == '-':
+			return numExpSign, true
+		case digit:
+			return numExpDigits, true
+		}
+	case numExpSign, numExpDigits:
+		if digit {
+			return numExpDigits, true
+		}
+	}
+	return s, false
+}
+
+func numAccepting(s numState) bool {
+	return s == numZero || s == numInt || s == numFrac || s == numExpDigits
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+// feed feeds b to every stack
+func feed(stacks []stack, b byte) []stack {
+	var out []stack
+	for _, st := range stacks {
+		out = step(st, b, out)
+	}
+	return out
+}
@@ -0,0 +1,257 @@
+package constrain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// kind is the kind of JSON value a node matches
+type kind int
+
+const (
+	kindAnyOf kind = iota
+	kindLiteral
+	kindString
+	kindNumber
+	kindInteger
+	kindObject
+	kindArray
+)
+
+type property struct {
+	// key is the JSON encoding of the name, quotes included
+	key      []byte
+	value    *node
+	required bool
+}
+
+// node is a compiled JSON schema
+type node struct {
+	kind  kind
+	anyOf []*node
+	// literals are the JSON encodings of the values of an enum or const
+	literals [][]byte
+	// props are the properties of an object in the order they must appear in. An object
+	// without properties is free: it accepts any keys with values of any type.
+	props []property
+	items *node
+}
+
+var (
+	stringNode = &node{kind: kindString}
+	// anyNode matches any JSON value
+	anyNode = newAnyNode()
+)
+
+func newAnyNode() *node {
+	n := &node{kind: kindAnyOf}
+	n.anyOf = []*node{
+		{kind: kindObject},
+		{kind: kindArray, items: n},
+		stringNode,
+		{kind: kindNumber},
+		{kind: kindLiteral, literals: [][]byte{[]byte("true"), []byte("false"), []byte("null")}},
+	}
+	return n
+}
+
+// schemaObject is a JSON schema object, decoded either as an orderedjson.Object or, for
+// schemas nested in arrays, as a map
+type schemaObject interface {
+	Get(key string) (any, bool)
+	Keys() []string
+}
+
+type mapObject map[string]any
+
+func (m mapObject) Get(key string) (any, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+// Keys returns the keys sorted, the order of a map is lost
+func (m mapObject) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func asSchemaObject(v any) (schemaObject, bool) {
+	switch o := v.(type) {
+	case orderedjson.Object:
+		return &o, true
+	case *orderedjson.Object:
+		return o, true
+	case map[string]any:
+		return mapObject(o), true
+	}
+	return nil, false
+}
+
+// compile compiles a JSON schema. The supported keywords are type, properties, required,
+// items, enum, const, anyOf and oneOf, others are ignored.
+func compile(v any) (*node, error) {
+	if b, ok := v.(bool); ok {
+		if !b {
+			return nil, errors.New("schema false matches no value")
+		}
+		return anyNode, nil
+	}
+	s, ok := asSchemaObject(v)
+	if !ok {
+		return nil, fmt.Errorf("schema must be an object, got %T", v)
+	}
+
+	if c, ok := s.Get("const"); ok {
+		return literalNode([]any{c})
+	}
+	if e, ok := s.Get("enum"); ok {
+		values, ok := e.([]any)
+		if !ok || len(values) == 0 {
+			return nil, errors.New("enum must be a non-empty array")
+		}
+		return literalNode(values)
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if alts, ok := s.Get(keyword); ok {
+			schemas, ok := alts.([]any)
+			if !ok || len(schemas) == 0 {
+				return nil, fmt.Errorf("%s must be a non-empty array", keyword)
+			}
+			n := &node{kind: kindAnyOf}
+			for _, alt := range schemas {
+				c, err := compile(alt)
+				if err != nil {
+					return nil, err
+				}
+				n.anyOf = append(n.anyOf, c)
+			}
+			return n, nil
+		}
+	}
+
+	t, ok := s.Get("type")
+	if !ok {
+		return anyNode, nil
+	}
+	switch types := t.(type) {
+	case string:
+		return typeNode(types, s)
+	case []any:
+		n := &node{kind: kindAnyOf}
+		for _, typ := range types {
+			name, ok := typ.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid type %v", typ)
+			}
+			c, err := typeNode(name, s)
+			if err != nil {
+				return nil, err
+			}
+			n.anyOf = append(n.anyOf, c)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid type %v", t)
+}
+
+func literalNode(values []any) (*node, error) {
+	n := &node{kind: kindLiteral}
+	for _, v := range values {
+		b, err := marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		n.literals = append(n.literals, b)
+	}
+	return n, nil
+}
+
+// marshal encodes v as compact JSON without escaping HTML characters
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+func typeNode(name string, s schemaObject) (*node, error) {
+	switch name {
+	case "string":
+		return stringNode, nil
+	case "number":
+		return &node{kind: kindNumber}, nil
+	case "integer":
+		return &node{kind: kindInteger}, nil
+	case "boolean":
+		return &node{kind: kindLiteral, literals: [][]byte{[]byte("true"), []byte("false")}}, nil
+	case "null":
+		return &node{kind: kindLiteral, literals: [][]byte{[]byte("null")}}, nil
+	case "array":
+		n := &node{kind: kindArray, items: anyNode}
+		if items, ok := s.Get("items"); ok {
+			c, err := compile(items)
+			if err != nil {
+				return nil, fmt.Errorf("items: %w", err)
+			}
+			n.items = c
+		}
+		return n, nil
+	case "object":
+		return objectNode(s)
+	}
+	return nil, fmt.Errorf("unknown type %q", name)
+}
+
+func objectNode(s schemaObject) (*node, error) {
+	n := &node{kind: kindObject}
+	p, ok := s.Get("properties")
+	if !ok {
+		return n, nil
+	}
+	props, ok := asSchemaObject(p)
+	if !ok {
+		return nil, errors.New("properties must be an object")
+	}
+
+	required := map[string]bool{}
+	if r, ok := s.Get("required"); ok {
+		switch names := r.(type) {
+		case []string:
+			for _, name := range names {
+				required[name] = true
+			}
+		case []any:
+			for _, name := range names {
+				if name, ok := name.(string); ok {
+					required[name] = true
+				}
+			}
+		}
+	}
+
+	for _, name := range props.Keys() {
+		v, _ := props.Get(name)
+		c, err := compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", name, err)
+		}
+		key, err := marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		n.props = append(n.props, property{key: key, value: c, required: required[name]})
+	}
+	return n, nil
+}
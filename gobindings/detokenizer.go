@@ -0,0 +1,91 @@
+package gobindings
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenDecoder decodes token ids into text. It is satisfied by *tokenizers.Tokenizer.
+type TokenDecoder interface {
+	Decode(tokenIDs []uint32, skipSpecialTokens bool) string
+	VocabSize() uint32
+}
+
+// maxHeldTokens is the number of tokens held back waiting for the rest of a UTF-8
+// sequence before they are emitted anyway, a UTF-8 sequence is at most 4 bytes
+const maxHeldTokens = 4
+
+// Detokenizer turns a stream of token ids into clean UTF-8 text deltas, without any of
+// the parsing of a Filter. Tokens that decode to an incomplete UTF-8 sequence are held
+// back until the sequence is complete, and special tokens are stripped unless
+// WithSpecialTokensKept is given.
+//
+// Every delta is decoded together with the tokens before it, so tokenizers whose
+// decoding of a token depends on the previous ones, e.g. to drop a leading space, produce
+// the same text as decoding all the tokens at once.
+type Detokenizer struct {
+	decoder           TokenDecoder
+	skipSpecialTokens bool
+
+	ids []uint32
+	// prefixOffset is the start of the tokens decoded to compute the next delta,
+	// readOffset is the end of the tokens whose text has been returned
+	prefixOffset int
+	readOffset   int
+}
+
+// DetokenizerOption configures a Detokenizer
+type DetokenizerOption func(*Detokenizer)
+
+// WithSpecialTokensKept keeps the text of special tokens in the deltas
+func WithSpecialTokensKept() DetokenizerOption {
+	return func(d *Detokenizer) {
+		d.skipSpecialTokens = false
+	}
+}
+
+// NewDetokenizer creates a Detokenizer decoding tokens with decoder
+func NewDetokenizer(decoder TokenDecoder, options ...DetokenizerOption) *Detokenizer {
+	d := &Detokenizer{decoder: decoder, skipSpecialTokens: true}
+	for _, opt := range options {
+		opt(d)
+	}
+	return d
+}
+
+// Write adds a token and returns the text it completes, which is empty while the token
+// is held back. It returns an error if the token id is not in the vocabulary.
+func (d *Detokenizer) Write(tokenID uint32) (string, error) {
+	if tokenID >= d.decoder.VocabSize() {
+		return "", fmt.Errorf("token id %d is out of the vocabulary of size %d", tokenID, d.decoder.VocabSize())
+	}
+	d.ids = append(d.ids, tokenID)
+
+	prefix := d.decoder.Decode(d.ids[d.prefixOffset:d.readOffset], d.skipSpecialTokens)
+	text := d.decoder.Decode(d.ids[d.prefixOffset:], d.skipSpecialTokens)
+	incomplete := strings.HasSuffix(text, string(utf8.RuneError))
+	if len(text) <= len(prefix) || (incomplete && len(d.ids)-d.readOffset < maxHeldTokens) {
+		return "", nil
+	}
+	return d.advance(text[len(prefix):]), nil
+}
+
+// Flush returns the text of the tokens that are held back, with incomplete UTF-8
+// sequences replaced by U+FFFD, and resets the Detokenizer so it can be reused.
+func (d *Detokenizer) Flush() (string, error) {
+	prefix := d.decoder.Decode(d.ids[d.prefixOffset:d.readOffset], d.skipSpecialTokens)
+	text := d.decoder.Decode(d.ids[d.prefixOffset:], d.skipSpecialTokens)
+	d.ids, d.prefixOffset, d.readOffset = nil, 0, 0
+	if len(text) <= len(prefix) {
+		return "", nil
+	}
+	return strings.ToValidUTF8(text[len(prefix):], string(utf8.RuneError)), nil
+}
+
+// advance marks all tokens as read and drops the tokens that are no longer needed as context
+func (d *Detokenizer) advance(delta string) string {
+	d.ids = d.ids[d.readOffset:]
+	d.prefixOffset, d.readOffset = 0, len(d.ids)
+	return strings.ToValidUTF8(delta, string(utf8.RuneError))
+}
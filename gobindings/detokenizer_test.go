@@ -0,0 +1,64 @@
+package gobindings_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/tokenizers/tokenizertest"
+)
+
+func detokenize(t *testing.T, d *melody.Detokenizer, ids []uint32) []string {
+	t.Helper()
+	var deltas []string
+	for _, id := range ids {
+		delta, err := d.Write(id)
+		require.NoError(t, err)
+		deltas = append(deltas, delta)
+	}
+	delta, err := d.Flush()
+	require.NoError(t, err)
+	return append(deltas, delta)
+}
+
+func TestDetokenizer(t *testing.T) {
+	t.Parallel()
+	tk := tokenizertest.New()
+
+	ids, _ := tk.Encode("a🌈<|START_RESPONSE|>b", false)
+	deltas := detokenize(t, melody.NewDetokenizer(tk), ids)
+	// the rainbow is held back until its 4th byte and the special token is stripped
+	require.Equal(t, []string{"a", "", "", "", "🌈", "", "b", ""}, deltas)
+
+	deltas = detokenize(t, melody.NewDetokenizer(tk, melody.WithSpecialTokensKept()), ids)
+	require.Equal(t, "a🌈<|START_RESPONSE|>b", strings.Join(deltas, ""))
+}
+
+func TestDetokenizer_Flush(t *testing.T) {
+	t.Parallel()
+	tk := tokenizertest.New()
+	d := melody.NewDetokenizer(tk)
+
+	ids, _ := tk.Encode("🌈", false)
+	for _, id := range ids[:2] {
+		delta, err := d.Write(id)
+		require.NoError(t, err)
+		require.Empty(t, delta)
+	}
+	delta, err := d.Flush()
+	require.NoError(t, err)
+	require.Equal(t, "�", delta)
+
+	// the detokenizer is reset and can be reused
+	require.Equal(t, []string{"h", "i", ""}, detokenize(t, d, []uint32{'h', 'i'}))
+}
+
+func TestDetokenizer_UnknownToken(t *testing.T) {
+	t.Parallel()
+	tk := tokenizertest.New()
+
+	_, err := melody.NewDetokenizer(tk).Write(tk.VocabSize())
+	require.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package gobindings
+
+// #include "melody.h"
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DocumentSource is where a document numbered by a rendered prompt comes from
+type DocumentSource struct {
+	// ToolCallIndex and ToolResultIndex are the indices citation sources refer to the
+	// document by
+	ToolCallIndex   uint `json:"tool_call_index"`
+	ToolResultIndex uint `json:"tool_result_index"`
+	// ToolCallID is the ID of the tool call, empty for the documents of the render options
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// MessageIndex is the index of the tool message in the messages, nil for the documents
+	// of the render options
+	MessageIndex *int `json:"message_index,omitempty"`
+	// ContentIndex is the index of the document in the content of the tool message, or in
+	// the documents of the render options
+	ContentIndex int `json:"content_index"`
+}
+
+// DocumentIndexMap maps the documents numbered by a rendered prompt back to the messages
+// and documents they come from
+type DocumentIndexMap struct {
+	// Documents are the documents in the order they are rendered
+	Documents []DocumentSource `json:"documents"`
+}
+
+// NewDocumentIndexMap returns the DocumentIndexMap of a RenderCMD3 or RenderCMD4 prompt
+// rendered from messages and documentsLen documents, so citation sources can be resolved to
+// the tool outputs they cite without re-deriving the numbering of the template: documents
+// come first under tool call index 0, followed by the results of the tool calls in the
+// order the chatbot made them.
+func NewDocumentIndexMap(messages []Message, documentsLen int) (DocumentIndexMap, error) {
+	var a cAllocator
+	defer a.FreeAll()
+
+	cMsgs, cMsgsLen := buildCMessages(&a, messages)
+	res := C.melody_document_index_map(cMsgs, cMsgsLen, C.size_t(documentsLen))
+	if res == nil {
+		return DocumentIndexMap{}, errors.New("melody_document_index_map returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.error != nil {
+		return DocumentIndexMap{}, renderError(res)
+	}
+	if res.result == nil {
+		return DocumentIndexMap{}, errors.New("melody_document_index_map returned neither result nor error")
+	}
+	var m DocumentIndexMap
+	if err := json.Unmarshal([]byte(C.GoString(res.result)), &m); err != nil {
+		return DocumentIndexMap{}, fmt.Errorf("invalid document index map: %w", err)
+	}
+	return m, nil
+}
+
+// Lookup returns the source of the document at a tool call and tool result index
+func (m DocumentIndexMap) Lookup(toolCallIndex, toolResultIndex uint) (DocumentSource, bool) {
+	for _, d := range m.Documents {
+		if d.ToolCallIndex == toolCallIndex && d.ToolResultIndex == toolResultIndex {
+			return d, true
+		}
+	}
+	return DocumentSource{}, false
+}
+
+// Resolve returns the sources of the documents cited by sources, skipping indices that
+// are out of range
+func (m DocumentIndexMap) Resolve(sources []Source) []DocumentSource {
+	var res []DocumentSource
+	for _, s := range sources {
+		for _, idx := range s.ToolResultIndices {
+			if d, ok := m.Lookup(s.ToolCallIndex, idx); ok {
+				res = append(res, d)
+			}
+		}
+	}
+	return res
+}
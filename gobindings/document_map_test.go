@@ -0,0 +1,37 @@
+package gobindings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocumentIndexMap(t *testing.T) {
+	t.Parallel()
+
+	messages := []Message{
+		{Role: RoleUser, Content: []Content{{Type: ContentText, Text: "Weather?"}}},
+		{Role: RoleChatbot, ToolCalls: []ToolCall{{ID: "a", Name: "search", Parameters: "{}"}, {ID: "b", Name: "search", Parameters: "{}"}}},
+		{Role: RoleTool, ToolCallID: "b", Content: []Content{{Type: ContentText, Text: "sunny"}, {Type: ContentText, Text: "warm"}}},
+		{Role: RoleTool, ToolCallID: "a", Content: []Content{{Type: ContentText, Text: "rain"}}},
+	}
+	m, err := NewDocumentIndexMap(messages, 1)
+	require.NoError(t, err)
+
+	two, three := 2, 3
+	require.Equal(t, []DocumentSource{
+		{ToolCallIndex: 0, ToolResultIndex: 0, ContentIndex: 0},
+		{ToolCallIndex: 2, ToolResultIndex: 0, ToolCallID: "b", MessageIndex: &two, ContentIndex: 0},
+		{ToolCallIndex: 2, ToolResultIndex: 1, ToolCallID: "b", MessageIndex: &two, ContentIndex: 1},
+		{ToolCallIndex: 1, ToolResultIndex: 0, ToolCallID: "a", MessageIndex: &three, ContentIndex: 0},
+	}, m.Documents)
+
+	resolved := m.Resolve([]Source{{ToolCallIndex: 2, ToolResultIndices: []uint{1, 5}}, {ToolCallIndex: 1, ToolResultIndices: []uint{0}}})
+	require.Len(t, resolved, 2)
+	require.Equal(t, "b", resolved[0].ToolCallID)
+	require.Equal(t, 1, resolved[0].ContentIndex)
+	require.Equal(t, "a", resolved[1].ToolCallID)
+
+	_, err = NewDocumentIndexMap([]Message{{Role: RoleTool, Content: []Content{{Type: ContentText, Text: "x"}}}}, 0)
+	require.ErrorContains(t, err, "missing tool_call_id")
+}
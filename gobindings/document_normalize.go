@@ -0,0 +1,154 @@
+package gobindings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// DocumentNormalization configures NormalizeDocuments
+type DocumentNormalization struct {
+	// HashFields are the fields compared to find duplicate documents, all the fields but
+	// "id" when empty
+	HashFields []string `json:"hash_fields,omitempty"`
+}
+
+// NormalizedDocument is where a document passed to NormalizeDocuments ends up
+type NormalizedDocument struct {
+	// InputIndex is the index of the document in the input documents
+	InputIndex int `json:"input_index"`
+	// Index is the index of the document in the normalized documents, that of the first of
+	// its duplicates for a duplicate
+	Index int `json:"index"`
+	// InputID is the "id" of the input document, empty if it had none
+	InputID string `json:"input_id,omitempty"`
+	// ID is the "id" of the normalized document
+	ID        string `json:"id"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// DocumentNormalizationReport maps the documents passed to NormalizeDocuments to the
+// normalized documents
+type DocumentNormalizationReport struct {
+	// Documents are the input documents, in order
+	Documents []NormalizedDocument `json:"documents"`
+}
+
+// InputIndices returns the indices of the input documents normalized to the document at
+// index, e.g. to resolve the tool result indices of a citation to the input documents
+func (r DocumentNormalizationReport) InputIndices(index int) []int {
+	var indices []int
+	for _, d := range r.Documents {
+		if d.Index == index {
+			indices = append(indices, d.InputIndex)
+		}
+	}
+	return indices
+}
+
+// NormalizeDocuments returns the documents with an "id" each and without duplicates, so the
+// documents of a prompt can be told apart by their ID and citations never split between two
+// copies of a document. A document is a duplicate of an earlier one with the same values
+// of the hash fields of opts, whatever their order, and is dropped. A document without a
+// string "id", or with the "id" of an earlier document it is not a duplicate of, is
+// assigned an ID derived from its content, so it is the same in every request. The input
+// documents are not modified.
+func NormalizeDocuments(docs []orderedjson.Object, opts DocumentNormalization) ([]orderedjson.Object, DocumentNormalizationReport) {
+	var normalized []orderedjson.Object
+	report := DocumentNormalizationReport{Documents: make([]NormalizedDocument, len(docs))}
+	// firstByHash holds the input index of the first document of every content
+	firstByHash := make(map[string]int, len(docs))
+	ids := make(map[string]bool, len(docs))
+
+	for i, doc := range docs {
+		hash := documentHash(doc, opts.HashFields)
+		d := NormalizedDocument{InputIndex: i}
+		if id, ok := doc.Get("id"); ok {
+			d.InputID, _ = id.(string)
+		}
+
+		if first, ok := firstByHash[hash]; ok {
+			d.Index, d.ID, d.Duplicate = report.Documents[first].Index, report.Documents[first].ID, true
+			report.Documents[i] = d
+			continue
+		}
+		firstByHash[hash] = i
+
+		d.Index, d.ID = len(normalized), d.InputID
+		if d.ID == "" || ids[d.ID] {
+			d.ID = "doc_" + hash[:12]
+			for n := 2; ids[d.ID]; n++ {
+				d.ID = "doc_" + hash[:12] + "_" + strconv.Itoa(n)
+			}
+		}
+		ids[d.ID] = true
+		report.Documents[i] = d
+
+		// Copy the document, the copies of an Object share its fields
+		out := orderedjson.New()
+		if !doc.Contains("id") {
+			out.Set("id", d.ID)
+		}
+		for _, key := range doc.Keys() {
+			value, _ := doc.Get(key)
+			if key == "id" {
+				value = d.ID
+			}
+			out.Set(key, value)
+		}
+		normalized = append(normalized, out)
+	}
+	return normalized, report
+}
+
+// renderedDocuments returns the documents rendered with the options, normalized if
+// normalization is set, then ordered if order is set, and the report of the normalization
+func renderedDocuments(docs []orderedjson.Object, normalization *DocumentNormalization, order *DocumentOrder) ([]orderedjson.Object, *DocumentNormalizationReport) {
+	var report *DocumentNormalizationReport
+	if normalization != nil {
+		var r DocumentNormalizationReport
+		docs, r = NormalizeDocuments(docs, *normalization)
+		report = &r
+	}
+	if order != nil {
+		docs, _ = OrderDocuments(docs, *order)
+	}
+	return docs, report
+}
+
+// documentOrderOptions returns the filter options mapping the citations of a prompt
+// rendered with the options back to the documents before they were ordered
+func documentOrderOptions(docs []orderedjson.Object, normalization *DocumentNormalization, order *DocumentOrder) []FilterOption {
+	if order == nil {
+		return nil
+	}
+	if normalization != nil {
+		docs, _ = NormalizeDocuments(docs, *normalization)
+	}
+	_, indices := OrderDocuments(docs, *order)
+	return []FilterOption{WithDocumentOrder(indices)}
+}
+
+// documentHash returns the hex-encoded SHA-256 hash of the fields of doc compared to find
+// duplicates
+func documentHash(doc orderedjson.Object, fields []string) string {
+	values := doc.ToMap()
+	if len(fields) == 0 {
+		delete(values, "id")
+	} else {
+		selected := make(map[string]any, len(fields))
+		for _, f := range fields {
+			if v, ok := values[f]; ok {
+				selected[f] = v
+			}
+		}
+		values = selected
+	}
+	// Maps are encoded with sorted keys, so the order of the fields does not matter
+	b, _ := json.Marshal(values)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
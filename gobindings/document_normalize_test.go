@@ -0,0 +1,68 @@
+package gobindings
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+func TestNormalizeDocuments(t *testing.T) {
+	t.Parallel()
+
+	var docs []orderedjson.Object
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"title": "Sky", "id": "a", "text": "blue"},
+		{"text": "green", "title": "Grass"},
+		{"id": "b", "text": "blue", "title": "Sky"},
+		{"id": "a", "title": "Sea", "text": "blue"},
+		{"title": "Grass", "text": "green"}
+	]`), &docs))
+
+	normalized, report := NormalizeDocuments(docs, DocumentNormalization{})
+	got, err := json.Marshal(normalized)
+	require.NoError(t, err)
+	grassID := report.Documents[1].ID
+	seaID := report.Documents[3].ID
+	require.Regexp(t, `^doc_[0-9a-f]{12}$`, grassID)
+	require.Regexp(t, `^doc_[0-9a-f]{12}$`, seaID)
+	require.JSONEq(t, `[
+		{"title": "Sky", "id": "a", "text": "blue"},
+		{"id": "`+grassID+`", "text": "green", "title": "Grass"},
+		{"id": "`+seaID+`", "title": "Sea", "text": "blue"}
+	]`, string(got))
+	require.Equal(t, []NormalizedDocument{
+		{InputIndex: 0, Index: 0, InputID: "a", ID: "a"},
+		{InputIndex: 1, Index: 1, ID: grassID},
+		{InputIndex: 2, Index: 0, InputID: "b", ID: "a", Duplicate: true},
+		{InputIndex: 3, Index: 2, InputID: "a", ID: seaID},
+		{InputIndex: 4, Index: 1, ID: grassID, Duplicate: true},
+	}, report.Documents)
+	require.Equal(t, []int{1, 4}, report.InputIndices(1))
+
+	// The input is not modified and the IDs are stable
+	require.False(t, docs[1].Contains("id"))
+	_, again := NormalizeDocuments(docs[1:2], DocumentNormalization{})
+	require.Equal(t, grassID, again.Documents[0].ID)
+
+	// Only the hash fields are compared
+	normalized, report = NormalizeDocuments(docs, DocumentNormalization{HashFields: []string{"text"}})
+	require.Len(t, normalized, 2)
+	require.True(t, report.Documents[3].Duplicate)
+
+	// RenderCMD3 renders the normalized documents
+	opts := RenderCmd3Options{Documents: docs, NormalizeDocuments: &DocumentNormalization{}}
+	_, rendered, _ := opts.promptContext()
+	require.Len(t, rendered, 3)
+	_, renderReport, err := RenderCMD3WithReport(opts)
+	require.NoError(t, err)
+	require.NotNil(t, renderReport.Normalization)
+	require.Equal(t, []int{1, 4}, renderReport.Normalization.InputIndices(1))
+
+	// There is no normalization to report without NormalizeDocuments
+	_, renderReport, err = RenderCMD4WithReport(RenderCmd4Options{Documents: docs})
+	require.NoError(t, err)
+	require.Nil(t, renderReport.Normalization)
+}
@@ -0,0 +1,146 @@
+package gobindings
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// DocumentOrdering is the order OrderDocuments puts documents in
+type DocumentOrdering int
+
+const (
+	// DocumentOrderingOriginal keeps the documents in the order they are given
+	DocumentOrderingOriginal DocumentOrdering = iota
+	// DocumentOrderingByScoreDesc sorts the documents by decreasing relevance score, the
+	// documents without a score last
+	DocumentOrderingByScoreDesc
+	// DocumentOrderingRoundRobinBySource takes the first document of every source, then the
+	// second, and so on, so the documents of a source do not crowd out the others. The
+	// sources are in the order of their first document.
+	DocumentOrderingRoundRobinBySource
+)
+
+// DocumentOrder configures OrderDocuments
+type DocumentOrder struct {
+	Ordering DocumentOrdering `json:"ordering"`
+	// ScoreField is the numeric field of the relevance score of a document, "score" when
+	// empty
+	ScoreField string `json:"score_field,omitempty"`
+	// SourceField is the field of the source of a document, "source" when empty. The
+	// documents without one share a source.
+	SourceField string `json:"source_field,omitempty"`
+}
+
+// OrderDocuments returns the documents in the order of opts, with the index in docs of
+// each of them. The order is stable: documents with the same score, and the documents of a
+// source, keep the order they are given in. The indices map the citations of a prompt
+// rendered with the ordered documents back to docs, see WithDocumentOrder.
+func OrderDocuments(docs []orderedjson.Object, opts DocumentOrder) ([]orderedjson.Object, []int) {
+	indices := make([]int, len(docs))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	switch opts.Ordering {
+	case DocumentOrderingByScoreDesc:
+		field := cmp.Or(opts.ScoreField, "score")
+		scores := make([]float64, len(docs))
+		scored := make([]bool, len(docs))
+		for i, doc := range docs {
+			scores[i], scored[i] = documentScore(doc, field)
+		}
+		slices.SortStableFunc(indices, func(a, b int) int {
+			if scored[a] != scored[b] {
+				if scored[a] {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Compare(scores[b], scores[a])
+		})
+	case DocumentOrderingRoundRobinBySource:
+		field := cmp.Or(opts.SourceField, "source")
+		var sources []string
+		bySource := make(map[string][]int)
+		for i, doc := range docs {
+			var source string
+			if v, ok := doc.Get(field); ok {
+				source = fmt.Sprint(v)
+			}
+			if _, ok := bySource[source]; !ok {
+				sources = append(sources, source)
+			}
+			bySource[source] = append(bySource[source], i)
+		}
+		indices = indices[:0]
+		for round := 0; len(indices) < len(docs); round++ {
+			for _, source := range sources {
+				if round < len(bySource[source]) {
+					indices = append(indices, bySource[source][round])
+				}
+			}
+		}
+	}
+
+	ordered := make([]orderedjson.Object, len(indices))
+	for i, idx := range indices {
+		ordered[i] = docs[idx]
+	}
+	return ordered, indices
+}
+
+// documentScore returns the numeric value of the field of doc
+func documentScore(doc orderedjson.Object, field string) (float64, bool) {
+	v, ok := doc.Get(field)
+	if !ok {
+		return 0, false
+	}
+	switch s := v.(type) {
+	case float64:
+		return s, true
+	case float32:
+		return float64(s), true
+	case int:
+		return float64(s), true
+	case int64:
+		return float64(s), true
+	case json.Number:
+		f, err := s.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// remapDocumentIndices maps the indices of the citation sources of the documents of the
+// render options, which the prompt numbers as the results of tool call 0, from the order
+// they were rendered in to the order they were given in, see WithDocumentOrder
+func (f *SyncFilter) remapDocumentIndices(outputs []FilterOutput) {
+	if f.documentOrder == nil {
+		return
+	}
+	for i := range outputs {
+		for j := range outputs[i].Citations {
+			for k := range outputs[i].Citations[j].Sources {
+				s := &outputs[i].Citations[j].Sources[k]
+				if s.SourceName != "" || s.ToolCallIndex != 0 {
+					continue
+				}
+				indices := make([]uint, len(s.ToolResultIndices))
+				for l, idx := range s.ToolResultIndices {
+					indices[l] = idx
+					if idx < uint(len(f.documentOrder)) {
+						indices[l] = uint(f.documentOrder[idx])
+					} else {
+						f.logger.Warn("citation source has no document", Field{Key: "tool_result_index", Value: idx})
+					}
+				}
+				s.ToolResultIndices = indices
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package gobindings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+func TestOrderDocuments(t *testing.T) {
+	t.Parallel()
+
+	doc := func(source string, score any) orderedjson.Object {
+		d := orderedjson.New()
+		d.Set("source", source)
+		if score != nil {
+			d.Set("score", score)
+		}
+		return d
+	}
+	docs := []orderedjson.Object{
+		doc("web", 0.2),
+		doc("wiki", nil),
+		doc("web", int64(3)),
+		doc("news", 0.2),
+		doc("web", 0.9),
+		doc("wiki", 0.5),
+	}
+
+	cases := []struct {
+		name  string
+		order DocumentOrder
+		want  []int
+	}{
+		{name: "original", order: DocumentOrder{}, want: []int{0, 1, 2, 3, 4, 5}},
+		{name: "by score", order: DocumentOrder{Ordering: DocumentOrderingByScoreDesc}, want: []int{2, 4, 5, 0, 3, 1}},
+		{name: "round robin", order: DocumentOrder{Ordering: DocumentOrderingRoundRobinBySource}, want: []int{0, 1, 3, 2, 5, 4}},
+		{name: "custom field", order: DocumentOrder{Ordering: DocumentOrderingRoundRobinBySource, SourceField: "missing"}, want: []int{0, 1, 2, 3, 4, 5}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ordered, indices := OrderDocuments(docs, tc.order)
+			require.Equal(t, tc.want, indices)
+			for i, idx := range indices {
+				require.Equal(t, docs[idx], ordered[i])
+			}
+		})
+	}
+}
+
+func TestFilter_DocumentOrder(t *testing.T) {
+	t.Parallel()
+
+	docs := []orderedjson.Object{
+		orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{Key: "id", Value: "a"}, orderedjson.Pair{Key: "score", Value: 0.1})),
+		orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{Key: "id", Value: "b"}, orderedjson.Pair{Key: "score", Value: 0.9})),
+		orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{Key: "id", Value: "c"}, orderedjson.Pair{Key: "score", Value: 0.5})),
+	}
+	opts := RenderCmd3Options{Documents: docs, OrderDocuments: &DocumentOrder{Ordering: DocumentOrderingByScoreDesc}}
+
+	// The prompt renders b, c and a, the model cites c and a as documents 1 and 2
+	options := append(opts.filterOptions(), WithDocumentIDs([][]string{{"a", "b", "c"}}))
+	f := NewFilter(options...)
+	var citations []FilterCitation
+	for _, token := range []string{"<|START_RESPONSE|>", "It is ", "<co>", "sunny", "</co: 0:[1,2]>", ".", "<|END_RESPONSE|>"} {
+		out, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			citations = append(citations, o.Citations...)
+		}
+	}
+	require.Len(t, citations, 1)
+	require.Equal(t, []Source{{ToolCallIndex: 0, ToolResultIndices: []uint{2, 0}}}, citations[0].Sources)
+	require.Equal(t, []string{"c", "a"}, citations[0].DocumentIDs)
+}
@@ -0,0 +1,57 @@
+package gobindings
+
+import "errors"
+
+// ErrorKind is the kind of an error returned by the Rust library
+type ErrorKind int
+
+// ErrorKind values, matching CErrorKind of the C API
+const (
+	ErrorKindUnknown ErrorKind = iota + 1
+	ErrorKindInvalidArgument
+	ErrorKindTemplateSyntax
+	ErrorKindInvalidMessages
+	ErrorKindJSON
+	ErrorKindPanic
+)
+
+// Sentinels of the kinds of Error, matched with errors.Is
+var (
+	// ErrInvalidArgument is an invalid option or argument, e.g. a filter state saved by a
+	// newer version
+	ErrInvalidArgument = errors.New("melody: invalid argument")
+	// ErrTemplateSyntax is a template that cannot be parsed or rendered
+	ErrTemplateSyntax = errors.New("melody: template syntax error")
+	// ErrInvalidMessages is a sequence of messages that cannot be rendered, e.g. a tool
+	// result without a tool call
+	ErrInvalidMessages = errors.New("melody: invalid messages")
+	// ErrJSON is a JSON value, such as a tool schema or a document, that cannot be encoded
+	// or decoded
+	ErrJSON = errors.New("melody: JSON error")
+	// ErrPanic is a panic of the Rust library
+	ErrPanic = errors.New("melody: panic")
+)
+
+var errorKindSentinels = map[ErrorKind]error{
+	ErrorKindInvalidArgument: ErrInvalidArgument,
+	ErrorKindTemplateSyntax:  ErrTemplateSyntax,
+	ErrorKindInvalidMessages: ErrInvalidMessages,
+	ErrorKindJSON:            ErrJSON,
+	ErrorKindPanic:           ErrPanic,
+}
+
+// Error is an error returned by the Rust library, its message is the Rust error's
+type Error struct {
+	Kind    ErrorKind
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is the sentinel of the kind of e, e.g. ErrTemplateSyntax
+func (e *Error) Is(target error) bool {
+	sentinel, ok := errorKindSentinels[e.Kind]
+	return ok && sentinel == target
+}
@@ -0,0 +1,85 @@
+// Package export writes parsed model turns in the JSONL format of finetuning pipelines,
+// one turn per line, so that the structured result of a generation can be persisted after
+// it is parsed.
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+// RoleChatbot is the role of the turns converted from filter outputs
+const RoleChatbot = "chatbot"
+
+// ParsedTurn is a parsed model turn
+type ParsedTurn struct {
+	Role      string                  `json:"role"`
+	Text      string                  `json:"text,omitempty"`
+	Reasoning string                  `json:"reasoning,omitempty"`
+	ToolCalls []melody.ToolCall       `json:"tool_calls,omitempty"`
+	Citations []melody.FilterCitation `json:"citations,omitempty"`
+	// Logprobs are the token IDs and log probabilities of the turn, if the filter was given any
+	Logprobs *Logprobs `json:"logprobs,omitempty"`
+}
+
+// Logprobs are the token IDs of a turn with their log probabilities
+type Logprobs struct {
+	TokenIDs []uint32  `json:"token_ids"`
+	Logprobs []float32 `json:"logprobs"`
+}
+
+// FromFilterOutputs converts the stream of filter outputs of a generation to a chatbot turn,
+// accumulated with melody.CollectOutputs
+func FromFilterOutputs(outputs []melody.FilterOutput) ParsedTurn {
+	c := melody.CollectOutputs(outputs)
+	turn := ParsedTurn{
+		Role:      RoleChatbot,
+		Text:      c.Text,
+		Reasoning: c.Reasoning,
+		ToolCalls: c.ToolCalls,
+		Citations: c.Citations,
+	}
+	if len(c.Logprobs.TokenIDs) > 0 || len(c.Logprobs.Logprobs) > 0 {
+		turn.Logprobs = &Logprobs{TokenIDs: c.Logprobs.TokenIDs, Logprobs: c.Logprobs.Logprobs}
+	}
+	return turn
+}
+
+// WriteJSONL writes the turns to w as JSON lines
+func WriteJSONL(w io.Writer, turns []ParsedTurn) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for i, turn := range turns {
+		if err := enc.Encode(turn); err != nil {
+			return fmt.Errorf("turn %d: %w", i, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadJSONL reads the turns written by WriteJSONL from r, skipping empty lines
+func ReadJSONL(r io.Reader) ([]ParsedTurn, error) {
+	var turns []ParsedTurn
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var turn ParsedTurn
+		if err := json.Unmarshal(scanner.Bytes(), &turn); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		turns = append(turns, turn)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return turns, nil
+}
@@ -0,0 +1,71 @@
+package export
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+func TestFromFilterOutputs(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions())
+	var outputs []melody.FilterOutput
+	chunks := []string{
+		"<|START_THINKING|>", "I will check.", "<|END_THINKING|>",
+		"<|START_ACTION|>", `[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome"}}]`, "<|END_ACTION|>",
+	}
+	for i, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, &melody.TokenIDsWithLogProb{TokenIDs: []uint32{uint32(i)}, Logprobs: []float32{-0.5}})
+		require.NoError(t, err)
+		outputs = append(outputs, out...)
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	outputs = append(outputs, out...)
+
+	turn := FromFilterOutputs(outputs)
+	require.Equal(t, RoleChatbot, turn.Role)
+	require.Equal(t, "I will check.", turn.Reasoning)
+	require.Equal(t, []melody.ToolCall{{ID: "0", Name: "get_weather", Parameters: `{"city": "Rome"}`}}, turn.ToolCalls)
+	require.NotNil(t, turn.Logprobs)
+	require.Len(t, turn.Logprobs.Logprobs, len(turn.Logprobs.TokenIDs))
+}
+
+func TestJSONL_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	turns := []ParsedTurn{
+		{
+			Role: RoleChatbot,
+			Text: "It is sunny in <b>Paris</b>.",
+			Citations: []melody.FilterCitation{{
+				StartIndex: 6,
+				EndIndex:   11,
+				Text:       "sunny",
+				Sources:    []melody.Source{{ToolCallIndex: 0, ToolResultIndices: []uint{1}}},
+			}},
+			Logprobs: &Logprobs{TokenIDs: []uint32{1, 2}, Logprobs: []float32{-0.1, -2.5}},
+		},
+		{
+			Role:      RoleChatbot,
+			Reasoning: "I will check.",
+			ToolCalls: []melody.ToolCall{{ID: "0", Name: "get_weather", Parameters: `{"city": "Rome"}`}},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteJSONL(&buf, turns))
+	require.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+	require.Contains(t, buf.String(), "<b>Paris</b>")
+
+	got, err := ReadJSONL(&buf)
+	require.NoError(t, err)
+	require.Equal(t, turns, got)
+
+	_, err = ReadJSONL(bytes.NewBufferString("{}\n\n{"))
+	require.ErrorContains(t, err, "line 3")
+}
@@ -0,0 +1,7 @@
+package gobindings
+
+// NewLinearMatchingFilter creates a filter like TryNewFilter whose special tokens and stops
+// are matched one at a time, for the benchmarks of the external tests
+func NewLinearMatchingFilter(options ...FilterOption) (Filter, error) {
+	return newSyncFilter(newFilterConfig(options), func(opts *FilterOptions) { opts.LinearTokenMatching() })
+}
@@ -0,0 +1,27 @@
+package gobindings
+
+// ExtractCitations parses a complete completion in the registered format, e.g. "cmd3", and
+// returns its citations. Unlike a Filter it needs no streaming, for offline processing of
+// completions that are already complete.
+func ExtractCitations(text, format string) ([]FilterCitation, error) {
+	res, err := extract(text, format)
+	return res.Citations, err
+}
+
+// ExtractToolCalls parses a complete completion in the registered format, e.g. "cmd3", and
+// returns its tool calls, with the raw JSON of their parameters. Unlike a Filter it needs no
+// streaming, for offline processing of completions that are already complete.
+func ExtractToolCalls(text, format string) ([]ToolCall, error) {
+	res, err := extract(text, format)
+	return res.ToolCalls, err
+}
+
+// extract parses a complete completion in the registered format
+func extract(text, format string) (ParsedResult, error) {
+	var res ParsedResult
+	if _, err := lookupFormat(format); err != nil {
+		return res, err
+	}
+	err := res.parse(text, WithFormat(format))
+	return res, err
+}
@@ -0,0 +1,33 @@
+package gobindings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractCitations(t *testing.T) {
+	t.Parallel()
+
+	citations, err := ExtractCitations("<|START_RESPONSE|>It is <co>sunny</co: 1:[0,2]> in <co>Paris</co: 0:[0]>.<|END_RESPONSE|>", "cmd3")
+	require.NoError(t, err)
+	require.Len(t, citations, 2)
+	require.Equal(t, "sunny", citations[0].Text)
+	require.Equal(t, []Source{{ToolCallIndex: 1, ToolResultIndices: []uint{0, 2}}}, citations[0].Sources)
+	require.Equal(t, "Paris", citations[1].Text)
+	require.Equal(t, []Source{{ToolCallIndex: 0, ToolResultIndices: []uint{0}}}, citations[1].Sources)
+
+	_, err = ExtractCitations("<|START_RESPONSE|>It is sunny.<|END_RESPONSE|>", "cmd5")
+	require.EqualError(t, err, `unknown format "cmd5"`)
+}
+
+func TestExtractToolCalls(t *testing.T) {
+	t.Parallel()
+
+	calls, err := ExtractToolCalls(`<|START_ACTION|>[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome"}}, {"tool_call_id": "1", "tool_name": "get_time", "parameters": {"tz": "CET"}}]<|END_ACTION|>`, "cmd3")
+	require.NoError(t, err)
+	require.Equal(t, []ToolCall{
+		{ID: "0", Name: "get_weather", Parameters: `{"city": "Rome"}`},
+		{ID: "1", Name: "get_time", Parameters: `{"tz": "CET"}`},
+	}, calls)
+}
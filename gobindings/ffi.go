@@ -5,6 +5,7 @@ package gobindings
 // #include "melody.h"
 import "C"
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"runtime"
@@ -78,6 +79,22 @@ func (opts *FilterOptions) HandleMultiHop() *FilterOptions {
 	return opts
 }
 
+// HandleLlama3Chat configures options for Llama 3.x chat format
+func (opts *FilterOptions) HandleLlama3Chat() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_handle_llama3_chat(opts.ptr)
+	}
+	return opts
+}
+
+// HandleFIM configures options for fill-in-the-middle completions of the given model family
+func (opts *FilterOptions) HandleFIM(family FIMFamily) *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_handle_fim(opts.ptr, C.CFimFamily(family))
+	}
+	return opts
+}
+
 // StreamNonGroundedAnswer enables streaming of non-grounded answer
 func (opts *FilterOptions) StreamNonGroundedAnswer() *FilterOptions {
 	if opts.ptr != nil {
@@ -102,6 +119,112 @@ func (opts *FilterOptions) StreamProcessedParams() *FilterOptions {
 	return opts
 }
 
+// WithCitationMerging enables merging of adjacent citations that share the same sources
+func (opts *FilterOptions) WithCitationMerging() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_citation_merging(opts.ptr)
+	}
+	return opts
+}
+
+// WithSentenceCitations enables alignment of citations to the sentences containing them
+func (opts *FilterOptions) WithSentenceCitations() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_sentence_citations(opts.ptr)
+	}
+	return opts
+}
+
+// WithFinishReason enables the terminal output reporting why the stream ended
+func (opts *FilterOptions) WithFinishReason() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_finish_reason(opts.ptr)
+	}
+	return opts
+}
+
+// StreamDocumentSelections emits the document indices of "Relevant Documents:" and
+// "Cited Documents:" lines
+func (opts *FilterOptions) StreamDocumentSelections() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_stream_document_selections(opts.ptr)
+	}
+	return opts
+}
+
+// WithPromptEcho passes the first promptTokenCount tokens through as echoed prompt tokens
+func (opts *FilterOptions) WithPromptEcho(promptTokenCount int) *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_prompt_echo(opts.ptr, C.size_t(promptTokenCount))
+	}
+	return opts
+}
+
+// WithResponsePrefix continues a response that starts with prefix, which is not emitted
+func (opts *FilterOptions) WithResponsePrefix(prefix string) *FilterOptions {
+	if opts.ptr != nil {
+		cPrefix := C.CString(prefix)
+		defer C.free(unsafe.Pointer(cPrefix))
+		C.melody_filter_options_with_response_prefix(opts.ptr, cPrefix)
+	}
+	return opts
+}
+
+// WithHealedPrefix strips the healed text of a response prefix from the start of the completion
+func (opts *FilterOptions) WithHealedPrefix(healed string) *FilterOptions {
+	if opts.ptr != nil {
+		cHealed := C.CString(healed)
+		defer C.free(unsafe.Pointer(cHealed))
+		C.melody_filter_options_with_healed_prefix(opts.ptr, cHealed)
+	}
+	return opts
+}
+
+// WithPrefixTrim drops a prefix from the start of the completion
+func (opts *FilterOptions) WithPrefixTrim(prefix string) *FilterOptions {
+	if opts.ptr != nil {
+		cPrefix := C.CString(prefix)
+		defer C.free(unsafe.Pointer(cPrefix))
+		C.melody_filter_options_with_prefix_trim(opts.ptr, cPrefix)
+	}
+	return opts
+}
+
+// WithResumeState resumes a truncated response from the text and citations already emitted
+func (opts *FilterOptions) WithResumeState(priorText string, priorCitations []FilterCitation) *FilterOptions {
+	if opts.ptr != nil {
+		var a cAllocator
+		defer a.FreeAll()
+		cCitations, cCitationsLen := buildCCitations(&a, priorCitations)
+		C.melody_filter_options_with_resume_state(opts.ptr, a.CString(priorText), cCitations, cCitationsLen)
+	}
+	return opts
+}
+
+// WithCitationIndexUnit sets the unit of citation start and end indices
+func (opts *FilterOptions) WithCitationIndexUnit(unit CitationIndexUnit) *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_citation_index_unit(opts.ptr, C.CCitationIndexUnit(unit))
+	}
+	return opts
+}
+
+// WithCitationSourceFormat sets the format of the sources of Command 3 citations
+func (opts *FilterOptions) WithCitationSourceFormat(format CitationSourceFormat) *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_citation_source_format(opts.ptr, C.CCitationSourceFormat(format))
+	}
+	return opts
+}
+
+// WithUnicodeNormalization sets the Unicode normalization form of the emitted text
+func (opts *FilterOptions) WithUnicodeNormalization(form UnicodeNormalization) *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_with_unicode_normalization(opts.ptr, C.CUnicodeNormalization(form))
+	}
+	return opts
+}
+
 // WithLeftTrimmed enables left trimming
 func (opts *FilterOptions) WithLeftTrimmed() *FilterOptions {
 	if opts.ptr != nil {
@@ -126,6 +249,49 @@ func (opts *FilterOptions) WithChunkSize(size int) *FilterOptions {
 	return opts
 }
 
+// WithWordBoundaryChunking sets word boundary chunking of text with a minimum chunk length
+// in characters
+func (opts *FilterOptions) WithWordBoundaryChunking(minChars int) *FilterOptions {
+	if opts.ptr != nil && minChars >= 0 {
+		C.melody_filter_options_with_word_boundary_chunking(opts.ptr, C.size_t(minChars))
+	}
+	return opts
+}
+
+// WithRollbackWindow sets the number of tokens that can be rolled back
+func (opts *FilterOptions) WithRollbackWindow(tokens int) *FilterOptions {
+	if opts.ptr != nil && tokens >= 0 {
+		C.melody_filter_options_with_rollback_window(opts.ptr, C.size_t(tokens))
+	}
+	return opts
+}
+
+// WithDedupWindow sets the number of bytes of emitted text a retry may replay
+func (opts *FilterOptions) WithDedupWindow(bytes int) *FilterOptions {
+	if opts.ptr != nil && bytes >= 0 {
+		C.melody_filter_options_with_dedup_window(opts.ptr, C.size_t(bytes))
+	}
+	return opts
+}
+
+// LegacySearchQuerySplitting splits search queries at every separator, without reading
+// quoting and escaping
+func (opts *FilterOptions) LegacySearchQuerySplitting() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_legacy_search_query_splitting(opts.ptr)
+	}
+	return opts
+}
+
+// LinearTokenMatching matches the special tokens and stops one at a time instead of in a
+// single pass. The outputs are the same, it only exists to benchmark the two.
+func (opts *FilterOptions) LinearTokenMatching() *FilterOptions {
+	if opts.ptr != nil {
+		C.melody_filter_options_linear_token_matching(opts.ptr)
+	}
+	return opts
+}
+
 // WithInclusiveStops sets inclusive stop sequences
 func (opts *FilterOptions) WithInclusiveStops(stops []string) *FilterOptions {
 	if opts.ptr != nil && len(stops) > 0 {
@@ -160,6 +326,35 @@ func (opts *FilterOptions) WithExclusiveStops(stops []string) *FilterOptions {
 	return opts
 }
 
+// WithConditionalStops sets exclusive stop sequences that only apply in a context
+func (opts *FilterOptions) WithConditionalStops(stops []ConditionalStop) *FilterOptions {
+	if opts.ptr != nil && len(stops) > 0 {
+		cStops := make([]*C.char, len(stops))
+		cContexts := make([]C.CStopContext, len(stops))
+		for i, stop := range stops {
+			cStops[i] = C.CString(stop.Stop)
+			cContexts[i] = C.CStopContext(stop.Context)
+		}
+		C.melody_filter_options_with_conditional_stops(opts.ptr, (**C.char)(unsafe.Pointer(&cStops[0])), &cContexts[0], C.size_t(len(stops)))
+
+		// Free all C strings after the call
+		for _, cStr := range cStops {
+			C.free(unsafe.Pointer(cStr))
+		}
+	}
+	return opts
+}
+
+// WithSpecialToken adds or remaps a special token
+func (opts *FilterOptions) WithSpecialToken(token string, mode FilterMode) *FilterOptions {
+	if opts.ptr != nil {
+		cToken := C.CString(token)
+		defer C.free(unsafe.Pointer(cToken))
+		C.melody_filter_options_with_special_token(opts.ptr, cToken, C.CFilterMode(mode))
+	}
+	return opts
+}
+
 // RemoveToken removes a specific token from the output
 func (opts *FilterOptions) RemoveToken(token string) *FilterOptions {
 	if opts.ptr != nil {
@@ -229,7 +424,24 @@ func (f *cFilter) writeDecoded(decodedToken string, logprobs TokenIDsWithLogProb
 		cLogprobs = (*C.float)(unsafe.Pointer(&logprobs.Logprobs[0]))
 	}
 
-	res := C.melody_filter_write_decoded(f.ptr, cToken, cTokenIds, tokenIdsLen, cLogprobs, logprobsLen)
+	var res *C.CFilterOutputResult
+	if len(logprobs.TopLogProbs) > 0 {
+		// The alternatives are flattened like the tokens of writeDecodedBatch
+		topLens := make([]C.size_t, len(logprobs.TopLogProbs))
+		var topIDs []uint32
+		var topLogprobs []float32
+		for i, top := range logprobs.TopLogProbs {
+			n := min(len(top.TokenIDs), len(top.Logprobs))
+			topIDs = append(topIDs, top.TokenIDs[:n]...)
+			topLogprobs = append(topLogprobs, top.Logprobs[:n]...)
+			topLens[i] = C.size_t(n)
+		}
+		res = C.melody_filter_write_decoded_with_top_logprobs(f.ptr, cToken, cTokenIds, tokenIdsLen, cLogprobs, logprobsLen,
+			unsafe.SliceData(topLens), C.size_t(len(topLens)),
+			(*C.uint32_t)(unsafe.SliceData(topIDs)), (*C.float)(unsafe.SliceData(topLogprobs)))
+	} else {
+		res = C.melody_filter_write_decoded(f.ptr, cToken, cTokenIds, tokenIdsLen, cLogprobs, logprobsLen)
+	}
 	if res == nil {
 		return nil, nil
 	}
@@ -261,6 +473,188 @@ func (f *cFilter) flushPartials() ([]FilterOutput, error) {
 	return convertCOutputArray(res.result), nil
 }
 
+// writeDecodedBatch writes decoded tokens to the filter in one cgo call. logprobs is
+// either empty or has the log probabilities of every token.
+func (f *cFilter) writeDecodedBatch(tokens []string, logprobs []TokenIDsWithLogProb) ([]FilterOutput, error) {
+	if f.ptr == nil || len(tokens) == 0 {
+		return nil, nil
+	}
+
+	// The batch is flattened into arrays of values without Go pointers, which cgo lets
+	// Rust read in place
+	var text []byte
+	textLens := make([]C.size_t, len(tokens))
+	for i, token := range tokens {
+		text = append(text, token...)
+		textLens[i] = C.size_t(len(token))
+	}
+	var tokenIDs []uint32
+	var lps []float32
+	var tokenIDsLens, lpsLens []C.size_t
+	if len(logprobs) > 0 {
+		tokenIDsLens = make([]C.size_t, len(tokens))
+		lpsLens = make([]C.size_t, len(tokens))
+		for i, lp := range logprobs {
+			tokenIDs = append(tokenIDs, lp.TokenIDs...)
+			lps = append(lps, lp.Logprobs...)
+			tokenIDsLens[i] = C.size_t(len(lp.TokenIDs))
+			lpsLens[i] = C.size_t(len(lp.Logprobs))
+		}
+	}
+
+	res := C.melody_filter_write_decoded_batch(f.ptr,
+		(*C.char)(unsafe.Pointer(unsafe.SliceData(text))), unsafe.SliceData(textLens), C.size_t(len(tokens)),
+		(*C.uint32_t)(unsafe.SliceData(tokenIDs)), unsafe.SliceData(tokenIDsLens),
+		(*C.float)(unsafe.SliceData(lps)), unsafe.SliceData(lpsLens))
+	return takeCOutputResult(res)
+}
+
+// writeToken writes a token ID to the filter, decoded by the Rust tokenizer
+func (f *cFilter) writeToken(tokenizer unsafe.Pointer, id uint32, logprob *float32) ([]FilterOutput, error) {
+	if f.ptr == nil {
+		return nil, nil
+	}
+
+	var cLogprob C.float
+	if logprob != nil {
+		cLogprob = C.float(*logprob)
+	}
+	res := C.melody_filter_write_token(f.ptr, tokenizer, C.uint32_t(id), cLogprob, C.bool(logprob != nil))
+	return takeCOutputResult(res)
+}
+
+// flushTokens flushes the tokens held back by writeToken, then any partial outputs
+func (f *cFilter) flushTokens(tokenizer unsafe.Pointer) ([]FilterOutput, error) {
+	if f.ptr == nil {
+		return nil, nil
+	}
+	return takeCOutputResult(C.melody_filter_flush_tokens(f.ptr, tokenizer))
+}
+
+// takeCOutputResult converts and frees the result of a filter call
+func takeCOutputResult(res *C.CFilterOutputResult) ([]FilterOutput, error) {
+	if res == nil {
+		return nil, nil
+	}
+	defer C.melody_result_free(res)
+
+	if res.error != nil {
+		return nil, errors.New(C.GoString(res.error))
+	}
+	return convertCOutputArray(res.result), nil
+}
+
+// bufferedBytes returns the number of bytes the filter holds back
+func (f *cFilter) bufferedBytes() int {
+	if f.ptr == nil {
+		return 0
+	}
+	return int(C.melody_filter_buffered_bytes(f.ptr))
+}
+
+// currentMode returns the mode the filter parses the next text in
+func (f *cFilter) currentMode() FilterMode {
+	if f.ptr == nil {
+		return FilterModePlainText
+	}
+	return FilterMode(C.melody_filter_current_mode(f.ptr))
+}
+
+// saveState returns the parsing state of the filter encoded as JSON
+func (f *cFilter) saveState() ([]byte, error) {
+	if f.ptr == nil {
+		return nil, errors.New("filter is closed")
+	}
+
+	res := C.melody_filter_save_state(f.ptr)
+	if res == nil {
+		return nil, errors.New("melody_filter_save_state returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.error != nil {
+		return nil, renderError(res)
+	}
+	return []byte(C.GoString(res.result)), nil
+}
+
+// restoreState replaces the parsing state of the filter with one returned by saveState
+func (f *cFilter) restoreState(state []byte) error {
+	if f.ptr == nil {
+		return errors.New("filter is closed")
+	}
+
+	cState := C.CString(string(state))
+	defer C.free(unsafe.Pointer(cState))
+
+	res := C.melody_filter_restore_state(f.ptr, cState)
+	if res == nil {
+		return errors.New("melody_filter_restore_state returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.error != nil {
+		return renderError(res)
+	}
+	return nil
+}
+
+// rollback rewinds the filter to its state before the last tokens written
+func (f *cFilter) rollback(tokens int) error {
+	if f.ptr == nil {
+		return errors.New("filter is closed")
+	}
+
+	res := C.melody_filter_rollback(f.ptr, C.size_t(tokens))
+	if res == nil {
+		return errors.New("melody_filter_rollback returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.error != nil {
+		return renderError(res)
+	}
+	return nil
+}
+
+// requestSoftStop asks the filter to stop at the next sentence boundary
+func (f *cFilter) requestSoftStop() {
+	if f.ptr == nil {
+		return
+	}
+	C.melody_filter_request_soft_stop(f.ptr)
+}
+
+// describeFormat returns the descriptor of a built-in format encoded as JSON
+func describeFormat(name string) ([]byte, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	res := C.melody_describe_format(cName)
+	if res == nil {
+		return nil, errors.New("melody_describe_format returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.error != nil {
+		return nil, renderError(res)
+	}
+	return []byte(C.GoString(res.result)), nil
+}
+
+// resume marks a retry of the upstream stream
+func (f *cFilter) resume() {
+	if f.ptr == nil {
+		return
+	}
+	C.melody_filter_resume(f.ptr)
+}
+
+// renderError returns the *Error of a CRenderResult with an error
+func renderError(res *C.CRenderResult) error {
+	return &Error{Kind: ErrorKind(res.error_kind), Message: C.GoString(res.error)}
+}
+
 // convertCOutputArray converts a C output array to Go FilterOutput slice
 func convertCOutputArray(cArr *C.CFilterOutputArray) []FilterOutput {
 	if cArr == nil || cArr.len == 0 {
@@ -303,6 +697,22 @@ func convertCOutput(cOutput *C.CFilterOutput) FilterOutput {
 		}
 	}
 
+	if cOutput.top_logprobs_lens != nil && cOutput.top_logprobs_lens_len > 0 {
+		lens := unsafe.Slice(cOutput.top_logprobs_lens, int(cOutput.top_logprobs_lens_len))
+		ids := unsafe.Slice((*uint32)(unsafe.Pointer(cOutput.top_token_ids)), int(cOutput.top_logprobs_len))
+		logprobs := unsafe.Slice((*float32)(unsafe.Pointer(cOutput.top_logprobs)), int(cOutput.top_logprobs_len))
+		output.Logprobs.TopLogProbs = make([]TopLogProbs, len(lens))
+		start := 0
+		for i, n := range lens {
+			end := start + int(n)
+			output.Logprobs.TopLogProbs[i] = TopLogProbs{
+				TokenIDs: append([]uint32(nil), ids[start:end]...),
+				Logprobs: append([]float32(nil), logprobs[start:end]...),
+			}
+			start = end
+		}
+	}
+
 	// Convert search query
 	if cOutput.search_query_index >= 0 {
 		output.SearchQuery = &FilterSearchQueryDelta{
@@ -339,12 +749,42 @@ func convertCOutput(cOutput *C.CFilterOutput) FilterOutput {
 		output.ToolCallDelta = tc
 	}
 
+	// Convert finish
+	if cOutput.finish_reason >= 0 {
+		output.Finish = &FilterFinish{
+			Reason:       FinishReason(cOutput.finish_reason),
+			StopSequence: C.GoString(cOutput.stop_sequence),
+		}
+	}
+
 	output.IsPostAnswer = bool(cOutput.is_post_answer)
 	output.IsReasoning = bool(cOutput.is_reasoning)
+	output.PlanIndex = uint(cOutput.plan_index)
+	output.IsEcho = bool(cOutput.is_echo)
+
+	// Convert document selections
+	if cOutput.has_relevant_doc_indices {
+		output.RelevantDocIndices = convertCDocIndices(cOutput.relevant_doc_indices, cOutput.relevant_doc_indices_len)
+	}
+	if cOutput.has_cited_doc_indices {
+		output.CitedDocIndices = convertCDocIndices(cOutput.cited_doc_indices, cOutput.cited_doc_indices_len)
+	}
 
 	return output
 }
 
+// convertCDocIndices converts C document indices to a non-nil slice, empty for a line
+// selecting no documents
+func convertCDocIndices(ptr *C.size_t, n C.size_t) []uint {
+	indices := make([]uint, 0, int(n))
+	if ptr != nil && n > 0 {
+		for _, idx := range unsafe.Slice(ptr, int(n)) {
+			indices = append(indices, uint(idx))
+		}
+	}
+	return indices
+}
+
 // convertCCitation converts a C citation to Go FilterCitation
 func convertCCitation(cCitation *C.CFilterCitation) FilterCitation {
 	citation := FilterCitation{
@@ -370,6 +810,9 @@ func convertCSource(cSource *C.CSource) Source {
 	source := Source{
 		ToolCallIndex: uint(cSource.tool_call_index),
 	}
+	if cSource.source_name != nil {
+		source.SourceName = C.GoString(cSource.source_name)
+	}
 
 	if cSource.tool_result_indices != nil && cSource.tool_result_indices_len > 0 {
 		indices := unsafe.Slice(cSource.tool_result_indices, int(cSource.tool_result_indices_len))
@@ -401,6 +844,10 @@ const (
 	ContentThinking ContentType = 2
 	ContentImage    ContentType = 3
 	ContentDocument ContentType = 4
+	// ContentElidedTurns marks turns elided from the history to fit the context. It is
+	// rendered as a system turn saying how many of them, Content.ElidedTurns, were omitted,
+	// and must be the only content of its message.
+	ContentElidedTurns ContentType = 5
 )
 
 type CitationQuality int32
@@ -479,6 +926,8 @@ func (t *ContentType) UnmarshalJSON(data []byte) error {
 			*t = ContentImage
 		case "document":
 			*t = ContentDocument
+		case "elided_turns":
+			*t = ContentElidedTurns
 		default:
 			return errors.New("invalid ContentType: " + s)
 		}
@@ -595,6 +1044,11 @@ type Tool struct {
 
 type Image struct {
 	TemplatePlaceholder string `json:"template_placeholder"`
+	// Data is the encoded image of an inline image and MediaType its media type, e.g.
+	// "image/png". They are not rendered: images.Layout.ResolveInline sets the placeholder
+	// of inline images and returns them in the order of their placeholders.
+	Data      []byte `json:"data,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
 }
 
 type Content struct {
@@ -603,6 +1057,8 @@ type Content struct {
 	Thinking string             `json:"thinking,omitempty"` // optional: empty means omitted
 	Image    *Image             `json:"image,omitempty"`    // optional
 	Document orderedjson.Object `json:"document,omitempty"`
+	// ElidedTurns is the number of turns omitted, for ContentElidedTurns
+	ElidedTurns int `json:"elided_turns,omitempty"`
 }
 
 type ToolCall struct {
@@ -634,6 +1090,19 @@ type RenderCmd3Options struct {
 	JSONMode                 bool                 `json:"json_mode,omitempty"`
 	AdditionalTemplateFields map[string]any       `json:"additional_template_fields,omitempty"` // optional: JSON-encoded
 	EscapedSpecialTokens     map[string]string    `json:"escaped_special_tokens,omitempty"`     // optional: JSON-encoded
+	// AllowedTemplateFields are the only AdditionalTemplateFields accepted, any are if empty
+	AllowedTemplateFields []string `json:"allowed_template_fields,omitempty"`
+	// NormalizeDocuments renders the documents normalized by NormalizeDocuments, optional.
+	// The report of the normalization is returned by the WithReport render.
+	NormalizeDocuments *DocumentNormalization `json:"normalize_documents,omitempty"`
+	// OrderDocuments renders the documents, normalized first if NormalizeDocuments is set,
+	// in the order of OrderDocuments, optional. Completions are parsed WithDocumentOrder
+	// so that citations cite the documents in the order they are given.
+	OrderDocuments *DocumentOrder `json:"order_documents,omitempty"`
+	// Sanitizer sanitizes the tool results and documents before they are rendered, optional
+	Sanitizer Sanitizer `json:"-"`
+	// Tracer traces the render, optional
+	Tracer Tracer `json:"-"`
 }
 
 type RenderCmd4Options struct {
@@ -649,25 +1118,68 @@ type RenderCmd4Options struct {
 	JSONMode                 bool                 `json:"json_mode,omitempty"`
 	AdditionalTemplateFields map[string]any       `json:"additional_template_fields,omitempty"` // optional
 	EscapedSpecialTokens     map[string]string    `json:"escaped_special_tokens,omitempty"`     // optional
+	// AllowedTemplateFields are the only AdditionalTemplateFields accepted, any are if empty
+	AllowedTemplateFields []string `json:"allowed_template_fields,omitempty"`
+	// NormalizeDocuments renders the documents normalized by NormalizeDocuments, optional.
+	// The report of the normalization is returned by the WithReport render.
+	NormalizeDocuments *DocumentNormalization `json:"normalize_documents,omitempty"`
+	// OrderDocuments renders the documents, normalized first if NormalizeDocuments is set,
+	// in the order of OrderDocuments, optional. Completions are parsed WithDocumentOrder
+	// so that citations cite the documents in the order they are given.
+	OrderDocuments *DocumentOrder `json:"order_documents,omitempty"`
+	// Sanitizer sanitizes the tool results and documents before they are rendered, optional
+	Sanitizer Sanitizer `json:"-"`
+	// Tracer traces the render, optional
+	Tracer Tracer `json:"-"`
 }
 
-// Internal C allocator helper to track and free C allocations
+// cAllocator allocates the C memory of a call into Rust, which is all freed at once by
+// FreeAll. Allocations are carved from zeroed slabs of C memory, so a render of a prompt
+// with many messages and documents takes a few mallocs rather than one per string.
 type cAllocator struct {
 	ptrs []unsafe.Pointer
+	// free is the unused part of the last slab
+	free []byte
 }
 
+const (
+	// cSlabSize is the size of a slab, allocations larger than a quarter of it get their own
+	cSlabSize = 64 << 10
+	// cMaxAlign is the alignment of the allocations of Malloc, that of malloc on 64-bit platforms
+	cMaxAlign = 16
+)
+
 func (a *cAllocator) CString(s string) *C.char {
-	p := C.CString(s)
-	a.ptrs = append(a.ptrs, unsafe.Pointer(p))
-	return p
+	p := a.alloc(uintptr(len(s))+1, 1)
+	copy(unsafe.Slice((*byte)(p), len(s)), s)
+	return (*C.char)(p)
 }
 
 func (a *cAllocator) Malloc(size uintptr) unsafe.Pointer {
 	if size == 0 {
 		return nil
 	}
-	p := C.malloc(C.size_t(size))
-	a.ptrs = append(a.ptrs, p)
+	return a.alloc(size, cMaxAlign)
+}
+
+// alloc returns size zeroed bytes aligned to align, a power of two
+func (a *cAllocator) alloc(size, align uintptr) unsafe.Pointer {
+	if size > cSlabSize/4 {
+		p := C.calloc(1, C.size_t(size))
+		a.ptrs = append(a.ptrs, p)
+		trackCAllocs(1)
+		return p
+	}
+	pad := -uintptr(unsafe.Pointer(unsafe.SliceData(a.free))) & (align - 1)
+	if len(a.free) == 0 || pad+size > uintptr(len(a.free)) {
+		p := C.calloc(1, cSlabSize)
+		a.ptrs = append(a.ptrs, p)
+		trackCAllocs(1)
+		a.free = unsafe.Slice((*byte)(p), cSlabSize)
+		pad = 0
+	}
+	p := unsafe.Pointer(&a.free[pad])
+	a.free = a.free[pad+size:]
 	return p
 }
 
@@ -675,7 +1187,9 @@ func (a *cAllocator) FreeAll() {
 	for i := len(a.ptrs) - 1; i >= 0; i-- {
 		C.free(a.ptrs[i])
 	}
+	trackCAllocs(-len(a.ptrs))
 	a.ptrs = nil
+	a.free = nil
 }
 
 // Helpers to map Go enums to C enums
@@ -746,6 +1260,7 @@ func buildCContents(a *cAllocator, contents []Content) (*C.CContent, C.size_t) {
 		arr[i].thinking = nil
 		arr[i].image = nil
 		arr[i].document_json = nil
+		arr[i].elided_turns = C.size_t(c.ElidedTurns)
 
 		if c.Text != "" {
 			arr[i].text = a.CString(c.Text)
@@ -821,6 +1336,11 @@ func buildCSources(a *cAllocator, sources []Source) (*C.CSource, C.size_t) {
 			arr[i].tool_result_indices = nil
 			arr[i].tool_result_indices_len = 0
 		}
+		if source.SourceName != "" {
+			arr[i].source_name = a.CString(source.SourceName)
+		} else {
+			arr[i].source_name = nil
+		}
 	}
 	return base, C.size_t(n)
 }
@@ -885,14 +1405,49 @@ func buildCMessages(a *cAllocator, msgs []Message) (*C.CMessage, C.size_t) {
 	return base, C.size_t(n)
 }
 
+// RenderReport is what RenderCMD3WithReport and RenderCMD4WithReport report about the
+// context of a prompt
+type RenderReport struct {
+	// Findings are the findings of the Sanitizer of the options
+	Findings []Finding
+	// Normalization maps the documents of the options to the rendered documents, nil
+	// unless NormalizeDocuments is set. Its indices are those before OrderDocuments.
+	Normalization *DocumentNormalizationReport
+}
+
 // RenderCMD3 renders CMD3 using the Rust templating engine via FFI.
 func RenderCMD3(opts RenderCmd3Options) (string, error) {
+	prompt, _, err := RenderCMD3WithFindings(opts)
+	return prompt, err
+}
+
+// RenderCMD3WithFindings renders CMD3 like RenderCMD3, returning the findings of the
+// Sanitizer of opts with the prompt.
+func RenderCMD3WithFindings(opts RenderCmd3Options) (prompt string, findings []Finding, err error) {
+	prompt, report, err := RenderCMD3WithReport(opts)
+	return prompt, report.Findings, err
+}
+
+// RenderCMD3WithReport renders CMD3 like RenderCMD3, returning the findings of the
+// Sanitizer of opts and the normalization of its documents with the prompt.
+func RenderCMD3WithReport(opts RenderCmd3Options) (prompt string, report RenderReport, err error) {
+	_, span := startSpan(context.Background(), opts.Tracer, "melody.RenderCMD3")
+	defer func() { endSpan(span, err) }()
+
+	if err := templateFieldsErr(opts.AdditionalTemplateFields, opts.AllowedTemplateFields); err != nil {
+		return "", RenderReport{}, err
+	}
+
+	docs, normalization := renderedDocuments(opts.Documents, opts.NormalizeDocuments, opts.OrderDocuments)
+	msgs, docs, findings := sanitizePrompt(opts.Sanitizer, opts.Messages, docs)
+	report = RenderReport{Findings: findings, Normalization: normalization}
+
 	var a cAllocator
 	defer a.FreeAll()
 
 	// Build nested arrays
-	cMsgs, cMsgsLen := buildCMessages(&a, opts.Messages)
-	cDocs, cDocsLen := buildCDocuments(&a, opts.Documents)
+	cMsgs, cMsgsLen := buildCMessages(&a, msgs)
+	cDocs, cDocsLen := buildCDocuments(&a, docs)
 	cTools, cToolsLen := buildCTools(&a, opts.AvailableTools)
 
 	// Optional enums with presence flags
@@ -955,26 +1510,51 @@ func RenderCMD3(opts RenderCmd3Options) (string, error) {
 	// Call into Rust
 	res := C.melody_render_cmd3(&cOpts)
 	if res == nil {
-		return "", errors.New("melody_render_cmd3 returned null result struct")
+		return "", RenderReport{}, errors.New("melody_render_cmd3 returned null result struct")
 	}
 	defer C.melody_render_result_free(res)
 
 	if res.result != nil {
-		return C.GoString(res.result), nil
+		return C.GoString(res.result), report, nil
 	}
 	if res.error != nil {
-		return "", errors.New(C.GoString(res.error))
+		return "", RenderReport{}, renderError(res)
 	}
-	return "", errors.New("melody_render_cmd3 returned neither result nor error")
+	return "", RenderReport{}, errors.New("melody_render_cmd3 returned neither result nor error")
 }
 
 // RenderCMD4 renders CMD4 using the Rust templating engine via FFI.
 func RenderCMD4(opts RenderCmd4Options) (string, error) {
+	prompt, _, err := RenderCMD4WithFindings(opts)
+	return prompt, err
+}
+
+// RenderCMD4WithFindings renders CMD4 like RenderCMD4, returning the findings of the
+// Sanitizer of opts with the prompt.
+func RenderCMD4WithFindings(opts RenderCmd4Options) (prompt string, findings []Finding, err error) {
+	prompt, report, err := RenderCMD4WithReport(opts)
+	return prompt, report.Findings, err
+}
+
+// RenderCMD4WithReport renders CMD4 like RenderCMD4, returning the findings of the
+// Sanitizer of opts and the normalization of its documents with the prompt.
+func RenderCMD4WithReport(opts RenderCmd4Options) (prompt string, report RenderReport, err error) {
+	_, span := startSpan(context.Background(), opts.Tracer, "melody.RenderCMD4")
+	defer func() { endSpan(span, err) }()
+
+	if err := templateFieldsErr(opts.AdditionalTemplateFields, opts.AllowedTemplateFields); err != nil {
+		return "", RenderReport{}, err
+	}
+
+	docs, normalization := renderedDocuments(opts.Documents, opts.NormalizeDocuments, opts.OrderDocuments)
+	msgs, docs, findings := sanitizePrompt(opts.Sanitizer, opts.Messages, docs)
+	report = RenderReport{Findings: findings, Normalization: normalization}
+
 	var a cAllocator
 	defer a.FreeAll()
 
-	cMsgs, cMsgsLen := buildCMessages(&a, opts.Messages)
-	cDocs, cDocsLen := buildCDocuments(&a, opts.Documents)
+	cMsgs, cMsgsLen := buildCMessages(&a, msgs)
+	cDocs, cDocsLen := buildCDocuments(&a, docs)
 	cTools, cToolsLen := buildCTools(&a, opts.AvailableTools)
 
 	var cGround C.CGrounding
@@ -1017,15 +1597,15 @@ func RenderCMD4(opts RenderCmd4Options) (string, error) {
 
 	res := C.melody_render_cmd4(&cOpts)
 	if res == nil {
-		return "", errors.New("melody_render_cmd4 returned null result struct")
+		return "", RenderReport{}, errors.New("melody_render_cmd4 returned null result struct")
 	}
 	defer C.melody_render_result_free(res)
 
 	if res.result != nil {
-		return C.GoString(res.result), nil
+		return C.GoString(res.result), report, nil
 	}
 	if res.error != nil {
-		return "", errors.New(C.GoString(res.error))
+		return "", RenderReport{}, renderError(res)
 	}
-	return "", errors.New("melody_render_cmd4 returned neither result nor error")
+	return "", RenderReport{}, errors.New("melody_render_cmd4 returned neither result nor error")
 }
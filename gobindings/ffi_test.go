@@ -0,0 +1,40 @@
+package gobindings
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAllocator(t *testing.T) {
+	t.Parallel()
+
+	var a cAllocator
+	defer a.FreeAll()
+
+	var strs []unsafe.Pointer
+	for i := range 1000 {
+		p := a.CString(strings.Repeat("x", i%10))
+		strs = append(strs, unsafe.Pointer(p))
+		m := a.Malloc(24)
+		require.Zero(t, uintptr(m)%cMaxAlign)
+		require.Equal(t, make([]byte, 24), unsafe.Slice((*byte)(m), 24))
+	}
+	for i, p := range strs {
+		n := i % 10
+		require.Equal(t, strings.Repeat("x", n)+"\x00", unsafe.String((*byte)(p), n+1))
+	}
+	// The strings and structs share a single slab
+	require.Len(t, a.ptrs, 1)
+
+	// A large allocation gets its own block, leaving the slab in use
+	big := a.CString(strings.Repeat("y", cSlabSize))
+	require.Equal(t, byte('y'), *(*byte)(unsafe.Pointer(big)))
+	require.Len(t, a.ptrs, 2)
+	a.CString("z")
+	require.Len(t, a.ptrs, 2)
+
+	require.Nil(t, a.Malloc(0))
+}
@@ -0,0 +1,21 @@
+//go:build ffileak
+
+package gobindings
+
+// #include <stdint.h>
+// extern int64_t melody_live_allocations(void);
+import "C"
+import "sync/atomic"
+
+// liveCAllocs is the number of blocks of C memory allocated by a cAllocator and not freed
+var liveCAllocs atomic.Int64
+
+func trackCAllocs(delta int) {
+	liveCAllocs.Add(int64(delta))
+}
+
+// liveAllocations returns the number of allocations of the Rust library and of the
+// cAllocators not freed yet. It needs the library built with the ffileak feature.
+func liveAllocations() int64 {
+	return int64(C.melody_live_allocations()) + liveCAllocs.Load()
+}
@@ -0,0 +1,6 @@
+//go:build !ffileak
+
+package gobindings
+
+// trackCAllocs counts the C memory of the cAllocators with the ffileak build tag
+func trackCAllocs(int) {}
@@ -0,0 +1,134 @@
+//go:build ffileak
+
+package gobindings
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// The leak tests need the Rust library built with the ffileak feature:
+//
+//	cargo build --release --features tkzrs,ffileak
+//	go test -tags ffileak -run Leak ./gobindings
+//
+// They are not parallel, so no other test allocates while they count.
+
+// requireNoLeaks runs workload until the caches of the library are warm, then checks that
+// running it many more times does not increase the live allocations. Caches may shrink,
+// so fewer live allocations are fine.
+func requireNoLeaks(t *testing.T, workload func()) {
+	t.Helper()
+
+	// The regexes of the library keep a cache per thread, pin the workload to one so
+	// they are warmed once
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for range 5 {
+		workload()
+	}
+	// settle returns the live allocations once the finalizers freeing the filters and
+	// filter options have run, when the count stops changing between GCs
+	settle := func() int64 {
+		live := liveAllocations()
+		for range 50 {
+			runtime.GC()
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+			next := liveAllocations()
+			if next == live {
+				break
+			}
+			live = next
+		}
+		return live
+	}
+	before := settle()
+	for range 50 {
+		workload()
+	}
+	after := settle()
+	require.LessOrEqual(t, after, before, "the workload leaked %d allocations", after-before)
+}
+
+func TestLeak_Filter(t *testing.T) {
+	chunks := []string{
+		"<|START_THINKING|>", "Let me search.", "<|END_THINKING|>", "<|START_ACTION|>",
+		`[{"tool_call_id": "0", "tool_name": "search", "parameters": {"query": "sky"}}]`,
+		"<|END_ACTION|>", "<|START_RESPONSE|>", "The ", "<co>", "sky", "</co: 0:[1]>",
+		" is blue.", "<|END_RESPONSE|>",
+	}
+	logprobs := make([]TokenIDsWithLogProb, len(chunks))
+	for i := range logprobs {
+		logprobs[i] = TokenIDsWithLogProb{TokenIDs: []uint32{uint32(i)}, Logprobs: []float32{-1}}
+	}
+	options := []FilterOption{
+		HandleMultiHopCmd3(), StreamToolActions(), WithInclusiveStops([]string{"<stop>"}),
+		WithDocumentIDs([][]string{{"a", "b"}}), WithFinishReason(),
+	}
+
+	requireNoLeaks(t, func() {
+		f := NewFilter(options...)
+		for i, chunk := range chunks {
+			_, err := f.WriteDecoded(chunk, &logprobs[i])
+			require.NoError(t, err)
+		}
+		state, err := f.SaveState()
+		require.NoError(t, err)
+		_, err = f.FlushPartials()
+		require.NoError(t, err)
+
+		restored, err := RestoreFilter(state, options...)
+		require.NoError(t, err)
+		_, err = restored.WriteDecodedBatch(chunks, logprobs)
+		require.NoError(t, err)
+		_, err = restored.FlushPartials()
+		require.NoError(t, err)
+
+		_, err = RestoreFilter([]byte(`{"version": 1, "parser": {"version": 2}}`), options...)
+		require.Error(t, err)
+	})
+}
+
+func TestLeak_Render(t *testing.T) {
+	doc := orderedjson.New()
+	doc.Set("title", "Sky")
+	doc.Set("text", "The sky is blue.")
+	messages := []Message{
+		{Role: RoleSystem, Content: []Content{{Type: ContentText, Text: "Be brief."}}},
+		{Role: RoleUser, Content: []Content{
+			{Type: ContentText, Text: "What color is the sky?"},
+			{Type: ContentImage, Image: &Image{TemplatePlaceholder: "<image>"}},
+		}},
+		{Role: RoleChatbot, Content: []Content{{Type: ContentThinking, Thinking: "Search."}},
+			ToolCalls: []ToolCall{{ID: "0", Name: "search", Parameters: `{"query": "sky"}`}}},
+		{Role: RoleTool, ToolCallID: "0", Content: []Content{{Type: ContentDocument, Document: doc}}},
+		{Role: RoleChatbot, Content: []Content{{Type: ContentText, Text: "Blue."}},
+			Citations: []FilterCitation{{StartIndex: 0, EndIndex: 5, Text: "Blue.", Sources: []Source{{ToolCallIndex: 0, ToolResultIndices: []uint{0}}}}}},
+	}
+	params := orderedjson.New()
+	params.Set("type", "object")
+	tools := []Tool{{Name: "search", Description: "Searches the web", Parameters: params}}
+	safety := SafetyModeContextual
+
+	requireNoLeaks(t, func() {
+		// The results are not checked, only that rendering frees what it allocates
+		_, _ = RenderCMD3(RenderCmd3Options{Messages: messages, Documents: []orderedjson.Object{doc}, AvailableTools: tools, SafetyMode: &safety})
+		_, _ = RenderCMD4(RenderCmd4Options{Messages: messages, Documents: []orderedjson.Object{doc}, AvailableTools: tools})
+		_, err := RenderCMD3(RenderCmd3Options{Messages: []Message{{Role: RoleChatbot, ToolCalls: []ToolCall{{Name: "search"}}}}})
+		require.ErrorIs(t, err, ErrInvalidMessages)
+
+		_, err = BuildPreamble(&safety, nil, nil, nil)
+		require.NoError(t, err)
+		_, err = RenderFIM("a = ", "\nprint(a)", RenderFIMOptions{})
+		require.NoError(t, err)
+		_, err = NewDocumentIndexMap(messages, 1)
+		require.NoError(t, err)
+	})
+}
@@ -1,59 +1,571 @@
 package gobindings
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
 // Filter is the interface used to parse the output of a cohere model
 type Filter interface {
 	// WriteDecoded writes a decoded token string to the filter
 	// For raw text processing
 	WriteDecoded(decodedToken string, logprob *TokenIDsWithLogProb) ([]FilterOutput, error)
 
+	// WriteDecodedBatch writes several decoded token strings to the filter at once
+	WriteDecodedBatch(decodedTokens []string, logprobs []TokenIDsWithLogProb) ([]FilterOutput, error)
+
+	// WriteToken writes a token ID to the filter, decoded by the tokenizer set with
+	// WithTokenizer
+	WriteToken(id uint32, logprob *float32) ([]FilterOutput, error)
+
 	// FlushPartials flushes any partial outputs
 	FlushPartials() ([]FilterOutput, error)
+
+	// SaveState returns the parsing state of the filter, see RestoreFilter
+	SaveState() ([]byte, error)
+
+	// Rollback rewinds the filter to its state before the last n tokens written, see
+	// WithRollbackWindow
+	Rollback(n int) error
+
+	// RequestSoftStop asks the filter to end the stream at the next sentence boundary
+	RequestSoftStop()
+
+	// Resume marks a retry of the upstream stream, see WithDedupWindow
+	Resume()
+
+	// CurrentMode returns the mode the filter parses the next text in
+	CurrentMode() FilterMode
+
+	// Idle returns a channel closed once the timeout of WithIdleTimeout elapses without a
+	// write, CheckIdle then fails the stream
+	Idle() <-chan struct{}
+
+	// CheckIdle fails the stream if the timeout of WithIdleTimeout elapsed since the last
+	// write, as the next write would
+	CheckIdle() ([]FilterOutput, error)
 }
 
-// SyncFilter is a synchronous filter implementation
+// SyncFilter is a synchronous filter implementation. It parses a single token stream and
+// is not safe for concurrent use, callers sharing one between goroutines must serialize
+// the calls to WriteDecoded and FlushPartials
 type SyncFilter struct {
-	cfilter *cFilter
+	cfilter     *cFilter
+	documentIDs [][]string
+	rawTap      io.Writer
+	// tokenizer decodes the tokens written with WriteToken
+	tokenizer *tokenizers.Tokenizer
+	// sections maps the special tokens of formats with custom sections to their section,
+	// section is the custom section the filter is currently in
+	sections map[string]formatSection
+	section  *formatSection
+
+	maxBufferBytes int
+	idleTimeout    time.Duration
+	// lastWrite is the time of the last write, limitErr is set once a limit is exceeded
+	lastWrite time.Time
+	limitErr  *StreamLimitError
+	// idleTimer closes idle once idleTimeout elapses after the last write
+	idleTimer *time.Timer
+	idle      chan struct{}
+
+	// rawParams re-encodes the raw parameters of each tool call, see WithRawParamEncoding
+	rawParamEncoding *RawParamEncoding
+	rawParams        map[uint]*rawParamEncoder
+
+	// toolCallID generates the IDs of tool calls without one, toolCallsWithID holds the
+	// indices of the tool calls that have one, see WithToolCallIDGenerator
+	toolCallID      func(index int) string
+	toolCallsWithID map[uint]bool
+
+	// paramPaths splits the parameter values of each tool call, see WithNestedParamPaths
+	nestedParamPaths bool
+	paramPaths       map[uint]*paramPathScanner
+
+	// rollbackStates are the states before each of the last rollbackWindow tokens, oldest
+	// first, see WithRollbackWindow
+	rollbackWindow int
+	rollbackStates []rollbackState
+
+	// transform rewrites the text of the outputs, transformed holds the text it rewrote to
+	// move the citation indices, see WithOutputTransformer. The response text starts after
+	// responsePrefix.
+	transform         OutputTransformer
+	transformed       []transformedText
+	citationIndexUnit CitationIndexUnit
+	responsePrefix    string
+
+	// readinessTools are the tools of WithToolReadiness by name, toolReadiness follows the
+	// parameters of each tool call to them
+	readinessTools map[string]Tool
+	toolReadiness  map[uint]*toolCallReadiness
+
+	// markdown follows the markdown blocks of the text, see WithMarkdownState
+	markdownState bool
+	markdown      []markdownTracker
+
+	// languageWindows are the latest text of the response and of each thinking block, see
+	// WithLanguageDetection
+	languageDetection bool
+	languageWindows   []languageWindow
+
+	// latency stamps the outputs with their timing, see WithLatencyStamps
+	latency *latencyStamps
+
+	// citationLogprobsByText are the logprobs of the response and of each thinking block,
+	// which citationConfidence aggregates, see WithCitationConfidence
+	citationConfidence     *CitationConfidence
+	citationLogprobsByText []citationLogprobs
+
+	// emitted is the text of the response and of each thinking block, see
+	// WithCitationValidation
+	citationValidation bool
+	emitted            []emittedText
+
+	// zones are the zones of the text citations are dropped in, see
+	// WithCitationExclusionZones
+	citationExclusionZones []ZoneKind
+	zones                  []zoneTracker
+
+	// reasoningTokens are the tokens written in thinking blocks, see WithSuppressedReasoning
+	suppressedReasoning bool
+	reasoningTokens     int
+
+	// documentOrder maps the documents as rendered to the documents given, see
+	// WithDocumentOrder
+	documentOrder []int
+
+	// searchQueries are the search queries emitted, see WithSearchQueryDedup
+	searchQueryDedup bool
+	searchQueries    searchQueryDedup
+
+	// mode is the last mode reported with a ModeEvent, see WithModeEvents
+	modeEvents bool
+	mode       FilterMode
+
+	logger Logger
+	trace  *filterTrace
 }
 
-// NewFilter creates a new synchronous filter
+// NewFilter creates a new synchronous filter. It returns nil if the filter cannot be
+// created, e.g. for an unknown format or for conflicting options with WithStrictOptions,
+// whose conflicts are logged; TryNewFilter returns why instead.
 func NewFilter(options ...FilterOption) Filter {
+	cfg := newFilterConfig(options)
+	if cfg.strictOptions {
+		if err := cfg.validate(); err != nil {
+			cfg.logger.Error("conflicting filter options", Field{Key: "error", Value: err})
+			return nil
+		}
+	}
+	f, err := newSyncFilter(cfg)
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// TryNewFilter creates a new synchronous filter like NewFilter, but returns an error if it
+// cannot be created. With WithStrictOptions it returns the *OptionConflictError of
+// ValidateOptions if the options conflict.
+func TryNewFilter(options ...FilterOption) (Filter, error) {
+	cfg := newFilterConfig(options)
+	if cfg.strictOptions {
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := newSyncFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// newFilterConfig applies the options to a configuration, whose logger is set
+func newFilterConfig(options []FilterOption) *filterConfig {
 	cfg := &filterConfig{}
 	for _, opt := range options {
 		opt(cfg)
 	}
+	if cfg.logger == nil {
+		cfg.logger = nopLogger{}
+	}
+	return cfg
+}
+
+// newSyncFilter creates a filter with the configuration, then extra is applied to the
+// options of the Rust filter
+func newSyncFilter(cfg *filterConfig, extra ...func(*FilterOptions)) (*SyncFilter, error) {
+	handlers, err := cfg.formatHandlers()
+	if err != nil {
+		return nil, err
+	}
 
 	// Build FilterOptions using the builder pattern
 	opts := NewFilterOptions()
 	if opts == nil {
-		return nil
+		return nil, errors.New("failed to create the filter options")
 	}
 
 	// Apply configuration
-	cfg.apply(opts)
+	cfg.apply(opts, handlers)
+	for _, fn := range extra {
+		fn(opts)
+	}
 
 	// Create filter with configured options
 	cfilter := newCFilter(opts)
 	if cfilter == nil {
-		return nil
+		return nil, errors.New("failed to create the filter")
 	}
 
-	return &SyncFilter{
-		cfilter: cfilter,
+	var idle chan struct{}
+	if cfg.idleTimeout > 0 {
+		idle = make(chan struct{})
+	}
+	var latency *latencyStamps
+	if cfg.latencyStamps {
+		latency = &latencyStamps{}
 	}
+	responsePrefix := cfg.responsePrefix
+	if cfg.resume != nil {
+		responsePrefix = cfg.resume.PriorText
+	}
+	var readinessTools map[string]Tool
+	for _, t := range cfg.toolReadiness {
+		if readinessTools == nil {
+			readinessTools = make(map[string]Tool, len(cfg.toolReadiness))
+		}
+		readinessTools[t.Name] = t
+	}
+
+	return &SyncFilter{
+		cfilter:     cfilter,
+		documentIDs: cfg.documentIDs,
+		rawTap:      cfg.rawTap,
+		tokenizer:   cfg.tokenizer,
+		sections:    formatSections(handlers),
+
+		maxBufferBytes: cfg.maxBufferBytes,
+		idleTimeout:    cfg.idleTimeout,
+		idle:           idle,
+
+		rawParamEncoding: cfg.rawParamEncoding,
+
+		toolCallID:       cfg.toolCallIDGenerator,
+		nestedParamPaths: cfg.nestedParamPaths,
+		rollbackWindow:   cfg.rollbackWindow,
+
+		transform:         cfg.outputTransformer,
+		citationIndexUnit: cfg.citationIndexUnit,
+		responsePrefix:    responsePrefix,
+
+		readinessTools: readinessTools,
+		markdownState:  cfg.markdownState,
+
+		languageDetection: cfg.languageDetection,
+		latency:           latency,
+
+		citationConfidence: cfg.citationConfidence,
+
+		citationValidation:     cfg.citationValidation,
+		citationExclusionZones: cfg.citationExclusionZones,
+		suppressedReasoning:    cfg.suppressedReasoning,
+
+		documentOrder: cfg.documentOrder,
+
+		searchQueryDedup: cfg.searchQueryDedup,
+
+		modeEvents: cfg.modeEvents,
+		mode:       cfilter.currentMode(),
+
+		logger: cfg.logger,
+		trace:  newFilterTrace(cfg.tracer),
+	}, nil
 }
 
-// WriteDecoded writes a decoded token string to the filter
+// WriteDecoded writes a decoded token string to the filter. Once a limit set with
+// WithMaxBufferBytes or WithIdleTimeout is exceeded, it returns the force-flushed outputs
+// with a *StreamLimitError, and only the error on every later call.
+//
+// The TopLogProbs of logprob, the alternatives of its tokens, are carried to the outputs
+// of the tokens with their log probabilities.
 func (f *SyncFilter) WriteDecoded(decodedToken string, logprob *TokenIDsWithLogProb) ([]FilterOutput, error) {
+	return f.write(1, func() ([]FilterOutput, error) {
+		return f.modeEvent(f.writeDecoded(decodedToken, logprob))
+	})
+}
+
+// WriteDecodedBatch writes decoded tokens to the filter and returns the outputs of all of
+// them, as calling WriteDecoded for each would. The tokens cross the cgo boundary in a
+// single call, which saves its cost per token when tokens arrive in chunks. logprobs is
+// either nil or has the log probabilities of every token.
+//
+// The limits are checked once per batch, so a batch exceeding WithMaxBufferBytes is parsed
+// in full before the filter is force-flushed.
+func (f *SyncFilter) WriteDecodedBatch(decodedTokens []string, logprobs []TokenIDsWithLogProb) ([]FilterOutput, error) {
+	if logprobs != nil && len(logprobs) != len(decodedTokens) {
+		return nil, fmt.Errorf("got %d log probabilities for %d tokens", len(logprobs), len(decodedTokens))
+	}
+	return f.write(len(decodedTokens), func() ([]FilterOutput, error) {
+		if len(f.sections) > 0 || f.rollbackWindow > 0 || f.modeEvents || f.suppressedReasoning || hasTopLogProbs(logprobs) {
+			// The tokens of custom sections are routed in Go one by one, the Go state is
+			// saved before each token for Rollback, and the mode is checked after each
+			// token for WithModeEvents and WithSuppressedReasoning. The batch call does not
+			// carry top log probabilities.
+			var out []FilterOutput
+			for i, token := range decodedTokens {
+				var lp *TokenIDsWithLogProb
+				if logprobs != nil {
+					lp = &logprobs[i]
+				}
+				o, err := f.modeEvent(f.writeDecoded(token, lp))
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, o...)
+			}
+			return out, nil
+		}
+
+		if f.rawTap != nil {
+			for _, token := range decodedTokens {
+				if _, err := io.WriteString(f.rawTap, token); err != nil {
+					return nil, fmt.Errorf("failed to write to raw tap: %w", err)
+				}
+			}
+		}
+		out, err := f.cfilter.writeDecodedBatch(decodedTokens, logprobs)
+		if err != nil {
+			return nil, err
+		}
+		return f.postprocess(out)
+	})
+}
+
+// hasTopLogProbs reports whether any token has top log probabilities
+func hasTopLogProbs(logprobs []TokenIDsWithLogProb) bool {
+	for _, lp := range logprobs {
+		if len(lp.TopLogProbs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteToken writes a token ID to the filter, decoded by the Rust tokenizer set with
+// WithTokenizer so the token text is never copied into Go. Tokens that end with an
+// incomplete UTF-8 sequence are held back until the next ones complete it. The limits
+// apply as with WriteDecoded.
+//
+// A filter written to with WriteToken does not support WithRawTap or formats with
+// custom sections, which read the decoded tokens in Go.
+func (f *SyncFilter) WriteToken(id uint32, logprob *float32) ([]FilterOutput, error) {
+	if f.tokenizer == nil {
+		return nil, errors.New("WriteToken requires a filter created WithTokenizer")
+	}
+	if f.rawTap != nil || len(f.sections) > 0 {
+		return nil, errors.New("WriteToken does not support WithRawTap or formats with custom sections")
+	}
+	return f.write(1, func() ([]FilterOutput, error) {
+		f.pushRollbackState()
+		if f.suppressedReasoning {
+			defer f.countReasoningToken(f.CurrentMode())
+		}
+		out, err := f.cfilter.writeToken(f.tokenizer.Handle(), id, logprob)
+		if err != nil {
+			f.popRollbackState()
+			return nil, err
+		}
+		return f.modeEvent(f.postprocess(out))
+	})
+}
+
+// write applies the limits of the filter around a write of tokens tokens
+func (f *SyncFilter) write(tokens int, write func() ([]FilterOutput, error)) ([]FilterOutput, error) {
 	if f.cfilter == nil {
 		return nil, nil
 	}
+	if f.limitErr != nil {
+		return nil, f.limitErr
+	}
+
+	now := time.Now()
+	defer f.trace.write(now)
+	if f.idleElapsed(now) {
+		out, err := f.exceedLimit(LimitIdleTimeout)
+		f.latency.stamp(now, 0, out, false)
+		return out, err
+	}
+	f.lastWrite = now
+	f.armIdleTimer()
+
+	out, err := write()
+	if err != nil {
+		return nil, err
+	}
+	if f.maxBufferBytes > 0 && f.cfilter.bufferedBytes() > f.maxBufferBytes {
+		flushed, err := f.exceedLimit(LimitMaxBufferBytes)
+		out = append(out, flushed...)
+		f.latency.stamp(now, tokens, out, false)
+		return out, err
+	}
+	if f.latency != nil {
+		f.latency.stamp(now, tokens, out, f.cfilter.bufferedBytes() > 0)
+	}
+	return out, nil
+}
+
+// idleElapsed returns whether the idle timeout elapsed since the last write
+func (f *SyncFilter) idleElapsed(now time.Time) bool {
+	if f.idleTimeout <= 0 || f.lastWrite.IsZero() {
+		return false
+	}
+	select {
+	case <-f.idle:
+		return true
+	default:
+		return now.Sub(f.lastWrite) > f.idleTimeout
+	}
+}
+
+// armIdleTimer restarts the idle timeout after a write. A timer that already fired is not
+// restarted, idle stays closed and the stream fails at the next check.
+func (f *SyncFilter) armIdleTimer() {
+	if f.idleTimeout <= 0 {
+		return
+	}
+	if f.idleTimer == nil {
+		idle := f.idle
+		f.idleTimer = time.AfterFunc(f.idleTimeout, func() { close(idle) })
+		return
+	}
+	if f.idleTimer.Stop() {
+		f.idleTimer.Reset(f.idleTimeout)
+	}
+}
+
+// stopIdleTimer stops the idle timeout once the stream ended
+func (f *SyncFilter) stopIdleTimer() {
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+	}
+}
+
+// Idle returns a channel closed once the timeout of WithIdleTimeout elapses after a write,
+// so callers waiting for the next token can also wait for it and call CheckIdle. The filter
+// is not safe for concurrent use, so it is not flushed when the timeout elapses but at the
+// next call. Idle returns nil without WithIdleTimeout.
+func (f *SyncFilter) Idle() <-chan struct{} {
+	return f.idle
+}
+
+// CheckIdle fails the stream if the timeout of WithIdleTimeout elapsed since the last
+// write, as the next write would: it returns the force-flushed outputs with a
+// *StreamLimitError. It returns nothing if the timeout did not elapse.
+func (f *SyncFilter) CheckIdle() ([]FilterOutput, error) {
+	if f.cfilter == nil {
+		return nil, nil
+	}
+	if f.limitErr != nil {
+		return nil, f.limitErr
+	}
+	now := time.Now()
+	if !f.idleElapsed(now) {
+		return nil, nil
+	}
+	out, err := f.exceedLimit(LimitIdleTimeout)
+	f.latency.stamp(now, 0, out, false)
+	return out, err
+}
+
+// exceedLimit force-flushes the filter and fails the stream with a StreamLimitError
+func (f *SyncFilter) exceedLimit(limit StreamLimit) ([]FilterOutput, error) {
+	f.limitErr = &StreamLimitError{Limit: limit}
+	f.stopIdleTimer()
+	f.logger.Warn("filter stream exceeded a limit", Field{Key: "limit", Value: string(limit)})
+	out, err := f.flushPartials()
+	if err != nil {
+		f.trace.end(err)
+		return nil, err
+	}
+	f.trace.end(f.limitErr)
+	return out, f.limitErr
+}
+
+func (f *SyncFilter) writeDecoded(decodedToken string, logprob *TokenIDsWithLogProb) ([]FilterOutput, error) {
+	f.pushRollbackState()
+	if f.suppressedReasoning {
+		defer f.countReasoningToken(f.CurrentMode())
+	}
+	if f.rawTap != nil {
+		if _, err := io.WriteString(f.rawTap, decodedToken); err != nil {
+			f.popRollbackState()
+			return nil, fmt.Errorf("failed to write to raw tap: %w", err)
+		}
+	}
+
+	if s, ok := f.sections[decodedToken]; ok {
+		if s.mode >= FilterModeCustom {
+			f.logger.Debug("entering custom section", Field{Key: "token", Value: decodedToken})
+			f.section = &s
+			return nil, nil
+		}
+		f.section = nil
+	} else if f.section != nil {
+		out, err := f.section.handler.HandleSection(f.section.mode, []byte(decodedToken))
+		if err != nil {
+			f.popRollbackState()
+			return nil, err
+		}
+		return f.postprocess(out)
+	}
 
 	var lp TokenIDsWithLogProb
 	if logprob != nil {
 		lp = *logprob
 	}
 
-	return f.cfilter.writeDecoded(decodedToken, lp)
+	out, err := f.cfilter.writeDecoded(decodedToken, lp)
+	if err != nil {
+		f.popRollbackState()
+		return nil, err
+	}
+	return f.postprocess(out)
+}
+
+// CurrentMode returns the mode the filter parses the next text in: the default mode of its
+// format until a special token switches it, or the custom mode of the section of a format
+// registered with RegisterFormat the filter is in
+func (f *SyncFilter) CurrentMode() FilterMode {
+	if f.section != nil {
+		return f.section.mode
+	}
+	if f.cfilter == nil {
+		return FilterModePlainText
+	}
+	return f.cfilter.currentMode()
+}
+
+// modeEvent appends an output with a ModeEvent to the outputs of a write that switched the
+// mode of a filter created WithModeEvents
+func (f *SyncFilter) modeEvent(out []FilterOutput, err error) ([]FilterOutput, error) {
+	if !f.modeEvents || err != nil {
+		return out, err
+	}
+	if mode := f.CurrentMode(); mode != f.mode {
+		f.logger.Debug("filter mode changed", Field{Key: "mode", Value: mode})
+		out = append(out, FilterOutput{ModeEvent: &FilterModeEvent{From: f.mode, To: mode}})
+		f.mode = mode
+	}
+	return out, nil
 }
 
 // FlushPartials flushes any partial outputs
@@ -61,6 +573,198 @@ func (f *SyncFilter) FlushPartials() ([]FilterOutput, error) {
 	if f.cfilter == nil {
 		return nil, nil
 	}
+	if f.limitErr != nil {
+		return nil, f.limitErr
+	}
+	f.stopIdleTimer()
+	span := f.trace.flush()
+	out, err := f.flushPartials()
+	if err == nil {
+		err = f.closeRawParams()
+	}
+	endSpan(span, err)
+	f.trace.end(err)
+	if err != nil {
+		return nil, err
+	}
+	f.latency.stamp(time.Now(), 0, out, false)
+	return f.latency.summarize(f.reportReasoningTokens(out)), nil
+}
+
+// RequestSoftStop asks the filter to wind the stream down, e.g. when moderation flags it
+// mid-generation: the text goes on until the end of the current sentence, or of the next
+// one if the text so far ends one, then the stream ends as if an exclusive stop matched,
+// with a FinishReasonExclusiveStop finish output if WithFinishReason is set. Tool calls,
+// search queries and other outputs that are not text end the stream before them. The end
+// of a sentence is only known once the next one starts, so the stream ends with the first
+// token of the next sentence or at the flush. The text of custom sections is not stopped.
+func (f *SyncFilter) RequestSoftStop() {
+	if f.cfilter == nil {
+		return
+	}
+	f.cfilter.requestSoftStop()
+}
+
+// Resume marks a retry of the upstream stream, which may start by replaying tokens already
+// written: the answer text written next is held back until its overlap with the end of the
+// text emitted is known, then the overlap and the citations it repeats are dropped and the
+// indices of later text and citations continue the emitted text. It does nothing without
+// WithDedupWindow. The text of custom sections is not deduplicated.
+func (f *SyncFilter) Resume() {
+	if f.cfilter == nil {
+		return
+	}
+	f.cfilter.resume()
+}
+
+func (f *SyncFilter) flushPartials() ([]FilterOutput, error) {
+	var out []FilterOutput
+	var err error
+	if f.tokenizer != nil {
+		// Also flush the tokens held back by WriteToken
+		out, err = f.cfilter.flushTokens(f.tokenizer.Handle())
+	} else {
+		out, err = f.cfilter.flushPartials()
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err = f.postprocess(out)
+	if err != nil {
+		return nil, err
+	}
+	return f.endSearchQueries(out), nil
+}
+
+// postprocess applies the Go side options to the outputs of the filter
+func (f *SyncFilter) postprocess(outputs []FilterOutput) ([]FilterOutput, error) {
+	f.scoreCitations(outputs)
+	f.transformOutputs(outputs)
+	f.excludeCitations(outputs)
+	outputs = f.validateCitations(outputs)
+	outputs = f.suppressReasoning(outputs)
+	f.trackMarkdown(outputs)
+	f.detectLanguages(outputs)
+	f.remapDocumentIndices(outputs)
+	f.resolveDocumentIDs(outputs)
+	f.generateToolCallIDs(outputs)
+	f.reportToolReadiness(outputs)
+	outputs = f.dedupSearchQueries(outputs)
+	if err := f.encodeRawParams(outputs); err != nil {
+		return nil, err
+	}
+	return f.splitParamPaths(outputs), nil
+}
+
+// generateToolCallIDs sets a generated ID on the first tool name delta of every tool call
+// the model did not write an ID for. The ID of a tool call always precedes its name.
+func (f *SyncFilter) generateToolCallIDs(outputs []FilterOutput) {
+	if f.toolCallID == nil {
+		return
+	}
+	for i := range outputs {
+		d := outputs[i].ToolCallDelta
+		if d == nil || f.toolCallsWithID[d.Index] {
+			continue
+		}
+		if d.ID == "" && d.Name == "" {
+			continue
+		}
+		if f.toolCallsWithID == nil {
+			f.toolCallsWithID = make(map[uint]bool)
+		}
+		f.toolCallsWithID[d.Index] = true
+		if d.ID == "" {
+			d.ID = f.toolCallID(int(d.Index))
+			d.IDSynthesized = true
+		}
+	}
+}
+
+// rawParamEncoder re-encodes the raw parameters of a tool call into buf
+type rawParamEncoder struct {
+	buf bytes.Buffer
+	enc *orderedjson.Encoder
+}
+
+// encodeRawParams replaces the RawParamDelta of every tool call delta in outputs with its
+// re-encoded form
+func (f *SyncFilter) encodeRawParams(outputs []FilterOutput) error {
+	if f.rawParamEncoding == nil {
+		return nil
+	}
+	for i := range outputs {
+		d := outputs[i].ToolCallDelta
+		if d == nil || d.RawParamDelta == "" {
+			continue
+		}
+		e, ok := f.rawParams[d.Index]
+		if !ok {
+			e = &rawParamEncoder{}
+			opts := []orderedjson.EncoderOption{orderedjson.WithIndent("", f.rawParamEncoding.Indent)}
+			if f.rawParamEncoding.Strict {
+				opts = append(opts, orderedjson.WithStrict())
+			}
+			e.enc = orderedjson.NewEncoder(&e.buf, opts...)
+			if f.rawParams == nil {
+				f.rawParams = make(map[uint]*rawParamEncoder)
+			}
+			f.rawParams[d.Index] = e
+		}
+		if _, err := e.enc.Write([]byte(d.RawParamDelta)); err != nil {
+			return fmt.Errorf("tool call %d: %w", d.Index, err)
+		}
+		d.RawParamDelta = e.buf.String()
+		e.buf.Reset()
+	}
+	return nil
+}
+
+// closeRawParams ends the raw parameters of every tool call, which fails on incomplete
+// parameters when the encoding is strict
+func (f *SyncFilter) closeRawParams() error {
+	for idx, e := range f.rawParams {
+		if err := e.enc.Close(); err != nil {
+			return fmt.Errorf("tool call %d: %w", idx, err)
+		}
+	}
+	return nil
+}
 
-	return f.cfilter.flushPartials()
+// resolveDocumentIDs populates the DocumentIDs of every citation in outputs
+func (f *SyncFilter) resolveDocumentIDs(outputs []FilterOutput) {
+	if f.documentIDs == nil {
+		return
+	}
+	for i := range outputs {
+		for j := range outputs[i].Citations {
+			c := &outputs[i].Citations[j]
+			c.DocumentIDs = f.documentIDsForSources(c.Sources)
+		}
+	}
+}
+
+// documentIDsForSources maps citation sources to document IDs, skipping indices that are out of range
+func (f *SyncFilter) documentIDsForSources(sources []Source) []string {
+	var res []string
+	for _, s := range sources {
+		// The document IDs are per tool call, sources citing a tool by name have no index
+		if s.SourceName != "" {
+			continue
+		}
+		if s.ToolCallIndex >= uint(len(f.documentIDs)) {
+			f.logger.Warn("citation source has no document IDs", Field{Key: "tool_call_index", Value: s.ToolCallIndex})
+			continue
+		}
+		toolIDs := f.documentIDs[s.ToolCallIndex]
+		for _, idx := range s.ToolResultIndices {
+			if idx >= uint(len(toolIDs)) {
+				f.logger.Warn("citation source has no document ID",
+					Field{Key: "tool_call_index", Value: s.ToolCallIndex}, Field{Key: "tool_result_index", Value: idx})
+				continue
+			}
+			res = append(res, toolIDs[idx])
+		}
+	}
+	return res
 }
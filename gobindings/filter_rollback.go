@@ -0,0 +1,144 @@
+package gobindings
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// rollbackState is the state of the Go side of a SyncFilter before a token, the state of
+// the parser is kept by the Rust filter
+type rollbackState struct {
+	section          *formatSection
+	toolCallsWithID  map[uint]bool
+	paramPaths       map[uint]*paramPathScanner
+	transformed      []transformedText
+	toolReadiness    map[uint]*toolCallReadiness
+	markdown         []markdownTracker
+	languageWindows  []languageWindow
+	citationLogprobs []citationLogprobs
+	emitted          []emittedText
+	zones            []zoneTracker
+	reasoningTokens  int
+	searchQueries    searchQueryDedup
+	// mode is the mode last reported with a ModeEvent, and latency the timing of the text
+	// held back, see WithModeEvents and WithLatencyStamps
+	mode    FilterMode
+	latency latencyStamps
+}
+
+// pushRollbackState saves the state before a token, dropping the oldest state once the
+// rollback window is full
+func (f *SyncFilter) pushRollbackState() {
+	if f.rollbackWindow <= 0 {
+		return
+	}
+	if len(f.rollbackStates) == f.rollbackWindow {
+		f.rollbackStates = slices.Delete(f.rollbackStates, 0, 1)
+	}
+	s := rollbackState{
+		section:         f.section,
+		toolCallsWithID: maps.Clone(f.toolCallsWithID),
+		languageWindows: slices.Clone(f.languageWindows),
+		emitted:         slices.Clone(f.emitted),
+		reasoningTokens: f.reasoningTokens,
+		searchQueries:   f.searchQueries.clone(),
+		mode:            f.mode,
+	}
+	if f.latency != nil {
+		s.latency = latencyStamps{pending: f.latency.pending, tokens: f.latency.tokens}
+	}
+	for _, t := range f.transformed {
+		// The edits are only appended to, a clipped slice keeps those before the token
+		t.Edits = slices.Clip(t.Edits)
+		s.transformed = append(s.transformed, t)
+	}
+	for _, l := range f.citationLogprobsByText {
+		l.Spans, l.Pending = slices.Clip(l.Spans), slices.Clip(l.Pending)
+		s.citationLogprobs = append(s.citationLogprobs, l)
+	}
+	for idx, p := range f.paramPaths {
+		if s.paramPaths == nil {
+			s.paramPaths = make(map[uint]*paramPathScanner, len(f.paramPaths))
+		}
+		s.paramPaths[idx] = p.clone()
+	}
+	for idx, r := range f.toolReadiness {
+		if s.toolReadiness == nil {
+			s.toolReadiness = make(map[uint]*toolCallReadiness, len(f.toolReadiness))
+		}
+		s.toolReadiness[idx] = r.clone()
+	}
+	for _, t := range f.markdown {
+		s.markdown = append(s.markdown, t.clone())
+	}
+	for _, t := range f.zones {
+		s.zones = append(s.zones, t.clone())
+	}
+	f.rollbackStates = append(f.rollbackStates, s)
+}
+
+// popRollbackState drops the state saved before a token the filter did not read
+func (f *SyncFilter) popRollbackState() {
+	if len(f.rollbackStates) > 0 {
+		f.rollbackStates = f.rollbackStates[:len(f.rollbackStates)-1]
+	}
+}
+
+// Rollback rewinds the filter to its state before the last n tokens written, e.g. when
+// speculative decoding retracts accepted tokens, so the stream goes on with the corrected
+// tokens without recreating the filter and replaying it. The outputs already returned for
+// the rolled back tokens are not retracted, and a raw tap set with WithRawTap keeps them.
+//
+// n is bounded by the window set with WithRollbackWindow and by the number of tokens
+// written. It fails once a limit set with WithMaxBufferBytes or WithIdleTimeout is
+// exceeded, for formats with custom sections, and for a filter created
+// WithRawParamEncoding once a tool call has started.
+func (f *SyncFilter) Rollback(n int) error {
+	if f.cfilter == nil {
+		return errors.New("filter is closed")
+	}
+	if f.limitErr != nil {
+		return f.limitErr
+	}
+	if len(f.sections) > 0 {
+		return errors.New("Rollback does not support formats with custom sections")
+	}
+	if len(f.rawParams) > 0 {
+		return errors.New("the raw parameter encoding of a tool call cannot be rolled back")
+	}
+	if n < 0 || n > len(f.rollbackStates) {
+		return &Error{
+			Kind:    ErrorKindInvalidArgument,
+			Message: fmt.Sprintf("cannot roll back %d tokens, only the last %d can be rolled back", n, len(f.rollbackStates)),
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	if err := f.cfilter.rollback(n); err != nil {
+		return fmt.Errorf("failed to roll back the filter: %w", err)
+	}
+	s := f.rollbackStates[len(f.rollbackStates)-n]
+	f.rollbackStates = f.rollbackStates[:len(f.rollbackStates)-n]
+	f.section = s.section
+	f.toolCallsWithID = s.toolCallsWithID
+	f.paramPaths = s.paramPaths
+	f.transformed = s.transformed
+	f.toolReadiness = s.toolReadiness
+	f.markdown = s.markdown
+	f.languageWindows = s.languageWindows
+	f.citationLogprobsByText = s.citationLogprobs
+	f.emitted = s.emitted
+	f.zones = s.zones
+	f.reasoningTokens = s.reasoningTokens
+	f.searchQueries = s.searchQueries
+	f.mode = s.mode
+	if f.latency != nil {
+		// The latencies of the outputs already emitted are kept
+		f.latency.pending, f.latency.tokens = s.latency.pending, s.latency.tokens
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package gobindings_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+func TestFilter_Rollback(t *testing.T) {
+	t.Parallel()
+
+	options := []melody.FilterOption{
+		melody.HandleMultiHopCmd3(), melody.StreamToolActions(), melody.StreamProcessedParams(),
+		melody.WithNestedParamPaths(), melody.WithToolCallIDGenerator(nil), melody.WithRollbackWindow(3),
+	}
+	chunks := []string{
+		"<|START_RESPONSE|>", "The ", "<co>", "sky", "</co: 0:[1]>", " is blue.<|END_RESPONSE|>",
+		"<|START_ACTION|>", `[{"tool_name": "search", "parameters": {"filters": {"da`,
+		`te": "2024"}, "li`, `mit": 5}}]`, "<|END_ACTION|>",
+	}
+	rejected := []string{"<|END_RESPONSE|>", `x"}, "b": {`, "<co>"}
+
+	for split := range len(chunks) + 1 {
+		f := melody.NewFilter(options...)
+		_, err := f.WriteDecodedBatch(chunks[:split], nil)
+		require.NoError(t, err)
+		want, err := f.WriteDecodedBatch(chunks[split:], nil)
+		require.NoError(t, err)
+		out, err := f.FlushPartials()
+		require.NoError(t, err)
+		want = append(want, out...)
+
+		// The rejected tokens leave no trace in the rest of the stream
+		for n := 1; n <= len(rejected); n++ {
+			f := melody.NewFilter(options...)
+			_, err := f.WriteDecodedBatch(chunks[:split], nil)
+			require.NoError(t, err)
+			_, err = f.WriteDecodedBatch(rejected[:n], nil)
+			require.NoError(t, err)
+			require.NoError(t, f.Rollback(n))
+
+			var got []melody.FilterOutput
+			for _, chunk := range chunks[split:] {
+				out, err := f.WriteDecoded(chunk, nil)
+				require.NoError(t, err)
+				got = append(got, out...)
+			}
+			out, err := f.FlushPartials()
+			require.NoError(t, err)
+			got = append(got, out...)
+			require.Equal(t, want, got, "split at %d, %d rejected", split, n)
+		}
+	}
+
+	f := melody.NewFilter(options...)
+	_, err := f.WriteDecodedBatch(chunks[:2], nil)
+	require.NoError(t, err)
+	err = f.Rollback(3)
+	require.ErrorIs(t, err, melody.ErrInvalidArgument)
+	require.EqualError(t, err, "cannot roll back 3 tokens, only the last 2 can be rolled back")
+	_, err = f.WriteDecodedBatch(chunks[2:], nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, f.Rollback(4), melody.ErrInvalidArgument)
+	require.NoError(t, f.Rollback(0))
+
+	// Without a window nothing can be rolled back
+	f = melody.NewFilter(melody.HandleMultiHopCmd3())
+	_, err = f.WriteDecoded("<|START_THINKING|>", nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, f.Rollback(1), melody.ErrInvalidArgument)
+}
+
+// tokenFailingWriter fails the writes of the token fail
+type tokenFailingWriter struct {
+	fail string
+}
+
+func (w tokenFailingWriter) Write(p []byte) (int, error) {
+	if string(p) == w.fail {
+		return 0, errors.New("write failed")
+	}
+	return len(p), nil
+}
+
+func TestFilter_RollbackModeChange(t *testing.T) {
+	t.Parallel()
+
+	options := []melody.FilterOption{
+		melody.HandleMultiHopCmd3(), melody.WithRollbackWindow(2), melody.WithModeEvents(),
+		melody.WithLatencyStamps(), melody.WithRawTap(tokenFailingWriter{fail: "<fail>"}),
+	}
+	modeEvents := func(out []melody.FilterOutput) []melody.FilterModeEvent {
+		var events []melody.FilterModeEvent
+		for _, o := range out {
+			if o.ModeEvent != nil {
+				events = append(events, *o.ModeEvent)
+			}
+		}
+		return events
+	}
+
+	f := melody.NewFilter(options...)
+	initial := f.CurrentMode()
+	out, err := f.WriteDecoded("<|START_THINKING|>", nil)
+	require.NoError(t, err)
+	want := modeEvents(out)
+	require.Len(t, want, 1)
+
+	// A failed write leaves nothing to roll back, the rollback crosses the mode change
+	_, err = f.WriteDecoded("<fail>", nil)
+	require.Error(t, err)
+	require.NoError(t, f.Rollback(1))
+	require.Equal(t, initial, f.CurrentMode())
+
+	out, err = f.WriteDecoded("<|START_THINKING|>", nil)
+	require.NoError(t, err)
+	require.Equal(t, want, modeEvents(out))
+
+	// The rolled back tokens are not counted
+	_, err = f.WriteDecoded("Hi", nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Rollback(1))
+	out, err = f.FlushPartials()
+	require.NoError(t, err)
+	require.Equal(t, 1, out[len(out)-1].LatencySummary.Tokens)
+}
@@ -0,0 +1,176 @@
+package gobindings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// filterStateVersion is the version of the encoding of a saved SyncFilter. It changes
+// whenever a field is renamed or removed.
+const filterStateVersion = 2
+
+// filterState is the encoding of the state of a SyncFilter
+type filterState struct {
+	Version int `json:"version"`
+	// Parser is the state of the Rust filter, which has its own version
+	Parser json.RawMessage `json:"parser"`
+	// Section is the mode of the custom section the filter is in, if any
+	Section         *FilterMode                `json:"section,omitempty"`
+	ToolCallsWithID []uint                     `json:"tool_calls_with_id,omitempty"`
+	ParamPaths      map[uint]paramScannerState `json:"param_paths,omitempty"`
+	// TransformedText is the text rewritten by the output transformer, see
+	// WithOutputTransformer
+	TransformedText []transformedText `json:"transformed_text,omitempty"`
+	// ToolReadiness are the parameters of the tool calls read, see WithToolReadiness
+	ToolReadiness map[uint]*toolCallReadiness `json:"tool_readiness,omitempty"`
+	// Markdown are the markdown blocks of the text read, see WithMarkdownState
+	Markdown []markdownTracker `json:"markdown,omitempty"`
+	// LanguageWindows are the latest text read, see WithLanguageDetection
+	LanguageWindows []languageWindow `json:"language_windows,omitempty"`
+	// CitationLogprobs are the logprobs of the text read, see WithCitationConfidence
+	CitationLogprobs []citationLogprobs `json:"citation_logprobs,omitempty"`
+	// EmittedText is the text emitted, see WithCitationValidation
+	EmittedText []emittedText `json:"emitted_text,omitempty"`
+	// CitationZones are the zones of the text read, see WithCitationExclusionZones
+	CitationZones []zoneTracker `json:"citation_zones,omitempty"`
+	// ReasoningTokens are the tokens of the thinking blocks, see WithSuppressedReasoning
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+	// SearchQueries are the search queries read, see WithSearchQueryDedup
+	SearchQueries *searchQueryDedup `json:"search_queries,omitempty"`
+}
+
+// paramScannerState is the encoding of a paramPathScanner between two chunks
+type paramScannerState struct {
+	Path    []string             `json:"path"`
+	Objects int                  `json:"objects"`
+	Depth   int                  `json:"depth"`
+	Failed  bool                 `json:"failed,omitempty"`
+	Decoder *orderedjson.Decoder `json:"decoder,omitempty"`
+}
+
+// SaveState returns the parsing state of the filter: its buffers, mode, citation indices
+// and the tool calls being parsed. A filter created with RestoreFilter from the state
+// resumes the stream, e.g. on another instance of a service.
+//
+// It fails once a limit set with WithMaxBufferBytes or WithIdleTimeout is exceeded, and
+// for a filter created WithRawParamEncoding once a tool call has started.
+func (f *SyncFilter) SaveState() ([]byte, error) {
+	if f.cfilter == nil {
+		return nil, errors.New("filter is closed")
+	}
+	if f.limitErr != nil {
+		return nil, f.limitErr
+	}
+	if len(f.rawParams) > 0 {
+		return nil, errors.New("the raw parameter encoding of a tool call cannot be saved")
+	}
+
+	parser, err := f.cfilter.saveState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save the filter state: %w", err)
+	}
+	state := filterState{
+		Version:         filterStateVersion,
+		Parser:          parser,
+		ToolCallsWithID: slices.Sorted(maps.Keys(f.toolCallsWithID)),
+		TransformedText: f.transformed,
+		ToolReadiness:   f.toolReadiness,
+		Markdown:        f.markdown,
+		LanguageWindows: f.languageWindows,
+
+		CitationLogprobs: f.citationLogprobsByText,
+		EmittedText:      f.emitted,
+		CitationZones:    f.zones,
+		ReasoningTokens:  f.reasoningTokens,
+	}
+	if f.section != nil {
+		state.Section = &f.section.mode
+	}
+	if f.searchQueryDedup {
+		state.SearchQueries = &f.searchQueries
+	}
+	for idx, s := range f.paramPaths {
+		if state.ParamPaths == nil {
+			state.ParamPaths = make(map[uint]paramScannerState, len(f.paramPaths))
+		}
+		p := paramScannerState{Path: s.path, Objects: s.objects, Depth: s.depth, Failed: s.failed}
+		if !s.failed {
+			p.Decoder = s.dec
+		}
+		state.ParamPaths[idx] = p
+	}
+	return json.Marshal(state)
+}
+
+// RestoreFilter creates a filter that resumes the stream of a filter saved with SaveState.
+// The options must be those of the saved filter, the state only holds what the filter
+// read from the stream.
+func RestoreFilter(state []byte, options ...FilterOption) (Filter, error) {
+	var s filterState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return nil, fmt.Errorf("invalid filter state: %w", err)
+	}
+	if s.Version > filterStateVersion {
+		return nil, fmt.Errorf("unsupported filter state version %d, the latest is %d", s.Version, filterStateVersion)
+	}
+
+	filter, err := TryNewFilter(options...)
+	if err != nil {
+		return nil, err
+	}
+	f := filter.(*SyncFilter)
+	if err := f.cfilter.restoreState(s.Parser); err != nil {
+		return nil, fmt.Errorf("failed to restore the filter state: %w", err)
+	}
+
+	if s.Section != nil {
+		for _, section := range f.sections {
+			if section.mode == *s.Section {
+				f.section = &section
+				break
+			}
+		}
+		if f.section == nil {
+			return nil, fmt.Errorf("no format of the options has the section %d", *s.Section)
+		}
+	}
+	f.mode = f.CurrentMode()
+	f.transformed = s.TransformedText
+	f.toolReadiness = s.ToolReadiness
+	f.markdown = s.Markdown
+	f.languageWindows = s.LanguageWindows
+	f.citationLogprobsByText = s.CitationLogprobs
+	f.emitted = s.EmittedText
+	f.zones = s.CitationZones
+	f.reasoningTokens = s.ReasoningTokens
+	if s.SearchQueries != nil {
+		f.searchQueries = *s.SearchQueries
+	}
+	for _, idx := range s.ToolCallsWithID {
+		if f.toolCallsWithID == nil {
+			f.toolCallsWithID = make(map[uint]bool)
+		}
+		f.toolCallsWithID[idx] = true
+	}
+	for idx, p := range s.ParamPaths {
+		if f.paramPaths == nil {
+			f.paramPaths = make(map[uint]*paramPathScanner)
+		}
+		if p.Decoder == nil && !p.Failed {
+			return nil, fmt.Errorf("the state of the parameter paths of tool call %d has no decoder", idx)
+		}
+		f.paramPaths[idx] = &paramPathScanner{
+			dec:     p.Decoder,
+			path:    p.Path,
+			objects: p.Objects,
+			depth:   p.Depth,
+			failed:  p.Failed,
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,63 @@
+package gobindings_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+func TestRestoreFilter(t *testing.T) {
+	t.Parallel()
+
+	options := []melody.FilterOption{
+		melody.HandleMultiHopCmd3(), melody.StreamToolActions(), melody.StreamProcessedParams(),
+		melody.WithNestedParamPaths(), melody.WithToolCallIDGenerator(nil),
+	}
+	chunks := []string{
+		"<|START_RESPONSE|>", "The ", "<co>", "sky", "</co: 0:[1]>", " is blue.<|END_RESPONSE|>",
+		"<|START_ACTION|>", `[{"tool_name": "search", "parameters": {"filters": {"da`,
+		`te": "2024"}, "li`, `mit": 5}}]`, "<|END_ACTION|>",
+	}
+	write := func(f melody.Filter, chunks []string) []melody.FilterOutput {
+		var outputs []melody.FilterOutput
+		for _, chunk := range chunks {
+			out, err := f.WriteDecoded(chunk, nil)
+			require.NoError(t, err)
+			outputs = append(outputs, out...)
+		}
+		return outputs
+	}
+
+	f := melody.NewFilter(options...)
+	want := write(f, chunks)
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	want = append(want, out...)
+
+	for split := range len(chunks) + 1 {
+		f := melody.NewFilter(options...)
+		got := write(f, chunks[:split])
+		state, err := f.SaveState()
+		require.NoError(t, err)
+
+		restored, err := melody.RestoreFilter(state, options...)
+		require.NoError(t, err)
+		got = append(got, write(restored, chunks[split:])...)
+		out, err := restored.FlushPartials()
+		require.NoError(t, err)
+		got = append(got, out...)
+		require.Equal(t, want, got, "split at %d", split)
+	}
+}
+
+func TestRestoreFilter_InvalidState(t *testing.T) {
+	t.Parallel()
+
+	_, err := melody.RestoreFilter([]byte(`{"version": 3}`))
+	require.EqualError(t, err, "unsupported filter state version 3, the latest is 2")
+
+	_, err = melody.RestoreFilter([]byte(`{"version": 1, "parser": {"version": 2}}`))
+	require.ErrorContains(t, err, "unsupported filter state version 2")
+}
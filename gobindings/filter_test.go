@@ -2,12 +2,22 @@ package gobindings_test
 
 import (
 	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
 	"github.com/cohere-ai/melody/gobindings/tokenizers"
 )
 
@@ -154,6 +164,1496 @@ func TestFilter_Command3(t *testing.T) {
 				out = append(out, outputs...)
 			}
 			require.Equal(t, tt.want, out)
+
+			// Writing the token IDs decodes them in Rust to the same outputs
+			f = melody.NewFilter(append(slices.Clone(tt.options), melody.WithTokenizer(tkzr))...)
+			out = []melody.FilterOutput{}
+			for i, token := range tokens {
+				outputs, err := f.WriteToken(token, &tt.likelihoods[i])
+				require.NoError(t, err)
+				out = append(out, outputs...)
+			}
+			require.Equal(t, tt.want, out)
+		})
+	}
+}
+
+func TestFilter_WriteTokenRequiresTokenizer(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3())
+	_, err := f.WriteToken(1, nil)
+	require.EqualError(t, err, "WriteToken requires a filter created WithTokenizer")
+
+	f = melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithTokenizer(&tokenizers.Tokenizer{}),
+		melody.WithRawTap(io.Discard))
+	_, err = f.WriteToken(1, nil)
+	require.EqualError(t, err, "WriteToken does not support WithRawTap or formats with custom sections")
+}
+
+func TestFilter_DocumentIDs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		input       string
+		documentIDs [][]string
+		want        [][]string
+	}{
+		{
+			name:        "single tool call",
+			input:       "foo <co>bar</co: 0:[1,0]>",
+			documentIDs: [][]string{{"doc_a", "doc_b"}},
+			want:        [][]string{{"doc_b", "doc_a"}},
+		},
+		{
+			name:        "multiple tool calls",
+			input:       "foo <co>bar</co: 0:[1],1:[0]> <co>baz</co: 1:[1]>",
+			documentIDs: [][]string{{"doc_a", "doc_b"}, {"doc_c", "doc_d"}},
+			want:        [][]string{{"doc_b", "doc_c"}, {"doc_d"}},
+		},
+		{
+			name:        "out of range indices are skipped",
+			input:       "foo <co>bar</co: 0:[0,5],3:[0]> <co>baz</co: 2:[0]>",
+			documentIDs: [][]string{{"doc_a"}},
+			want:        [][]string{{"doc_a"}, nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithDocumentIDs(tt.documentIDs))
+			out, err := f.WriteDecoded(tt.input, nil)
+			require.NoError(t, err)
+			flushed, err := f.FlushPartials()
+			require.NoError(t, err)
+			out = append(out, flushed...)
+
+			var got [][]string
+			for _, o := range out {
+				for _, c := range o.Citations {
+					got = append(got, c.DocumentIDs)
+				}
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFilter_Logger(t *testing.T) {
+	t.Parallel()
+
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithDocumentIDs([][]string{{"doc_a"}}),
+		melody.WithLogger(melody.NewSlogLogger(logger)))
+	_, err := f.WriteDecoded("foo <co>bar</co: 0:[0,5],3:[0]>", nil)
+	require.NoError(t, err)
+	_, err = f.FlushPartials()
+	require.NoError(t, err)
+	require.Equal(t, `level=WARN msg="citation source has no document ID" tool_call_index=0 tool_result_index=5
+level=WARN msg="citation source has no document IDs" tool_call_index=3
+`, logs.String())
+}
+
+func TestFilter_RawTap(t *testing.T) {
+	t.Parallel()
+
+	chunks := []string{"<|START_THINKING|>", "Plan", "<|END_THINKING|>", "<|START_RESPONSE|>", "foo <co>bar</co: 0:[1]>", "<|END_RESPONSE|>"}
+
+	var raw strings.Builder
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithRawTap(&raw))
+	var text strings.Builder
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text.WriteString(o.Text)
+		}
+	}
+
+	require.Equal(t, strings.Join(chunks, ""), raw.String())
+	require.Equal(t, "Planfoo bar", text.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestFilter_RawTapError(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithRawTap(failingWriter{}))
+	_, err := f.WriteDecoded("foo", nil)
+	require.ErrorContains(t, err, "disk full")
+}
+
+func TestFilter_MaxBufferBytes(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithMaxBufferBytes(8))
+	for _, chunk := range []string{"<|START_RESPONSE|>", "foo", " <", "|", "START"} {
+		_, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+	}
+
+	// the partial special token never terminates and is force-flushed past the limit
+	out, err := f.WriteDecoded("_", nil)
+	var limitErr *melody.StreamLimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, melody.LimitMaxBufferBytes, limitErr.Limit)
+	require.Len(t, out, 1)
+	require.Equal(t, " <|START_", out[0].Text)
+
+	out, err = f.WriteDecoded("RESPONSE", nil)
+	require.ErrorAs(t, err, &limitErr)
+	require.Empty(t, out)
+	_, err = f.FlushPartials()
+	require.ErrorAs(t, err, &limitErr)
+}
+
+func TestFilter_IdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithIdleTimeout(10*time.Millisecond))
+	_, err := f.WriteDecoded("<|START_RESPONSE|>", nil)
+	require.NoError(t, err)
+	_, err = f.WriteDecoded("foo <", nil)
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	out, err := f.WriteDecoded("bar", nil)
+	var limitErr *melody.StreamLimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, melody.LimitIdleTimeout, limitErr.Limit)
+	require.Equal(t, "filter stream exceeded its idle timeout", err.Error())
+	var text strings.Builder
+	for _, o := range out {
+		text.WriteString(o.Text)
+	}
+	require.Equal(t, "foo <", text.String())
+}
+
+func TestFilter_IdleTimeoutWithoutWrite(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithIdleTimeout(10*time.Millisecond))
+	_, err := f.WriteDecoded("<|START_RESPONSE|>", nil)
+	require.NoError(t, err)
+	_, err = f.WriteDecoded("foo <", nil)
+	require.NoError(t, err)
+	out, err := f.CheckIdle()
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	// The producer stalls, the timeout fires without a write
+	select {
+	case <-f.Idle():
+	case <-time.After(time.Second):
+		t.Fatal("the idle timeout did not fire")
+	}
+	out, err = f.CheckIdle()
+	var limitErr *melody.StreamLimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, melody.LimitIdleTimeout, limitErr.Limit)
+	var text strings.Builder
+	for _, o := range out {
+		text.WriteString(o.Text)
+	}
+	require.Equal(t, "foo <", text.String())
+
+	_, err = f.WriteDecoded("bar", nil)
+	require.ErrorAs(t, err, &limitErr)
+
+	// Without the option there is no timeout to wait for
+	require.Nil(t, melody.NewFilter(melody.HandleMultiHopCmd3()).Idle())
+}
+
+func TestFilter_SpecialTokenMap(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(
+		melody.HandleMultiHopCmd3(),
+		melody.WithSpecialTokenMap(map[string]melody.FilterMode{
+			"<|START_TOOL_CALLS|>": melody.FilterModeToolAction,
+			"<|END_TOOL_CALLS|>":   melody.FilterModeIgnore,
+		}),
+	)
+
+	chunks := []string{
+		"<|START_RESPONSE|>", "foo", "<|END_RESPONSE|>",
+		"<|START_TOOL_CALLS|>", `[{"tool_call_id": "0", "tool_name": "add", "parameters": {}}]`, "<|END_TOOL_CALLS|>",
+	}
+	var text, toolName strings.Builder
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text.WriteString(o.Text)
+			if o.ToolCallDelta != nil {
+				toolName.WriteString(o.ToolCallDelta.Name)
+			}
+		}
+	}
+
+	require.Equal(t, "foo", text.String())
+	require.Equal(t, "add", toolName.String())
+}
+
+// shoutFormat is a format with a custom section whose text is upper cased
+type shoutFormat struct{}
+
+func (shoutFormat) Configure(opts *melody.FilterOptions) {}
+
+func (shoutFormat) SpecialTokens() map[string]melody.FilterMode {
+	return map[string]melody.FilterMode{
+		"<|START_SHOUT|>": melody.FilterModeCustom,
+		"<|END_SHOUT|>":   melody.FilterModePlainText,
+	}
+}
+
+func (shoutFormat) HandleSection(mode melody.FilterMode, text []byte) ([]melody.FilterOutput, error) {
+	return []melody.FilterOutput{{Text: strings.ToUpper(string(text))}}, nil
+}
+
+func TestFilter_RegisterFormat(t *testing.T) {
+	t.Parallel()
+
+	melody.RegisterFormat("test_shout", shoutFormat{})
+	require.Contains(t, melody.Formats(), "test_shout")
+	require.Contains(t, melody.Formats(), "cmd3")
+	require.Panics(t, func() { melody.RegisterFormat("test_shout", shoutFormat{}) })
+
+	f := melody.NewFilter(melody.WithFormat("test_shout"))
+	require.NotNil(t, f)
+
+	var text []string
+	for _, chunk := range []string{"hello", "<|START_SHOUT|>", "quiet", " please", "<|END_SHOUT|>", " bye"} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text = append(text, o.Text)
+		}
+	}
+	require.Equal(t, []string{"hello", "QUIET", " PLEASE", " bye"}, text)
+
+	require.Nil(t, melody.NewFilter(melody.WithFormat("unknown")))
+}
+
+func TestFilter_FormatPresetOrder(t *testing.T) {
+	t.Parallel()
+
+	parse := func(options ...melody.FilterOption) []melody.FilterOutput {
+		f := melody.NewFilter(options...)
+		var outputs []melody.FilterOutput
+		for _, chunk := range []string{"Plan", "<|START_RESPONSE|>", "Hello", "<|END_RESPONSE|>", "<|START_ANSWER|>", "Bye", "<|END_ANSWER|>"} {
+			out, err := f.WriteDecoded(chunk, nil)
+			require.NoError(t, err)
+			outputs = append(outputs, out...)
+		}
+		out, err := f.FlushPartials()
+		require.NoError(t, err)
+		return append(outputs, out...)
+	}
+
+	// The presets apply in a fixed order, whatever the order of their options, and once
+	want := parse(melody.HandleMultiHopCmd3(), melody.HandleMultiHopCmd4(), melody.HandleRAG(), melody.HandleSearchQuery(), melody.HandleMultiHop())
+	require.NotEmpty(t, want)
+	require.Equal(t, want, parse(melody.HandleMultiHop(), melody.HandleSearchQuery(), melody.HandleRAG(), melody.HandleMultiHopCmd4(), melody.HandleMultiHopCmd3()))
+	require.Equal(t, want, parse(melody.HandleMultiHopCmd3(), melody.HandleMultiHopCmd4(), melody.HandleRAG(), melody.HandleSearchQuery(), melody.HandleMultiHop(), melody.HandleMultiHopCmd3()))
+}
+
+func TestDescribeFormat(t *testing.T) {
+	t.Parallel()
+
+	cmd3, err := melody.DescribeFormat("cmd3")
+	require.NoError(t, err)
+	require.Equal(t, "cmd3", cmd3.Name)
+	require.Equal(t, melody.FilterModeGroundedAnswer.String(), cmd3.DefaultMode)
+	require.Contains(t, cmd3.SpecialTokens, melody.FormatToken{Token: "<|START_THINKING|>", Mode: "tool_reason"})
+	require.Contains(t, cmd3.CitationSyntax, "</co: ")
+	require.Contains(t, cmd3.ToolCallShape, `"tool_name"`)
+
+	search, err := melody.DescribeFormat("search_query")
+	require.NoError(t, err)
+	require.Empty(t, search.ToolCallShape)
+
+	melody.RegisterFormat("test_describe_shout", shoutFormat{})
+	shout, err := melody.DescribeFormat("test_describe_shout")
+	require.NoError(t, err)
+	require.Equal(t, []melody.FormatToken{
+		{Token: "<|END_SHOUT|>", Mode: "plain_text"},
+		{Token: "<|START_SHOUT|>", Mode: "custom_256"},
+	}, shout.SpecialTokens)
+	require.Len(t, shout.Sections, 1)
+
+	_, err = melody.DescribeFormat("unknown")
+	require.EqualError(t, err, `unknown format "unknown"`)
+}
+
+func TestFilter_HandleFIM(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleFIM(melody.FIMFamilyStarCoder))
+	require.NotNil(t, f)
+
+	var text strings.Builder
+	for _, chunk := range []string{"<fim_middle>", "c = a", " + b", "<|endoftext|>", "ignored"} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text.WriteString(o.Text)
+		}
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	for _, o := range out {
+		text.WriteString(o.Text)
+	}
+	require.Equal(t, "c = a + b", text.String())
+}
+
+func TestFilter_CitationIndexUnit(t *testing.T) {
+	t.Parallel()
+
+	// the ZWJ sequence is split across chunks and the citation has a combining accent
+	chunks := []string{"<|START_RESPONSE|>", "hi \U0001F468\u200D", "\U0001F469 <co>", "e\u0301t\u00E9", "</co: 0:[1]>"}
+	tests := []struct {
+		unit       melody.CitationIndexUnit
+		start, end uint
+	}{
+		{melody.CitationIndexRunes, 7, 11},
+		{melody.CitationIndexGraphemes, 5, 8},
+		{melody.CitationIndexUTF16, 9, 13},
+		{melody.CitationIndexBytes, 15, 21},
+	}
+	for _, tt := range tests {
+		f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithCitationIndexUnit(tt.unit))
+		var citations []melody.FilterCitation
+		for _, chunk := range chunks {
+			out, err := f.WriteDecoded(chunk, nil)
+			require.NoError(t, err)
+			for _, o := range out {
+				citations = append(citations, o.Citations...)
+			}
+		}
+		require.Len(t, citations, 1)
+		require.Equal(t, tt.start, citations[0].StartIndex, "unit %d", tt.unit)
+		require.Equal(t, tt.end, citations[0].EndIndex, "unit %d", tt.unit)
+	}
+}
+
+func TestFilter_CitationSourceFormat(t *testing.T) {
+	t.Parallel()
+
+	chunks := []string{"<|START_RESPONSE|>", "The <co>", "sky", "</co: web_", "search:[2],1:[0]>", " is blue."}
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithCitationSourceFormat(melody.CitationSourceToolName),
+		melody.WithDocumentIDs([][]string{{"a", "b", "c"}}))
+	var citations []melody.FilterCitation
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			citations = append(citations, o.Citations...)
+		}
+	}
+	require.Equal(t, []melody.FilterCitation{{
+		StartIndex: 4,
+		EndIndex:   7,
+		Text:       "sky",
+		Sources: []melody.Source{
+			{ToolResultIndices: []uint{2}, SourceName: "web_search"},
+			{ToolCallIndex: 1, ToolResultIndices: []uint{0}},
+		},
+	}}, citations)
+
+	// Tool names are dropped in the default format
+	f = melody.NewFilter(melody.HandleMultiHopCmd3())
+	citations = nil
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			citations = append(citations, o.Citations...)
+		}
+	}
+	require.Len(t, citations, 1)
+	require.Equal(t, []melody.Source{{ToolCallIndex: 1, ToolResultIndices: []uint{0}}}, citations[0].Sources)
+}
+
+func TestFilter_SentenceCitations(t *testing.T) {
+	t.Parallel()
+
+	chunks := []string{"<|START_RESPONSE|>", "The <co>sky</co: 0:[1]> is ", "<co>blue</co: 0:[2],1:[0]>", ". Grass", " is green."}
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithSentenceCitations())
+	var citations []melody.FilterCitation
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			citations = append(citations, o.Citations...)
+		}
+	}
+	// The citation is emitted once the next sentence starts
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	for _, o := range out {
+		require.Empty(t, o.Citations)
+	}
+	require.Equal(t, []melody.FilterCitation{{
+		StartIndex: 0,
+		EndIndex:   16,
+		Text:       "The sky is blue.",
+		Sources: []melody.Source{
+			{ToolCallIndex: 0, ToolResultIndices: []uint{1, 2}},
+			{ToolCallIndex: 1, ToolResultIndices: []uint{0}},
+		},
+	}}, citations)
+}
+
+func TestFilter_RequestSoftStop(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithFinishReason())
+	var text strings.Builder
+	var finishes []melody.FilterFinish
+	for i, chunk := range []string{"<|START_RESPONSE|>The sky is", " blue. It", " is cloudy.<|END_RESPONSE|>"} {
+		if i == 1 {
+			f.RequestSoftStop()
+		}
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text.WriteString(o.Text)
+			if o.Finish != nil {
+				finishes = append(finishes, *o.Finish)
+			}
+		}
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	require.Empty(t, out)
+	require.Equal(t, "The sky is blue.", text.String())
+	require.Equal(t, []melody.FilterFinish{{Reason: melody.FinishReasonExclusiveStop}}, finishes)
+}
+
+func TestFilter_DedupWindow(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithDedupWindow(32))
+	var text strings.Builder
+	var citations []melody.FilterCitation
+	for i, chunk := range []string{"<|START_RESPONSE|>The sky is ", "<co>blue</co: 0:[1]>", " is <co>blue</co: 0:[1]>", " today."} {
+		if i == 2 {
+			// The upstream retried and replays " is blue"
+			f.Resume()
+		}
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text.WriteString(o.Text)
+			citations = append(citations, o.Citations...)
+		}
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	for _, o := range out {
+		text.WriteString(o.Text)
+	}
+	require.Equal(t, "The sky is blue today.", text.String())
+	require.Len(t, citations, 1)
+	require.Equal(t, uint(11), citations[0].StartIndex)
+}
+
+func TestFilter_UnicodeNormalization(t *testing.T) {
+	t.Parallel()
+
+	collect := func(opts ...melody.FilterOption) string {
+		f := melody.NewFilter(opts...)
+		out, err := f.WriteDecoded("Cafe\u0301 au lait", nil)
+		require.NoError(t, err)
+		flushed, err := f.FlushPartials()
+		require.NoError(t, err)
+		var sb strings.Builder
+		for _, o := range append(out, flushed...) {
+			sb.WriteString(o.Text)
+		}
+		return sb.String()
+	}
+	require.Equal(t, "Caf\u00e9 au lait", collect(melody.WithUnicodeNormalization(melody.UnicodeNormalizationNFC)))
+	require.Equal(t, "Cafe\u0301 au lait", collect())
+}
+
+func TestFilter_PrefixTrim(t *testing.T) {
+	t.Parallel()
+
+	collect := func(tokens ...string) string {
+		f := melody.NewFilter(melody.WithPrefixTrim("Answer: "))
+		var sb strings.Builder
+		for _, token := range tokens {
+			out, err := f.WriteDecoded(token, nil)
+			require.NoError(t, err)
+			for _, o := range out {
+				sb.WriteString(o.Text)
+			}
+		}
+		return sb.String()
+	}
+	// The prefix is dropped across tokens, text that only starts like it is kept
+	require.Equal(t, "It is sunny", collect("Ans", "wer", ": It", " is sunny"))
+	require.Equal(t, "Answers vary", collect("Ans", "wers vary"))
+}
+
+func TestFilter_TopLogProbs(t *testing.T) {
+	t.Parallel()
+
+	tokens := []string{"<|START_RESPONSE|>", "The ", "<co>", "sky", "</co: 0:[1]>", " is blue.", "<|END_RESPONSE|>"}
+	logprobs := make([]melody.TokenIDsWithLogProb, len(tokens))
+	var want []melody.TopLogProbs
+	for i := range logprobs {
+		top := melody.TopLogProbs{TokenIDs: []uint32{uint32(i), uint32(i + 100)}, Logprobs: []float32{-float32(i), -float32(i) - 1}}
+		logprobs[i] = melody.TokenIDsWithLogProb{TokenIDs: []uint32{uint32(i)}, Logprobs: []float32{-float32(i)}, TopLogProbs: []melody.TopLogProbs{top}}
+		if i > 0 && i < len(tokens)-1 {
+			want = append(want, top)
+		}
+	}
+
+	check := func(out []melody.FilterOutput) {
+		var got []melody.TopLogProbs
+		for _, o := range out {
+			require.Len(t, o.Logprobs.TopLogProbs, len(o.Logprobs.TokenIDs))
+			got = append(got, o.Logprobs.TopLogProbs...)
+		}
+		require.Equal(t, want, got)
+	}
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3())
+	var out []melody.FilterOutput
+	for i, token := range tokens {
+		o, err := f.WriteDecoded(token, &logprobs[i])
+		require.NoError(t, err)
+		out = append(out, o...)
+	}
+	check(out)
+
+	f = melody.NewFilter(melody.HandleMultiHopCmd3())
+	out, err := f.WriteDecodedBatch(tokens, logprobs)
+	require.NoError(t, err)
+	check(out)
+}
+
+func TestFilter_OutputTransformer(t *testing.T) {
+	t.Parallel()
+
+	email := regexp.MustCompile(`[\w.]+@[\w.]+\w`)
+	redact := func(text string) (string, []melody.Redaction) {
+		var redactions []melody.Redaction
+		for _, m := range email.FindAllStringIndex(text, -1) {
+			redactions = append(redactions, melody.Redaction{Start: m[0], End: m[1], Replacement: "[EMAIL]", Kind: "email"})
+		}
+		return email.ReplaceAllString(text, "[EMAIL]"), redactions
+	}
+	tokens := []string{
+		"<|START_RESPONSE|>", "Mail alice@example.com: ", "<co>", "sky", "</co: 0:[1]>",
+		" or <co>bob@example.com</co: 0:[2]>", " é", "<|END_RESPONSE|>",
+	}
+	options := []melody.FilterOption{melody.HandleMultiHopCmd3(), melody.WithOutputTransformer(redact)}
+
+	check := func(out []melody.FilterOutput) {
+		var text strings.Builder
+		var citations []melody.FilterCitation
+		var redactions []melody.Redaction
+		for _, o := range out {
+			text.WriteString(o.Text)
+			citations = append(citations, o.Citations...)
+			redactions = append(redactions, o.Redactions...)
+		}
+		require.Equal(t, "Mail [EMAIL]: sky or [EMAIL] é", text.String())
+		require.Equal(t, []melody.Redaction{
+			{Start: 5, End: 22, Replacement: "[EMAIL]", Kind: "email"},
+			{Start: 4, End: 19, Replacement: "[EMAIL]", Kind: "email"},
+		}, redactions)
+		require.Len(t, citations, 2)
+		runes := []rune(text.String())
+		for i, want := range []string{"sky", "[EMAIL]"} {
+			c := citations[i]
+			require.Equal(t, want, c.Text)
+			require.Equal(t, want, string(runes[c.StartIndex:c.EndIndex]))
+		}
+	}
+
+	f := melody.NewFilter(options...)
+	var out []melody.FilterOutput
+	for _, token := range tokens {
+		o, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		out = append(out, o...)
+	}
+	check(out)
+
+	// The rewritten text is kept in the saved state
+	f = melody.NewFilter(options...)
+	out = nil
+	for i, token := range tokens {
+		if i == 3 {
+			state, err := f.SaveState()
+			require.NoError(t, err)
+			f, err = melody.RestoreFilter(state, options...)
+			require.NoError(t, err)
+		}
+		o, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		out = append(out, o...)
+	}
+	check(out)
+}
+
+func TestFilter_FinishReason(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.WithExclusiveStops([]string{"STOP"}), melody.WithFinishReason())
+	out, err := f.WriteDecoded("foo STOP bar", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, out)
+	require.Equal(t, &melody.FilterFinish{Reason: melody.FinishReasonExclusiveStop, StopSequence: "STOP"}, out[len(out)-1].Finish)
+	out, err = f.FlushPartials()
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	f = melody.NewFilter(melody.WithFinishReason())
+	_, err = f.WriteDecoded("foo", nil)
+	require.NoError(t, err)
+	out, err = f.FlushPartials()
+	require.NoError(t, err)
+	require.Equal(t, &melody.FilterFinish{Reason: melody.FinishReasonFlush}, out[len(out)-1].Finish)
+}
+
+func TestFilter_ConditionalStops(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.WithFinishReason(),
+		melody.WithConditionalStops([]melody.ConditionalStop{{Stop: "BAD", Context: melody.StopContextPlainText}}))
+	var text strings.Builder
+	var finish *melody.FilterFinish
+	for _, token := range []string{"Run:\n```sh\n", "BAD\n", "```\n", "Not BAD", " here"} {
+		out, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text.WriteString(o.Text)
+			if o.Finish != nil {
+				finish = o.Finish
+			}
+		}
+	}
+	require.Equal(t, "Run:\n```sh\nBAD\n```\nNot ", text.String())
+	require.Equal(t, &melody.FilterFinish{Reason: melody.FinishReasonExclusiveStop, StopSequence: "BAD"}, finish)
+}
+
+func TestFilter_LatencyStamps(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.WithExclusiveStops([]string{"STOP"}), melody.WithLatencyStamps())
+	first := time.Now()
+	out, err := f.WriteDecoded("foo", nil)
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	require.False(t, out[0].Timing.WrittenAt.Before(first))
+	require.False(t, out[0].Timing.EmittedAt.Before(out[0].Timing.WrittenAt))
+
+	// The text held back keeps the time of its write
+	held := time.Now()
+	out, err = f.WriteDecoded(" ST", nil)
+	require.NoError(t, err)
+	require.Empty(t, out)
+	time.Sleep(10 * time.Millisecond)
+	out, err = f.WriteDecoded("ing", nil)
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	require.Equal(t, " STing", out[0].Text)
+	require.False(t, out[0].Timing.WrittenAt.Before(held))
+	require.GreaterOrEqual(t, out[0].Timing.EmittedAt.Sub(out[0].Timing.WrittenAt), 10*time.Millisecond)
+
+	out, err = f.FlushPartials()
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	summary := out[0].LatencySummary
+	require.NotNil(t, summary)
+	require.Equal(t, 3, summary.Tokens)
+	require.Equal(t, 2, summary.Chunks)
+	require.LessOrEqual(t, summary.P50, summary.P95)
+}
+
+func TestFilter_CitationConfidence(t *testing.T) {
+	t.Parallel()
+
+	tokens := []string{"<|START_RESPONSE|>", "It is ", "<co>", "sun", "ny", "</co: 0:[1]>", " today."}
+	confidence := func(agg melody.CitationConfidence, restoreAt int) float64 {
+		options := []melody.FilterOption{melody.HandleMultiHopCmd3(), melody.WithCitationConfidence(agg)}
+		f := melody.NewFilter(options...)
+		var citations []melody.FilterCitation
+		for i, token := range tokens {
+			if i == restoreAt {
+				state, err := f.SaveState()
+				require.NoError(t, err)
+				f, err = melody.RestoreFilter(state, options...)
+				require.NoError(t, err)
+			}
+			logprobs := &melody.TokenIDsWithLogProb{TokenIDs: []uint32{uint32(i)}, Logprobs: []float32{-0.1 * float32(i)}}
+			out, err := f.WriteDecoded(token, logprobs)
+			require.NoError(t, err)
+			for _, o := range out {
+				citations = append(citations, o.Citations...)
+			}
+		}
+		require.Len(t, citations, 1)
+		require.Equal(t, "sunny", citations[0].Text)
+		require.NotNil(t, citations[0].Confidence)
+		return *citations[0].Confidence
+	}
+
+	// The tokens of "sun", "ny" and the end of the citation
+	require.InDelta(t, math.Exp(-0.4), confidence(melody.CitationConfidenceMean, -1), 1e-6)
+	require.InDelta(t, math.Exp(-0.5), confidence(melody.CitationConfidenceMin, -1), 1e-6)
+	require.InDelta(t, math.Exp(-0.4), confidence(melody.CitationConfidenceMean, 4), 1e-6)
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithCitationConfidence(melody.CitationConfidenceMean))
+	var out []melody.FilterOutput
+	for _, token := range tokens {
+		o, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		out = append(out, o...)
+	}
+	for _, o := range out {
+		for _, c := range o.Citations {
+			require.Nil(t, c.Confidence)
+		}
+	}
+}
+
+func TestFilter_CitationValidation(t *testing.T) {
+	t.Parallel()
+
+	write := func(tokens []string, options ...melody.FilterOption) []melody.FilterOutput {
+		f := melody.NewFilter(append([]melody.FilterOption{melody.HandleMultiHopCmd3(), melody.WithCitationValidation()}, options...)...)
+		var out []melody.FilterOutput
+		for _, token := range tokens {
+			o, err := f.WriteDecoded(token, nil)
+			require.NoError(t, err)
+			out = append(out, o...)
+		}
+		o, err := f.FlushPartials()
+		require.NoError(t, err)
+		return append(out, o...)
+	}
+	citations := func(out []melody.FilterOutput) ([]melody.FilterCitation, []melody.InvalidCitation) {
+		var valid []melody.FilterCitation
+		var invalid []melody.InvalidCitation
+		for _, o := range out {
+			valid = append(valid, o.Citations...)
+			invalid = append(invalid, o.InvalidCitations...)
+		}
+		return valid, invalid
+	}
+
+	tokens := []string{
+		"<|START_THINKING|>", "I will <co>check</co: 0:[0]>.", "<|END_THINKING|>",
+		"<|START_RESPONSE|>", "It is 🌞 ", "<co>", "sun", "ny", "</co: 0:[1]>", " today.", "<|END_RESPONSE|>",
+	}
+	for _, unit := range []melody.CitationIndexUnit{melody.CitationIndexRunes, melody.CitationIndexUTF16, melody.CitationIndexBytes, melody.CitationIndexGraphemes} {
+		valid, invalid := citations(write(tokens, melody.WithCitationIndexUnit(unit)))
+		require.Len(t, valid, 2, "unit %d", unit)
+		require.Empty(t, invalid, "unit %d", unit)
+	}
+	valid, invalid := citations(write(tokens[4:], melody.WithResponsePrefix("Well, ")))
+	require.Len(t, valid, 1)
+	require.Empty(t, invalid)
+
+	// A transformer rewriting every chunk moves the indices to the chunks, not the text
+	exclaim := func(text string) (string, []melody.Redaction) { return text + "!", nil }
+	out := write(tokens[3:], melody.WithOutputTransformer(exclaim))
+	valid, invalid = citations(out)
+	require.Empty(t, valid)
+	require.Len(t, invalid, 1)
+	require.Equal(t, "sunny!", invalid[0].Citation.Text)
+	require.Contains(t, invalid[0].Reason, `slice "sun!ny!"`)
+	for i, o := range out {
+		if o.InvalidCitations != nil {
+			require.Equal(t, melody.FilterOutput{InvalidCitations: o.InvalidCitations}, o)
+			require.Positive(t, i)
+		}
+	}
+}
+
+func TestFilter_CitationExclusionZones(t *testing.T) {
+	t.Parallel()
+
+	tokens := []string{
+		"<|START_RESPONSE|>", "Use <co>sort</co: 0:[0]>:\n", "```go\n", "x := <co>sort.Ints(a)</co: 0:[1]>\n",
+		"```\n", "Or `<co>slices</co: 0:[2]>`, $<co>n</co: 0:[3]>^2$ and $5 <co>now</co: 0:[4]>.", "<|END_RESPONSE|>",
+	}
+	cited := func(restoreAt int, options ...melody.FilterOption) []string {
+		options = append([]melody.FilterOption{melody.HandleMultiHopCmd3()}, options...)
+		f := melody.NewFilter(options...)
+		var texts []string
+		for i, token := range append(tokens, "") {
+			if i == restoreAt {
+				state, err := f.SaveState()
+				require.NoError(t, err)
+				f, err = melody.RestoreFilter(state, options...)
+				require.NoError(t, err)
+			}
+			var out []melody.FilterOutput
+			var err error
+			if token == "" {
+				out, err = f.FlushPartials()
+			} else {
+				out, err = f.WriteDecoded(token, nil)
+			}
+			require.NoError(t, err)
+			for _, o := range out {
+				for _, c := range o.Citations {
+					texts = append(texts, c.Text)
+				}
+			}
+		}
+		return texts
+	}
+
+	all := []string{"sort", "sort.Ints(a)", "slices", "n", "now"}
+	require.Equal(t, all, cited(-1))
+	require.Equal(t, []string{"sort", "now"}, cited(-1, melody.WithCitationExclusionZones(melody.ZoneCodeFence, melody.ZoneInlineCode, melody.ZoneMath)))
+	require.Equal(t, []string{"sort", "now"}, cited(3, melody.WithCitationExclusionZones(melody.ZoneCodeFence, melody.ZoneInlineCode, melody.ZoneMath)))
+	require.Equal(t, []string{"sort", "slices", "n", "now"}, cited(-1, melody.WithCitationExclusionZones(melody.ZoneCodeFence)))
+
+	// The indices of the citations after a zone still slice the text
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithCitationExclusionZones(melody.ZoneCodeFence), melody.WithCitationValidation())
+	for _, token := range tokens {
+		out, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			require.Empty(t, o.InvalidCitations)
+		}
+	}
+}
+
+func TestFilter_SuppressedReasoning(t *testing.T) {
+	t.Parallel()
+
+	tokens := []string{
+		"<|START_THINKING|>", "I will ", "<co>", "check", "</co: 0:[0]>", ".", "<|END_THINKING|>",
+		"<|START_RESPONSE|>", "It is ", "<co>", "sunny", "</co: 0:[1]>", ".", "<|END_RESPONSE|>",
+	}
+	write := func(options ...melody.FilterOption) []melody.FilterOutput {
+		options = append([]melody.FilterOption{melody.HandleMultiHopCmd3()}, options...)
+		f := melody.NewFilter(options...)
+		var out []melody.FilterOutput
+		for i, token := range tokens {
+			if i == 3 {
+				state, err := f.SaveState()
+				require.NoError(t, err)
+				f, err = melody.RestoreFilter(state, options...)
+				require.NoError(t, err)
+			}
+			o, err := f.WriteDecoded(token, nil)
+			require.NoError(t, err)
+			out = append(out, o...)
+		}
+		o, err := f.FlushPartials()
+		require.NoError(t, err)
+		return append(out, o...)
+	}
+
+	var want []melody.FilterOutput
+	for _, o := range write() {
+		if !o.IsReasoning {
+			want = append(want, o)
+		}
+	}
+	// The flush has no outputs, the tokens are reported on an output of their own
+	out := write(melody.WithSuppressedReasoning())
+	require.Equal(t, append(want, melody.FilterOutput{ReasoningTokens: 5}), out)
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithSuppressedReasoning())
+	out, err := f.WriteDecodedBatch(tokens[:7], nil)
+	require.NoError(t, err)
+	require.Empty(t, out)
+	out, err = f.FlushPartials()
+	require.NoError(t, err)
+	require.Equal(t, []melody.FilterOutput{{ReasoningTokens: 5}}, out)
+}
+
+func TestFilter_ModeEvents(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithModeEvents())
+	require.Equal(t, melody.FilterModeGroundedAnswer, f.CurrentMode())
+
+	var events []melody.FilterModeEvent
+	for _, token := range []string{
+		"<|START_THINKING|>", "I will check.", "<|END_THINKING|>",
+		"<|START_RESPONSE|>", "It is sunny.", "<|END_RESPONSE|>",
+	} {
+		out, err := f.WriteDecoded(token, nil)
+		require.NoError(t, err)
+		for i, o := range out {
+			if o.ModeEvent != nil {
+				require.Equal(t, len(out)-1, i, "the mode event is the last output of the write")
+				require.Equal(t, o.ModeEvent.To, f.CurrentMode())
+				events = append(events, *o.ModeEvent)
+			}
+		}
+	}
+	require.Equal(t, []melody.FilterModeEvent{
+		{From: melody.FilterModeGroundedAnswer, To: melody.FilterModeToolReason},
+		{From: melody.FilterModeToolReason, To: melody.FilterModeGroundedAnswer},
+		{From: melody.FilterModeGroundedAnswer, To: melody.FilterModeIgnore},
+	}, events)
+
+	// Without WithModeEvents the mode is only queried
+	f = melody.NewFilter(melody.HandleMultiHopCmd3())
+	out, err := f.WriteDecodedBatch([]string{"<|START_ACTION|>", "["}, nil)
+	require.NoError(t, err)
+	for _, o := range out {
+		require.Nil(t, o.ModeEvent)
+	}
+	require.Equal(t, melody.FilterModeToolAction, f.CurrentMode())
+}
+
+func TestFilter_SearchToolQueries(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHop(), melody.HandleSearchQuery())
+	completion := "Plan: I will search.\nAction: ```json\n[{\"tool_name\": \"search\", \"parameters\": {\"queries\": [\"weather\", \"news\"]}}]\n```"
+	var queries []melody.FilterSearchQueryDelta
+	for _, c := range completion {
+		out, err := f.WriteDecoded(string(c), nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			if o.SearchQuery != nil {
+				queries = append(queries, *o.SearchQuery)
+			}
+		}
+	}
+	require.Equal(t, []melody.FilterSearchQueryDelta{
+		{Index: 0, Text: "weather"},
+		{Index: 1, Text: "news"},
+	}, queries)
+}
+
+func TestFilter_SearchQueryQuoting(t *testing.T) {
+	t.Parallel()
+
+	queries := func(options ...melody.FilterOption) []string {
+		f := melody.NewFilter(append([]melody.FilterOption{melody.HandleSearchQuery()}, options...)...)
+		var out []melody.FilterOutput
+		for _, c := range "Search: \"a|||b\" c\\|||d\ne\\\\" {
+			o, err := f.WriteDecoded(string(c), nil)
+			require.NoError(t, err)
+			out = append(out, o...)
+		}
+		o, err := f.FlushPartials()
+		require.NoError(t, err)
+		var texts []string
+		for _, o := range append(out, o...) {
+			if q := o.SearchQuery; q != nil {
+				if int(q.Index) == len(texts) {
+					texts = append(texts, "")
+				}
+				texts[q.Index] += q.Text
+			}
+		}
+		return texts
+	}
+
+	require.Equal(t, []string{"\"a|||b\" c|||d", "e\\"}, queries())
+	require.Equal(t, []string{"\"a", "b\" c\\", "d", "e\\\\"}, queries(melody.WithLegacyQuerySplitting()))
+}
+
+func TestFilter_SearchQueryDedup(t *testing.T) {
+	t.Parallel()
+
+	completion := "Search: weather|||Weather  |||weather in Paris|||news\n NEWS"
+	queries := func(restoreAt int, options ...melody.FilterOption) []string {
+		options = append([]melody.FilterOption{melody.HandleSearchQuery()}, options...)
+		f := melody.NewFilter(options...)
+		var out []melody.FilterOutput
+		for i, c := range completion {
+			if i == restoreAt {
+				state, err := f.SaveState()
+				require.NoError(t, err)
+				f, err = melody.RestoreFilter(state, options...)
+				require.NoError(t, err)
+			}
+			o, err := f.WriteDecoded(string(c), nil)
+			require.NoError(t, err)
+			out = append(out, o...)
+		}
+		o, err := f.FlushPartials()
+		require.NoError(t, err)
+		var texts []string
+		for _, o := range append(out, o...) {
+			if q := o.SearchQuery; q != nil {
+				// Indices are contiguous
+				if int(q.Index) == len(texts) {
+					texts = append(texts, "")
+				}
+				require.Len(t, texts, int(q.Index)+1)
+				texts[q.Index] += q.Text
+			}
+		}
+		return texts
+	}
+
+	require.Equal(t, []string{"weather", "Weather", "weather in Paris", "news", "NEWS"}, queries(-1))
+	want := []string{"weather", "weather in Paris", "news"}
+	require.Equal(t, want, queries(-1, melody.WithSearchQueryDedup()))
+	require.Equal(t, want, queries(30, melody.WithSearchQueryDedup()))
+}
+
+func TestFilter_PromptEcho(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithPromptEcho(2))
+	var echo, text string
+	for _, chunk := range []string{"Hi <co>", "<|END_RESPONSE|>", "<|START_RESPONSE|>", "Hello"} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			if o.IsEcho {
+				echo += o.Text
+			} else {
+				text += o.Text
+			}
+		}
+	}
+	require.Equal(t, "Hi <co><|END_RESPONSE|>", echo)
+	require.Equal(t, "Hello", text)
+}
+
+func TestFilter_RawParamEncoding(t *testing.T) {
+	t.Parallel()
+
+	write := func(f melody.Filter, completion string) (string, error) {
+		var params string
+		for _, c := range completion {
+			out, err := f.WriteDecoded(string(c), nil)
+			if err != nil {
+				return params, err
+			}
+			for _, o := range out {
+				if o.ToolCallDelta != nil {
+					params += o.ToolCallDelta.RawParamDelta
+				}
+			}
+		}
+		_, err := f.FlushPartials()
+		return params, err
+	}
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions(),
+		melody.WithRawParamEncoding(melody.RawParamEncoding{Indent: "  ", Strict: true}))
+	params, err := write(f, `<|START_ACTION|>[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"units": "C",  "city":"Rome"}}]<|END_ACTION|>`)
+	require.NoError(t, err)
+	require.Equal(t, "{\n  \"units\": \"C\",\n  \"city\": \"Rome\"\n}", params)
+
+	f = melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions(),
+		melody.WithRawParamEncoding(melody.RawParamEncoding{Strict: true}))
+	_, err = write(f, `<|START_ACTION|>[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome", "city": "Oslo"}}]<|END_ACTION|>`)
+	var syntaxErr *orderedjson.SyntaxError
+	require.ErrorAs(t, err, &syntaxErr)
+}
+
+func TestFilter_ResponsePrefix(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithResponsePrefix("The sky"))
+	var text string
+	var citations []melody.FilterCitation
+	for _, chunk := range []string{" is", " <co>", "blue", "</co: 0:[1]>", "."} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text += o.Text
+			citations = append(citations, o.Citations...)
+		}
+	}
+	require.Equal(t, " is blue.", text)
+	require.Len(t, citations, 1)
+	require.Equal(t, uint(11), citations[0].StartIndex)
+	require.Equal(t, uint(15), citations[0].EndIndex)
+}
+
+func TestFilter_ResumeState(t *testing.T) {
+	t.Parallel()
+
+	source := []melody.Source{{ToolCallIndex: 0, ToolResultIndices: []uint{1}}}
+	prior := []melody.FilterCitation{{StartIndex: 11, EndIndex: 15, Text: "blue", Sources: source}}
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithResumeState("The sky is blue", prior))
+	var text string
+	var citations []melody.FilterCitation
+	// The completion repeats "is blue" and its citation before continuing
+	for _, chunk := range []string{"is ", "<co>", "blue", "</co: 0:[1]>", " and ", "<co>", "clear", "</co: 0:[1]>", "."} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			text += o.Text
+			citations = append(citations, o.Citations...)
+		}
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	for _, o := range out {
+		text += o.Text
+	}
+	require.Equal(t, " and clear.", text)
+	require.Equal(t, []melody.FilterCitation{{StartIndex: 20, EndIndex: 25, Text: "clear", Sources: source}}, citations)
+}
+
+func TestFilter_StreamDocumentSelections(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHop(), melody.StreamDocumentSelections())
+	var relevant, cited []uint
+	var text string
+	for _, chunk := range []string{"Relevant Documents:", " 0,", "1\n", "Cited Documents: None\n", "Grounded answer:", " Yes."} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			if o.RelevantDocIndices != nil {
+				relevant = o.RelevantDocIndices
+			}
+			if o.CitedDocIndices != nil {
+				cited = o.CitedDocIndices
+			}
+			text += o.Text
+		}
+	}
+	require.Equal(t, []uint{0, 1}, relevant)
+	require.NotNil(t, cited)
+	require.Empty(t, cited)
+	require.Equal(t, " Yes.", text)
+}
+
+func TestFilter_ToolCallIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	type toolCallID struct {
+		ID          string
+		Synthesized bool
+	}
+	write := func(f melody.Filter, completion string) map[uint]toolCallID {
+		ids := map[uint]toolCallID{}
+		for _, c := range completion {
+			out, err := f.WriteDecoded(string(c), nil)
+			require.NoError(t, err)
+			for _, o := range out {
+				if d := o.ToolCallDelta; d != nil && d.ID != "" {
+					id := ids[d.Index]
+					id.ID += d.ID
+					id.Synthesized = id.Synthesized || d.IDSynthesized
+					ids[d.Index] = id
+				}
+			}
+		}
+		return ids
+	}
+
+	f := melody.NewFilter(melody.HandleMultiHop(), melody.StreamToolActions(),
+		melody.WithToolCallIDGenerator(func(index int) string { return fmt.Sprintf("call_%d", index) }))
+	ids := write(f, "Action: ```json\n[{\"tool_name\": \"search\", \"parameters\": {}}, {\"tool_name\": \"fetch\", \"parameters\": {}}]\n```")
+	require.Equal(t, map[uint]toolCallID{0: {"call_0", true}, 1: {"call_1", true}}, ids)
+
+	// IDs written by the model are kept
+	f = melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions(), melody.WithToolCallIDGenerator(nil))
+	ids = write(f, `<|START_ACTION|>[{"tool_call_id": "abc", "tool_name": "search", "parameters": {}}]<|END_ACTION|>`)
+	require.Equal(t, map[uint]toolCallID{0: {"abc", false}}, ids)
+
+	f = melody.NewFilter(melody.HandleMultiHop(), melody.StreamToolActions(), melody.WithToolCallIDGenerator(nil))
+	ids = write(f, "Action: ```json\n[{\"tool_name\": \"search\", \"parameters\": {}}]\n```")
+	require.Equal(t, map[uint]toolCallID{0: {"0", true}}, ids)
+}
+
+func TestFilter_NestedParamPaths(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions(), melody.StreamProcessedParams(),
+		melody.WithNestedParamPaths())
+	completion := `<|START_ACTION|>[{"tool_call_id": "0", "tool_name": "search", "parameters": {"filters": {"date": {"start": "2024", "end": "2025"}}, "limit": 5}}]<|END_ACTION|>`
+	var params [][2]string
+	for _, c := range completion {
+		out, err := f.WriteDecoded(string(c), nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			if o.ToolCallDelta == nil || o.ToolCallDelta.ParamDelta == nil {
+				continue
+			}
+			p := o.ToolCallDelta.ParamDelta
+			path := strings.Join(p.Path, ".")
+			if n := len(params); n > 0 && params[n-1][0] == path {
+				params[n-1][1] += p.ValueDelta
+				continue
+			}
+			params = append(params, [2]string{path, p.ValueDelta})
+		}
+	}
+	require.Equal(t, [][2]string{
+		{"filters", ""},
+		{"filters.date.start", `"2024"`},
+		{"filters.date.end", `"2025"`},
+		{"limit", "5"},
+	}, params)
+}
+
+func TestFilter_ToolReadiness(t *testing.T) {
+	t.Parallel()
+
+	var schema orderedjson.Object
+	require.NoError(t, schema.UnmarshalJSON([]byte(`{"type": "object", "required": ["city", "units"]}`)))
+	options := []melody.FilterOption{
+		melody.HandleMultiHopCmd3(), melody.StreamToolActions(),
+		melody.WithToolReadiness([]melody.Tool{{Name: "get_weather", Parameters: schema}}),
+	}
+	completion := `<|START_ACTION|>[` +
+		`{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome", "units": {"temp": "C"}, "days": 3}}, ` +
+		`{"tool_call_id": "1", "tool_name": "search", "parameters": {"city": "Rome", "units": "C"}}, ` +
+		`{"tool_call_id": "2", "tool_name": "get_weather", "parameters": {"city": "Oslo"}}` +
+		`]<|END_ACTION|>`
+
+	// write writes the completion, restoring the filter from its saved state at restoreAt
+	write := func(restoreAt int) {
+		f := melody.NewFilter(options...)
+		var ready []*melody.FilterToolReady
+		for i, c := range completion {
+			if i == restoreAt {
+				state, err := f.SaveState()
+				require.NoError(t, err)
+				f, err = melody.RestoreFilter(state, options...)
+				require.NoError(t, err)
+			}
+			out, err := f.WriteDecoded(string(c), nil)
+			require.NoError(t, err)
+			for _, o := range out {
+				if o.ToolReady != nil {
+					// The tool call is ready at the end of the last required parameter
+					require.True(t, strings.HasSuffix(completion[:i+1], `{"temp": "C"}`), completion[:i+1])
+					ready = append(ready, o.ToolReady)
+				}
+			}
+		}
+		require.Len(t, ready, 1)
+		require.Equal(t, uint(0), ready[0].Index)
+		require.Equal(t, "0", ready[0].ID)
+		require.Equal(t, "get_weather", ready[0].Name)
+		params, err := json.Marshal(ready[0].Parameters)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"city": "Rome", "units": {"temp": "C"}}`, string(params))
+	}
+	write(-1)
+	write(strings.Index(completion, `"units"`))
+}
+
+func TestFilter_MarkdownState(t *testing.T) {
+	t.Parallel()
+
+	tokens := []string{
+		"Run:\n", "```go\n", "x := 1\n", "```", "\n- one\n", "  - two", "\n\n", "| a | b |\n", "|---|---|", "\n\nDone",
+	}
+	want := []melody.MarkdownState{
+		{},
+		{InCodeFence: true, CodeLanguage: "go"},
+		{InCodeFence: true, CodeLanguage: "go"},
+		{},
+		{ListDepth: 1},
+		{ListDepth: 2},
+		{ListDepth: 2},
+		{InTable: true},
+		{InTable: true},
+		{},
+	}
+	options := []melody.FilterOption{melody.WithMarkdownState()}
+
+	write := func(restoreAt int) {
+		f := melody.NewFilter(options...)
+		var got []melody.MarkdownState
+		for i, token := range tokens {
+			if i == restoreAt {
+				state, err := f.SaveState()
+				require.NoError(t, err)
+				f, err = melody.RestoreFilter(state, options...)
+				require.NoError(t, err)
+			}
+			out, err := f.WriteDecoded(token, nil)
+			require.NoError(t, err)
+			require.Len(t, out, 1)
+			require.Equal(t, token, out[0].Text)
+			require.NotNil(t, out[0].Markdown)
+			got = append(got, *out[0].Markdown)
+		}
+		require.Equal(t, want, got)
+	}
+	write(-1)
+	write(2)
+
+	// Without the option outputs have no markdown state
+	out, err := melody.NewFilter().WriteDecoded("```go\n", nil)
+	require.NoError(t, err)
+	require.Nil(t, out[0].Markdown)
+}
+
+func TestFilter_WordBoundaryChunking(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.WithWordBoundaryChunking(6))
+	var texts []string
+	for _, chunk := range []string{"<|START_RESPONSE|>", "The", " s", "ky", " is", " blue", " to", "day", "<|END_RESPONSE|>"} {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		for _, o := range out {
+			texts = append(texts, o.Text)
+		}
+	}
+	require.Equal(t, []string{"The sky", " is blue", " today"}, texts)
+}
+
+func TestCallbackFilter(t *testing.T) {
+	t.Parallel()
+
+	chunks := []string{"<|START_RESPONSE|>", "The ", "<co>", "sky", "</co: 0:[1]>", " is blue.", "<|END_RESPONSE|>"}
+	f := melody.NewFilter(melody.HandleMultiHopCmd3())
+	var want []melody.FilterOutput
+	for _, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		want = append(want, out...)
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	want = append(want, out...)
+
+	var got []melody.FilterOutput
+	cf := melody.NewCallbackFilter(func(o melody.FilterOutput) { got = append(got, o) }, melody.HandleMultiHopCmd3())
+	require.NoError(t, cf.WriteDecoded(chunks[0], nil))
+	require.NoError(t, cf.WriteDecodedBatch(chunks[1:], nil))
+	require.NoError(t, cf.FlushPartials())
+	require.Equal(t, want, got)
+}
+
+func TestFilter_WriteDecodedBatch(t *testing.T) {
+	t.Parallel()
+
+	tokens := []string{
+		"<|START_RESPONSE|>", "The ", "<co>", "sky", "</co: 0:[1]>", " is blue.", "<|END_RESPONSE|>",
+		"<|START_ACTION|>", `[{"tool_name": "search", "parameters": {"query": "sk`, `y"}}]`, "<|END_ACTION|>",
+	}
+	logprobs := make([]melody.TokenIDsWithLogProb, len(tokens))
+	for i := range logprobs {
+		logprobs[i] = melody.TokenIDsWithLogProb{TokenIDs: []uint32{uint32(i)}, Logprobs: []float32{-float32(i)}}
+	}
+	options := []melody.FilterOption{melody.HandleMultiHopCmd3(), melody.StreamToolActions()}
+
+	write := func(logprobs []melody.TokenIDsWithLogProb) []melody.FilterOutput {
+		f := melody.NewFilter(options...)
+		var out []melody.FilterOutput
+		for i, token := range tokens {
+			var lp *melody.TokenIDsWithLogProb
+			if logprobs != nil {
+				lp = &logprobs[i]
+			}
+			o, err := f.WriteDecoded(token, lp)
+			require.NoError(t, err)
+			out = append(out, o...)
+		}
+		return out
+	}
+
+	want := write(nil)
+	for _, size := range []int{1, 3, len(tokens)} {
+		f := melody.NewFilter(options...)
+		var got []melody.FilterOutput
+		for chunk := range slices.Chunk(tokens, size) {
+			out, err := f.WriteDecodedBatch(chunk, nil)
+			require.NoError(t, err)
+			got = append(got, out...)
+		}
+		require.Equal(t, want, got, "batch size %d", size)
+	}
+
+	f := melody.NewFilter(options...)
+	got, err := f.WriteDecodedBatch(tokens, logprobs)
+	require.NoError(t, err)
+	require.Equal(t, write(logprobs), got)
+
+	_, err = f.WriteDecodedBatch(tokens, logprobs[:1])
+	require.EqualError(t, err, "got 1 log probabilities for 11 tokens")
+}
+
+// BenchmarkFilter_WriteDecodedBatch compares writing tokens one by one to writing them in
+// batches, which crosses the cgo boundary once per batch
+func BenchmarkFilter_WriteDecodedBatch(b *testing.B) {
+	tokens := strings.SplitAfter(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 50), " ")
+	b.Run("per_token", func(b *testing.B) {
+		for b.Loop() {
+			f := melody.NewFilter(melody.HandleMultiHopCmd3())
+			for _, token := range tokens {
+				if _, err := f.WriteDecoded(token, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	for _, size := range []int{4, 16, 64} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			for b.Loop() {
+				f := melody.NewFilter(melody.HandleMultiHopCmd3())
+				for chunk := range slices.Chunk(tokens, size) {
+					if _, err := f.WriteDecodedBatch(chunk, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
 		})
 	}
 }
+
+// BenchmarkFilter_StopSequences compares the matching of stop sequences in a single pass to
+// matching them one at a time, compare runs across changes to it with benchstat
+func BenchmarkFilter_StopSequences(b *testing.B) {
+	words := strings.SplitAfter(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20), " ")
+	matchers := []struct {
+		name      string
+		newFilter func(...melody.FilterOption) (melody.Filter, error)
+	}{
+		{"automaton", melody.TryNewFilter},
+		{"linear", melody.NewLinearMatchingFilter},
+	}
+	for _, m := range matchers {
+		for _, n := range []int{1, 10, 100} {
+			stops := make([]string, n)
+			for i := range stops {
+				stops[i] = fmt.Sprintf("<stop_%d>", i)
+			}
+			b.Run(fmt.Sprintf("%s/stops=%d", m.name, n), func(b *testing.B) {
+				f, err := m.newFilter(melody.HandleMultiHopCmd3(), melody.WithExclusiveStops(stops))
+				if err != nil {
+					b.Fatal(err)
+				}
+				for b.Loop() {
+					for _, word := range words {
+						if _, err := f.WriteDecoded(word, nil); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
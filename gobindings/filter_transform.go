@@ -0,0 +1,140 @@
+package gobindings
+
+import (
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// transformedText is the text of a citation index space as the filter emitted it before
+// the output transformer rewrote it, the response or a thinking block of the reasoning,
+// see WithOutputTransformer. Its length and spans are in the citation index unit.
+type transformedText struct {
+	Reasoning bool       `json:"reasoning,omitempty"`
+	PlanIndex uint       `json:"plan_index,omitempty"`
+	Length    int        `json:"length"`
+	Edits     []textEdit `json:"edits,omitempty"`
+}
+
+// textEdit is a span [Start, End) of the text replaced by NewLen units
+type textEdit struct {
+	Start  int `json:"start"`
+	End    int `json:"end"`
+	NewLen int `json:"new_len"`
+}
+
+// transformOutputs rewrites the text of the outputs with the output transformer and moves
+// their citation indices by the change in length of the text before them
+func (f *SyncFilter) transformOutputs(outputs []FilterOutput) {
+	if f.transform == nil {
+		return
+	}
+	for i := range outputs {
+		o := &outputs[i]
+		if o.Text != "" {
+			text, redactions := f.transform(o.Text)
+			if !o.IsEcho {
+				f.transformedText(o.IsReasoning, o.PlanIndex).edit(o.Text, text, redactions, f.citationIndexUnit)
+			}
+			o.Text, o.Redactions = text, redactions
+		}
+		for j := range o.Citations {
+			c := &o.Citations[j]
+			t := f.transformedText(c.IsThinking, o.PlanIndex)
+			c.StartIndex = uint(t.remap(int(c.StartIndex), false))
+			c.EndIndex = uint(t.remap(int(c.EndIndex), true))
+			c.Text, _ = f.transform(c.Text)
+		}
+	}
+}
+
+// transformedText returns the text of the response or of a thinking block, the response
+// starting after the response prefix
+func (f *SyncFilter) transformedText(reasoning bool, plan uint) *transformedText {
+	if !reasoning {
+		plan = 0
+	}
+	for i := range f.transformed {
+		if t := &f.transformed[i]; t.Reasoning == reasoning && t.PlanIndex == plan {
+			return t
+		}
+	}
+	t := transformedText{Reasoning: reasoning, PlanIndex: plan}
+	if !reasoning {
+		t.Length = textUnits(f.responsePrefix, f.citationIndexUnit)
+	}
+	f.transformed = append(f.transformed, t)
+	return &f.transformed[len(f.transformed)-1]
+}
+
+// edit appends the text before the transformer to t, with the spans it replaced
+func (t *transformedText) edit(before, after string, redactions []Redaction, unit CitationIndexUnit) {
+	start := t.Length
+	t.Length += textUnits(before, unit)
+	if !validRedactions(before, redactions) {
+		if after != before {
+			t.Edits = append(t.Edits, textEdit{Start: start, End: t.Length, NewLen: textUnits(after, unit)})
+		}
+		return
+	}
+	for _, r := range redactions {
+		s := start + textUnits(before[:r.Start], unit)
+		t.Edits = append(t.Edits, textEdit{
+			Start:  s,
+			End:    s + textUnits(before[r.Start:r.End], unit),
+			NewLen: textUnits(r.Replacement, unit),
+		})
+	}
+}
+
+// remap returns the index i of the text before the transformer in the text after it. An
+// index in a replaced span moves to the start of the replacement, or to its end for the
+// end of a citation.
+func (t *transformedText) remap(i int, end bool) int {
+	shift := 0
+	for _, e := range t.Edits {
+		switch {
+		case i >= e.End:
+			shift += e.NewLen - (e.End - e.Start)
+		case i > e.Start && end:
+			return e.Start + shift + e.NewLen
+		case i > e.Start:
+			return e.Start + shift
+		default:
+			return i + shift
+		}
+	}
+	return i + shift
+}
+
+// validRedactions reports whether the redactions are ordered spans of text that do not
+// overlap
+func validRedactions(text string, redactions []Redaction) bool {
+	if len(redactions) == 0 {
+		return false
+	}
+	prev := 0
+	for _, r := range redactions {
+		if r.Start < prev || r.End < r.Start || r.End > len(text) {
+			return false
+		}
+		prev = r.End
+	}
+	return true
+}
+
+// textUnits returns the length of s in the citation index unit. Graphemes are counted as
+// runes.
+func textUnits(s string, unit CitationIndexUnit) int {
+	switch unit {
+	case CitationIndexBytes:
+		return len(s)
+	case CitationIndexUTF16:
+		n := 0
+		for _, r := range s {
+			n += utf16.RuneLen(r)
+		}
+		return n
+	default:
+		return utf8.RuneCountInString(s)
+	}
+}
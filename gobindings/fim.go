@@ -0,0 +1,58 @@
+package gobindings
+
+// #include "melody.h"
+import "C"
+import (
+	"context"
+	"errors"
+)
+
+// FIMFamily is the model family of a fill-in-the-middle prompt, which determines its
+// special tokens and layout
+type FIMFamily int32
+
+const (
+	// FIMFamilyCommand uses the <|BEGINNING_OF_PREFIX_FIM_TOKEN|> tokens of Cohere Command models
+	FIMFamilyCommand FIMFamily = 0
+	// FIMFamilyCodeLlama uses the <PRE>, <SUF> and <MID> tokens of Code Llama models
+	FIMFamilyCodeLlama FIMFamily = 1
+	// FIMFamilyStarCoder uses the <fim_prefix>, <fim_suffix> and <fim_middle> tokens of StarCoder models
+	FIMFamilyStarCoder FIMFamily = 2
+)
+
+// RenderFIMOptions are the options of a fill-in-the-middle prompt
+type RenderFIMOptions struct {
+	Family               FIMFamily         `json:"family"`
+	EscapedSpecialTokens map[string]string `json:"escaped_special_tokens,omitempty"` // optional: JSON-encoded
+	// Tracer traces the render, optional
+	Tracer Tracer `json:"-"`
+}
+
+// RenderFIM renders a fill-in-the-middle prompt asking the model for the text between
+// prefix and suffix. The completion is the middle text, parse it with HandleFIM.
+func RenderFIM(prefix, suffix string, opts RenderFIMOptions) (prompt string, err error) {
+	_, span := startSpan(context.Background(), opts.Tracer, "melody.RenderFIM")
+	defer func() { endSpan(span, err) }()
+
+	var a cAllocator
+	defer a.FreeAll()
+
+	cOpts := C.CRenderFimOptions{
+		family:                      C.CFimFamily(opts.Family),
+		escaped_special_tokens_json: jsonCString(&a, opts.EscapedSpecialTokens),
+	}
+
+	res := C.melody_render_fim(a.CString(prefix), a.CString(suffix), &cOpts)
+	if res == nil {
+		return "", errors.New("melody_render_fim returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.result != nil {
+		return C.GoString(res.result), nil
+	}
+	if res.error != nil {
+		return "", renderError(res)
+	}
+	return "", errors.New("melody_render_fim returned neither result nor error")
+}
@@ -0,0 +1,135 @@
+package gobindings
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// ErrContextExceeded is returned by FitToContext when the prompt does not fit with nothing
+// left to trim
+var ErrContextExceeded = errors.New("melody: prompt exceeds the context length")
+
+// PromptTokenizer counts the tokens of a rendered prompt. It is satisfied by
+// *tokenizers.Tokenizer.
+type PromptTokenizer interface {
+	Encode(str string, addSpecialTokens bool) ([]uint32, []string)
+}
+
+// ContextTrim is what FitToContext removed from the options so the prompt fits
+type ContextTrim struct {
+	// Documents are the documents removed from the end of the documents, the last first
+	Documents []orderedjson.Object
+	// Messages are the messages elided from the start of the history, oldest first
+	Messages []Message
+	// PromptTokens is the number of tokens of the last rendered prompt
+	PromptTokens int
+}
+
+// fittable are the render options FitToContext trims, implemented by RenderCmd3Options
+// and RenderCmd4Options
+type fittable[O any] interface {
+	RenderOpts
+	context() ([]Message, []orderedjson.Object)
+	withContext(messages []Message, documents []orderedjson.Object) O
+}
+
+func (opts RenderCmd3Options) context() ([]Message, []orderedjson.Object) {
+	return opts.Messages, opts.Documents
+}
+
+func (opts RenderCmd3Options) withContext(messages []Message, documents []orderedjson.Object) RenderCmd3Options {
+	opts.Messages, opts.Documents = messages, documents
+	return opts
+}
+
+func (opts RenderCmd4Options) context() ([]Message, []orderedjson.Object) {
+	return opts.Messages, opts.Documents
+}
+
+func (opts RenderCmd4Options) withContext(messages []Message, documents []orderedjson.Object) RenderCmd4Options {
+	opts.Messages, opts.Documents = messages, documents
+	return opts
+}
+
+// FitToContext trims opts until its prompt leaves reserveForResponse tokens of a context
+// of contextLength tokens, for the response and its trailing special tokens. Documents are
+// removed first, from the last one since documents are usually sorted by relevance. Then
+// the oldest turns of the history are elided, a user message and the replies to it at a
+// time, and replaced by a ContentElidedTurns message. The system messages at the start of
+// the history and the last user turn are always kept.
+//
+// The prompt is rendered and counted with tokenizer after every removal. It returns the
+// trimmed options with what was removed, and ErrContextExceeded once there is nothing left
+// to trim.
+func FitToContext[O fittable[O]](opts O, tokenizer PromptTokenizer, contextLength, reserveForResponse int) (O, ContextTrim, error) {
+	var trim ContextTrim
+	budget := contextLength - reserveForResponse
+	if budget <= 0 {
+		return opts, trim, fmt.Errorf("%w: %d tokens reserved for the response of a context of %d", ErrContextExceeded, reserveForResponse, contextLength)
+	}
+
+	messages, documents := opts.context()
+	messages, documents = slices.Clone(messages), slices.Clone(documents)
+	for {
+		prompt, err := opts.render()
+		if err != nil {
+			return opts, trim, fmt.Errorf("failed to render prompt: %w", err)
+		}
+		ids, _ := tokenizer.Encode(prompt, false)
+		trim.PromptTokens = len(ids)
+		if len(ids) <= budget {
+			return opts, trim, nil
+		}
+
+		if n := len(documents); n > 0 {
+			trim.Documents = append(trim.Documents, documents[n-1])
+			documents = documents[:n-1]
+		} else {
+			var elided []Message
+			messages, elided = elideOldestTurn(messages)
+			if len(elided) == 0 {
+				return opts, trim, fmt.Errorf("%w: the prompt has %d tokens with nothing left to trim, %d fit", ErrContextExceeded, len(ids), budget)
+			}
+			trim.Messages = append(trim.Messages, elided...)
+		}
+		opts = opts.withContext(messages, documents)
+	}
+}
+
+// elideOldestTurn replaces the oldest turn of the history, after the system messages at
+// its start, with a ContentElidedTurns message counting every message elided so far. It
+// returns the messages and the elided ones, none if only the last user turn is left.
+func elideOldestTurn(messages []Message) ([]Message, []Message) {
+	start := 0
+	for start < len(messages) && messages[start].Role == RoleSystem && !isElidedTurns(messages[start]) {
+		start++
+	}
+	first, elidedBefore := start, 0
+	if first < len(messages) && isElidedTurns(messages[first]) {
+		first, elidedBefore = first+1, messages[first].Content[0].ElidedTurns
+	}
+
+	// The turn ends at the next user message, there is none after the last turn
+	end := first + 1
+	for end < len(messages) && messages[end].Role != RoleUser {
+		end++
+	}
+	if end >= len(messages) {
+		return messages, nil
+	}
+
+	elided := slices.Clone(messages[first:end])
+	marker := Message{
+		Role:    RoleSystem,
+		Content: []Content{{Type: ContentElidedTurns, ElidedTurns: elidedBefore + len(elided)}},
+	}
+	return slices.Concat(messages[:start], []Message{marker}, messages[end:]), elided
+}
+
+// isElidedTurns reports whether m stands in for turns elided from the history
+func isElidedTurns(m Message) bool {
+	return len(m.Content) == 1 && m.Content[0].Type == ContentElidedTurns
+}
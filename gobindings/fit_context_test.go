@@ -0,0 +1,100 @@
+package gobindings
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+	"github.com/cohere-ai/melody/gobindings/tokenizers/tokenizertest"
+)
+
+func textMessage(role Role, text string) Message {
+	return Message{Role: role, Content: []Content{{Type: ContentText, Text: text}}}
+}
+
+func elidedTurns(n int) Message {
+	return Message{Role: RoleSystem, Content: []Content{{Type: ContentElidedTurns, ElidedTurns: n}}}
+}
+
+func TestFitToContext(t *testing.T) {
+	t.Parallel()
+
+	tok := tokenizertest.New()
+	count := func(opts RenderCmd3Options) int {
+		prompt, err := RenderCMD3(opts)
+		require.NoError(t, err)
+		ids, _ := tok.Encode(prompt, false)
+		return len(ids)
+	}
+	var docs []orderedjson.Object
+	for _, text := range []string{"It is sunny in Rome.", "It rained in Paris.", "Snow is expected in Oslo."} {
+		docs = append(docs, orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{Key: "text", Value: strings.Repeat(text, 10)})))
+	}
+	opts := RenderCmd3Options{
+		Messages: []Message{
+			textMessage(RoleSystem, "Be brief."),
+			textMessage(RoleUser, "Hi"),
+			textMessage(RoleChatbot, "Hello, how can I help?"),
+			textMessage(RoleUser, "What is the weather in Rome?"),
+			textMessage(RoleChatbot, "It is sunny."),
+			textMessage(RoleUser, "And in Paris?"),
+		},
+		Documents: docs,
+	}
+
+	got, trim, err := FitToContext(opts, tok, count(opts)+100, 100)
+	require.NoError(t, err)
+	require.Equal(t, opts, got)
+	require.Empty(t, trim.Documents)
+
+	want := opts
+	want.Documents = docs[:1]
+	got, trim, err = FitToContext(opts, tok, count(want)+100, 100)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, []orderedjson.Object{docs[2], docs[1]}, trim.Documents)
+	require.Equal(t, count(want), trim.PromptTokens)
+
+	want.Documents = nil
+	want.Messages = []Message{opts.Messages[0], elidedTurns(2), opts.Messages[3], opts.Messages[4], opts.Messages[5]}
+	got, trim, err = FitToContext(opts, tok, count(want)+100, 100)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Len(t, trim.Documents, 3)
+	require.Equal(t, opts.Messages[1:3], trim.Messages)
+
+	_, trim, err = FitToContext(opts, tok, 200, 100)
+	require.ErrorIs(t, err, ErrContextExceeded)
+	require.Equal(t, opts.Messages[1:5], trim.Messages)
+	_, _, err = FitToContext(opts, tok, 100, 100)
+	require.ErrorIs(t, err, ErrContextExceeded)
+}
+
+func TestElideOldestTurn(t *testing.T) {
+	t.Parallel()
+
+	system := textMessage(RoleSystem, "Be brief.")
+	call := Message{Role: RoleChatbot, ToolCalls: []ToolCall{{ID: "0", Name: "search", Parameters: "{}"}}}
+	result := Message{Role: RoleTool, ToolCallID: "0", Content: []Content{{Type: ContentText, Text: "sunny"}}}
+	messages := []Message{
+		system,
+		textMessage(RoleUser, "Weather?"), call, result, textMessage(RoleChatbot, "Sunny."),
+		textMessage(RoleUser, "Thanks"), textMessage(RoleChatbot, "You're welcome."),
+		textMessage(RoleUser, "Bye"),
+	}
+
+	// A tool call is elided together with its result
+	got, elided := elideOldestTurn(messages)
+	require.Equal(t, messages[1:5], elided)
+	require.Equal(t, []Message{system, elidedTurns(4), messages[5], messages[6], messages[7]}, got)
+
+	got, elided = elideOldestTurn(got)
+	require.Equal(t, messages[5:7], elided)
+	require.Equal(t, []Message{system, elidedTurns(6), messages[7]}, got)
+
+	got, elided = elideOldestTurn(got)
+	require.Empty(t, elided)
+	require.Equal(t, []Message{system, elidedTurns(6), messages[7]}, got)
+}
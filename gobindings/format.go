@@ -0,0 +1,181 @@
+package gobindings
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FormatHandler is a model output format that the filter can parse.
+//
+// The built-in formats configure a preset of the filter and own no sections of their own.
+// A downstream format can add special tokens that switch the filter to one of the built-in
+// modes, or to a custom mode at or above FilterModeCustom. Text written while the filter is
+// in a custom mode is not parsed by the filter but passed to HandleSection, until the next
+// special token owned by the format. Special tokens that switch to a custom mode must be
+// written to the filter as a single decoded token.
+type FormatHandler interface {
+	// Configure applies the format's preset to the filter options
+	Configure(opts *FilterOptions)
+
+	// SpecialTokens returns the special tokens owned by the format and the mode each one switches to
+	SpecialTokens() map[string]FilterMode
+
+	// HandleSection parses a chunk of text written while the filter is in the custom mode
+	HandleSection(mode FilterMode, text []byte) ([]FilterOutput, error)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = make(map[string]FormatHandler)
+)
+
+func init() {
+	RegisterFormat("cmd3", presetFormat((*FilterOptions).Cmd3))
+	RegisterFormat("cmd4", presetFormat((*FilterOptions).Cmd4))
+	RegisterFormat("rag", presetFormat((*FilterOptions).HandleRAG))
+	RegisterFormat("search_query", presetFormat((*FilterOptions).HandleSearchQuery))
+	RegisterFormat("multi_hop", presetFormat((*FilterOptions).HandleMultiHop))
+	RegisterFormat("llama3_chat", presetFormat((*FilterOptions).HandleLlama3Chat))
+}
+
+// RegisterFormat makes a format available by name to WithFormat.
+// It panics if the handler is nil or a format with the same name is already registered.
+func RegisterFormat(name string, h FormatHandler) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	if h == nil {
+		panic("melody: RegisterFormat handler is nil")
+	}
+	if _, dup := formats[name]; dup {
+		panic("melody: RegisterFormat called twice for format " + name)
+	}
+	formats[name] = h
+}
+
+// Formats returns the sorted names of the registered formats
+func Formats() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatDescriptor is the grammar of an output format: its special tokens, the sections
+// they delimit, and the syntax of its citations and tool calls, see DescribeFormat. Modes
+// are named as by FilterMode.String.
+type FormatDescriptor struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary,omitempty"`
+	// DefaultMode is the mode of the text before the first special token, empty if the
+	// format does not set it
+	DefaultMode   string          `json:"default_mode,omitempty"`
+	SpecialTokens []FormatToken   `json:"special_tokens"`
+	Sections      []FormatSection `json:"sections,omitempty"`
+	// CitationSyntax is the syntax of the citations of the answer, empty without citations
+	CitationSyntax string `json:"citation_syntax,omitempty"`
+	// ToolCallShape is the JSON shape of the tool calls of an action section, empty
+	// without tool calls
+	ToolCallShape string `json:"tool_call_shape,omitempty"`
+}
+
+// FormatToken is a special token of a format and the mode it switches the filter to
+type FormatToken struct {
+	Token string `json:"token"`
+	Mode  string `json:"mode"`
+}
+
+// FormatSection is the text of a format parsed in a mode
+type FormatSection struct {
+	Mode        string `json:"mode"`
+	Description string `json:"description"`
+}
+
+// DescribeFormat returns the descriptor of a registered format, for tooling that documents
+// what the filter parses. The descriptors of the built-in formats are those the filter
+// presets are configured from. A format registered with RegisterFormat is described by its
+// special tokens, sorted, and the sections of its custom modes.
+func DescribeFormat(name string) (FormatDescriptor, error) {
+	h, err := lookupFormat(name)
+	if err != nil {
+		return FormatDescriptor{}, err
+	}
+	if _, ok := h.(presetFormat); ok {
+		data, err := describeFormat(name)
+		if err != nil {
+			return FormatDescriptor{}, err
+		}
+		var d FormatDescriptor
+		if err := json.Unmarshal(data, &d); err != nil {
+			return FormatDescriptor{}, fmt.Errorf("failed to decode format descriptor: %w", err)
+		}
+		return d, nil
+	}
+
+	d := FormatDescriptor{Name: name, SpecialTokens: []FormatToken{}}
+	custom := make(map[FilterMode]bool)
+	for token, mode := range h.SpecialTokens() {
+		d.SpecialTokens = append(d.SpecialTokens, FormatToken{Token: token, Mode: mode.String()})
+		if mode >= FilterModeCustom && !custom[mode] {
+			custom[mode] = true
+			d.Sections = append(d.Sections, FormatSection{Mode: mode.String(), Description: "Parsed by the format"})
+		}
+	}
+	sort.Slice(d.SpecialTokens, func(i, j int) bool { return d.SpecialTokens[i].Token < d.SpecialTokens[j].Token })
+	sort.Slice(d.Sections, func(i, j int) bool { return d.Sections[i].Mode < d.Sections[j].Mode })
+	return d, nil
+}
+
+// lookupFormat returns the registered format with the given name
+func lookupFormat(name string) (FormatHandler, error) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	h, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", name)
+	}
+	return h, nil
+}
+
+// presetFormat is a built-in format that applies a filter options preset
+type presetFormat func(opts *FilterOptions) *FilterOptions
+
+func (p presetFormat) Configure(opts *FilterOptions) {
+	p(opts)
+}
+
+func (p presetFormat) SpecialTokens() map[string]FilterMode {
+	return nil
+}
+
+func (p presetFormat) HandleSection(FilterMode, []byte) ([]FilterOutput, error) {
+	return nil, nil
+}
+
+// formatSection is the format and mode a special token of a format switches to
+type formatSection struct {
+	handler FormatHandler
+	mode    FilterMode
+}
+
+// formatSections maps the special tokens of the given formats to their sections.
+// It returns nil if none of the formats own a custom section.
+func formatSections(handlers []FormatHandler) map[string]formatSection {
+	sections := make(map[string]formatSection)
+	custom := false
+	for _, h := range handlers {
+		for token, mode := range h.SpecialTokens() {
+			sections[token] = formatSection{handler: h, mode: mode}
+			custom = custom || mode >= FilterModeCustom
+		}
+	}
+	if !custom {
+		return nil
+	}
+	return sections
+}
@@ -0,0 +1,83 @@
+package gobindings_test
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/tokenizers/tokenizertest"
+)
+
+// runFuzzFilter streams input through a filter token by token using the byte-level
+// test tokenizer and checks the invariants that must hold for any model output.
+func runFuzzFilter(t *testing.T, input string, options ...melody.FilterOption) {
+	t.Helper()
+
+	tk := tokenizertest.New()
+	ids, _ := tk.Encode(input, false)
+	chunks, _ := tokenizertest.DecodeChunks(tk, ids)
+
+	f := melody.NewFilter(options...)
+	require.NotNil(t, f)
+
+	var out []melody.FilterOutput
+	for _, chunk := range chunks {
+		o, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+		out = append(out, o...)
+	}
+	o, err := f.FlushPartials()
+	require.NoError(t, err)
+	out = append(out, o...)
+
+	for _, o := range out {
+		require.True(t, utf8.ValidString(o.Text), "invalid utf-8 text %q", o.Text)
+		for _, c := range o.Citations {
+			require.LessOrEqual(t, c.StartIndex, c.EndIndex)
+		}
+		if o.ToolCallDelta != nil {
+			require.True(t, utf8.ValidString(o.ToolCallDelta.RawParamDelta))
+		}
+	}
+}
+
+func FuzzWriteDecoded(f *testing.F) {
+	f.Add("<|START_THINKING|>This is a rainbow <co>emoji: 🌈</co: 0:[1]><|END_THINKING|>\n<|START_RESPONSE|>foo <co>bar</co: 0:[1,2],1:[3,4]><|END_RESPONSE|>")
+	f.Add(`<|START_ACTION|>[{"tool_call_id": "0", "tool_name": "add", "parameters": {"a": 6, "b": 7}}]<|END_ACTION|>`)
+	f.Add("<|START_RESPONSE|>foo <co>bar <co>baz</co: 1:[1]> boo</co: 0:[1,2],1:[3,4]><|END_RESPONSE|>")
+	f.Add("<|START_THINKING|>hello <")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		runFuzzFilter(t, input, melody.HandleMultiHopCmd3(), melody.StreamToolActions())
+		runFuzzFilter(t, input, melody.HandleMultiHopCmd4(), melody.StreamProcessedParams(), melody.WithCitationMerging())
+	})
+}
+
+func FuzzParseActions(f *testing.F) {
+	f.Add(`[{"tool_call_id": "0", "tool_name": "add", "parameters": {"a": 6, "b": 7}}]`)
+	f.Add(`[{"tool_call_id": "0", "tool_name": "web_search", "parameters": {"query": "United States"}},{"tool_call_id": "1", "tool_name": "web_search", "parameters": {"query": "Canada"}}]`)
+	f.Add(`[{"tool_call_id": "0", "tool_name": "order_cancel", "parameters": {"order_id": "#W9284598", "reason": "طلبته بالخطأ"}}]`)
+	f.Add(`[{"tool_call_id": "0", "tool_name": "nested", "parameters": {"a": {"b": [1, {"c": null}]}, "d": "\"}"}}]`)
+
+	f.Fuzz(func(t *testing.T, action string) {
+		input := "<|START_ACTION|>" + action + "<|END_ACTION|>"
+		runFuzzFilter(t, input, melody.HandleMultiHopCmd3())
+		runFuzzFilter(t, input, melody.HandleMultiHopCmd3(), melody.StreamProcessedParams())
+	})
+}
+
+func FuzzParseCitations(f *testing.F) {
+	f.Add("bar", "0:[1,2],1:[3,4]")
+	f.Add("emoji: 🌈", "0:[1]")
+	f.Add("bar <co>baz</co: 1:[1]> boo", "0:[1]")
+	f.Add("", "")
+	f.Add("bar", "x:[y]")
+
+	f.Fuzz(func(t *testing.T, text, sources string) {
+		input := "<|START_RESPONSE|>foo <co>" + text + "</co: " + sources + "> qux<|END_RESPONSE|>"
+		runFuzzFilter(t, input, melody.HandleMultiHopCmd3())
+		runFuzzFilter(t, input, melody.HandleMultiHopCmd3(), melody.WithCitationMerging())
+	})
+}
@@ -0,0 +1,221 @@
+// Package goldentest checks that rendering a set of fixtures produces byte-identical
+// prompts across releases.
+//
+// A fixture directory holds one directory per template version, "cmd3" or "cmd4", with a
+// directory per case containing an input.json (the render options) and an output.txt (the
+// expected prompt), the layout of tests/templating at the root of the repository. The
+// SHA-256 hashes of the expected prompts are kept in a prompts.sha256 manifest next to the
+// version directories, so CI can compare renders without diffing whole prompts.
+//
+// Check rewrites the expected prompts and the manifest from the current renders when told
+// to update them, e.g. by an -update flag of the tests calling it.
+package goldentest
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+// ManifestName is the name of the manifest of prompt hashes in a fixture directory
+const ManifestName = "prompts.sha256"
+
+// versions are the template versions of a fixture directory
+var versions = []string{"cmd3", "cmd4"}
+
+// Fixture is a single case loaded from a fixture directory
+type Fixture struct {
+	// Version is the template version of the case, "cmd3" or "cmd4"
+	Version string
+	Name    string
+	Dir     string
+	// Input is the JSON encoding of the RenderCmd3Options or RenderCmd4Options
+	Input []byte
+	// Want is the expected prompt, empty when the case has no output.txt yet
+	Want string
+}
+
+// Key is the path of the case relative to the fixture directory, e.g. "cmd3/one_message"
+func (f Fixture) Key() string {
+	return f.Version + "/" + f.Name
+}
+
+// Result is the render of a fixture
+type Result struct {
+	Fixture Fixture
+	Got     string
+	Err     error
+}
+
+// Hash returns the hash of the rendered prompt
+func (r Result) Hash() string {
+	return Hash(r.Got)
+}
+
+// Diff returns the sections of the prompt that differ from the expected prompt
+func (r Result) Diff() melody.PromptDiff {
+	return melody.DiffRenders(r.Fixture.Want, r.Got)
+}
+
+// Hash returns the hex-encoded SHA-256 hash of a prompt
+func Hash(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadFixtures reads every case of the fixture directory dir, sorted by version and name.
+// Version directories that do not exist are skipped.
+func LoadFixtures(dir string) ([]Fixture, error) {
+	var fixtures []Fixture
+	for _, version := range versions {
+		entries, err := os.ReadDir(filepath.Join(dir, version))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			f := Fixture{Version: version, Name: entry.Name(), Dir: filepath.Join(dir, version, entry.Name())}
+			if f.Input, err = os.ReadFile(filepath.Join(f.Dir, "input.json")); err != nil {
+				return nil, err
+			}
+			want, err := os.ReadFile(filepath.Join(f.Dir, "output.txt"))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			f.Want = string(want)
+			fixtures = append(fixtures, f)
+		}
+	}
+	return fixtures, nil
+}
+
+// Render renders the fixture with the template of its version
+func Render(f Fixture) (string, error) {
+	switch f.Version {
+	case "cmd3":
+		var opts melody.RenderCmd3Options
+		if err := json.Unmarshal(f.Input, &opts); err != nil {
+			return "", fmt.Errorf("%s: invalid input.json: %w", f.Key(), err)
+		}
+		return melody.RenderCMD3(opts)
+	case "cmd4":
+		var opts melody.RenderCmd4Options
+		if err := json.Unmarshal(f.Input, &opts); err != nil {
+			return "", fmt.Errorf("%s: invalid input.json: %w", f.Key(), err)
+		}
+		return melody.RenderCMD4(opts)
+	}
+	return "", fmt.Errorf("%s: unknown template version %q", f.Key(), f.Version)
+}
+
+// RenderAll renders every fixture
+func RenderAll(fixtures []Fixture) []Result {
+	results := make([]Result, len(fixtures))
+	for i, f := range fixtures {
+		got, err := Render(f)
+		results[i] = Result{Fixture: f, Got: got, Err: err}
+	}
+	return results
+}
+
+// ReadHashes reads a manifest of prompt hashes, keyed by the Key of the fixtures
+func ReadHashes(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		// The format of sha256sum, the hash and the name separated by two spaces
+		hash, key, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid manifest line", path, line)
+		}
+		hashes[key] = hash
+	}
+	return hashes, scanner.Err()
+}
+
+// WriteHashes writes the manifest of the prompt hashes of the results that rendered
+func WriteHashes(path string, results []Result) error {
+	var lines []string
+	for _, r := range results {
+		if r.Err == nil {
+			lines = append(lines, r.Hash()+"  "+r.Fixture.Key()+"\n")
+		}
+	}
+	slices.Sort(lines)
+	return os.WriteFile(path, []byte(strings.Join(lines, "")), 0o644)
+}
+
+// Update rewrites the expected prompts of the fixture directory dir and its manifest
+// from the results
+func Update(dir string, results []Result) error {
+	for _, r := range results {
+		if r.Err != nil {
+			return r.Err
+		}
+		if err := os.WriteFile(filepath.Join(r.Fixture.Dir, "output.txt"), []byte(r.Got), 0o644); err != nil {
+			return err
+		}
+	}
+	return WriteHashes(filepath.Join(dir, ManifestName), results)
+}
+
+// Check renders the fixtures of dir and fails t for every prompt that differs from its
+// expected prompt or from its hash in the manifest, if there is one. With update it rewrites
+// the expected prompts and the manifest instead.
+func Check(t testing.TB, dir string, update bool) {
+	t.Helper()
+	fixtures, err := LoadFixtures(dir)
+	if err != nil {
+		t.Fatalf("failed to load the fixtures: %v", err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatalf("no fixtures in %s", dir)
+	}
+	results := RenderAll(fixtures)
+	if update {
+		if err := Update(dir, results); err != nil {
+			t.Fatalf("failed to update the fixtures: %v", err)
+		}
+		return
+	}
+
+	hashes, err := ReadHashes(filepath.Join(dir, ManifestName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("failed to read the manifest: %v", err)
+	}
+	for _, r := range results {
+		key := r.Fixture.Key()
+		switch {
+		case r.Err != nil:
+			t.Errorf("%s: %v", key, r.Err)
+		case r.Got != r.Fixture.Want:
+			t.Errorf("%s: the prompt differs from output.txt:\n%s", key, r.Diff())
+		case hashes != nil && hashes[key] != r.Hash():
+			t.Errorf("%s: the prompt hash %s differs from the manifest hash %q", key, r.Hash(), hashes[key])
+		}
+	}
+}
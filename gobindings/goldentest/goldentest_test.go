@@ -0,0 +1,46 @@
+package goldentest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGolden(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	input := `{"messages": [{"role": "user", "content": [{"type": "text", "text": "Hi"}]}]}`
+	for _, version := range []string{"cmd3", "cmd4"} {
+		caseDir := filepath.Join(dir, version, "one_message")
+		require.NoError(t, os.MkdirAll(caseDir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(caseDir, "input.json"), []byte(input), 0o644))
+	}
+
+	fixtures, err := LoadFixtures(dir)
+	require.NoError(t, err)
+	require.Len(t, fixtures, 2)
+	require.Equal(t, "cmd3/one_message", fixtures[0].Key())
+	require.Empty(t, fixtures[0].Want)
+
+	results := RenderAll(fixtures)
+	require.NoError(t, results[0].Err)
+	require.NoError(t, Update(dir, results))
+
+	// The updated fixtures match their renders
+	Check(t, dir, false)
+	hashes, err := ReadHashes(filepath.Join(dir, ManifestName))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"cmd3/one_message": Hash(results[0].Got),
+		"cmd4/one_message": Hash(results[1].Got),
+	}, hashes)
+
+	// A changed prompt is reported by section
+	fixtures[0].Want = results[0].Got + "\n"
+	r := RenderAll(fixtures[:1])[0]
+	require.NotEqual(t, fixtures[0].Want, r.Got)
+	require.NotEmpty(t, r.Diff())
+}
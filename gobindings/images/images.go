@@ -0,0 +1,236 @@
+// Package images computes how images in multimodal prompts are laid out as tokens, so
+// the placeholders of image content and the number of tokens they take are derived from
+// the images rather than pre-computed by callers.
+//
+// A Layout describes how a model splits an image into square tiles, each taking a fixed
+// number of tokens. The layout of an image is computed from its dimensions, or from its
+// encoded bytes:
+//
+//	img, err := images.CommandAVision.FromBytes(data)
+//	msg := melody.Message{Role: melody.RoleUser, Content: []melody.Content{img.Content()}}
+//	budget -= img.Tokens
+//
+// Inline images, image content with the encoded image as Data, get their placeholders from
+// Layout.ResolveInline, which returns the images in the order of their placeholders.
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	// Register the decoders of the formats accepted by FromBytes
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"slices"
+	"strings"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+// Layout is how a model splits images into tiles. Its special tokens are each assumed to
+// be a single token of the model's vocabulary.
+type Layout struct {
+	// TileSize is the width and height in pixels of a tile
+	TileSize int
+	// MaxTiles is the maximum number of tiles of an image, its thumbnail excluded
+	MaxTiles int
+	// TokensPerTile is the number of patch tokens of a tile
+	TokensPerTile int
+	// Thumbnail adds a tile of the whole image downscaled to images split into several tiles
+	Thumbnail bool
+
+	// StartToken and EndToken enclose the tokens of an image, PatchToken is repeated
+	// TokensPerTile times for every tile
+	StartToken string
+	PatchToken string
+	EndToken   string
+}
+
+// CommandAVision is the layout of the Command A Vision models
+var CommandAVision = Layout{
+	TileSize:      512,
+	MaxTiles:      12,
+	TokensPerTile: 256,
+	Thumbnail:     true,
+	StartToken:    "<|START_OF_IMG|>",
+	PatchToken:    "<|IMG_PATCH|>",
+	EndToken:      "<|END_OF_IMG|>",
+}
+
+// Image is the layout of an image
+type Image struct {
+	Width  int
+	Height int
+	// Rows and Cols are the grid of tiles the image is resized to
+	Rows int
+	Cols int
+	// Thumbnail is set if a thumbnail tile follows the grid
+	Thumbnail bool
+	// Tokens is the number of tokens of the image in the prompt, the start and end tokens
+	// included
+	Tokens int
+	// Placeholder is the text of the image in the prompt
+	Placeholder string
+}
+
+// Tiles returns the number of tiles of the image, its thumbnail included
+func (img Image) Tiles() int {
+	n := img.Rows * img.Cols
+	if img.Thumbnail {
+		n++
+	}
+	return n
+}
+
+// Content returns the image content of a message
+func (img Image) Content() melody.Content {
+	return melody.Content{
+		Type:  melody.ContentImage,
+		Image: &melody.Image{TemplatePlaceholder: img.Placeholder},
+	}
+}
+
+// TotalTokens returns the number of tokens of the images
+func TotalTokens(imgs ...Image) int {
+	n := 0
+	for _, img := range imgs {
+		n += img.Tokens
+	}
+	return n
+}
+
+// FromBytes returns the layout of an encoded PNG, JPEG or GIF image. Only its header is
+// decoded.
+func (l Layout) FromBytes(data []byte) (Image, error) {
+	img, _, err := l.fromBytes(data)
+	return img, err
+}
+
+func (l Layout) fromBytes(data []byte) (Image, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	img, err := l.FromDimensions(cfg.Width, cfg.Height)
+	return img, format, err
+}
+
+// Payload is an inline image of a prompt, for the vision encoder
+type Payload struct {
+	// Data is the encoded image and MediaType its media type, detected from Data when the
+	// content has none
+	Data      []byte
+	MediaType string
+	// Image is the layout of the image
+	Image Image
+}
+
+// ResolveInline sets the placeholder of the inline images of messages, the image content
+// with Data, to the placeholder of their layout when they have none, and returns the
+// payloads of the inline images in the order of their placeholders in the prompt. The
+// messages are copied rather than modified. Image content without Data is kept as given
+// and has no payload.
+//
+// Messages should be resolved last, after they are trimmed e.g. by melody.FitToContext, so
+// the payloads stay aligned with the placeholders of the rendered prompt.
+func (l Layout) ResolveInline(messages []melody.Message) ([]melody.Message, []Payload, error) {
+	resolved := slices.Clone(messages)
+	var payloads []Payload
+	for i, m := range resolved {
+		copied := false
+		for j, c := range m.Content {
+			if c.Image == nil || len(c.Image.Data) == 0 {
+				continue
+			}
+			img, format, err := l.fromBytes(c.Image.Data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("message[%d] content[%d]: %w", i, j, err)
+			}
+			inline := *c.Image
+			if inline.TemplatePlaceholder == "" {
+				inline.TemplatePlaceholder = img.Placeholder
+			}
+			if inline.MediaType == "" {
+				inline.MediaType = "image/" + format
+			}
+			if !copied {
+				resolved[i].Content = slices.Clone(m.Content)
+				copied = true
+			}
+			resolved[i].Content[j].Image = &inline
+			payloads = append(payloads, Payload{Data: inline.Data, MediaType: inline.MediaType, Image: img})
+		}
+	}
+	return resolved, payloads, nil
+}
+
+// FromDimensions returns the layout of an image of the given size in pixels
+func (l Layout) FromDimensions(width, height int) (Image, error) {
+	if err := l.validate(); err != nil {
+		return Image{}, err
+	}
+	if width <= 0 || height <= 0 {
+		return Image{}, fmt.Errorf("invalid image dimensions %dx%d", width, height)
+	}
+
+	rows, cols := l.grid(width, height)
+	img := Image{
+		Width:     width,
+		Height:    height,
+		Rows:      rows,
+		Cols:      cols,
+		Thumbnail: l.Thumbnail && rows*cols > 1,
+	}
+	img.Tokens = img.Tiles()*l.TokensPerTile + 2
+	img.Placeholder = l.placeholder(img.Tiles())
+	return img, nil
+}
+
+func (l Layout) validate() error {
+	if l.TileSize <= 0 || l.MaxTiles <= 0 || l.TokensPerTile <= 0 {
+		return errors.New("the tile size, max tiles and tokens per tile of a layout must be positive")
+	}
+	return nil
+}
+
+// grid returns the grid of at most MaxTiles tiles whose aspect ratio is the closest to the
+// image's. Among grids of the same ratio, the larger one is kept only if the image covers
+// at least half of it, so small images are not upscaled into many tiles.
+func (l Layout) grid(width, height int) (rows, cols int) {
+	ratio := float64(width) / float64(height)
+	area := float64(width) * float64(height)
+	tileArea := float64(l.TileSize) * float64(l.TileSize)
+
+	bestDiff := math.Inf(1)
+	rows, cols = 1, 1
+	for n := 1; n <= l.MaxTiles; n++ {
+		for c := 1; c <= n; c++ {
+			if n%c != 0 {
+				continue
+			}
+			r := n / c
+			diff := math.Abs(math.Log(ratio * float64(r) / float64(c)))
+			switch {
+			case diff < bestDiff-1e-9:
+				bestDiff, rows, cols = diff, r, c
+			case math.Abs(diff-bestDiff) <= 1e-9 && area > 0.5*tileArea*float64(n):
+				rows, cols = r, c
+			}
+		}
+	}
+	return rows, cols
+}
+
+func (l Layout) placeholder(tiles int) string {
+	var b strings.Builder
+	b.Grow(len(l.StartToken) + tiles*l.TokensPerTile*len(l.PatchToken) + len(l.EndToken))
+	b.WriteString(l.StartToken)
+	for range tiles * l.TokensPerTile {
+		b.WriteString(l.PatchToken)
+	}
+	b.WriteString(l.EndToken)
+	return b.String()
+}
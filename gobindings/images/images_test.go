@@ -0,0 +1,112 @@
+package images_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/images"
+)
+
+func TestLayout_FromDimensions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		width, height int
+		rows, cols    int
+		thumbnail     bool
+	}{
+		{width: 512, height: 512, rows: 1, cols: 1},
+		// Small images are not upscaled into several tiles
+		{width: 100, height: 100, rows: 1, cols: 1},
+		{width: 1024, height: 512, rows: 1, cols: 2, thumbnail: true},
+		{width: 512, height: 1536, rows: 3, cols: 1, thumbnail: true},
+		{width: 4000, height: 3000, rows: 3, cols: 4, thumbnail: true},
+		// Extreme ratios are capped by the number of tiles
+		{width: 10000, height: 100, rows: 1, cols: 12, thumbnail: true},
+	} {
+		img, err := images.CommandAVision.FromDimensions(tc.width, tc.height)
+		require.NoError(t, err)
+		require.Equal(t, tc.rows, img.Rows, "%dx%d", tc.width, tc.height)
+		require.Equal(t, tc.cols, img.Cols, "%dx%d", tc.width, tc.height)
+		require.Equal(t, tc.thumbnail, img.Thumbnail, "%dx%d", tc.width, tc.height)
+		require.Equal(t, img.Tiles()*256+2, img.Tokens)
+		require.Equal(t, img.Tiles()*256, strings.Count(img.Placeholder, "<|IMG_PATCH|>"))
+		require.True(t, strings.HasPrefix(img.Placeholder, "<|START_OF_IMG|>"))
+		require.True(t, strings.HasSuffix(img.Placeholder, "<|END_OF_IMG|>"))
+	}
+
+	_, err := images.CommandAVision.FromDimensions(0, 10)
+	require.EqualError(t, err, "invalid image dimensions 0x10")
+	_, err = images.Layout{}.FromDimensions(10, 10)
+	require.Error(t, err)
+}
+
+func TestLayout_FromBytes(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1024, 512))))
+	img, err := images.CommandAVision.FromBytes(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, 1024, img.Width)
+	require.Equal(t, 512, img.Height)
+	require.Equal(t, 3, img.Tiles())
+	require.Equal(t, 770, images.TotalTokens(img))
+
+	content := img.Content()
+	require.Equal(t, melody.ContentImage, content.Type)
+	require.Equal(t, img.Placeholder, content.Image.TemplatePlaceholder)
+
+	_, err = images.CommandAVision.FromBytes([]byte("not an image"))
+	require.ErrorContains(t, err, "failed to decode image")
+}
+
+func TestLayout_ResolveInline(t *testing.T) {
+	t.Parallel()
+
+	encode := func(width, height int) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))))
+		return buf.Bytes()
+	}
+	wide, tall := encode(1024, 512), encode(512, 512)
+	messages := []melody.Message{
+		{Role: melody.RoleUser, Content: []melody.Content{
+			{Type: melody.ContentText, Text: "Compare"},
+			{Type: melody.ContentImage, Image: &melody.Image{Data: wide}},
+			{Type: melody.ContentImage, Image: &melody.Image{TemplatePlaceholder: "<img>"}},
+		}},
+		{Role: melody.RoleChatbot, Content: []melody.Content{{Type: melody.ContentText, Text: "With?"}}},
+		{Role: melody.RoleUser, Content: []melody.Content{
+			{Type: melody.ContentImage, Image: &melody.Image{Data: tall, MediaType: "image/x-png"}},
+		}},
+	}
+
+	resolved, payloads, err := images.CommandAVision.ResolveInline(messages)
+	require.NoError(t, err)
+	require.Len(t, payloads, 2)
+	require.Equal(t, wide, payloads[0].Data)
+	require.Equal(t, "image/png", payloads[0].MediaType)
+	require.Equal(t, 3, payloads[0].Image.Tiles())
+	require.Equal(t, "image/x-png", payloads[1].MediaType)
+	require.Equal(t, 1, payloads[1].Image.Tiles())
+
+	require.Equal(t, payloads[0].Image.Placeholder, resolved[0].Content[1].Image.TemplatePlaceholder)
+	require.Equal(t, "<img>", resolved[0].Content[2].Image.TemplatePlaceholder)
+	require.Equal(t, payloads[1].Image.Placeholder, resolved[2].Content[0].Image.TemplatePlaceholder)
+	require.Empty(t, melody.Validate(resolved, nil, nil))
+
+	// The messages are not modified
+	require.Empty(t, messages[0].Content[1].Image.TemplatePlaceholder)
+	require.Equal(t, melody.ValidationUnresolvedImage, melody.Validate(messages, nil, nil)[0].Code)
+
+	messages[2].Content[0].Image.Data = []byte("not an image")
+	_, _, err = images.CommandAVision.ResolveInline(messages)
+	require.ErrorContains(t, err, "message[2] content[0]: failed to decode image")
+}
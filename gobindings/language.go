@@ -0,0 +1,171 @@
+package gobindings
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// languageWindowRunes is the number of runes of the latest text the language is detected on
+const languageWindowRunes = 256
+
+// LanguageUndetermined is the code of text whose language is not detected, e.g. numbers or
+// code
+const LanguageUndetermined = "und"
+
+// languageStopwords are frequent words of the languages of the Latin script, which tell
+// them apart
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "you", "was", "with", "on", "are", "this", "be", "have", "not"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "un", "du", "que", "pour", "dans", "pas", "qui", "sur", "au", "avec", "je", "vous"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "sich", "auf", "ich", "es", "dem", "sie", "von"},
+	"es": {"el", "la", "los", "las", "y", "que", "en", "es", "un", "una", "por", "con", "para", "del", "se", "no", "lo", "como"},
+	"it": {"il", "la", "che", "di", "e", "un", "una", "per", "non", "sono", "con", "gli", "del", "della", "è", "mi", "ho", "anche"},
+	"pt": {"o", "a", "os", "as", "que", "não", "um", "uma", "com", "para", "do", "da", "em", "é", "se", "mais", "no", "você"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "zijn", "voor", "met", "ik", "je", "ook", "maar", "er"},
+}
+
+// stopwordLanguages maps every stopword to the languages it is frequent in
+var stopwordLanguages = func() map[string][]string {
+	m := make(map[string][]string)
+	for lang, words := range languageStopwords {
+		for _, w := range words {
+			m[w] = append(m[w], lang)
+		}
+	}
+	return m
+}()
+
+// languageScripts are the languages told by their script alone. Han is Chinese unless
+// the text has kana.
+var languageScripts = []struct {
+	script *unicode.RangeTable
+	code   string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Bengali, "bn"},
+	{unicode.Tamil, "ta"},
+}
+
+// detectLanguage returns the ISO 639-1 code of the language of text and the confidence of
+// it, between 0 and 1. The script of the letters tells most languages, the frequent words
+// tell those of the Latin script apart.
+func detectLanguage(text string) LanguageGuess {
+	counts := make(map[string]int)
+	letters, latin, kana := 0, 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, s := range languageScripts {
+			if unicode.Is(s.script, r) {
+				counts[s.code]++
+				break
+			}
+		}
+		if unicode.In(r, unicode.Hiragana, unicode.Katakana) {
+			kana++
+		}
+	}
+	if letters == 0 {
+		return LanguageGuess{Code: LanguageUndetermined}
+	}
+	if kana > 0 {
+		// Japanese is written with kanji, the Han characters
+		counts["ja"] += counts["zh"]
+		delete(counts, "zh")
+	}
+
+	code, best := "", 0
+	for c, n := range counts {
+		if n > best || n == best && c < code {
+			code, best = c, n
+		}
+	}
+	if best > latin {
+		return LanguageGuess{Code: code, Confidence: float64(best) / float64(letters)}
+	}
+
+	hits := make(map[string]int)
+	total := 0
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for _, lang := range stopwordLanguages[w] {
+			hits[lang]++
+			total++
+		}
+	}
+	code, best = LanguageUndetermined, 0
+	for c, n := range hits {
+		if n > best || n == best && c < code {
+			code, best = c, n
+		}
+	}
+	if best == 0 {
+		return LanguageGuess{Code: LanguageUndetermined}
+	}
+	// A few frequent words are weak evidence
+	confidence := float64(latin) / float64(letters) * float64(best) / float64(total) * min(1, float64(best)/4)
+	return LanguageGuess{Code: code, Confidence: confidence}
+}
+
+// languageWindow is the latest text of the response or of a thinking block of the
+// reasoning, see WithLanguageDetection
+type languageWindow struct {
+	Reasoning bool   `json:"reasoning,omitempty"`
+	PlanIndex uint   `json:"plan_index,omitempty"`
+	Text      string `json:"text,omitempty"`
+}
+
+// write appends text to the window, keeping its last languageWindowRunes runes
+func (w *languageWindow) write(text string) {
+	w.Text += text
+	for n := utf8.RuneCountInString(w.Text); n > languageWindowRunes; n-- {
+		_, size := utf8.DecodeRuneInString(w.Text)
+		w.Text = w.Text[size:]
+	}
+}
+
+// detectLanguages sets the language of the text of every output, see WithLanguageDetection
+func (f *SyncFilter) detectLanguages(outputs []FilterOutput) {
+	if !f.languageDetection {
+		return
+	}
+	for i := range outputs {
+		o := &outputs[i]
+		if o.Text == "" || o.IsEcho {
+			continue
+		}
+		w := f.languageWindow(o.IsReasoning, o.PlanIndex)
+		w.write(o.Text)
+		guess := detectLanguage(w.Text)
+		o.Language = &guess
+	}
+}
+
+// languageWindow returns the window of the response or of a thinking block
+func (f *SyncFilter) languageWindow(reasoning bool, plan uint) *languageWindow {
+	if !reasoning {
+		plan = 0
+	}
+	for i := range f.languageWindows {
+		if w := &f.languageWindows[i]; w.Reasoning == reasoning && w.PlanIndex == plan {
+			return w
+		}
+	}
+	f.languageWindows = append(f.languageWindows, languageWindow{Reasoning: reasoning, PlanIndex: plan})
+	return &f.languageWindows[len(f.languageWindows)-1]
+}
@@ -0,0 +1,59 @@
+package gobindings
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	t.Parallel()
+
+	for text, want := range map[string]string{
+		"The weather is nice and the sky is clear, so you should go for a walk.":    "en",
+		"Le temps est beau et le ciel est clair, vous pouvez sortir avec nous.":     "fr",
+		"Das Wetter ist schön und der Himmel ist klar, ich gehe mit dir raus.":      "de",
+		"El tiempo es bueno y el cielo está despejado, puedes salir con los tuyos.": "es",
+		"Het weer is mooi en de lucht is helder, je kunt ook een wandeling maken.":  "nl",
+		"今日はいい天気ですね。":                                                               "ja",
+		"今天天气很好。":                                                                   "zh",
+		"오늘 날씨가 좋네요.":                                                               "ko",
+		"Сегодня хорошая погода.":                                                   "ru",
+		"الطقس جميل اليوم":                                                          "ar",
+		"12345 + 678":                                                               LanguageUndetermined,
+		"func main() { fmt.Println() }":                                             LanguageUndetermined,
+	} {
+		got := detectLanguage(text)
+		require.Equal(t, want, got.Code, text)
+		if want != LanguageUndetermined {
+			require.Greater(t, got.Confidence, 0.5, text)
+		}
+	}
+	// A few words are weak evidence
+	require.Less(t, detectLanguage("the sky").Confidence, 0.5)
+}
+
+func TestFilter_LanguageDetection(t *testing.T) {
+	t.Parallel()
+
+	f := NewFilter(WithLanguageDetection())
+	languages := func(text string) []string {
+		var codes []string
+		for _, word := range strings.SplitAfter(text, " ") {
+			out, err := f.WriteDecoded(word, nil)
+			require.NoError(t, err)
+			for _, o := range out {
+				require.NotNil(t, o.Language)
+				codes = append(codes, o.Language.Code)
+			}
+		}
+		return codes
+	}
+	english := languages("The weather is nice and the sky is clear, so you should go for a walk. ")
+	require.Equal(t, "en", english[len(english)-1])
+
+	// The window follows a change of language
+	french := languages(strings.Repeat("Le temps est beau et le ciel est clair, vous pouvez sortir avec nous. ", 4))
+	require.Equal(t, "fr", french[len(french)-1])
+}
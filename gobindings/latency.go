@@ -0,0 +1,81 @@
+package gobindings
+
+import (
+	"slices"
+	"time"
+)
+
+// FilterTiming is when the text of an output was written to the filter and when the output
+// was emitted. Both hold a reading of the monotonic clock, so EmittedAt.Sub(WrittenAt), the
+// time the filter held the text back and parsed it, is not skewed by changes of the wall
+// clock. The reading is not kept by the JSON encoding.
+type FilterTiming struct {
+	// WrittenAt is the time of the oldest write the output carries text of
+	WrittenAt time.Time `json:"written_at"`
+	EmittedAt time.Time `json:"emitted_at"`
+}
+
+// LatencySummary is the in-filter latency of a stream, the time from the write of the text
+// of an output to its emission
+type LatencySummary struct {
+	// Tokens is the number of tokens written, Chunks the number of outputs emitted
+	Tokens int           `json:"tokens"`
+	Chunks int           `json:"chunks"`
+	P50    time.Duration `json:"p50"`
+	P95    time.Duration `json:"p95"`
+}
+
+// latencyStamps stamps the outputs of a filter with their timing, see WithLatencyStamps
+type latencyStamps struct {
+	// pending is the time of the oldest write whose text the filter holds back, zero when
+	// it holds none
+	pending   time.Time
+	tokens    int
+	latencies []time.Duration
+}
+
+// stamp sets the timing of the outputs of tokens written at written. buffered reports
+// whether the filter holds text back after the write.
+func (l *latencyStamps) stamp(written time.Time, tokens int, outputs []FilterOutput, buffered bool) {
+	if l == nil {
+		return
+	}
+	l.tokens += tokens
+	if l.pending.IsZero() {
+		l.pending = written
+	}
+	if len(outputs) == 0 {
+		return
+	}
+	emitted := time.Now()
+	for i := range outputs {
+		outputs[i].Timing = &FilterTiming{WrittenAt: l.pending, EmittedAt: emitted}
+		l.latencies = append(l.latencies, emitted.Sub(l.pending))
+	}
+	// The text held back is at most as old as the last write
+	l.pending = time.Time{}
+	if buffered {
+		l.pending = written
+	}
+}
+
+// summarize sets the latency summary of the stream on its last output, appending an output
+// if there is none
+func (l *latencyStamps) summarize(outputs []FilterOutput) []FilterOutput {
+	if l == nil {
+		return outputs
+	}
+	sorted := slices.Clone(l.latencies)
+	slices.Sort(sorted)
+	summary := &LatencySummary{
+		Tokens: l.tokens,
+		Chunks: len(sorted),
+		P50:    percentile(sorted, 50),
+		P95:    percentile(sorted, 95),
+	}
+	if len(outputs) == 0 {
+		outputs = append(outputs, FilterOutput{})
+	}
+	outputs[len(outputs)-1].LatencySummary = summary
+	return outputs
+}
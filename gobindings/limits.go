@@ -0,0 +1,23 @@
+package gobindings
+
+import "fmt"
+
+// StreamLimit is a limit of a filter stream
+type StreamLimit string
+
+const (
+	// LimitMaxBufferBytes is the limit set with WithMaxBufferBytes
+	LimitMaxBufferBytes StreamLimit = "max buffer bytes"
+	// LimitIdleTimeout is the limit set with WithIdleTimeout
+	LimitIdleTimeout StreamLimit = "idle timeout"
+)
+
+// StreamLimitError is returned by a filter whose stream exceeded a limit. The stream cannot
+// be resumed, serving layers should recycle the connection.
+type StreamLimitError struct {
+	Limit StreamLimit
+}
+
+func (e *StreamLimitError) Error() string {
+	return fmt.Sprintf("filter stream exceeded its %s", e.Limit)
+}
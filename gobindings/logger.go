@@ -0,0 +1,50 @@
+package gobindings
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Field is a key-value pair attached to a log message
+type Field struct {
+	Key   string
+	Value any
+}
+
+// Logger receives the log messages of a filter, e.g. about citations that cannot be resolved.
+// Services plug in their own logging with an adapter like NewSlogLogger, a zap logger can be
+// used through its slog handler.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// nopLogger discards every message, it is the Logger of filters created without WithLogger
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+// slogLogger adapts a *slog.Logger to Logger
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to l
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Debug(msg string, fields ...Field) { s.log(slog.LevelDebug, msg, fields) }
+func (s slogLogger) Warn(msg string, fields ...Field)  { s.log(slog.LevelWarn, msg, fields) }
+func (s slogLogger) Error(msg string, fields ...Field) { s.log(slog.LevelError, msg, fields) }
+
+func (s slogLogger) log(level slog.Level, msg string, fields []Field) {
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	s.l.LogAttrs(context.Background(), level, msg, attrs...)
+}
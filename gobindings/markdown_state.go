@@ -0,0 +1,144 @@
+package gobindings
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	markdownFence    = regexp.MustCompile("^\\s*(`{3,}|~{3,})\\s*([^\\s`]*)")
+	markdownListItem = regexp.MustCompile(`^\s*([-*+]|\d{1,9}[.)])\s`)
+)
+
+// markdownTracker follows the markdown blocks of the text of the response or of a thinking
+// block of the reasoning, see WithMarkdownState
+type markdownTracker struct {
+	Reasoning bool `json:"reasoning,omitempty"`
+	PlanIndex uint `json:"plan_index,omitempty"`
+	// Line is the start of the line being written
+	Line string `json:"line,omitempty"`
+	// Fence is the marker of the open code fence, e.g. "```", and Language its language
+	Fence    string `json:"fence,omitempty"`
+	Language string `json:"language,omitempty"`
+	// ListIndents are the indentations of the items of the open lists, outermost first
+	ListIndents []int `json:"list_indents,omitempty"`
+	// AfterBlank is set after a blank line, which a list ends at
+	AfterBlank bool `json:"after_blank,omitempty"`
+	InTable    bool `json:"in_table,omitempty"`
+}
+
+// clone returns a copy of t that reads on independently
+func (t markdownTracker) clone() markdownTracker {
+	t.ListIndents = slices.Clone(t.ListIndents)
+	return t
+}
+
+// write reads text and returns the blocks open at its end. The line being written is read
+// as if it ended there, so a table row or a fence is open from its first characters.
+func (t *markdownTracker) write(text string) MarkdownState {
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		t.endLine(t.Line + text[:i])
+		t.Line, text = "", text[i+1:]
+	}
+	t.Line += text
+
+	s := *t
+	if s.Line != "" {
+		s = t.clone()
+		s.endLine(s.Line)
+	}
+	return MarkdownState{
+		InCodeFence:  s.Fence != "",
+		CodeLanguage: s.Language,
+		ListDepth:    len(s.ListIndents),
+		InTable:      s.InTable,
+	}
+}
+
+// endLine reads a complete line
+func (t *markdownTracker) endLine(line string) {
+	trimmed := strings.TrimSpace(line)
+	if t.Fence != "" {
+		if len(trimmed) >= len(t.Fence) && strings.Trim(trimmed, t.Fence[:1]) == "" {
+			t.Fence, t.Language = "", ""
+		}
+		return
+	}
+	if m := markdownFence.FindStringSubmatch(line); m != nil {
+		t.Fence, t.Language, t.InTable = m[1], m[2], false
+		return
+	}
+	if trimmed == "" {
+		t.AfterBlank, t.InTable = true, false
+		return
+	}
+
+	indent := markdownIndent(line)
+	t.InTable = strings.HasPrefix(trimmed, "|")
+	switch {
+	case markdownListItem.MatchString(line):
+		for len(t.ListIndents) > 0 && t.ListIndents[len(t.ListIndents)-1] > indent {
+			t.ListIndents = t.ListIndents[:len(t.ListIndents)-1]
+		}
+		if len(t.ListIndents) == 0 || t.ListIndents[len(t.ListIndents)-1] < indent {
+			t.ListIndents = append(t.ListIndents, indent)
+		}
+	case t.AfterBlank:
+		// A paragraph after a blank line ends the lists it is not indented into
+		for len(t.ListIndents) > 0 && t.ListIndents[len(t.ListIndents)-1] >= indent {
+			t.ListIndents = t.ListIndents[:len(t.ListIndents)-1]
+		}
+	}
+	t.AfterBlank = false
+}
+
+// markdownIndent returns the indentation of line in columns, a tab being 4
+func markdownIndent(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// trackMarkdown sets the markdown blocks open at the end of the text of every output, see
+// WithMarkdownState
+func (f *SyncFilter) trackMarkdown(outputs []FilterOutput) {
+	if !f.markdownState {
+		return
+	}
+	for i := range outputs {
+		o := &outputs[i]
+		if o.Text == "" || o.IsEcho {
+			continue
+		}
+		s := f.markdownTracker(o.IsReasoning, o.PlanIndex).write(o.Text)
+		o.Markdown = &s
+	}
+}
+
+// markdownTracker returns the tracker of the response or of a thinking block
+func (f *SyncFilter) markdownTracker(reasoning bool, plan uint) *markdownTracker {
+	if !reasoning {
+		plan = 0
+	}
+	for i := range f.markdown {
+		if t := &f.markdown[i]; t.Reasoning == reasoning && t.PlanIndex == plan {
+			return t
+		}
+	}
+	f.markdown = append(f.markdown, markdownTracker{Reasoning: reasoning, PlanIndex: plan})
+	return &f.markdown[len(f.markdown)-1]
+}
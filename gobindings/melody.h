@@ -19,6 +19,7 @@ typedef enum {
     CContentType_Thinking = 2,
     CContentType_Image = 3,
     CContentType_Document = 4,
+    CContentType_ElidedTurns = 5,
 } CContentType;
 
 typedef enum {
@@ -62,6 +63,7 @@ typedef struct {
     const char* thinking;
     const CImage* image;          // null if None
     const char* document_json;    // null if None; JSON Map<String, Value>
+    size_t elided_turns;
 } CContent;
 
 typedef struct {
@@ -74,6 +76,7 @@ typedef struct {
     size_t tool_call_index;
     size_t* tool_result_indices;
     size_t tool_result_indices_len;
+    char* source_name;
 } CSource;
 
 typedef struct {
@@ -142,18 +145,121 @@ typedef struct {
 // Templating FFI functions
 // ============================================================================
 
+typedef enum {
+    CErrorKind_None = 0,
+    CErrorKind_Unknown = 1,
+    CErrorKind_InvalidArgument = 2,
+    CErrorKind_TemplateSyntax = 3,
+    CErrorKind_InvalidMessages = 4,
+    CErrorKind_Json = 5,
+    CErrorKind_Panic = 6,
+} CErrorKind;
+
 typedef struct {
     char* result; // null if error
     char* error;  // null if success
+    CErrorKind error_kind;
 } CRenderResult;
 
 extern CRenderResult* melody_render_cmd3(const CRenderCmd3Options* opts);
 extern CRenderResult* melody_render_cmd4(const CRenderCmd4Options* opts);
 extern void melody_render_result_free(CRenderResult* res);
 
+// cmd3 system preamble, freed with melody_render_result_free
+typedef struct {
+    CSafetyMode safety_mode;
+    bool has_safety_mode;
+    CCitationQuality citation_quality;
+    bool has_citation_quality; // tool use instructions are left out if not set
+    CReasoningType reasoning_type;
+    bool has_reasoning_type;
+    const char* dev_instruction;
+} CPreambleOptions;
+
+extern CRenderResult* melody_build_preamble(const CPreambleOptions* opts);
+
+typedef enum {
+    CStructuredOutputMode_JsonObject = 0,
+    CStructuredOutputMode_JsonSchema = 1,
+} CStructuredOutputMode;
+
+extern CRenderResult* melody_build_structured_output_section(const char* schema, CStructuredOutputMode mode);
+extern CRenderResult* melody_document_index_map(const CMessage* messages, size_t messages_len, size_t documents_len);
+
+// Fill-in-the-middle prompts, freed with melody_render_result_free
+typedef enum {
+    CFimFamily_Command = 0,
+    CFimFamily_CodeLlama = 1,
+    CFimFamily_StarCoder = 2,
+} CFimFamily;
+
+typedef struct {
+    CFimFamily family;
+    const char* escaped_special_tokens_json; // JSON BTreeMap<String, String>
+} CRenderFimOptions;
+
+extern CRenderResult* melody_render_fim(const char* prefix, const char* suffix, const CRenderFimOptions* opts);
+
+// Custom template filters and tags. The callback returns the result as JSON, or
+// null and sets error. Both strings must be allocated with malloc, melody frees them.
+typedef char* (*CTemplateCallback)(uintptr_t handle, const char* input_json, const char* args_json, char** error);
+
+extern void melody_template_register_filter(const char* name, CTemplateCallback callback, uintptr_t handle);
+extern void melody_template_register_tag(const char* name, CTemplateCallback callback, uintptr_t handle);
+extern CRenderResult* melody_template_register_partial(const char* name, const char* body);
+
+// Template cache
+typedef struct {
+    uint64_t hits;
+    uint64_t misses;
+    uint64_t evictions;
+    size_t len;
+    size_t capacity;
+} CTemplateCacheStats;
+
+extern void melody_template_cache_set_capacity(size_t capacity);
+extern CTemplateCacheStats melody_template_cache_stats();
+
 typedef struct CFilter CFilter;
 typedef struct CFilterOptions CFilterOptions;
 
+typedef enum {
+    CFilterMode_PlainText = 0,
+    CFilterMode_Ignore = 1,
+    CFilterMode_ToolAction = 2,
+    CFilterMode_ToolReason = 3,
+    CFilterMode_Answer = 4,
+    CFilterMode_GroundedAnswer = 5,
+    CFilterMode_InclusiveStop = 6,
+    CFilterMode_ExclusiveStop = 7,
+    CFilterMode_SearchQuery = 8,
+    CFilterMode_NextSearchQuery = 9,
+} CFilterMode;
+
+typedef enum {
+    CCitationIndexUnit_Runes = 0,
+    CCitationIndexUnit_Graphemes = 1,
+    CCitationIndexUnit_Utf16 = 2,
+    CCitationIndexUnit_Bytes = 3,
+} CCitationIndexUnit;
+
+typedef enum {
+    CStopContext_PlainText = 0,
+    CStopContext_NotInAction = 1,
+    CStopContext_NotInThinking = 2,
+} CStopContext;
+
+typedef enum {
+    CCitationSourceFormat_ToolIndex = 0,
+    CCitationSourceFormat_ToolName = 1,
+} CCitationSourceFormat;
+
+typedef enum {
+    CUnicodeNormalization_None = 0,
+    CUnicodeNormalization_Nfc = 1,
+    CUnicodeNormalization_Nfkc = 2,
+} CUnicodeNormalization;
+
 typedef struct {
     char* text;
     size_t text_len;
@@ -161,6 +267,11 @@ typedef struct {
     size_t token_ids_len;
     float* logprobs;
     size_t logprobs_len;
+    size_t* top_logprobs_lens;
+    size_t top_logprobs_lens_len;
+    uint32_t* top_token_ids;
+    float* top_logprobs;
+    size_t top_logprobs_len;
     int32_t search_query_index;
     char* search_query_text;
     CFilterCitation* citations;
@@ -173,6 +284,16 @@ typedef struct {
     char* tool_call_raw_param_delta;
     bool is_post_answer;
     bool is_reasoning;
+    size_t plan_index;
+    bool is_echo;
+    int32_t finish_reason;
+    char* stop_sequence;
+    size_t* relevant_doc_indices;
+    size_t relevant_doc_indices_len;
+    bool has_relevant_doc_indices;
+    size_t* cited_doc_indices;
+    size_t cited_doc_indices_len;
+    bool has_cited_doc_indices;
 } CFilterOutput;
 
 typedef struct {
@@ -193,20 +314,53 @@ extern void melody_filter_options_cmd4(CFilterOptions* options);
 extern void melody_filter_options_handle_rag(CFilterOptions* options);
 extern void melody_filter_options_handle_search_query(CFilterOptions* options);
 extern void melody_filter_options_handle_multi_hop(CFilterOptions* options);
+extern void melody_filter_options_handle_llama3_chat(CFilterOptions* options);
+extern void melody_filter_options_handle_fim(CFilterOptions* options, CFimFamily family);
 extern void melody_filter_options_stream_non_grounded_answer(CFilterOptions* options);
 extern void melody_filter_options_stream_tool_actions(CFilterOptions* options);
 extern void melody_filter_options_stream_processed_params(CFilterOptions* options);
+extern void melody_filter_options_with_citation_merging(CFilterOptions* options);
+extern void melody_filter_options_with_sentence_citations(CFilterOptions* options);
+extern void melody_filter_options_with_finish_reason(CFilterOptions* options);
+extern void melody_filter_options_stream_document_selections(CFilterOptions* options);
+extern void melody_filter_options_with_prompt_echo(CFilterOptions* options, size_t prompt_token_count);
+extern void melody_filter_options_with_response_prefix(CFilterOptions* options, const char* prefix);
+extern void melody_filter_options_with_healed_prefix(CFilterOptions* options, const char* healed);
+extern void melody_filter_options_with_prefix_trim(CFilterOptions* options, const char* prefix);
+extern void melody_filter_options_with_resume_state(CFilterOptions* options, const char* prior_text, const CFilterCitation* citations, size_t citations_len);
+extern void melody_filter_options_with_citation_index_unit(CFilterOptions* options, CCitationIndexUnit unit);
+extern void melody_filter_options_with_citation_source_format(CFilterOptions* options, CCitationSourceFormat format);
+extern void melody_filter_options_with_unicode_normalization(CFilterOptions* options, CUnicodeNormalization form);
 extern void melody_filter_options_with_left_trimmed(CFilterOptions* options);
 extern void melody_filter_options_with_right_trimmed(CFilterOptions* options);
 extern void melody_filter_options_with_chunk_size(CFilterOptions* options, size_t size);
+extern void melody_filter_options_with_word_boundary_chunking(CFilterOptions* options, size_t min_chars);
+extern void melody_filter_options_with_rollback_window(CFilterOptions* options, size_t tokens);
+extern void melody_filter_options_with_dedup_window(CFilterOptions* options, size_t bytes);
+extern void melody_filter_options_legacy_search_query_splitting(CFilterOptions* options);
+extern void melody_filter_options_linear_token_matching(CFilterOptions* options);
 extern void melody_filter_options_with_inclusive_stops(CFilterOptions* options, const char** stops, size_t stops_len);
 extern void melody_filter_options_with_exclusive_stops(CFilterOptions* options, const char** stops, size_t stops_len);
+extern void melody_filter_options_with_conditional_stops(CFilterOptions* options, const char** stops, const CStopContext* contexts, size_t stops_len);
+extern void melody_filter_options_with_special_token(CFilterOptions* options, const char* token, CFilterMode mode);
 extern void melody_filter_options_remove_token(CFilterOptions* options, const char* token);
 
 // Filter functions
 extern CFilter* melody_filter_new(const CFilterOptions* options);
 extern void melody_filter_free(CFilter* filter);
 extern CFilterOutputResult* melody_filter_write_decoded(CFilter* filter, const char* decoded_token, const uint32_t* token_ids, size_t token_ids_len, const float* logprobs, size_t logprobs_len);
+extern CFilterOutputResult* melody_filter_write_decoded_with_top_logprobs(CFilter* filter, const char* decoded_token, const uint32_t* token_ids, size_t token_ids_len, const float* logprobs, size_t logprobs_len, const size_t* top_lens, size_t top_lens_len, const uint32_t* top_token_ids, const float* top_logprobs);
+extern CFilterOutputResult* melody_filter_write_decoded_batch(CFilter* filter, const char* text, const size_t* text_lens, size_t tokens_len, const uint32_t* token_ids, const size_t* token_ids_lens, const float* logprobs, const size_t* logprobs_lens);
 extern CFilterOutputResult* melody_filter_flush_partials(CFilter* filter);
+extern CFilterOutputResult* melody_filter_write_token(CFilter* filter, const void* tokenizer, uint32_t token_id, float logprob, bool has_logprob);
+extern CFilterOutputResult* melody_filter_flush_tokens(CFilter* filter, const void* tokenizer);
+extern size_t melody_filter_buffered_bytes(const CFilter* filter);
+extern CFilterMode melody_filter_current_mode(const CFilter* filter);
+extern CRenderResult* melody_filter_save_state(const CFilter* filter);
+extern CRenderResult* melody_filter_restore_state(CFilter* filter, const char* state);
+extern CRenderResult* melody_filter_rollback(CFilter* filter, size_t tokens);
+extern void melody_filter_request_soft_stop(CFilter* filter);
+extern void melody_filter_resume(CFilter* filter);
+extern CRenderResult* melody_describe_format(const char* name);
 extern void melody_result_free(CFilterOutputResult* res);
 extern void melody_filter_output_array_free(CFilterOutputArray* arr);
@@ -0,0 +1,100 @@
+package gobindings
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// presetFormatOptions are the options of the built-in formats by format name
+var presetFormatOptions = map[string]string{
+	"cmd3":         "HandleMultiHopCmd3",
+	"cmd4":         "HandleMultiHopCmd4",
+	"rag":          "HandleRAG",
+	"search_query": "HandleSearchQuery",
+	"multi_hop":    "HandleMultiHop",
+	"llama3_chat":  "HandleLlama3Chat",
+}
+
+// OptionConflict is a combination of filter options that is accepted but does not do what
+// it says, found by ValidateOptions
+type OptionConflict struct {
+	// Options are the names of the conflicting options, e.g. "HandleRAG"
+	Options []string `json:"options"`
+	Reason  string   `json:"reason"`
+}
+
+func (c OptionConflict) String() string {
+	return strings.Join(c.Options, " and ") + ": " + c.Reason
+}
+
+// OptionConflictError is the error of ValidateOptions, it matches ErrInvalidArgument
+type OptionConflictError struct {
+	Conflicts []OptionConflict
+}
+
+func (e *OptionConflictError) Error() string {
+	msgs := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		msgs[i] = c.String()
+	}
+	return "conflicting filter options: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether target is ErrInvalidArgument
+func (e *OptionConflictError) Is(target error) bool {
+	return target == ErrInvalidArgument
+}
+
+// ValidateOptions checks that filter options do not conflict, and returns an
+// *OptionConflictError listing all the conflicts found. NewFilter accepts conflicting
+// options, one of them silently winning, unless given WithStrictOptions: TryNewFilter then
+// rejects them with this error, and NewFilter returns nil.
+func ValidateOptions(options ...FilterOption) error {
+	cfg := &filterConfig{}
+	for _, opt := range options {
+		opt(cfg)
+	}
+	return cfg.validate()
+}
+
+// validate returns the conflicts of the configuration as an *OptionConflictError, or nil
+func (cfg *filterConfig) validate() error {
+	var conflicts []OptionConflict
+	conflict := func(reason string, options ...string) {
+		conflicts = append(conflicts, OptionConflict{Options: options, Reason: reason})
+	}
+
+	var presets []string
+	for _, name := range presetFormatOrder {
+		if slices.Contains(cfg.formats, name) {
+			presets = append(presets, presetFormatOptions[name])
+		}
+	}
+	if len(presets) > 1 {
+		conflict("built-in formats are not combined: their special tokens are merged and the last of them, in this order, sets the default mode", presets...)
+	}
+
+	if cfg.chunkSize > 0 && cfg.wordBoundaryChunking != nil {
+		conflict("word boundary chunking replaces the chunk size for text", "WithChunkSize", "WithWordBoundaryChunking")
+	}
+	if cfg.responsePrefix != "" && cfg.resume != nil {
+		conflict("the prior text of the resume state replaces the response prefix", "WithResponsePrefix", "WithResumeState")
+	}
+	if cfg.healedPrefix != "" && !strings.HasSuffix(cfg.responsePrefix, cfg.healedPrefix) {
+		conflict(fmt.Sprintf("the healed prefix %q is not the end of the response prefix", cfg.healedPrefix), "WithHealedPrefix", "WithResponsePrefix")
+	}
+	if cfg.healedPrefix != "" && cfg.prefixTrim != "" {
+		conflict("the prefix trim replaces the text stripped for the healed prefix", "WithHealedPrefix", "WithPrefixTrim")
+	}
+	for _, stop := range cfg.inclusiveStops {
+		if slices.Contains(cfg.exclusiveStops, stop) {
+			conflict(fmt.Sprintf("the stop %q is both inclusive and exclusive", stop), "WithInclusiveStops", "WithExclusiveStops")
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return &OptionConflictError{Conflicts: conflicts}
+}
@@ -0,0 +1,75 @@
+package gobindings
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOptions(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, ValidateOptions(HandleMultiHopCmd3(), HandleMultiHopCmd3(), WithChunkSize(4), WithResponsePrefix("It is"), WithHealedPrefix(" is")))
+
+	err := ValidateOptions(
+		HandleRAG(),
+		HandleSearchQuery(),
+		WithFormat("llama3_chat"),
+		WithChunkSize(4),
+		WithWordBoundaryChunking(10),
+		WithResponsePrefix("It"),
+		WithResumeState("It was", nil),
+		WithHealedPrefix(" is"),
+		WithPrefixTrim("Answer: "),
+		WithInclusiveStops([]string{"END", "STOP"}),
+		WithExclusiveStops([]string{"STOP"}),
+	)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	var conflictErr *OptionConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	options := make([][]string, len(conflictErr.Conflicts))
+	for i, c := range conflictErr.Conflicts {
+		options[i] = c.Options
+	}
+	require.Equal(t, [][]string{
+		{"HandleRAG", "HandleSearchQuery", "HandleLlama3Chat"},
+		{"WithChunkSize", "WithWordBoundaryChunking"},
+		{"WithResponsePrefix", "WithResumeState"},
+		{"WithHealedPrefix", "WithResponsePrefix"},
+		{"WithHealedPrefix", "WithPrefixTrim"},
+		{"WithInclusiveStops", "WithExclusiveStops"},
+	}, options)
+	require.Contains(t, err.Error(), `WithInclusiveStops and WithExclusiveStops: the stop "STOP" is both inclusive and exclusive`)
+}
+
+func TestNewFilter_StrictOptions(t *testing.T) {
+	t.Parallel()
+
+	// Conflicting options are only rejected in strict mode
+	require.NotNil(t, NewFilter(HandleMultiHopCmd3(), HandleLlama3Chat()))
+	f, err := TryNewFilter(HandleMultiHopCmd3(), HandleLlama3Chat())
+	require.NoError(t, err)
+	require.NotNil(t, f)
+
+	options := []FilterOption{HandleMultiHopCmd3(), HandleLlama3Chat(), WithStrictOptions()}
+	f, err = TryNewFilter(options...)
+	require.Nil(t, f)
+	var conflictErr *OptionConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = RestoreFilter([]byte(`{"version": 1}`), options...)
+	require.ErrorAs(t, err, &conflictErr)
+
+	// NewFilter returns no error, it logs the conflicts and creates no filter
+	var logs bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	require.Nil(t, NewFilter(append(options, WithLogger(logger))...))
+	require.Contains(t, logs.String(), "conflicting filter options")
+	require.Contains(t, logs.String(), "HandleMultiHopCmd3 and HandleLlama3Chat")
+
+	f, err = TryNewFilter(HandleMultiHopCmd3(), WithStrictOptions())
+	require.NoError(t, err)
+	require.NotNil(t, f)
+}
@@ -1,44 +1,124 @@
 package gobindings
 
+import (
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
 // FilterOption is a function that configures a filter
 type FilterOption func(*filterConfig)
 
-// filterConfig holds the configuration for creating a filter
+// filterConfig holds the configuration for creating a filter. Options mirrors its fields,
+// so a new field needs a matching Options field.
 type filterConfig struct {
-	multiHopCmd3            bool
-	multiHopCmd4            bool
-	rag                     bool
-	searchQuery             bool
-	multiHop                bool
-	streamToolActions       bool
-	streamNonGroundedAnswer bool
-	streamProcessedParams   bool
-	leftTrimmed             bool
-	rightTrimmed            bool
-	prefixTrim              string
-	chunkSize               int
-	inclusiveStops          []string
-	exclusiveStops          []string
-	removeTokens            []string
+	formats                  []string
+	fimFamily                *FIMFamily
+	streamToolActions        bool
+	streamNonGroundedAnswer  bool
+	streamProcessedParams    bool
+	streamDocumentSelections bool
+	citationMerging          bool
+	sentenceCitations        bool
+	citationIndexUnit        CitationIndexUnit
+	citationSourceFormat     CitationSourceFormat
+	unicodeNormalization     UnicodeNormalization
+	finishReason             bool
+	promptEchoTokens         int
+	responsePrefix           string
+	healedPrefix             string
+	resume                   *ResumeState
+	documentIDs              [][]string
+	rawTap                   io.Writer
+	tokenizer                *tokenizers.Tokenizer
+	specialTokenMap          map[string]FilterMode
+	leftTrimmed              bool
+	rightTrimmed             bool
+	prefixTrim               string
+	chunkSize                int
+	wordBoundaryChunking     *int
+	inclusiveStops           []string
+	exclusiveStops           []string
+	removeTokens             []string
+	maxBufferBytes           int
+	idleTimeout              time.Duration
+	rawParamEncoding         *RawParamEncoding
+	logger                   Logger
+	tracer                   Tracer
+	toolCallIDGenerator      func(index int) string
+	nestedParamPaths         bool
+	rollbackWindow           int
+	outputTransformer        OutputTransformer
+	toolReadiness            []Tool
+	markdownState            bool
+	languageDetection        bool
+	conditionalStops         []ConditionalStop
+	latencyStamps            bool
+	citationConfidence       *CitationConfidence
+	modeEvents               bool
+	citationValidation       bool
+	suppressedReasoning      bool
+	documentOrder            []int
+	strictOptions            bool
+	dedupWindow              int
+	citationExclusionZones   []ZoneKind
+	legacyQuerySplitting     bool
+	searchQueryDedup         bool
 }
 
-// apply applies the configuration to the FilterOptions builder
-func (cfg *filterConfig) apply(opts *FilterOptions) {
-	// Handle format types
-	if cfg.multiHopCmd3 {
-		opts.Cmd3()
+// presetFormatOrder is the order the built-in formats are applied in, whatever the order
+// of their options
+var presetFormatOrder = []string{"cmd3", "cmd4", "rag", "search_query", "multi_hop", "llama3_chat"}
+
+// formatHandlers returns the handlers of the configured formats, each once: the built-in
+// formats in the order of presetFormatOrder, then the registered formats in the order they
+// were given
+func (cfg *filterConfig) formatHandlers() ([]FormatHandler, error) {
+	var names []string
+	for _, name := range presetFormatOrder {
+		if slices.Contains(cfg.formats, name) {
+			names = append(names, name)
+		}
 	}
-	if cfg.multiHopCmd4 {
-		opts.Cmd4()
+	for _, name := range cfg.formats {
+		if !slices.Contains(presetFormatOrder, name) && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
 	}
-	if cfg.rag {
-		opts.HandleRAG()
+
+	var handlers []FormatHandler
+	for _, name := range names {
+		h, err := lookupFormat(name)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, h)
+	}
+	return handlers, nil
+}
+
+// apply applies the configuration to the FilterOptions builder
+func (cfg *filterConfig) apply(opts *FilterOptions, handlers []FormatHandler) {
+	// Handle format types, custom sections are handled by the format rather than the filter
+	for _, h := range handlers {
+		h.Configure(opts)
+		for token, mode := range h.SpecialTokens() {
+			if mode < FilterModeCustom {
+				opts.WithSpecialToken(token, mode)
+			}
+		}
 	}
-	if cfg.searchQuery {
-		opts.HandleSearchQuery()
+
+	if cfg.fimFamily != nil {
+		opts.HandleFIM(*cfg.fimFamily)
 	}
-	if cfg.multiHop {
-		opts.HandleMultiHop()
+
+	// Handle custom special tokens, merged on top of the format's tokens
+	for token, mode := range cfg.specialTokenMap {
+		opts.WithSpecialToken(token, mode)
 	}
 
 	// Handle streaming options
@@ -51,6 +131,43 @@ func (cfg *filterConfig) apply(opts *FilterOptions) {
 	if cfg.streamProcessedParams {
 		opts.StreamProcessedParams()
 	}
+	if cfg.streamDocumentSelections {
+		opts.StreamDocumentSelections()
+	}
+
+	// Handle citation options
+	if cfg.citationMerging {
+		opts.WithCitationMerging()
+	}
+	if cfg.sentenceCitations {
+		opts.WithSentenceCitations()
+	}
+	if cfg.citationIndexUnit != CitationIndexRunes {
+		opts.WithCitationIndexUnit(cfg.citationIndexUnit)
+	}
+	if cfg.citationSourceFormat != CitationSourceToolIndex {
+		opts.WithCitationSourceFormat(cfg.citationSourceFormat)
+	}
+	if cfg.unicodeNormalization != UnicodeNormalizationNone {
+		opts.WithUnicodeNormalization(cfg.unicodeNormalization)
+	}
+
+	if cfg.finishReason {
+		opts.WithFinishReason()
+	}
+
+	if cfg.promptEchoTokens > 0 {
+		opts.WithPromptEcho(cfg.promptEchoTokens)
+	}
+	if cfg.responsePrefix != "" {
+		opts.WithResponsePrefix(cfg.responsePrefix)
+	}
+	if cfg.healedPrefix != "" {
+		opts.WithHealedPrefix(cfg.healedPrefix)
+	}
+	if cfg.resume != nil {
+		opts.WithResumeState(cfg.resume.PriorText, cfg.resume.PriorCitations)
+	}
 
 	// Handle trimming options
 	if cfg.leftTrimmed {
@@ -59,11 +176,26 @@ func (cfg *filterConfig) apply(opts *FilterOptions) {
 	if cfg.rightTrimmed {
 		opts.WithRightTrimmed()
 	}
+	if cfg.prefixTrim != "" {
+		opts.WithPrefixTrim(cfg.prefixTrim)
+	}
 
 	// Handle size and limit options
 	if cfg.chunkSize > 0 {
 		opts.WithChunkSize(cfg.chunkSize)
 	}
+	if cfg.wordBoundaryChunking != nil {
+		opts.WithWordBoundaryChunking(*cfg.wordBoundaryChunking)
+	}
+	if cfg.rollbackWindow > 0 {
+		opts.WithRollbackWindow(cfg.rollbackWindow)
+	}
+	if cfg.dedupWindow > 0 {
+		opts.WithDedupWindow(cfg.dedupWindow)
+	}
+	if cfg.legacyQuerySplitting {
+		opts.LegacySearchQuerySplitting()
+	}
 
 	// Handle stop sequences
 	if len(cfg.inclusiveStops) > 0 {
@@ -72,6 +204,9 @@ func (cfg *filterConfig) apply(opts *FilterOptions) {
 	if len(cfg.exclusiveStops) > 0 {
 		opts.WithExclusiveStops(cfg.exclusiveStops)
 	}
+	if len(cfg.conditionalStops) > 0 {
+		opts.WithConditionalStops(cfg.conditionalStops)
+	}
 
 	// Handle token removal
 	for _, token := range cfg.removeTokens {
@@ -81,23 +216,17 @@ func (cfg *filterConfig) apply(opts *FilterOptions) {
 
 // HandleMultiHopCmd3 configures the filter to handle multi-hop CMD3 format
 func HandleMultiHopCmd3() FilterOption {
-	return func(cfg *filterConfig) {
-		cfg.multiHopCmd3 = true
-	}
+	return WithFormat("cmd3")
 }
 
 // HandleMultiHopCmd4 configures the filter to handle multi-hop CMD4 format
 func HandleMultiHopCmd4() FilterOption {
-	return func(cfg *filterConfig) {
-		cfg.multiHopCmd4 = true
-	}
+	return WithFormat("cmd4")
 }
 
 // HandleRAG configures the filter to handle RAG (Retrieval Augmented Generation) format
 func HandleRAG() FilterOption {
-	return func(cfg *filterConfig) {
-		cfg.rag = true
-	}
+	return WithFormat("rag")
 }
 
 // StreamToolActions enables streaming of tool actions
@@ -109,15 +238,34 @@ func StreamToolActions() FilterOption {
 
 // HandleSearchQuery configures the filter to handle search query format
 func HandleSearchQuery() FilterOption {
-	return func(cfg *filterConfig) {
-		cfg.searchQuery = true
-	}
+	return WithFormat("search_query")
 }
 
 // HandleMultiHop configures the filter to handle multi-hop format
 func HandleMultiHop() FilterOption {
+	return WithFormat("multi_hop")
+}
+
+// HandleLlama3Chat configures the filter to handle Llama 3.x chat format, where assistant
+// turns are delimited by header tokens and <|eot_id|>, and tool calls follow <|python_tag|>
+func HandleLlama3Chat() FilterOption {
+	return WithFormat("llama3_chat")
+}
+
+// HandleFIM configures the filter for fill-in-the-middle completions of prompts rendered
+// with RenderFIM: the sentinels of the model family are stripped from the output and the
+// end sentinel stops the completion
+func HandleFIM(family FIMFamily) FilterOption {
 	return func(cfg *filterConfig) {
-		cfg.multiHop = true
+		cfg.fimFamily = &family
+	}
+}
+
+// WithFormat configures the filter to handle a format registered with RegisterFormat.
+// NewFilter returns nil if no format with the given name is registered.
+func WithFormat(name string) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.formats = append(cfg.formats, name)
 	}
 }
 
@@ -135,6 +283,155 @@ func StreamProcessedParams() FilterOption {
 	}
 }
 
+// StreamDocumentSelections emits the "Relevant Documents:" and "Cited Documents:" lines of
+// the multi-hop formats, which are otherwise dropped, as outputs with RelevantDocIndices or
+// CitedDocIndices set. A line of "None" gives an empty, non-nil slice.
+func StreamDocumentSelections() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.streamDocumentSelections = true
+	}
+}
+
+// WithCitationMerging coalesces adjacent or overlapping citations that share the
+// same sources and drops zero-length citations before they are emitted
+func WithCitationMerging() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.citationMerging = true
+	}
+}
+
+// WithSentenceCitations expands every citation to the sentence containing it, or the
+// sentences it spans, and merges the sources of the citations of the same sentence.
+// Sentences are found with Unicode sentence segmentation, and a citation is emitted once
+// its last sentence ends, with a later output or on FlushPartials. It replaces
+// WithCitationMerging.
+func WithSentenceCitations() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.sentenceCitations = true
+	}
+}
+
+// WithCitationIndexUnit sets the unit of citation StartIndex and EndIndex, which count runes
+// by default
+func WithCitationIndexUnit(unit CitationIndexUnit) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.citationIndexUnit = unit
+	}
+}
+
+// WithCitationSourceFormat sets how the sources of Command 3 citations are keyed. Newer
+// checkpoints cite by tool name, </co: web_search:[2]>, which CitationSourceToolName
+// parses into the SourceName of the sources. Sources keyed by a number are still parsed
+// into their ToolCallIndex.
+func WithCitationSourceFormat(format CitationSourceFormat) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.citationSourceFormat = format
+	}
+}
+
+// WithUnicodeNormalization normalizes the emitted text to NFC or NFKC, so that e.g. an "e"
+// followed by a combining acute accent is emitted as "é". Citation indices count the
+// normalized text. The last character of the text waits for the next token, so a
+// combining mark decoded in a later token than its base character is composed with it.
+// Tool calls and search queries are not normalized. The text is emitted as decoded by default.
+func WithUnicodeNormalization(form UnicodeNormalization) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.unicodeNormalization = form
+	}
+}
+
+// WithFinishReason emits a terminal FilterOutput, with only Finish set, reporting why the
+// stream ended and the matched stop sequence. It is emitted when the filter stops or on
+// FlushPartials.
+func WithFinishReason() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.finishReason = true
+	}
+}
+
+// WithPromptEcho is for streams that echo the prompt before the completion. The outputs
+// of the first promptTokenCount tokens are passed through unparsed with IsEcho set,
+// skipping stop, citation and action handling, and parsing resumes after them. Tokens are
+// counted by the token IDs given to WriteDecoded, or one per call without them.
+func WithPromptEcho(promptTokenCount int) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.promptEchoTokens = promptTokenCount
+	}
+}
+
+// WithResponsePrefix is for completions that continue a response prefix rendered in the
+// prompt, e.g. RenderCmd3Options.ResponsePrefix. The filter behaves as if the prefix preceded
+// the completion: citation indices count from the start of the prefix and the leading
+// whitespace of the completion is kept. The prefix itself is not emitted again.
+func WithResponsePrefix(prefix string) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.responsePrefix = prefix
+	}
+}
+
+// WithHealedPrefix is for completions of a response prefix healed with HealPrefix, given
+// to WithResponsePrefix whole. The completion starts by repeating the healed text, which
+// was already shown as part of the prefix, so it is stripped. Nothing is stripped if the
+// completion does not start with it.
+func WithHealedPrefix(healed string) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.healedPrefix = healed
+	}
+}
+
+// ResumeState is the text and citations already emitted for a truncated response, see
+// WithResumeState
+type ResumeState struct {
+	PriorText      string           `json:"prior_text"`
+	PriorCitations []FilterCitation `json:"prior_citations,omitempty"`
+}
+
+// WithResumeState is for completions that continue a truncated response, re-prompted with
+// the text already emitted. Like WithResponsePrefix, which it replaces, the indices of the
+// text and citations continue from priorText. The model may first repeat the end of
+// priorText: that overlap is held back and dropped, as are the citations repeating one of
+// priorCitations.
+func WithResumeState(priorText string, priorCitations []FilterCitation) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.resume = &ResumeState{PriorText: priorText, PriorCitations: priorCitations}
+	}
+}
+
+// WithDocumentIDs sets the document IDs for each tool call so that citations are
+// populated with the IDs of the documents they cite. ids[i][j] is the ID of result j
+// of tool call i. Citation indices without a matching ID are skipped.
+func WithDocumentIDs(ids [][]string) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.documentIDs = ids
+	}
+}
+
+// WithDocumentOrder is for completions of prompts rendered with documents reordered by
+// OrderDocuments, given the indices it returned. The citation sources of the documents,
+// the results of tool call 0, are mapped from the order the documents were rendered in to
+// the order they were given in, before the IDs of WithDocumentIDs are resolved.
+func WithDocumentOrder(indices []int) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.documentOrder = indices
+	}
+}
+
+// WithRawTap writes every decoded token passed to the filter, including special tokens,
+// to w before it is parsed. This captures the exact unfiltered stream, e.g. for audit logging.
+func WithRawTap(w io.Writer) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.rawTap = w
+	}
+}
+
+// WithTokenizer sets the tokenizer that decodes the token IDs written with
+// Filter.WriteToken. It must stay open as long as the filter is used.
+func WithTokenizer(t *tokenizers.Tokenizer) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.tokenizer = t
+	}
+}
+
 // WithLeftTrimmed enables left trimming
 func WithLeftTrimmed() FilterOption {
 	return func(cfg *filterConfig) {
@@ -149,6 +446,15 @@ func WithRightTrimmed() FilterOption {
 	}
 }
 
+// WithPrefixTrim drops prefix from the start of the completion, e.g. a label the model
+// repeats from the prompt. The text is held back while it could be the prefix, and emitted
+// as written once it is not. It replaces the text stripped by WithHealedPrefix.
+func WithPrefixTrim(prefix string) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.prefixTrim = prefix
+	}
+}
+
 // WithChunkSize sets the chunk size
 func WithChunkSize(size int) FilterOption {
 	return func(cfg *filterConfig) {
@@ -156,6 +462,17 @@ func WithChunkSize(size int) FilterOption {
 	}
 }
 
+// WithWordBoundaryChunking emits answer and reasoning text in chunks that end at word
+// boundaries, e.g. for text-to-speech: text is emitted up to the last whitespace or
+// punctuation after at least minChars characters, and the rest held back until the next
+// boundary. Special tokens and stops still flush it immediately. It replaces WithChunkSize
+// for text.
+func WithWordBoundaryChunking(minChars int) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.wordBoundaryChunking = &minChars
+	}
+}
+
 // WithInclusiveStops sets inclusive stop sequences
 func WithInclusiveStops(stops []string) FilterOption {
 	return func(cfg *filterConfig) {
@@ -170,6 +487,280 @@ func WithExclusiveStops(stops []string) FilterOption {
 	}
 }
 
+// WithConditionalStops sets exclusive stop sequences that only end the stream in their
+// context, e.g. a blocked phrase that is allowed in code. Elsewhere a stop is parsed as
+// the text around it.
+func WithConditionalStops(stops []ConditionalStop) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.conditionalStops = stops
+	}
+}
+
+// WithSpecialTokenMap adds or remaps special tokens. The tokens are merged with the
+// tokens of the configured format rather than replacing them, so a deployment can
+// support renamed or additional section tokens on top of e.g. HandleMultiHopCmd3.
+func WithSpecialTokenMap(tokenMap map[string]FilterMode) FilterOption {
+	return func(cfg *filterConfig) {
+		if cfg.specialTokenMap == nil {
+			cfg.specialTokenMap = make(map[string]FilterMode, len(tokenMap))
+		}
+		for token, mode := range tokenMap {
+			cfg.specialTokenMap[token] = mode
+		}
+	}
+}
+
+// WithMaxBufferBytes limits the number of bytes the filter holds back without returning an
+// output, e.g. a partial special token that never terminates. When the limit is exceeded the
+// filter is force-flushed and the stream fails with a *StreamLimitError.
+func WithMaxBufferBytes(n int) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.maxBufferBytes = n
+	}
+}
+
+// WithIdleTimeout limits the time between two writes to the filter, e.g. to detect a stalled
+// producer. When a write arrives after the timeout the filter is force-flushed and the
+// stream fails with a *StreamLimitError. Without a write, the channel of Filter.Idle is
+// closed once the timeout elapses and Filter.CheckIdle fails the stream.
+func WithIdleTimeout(d time.Duration) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.idleTimeout = d
+	}
+}
+
+// RawParamEncoding configures how the filter re-encodes the RawParamDelta of tool calls
+type RawParamEncoding struct {
+	// Indent indents the parameters with one copy of it per nesting level, they are
+	// compact if it is empty
+	Indent string `json:"indent,omitempty"`
+	// Strict fails the stream on parameters that are not valid JSON or repeat a key
+	Strict bool `json:"strict,omitempty"`
+}
+
+// WithRawParamEncoding re-encodes the raw parameters of tool calls as they are streamed,
+// replacing the whitespace of the model output according to enc. Keys keep the order and
+// values the exact form the model wrote them in, so the concatenated RawParamDelta of a tool
+// call is the model output byte for byte modulo whitespace. A strict encoding fails
+// WriteDecoded and FlushPartials with an *orderedjson.SyntaxError on invalid parameters.
+func WithRawParamEncoding(enc RawParamEncoding) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.rawParamEncoding = &enc
+	}
+}
+
+// WithLogger sets the Logger the filter reports problems to that do not fail the stream,
+// e.g. citation sources without a document ID. Messages are discarded by default.
+func WithLogger(l Logger) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.logger = l
+	}
+}
+
+// WithTracer traces the filter with t: a span from its creation to FlushPartials with the
+// number of its writes and the latency percentiles of the latest 1024, and a child span for
+// the flush
+func WithTracer(t Tracer) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.tracer = t
+	}
+}
+
+// SequentialToolCallID is the default ID of a tool call without one, its index as written
+// by Command 3 models, e.g. "0"
+func SequentialToolCallID(index int) string {
+	return strconv.Itoa(index)
+}
+
+// WithToolCallIDGenerator populates the ID of every tool call the model did not write one
+// for, e.g. in formats without tool_call_id, with fn(index). The generated ID is set on the
+// delta with the first chunk of the tool name, along with IDSynthesized. A nil fn uses
+// SequentialToolCallID.
+func WithToolCallIDGenerator(fn func(index int) string) FilterOption {
+	return func(cfg *filterConfig) {
+		if fn == nil {
+			fn = SequentialToolCallID
+		}
+		cfg.toolCallIDGenerator = fn
+	}
+}
+
+// WithNestedParamPaths splits the value deltas of object parameters into the deltas of their
+// nested fields, e.g. the value of "filters" in {"filters": {"date": {"start": "2024"}}} is
+// streamed as the value delta "\"2024\"" with the Path ["filters", "date", "start"]. A field
+// is complete once a delta with another Path arrives. Arrays and values that are not objects
+// are streamed whole, as without the option. A delta that is only the punctuation between
+// fields loses its ParamDelta, and the logprobs of a delta split in several are on the first.
+// It requires StreamProcessedParams.
+func WithNestedParamPaths() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.nestedParamPaths = true
+	}
+}
+
+// WithRollbackWindow keeps the state of the filter before each of the last tokens written,
+// so up to tokens of them can be retracted with Rollback, e.g. when speculative decoding
+// rejects accepted tokens. The tokens of WriteDecodedBatch are then parsed one by one.
+func WithRollbackWindow(tokens int) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.rollbackWindow = tokens
+	}
+}
+
+// OutputTransformer returns text rewritten and the spans of it that were replaced, see
+// WithOutputTransformer
+type OutputTransformer func(text string) (string, []Redaction)
+
+// WithOutputTransformer rewrites the Text of every output with fn before it is returned,
+// e.g. to redact emails and phone numbers. fn returns the new text and the spans it
+// replaced, which are set on the output's Redactions. The indices of later citations are
+// moved by the change in length, and citations of a replaced span cover its replacement.
+// A change of text without redactions is taken as a replacement of the whole text.
+//
+// fn sees the text of one output at a time, so a span split between outputs is not seen
+// whole. With CitationIndexGraphemes the replaced spans are measured in runes.
+func WithOutputTransformer(fn func(text string) (string, []Redaction)) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.outputTransformer = fn
+	}
+}
+
+// WithToolReadiness sets ToolReady on the output of a tool call to one of the tools once
+// the last of the required parameters of its schema is complete, so the tool can be run
+// before the end of the action. The Parameters of the event are those complete at that
+// point, optional parameters streamed after the required ones are not part of them. Tool
+// calls to other tools, or that are not valid JSON, have no event. It requires
+// StreamToolActions.
+func WithToolReadiness(tools []Tool) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.toolReadiness = tools
+	}
+}
+
+// WithMarkdownState sets Markdown on every output with text to the markdown blocks open at
+// the end of its text, so a UI can render partial markdown, e.g. close an open code fence.
+// The blocks are followed incrementally through the response and each thinking block of
+// the reasoning. The line being written counts as complete, and tables are the lines
+// starting with "|".
+func WithMarkdownState() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.markdownState = true
+	}
+}
+
+// WithLanguageDetection sets Language on every output with text to the language of the
+// latest text, e.g. to route speech synthesis by language. The language is detected on
+// the last 256 runes of the response or of the thinking block the output belongs to, so it
+// follows a change of language within a few sentences. The detection is lightweight: the
+// script tells most languages, and frequent words tell English, French, German, Spanish,
+// Italian, Portuguese and Dutch apart.
+func WithLanguageDetection() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.languageDetection = true
+	}
+}
+
+// WithLatencyStamps sets Timing on every output, when the oldest text it carries was
+// written and when it was emitted, to measure the latency the filter adds. The output of
+// FlushPartials, or the last of them, has the LatencySummary of the stream: the tokens and
+// outputs and the median and 95th percentile of the latency of the outputs.
+func WithLatencyStamps() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.latencyStamps = true
+	}
+}
+
+// WithCitationConfidence sets Confidence on every citation to the probability of the tokens
+// of its text, aggregated by agg from the logprobs written with them. The tokens of a
+// citation are those written with the outputs of its text, including the tokens of the
+// citation markup. Citations of text written without logprobs have no confidence.
+func WithCitationConfidence(agg CitationConfidence) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.citationConfidence = &agg
+	}
+}
+
+// WithModeEvents adds an output with ModeEvent after the outputs of every write that
+// switches the mode of the filter, e.g. when the model starts an action or a thinking
+// block, see SyncFilter.CurrentMode
+func WithModeEvents() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.modeEvents = true
+	}
+}
+
+// WithCitationValidation checks that the indices of every citation slice the text emitted
+// so far to the text of the citation. A citation whose indices do not is dropped from its
+// output rather than shipped with bad offsets, logged as a warning, and reported with
+// InvalidCitations on an output following it.
+func WithCitationValidation() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.citationValidation = true
+	}
+}
+
+// WithSuppressedReasoning parses the thinking blocks of the completion without emitting
+// them, for products that limit or bill reasoning tokens but do not show them. The outputs
+// of the reasoning are dropped once the filter has read them, so the citations of the
+// response are unchanged. The last output of FlushPartials has ReasoningTokens, the number
+// of tokens written in thinking blocks, counted as WithLatencyStamps counts tokens.
+func WithSuppressedReasoning() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.suppressedReasoning = true
+	}
+}
+
+// WithStrictOptions makes TryNewFilter and RestoreFilter check their options with
+// ValidateOptions, and return the *OptionConflictError if they conflict. NewFilter, which
+// returns no error, logs it to the logger of WithLogger and returns nil.
+func WithStrictOptions() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.strictOptions = true
+	}
+}
+
+// WithDedupWindow keeps the last nBytes bytes of the answer text emitted, so an upstream
+// retry that replays tokens already sent is not shown twice: after Filter.Resume the
+// replayed text is dropped, with the citations it repeats, and the indices of the text and
+// citations that follow continue the emitted text. The overlap of WithResumeState is also
+// searched for in the last nBytes bytes of the prior text rather than the last 256.
+func WithDedupWindow(nBytes int) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.dedupWindow = nBytes
+	}
+}
+
+// WithCitationExclusionZones drops the citations starting or ending inside a zone of the
+// given kinds, e.g. a code fence, whose tags would break the rendering of the zone. The tags
+// are still stripped from the text, but no FilterCitation is emitted for them. Zones are
+// read from the text emitted, as rewritten by WithOutputTransformer; indices in graphemes
+// are compared to the runes of the text.
+func WithCitationExclusionZones(zones ...ZoneKind) FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.citationExclusionZones = append(cfg.citationExclusionZones, zones...)
+	}
+}
+
+// WithLegacyQuerySplitting makes HandleSearchQuery split queries at every "|||" and
+// newline, and emit their text as written. By default a separator in a double-quoted
+// segment or after a backslash does not start the next query, and the backslashes escaping
+// a separator, a quote or a backslash are dropped from the query text.
+func WithLegacyQuerySplitting() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.legacyQuerySplitting = true
+	}
+}
+
+// WithSearchQueryDedup drops the search queries that repeat an earlier query of the stream
+// once trimmed, case-folded and with their whitespace collapsed. The deltas of a query are
+// held back while its text so far starts an earlier query, and a query is dropped if it
+// ends equal to one, the indices of the later queries staying contiguous.
+func WithSearchQueryDedup() FilterOption {
+	return func(cfg *filterConfig) {
+		cfg.searchQueryDedup = true
+	}
+}
+
 // RemoveToken removes a specific token from the output
 func RemoveToken(token string) FilterOption {
 	return func(cfg *filterConfig) {
@@ -0,0 +1,293 @@
+package gobindings
+
+import (
+	"io"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
+// Options is the plain struct form of the FilterOption funcs, e.g. for filter
+// configuration loaded from a file. Every FilterOption has a field, and
+// ToFilterOptions and OptionsFromFilterOptions convert between the two forms.
+type Options struct {
+	// Formats are the names of the registered formats to handle, see WithFormat
+	Formats                  []string               `json:"formats,omitempty"`
+	FIMFamily                *FIMFamily             `json:"fim_family,omitempty"`
+	StreamToolActions        bool                   `json:"stream_tool_actions,omitempty"`
+	StreamNonGroundedAnswer  bool                   `json:"stream_non_grounded_answer,omitempty"`
+	StreamProcessedParams    bool                   `json:"stream_processed_params,omitempty"`
+	StreamDocumentSelections bool                   `json:"stream_document_selections,omitempty"`
+	CitationMerging          bool                   `json:"citation_merging,omitempty"`
+	SentenceCitations        bool                   `json:"sentence_citations,omitempty"`
+	CitationIndexUnit        CitationIndexUnit      `json:"citation_index_unit,omitempty"`
+	CitationSourceFormat     CitationSourceFormat   `json:"citation_source_format,omitempty"`
+	UnicodeNormalization     UnicodeNormalization   `json:"unicode_normalization,omitempty"`
+	FinishReason             bool                   `json:"finish_reason,omitempty"`
+	PromptEchoTokens         int                    `json:"prompt_echo_tokens,omitempty"`
+	ResponsePrefix           string                 `json:"response_prefix,omitempty"`
+	HealedPrefix             string                 `json:"healed_prefix,omitempty"`
+	Resume                   *ResumeState           `json:"resume,omitempty"`
+	DocumentIDs              [][]string             `json:"document_ids,omitempty"`
+	RawTap                   io.Writer              `json:"-"`
+	Tokenizer                *tokenizers.Tokenizer  `json:"-"`
+	SpecialTokenMap          map[string]FilterMode  `json:"special_token_map,omitempty"`
+	LeftTrimmed              bool                   `json:"left_trimmed,omitempty"`
+	RightTrimmed             bool                   `json:"right_trimmed,omitempty"`
+	PrefixTrim               string                 `json:"prefix_trim,omitempty"`
+	ChunkSize                int                    `json:"chunk_size,omitempty"`
+	WordBoundaryChunking     *int                   `json:"word_boundary_chunking,omitempty"`
+	InclusiveStops           []string               `json:"inclusive_stops,omitempty"`
+	ExclusiveStops           []string               `json:"exclusive_stops,omitempty"`
+	RemoveTokens             []string               `json:"remove_tokens,omitempty"`
+	MaxBufferBytes           int                    `json:"max_buffer_bytes,omitempty"`
+	IdleTimeout              time.Duration          `json:"idle_timeout,omitempty"`
+	RawParamEncoding         *RawParamEncoding      `json:"raw_param_encoding,omitempty"`
+	Logger                   Logger                 `json:"-"`
+	Tracer                   Tracer                 `json:"-"`
+	ToolCallIDGenerator      func(index int) string `json:"-"`
+	NestedParamPaths         bool                   `json:"nested_param_paths,omitempty"`
+	RollbackWindow           int                    `json:"rollback_window,omitempty"`
+	OutputTransformer        OutputTransformer      `json:"-"`
+	ToolReadiness            []Tool                 `json:"tool_readiness,omitempty"`
+	MarkdownState            bool                   `json:"markdown_state,omitempty"`
+	LanguageDetection        bool                   `json:"language_detection,omitempty"`
+	ConditionalStops         []ConditionalStop      `json:"conditional_stops,omitempty"`
+	LatencyStamps            bool                   `json:"latency_stamps,omitempty"`
+	CitationConfidence       *CitationConfidence    `json:"citation_confidence,omitempty"`
+	ModeEvents               bool                   `json:"mode_events,omitempty"`
+	CitationValidation       bool                   `json:"citation_validation,omitempty"`
+	SuppressedReasoning      bool                   `json:"suppressed_reasoning,omitempty"`
+	DocumentOrder            []int                  `json:"document_order,omitempty"`
+	StrictOptions            bool                   `json:"strict_options,omitempty"`
+	DedupWindow              int                    `json:"dedup_window,omitempty"`
+	CitationExclusionZones   []ZoneKind             `json:"citation_exclusion_zones,omitempty"`
+	LegacyQuerySplitting     bool                   `json:"legacy_query_splitting,omitempty"`
+	SearchQueryDedup         bool                   `json:"search_query_dedup,omitempty"`
+}
+
+// ToFilterOptions returns the FilterOption funcs configuring a filter like o
+func (o Options) ToFilterOptions() []FilterOption {
+	var opts []FilterOption
+	for _, name := range o.Formats {
+		opts = append(opts, WithFormat(name))
+	}
+	if o.FIMFamily != nil {
+		opts = append(opts, HandleFIM(*o.FIMFamily))
+	}
+	if o.StreamToolActions {
+		opts = append(opts, StreamToolActions())
+	}
+	if o.StreamNonGroundedAnswer {
+		opts = append(opts, StreamNonGroundedAnswer())
+	}
+	if o.StreamProcessedParams {
+		opts = append(opts, StreamProcessedParams())
+	}
+	if o.StreamDocumentSelections {
+		opts = append(opts, StreamDocumentSelections())
+	}
+	if o.CitationMerging {
+		opts = append(opts, WithCitationMerging())
+	}
+	if o.SentenceCitations {
+		opts = append(opts, WithSentenceCitations())
+	}
+	if o.CitationIndexUnit != CitationIndexRunes {
+		opts = append(opts, WithCitationIndexUnit(o.CitationIndexUnit))
+	}
+	if o.CitationSourceFormat != CitationSourceToolIndex {
+		opts = append(opts, WithCitationSourceFormat(o.CitationSourceFormat))
+	}
+	if o.UnicodeNormalization != UnicodeNormalizationNone {
+		opts = append(opts, WithUnicodeNormalization(o.UnicodeNormalization))
+	}
+	if o.FinishReason {
+		opts = append(opts, WithFinishReason())
+	}
+	if o.PromptEchoTokens > 0 {
+		opts = append(opts, WithPromptEcho(o.PromptEchoTokens))
+	}
+	if o.ResponsePrefix != "" {
+		opts = append(opts, WithResponsePrefix(o.ResponsePrefix))
+	}
+	if o.HealedPrefix != "" {
+		opts = append(opts, WithHealedPrefix(o.HealedPrefix))
+	}
+	if o.Resume != nil {
+		opts = append(opts, WithResumeState(o.Resume.PriorText, o.Resume.PriorCitations))
+	}
+	if o.DocumentIDs != nil {
+		opts = append(opts, WithDocumentIDs(o.DocumentIDs))
+	}
+	if o.RawTap != nil {
+		opts = append(opts, WithRawTap(o.RawTap))
+	}
+	if o.Tokenizer != nil {
+		opts = append(opts, WithTokenizer(o.Tokenizer))
+	}
+	if len(o.SpecialTokenMap) > 0 {
+		opts = append(opts, WithSpecialTokenMap(o.SpecialTokenMap))
+	}
+	if o.LeftTrimmed {
+		opts = append(opts, WithLeftTrimmed())
+	}
+	if o.RightTrimmed {
+		opts = append(opts, WithRightTrimmed())
+	}
+	if o.PrefixTrim != "" {
+		opts = append(opts, WithPrefixTrim(o.PrefixTrim))
+	}
+	if o.ChunkSize > 0 {
+		opts = append(opts, WithChunkSize(o.ChunkSize))
+	}
+	if o.WordBoundaryChunking != nil {
+		opts = append(opts, WithWordBoundaryChunking(*o.WordBoundaryChunking))
+	}
+	if len(o.InclusiveStops) > 0 {
+		opts = append(opts, WithInclusiveStops(o.InclusiveStops))
+	}
+	if len(o.ExclusiveStops) > 0 {
+		opts = append(opts, WithExclusiveStops(o.ExclusiveStops))
+	}
+	for _, token := range o.RemoveTokens {
+		opts = append(opts, RemoveToken(token))
+	}
+	if o.MaxBufferBytes > 0 {
+		opts = append(opts, WithMaxBufferBytes(o.MaxBufferBytes))
+	}
+	if o.IdleTimeout > 0 {
+		opts = append(opts, WithIdleTimeout(o.IdleTimeout))
+	}
+	if o.RawParamEncoding != nil {
+		opts = append(opts, WithRawParamEncoding(*o.RawParamEncoding))
+	}
+	if o.Logger != nil {
+		opts = append(opts, WithLogger(o.Logger))
+	}
+	if o.Tracer != nil {
+		opts = append(opts, WithTracer(o.Tracer))
+	}
+	if o.ToolCallIDGenerator != nil {
+		opts = append(opts, WithToolCallIDGenerator(o.ToolCallIDGenerator))
+	}
+	if o.NestedParamPaths {
+		opts = append(opts, WithNestedParamPaths())
+	}
+	if o.RollbackWindow > 0 {
+		opts = append(opts, WithRollbackWindow(o.RollbackWindow))
+	}
+	if o.OutputTransformer != nil {
+		opts = append(opts, WithOutputTransformer(o.OutputTransformer))
+	}
+	if len(o.ToolReadiness) > 0 {
+		opts = append(opts, WithToolReadiness(o.ToolReadiness))
+	}
+	if o.MarkdownState {
+		opts = append(opts, WithMarkdownState())
+	}
+	if o.LanguageDetection {
+		opts = append(opts, WithLanguageDetection())
+	}
+	if len(o.ConditionalStops) > 0 {
+		opts = append(opts, WithConditionalStops(o.ConditionalStops))
+	}
+	if o.LatencyStamps {
+		opts = append(opts, WithLatencyStamps())
+	}
+	if o.CitationConfidence != nil {
+		opts = append(opts, WithCitationConfidence(*o.CitationConfidence))
+	}
+	if o.ModeEvents {
+		opts = append(opts, WithModeEvents())
+	}
+	if o.CitationValidation {
+		opts = append(opts, WithCitationValidation())
+	}
+	if o.SuppressedReasoning {
+		opts = append(opts, WithSuppressedReasoning())
+	}
+	if o.DocumentOrder != nil {
+		opts = append(opts, WithDocumentOrder(o.DocumentOrder))
+	}
+	if o.StrictOptions {
+		opts = append(opts, WithStrictOptions())
+	}
+	if o.DedupWindow > 0 {
+		opts = append(opts, WithDedupWindow(o.DedupWindow))
+	}
+	if len(o.CitationExclusionZones) > 0 {
+		opts = append(opts, WithCitationExclusionZones(o.CitationExclusionZones...))
+	}
+	if o.LegacyQuerySplitting {
+		opts = append(opts, WithLegacyQuerySplitting())
+	}
+	if o.SearchQueryDedup {
+		opts = append(opts, WithSearchQueryDedup())
+	}
+	return opts
+}
+
+// OptionsFromFilterOptions returns the Options equivalent to the FilterOption funcs
+func OptionsFromFilterOptions(options ...FilterOption) Options {
+	cfg := &filterConfig{}
+	for _, opt := range options {
+		opt(cfg)
+	}
+	return Options{
+		Formats:                  slices.Clone(cfg.formats),
+		FIMFamily:                cfg.fimFamily,
+		StreamToolActions:        cfg.streamToolActions,
+		StreamNonGroundedAnswer:  cfg.streamNonGroundedAnswer,
+		StreamProcessedParams:    cfg.streamProcessedParams,
+		StreamDocumentSelections: cfg.streamDocumentSelections,
+		CitationMerging:          cfg.citationMerging,
+		SentenceCitations:        cfg.sentenceCitations,
+		CitationIndexUnit:        cfg.citationIndexUnit,
+		CitationSourceFormat:     cfg.citationSourceFormat,
+		UnicodeNormalization:     cfg.unicodeNormalization,
+		FinishReason:             cfg.finishReason,
+		PromptEchoTokens:         cfg.promptEchoTokens,
+		ResponsePrefix:           cfg.responsePrefix,
+		HealedPrefix:             cfg.healedPrefix,
+		Resume:                   cfg.resume,
+		DocumentIDs:              cfg.documentIDs,
+		RawTap:                   cfg.rawTap,
+		Tokenizer:                cfg.tokenizer,
+		SpecialTokenMap:          maps.Clone(cfg.specialTokenMap),
+		LeftTrimmed:              cfg.leftTrimmed,
+		RightTrimmed:             cfg.rightTrimmed,
+		PrefixTrim:               cfg.prefixTrim,
+		ChunkSize:                cfg.chunkSize,
+		WordBoundaryChunking:     cfg.wordBoundaryChunking,
+		InclusiveStops:           cfg.inclusiveStops,
+		ExclusiveStops:           cfg.exclusiveStops,
+		RemoveTokens:             slices.Clone(cfg.removeTokens),
+		MaxBufferBytes:           cfg.maxBufferBytes,
+		IdleTimeout:              cfg.idleTimeout,
+		RawParamEncoding:         cfg.rawParamEncoding,
+		Logger:                   cfg.logger,
+		Tracer:                   cfg.tracer,
+		ToolCallIDGenerator:      cfg.toolCallIDGenerator,
+		NestedParamPaths:         cfg.nestedParamPaths,
+		RollbackWindow:           cfg.rollbackWindow,
+		OutputTransformer:        cfg.outputTransformer,
+		ToolReadiness:            cfg.toolReadiness,
+		MarkdownState:            cfg.markdownState,
+		LanguageDetection:        cfg.languageDetection,
+		ConditionalStops:         cfg.conditionalStops,
+		LatencyStamps:            cfg.latencyStamps,
+		CitationConfidence:       cfg.citationConfidence,
+		ModeEvents:               cfg.modeEvents,
+		CitationValidation:       cfg.citationValidation,
+		SuppressedReasoning:      cfg.suppressedReasoning,
+		DocumentOrder:            cfg.documentOrder,
+		StrictOptions:            cfg.strictOptions,
+		DedupWindow:              cfg.dedupWindow,
+		CitationExclusionZones:   cfg.citationExclusionZones,
+		LegacyQuerySplitting:     cfg.legacyQuerySplitting,
+		SearchQueryDedup:         cfg.searchQueryDedup,
+	}
+}
@@ -0,0 +1,99 @@
+package gobindings
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
+func TestOptions_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	family := FIMFamilyStarCoder
+	confidence := CitationConfidenceMin
+	opts := Options{
+		Formats:                  []string{"cmd3"},
+		FIMFamily:                &family,
+		StreamToolActions:        true,
+		StreamNonGroundedAnswer:  true,
+		StreamProcessedParams:    true,
+		StreamDocumentSelections: true,
+		CitationMerging:          true,
+		SentenceCitations:        true,
+		CitationIndexUnit:        CitationIndexBytes,
+		CitationSourceFormat:     CitationSourceToolName,
+		UnicodeNormalization:     UnicodeNormalizationNFC,
+		FinishReason:             true,
+		PromptEchoTokens:         3,
+		ResponsePrefix:           "The",
+		HealedPrefix:             "The",
+		Resume:                   &ResumeState{PriorText: "The sky"},
+		DocumentIDs:              [][]string{{"doc"}},
+		RawTap:                   io.Discard,
+		Tokenizer:                &tokenizers.Tokenizer{},
+		SpecialTokenMap:          map[string]FilterMode{"<tool>": FilterModeToolAction},
+		LeftTrimmed:              true,
+		RightTrimmed:             true,
+		PrefixTrim:               "Answer: ",
+		ChunkSize:                2,
+		WordBoundaryChunking:     new(int),
+		InclusiveStops:           []string{"a"},
+		ExclusiveStops:           []string{"b"},
+		RemoveTokens:             []string{"c"},
+		MaxBufferBytes:           64,
+		IdleTimeout:              time.Second,
+		RawParamEncoding:         &RawParamEncoding{Indent: "  ", Strict: true},
+		Logger:                   nopLogger{},
+		Tracer:                   &recordingTracer{},
+		ToolCallIDGenerator:      SequentialToolCallID,
+		NestedParamPaths:         true,
+		RollbackWindow:           4,
+		OutputTransformer:        func(text string) (string, []Redaction) { return text + "!", nil },
+		ToolReadiness:            []Tool{{Name: "search"}},
+		MarkdownState:            true,
+		LanguageDetection:        true,
+		ConditionalStops:         []ConditionalStop{{Stop: "d", Context: StopContextNotInAction}},
+		LatencyStamps:            true,
+		CitationConfidence:       &confidence,
+		ModeEvents:               true,
+		CitationValidation:       true,
+		SuppressedReasoning:      true,
+		DocumentOrder:            []int{1, 0},
+		StrictOptions:            true,
+		DedupWindow:              64,
+		CitationExclusionZones:   []ZoneKind{ZoneCodeFence, ZoneMath},
+		LegacyQuerySplitting:     true,
+		SearchQueryDedup:         true,
+	}
+
+	// Every option must be set above so a field missing from a conversion is caught
+	v := reflect.ValueOf(opts)
+	for i := range v.NumField() {
+		require.False(t, v.Field(i).IsZero(), "field %s is not set", v.Type().Field(i).Name)
+	}
+	got := OptionsFromFilterOptions(opts.ToFilterOptions()...)
+	// Functions are never equal, compare the generated IDs instead
+	require.Equal(t, opts.ToolCallIDGenerator(1), got.ToolCallIDGenerator(1))
+	opts.ToolCallIDGenerator, got.ToolCallIDGenerator = nil, nil
+	gotText, _ := got.OutputTransformer("a")
+	require.Equal(t, "a!", gotText)
+	opts.OutputTransformer, got.OutputTransformer = nil, nil
+	require.Equal(t, opts, got)
+}
+
+func TestOptions_CoversFilterConfig(t *testing.T) {
+	t.Parallel()
+
+	// Options must have a field for every field of filterConfig, in the same order
+	cfg := reflect.TypeFor[filterConfig]()
+	opts := reflect.TypeFor[Options]()
+	require.Equal(t, cfg.NumField(), opts.NumField())
+	for i := range cfg.NumField() {
+		require.Equal(t, cfg.Field(i).Type, opts.Field(i).Type, "field %s", opts.Field(i).Name)
+	}
+}
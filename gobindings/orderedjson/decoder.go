@@ -0,0 +1,372 @@
+package orderedjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// EventKind is the kind of an Event
+type EventKind int
+
+const (
+	BeginObject EventKind = iota
+	EndObject
+	BeginArray
+	EndArray
+	// Key is an object key, reported once it is complete
+	Key
+	// Value is a string, number or literal, reported in parts as its chunks are read
+	Value
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case BeginObject:
+		return "BeginObject"
+	case EndObject:
+		return "EndObject"
+	case BeginArray:
+		return "BeginArray"
+	case EndArray:
+		return "EndArray"
+	case Key:
+		return "Key"
+	case Value:
+		return "Value"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is a token of a JSON document read by a Decoder
+type Event struct {
+	Kind EventKind
+	// Key is the decoded key of a Key event
+	Key string
+	// Raw is the JSON text of the event: the bracket of a Begin or End event, the quoted
+	// key of a Key event and the part of the value read from the chunk of a Value event
+	Raw []byte
+	// Partial is set on a Value event when the value continues in the next chunk. The
+	// last part of a number or literal is only known at the byte after it, so it may be
+	// empty.
+	Partial bool
+	// Offset is the number of input bytes read before Raw
+	Offset int64
+}
+
+// Decoder reads a JSON document fed to it in arbitrary chunks and reports its tokens in
+// order as they are read, so the keys of objects can be followed before the document
+// is complete. It is used to split the parameters of tool calls as they are streamed.
+type Decoder struct {
+	stack []level
+	// done is set once a complete top-level value was read
+	done bool
+
+	inString bool
+	escape   bool
+	isKey    bool
+	literal  bool
+	// token holds the string or literal being read, which may start in a previous chunk
+	token       []byte
+	tokenOffset int64
+
+	offset int64
+	err    error
+
+	// chunk and start are the chunk being read and the start in it of the value being read
+	chunk       []byte
+	chunkOffset int64
+	start       int
+	events      []Event
+}
+
+// NewDecoder returns a Decoder at the start of a document
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// InputOffset returns the number of input bytes read
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Clone returns a copy of the Decoder that reads on independently, e.g. to read the rest
+// of the document twice
+func (d *Decoder) Clone() *Decoder {
+	c := *d
+	c.stack = slices.Clone(d.stack)
+	c.token = slices.Clone(d.token)
+	c.chunk, c.events = nil, nil
+	return &c
+}
+
+// Feed reads chunk, which may end in the middle of a token, and returns its events. On
+// invalid JSON it returns the events read before the error, a *SyntaxError, and the
+// Decoder fails all later calls.
+func (d *Decoder) Feed(chunk []byte) ([]Event, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.chunk, d.chunkOffset, d.start, d.events = chunk, d.offset, 0, nil
+	for i, c := range chunk {
+		if err := d.readByte(i, c); err != nil {
+			d.err = err
+			return d.events, err
+		}
+		d.offset++
+	}
+	if (d.inString && !d.isKey) || d.literal {
+		d.valuePart(len(chunk), true)
+	}
+	d.chunk = nil
+	return d.events, nil
+}
+
+// Close ends the document and returns the last part of a top-level number or literal. It
+// returns an error if the document is incomplete.
+func (d *Decoder) Close() ([]Event, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.chunk, d.chunkOffset, d.start, d.events = nil, d.offset, 0, nil
+	if d.literal {
+		if err := d.endLiteral(0); err != nil {
+			d.err = err
+			return nil, err
+		}
+	}
+	if d.inString || len(d.stack) > 0 || !d.done {
+		d.err = d.syntaxError("unexpected end of JSON input")
+		return nil, d.err
+	}
+	return d.events, nil
+}
+
+func (d *Decoder) readByte(i int, c byte) error {
+	if d.inString {
+		d.token = append(d.token, c)
+		switch {
+		case d.escape:
+			d.escape = false
+		case c == '\\':
+			d.escape = true
+		case c == '"':
+			d.inString = false
+			return d.endString(i)
+		}
+		return nil
+	}
+
+	if d.literal {
+		if isLiteralByte(c) {
+			d.token = append(d.token, c)
+			return nil
+		}
+		if err := d.endLiteral(i); err != nil {
+			return err
+		}
+	}
+
+	switch c {
+	case ' ', '\t', '\n', '\r':
+	case '{', '[':
+		if err := d.startValue(); err != nil {
+			return err
+		}
+		d.stack = append(d.stack, level{open: c, next: expectFirst})
+		kind := BeginObject
+		if c == '[' {
+			kind = BeginArray
+		}
+		d.emit(kind, "", d.chunk[i:i+1], d.offset, false)
+	case '}', ']':
+		return d.closeContainer(i, c)
+	case ',':
+		if len(d.stack) == 0 || d.stack[len(d.stack)-1].next != expectCommaOrClose {
+			return d.syntaxError("unexpected ','")
+		}
+		top := &d.stack[len(d.stack)-1]
+		if top.open == '{' {
+			top.next = expectKey
+		} else {
+			top.next = expectValue
+		}
+	case ':':
+		if len(d.stack) == 0 || d.stack[len(d.stack)-1].next != expectColon {
+			return d.syntaxError("unexpected ':'")
+		}
+		d.stack[len(d.stack)-1].next = expectValue
+	case '"':
+		d.isKey = false
+		if len(d.stack) > 0 {
+			top := d.stack[len(d.stack)-1]
+			d.isKey = top.open == '{' && (top.next == expectKey || top.next == expectFirst)
+		}
+		if !d.isKey {
+			if err := d.startValue(); err != nil {
+				return err
+			}
+		}
+		d.inString = true
+		d.token = append(d.token[:0], c)
+		d.tokenOffset = d.offset
+		d.start = i
+	default:
+		if err := d.startValue(); err != nil {
+			return err
+		}
+		d.literal = true
+		d.token = append(d.token[:0], c)
+		d.tokenOffset = d.offset
+		d.start = i
+	}
+	return nil
+}
+
+// startValue checks that a value may start here
+func (d *Decoder) startValue() error {
+	if len(d.stack) == 0 {
+		if d.done {
+			return d.syntaxError("unexpected data after top-level value")
+		}
+		return nil
+	}
+	top := d.stack[len(d.stack)-1]
+	if top.next != expectValue && !(top.next == expectFirst && top.open == '[') {
+		return d.syntaxError("unexpected value")
+	}
+	return nil
+}
+
+// endValue records that a value was read
+func (d *Decoder) endValue() {
+	if len(d.stack) == 0 {
+		d.done = true
+		return
+	}
+	d.stack[len(d.stack)-1].next = expectCommaOrClose
+}
+
+// endString ends the string closed by the quote at i of the chunk
+func (d *Decoder) endString(i int) error {
+	var s string
+	if err := json.Unmarshal(d.token, &s); err != nil {
+		return d.syntaxError("invalid string")
+	}
+	if !d.isKey {
+		d.valuePart(i+1, false)
+		d.endValue()
+		return nil
+	}
+	d.emit(Key, s, d.token, d.tokenOffset, false)
+	d.stack[len(d.stack)-1].next = expectColon
+	return nil
+}
+
+// endLiteral ends the number or literal before i of the chunk
+func (d *Decoder) endLiteral(i int) error {
+	d.literal = false
+	if !json.Valid(d.token) {
+		return d.syntaxError(fmt.Sprintf("invalid literal %q", d.token))
+	}
+	d.valuePart(i, false)
+	d.endValue()
+	return nil
+}
+
+func (d *Decoder) closeContainer(i int, c byte) error {
+	if len(d.stack) == 0 {
+		return d.syntaxError(fmt.Sprintf("unexpected %q", c))
+	}
+	top := d.stack[len(d.stack)-1]
+	if (top.open == '{') != (c == '}') || (top.next != expectFirst && top.next != expectCommaOrClose) {
+		return d.syntaxError(fmt.Sprintf("unexpected %q", c))
+	}
+	d.stack = d.stack[:len(d.stack)-1]
+	kind := EndObject
+	if c == ']' {
+		kind = EndArray
+	}
+	d.emit(kind, "", d.chunk[i:i+1], d.offset, false)
+	d.endValue()
+	return nil
+}
+
+// valuePart emits the part of the value being read that ends before end of the chunk
+func (d *Decoder) valuePart(end int, partial bool) {
+	if partial && end == d.start {
+		return
+	}
+	d.emit(Value, "", d.chunk[d.start:end], d.chunkOffset+int64(d.start), partial)
+}
+
+func (d *Decoder) emit(kind EventKind, key string, raw []byte, offset int64, partial bool) {
+	d.events = append(d.events, Event{Kind: kind, Key: key, Raw: bytes.Clone(raw), Partial: partial, Offset: offset})
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.offset, Msg: msg}
+}
+
+// decoderState is the encoding of a Decoder between two chunks
+type decoderState struct {
+	Open        []byte `json:"open,omitempty"`
+	Next        []int  `json:"next,omitempty"`
+	Done        bool   `json:"done,omitempty"`
+	InString    bool   `json:"in_string,omitempty"`
+	Escape      bool   `json:"escape,omitempty"`
+	IsKey       bool   `json:"is_key,omitempty"`
+	Literal     bool   `json:"literal,omitempty"`
+	Token       []byte `json:"token,omitempty"`
+	TokenOffset int64  `json:"token_offset,omitempty"`
+	Offset      int64  `json:"offset"`
+}
+
+// MarshalJSON encodes the state of the Decoder, so the document can be read on by another
+// Decoder. A failed Decoder cannot be encoded.
+func (d *Decoder) MarshalJSON() ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	s := decoderState{
+		Done:        d.done,
+		InString:    d.inString,
+		Escape:      d.escape,
+		IsKey:       d.isKey,
+		Literal:     d.literal,
+		Token:       d.token,
+		TokenOffset: d.tokenOffset,
+		Offset:      d.offset,
+	}
+	for _, l := range d.stack {
+		s.Open = append(s.Open, l.open)
+		s.Next = append(s.Next, int(l.next))
+	}
+	return json.Marshal(s)
+}
+
+// UnmarshalJSON restores the state of a Decoder encoded with MarshalJSON
+func (d *Decoder) UnmarshalJSON(data []byte) error {
+	var s decoderState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if len(s.Open) != len(s.Next) {
+		return fmt.Errorf("orderedjson: invalid decoder state, %d containers and %d expectations", len(s.Open), len(s.Next))
+	}
+	*d = Decoder{
+		done:        s.Done,
+		inString:    s.InString,
+		escape:      s.Escape,
+		isKey:       s.IsKey,
+		literal:     s.Literal,
+		token:       s.Token,
+		tokenOffset: s.TokenOffset,
+		offset:      s.Offset,
+	}
+	for i, open := range s.Open {
+		d.stack = append(d.stack, level{open: open, next: expect(s.Next[i])})
+	}
+	return nil
+}
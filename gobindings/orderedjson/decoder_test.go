@@ -0,0 +1,190 @@
+package orderedjson
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// decodeAll feeds the chunks to a Decoder and returns its events, with the parts of
+// each value merged
+func decodeAll(t *testing.T, chunks ...string) []Event {
+	t.Helper()
+	d := NewDecoder()
+	var events []Event
+	add := func(evs []Event) {
+		for _, ev := range evs {
+			if n := len(events); n > 0 && events[n-1].Kind == Value && events[n-1].Partial {
+				events[n-1].Raw = append(events[n-1].Raw, ev.Raw...)
+				events[n-1].Partial = ev.Partial
+				continue
+			}
+			events = append(events, ev)
+		}
+	}
+	for _, chunk := range chunks {
+		evs, err := d.Feed([]byte(chunk))
+		require.NoError(t, err)
+		add(evs)
+	}
+	evs, err := d.Close()
+	require.NoError(t, err)
+	add(evs)
+	return events
+}
+
+func TestDecoder_Events(t *testing.T) {
+	in := `{"b": [1, "x\"]"], "a\"\\": {"c": null}, "éé": -1.5e3}`
+	want := []Event{
+		{Kind: BeginObject, Raw: []byte(`{`), Offset: 0},
+		{Kind: Key, Key: "b", Raw: []byte(`"b"`), Offset: 1},
+		{Kind: BeginArray, Raw: []byte(`[`), Offset: 6},
+		{Kind: Value, Raw: []byte(`1`), Offset: 7},
+		{Kind: Value, Raw: []byte(`"x\"]"`), Offset: 10},
+		{Kind: EndArray, Raw: []byte(`]`), Offset: 16},
+		{Kind: Key, Key: `a"\`, Raw: []byte(`"a\"\\"`), Offset: 19},
+		{Kind: BeginObject, Raw: []byte(`{`), Offset: 28},
+		{Kind: Key, Key: "c", Raw: []byte(`"c"`), Offset: 29},
+		{Kind: Value, Raw: []byte(`null`), Offset: 34},
+		{Kind: EndObject, Raw: []byte(`}`), Offset: 38},
+		{Kind: Key, Key: "éé", Raw: []byte(`"éé"`), Offset: 41},
+		{Kind: Value, Raw: []byte(`-1.5e3`), Offset: 49},
+		{Kind: EndObject, Raw: []byte(`}`), Offset: 55},
+	}
+	require.Equal(t, want, decodeAll(t, in))
+
+	// Every split of the input must decode like the whole input
+	for i := range len(in) + 1 {
+		require.Equal(t, want, decodeAll(t, in[:i], in[i:]), "split at %d", i)
+	}
+}
+
+func TestDecoder_Partial(t *testing.T) {
+	d := NewDecoder()
+	evs, err := d.Feed([]byte(`{"q": "sk`))
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{Kind: BeginObject, Raw: []byte(`{`)},
+		{Kind: Key, Key: "q", Raw: []byte(`"q"`), Offset: 1},
+		{Kind: Value, Raw: []byte(`"sk`), Partial: true, Offset: 6},
+	}, evs)
+
+	evs, err = d.Feed([]byte(`y", "n": 4`))
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{Kind: Value, Raw: []byte(`y"`), Offset: 9},
+		{Kind: Key, Key: "n", Raw: []byte(`"n"`), Offset: 13},
+		{Kind: Value, Raw: []byte(`4`), Partial: true, Offset: 18},
+	}, evs)
+
+	// The number only ends at the next byte
+	evs, err = d.Feed([]byte(`}`))
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{Kind: Value, Raw: []byte{}, Offset: 19},
+		{Kind: EndObject, Raw: []byte(`}`), Offset: 19},
+	}, evs)
+	require.Equal(t, int64(20), d.InputOffset())
+}
+
+func TestDecoder_SyntaxError(t *testing.T) {
+	invalid := []string{
+		`{"a" 1}`,
+		`{"a": 1,}`,
+		`[1 2]`,
+		`{"a": tru}`,
+		`{"a": 1]`,
+		`{"a": 1} 2`,
+		`{"a": "\x"}`,
+		`{"\q": 1}`,
+		`{"a": [1, 2]`,
+		`"abc`,
+		``,
+	}
+	for _, in := range invalid {
+		d := NewDecoder()
+		_, err := d.Feed([]byte(in))
+		if err == nil {
+			_, err = d.Close()
+		}
+		var syntaxErr *SyntaxError
+		require.ErrorAs(t, err, &syntaxErr, in)
+
+		// The error is sticky
+		_, err = d.Feed([]byte(`1`))
+		require.ErrorAs(t, err, &syntaxErr, in)
+	}
+
+	d := NewDecoder()
+	evs, err := d.Feed([]byte(`{"a": 1, "b" 2}`))
+	require.EqualError(t, err, "orderedjson: unexpected value at offset 13")
+	require.Equal(t, []Event{
+		{Kind: BeginObject, Raw: []byte(`{`)},
+		{Kind: Key, Key: "a", Raw: []byte(`"a"`), Offset: 1},
+		{Kind: Value, Raw: []byte(`1`), Offset: 6},
+		{Kind: Key, Key: "b", Raw: []byte(`"b"`), Offset: 9},
+	}, evs)
+}
+
+func TestDecoder_Clone(t *testing.T) {
+	in := `{"a": {"b\"": "x\\"}, "c": [1, 2]}`
+	want := decodeAll(t, in)
+	for i := range len(in) + 1 {
+		d := NewDecoder()
+		evs, err := d.Feed([]byte(in[:i]))
+		require.NoError(t, err)
+
+		// The clone reads the rest of the document after the decoder did
+		clone := d.Clone()
+		_, err = d.Feed([]byte(in[i:]))
+		require.NoError(t, err)
+		_, err = d.Close()
+		require.NoError(t, err)
+		rest, err := clone.Feed([]byte(in[i:]))
+		require.NoError(t, err)
+		last, err := clone.Close()
+		require.NoError(t, err)
+
+		var got []Event
+		for _, ev := range append(append(evs, rest...), last...) {
+			if n := len(got); n > 0 && got[n-1].Kind == Value && got[n-1].Partial {
+				got[n-1].Raw = append(got[n-1].Raw, ev.Raw...)
+				got[n-1].Partial = ev.Partial
+				continue
+			}
+			got = append(got, ev)
+		}
+		require.Equal(t, want, got, "split at %d", i)
+	}
+}
+
+func TestDecoder_MarshalJSON(t *testing.T) {
+	in := `{"a": {"b\"": "x\\"}, "c": [1, 2]}`
+	want := decodeAll(t, in)
+	for i := range len(in) + 1 {
+		d := NewDecoder()
+		evs, err := d.Feed([]byte(in[:i]))
+		require.NoError(t, err)
+		state, err := json.Marshal(d)
+		require.NoError(t, err)
+
+		restored := NewDecoder()
+		require.NoError(t, json.Unmarshal(state, restored))
+		rest, err := restored.Feed([]byte(in[i:]))
+		require.NoError(t, err)
+		last, err := restored.Close()
+		require.NoError(t, err)
+
+		var got []Event
+		for _, ev := range append(append(evs, rest...), last...) {
+			if n := len(got); n > 0 && got[n-1].Kind == Value && got[n-1].Partial {
+				got[n-1].Raw = append(got[n-1].Raw, ev.Raw...)
+				got[n-1].Partial = ev.Partial
+				continue
+			}
+			got = append(got, ev)
+		}
+		require.Equal(t, want, got, "split at %d", i)
+	}
+}
@@ -0,0 +1,385 @@
+package orderedjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SyntaxError is returned by a strict Encoder for input that is not valid JSON
+type SyntaxError struct {
+	// Offset is the number of input bytes read before the error
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("orderedjson: %s at offset %d", e.Msg, e.Offset)
+}
+
+// EncoderOption configures an Encoder
+type EncoderOption func(*Encoder)
+
+// WithIndent indents the output like json.Indent, each element on a new line starting
+// with prefix followed by one copy of indent per nesting level. Without it the output is
+// compact.
+func WithIndent(prefix, indent string) EncoderOption {
+	return func(e *Encoder) {
+		e.prefix = prefix
+		e.indent = indent
+	}
+}
+
+// WithStrict makes the Encoder validate its input, failing on invalid JSON, duplicate
+// object keys and, in Close, incomplete JSON. Without it any input is re-encoded on a
+// best effort basis.
+func WithStrict() EncoderOption {
+	return func(e *Encoder) {
+		e.strict = true
+	}
+}
+
+// expect is what a strict Encoder expects next in a container
+type expect int
+
+const (
+	expectValue expect = iota
+	expectKey
+	expectColon
+	expectCommaOrClose
+	// expectFirst is expectKey or expectValue, or the close of an empty container
+	expectFirst
+)
+
+type level struct {
+	open  byte
+	next  expect
+	empty bool
+	keys  map[string]struct{}
+}
+
+// Encoder re-encodes a JSON document written to it in arbitrary chunks. Strings, numbers
+// and literals are copied byte for byte, so object keys keep their order and values their
+// exact form, and only the whitespace between tokens is replaced according to the indent.
+// It is used to normalize the raw parameters of tool calls as they are streamed.
+type Encoder struct {
+	w      io.Writer
+	prefix string
+	indent string
+	strict bool
+
+	stack []level
+	// done is set once a complete top-level value was read
+	done bool
+	// lineBreak is set when the next token starts a new element
+	lineBreak bool
+
+	inString bool
+	escape   bool
+	isKey    bool
+	// token holds the string or literal being read, only when strict
+	token   []byte
+	literal bool
+
+	offset int64
+	err    error
+	out    []byte
+}
+
+// NewEncoder returns an Encoder writing to w
+func NewEncoder(w io.Writer, opts ...EncoderOption) *Encoder {
+	e := &Encoder{w: w}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Write re-encodes p, which may end in the middle of a token
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.out = e.out[:0]
+	for _, c := range p {
+		if err := e.writeByte(c); err != nil {
+			e.err = err
+			break
+		}
+		e.offset++
+	}
+	if len(e.out) > 0 {
+		if _, err := e.w.Write(e.out); err != nil && e.err == nil {
+			e.err = err
+		}
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+	return len(p), nil
+}
+
+// Close ends the document. A strict Encoder returns an error if the document is incomplete.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.literal {
+		if err := e.endLiteral(); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	if e.strict && (e.inString || len(e.stack) > 0 || !e.done) {
+		e.err = e.syntaxError("unexpected end of JSON input")
+		return e.err
+	}
+	return nil
+}
+
+func (e *Encoder) writeByte(c byte) error {
+	if e.inString {
+		e.out = append(e.out, c)
+		if e.strict {
+			e.token = append(e.token, c)
+		}
+		switch {
+		case e.escape:
+			e.escape = false
+		case c == '\\':
+			e.escape = true
+		case c == '"':
+			e.inString = false
+			return e.endString()
+		}
+		return nil
+	}
+
+	if e.literal {
+		if isLiteralByte(c) {
+			e.out = append(e.out, c)
+			if e.strict {
+				e.token = append(e.token, c)
+			}
+			return nil
+		}
+		if err := e.endLiteral(); err != nil {
+			return err
+		}
+	}
+
+	switch c {
+	case ' ', '\t', '\n', '\r':
+		return nil
+	case '{', '[':
+		if err := e.startValue(); err != nil {
+			return err
+		}
+		e.out = append(e.out, c)
+		l := level{open: c, next: expectFirst, empty: true}
+		if c == '{' && e.strict {
+			l.keys = make(map[string]struct{})
+		}
+		e.stack = append(e.stack, l)
+		e.lineBreak = true
+	case '}', ']':
+		return e.closeContainer(c)
+	case ',':
+		if len(e.stack) == 0 {
+			if e.strict {
+				return e.syntaxError("unexpected ','")
+			}
+			e.out = append(e.out, c)
+			return nil
+		}
+		top := &e.stack[len(e.stack)-1]
+		if e.strict && top.next != expectCommaOrClose {
+			return e.syntaxError("unexpected ','")
+		}
+		if top.open == '{' {
+			top.next = expectKey
+		} else {
+			top.next = expectValue
+		}
+		e.out = append(e.out, c)
+		e.lineBreak = true
+	case ':':
+		if len(e.stack) > 0 {
+			top := &e.stack[len(e.stack)-1]
+			if e.strict && top.next != expectColon {
+				return e.syntaxError("unexpected ':'")
+			}
+			top.next = expectValue
+		} else if e.strict {
+			return e.syntaxError("unexpected ':'")
+		}
+		e.out = append(e.out, c)
+		if e.indent != "" || e.prefix != "" {
+			e.out = append(e.out, ' ')
+		}
+	case '"':
+		e.isKey = false
+		if len(e.stack) > 0 {
+			top := &e.stack[len(e.stack)-1]
+			e.isKey = top.open == '{' && (top.next == expectKey || top.next == expectFirst)
+		}
+		if e.isKey {
+			e.startElement()
+		} else if err := e.startValue(); err != nil {
+			return err
+		}
+		e.inString = true
+		e.out = append(e.out, c)
+		if e.strict {
+			e.token = append(e.token[:0], c)
+		}
+	default:
+		if err := e.startValue(); err != nil {
+			return err
+		}
+		e.literal = true
+		e.out = append(e.out, c)
+		if e.strict {
+			e.token = append(e.token[:0], c)
+		}
+	}
+	return nil
+}
+
+// startElement writes the line break before a new element of the current container
+func (e *Encoder) startElement() {
+	if len(e.stack) > 0 {
+		e.stack[len(e.stack)-1].empty = false
+	}
+	if e.lineBreak {
+		e.newline(len(e.stack))
+		e.lineBreak = false
+	}
+}
+
+// startValue checks that a value may start here and writes the line break before it
+func (e *Encoder) startValue() error {
+	if len(e.stack) == 0 {
+		if e.strict && e.done {
+			return e.syntaxError("unexpected data after top-level value")
+		}
+		return nil
+	}
+	top := &e.stack[len(e.stack)-1]
+	if e.strict && top.next != expectValue && !(top.next == expectFirst && top.open == '[') {
+		return e.syntaxError("unexpected value")
+	}
+	if top.open == '[' {
+		e.startElement()
+	}
+	return nil
+}
+
+// endValue records that a value was read
+func (e *Encoder) endValue() {
+	if len(e.stack) == 0 {
+		e.done = true
+		return
+	}
+	e.stack[len(e.stack)-1].next = expectCommaOrClose
+}
+
+func (e *Encoder) endString() error {
+	if !e.strict {
+		if e.isKey {
+			e.stack[len(e.stack)-1].next = expectColon
+		} else {
+			e.endValue()
+		}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(e.token, &s); err != nil {
+		return e.syntaxError("invalid string")
+	}
+	if !e.isKey {
+		e.endValue()
+		return nil
+	}
+	top := &e.stack[len(e.stack)-1]
+	if _, ok := top.keys[s]; ok {
+		return e.syntaxError(fmt.Sprintf("duplicate key %q", s))
+	}
+	top.keys[s] = struct{}{}
+	top.next = expectColon
+	return nil
+}
+
+func (e *Encoder) endLiteral() error {
+	e.literal = false
+	if e.strict && !json.Valid(e.token) {
+		return e.syntaxError(fmt.Sprintf("invalid literal %q", e.token))
+	}
+	e.endValue()
+	return nil
+}
+
+func (e *Encoder) closeContainer(c byte) error {
+	if len(e.stack) == 0 {
+		if e.strict {
+			return e.syntaxError(fmt.Sprintf("unexpected %q", c))
+		}
+		e.out = append(e.out, c)
+		return nil
+	}
+	top := e.stack[len(e.stack)-1]
+	if e.strict {
+		if (top.open == '{') != (c == '}') {
+			return e.syntaxError(fmt.Sprintf("unexpected %q", c))
+		}
+		if top.next != expectFirst && top.next != expectCommaOrClose {
+			return e.syntaxError(fmt.Sprintf("unexpected %q", c))
+		}
+	}
+	e.stack = e.stack[:len(e.stack)-1]
+	e.lineBreak = false
+	if !top.empty {
+		e.newline(len(e.stack))
+	}
+	e.out = append(e.out, c)
+	e.endValue()
+	return nil
+}
+
+func (e *Encoder) newline(depth int) {
+	if e.indent == "" && e.prefix == "" {
+		return
+	}
+	e.out = append(e.out, '\n')
+	e.out = append(e.out, e.prefix...)
+	for range depth {
+		e.out = append(e.out, e.indent...)
+	}
+}
+
+func (e *Encoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: e.offset, Msg: msg}
+}
+
+func isLiteralByte(c byte) bool {
+	return !strings.ContainsRune(" \t\n\r{}[],:\"", rune(c))
+}
+
+// Reformat re-encodes a complete JSON document with an Encoder, e.g. to re-serialize tool
+// call parameters for a retry without changing the order of their keys
+func Reformat(data []byte, opts ...EncoderOption) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, opts...)
+	if _, err := enc.Write(data); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var _ io.WriteCloser = &Encoder{}
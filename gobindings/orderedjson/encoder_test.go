@@ -0,0 +1,74 @@
+package orderedjson
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoder_PreservesOrder(t *testing.T) {
+	in := `{ "z": 1.50, "a" : [true, null,{}], "m": {"y": "a, \"b\": c", "b": []} }`
+
+	out, err := Reformat([]byte(in))
+	require.NoError(t, err)
+	require.Equal(t, `{"z":1.50,"a":[true,null,{}],"m":{"y":"a, \"b\": c","b":[]}}`, string(out))
+
+	out, err = Reformat([]byte(in), WithIndent("", "  "))
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "z": 1.50,
+  "a": [
+    true,
+    null,
+    {}
+  ],
+  "m": {
+    "y": "a, \"b\": c",
+    "b": []
+  }
+}`, string(out))
+}
+
+func TestEncoder_Chunks(t *testing.T) {
+	in := `{"city": "París", "days": [1, 2]}`
+	// Every split of the input must encode like the whole input
+	for i := range len(in) + 1 {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, WithIndent("", "\t"), WithStrict())
+		_, err := enc.Write([]byte(in[:i]))
+		require.NoError(t, err)
+		_, err = enc.Write([]byte(in[i:]))
+		require.NoError(t, err)
+		require.NoError(t, enc.Close())
+		require.Equal(t, "{\n\t\"city\": \"París\",\n\t\"days\": [\n\t\t1,\n\t\t2\n\t]\n}", buf.String())
+	}
+}
+
+func TestEncoder_Strict(t *testing.T) {
+	invalid := []string{
+		`{"a": 1, "a": 2}`,
+		`{"a" 1}`,
+		`{"a": 1,}`,
+		`[1 2]`,
+		`{"a": tru}`,
+		`{"a": 1]`,
+		`{"a": 1} 2`,
+		`{"a": [1, 2]`,
+		`"abc`,
+		``,
+	}
+	for _, in := range invalid {
+		_, err := Reformat([]byte(in), WithStrict())
+		var syntaxErr *SyntaxError
+		require.ErrorAs(t, err, &syntaxErr, in)
+
+		// Without strict mode the input is re-encoded on a best effort basis
+		_, err = Reformat([]byte(in))
+		require.NoError(t, err, in)
+	}
+
+	out, err := Reformat([]byte(`{"a": {"a": 1}, "b": [{"a": 2}, {"a": 3}]}`), WithStrict())
+	require.NoError(t, err)
+	require.Equal(t, `{"a":{"a":1},"b":[{"a":2},{"a":3}]}`, string(out))
+}
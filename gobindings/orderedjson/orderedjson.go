@@ -189,6 +189,10 @@ func dumpWriter(writer *jwriter.Writer) ([]byte, error) {
 }
 
 func (o *Object) UnmarshalJSON(data []byte) error {
+	// null leaves the object as is, like it does for the types of encoding/json
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
 	if o == nil || o.pairs == nil {
 		*o = New()
 	}
@@ -159,6 +159,10 @@ func TestObject_UnmarshalJSON(t *testing.T) {
 			name:     "ensure escaped characters are handled correctly",
 			input:    `{"key": "hel\\\"lo"}`,
 			expected: New(WithInitialData(Pair{"key", `hel\"lo`})),
+		}, {
+			name:     "null leaves the object zero",
+			input:    `null`,
+			expected: Object{},
 		},
 	}
 
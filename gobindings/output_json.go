@@ -0,0 +1,97 @@
+package gobindings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// FilterOutputSchemaVersion is the version of the JSON encoding of FilterOutput, written to
+// its schema_version field. It changes whenever a field is renamed or removed.
+const FilterOutputSchemaVersion = 1
+
+// legacyFilterOutputKeys maps the keys of encodings that predate the versioned schema to
+// their current names: the field names of the untagged structs, and doc_indices for the
+// sources of a citation. Keys differing only in case need no entry.
+var legacyFilterOutputKeys = map[string]string{
+	"SearchQuery":   "search_query",
+	"ToolCallDelta": "tool_call_delta",
+	"IsPostAnswer":  "is_post_answer",
+	"IsReasoning":   "is_reasoning",
+	"IsEcho":        "is_echo",
+	"TokenIDs":      "token_ids",
+	"ParamDelta":    "param_delta",
+	"RawParamDelta": "raw_param_delta",
+	"ValueDelta":    "value_delta",
+	"StopSequence":  "stop_sequence",
+	"doc_indices":   "sources",
+	"DocIndices":    "sources",
+}
+
+// filterOutput has the fields of FilterOutput without its methods
+type filterOutput FilterOutput
+
+type versionedFilterOutput struct {
+	SchemaVersion int `json:"schema_version"`
+	*filterOutput
+}
+
+// MarshalJSON encodes the output with the current schema version
+func (o FilterOutput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(versionedFilterOutput{
+		SchemaVersion: FilterOutputSchemaVersion,
+		filterOutput:  (*filterOutput)(&o),
+	})
+}
+
+// UnmarshalJSON decodes an output of any schema version up to the current one, including
+// the legacy encodings without a schema_version
+func (o *FilterOutput) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw any
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	normalized, err := json.Marshal(renameLegacyKeys(raw))
+	if err != nil {
+		return err
+	}
+
+	v := versionedFilterOutput{filterOutput: (*filterOutput)(o)}
+	if err := json.Unmarshal(normalized, &v); err != nil {
+		return err
+	}
+	if v.SchemaVersion > FilterOutputSchemaVersion {
+		return fmt.Errorf("unsupported FilterOutput schema version %d, the latest is %d", v.SchemaVersion, FilterOutputSchemaVersion)
+	}
+	return nil
+}
+
+// renameLegacyKeys renames the legacy keys of every object in v, unless the object also has
+// the current key
+func renameLegacyKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, val := range v {
+			res[k] = renameLegacyKeys(val)
+		}
+		for legacy, current := range legacyFilterOutputKeys {
+			val, ok := res[legacy]
+			if !ok {
+				continue
+			}
+			delete(res, legacy)
+			if _, ok := res[current]; !ok {
+				res[current] = val
+			}
+		}
+		return res
+	case []any:
+		for i := range v {
+			v[i] = renameLegacyKeys(v[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,63 @@
+package gobindings
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// goldenFilterOutputs are the outputs encoded in testdata/filter_output
+var goldenFilterOutputs = []FilterOutput{
+	{
+		Text:     "It is sunny",
+		Logprobs: TokenIDsWithLogProb{TokenIDs: []uint32{1, 2}, Logprobs: []float32{-0.5, -1.25}},
+		Citations: []FilterCitation{{
+			StartIndex:  6,
+			EndIndex:    11,
+			Text:        "sunny",
+			Sources:     []Source{{ToolCallIndex: 0, ToolResultIndices: []uint{1}}},
+			DocumentIDs: []string{"doc_1"},
+		}},
+	},
+	{SearchQuery: &FilterSearchQueryDelta{Index: 1, Text: "weather"}, IsReasoning: true},
+	{
+		ToolCallDelta: &FilterToolCallDelta{
+			Index:         0,
+			ID:            "call_0",
+			Name:          "get_weather",
+			ParamDelta:    &FilterToolParameter{Name: "city", ValueDelta: `"Rome"`},
+			RawParamDelta: `{"city": "Rome"}`,
+		},
+	},
+	{Text: "Hi", IsPostAnswer: true, IsEcho: true},
+	{Finish: &FilterFinish{Reason: FinishReasonExclusiveStop, StopSequence: "<|END_RESPONSE|>"}},
+}
+
+func TestFilterOutput_JSON(t *testing.T) {
+	t.Parallel()
+
+	golden, err := os.ReadFile(filepath.Join("testdata", "filter_output", "v1.json"))
+	require.NoError(t, err)
+	got, err := json.MarshalIndent(goldenFilterOutputs, "", "  ")
+	require.NoError(t, err)
+	require.JSONEq(t, string(golden), string(got))
+
+	for _, name := range []string{"v1.json", "legacy.json"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "filter_output", name))
+		require.NoError(t, err)
+		var outputs []FilterOutput
+		require.NoError(t, json.Unmarshal(data, &outputs), name)
+		require.Equal(t, goldenFilterOutputs, outputs, name)
+	}
+}
+
+func TestFilterOutput_UnmarshalFutureVersion(t *testing.T) {
+	t.Parallel()
+
+	var o FilterOutput
+	err := json.Unmarshal([]byte(`{"schema_version": 2, "text": "hi"}`), &o)
+	require.EqualError(t, err, "unsupported FilterOutput schema version 2, the latest is 1")
+}
@@ -0,0 +1,158 @@
+package gobindings
+
+import (
+	"slices"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// paramPathSegment is the text of a chunk of a parameter value that belongs to one nested field
+type paramPathSegment struct {
+	path []string
+	text string
+}
+
+// paramPathScanner splits the value of a tool parameter, streamed in chunks, into the values
+// of its nested fields. Objects are descended into, every other value, arrays included, is a
+// leaf whose JSON text is reported with the path of keys leading to it.
+type paramPathScanner struct {
+	dec  *orderedjson.Decoder
+	path []string
+	// objects is the number of objects the scanner descended into
+	objects int
+	// depth is the nesting of the arrays and objects in the leaf being read
+	depth int
+	// failed is set once the value is not valid JSON, its rest is then reported as one leaf
+	failed bool
+}
+
+func newParamPathScanner(name string) *paramPathScanner {
+	return &paramPathScanner{dec: orderedjson.NewDecoder(), path: []string{name}}
+}
+
+// clone returns a copy of the scanner that reads on independently
+func (s *paramPathScanner) clone() *paramPathScanner {
+	c := *s
+	if s.dec != nil {
+		c.dec = s.dec.Clone()
+	}
+	c.path = slices.Clone(s.path)
+	return &c
+}
+
+// scan returns the segments of chunk, the next part of the parameter value
+func (s *paramPathScanner) scan(chunk string) []paramPathSegment {
+	if s.failed {
+		return s.leaf(nil, chunk)
+	}
+	base := s.dec.InputOffset()
+	events, err := s.dec.Feed([]byte(chunk))
+
+	var segs []paramPathSegment
+	// leafStart is the start in chunk of the array or object leaf being read
+	leafStart := 0
+	for _, ev := range events {
+		at := int(ev.Offset - base)
+		switch ev.Kind {
+		case orderedjson.BeginObject:
+			if s.depth == 0 {
+				s.objects++
+				continue
+			}
+			s.depth++
+		case orderedjson.BeginArray:
+			if s.depth == 0 {
+				leafStart = at
+			}
+			s.depth++
+		case orderedjson.EndObject, orderedjson.EndArray:
+			if s.depth == 0 {
+				s.objects--
+				s.path = s.path[:s.objects+1]
+				continue
+			}
+			s.depth--
+			if s.depth == 0 {
+				segs = s.leaf(segs, chunk[leafStart:at+1])
+			}
+		case orderedjson.Key:
+			if s.depth == 0 {
+				s.path = append(s.path[:s.objects], ev.Key)
+			}
+		case orderedjson.Value:
+			if s.depth == 0 {
+				segs = s.leaf(segs, string(ev.Raw))
+			}
+		}
+	}
+	if err != nil {
+		// Best effort, the value is reported from the first byte not read
+		s.failed = true
+		return s.leaf(segs, chunk[s.dec.InputOffset()-base:])
+	}
+	if s.depth > 0 {
+		segs = s.leaf(segs, chunk[leafStart:])
+	}
+	return segs
+}
+
+// leaf appends the text of the leaf at the current path to segs
+func (s *paramPathScanner) leaf(segs []paramPathSegment, text string) []paramPathSegment {
+	if text == "" {
+		return segs
+	}
+	return append(segs, paramPathSegment{path: append([]string(nil), s.path...), text: text})
+}
+
+// splitParamPaths replaces every parameter value delta in outputs with one delta per nested
+// field it covers, see WithNestedParamPaths
+func (f *SyncFilter) splitParamPaths(outputs []FilterOutput) []FilterOutput {
+	if !f.nestedParamPaths {
+		return outputs
+	}
+	res := outputs[:0:0]
+	for _, o := range outputs {
+		d := o.ToolCallDelta
+		if d == nil || d.ParamDelta == nil {
+			res = append(res, o)
+			continue
+		}
+		p := d.ParamDelta
+		if p.ValueDelta == "" {
+			// The name of a new parameter
+			if f.paramPaths == nil {
+				f.paramPaths = make(map[uint]*paramPathScanner)
+			}
+			f.paramPaths[d.Index] = newParamPathScanner(p.Name)
+			p.Path = []string{p.Name}
+			res = append(res, o)
+			continue
+		}
+		s, ok := f.paramPaths[d.Index]
+		if !ok {
+			res = append(res, o)
+			continue
+		}
+		segs := s.scan(p.ValueDelta)
+		if len(segs) == 0 {
+			// Only punctuation between the fields, the output is kept for its other content
+			delta := *d
+			delta.ParamDelta = nil
+			o.ToolCallDelta = &delta
+			res = append(res, o)
+			continue
+		}
+		for i, seg := range segs {
+			delta := *d
+			delta.ParamDelta = &FilterToolParameter{Name: p.Name, ValueDelta: seg.text, Path: seg.path}
+			out := o
+			out.ToolCallDelta = &delta
+			if i > 0 {
+				// The tokens are reported once, with the first segment
+				out.Logprobs = TokenIDsWithLogProb{}
+			}
+			res = append(res, out)
+		}
+	}
+	return res
+}
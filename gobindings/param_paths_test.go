@@ -0,0 +1,84 @@
+package gobindings
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParamPathScanner(t *testing.T) {
+	t.Parallel()
+
+	value := `{"date": {"start": "2024-01-01", "end": null}, "tags": ["a", {"b": 1}], "q": "x\"}", "n": -1.5e3}`
+	want := []paramPathSegment{
+		{path: []string{"filters", "date", "start"}, text: `"2024-01-01"`},
+		{path: []string{"filters", "date", "end"}, text: `null`},
+		{path: []string{"filters", "tags"}, text: `["a", {"b": 1}]`},
+		{path: []string{"filters", "q"}, text: `"x\"}"`},
+		{path: []string{"filters", "n"}, text: `-1.5e3`},
+	}
+
+	// Whole, then byte by byte with the segments of the same path merged
+	s := newParamPathScanner("filters")
+	require.Equal(t, want, s.scan(value))
+
+	s = newParamPathScanner("filters")
+	var got []paramPathSegment
+	for i := range len(value) {
+		for _, seg := range s.scan(value[i : i+1]) {
+			if n := len(got); n > 0 && slices.Equal(got[n-1].path, seg.path) {
+				got[n-1].text += seg.text
+				continue
+			}
+			got = append(got, seg)
+		}
+	}
+	require.Equal(t, want, got)
+
+	s = newParamPathScanner("city")
+	require.Equal(t, []paramPathSegment{{path: []string{"city"}, text: `"Rome"`}}, s.scan(`"Rome"`))
+
+	// Escaped keys are decoded, escaped backslashes end strings
+	s = newParamPathScanner("q")
+	require.Equal(t, []paramPathSegment{
+		{path: []string{"q", `a"b`}, text: `"x\\"`},
+		{path: []string{"q", "é"}, text: `[1, "]"]`},
+	}, s.scan(`{"a\"b": "x\\", "\u00e9": [1, "]"]}`))
+
+	// The rest of a value that is not valid JSON is reported at the last path
+	s = newParamPathScanner("q")
+	require.Equal(t, []paramPathSegment{
+		{path: []string{"q", "a"}, text: `1`},
+		{path: []string{"q", "a"}, text: `"b": 2}`},
+	}, s.scan(`{"a": 1 "b": 2}`))
+	require.Equal(t, []paramPathSegment{{path: []string{"q", "a"}, text: `]`}}, s.scan(`]`))
+}
+
+func TestSplitParamPaths(t *testing.T) {
+	t.Parallel()
+
+	f := &SyncFilter{nestedParamPaths: true}
+	param := func(value string, logprobs ...float32) FilterOutput {
+		return FilterOutput{
+			Logprobs:      TokenIDsWithLogProb{TokenIDs: make([]uint32, len(logprobs)), Logprobs: logprobs},
+			ToolCallDelta: &FilterToolCallDelta{ParamDelta: &FilterToolParameter{Name: "q", ValueDelta: value}},
+		}
+	}
+	out := f.splitParamPaths([]FilterOutput{
+		param(""),
+		param(`{"a": 1, "b": 2`, -1, -2),
+		param(`}`, -3),
+	})
+	require.Len(t, out, 4)
+
+	// The logprobs of a delta split in two are kept once
+	require.Equal(t, []string{"q", "a"}, out[1].ToolCallDelta.ParamDelta.Path)
+	require.Equal(t, []float32{-1, -2}, out[1].Logprobs.Logprobs)
+	require.Equal(t, []string{"q", "b"}, out[2].ToolCallDelta.ParamDelta.Path)
+	require.Empty(t, out[2].Logprobs.Logprobs)
+
+	// A delta without a field is kept, without ParamDelta
+	require.Nil(t, out[3].ToolCallDelta.ParamDelta)
+	require.Equal(t, []float32{-3}, out[3].Logprobs.Logprobs)
+}
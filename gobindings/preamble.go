@@ -0,0 +1,50 @@
+package gobindings
+
+// #include "melody.h"
+import "C"
+import "errors"
+
+// BuildPreamble builds the system preamble that RenderCMD3 renders at the start of the
+// prompt, without the special tokens around it. The blocks are assembled in the order of
+// the cmd3 template: safety instructions, model information, reasoning instructions, tool
+// use instructions, the default preamble and the developer preamble.
+//
+// The arguments are the fields of RenderCmd3Options with the same name. citationQuality
+// selects the tool use instructions of a prompt with tools or documents, nil leaves them
+// out. The tool use instructions end with the "Available Tools" introduction, the JSON
+// list of tool definitions that follows it in a rendered prompt is not included.
+func BuildPreamble(safetyMode *SafetyMode, citationQuality *CitationQuality, reasoningType *ReasoningType, devInstruction *string) (string, error) {
+	var a cAllocator
+	defer a.FreeAll()
+
+	var cOpts C.CPreambleOptions
+	if safetyMode != nil {
+		cOpts.safety_mode = safetyModeToC(*safetyMode)
+		cOpts.has_safety_mode = C.bool(true)
+	}
+	if citationQuality != nil {
+		cOpts.citation_quality = citationQualityToC(*citationQuality)
+		cOpts.has_citation_quality = C.bool(true)
+	}
+	if reasoningType != nil {
+		cOpts.reasoning_type = reasoningTypeToC(*reasoningType)
+		cOpts.has_reasoning_type = C.bool(true)
+	}
+	if devInstruction != nil {
+		cOpts.dev_instruction = a.CString(*devInstruction)
+	}
+
+	res := C.melody_build_preamble(&cOpts)
+	if res == nil {
+		return "", errors.New("melody_build_preamble returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.result != nil {
+		return C.GoString(res.result), nil
+	}
+	if res.error != nil {
+		return "", renderError(res)
+	}
+	return "", errors.New("melody_build_preamble returned neither result nor error")
+}
@@ -0,0 +1,55 @@
+package gobindings
+
+import (
+	"strings"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers"
+)
+
+// PrefixTokenizer encodes a response prefix and decodes the tokens of its vocabulary. It
+// is satisfied by *tokenizers.Tokenizer.
+type PrefixTokenizer interface {
+	EncodeWithOffsets(str string, addSpecialTokens bool) ([]uint32, []tokenizers.Offset)
+	Decode(tokenIDs []uint32, skipSpecialTokens bool) string
+	VocabSize() uint32
+}
+
+// HealedPrefix is a response prefix healed by HealPrefix
+type HealedPrefix struct {
+	// Prefix is the response prefix to render, without its last token
+	Prefix string `json:"prefix"`
+	// Healed is the text of the last token left out of Prefix, the completion starts with it
+	Healed string `json:"healed,omitempty"`
+	// Tokens are the tokens whose text starts with Healed, the first token of the
+	// completion should be constrained to them
+	Tokens []uint32 `json:"tokens,omitempty"`
+}
+
+// HealPrefix heals the last token of a response prefix. A prefix that ends mid-word, such
+// as "The weath", ends with a token the model would rarely produce there, so it continues
+// with odd tokens or repeats characters of the prefix. The healed prefix is rendered
+// without that token and the first token of the completion is constrained to the tokens
+// that start with its text, so the model picks the token it would have produced, e.g.
+// "weather". Pass the whole prefix to WithResponsePrefix and Healed to WithHealedPrefix so
+// the filter strips the repeated text from the completion.
+//
+// The tokens are found by decoding every token of the vocabulary on its own, which takes
+// a while for large vocabularies. A prefix without tokens is returned as is.
+func HealPrefix(prefix string, tokenizer PrefixTokenizer) HealedPrefix {
+	_, offsets := tokenizer.EncodeWithOffsets(prefix, false)
+	if len(offsets) == 0 {
+		return HealedPrefix{Prefix: prefix}
+	}
+	start := int(offsets[len(offsets)-1][0])
+	if start >= len(prefix) {
+		return HealedPrefix{Prefix: prefix}
+	}
+
+	healed := HealedPrefix{Prefix: prefix[:start], Healed: prefix[start:]}
+	for id := range tokenizer.VocabSize() {
+		if strings.HasPrefix(tokenizer.Decode([]uint32{id}, true), healed.Healed) {
+			healed.Tokens = append(healed.Tokens, id)
+		}
+	}
+	return healed
+}
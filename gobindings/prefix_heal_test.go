@@ -0,0 +1,39 @@
+package gobindings_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/tokenizers/tokenizertest"
+)
+
+func TestHealPrefix(t *testing.T) {
+	t.Parallel()
+
+	tk := tokenizertest.New()
+	require.Equal(t, melody.HealedPrefix{Prefix: "The weat", Healed: "h", Tokens: []uint32{'h'}}, melody.HealPrefix("The weath", tk))
+	require.Equal(t, melody.HealedPrefix{}, melody.HealPrefix("", tk))
+
+	collect := func(f melody.Filter, chunks ...string) string {
+		var sb strings.Builder
+		for _, chunk := range chunks {
+			out, err := f.WriteDecoded(chunk, nil)
+			require.NoError(t, err)
+			for _, o := range out {
+				sb.WriteString(o.Text)
+			}
+		}
+		return sb.String()
+	}
+	options := []melody.FilterOption{melody.HandleMultiHopCmd3(), melody.WithResponsePrefix("The weath"), melody.WithHealedPrefix("weath")}
+
+	// The healed text is stripped, also across tokens
+	require.Equal(t, "er is sunny", collect(melody.NewFilter(options...), "weather", " is sunny"))
+	require.Equal(t, "er is sunny", collect(melody.NewFilter(options...), "we", "ath", "er is sunny"))
+	// A completion that does not repeat it is kept
+	require.Equal(t, "er is sunny", collect(melody.NewFilter(options...), "er is sunny"))
+	require.Equal(t, "wet", collect(melody.NewFilter(options...), "we", "t"))
+}
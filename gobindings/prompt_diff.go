@@ -0,0 +1,201 @@
+package gobindings
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PromptSection is a structural section of a rendered Command 3 or Command 4 prompt
+type PromptSection string
+
+const (
+	// SectionPreamble is the system turn that opens the prompt, without the tool definitions
+	SectionPreamble PromptSection = "preamble"
+	// SectionTools is the list of available tools in the system turn
+	SectionTools PromptSection = "tools"
+	// SectionDocuments are the turns that inject the documents as results of the direct-injected-document tool
+	SectionDocuments PromptSection = "documents"
+	// SectionHistory are the remaining turns of the conversation
+	SectionHistory PromptSection = "history"
+	// SectionTrailing is the text after the last turn, e.g. the start of the chatbot turn and the response prefix
+	SectionTrailing PromptSection = "trailing"
+)
+
+// promptSections are the sections in the order they appear in a prompt
+var promptSections = []PromptSection{SectionPreamble, SectionTools, SectionDocuments, SectionHistory, SectionTrailing}
+
+const (
+	startOfTurnToken = "<|START_OF_TURN_TOKEN|>"
+	endOfTurnToken   = "<|END_OF_TURN_TOKEN|>"
+)
+
+// toolsHeadingRegex matches the "Available Tools" heading of the Command 3 and Command 4 system turns
+var toolsHeadingRegex = regexp.MustCompile(`(?m)^#{1,2} Available Tools$`)
+
+// SectionDiff is a section that differs between two rendered prompts
+type SectionDiff struct {
+	Section PromptSection
+	Before  string
+	After   string
+}
+
+// PromptDiff are the sections that differ between two rendered prompts, in prompt order
+type PromptDiff []SectionDiff
+
+// DiffRenders splits two rendered prompts into their sections and returns the sections
+// that differ, e.g. to check that a template upgrade only changes the expected sections
+func DiffRenders(a, b string) PromptDiff {
+	before := SplitPromptSections(a)
+	after := SplitPromptSections(b)
+
+	var diff PromptDiff
+	for _, s := range promptSections {
+		if before[s] != after[s] {
+			diff = append(diff, SectionDiff{Section: s, Before: before[s], After: after[s]})
+		}
+	}
+	return diff
+}
+
+// SplitPromptSections splits a rendered prompt into its sections. Text between turns,
+// such as <BOS_TOKEN>, belongs to the section of the turn that follows it.
+func SplitPromptSections(prompt string) map[PromptSection]string {
+	sections := make(map[PromptSection]*strings.Builder, len(promptSections))
+	for _, s := range promptSections {
+		sections[s] = &strings.Builder{}
+	}
+
+	rest := prompt
+	documentsResultNext := false
+	for i := 0; ; i++ {
+		start := strings.Index(rest, startOfTurnToken)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], endOfTurnToken)
+		if end < 0 {
+			break
+		}
+		end += start + len(endOfTurnToken)
+		gap, turn := rest[:start], rest[start:end]
+		rest = rest[end:]
+
+		switch {
+		case i == 0 && strings.HasPrefix(turn, startOfTurnToken+"<|SYSTEM_TOKEN|>"):
+			preamble, tools := splitTools(turn)
+			sections[SectionPreamble].WriteString(gap + preamble)
+			sections[SectionTools].WriteString(tools)
+		case strings.Contains(turn, `"tool_name": "direct-injected-document"`):
+			sections[SectionDocuments].WriteString(gap + turn)
+			documentsResultNext = true
+			continue
+		case documentsResultNext && strings.Contains(turn, "<|START_TOOL_RESULT|>"):
+			sections[SectionDocuments].WriteString(gap + turn)
+		default:
+			sections[SectionHistory].WriteString(gap + turn)
+		}
+		documentsResultNext = false
+	}
+	sections[SectionTrailing].WriteString(rest)
+
+	res := make(map[PromptSection]string, len(sections))
+	for s, sb := range sections {
+		res[s] = sb.String()
+	}
+	return res
+}
+
+// splitTools splits the tool definitions, from the "Available Tools" heading to the end of
+// the JSON code block that follows it, from the system turn
+func splitTools(turn string) (string, string) {
+	loc := toolsHeadingRegex.FindStringIndex(turn)
+	if loc == nil {
+		return turn, ""
+	}
+	end := len(turn)
+	if open := strings.Index(turn[loc[1]:], "```json"); open >= 0 {
+		open += loc[1] + len("```json")
+		if closing := strings.Index(turn[open:], "```"); closing >= 0 {
+			end = open + closing + len("```")
+		}
+	}
+	return turn[:loc[0]] + turn[end:], turn[loc[0]:end]
+}
+
+// Sections returns the sections that differ
+func (d PromptDiff) Sections() []PromptSection {
+	sections := make([]PromptSection, len(d))
+	for i, s := range d {
+		sections[i] = s.Section
+	}
+	return sections
+}
+
+// OnlyChanged returns an error describing every section that differs but is not allowed to
+func (d PromptDiff) OnlyChanged(allowed ...PromptSection) error {
+	var unexpected PromptDiff
+	for _, s := range d {
+		if !slices.Contains(allowed, s.Section) {
+			unexpected = append(unexpected, s)
+		}
+	}
+	if len(unexpected) == 0 {
+		return nil
+	}
+	return fmt.Errorf("unexpected prompt changes:\n%s", unexpected)
+}
+
+// String formats the diff as a line diff of every section that differs
+func (d PromptDiff) String() string {
+	var sb strings.Builder
+	for _, s := range d {
+		fmt.Fprintf(&sb, "--- %s\n+++ %s\n", s.Section, s.Section)
+		for _, line := range diffLines(strings.Split(s.Before, "\n"), strings.Split(s.After, "\n")) {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// diffLines returns the lines removed from a ("-") and added in b ("+") using the longest common subsequence
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
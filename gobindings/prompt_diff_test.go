@@ -0,0 +1,69 @@
+package gobindings
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitPromptSections(t *testing.T) {
+	t.Parallel()
+
+	prompt, err := os.ReadFile(filepath.Join("..", "tests", "templating", "cmd3", "one_hop_with_tools_and_documents_citation_quality_on", "output.txt"))
+	require.NoError(t, err)
+
+	sections := SplitPromptSections(string(prompt))
+	require.True(t, strings.HasPrefix(sections[SectionPreamble], "<BOS_TOKEN><|START_OF_TURN_TOKEN|><|SYSTEM_TOKEN|># System Preamble"))
+	require.NotContains(t, sections[SectionPreamble], "GetReminders")
+	require.True(t, strings.HasPrefix(sections[SectionTools], "## Available Tools"))
+	require.Contains(t, sections[SectionTools], "GetReminders")
+	require.Contains(t, sections[SectionDocuments], `"tool_name": "direct-injected-document"`)
+	require.Contains(t, sections[SectionDocuments], "<|START_TOOL_RESULT|>")
+	require.True(t, strings.HasPrefix(sections[SectionHistory], "<|START_OF_TURN_TOKEN|><|USER_TOKEN|>"))
+	require.Contains(t, sections[SectionHistory], "I will use the GetReminders tool")
+	require.Equal(t, "<|START_OF_TURN_TOKEN|><|CHATBOT_TOKEN|>", strings.TrimSpace(sections[SectionTrailing]))
+
+	var joined int
+	for _, s := range promptSections {
+		joined += len(sections[s])
+	}
+	require.Equal(t, len(prompt), joined)
+}
+
+func TestDiffRenders(t *testing.T) {
+	t.Parallel()
+
+	const before = "<BOS_TOKEN><|START_OF_TURN_TOKEN|><|SYSTEM_TOKEN|>Be helpful.\n\n# Available Tools\n```json\n[{\"name\": \"a\"}]\n```\nBe brief.<|END_OF_TURN_TOKEN|>" +
+		"<|START_OF_TURN_TOKEN|><|USER_TOKEN|>Hi<|END_OF_TURN_TOKEN|><|START_OF_TURN_TOKEN|><|CHATBOT_TOKEN|>"
+
+	t.Run("identical", func(t *testing.T) {
+		t.Parallel()
+		diff := DiffRenders(before, before)
+		require.Empty(t, diff)
+		require.NoError(t, diff.OnlyChanged())
+	})
+
+	t.Run("tools changed", func(t *testing.T) {
+		t.Parallel()
+		after := strings.Replace(before, `"name": "a"`, `"name": "b"`, 1)
+		diff := DiffRenders(before, after)
+		require.Equal(t, []PromptSection{SectionTools}, diff.Sections())
+		require.NoError(t, diff.OnlyChanged(SectionTools))
+		require.Contains(t, diff.String(), "-[{\"name\": \"a\"}]\n+[{\"name\": \"b\"}]\n")
+	})
+
+	t.Run("unexpected change", func(t *testing.T) {
+		t.Parallel()
+		after := strings.Replace(before, "Be brief.", "Be concise.", 1)
+		after = strings.Replace(after, "<|CHATBOT_TOKEN|>", "<|CHATBOT_TOKEN|><|START_RESPONSE|>", 1)
+		diff := DiffRenders(before, after)
+		require.Equal(t, []PromptSection{SectionPreamble, SectionTrailing}, diff.Sections())
+		err := diff.OnlyChanged(SectionTrailing)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "--- preamble")
+		require.NotContains(t, err.Error(), "--- trailing")
+	})
+}
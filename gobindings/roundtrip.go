@@ -0,0 +1,265 @@
+package gobindings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// RenderOpts are the options of a prompt that RoundTrip can render and parse the completion of.
+// It is implemented by RenderCmd3Options and RenderCmd4Options.
+type RenderOpts interface {
+	render() (string, error)
+	filterOptions() []FilterOption
+	promptContext() ([]Message, []orderedjson.Object, []Tool)
+}
+
+func (opts RenderCmd3Options) render() (string, error) { return RenderCMD3(opts) }
+
+func (opts RenderCmd3Options) filterOptions() []FilterOption {
+	return append([]FilterOption{HandleMultiHopCmd3()}, documentOrderOptions(opts.Documents, opts.NormalizeDocuments, opts.OrderDocuments)...)
+}
+
+func (opts RenderCmd3Options) promptContext() ([]Message, []orderedjson.Object, []Tool) {
+	docs, _ := renderedDocuments(opts.Documents, opts.NormalizeDocuments, opts.OrderDocuments)
+	return opts.Messages, docs, opts.AvailableTools
+}
+
+func (opts RenderCmd4Options) render() (string, error) { return RenderCMD4(opts) }
+
+func (opts RenderCmd4Options) filterOptions() []FilterOption {
+	return append([]FilterOption{HandleMultiHopCmd4()}, documentOrderOptions(opts.Documents, opts.NormalizeDocuments, opts.OrderDocuments)...)
+}
+
+func (opts RenderCmd4Options) promptContext() ([]Message, []orderedjson.Object, []Tool) {
+	docs, _ := renderedDocuments(opts.Documents, opts.NormalizeDocuments, opts.OrderDocuments)
+	return opts.Messages, docs, opts.AvailableTools
+}
+
+// ParsedResult is a rendered prompt together with the parsed completion of it
+type ParsedResult struct {
+	Prompt    string
+	Text      string
+	Reasoning string
+	Citations []FilterCitation
+	// ToolCalls are the complete tool calls of the completion, Parameters is the raw JSON
+	ToolCalls []ToolCall
+}
+
+// RoundTrip renders the prompt of opts, parses completion as the model's reply to it and
+// checks that the parsed output lines up with the prompt: every tool call must name an
+// available tool and have JSON parameters with the required fields of its schema, and
+// every citation must cite a document or tool result that is in the prompt.
+//
+// The parsed result is returned even if it does not line up with the prompt, the error
+// then lists every mismatch.
+func RoundTrip(opts RenderOpts, completion string) (ParsedResult, error) {
+	var res ParsedResult
+
+	prompt, err := opts.render()
+	if err != nil {
+		return res, fmt.Errorf("failed to render prompt: %w", err)
+	}
+	res.Prompt = prompt
+
+	if err := res.parse(completion, opts.filterOptions()...); err != nil {
+		return res, err
+	}
+
+	msgs, docs, tools := opts.promptContext()
+	return res, errors.Join(
+		validateToolCalls(res.ToolCalls, tools),
+		validateCitations(res.Citations, toolResultCounts(msgs, docs)),
+	)
+}
+
+var specialTokenRegex = regexp.MustCompile(`<\|[A-Za-z_]+\|>`)
+
+// splitSpecialTokens splits a completion into chunks so that every special token is a
+// chunk of its own, the way the completion is decoded when it is streamed
+func splitSpecialTokens(completion string) []string {
+	var chunks []string
+	last := 0
+	for _, loc := range specialTokenRegex.FindAllStringIndex(completion, -1) {
+		if loc[0] > last {
+			chunks = append(chunks, completion[last:loc[0]])
+		}
+		chunks = append(chunks, completion[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	if last < len(completion) {
+		chunks = append(chunks, completion[last:])
+	}
+	return chunks
+}
+
+// parse parses a complete completion with a filter created with options into the result
+func (r *ParsedResult) parse(completion string, options ...FilterOption) error {
+	f, err := TryNewFilter(options...)
+	if err != nil {
+		return fmt.Errorf("failed to create filter: %w", err)
+	}
+	var outputs []FilterOutput
+	for _, chunk := range splitSpecialTokens(completion) {
+		out, err := f.WriteDecoded(chunk, nil)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, out...)
+	}
+	out, err := f.FlushPartials()
+	if err != nil {
+		return err
+	}
+	c := CollectOutputs(append(outputs, out...))
+	r.Text, r.Reasoning, r.Citations, r.ToolCalls = c.Text, c.Reasoning, c.Citations, c.ToolCalls
+	return nil
+}
+
+// CollectedOutputs is the content of the filter outputs of a generation, see CollectOutputs
+type CollectedOutputs struct {
+	Text      string
+	Reasoning string
+	Citations []FilterCitation
+	// ToolCalls are the complete tool calls, Parameters is the raw JSON
+	ToolCalls []ToolCall
+	Logprobs  TokenIDsWithLogProb
+}
+
+// CollectOutputs accumulates the stream of filter outputs of a generation. Text and
+// reasoning are concatenated, tool call deltas are merged into complete tool calls with
+// the raw JSON of their parameters, and the citations and logprobs of every output are
+// concatenated. Echoed prompt tokens are skipped.
+func CollectOutputs(outputs []FilterOutput) CollectedOutputs {
+	var c CollectedOutputs
+	var text, reasoning strings.Builder
+	for _, o := range outputs {
+		if o.IsEcho {
+			continue
+		}
+		if o.IsReasoning {
+			reasoning.WriteString(o.Text)
+		} else {
+			text.WriteString(o.Text)
+		}
+		c.Citations = append(c.Citations, o.Citations...)
+		c.Logprobs.TokenIDs = append(c.Logprobs.TokenIDs, o.Logprobs.TokenIDs...)
+		c.Logprobs.Logprobs = append(c.Logprobs.Logprobs, o.Logprobs.Logprobs...)
+		c.Logprobs.TopLogProbs = append(c.Logprobs.TopLogProbs, o.Logprobs.TopLogProbs...)
+
+		if d := o.ToolCallDelta; d != nil {
+			for uint(len(c.ToolCalls)) <= d.Index {
+				c.ToolCalls = append(c.ToolCalls, ToolCall{})
+			}
+			tc := &c.ToolCalls[d.Index]
+			tc.ID += d.ID
+			tc.Name += d.Name
+			tc.Parameters += d.RawParamDelta
+		}
+	}
+	c.Text = text.String()
+	c.Reasoning = reasoning.String()
+	return c
+}
+
+// toolResultCounts returns the number of results of every tool call index a citation can
+// refer to, numbered the way the templates number them: the documents are tool call 0, if
+// there are any, followed by the tool calls of the conversation in the order of their results.
+func toolResultCounts(msgs []Message, docs []orderedjson.Object) []int {
+	var counts []int
+	if len(docs) > 0 {
+		counts = append(counts, len(docs))
+	}
+	indices := make(map[string]int)
+	for _, m := range msgs {
+		if m.Role != RoleTool {
+			continue
+		}
+		idx, ok := indices[m.ToolCallID]
+		if !ok {
+			idx = len(counts)
+			indices[m.ToolCallID] = idx
+			counts = append(counts, 0)
+		}
+		for _, c := range m.Content {
+			if c.Type == ContentText || c.Type == ContentDocument {
+				counts[idx]++
+			}
+		}
+	}
+	return counts
+}
+
+// validateCitations checks that every source of the citations is one of the tool results
+func validateCitations(citations []FilterCitation, counts []int) error {
+	var errs []error
+	for _, c := range citations {
+		for _, s := range c.Sources {
+			if s.ToolCallIndex >= uint(len(counts)) {
+				errs = append(errs, fmt.Errorf("citation %q cites unknown tool call %d", c.Text, s.ToolCallIndex))
+				continue
+			}
+			for _, idx := range s.ToolResultIndices {
+				if idx >= uint(counts[s.ToolCallIndex]) {
+					errs = append(errs, fmt.Errorf("citation %q cites unknown result %d of tool call %d", c.Text, idx, s.ToolCallIndex))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateToolCalls checks that every tool call names one of the tools and has the required parameters
+func validateToolCalls(calls []ToolCall, tools []Tool) error {
+	byName := make(map[string]Tool, len(tools))
+	for _, t := range tools {
+		byName[t.Name] = t
+	}
+
+	var errs []error
+	for i, tc := range calls {
+		tool, ok := byName[tc.Name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("tool call %d calls unknown tool %q", i, tc.Name))
+			continue
+		}
+		params := map[string]json.RawMessage{}
+		if strings.TrimSpace(tc.Parameters) != "" {
+			if err := json.Unmarshal([]byte(tc.Parameters), &params); err != nil {
+				errs = append(errs, fmt.Errorf("tool call %d has invalid parameters: %w", i, err))
+				continue
+			}
+		}
+		for _, name := range requiredParameters(tool) {
+			if _, ok := params[name]; !ok {
+				errs = append(errs, fmt.Errorf("tool call %d to %q is missing required parameter %q", i, tc.Name, name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requiredParameters returns the required parameters of a tool's JSON schema
+func requiredParameters(t Tool) []string {
+	v, ok := t.Parameters.Get("required")
+	if !ok {
+		return nil
+	}
+	switch required := v.(type) {
+	case []string:
+		return required
+	case []any:
+		var names []string
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
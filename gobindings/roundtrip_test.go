@@ -0,0 +1,111 @@
+package gobindings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	opts := RenderCmd3Options{
+		Messages: []Message{
+			{Role: RoleUser, Content: []Content{{Type: ContentText, Text: "What is the weather in Paris?"}}},
+			{
+				Role:      RoleChatbot,
+				ToolCalls: []ToolCall{{ID: "call_0", Name: "get_weather", Parameters: `{"city": "Paris"}`}},
+			},
+			{
+				Role:       RoleTool,
+				ToolCallID: "call_0",
+				Content:    []Content{{Type: ContentText, Text: "sunny"}, {Type: ContentText, Text: "25C"}},
+			},
+		},
+		Documents: []orderedjson.Object{
+			orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{Key: "content", Value: "Paris is in France"})),
+		},
+		AvailableTools: []Tool{{
+			Name: "get_weather",
+			Parameters: orderedjson.New(orderedjson.WithInitialData(
+				orderedjson.Pair{Key: "type", Value: "object"},
+				orderedjson.Pair{Key: "required", Value: []string{"city"}},
+			)),
+		}},
+	}
+
+	tests := []struct {
+		name       string
+		completion string
+		wantText   string
+		wantCalls  []ToolCall
+		wantErrs   []string
+	}{
+		{
+			name:       "grounded answer",
+			completion: "<|START_RESPONSE|>It is <co>sunny</co: 1:[0]> in <co>Paris</co: 0:[0]>.<|END_RESPONSE|>",
+			wantText:   "It is sunny in Paris.",
+		},
+		{
+			name:       "unknown sources",
+			completion: "<|START_RESPONSE|>It is <co>sunny</co: 1:[2],2:[0]>.<|END_RESPONSE|>",
+			wantText:   "It is sunny.",
+			wantErrs: []string{
+				`citation "sunny" cites unknown result 2 of tool call 1`,
+				`citation "sunny" cites unknown tool call 2`,
+			},
+		},
+		{
+			name:       "tool calls",
+			completion: `<|START_ACTION|>[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome"}}, {"tool_call_id": "1", "tool_name": "get_weather", "parameters": {"town": "Oslo"}}, {"tool_call_id": "2", "tool_name": "get_time", "parameters": {"tz": "CET"}}]<|END_ACTION|>`,
+			wantCalls: []ToolCall{
+				{ID: "0", Name: "get_weather", Parameters: `{"city": "Rome"}`},
+				{ID: "1", Name: "get_weather", Parameters: `{"town": "Oslo"}`},
+				{ID: "2", Name: "get_time", Parameters: `{"tz": "CET"}`},
+			},
+			wantErrs: []string{
+				`tool call 1 to "get_weather" is missing required parameter "city"`,
+				`tool call 2 calls unknown tool "get_time"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			res, err := RoundTrip(opts, tt.completion)
+			require.Equal(t, tt.wantText, res.Text)
+			require.Equal(t, tt.wantCalls, res.ToolCalls)
+			if len(tt.wantErrs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			for _, want := range tt.wantErrs {
+				require.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
+
+func TestCollectOutputs(t *testing.T) {
+	t.Parallel()
+
+	c := CollectOutputs([]FilterOutput{
+		{Text: "prompt", IsEcho: true, Logprobs: TokenIDsWithLogProb{TokenIDs: []uint32{1}, Logprobs: []float32{0}}},
+		{Text: "I will ", IsReasoning: true},
+		{Text: "check.", IsReasoning: true, Logprobs: TokenIDsWithLogProb{TokenIDs: []uint32{2}, Logprobs: []float32{-0.5}}},
+		{ToolCallDelta: &FilterToolCallDelta{Index: 0, ID: "call_0", Name: "get_weather"}},
+		{ToolCallDelta: &FilterToolCallDelta{Index: 0, RawParamDelta: `{"city": `}},
+		{ToolCallDelta: &FilterToolCallDelta{Index: 0, RawParamDelta: `"Rome"}`}},
+		{Text: "Sunny", Citations: []FilterCitation{{Text: "Sunny"}}},
+	})
+	require.Equal(t, CollectedOutputs{
+		Text:      "Sunny",
+		Reasoning: "I will check.",
+		Citations: []FilterCitation{{Text: "Sunny"}},
+		ToolCalls: []ToolCall{{ID: "call_0", Name: "get_weather", Parameters: `{"city": "Rome"}`}},
+		Logprobs:  TokenIDsWithLogProb{TokenIDs: []uint32{2}, Logprobs: []float32{-0.5}},
+	}, c)
+}
@@ -0,0 +1,115 @@
+package gobindings
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// Sanitizer scans the text of the tool results and documents of a prompt before it is
+// rendered, e.g. for instructions injected into a web page a tool fetched. Sanitize is
+// called with the path of every text, such as "documents[0].snippet" or
+// "messages[3].content[0].text", and returns the text to render in its place, the text
+// itself to leave it unchanged, with the findings about it.
+type Sanitizer interface {
+	Sanitize(field, text string) (string, []Finding)
+}
+
+// SanitizerFunc adapts a function to a Sanitizer
+type SanitizerFunc func(field, text string) (string, []Finding)
+
+func (f SanitizerFunc) Sanitize(field, text string) (string, []Finding) { return f(field, text) }
+
+// Finding is something a Sanitizer found in the text of a field
+type Finding struct {
+	// Field is the path of the field, set by the render
+	Field string `json:"field"`
+	// Rule names what was found, e.g. "instruction_override"
+	Rule string `json:"rule"`
+	// Start and End are the byte offsets of what was found in the text passed to Sanitize
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Redacted is whether the text returned by Sanitize leaves it out
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// sanitizePrompt returns the messages and documents with their tool results and document
+// fields sanitized by s, with the findings in the order of the fields. The messages and
+// documents passed in are not modified.
+func sanitizePrompt(s Sanitizer, msgs []Message, docs []orderedjson.Object) ([]Message, []orderedjson.Object, []Finding) {
+	if s == nil {
+		return msgs, docs, nil
+	}
+	var findings []Finding
+	sanitize := func(field, text string) string {
+		text, found := s.Sanitize(field, text)
+		for _, f := range found {
+			f.Field = field
+			findings = append(findings, f)
+		}
+		return text
+	}
+
+	sanitizedDocs := make([]orderedjson.Object, len(docs))
+	for i, doc := range docs {
+		sanitizedDocs[i] = sanitizeDocument("documents["+strconv.Itoa(i)+"]", doc, sanitize)
+	}
+
+	sanitizedMsgs := make([]Message, len(msgs))
+	for i, m := range msgs {
+		sanitizedMsgs[i] = m
+		if m.Role != RoleTool {
+			continue
+		}
+		sanitizedMsgs[i].Content = make([]Content, len(m.Content))
+		for j, c := range m.Content {
+			path := "messages[" + strconv.Itoa(i) + "].content[" + strconv.Itoa(j) + "]"
+			switch c.Type {
+			case ContentText:
+				c.Text = sanitize(path+".text", c.Text)
+			case ContentDocument:
+				c.Document = sanitizeDocument(path+".document", c.Document, sanitize)
+			}
+			sanitizedMsgs[i].Content[j] = c
+		}
+	}
+	return sanitizedMsgs, sanitizedDocs, findings
+}
+
+// sanitizeDocument returns a copy of doc with its string fields, nested ones included,
+// passed through sanitize
+func sanitizeDocument(path string, doc orderedjson.Object, sanitize func(field, text string) string) orderedjson.Object {
+	out := orderedjson.New()
+	for _, key := range doc.Keys() {
+		value, _ := doc.Get(key)
+		out.Set(key, sanitizeValue(path+"."+key, value, sanitize))
+	}
+	return out
+}
+
+// sanitizeValue returns a copy of a JSON value with its strings, those of nested objects
+// and arrays included, passed through sanitize. Array elements have paths like "field[i]".
+func sanitizeValue(path string, value any, sanitize func(field, text string) string) any {
+	switch v := value.(type) {
+	case string:
+		return sanitize(path, v)
+	case orderedjson.Object:
+		return sanitizeDocument(path, v, sanitize)
+	case []any:
+		out := make([]any, len(v))
+		for i, elem := range v {
+			out[i] = sanitizeValue(path+"["+strconv.Itoa(i)+"]", elem, sanitize)
+		}
+		return out
+	case map[string]any:
+		// The objects of arrays decode to maps, their keys are visited sorted
+		out := make(map[string]any, len(v))
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			out[key] = sanitizeValue(path+"."+key, v[key], sanitize)
+		}
+		return out
+	}
+	return value
+}
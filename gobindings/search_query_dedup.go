@@ -0,0 +1,122 @@
+package gobindings
+
+import (
+	"slices"
+	"strings"
+)
+
+// searchQueryDedup follows the search queries emitted, holding back the query being read
+// while it may repeat one of them, see WithSearchQueryDedup
+type searchQueryDedup struct {
+	// Seen are the normalized texts of the queries read
+	Seen []string `json:"seen,omitempty"`
+	// Reading is set once a query is read, Index is the index of the query being read and
+	// Text its text so far
+	Reading bool   `json:"reading,omitempty"`
+	Index   uint   `json:"index,omitempty"`
+	Text    string `json:"text,omitempty"`
+	// Held are the outputs of the query being read held back, until it differs from every
+	// query read or it ends. Released is set once they are emitted.
+	Held     []FilterOutput `json:"held,omitempty"`
+	Released bool           `json:"released,omitempty"`
+	// Dropped is the number of queries dropped, which the indices of later queries skip
+	Dropped uint `json:"dropped,omitempty"`
+}
+
+// clone returns a copy of d that reads on independently
+func (d searchQueryDedup) clone() searchQueryDedup {
+	// The queries and outputs are only appended to, clipped slices keep those read so far
+	d.Seen, d.Held = slices.Clip(d.Seen), slices.Clip(d.Held)
+	return d
+}
+
+// normalizeSearchQuery returns the text of a query trimmed, case-folded and with its runs
+// of whitespace collapsed to a space
+func normalizeSearchQuery(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// read reads an output with a search query delta and returns the outputs to emit
+func (d *searchQueryDedup) read(o FilterOutput) []FilterOutput {
+	var out []FilterOutput
+	if !d.Reading || o.SearchQuery.Index != d.Index {
+		out = d.end()
+		d.Reading, d.Index = true, o.SearchQuery.Index
+	}
+	d.Text += o.SearchQuery.Text
+	if d.Released {
+		return append(out, d.renumber(o))
+	}
+
+	d.Held = append(d.Held, o)
+	text := normalizeSearchQuery(d.Text)
+	if slices.ContainsFunc(d.Seen, func(seen string) bool { return strings.HasPrefix(seen, text) }) {
+		return out
+	}
+	return append(out, d.release()...)
+}
+
+// end ends the query being read: it is dropped if it repeats a query read, and its held
+// outputs are returned otherwise
+func (d *searchQueryDedup) end() []FilterOutput {
+	if !d.Reading {
+		return nil
+	}
+	var out []FilterOutput
+	text := normalizeSearchQuery(d.Text)
+	switch {
+	case d.Released:
+		d.Seen = append(d.Seen, text)
+	case slices.Contains(d.Seen, text):
+		d.Dropped++
+	default:
+		out = d.release()
+		d.Seen = append(d.Seen, text)
+	}
+	d.Reading, d.Index, d.Text, d.Held, d.Released = false, 0, "", nil, false
+	return out
+}
+
+// release returns the held outputs of the query being read, whose later outputs are no
+// longer held back
+func (d *searchQueryDedup) release() []FilterOutput {
+	out := make([]FilterOutput, len(d.Held))
+	for i, o := range d.Held {
+		out[i] = d.renumber(o)
+	}
+	d.Held, d.Released = nil, true
+	return out
+}
+
+// renumber returns o with the index of its query skipping the queries dropped
+func (d *searchQueryDedup) renumber(o FilterOutput) FilterOutput {
+	q := *o.SearchQuery
+	q.Index -= d.Dropped
+	o.SearchQuery = &q
+	return o
+}
+
+// dedupSearchQueries drops the search queries repeating an earlier query of the stream once
+// normalized, see WithSearchQueryDedup
+func (f *SyncFilter) dedupSearchQueries(outputs []FilterOutput) []FilterOutput {
+	if !f.searchQueryDedup {
+		return outputs
+	}
+	var out []FilterOutput
+	for _, o := range outputs {
+		if o.SearchQuery == nil {
+			out = append(out, o)
+			continue
+		}
+		out = append(out, f.searchQueries.read(o)...)
+	}
+	return out
+}
+
+// endSearchQueries ends the search query being read at the flush, see WithSearchQueryDedup
+func (f *SyncFilter) endSearchQueries(outputs []FilterOutput) []FilterOutput {
+	if !f.searchQueryDedup {
+		return outputs
+	}
+	return append(outputs, f.searchQueries.end()...)
+}
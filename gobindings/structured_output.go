@@ -0,0 +1,51 @@
+package gobindings
+
+// #include <stdlib.h>
+// #include "melody.h"
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+// StructuredOutputMode is the kind of structured output a prompt asks the model for
+type StructuredOutputMode int32
+
+const (
+	// StructuredOutputJSONObject asks for any JSON object, without a schema
+	StructuredOutputJSONObject StructuredOutputMode = 0
+	// StructuredOutputJSONSchema asks for a JSON object that adheres to a schema
+	StructuredOutputJSONSchema StructuredOutputMode = 1
+)
+
+// BuildStructuredOutputSection builds the structured output section of a prompt: the
+// instructions that RenderCMD3 and RenderCMD4 render with JSONMode, followed by the schema
+// with StructuredOutputJSONSchema. The schema is validated and minified, so prompts do not
+// depend on its whitespace.
+//
+// Only the keywords the models are trained to follow are accepted: type, properties,
+// required, additionalProperties, items, enum, const, anyOf, format, pattern, references
+// with $ref, $defs and definitions, and annotations such as title and description. It
+// returns an error for a schema with other keywords, e.g. minimum or oneOf, for a schema
+// with StructuredOutputJSONObject and for none with StructuredOutputJSONSchema.
+func BuildStructuredOutputSection(schema string, mode StructuredOutputMode) (string, error) {
+	var cSchema *C.char
+	if schema != "" {
+		cSchema = C.CString(schema)
+		defer C.free(unsafe.Pointer(cSchema))
+	}
+
+	res := C.melody_build_structured_output_section(cSchema, C.CStructuredOutputMode(mode))
+	if res == nil {
+		return "", errors.New("melody_build_structured_output_section returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.result != nil {
+		return C.GoString(res.result), nil
+	}
+	if res.error != nil {
+		return "", renderError(res)
+	}
+	return "", errors.New("melody_build_structured_output_section returned neither result nor error")
+}
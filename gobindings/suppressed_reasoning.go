@@ -0,0 +1,39 @@
+package gobindings
+
+// countReasoningToken counts a token written in a thinking block of a filter created
+// WithSuppressedReasoning, given the mode before it was written. The special tokens
+// starting and ending the block switch the mode and are not counted.
+func (f *SyncFilter) countReasoningToken(before FilterMode) {
+	if before == FilterModeToolReason && f.CurrentMode() == FilterModeToolReason {
+		f.reasoningTokens++
+	}
+}
+
+// suppressReasoning drops the outputs of the reasoning of a filter created
+// WithSuppressedReasoning. It runs after the citations are scored and validated, which
+// follow the text of the thinking blocks.
+func (f *SyncFilter) suppressReasoning(outputs []FilterOutput) []FilterOutput {
+	if !f.suppressedReasoning {
+		return outputs
+	}
+	kept := outputs[:0]
+	for _, o := range outputs {
+		if !o.IsReasoning {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// reportReasoningTokens sets the number of reasoning tokens on the last output of the
+// flush, appending an output if there is none
+func (f *SyncFilter) reportReasoningTokens(outputs []FilterOutput) []FilterOutput {
+	if !f.suppressedReasoning || f.reasoningTokens == 0 {
+		return outputs
+	}
+	if len(outputs) == 0 {
+		outputs = append(outputs, FilterOutput{})
+	}
+	outputs[len(outputs)-1].ReasoningTokens = f.reasoningTokens
+	return outputs
+}
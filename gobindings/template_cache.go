@@ -0,0 +1,37 @@
+package gobindings
+
+// #include "melody.h"
+import "C"
+
+// TemplateCacheStats are the counters and size of the compiled template cache
+type TemplateCacheStats struct {
+	// Hits is the number of renders whose template was found in the cache
+	Hits uint64
+	// Misses is the number of renders whose template was parsed
+	Misses uint64
+	// Evictions is the number of templates evicted from the cache
+	Evictions uint64
+	// Len is the number of templates in the cache
+	Len int
+	// Capacity is the maximum number of templates in the cache
+	Capacity int
+}
+
+// SetTemplateCacheCapacity sets the maximum number of compiled templates kept by the
+// template cache used by RenderCMD3 and RenderCMD4. Least recently used templates are
+// evicted when the cache is full. A capacity of 0 disables caching.
+func SetTemplateCacheCapacity(capacity int) {
+	C.melody_template_cache_set_capacity(C.size_t(max(capacity, 0)))
+}
+
+// ReadTemplateCacheStats returns the counters and size of the template cache, e.g. to export them as metrics
+func ReadTemplateCacheStats() TemplateCacheStats {
+	s := C.melody_template_cache_stats()
+	return TemplateCacheStats{
+		Hits:      uint64(s.hits),
+		Misses:    uint64(s.misses),
+		Evictions: uint64(s.evictions),
+		Len:       int(s.len),
+		Capacity:  int(s.capacity),
+	}
+}
@@ -0,0 +1,182 @@
+package gobindings
+
+// #include <stdlib.h>
+// #include "melody.h"
+//
+// extern char* melodyTemplateCallback(uintptr_t handle, char* input_json, char* args_json, char** error);
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+var (
+	templateFuncsMu sync.RWMutex
+	// templateFuncs holds the registered filters and tags, the handle passed to Rust is the index
+	templateFuncs []templateFunc
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterTemplateFilter adds a custom Liquid filter to the template engine used by
+// RenderCMD3 and RenderCMD4, e.g. {{ input | name: arg1, arg2 }}.
+//
+// fn must be a function whose first parameter is the filter input and whose remaining
+// parameters are the filter arguments, returning a value or a value and an error. The
+// input and arguments are converted to the parameter types through JSON and the result is
+// converted back the same way. A filter registered with the name of an existing custom
+// filter replaces it. Filters should be registered before templates are rendered.
+func RegisterTemplateFilter(name string, fn any) error {
+	return registerTemplateFunc(name, fn, true)
+}
+
+// RegisterTemplateTag adds a custom Liquid tag to the template engine used by RenderCMD3
+// and RenderCMD4, e.g. {% name arg1 arg2 %}.
+//
+// fn must be a function of the tag arguments returning a value or a value and an error,
+// converted the same way as for RegisterTemplateFilter. A string result is rendered as is
+// and any other result as JSON. Tags should be registered before templates are rendered.
+func RegisterTemplateTag(name string, fn any) error {
+	return registerTemplateFunc(name, fn, false)
+}
+
+// RegisterTemplatePartial adds a named partial to the template engine used by RenderCMD3
+// and RenderCMD4, rendered in place of {% include 'name' %} with the variables of the
+// including template. Template variants, e.g. with a preamble per safety mode, share
+// their common parts as partials instead of copies.
+//
+// A partial registered with the name of an existing partial replaces it. It returns an
+// error if body cannot be parsed. Partials should be registered before templates are
+// rendered.
+func RegisterTemplatePartial(name, body string) error {
+	if name == "" {
+		return errors.New("template partial name must not be empty")
+	}
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	cBody := C.CString(body)
+	defer C.free(unsafe.Pointer(cBody))
+
+	res := C.melody_template_register_partial(cName, cBody)
+	if res == nil {
+		return errors.New("melody_template_register_partial returned null result struct")
+	}
+	defer C.melody_render_result_free(res)
+
+	if res.error != nil {
+		return renderError(res)
+	}
+	return nil
+}
+
+func registerTemplateFunc(name string, fn any, isFilter bool) error {
+	if name == "" {
+		return errors.New("template function name must not be empty")
+	}
+	tf, err := newTemplateFunc(fn, isFilter)
+	if err != nil {
+		return err
+	}
+
+	templateFuncsMu.Lock()
+	handle := C.uintptr_t(len(templateFuncs))
+	templateFuncs = append(templateFuncs, tf)
+	templateFuncsMu.Unlock()
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	if isFilter {
+		C.melody_template_register_filter(cName, C.CTemplateCallback(C.melodyTemplateCallback), handle)
+	} else {
+		C.melody_template_register_tag(cName, C.CTemplateCallback(C.melodyTemplateCallback), handle)
+	}
+	return nil
+}
+
+// templateFunc is a registered filter or tag function
+type templateFunc struct {
+	fn reflect.Value
+	// hasInput is true for filters, whose first parameter is the filter input
+	hasInput bool
+}
+
+func newTemplateFunc(fn any, hasInput bool) (templateFunc, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return templateFunc{}, fmt.Errorf("template function must be a func, got %T", fn)
+	}
+	t := v.Type()
+	if hasInput && t.NumIn() == 0 {
+		return templateFunc{}, errors.New("template filter must take the filter input as its first parameter")
+	}
+	if t.NumOut() == 0 || t.NumOut() > 2 || (t.NumOut() == 2 && t.Out(1) != errorType) {
+		return templateFunc{}, errors.New("template function must return a value or a value and an error")
+	}
+	return templateFunc{fn: v, hasInput: hasInput}, nil
+}
+
+// call decodes the JSON input and arguments, calls the function and encodes its result as JSON
+func (tf templateFunc) call(inputJSON, argsJSON string) (string, error) {
+	var params []json.RawMessage
+	if err := json.Unmarshal([]byte(argsJSON), &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if tf.hasInput {
+		params = append([]json.RawMessage{json.RawMessage(inputJSON)}, params...)
+	}
+
+	t := tf.fn.Type()
+	if (t.IsVariadic() && len(params) < t.NumIn()-1) || (!t.IsVariadic() && len(params) != t.NumIn()) {
+		return "", fmt.Errorf("expected %d arguments, got %d", t.NumIn(), len(params))
+	}
+
+	in := make([]reflect.Value, len(params))
+	for i, p := range params {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= t.NumIn()-1 {
+			pt = t.In(t.NumIn() - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		v := reflect.New(pt)
+		if err := json.Unmarshal(p, v.Interface()); err != nil {
+			return "", fmt.Errorf("invalid argument %d: %w", i, err)
+		}
+		in[i] = v.Elem()
+	}
+
+	out := tf.fn.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return "", out[1].Interface().(error)
+	}
+	res, err := json.Marshal(out[0].Interface())
+	if err != nil {
+		return "", fmt.Errorf("invalid result: %w", err)
+	}
+	return string(res), nil
+}
+
+//export melodyTemplateCallback
+func melodyTemplateCallback(handle C.uintptr_t, inputJSON *C.char, argsJSON *C.char, errOut **C.char) (res *C.char) {
+	defer func() {
+		if r := recover(); r != nil {
+			*errOut = C.CString(fmt.Sprintf("Go panic: %v", r))
+			res = nil
+		}
+	}()
+
+	templateFuncsMu.RLock()
+	tf := templateFuncs[handle]
+	templateFuncsMu.RUnlock()
+
+	out, err := tf.call(C.GoString(inputJSON), C.GoString(argsJSON))
+	if err != nil {
+		*errOut = C.CString(err.Error())
+		return nil
+	}
+	return C.CString(out)
+}
@@ -2,12 +2,17 @@ package gobindings
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
 )
 
 type templateTest struct {
@@ -82,3 +87,199 @@ func TestTemplating_RenderCMD4_DirCases(t *testing.T) {
 		})
 	}
 }
+
+func TestTemplating_BuildPreamble_DirCases(t *testing.T) {
+	t.Parallel()
+	defaultTemplate := RenderCmd3Options{}.Template
+	for _, tc := range readTemplatingTestCases(t, "cmd3") {
+		var opts RenderCmd3Options
+		require.NoError(t, json.Unmarshal(tc.input, &opts))
+		if opts.SkipPreamble || opts.JSONMode || opts.Template != defaultTemplate {
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			citationQuality := opts.CitationQuality
+			if len(opts.AvailableTools) == 0 && len(opts.Documents) == 0 {
+				citationQuality = nil
+			} else if citationQuality == nil {
+				on := CitationQualityOn
+				citationQuality = &on
+			}
+
+			// the system turn without the JSON list of tool definitions
+			turn := strings.TrimPrefix(tc.output, "<BOS_TOKEN><|START_OF_TURN_TOKEN|><|SYSTEM_TOKEN|>")
+			turn, _, _ = strings.Cut(turn, "<|END_OF_TURN_TOKEN|>")
+			if before, rest, ok := strings.Cut(turn, "\n\n```json\n"); ok {
+				_, after, _ := strings.Cut(rest, "\n```\n")
+				turn = before + "\n" + after
+			}
+
+			got, err := BuildPreamble(opts.SafetyMode, citationQuality, opts.ReasoningType, opts.DevInstruction)
+			require.NoError(t, err)
+			require.Equal(t, turn, got)
+		})
+	}
+}
+
+func TestTemplating_BuildStructuredOutputSection(t *testing.T) {
+	t.Parallel()
+
+	got, err := BuildStructuredOutputSection("", StructuredOutputJSONObject)
+	require.NoError(t, err)
+	require.Equal(t, "When generating JSON objects, do not generate block markers. Generate an object directly without prefixing with ```json. Return only the JSON and nothing else.", got)
+
+	got, err = BuildStructuredOutputSection("{\n  \"type\": \"object\",\n  \"required\": [\"city\"]\n}", StructuredOutputJSONSchema)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(got, "Your output should adhere to the following json schema:\n{\"type\":\"object\",\"required\":[\"city\"]}"), got)
+
+	_, err = BuildStructuredOutputSection(`{"properties": {"age": {"minimum": 0}}}`, StructuredOutputJSONSchema)
+	require.ErrorContains(t, err, "unsupported json schema keyword 'minimum' at #/properties/age")
+	_, err = BuildStructuredOutputSection("", StructuredOutputJSONSchema)
+	require.Error(t, err)
+}
+
+func TestTemplating_RenderFIM(t *testing.T) {
+	t.Parallel()
+
+	got, err := RenderFIM("a = ", "\nprint(a)", RenderFIMOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "<BOS_TOKEN><|BEGINNING_OF_PREFIX_FIM_TOKEN|>a = <|BEGINNING_OF_SUFFIX_FIM_TOKEN|>\nprint(a)<|BEGINNING_OF_MIDDLE_FIM_TOKEN|>", got)
+
+	got, err = RenderFIM("<MID>", "", RenderFIMOptions{
+		Family:               FIMFamilyCodeLlama,
+		EscapedSpecialTokens: map[string]string{"<MID>": "<mid>"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "<PRE> <mid> <SUF> <MID>", got)
+}
+
+func TestTemplating_RenderErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := RenderCMD3(RenderCmd3Options{Messages: []Message{{
+		Role:      RoleChatbot,
+		ToolCalls: []ToolCall{{Name: "search", Parameters: "{}"}},
+	}}})
+	require.ErrorIs(t, err, ErrInvalidMessages)
+	require.NotErrorIs(t, err, ErrTemplateSyntax)
+	var melodyErr *Error
+	require.ErrorAs(t, err, &melodyErr)
+	require.Equal(t, ErrorKindInvalidMessages, melodyErr.Kind)
+	require.EqualError(t, err, "Template validation error: message[0] has tool call with empty id")
+
+	_, err = RestoreFilter([]byte(`{"version": 1, "parser": {"version": 2}}`))
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestTemplateFunc_Call(t *testing.T) {
+	t.Parallel()
+
+	join, err := newTemplateFunc(func(input string, sep string, parts ...int) string {
+		return fmt.Sprint(input, sep, parts)
+	}, true)
+	require.NoError(t, err)
+	out, err := join.call(`"a"`, `["-", 1, 2]`)
+	require.NoError(t, err)
+	require.Equal(t, `"a-[1 2]"`, out)
+
+	_, err = join.call(`"a"`, `[]`)
+	require.ErrorContains(t, err, "expected 3 arguments, got 1")
+	_, err = join.call(`"a"`, `[1]`)
+	require.ErrorContains(t, err, "invalid argument 1")
+
+	failing, err := newTemplateFunc(func() (int, error) { return 0, errors.New("boom") }, false)
+	require.NoError(t, err)
+	_, err = failing.call("null", "[]")
+	require.EqualError(t, err, "boom")
+
+	_, err = newTemplateFunc("not a func", false)
+	require.Error(t, err)
+	_, err = newTemplateFunc(func() {}, false)
+	require.Error(t, err)
+	_, err = newTemplateFunc(func() string { return "" }, true)
+	require.Error(t, err)
+}
+
+func TestTemplating_RegisterFilterAndTag(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, RegisterTemplateFilter("test_go_shout", func(s string, suffix string) string {
+		return strings.ToUpper(s) + suffix
+	}))
+	require.NoError(t, RegisterTemplateTag("test_go_sep", func(n int) string {
+		return strings.Repeat("-", n)
+	}))
+
+	got, err := RenderCMD3(RenderCmd3Options{Template: "{{ 'hi' | test_go_shout: '!' }} {% test_go_sep 3 %}"})
+	require.NoError(t, err)
+	require.Equal(t, "HI! ---", got)
+}
+
+func TestTemplating_RegisterPartial(t *testing.T) {
+	require.NoError(t, RegisterTemplatePartial("test_go_greeting", "Hello {{ name }}!"))
+	require.Error(t, RegisterTemplatePartial("", "body"))
+
+	got, err := RenderCMD3(RenderCmd3Options{
+		Template:                 "{% include 'test_go_greeting' %} Bye.",
+		AdditionalTemplateFields: map[string]any{"name": "Ada"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Hello Ada! Bye.", got)
+}
+
+func TestTemplating_DeterministicRender(t *testing.T) {
+	t.Parallel()
+
+	fields := map[string]any{}
+	for i := range 20 {
+		fields[fmt.Sprintf("field_%d", i)] = map[string]any{"b": i, "a": []any{i, "x"}}
+	}
+	params := orderedjson.New()
+	for _, name := range []string{"zone", "city", "units", "date"} {
+		params.Set(name, map[string]any{"type": "string"})
+	}
+	opts := RenderCmd3Options{
+		Messages: []Message{
+			{Role: RoleUser, Content: []Content{{Type: ContentText, Text: "Weather?"}}},
+			{
+				Role:    RoleChatbot,
+				Content: []Content{{Type: ContentText, Text: "It is sunny."}},
+				Citations: []FilterCitation{{
+					StartIndex: 6,
+					EndIndex:   11,
+					Text:       "sunny",
+					Sources: []Source{
+						{ToolCallIndex: 2, ToolResultIndices: []uint{0}},
+						{ToolCallIndex: 0, ToolResultIndices: []uint{1}},
+						{ToolCallIndex: 1, ToolResultIndices: []uint{3}},
+					},
+				}},
+			},
+		},
+		AvailableTools:           []Tool{{Name: "get_weather", Parameters: params}},
+		AdditionalTemplateFields: fields,
+	}
+
+	want, err := RenderCMD3(opts)
+	require.NoError(t, err)
+	for range 20 {
+		got, err := RenderCMD3(opts)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+func TestTemplating_Cache(t *testing.T) {
+	opts := RenderCmd3Options{Template: "test_templating_cache {{ preamble }}"}
+	_, err := RenderCMD3(opts)
+	require.NoError(t, err)
+	before := ReadTemplateCacheStats()
+	_, err = RenderCMD3(opts)
+	require.NoError(t, err)
+	after := ReadTemplateCacheStats()
+
+	require.Greater(t, after.Hits, before.Hits)
+	require.Positive(t, after.Len)
+	require.LessOrEqual(t, after.Len, after.Capacity)
+}
@@ -0,0 +1,6 @@
+// Package offset defines the byte offsets of tokens. It is apart from the tokenizers
+// package so packages without cgo, such as tokenizertest, can use them.
+package offset
+
+// Offset is the start and end, exclusive, of a token in the encoded text, in bytes
+type Offset [2]uint
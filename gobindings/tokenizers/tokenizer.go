@@ -13,6 +13,8 @@ import "C"
 import (
 	"io"
 	"unsafe"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers/offset"
 )
 
 type Tokenizer struct {
@@ -67,13 +69,20 @@ func FromFile(path string) (*Tokenizer, error) {
 	return &Tokenizer{tokenizer: tokenizer}, nil
 }
 
+// Handle returns the pointer to the Rust tokenizer, for the functions of the melody library
+// that decode tokens themselves. It is only valid until the tokenizer is closed.
+func (t *Tokenizer) Handle() unsafe.Pointer {
+	return t.tokenizer
+}
+
 func (t *Tokenizer) Close() error {
 	C.free_tokenizer(t.tokenizer)
 	t.tokenizer = nil
 	return nil
 }
 
-type Offset [2]uint
+// Offset is the start and end, exclusive, of a token in the encoded text, in bytes
+type Offset = offset.Offset
 
 type Encoding struct {
 	IDs               []uint32
@@ -143,6 +152,14 @@ func (t *Tokenizer) Encode(str string, addSpecialTokens bool) ([]uint32, []strin
 	return ids, tokens
 }
 
+// EncodeWithOffsets returns the token ids of str together with the byte offsets in str
+// that every token was encoded from, e.g. to map stop sequences and citation spans back
+// to positions in the prompt. Tokens added by addSpecialTokens have an empty offset.
+func (t *Tokenizer) EncodeWithOffsets(str string, addSpecialTokens bool) ([]uint32, []Offset) {
+	encoding := t.EncodeWithOptions(str, addSpecialTokens, WithReturnOffsets())
+	return encoding.IDs, encoding.Offsets
+}
+
 func WithReturnAllAttributes() EncodeOption {
 	return func(eo *encodeOpts) {
 		eo.ReturnTypeIDs = C.bool(true)
@@ -0,0 +1,163 @@
+// Package tokenizertest provides a deterministic byte-level tokenizer for tests and
+// fuzzing. Unlike the tokenizers package it needs no vocabulary file, so filter tests
+// built on it can run without the embedded tokenizer data.
+package tokenizertest
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers/offset"
+)
+
+// Encoder encodes text into token ids. It is satisfied by the Tokenizer of the
+// tokenizers package.
+type Encoder interface {
+	Encode(str string, addSpecialTokens bool) ([]uint32, []string)
+}
+
+// OffsetEncoder encodes text into token ids and the byte offsets of every token. It is
+// satisfied by the Tokenizer of the tokenizers package.
+type OffsetEncoder interface {
+	EncodeWithOffsets(str string, addSpecialTokens bool) ([]uint32, []offset.Offset)
+}
+
+// Decoder decodes token ids into text. It is satisfied by the Tokenizer of the
+// tokenizers package.
+type Decoder interface {
+	Decode(tokenIDs []uint32, skipSpecialTokens bool) string
+}
+
+// DefaultSpecialTokens are the Command 3 and Command 4 section tokens
+var DefaultSpecialTokens = []string{
+	"<|START_THINKING|>", "<|END_THINKING|>",
+	"<|START_RESPONSE|>", "<|END_RESPONSE|>",
+	"<|START_TEXT|>", "<|END_TEXT|>",
+	"<|START_ACTION|>", "<|END_ACTION|>",
+}
+
+// numByteTokens is the number of byte tokens, the ids of special tokens start after them
+const numByteTokens = 256
+
+// Tokenizer is a byte-level tokenizer: every byte is a token whose id is the byte
+// value, and every special token is a single token with an id of 256 or more.
+type Tokenizer struct {
+	special []string
+	ids     map[string]uint32
+	// byLength holds the special tokens longest first so that encoding is greedy
+	byLength []string
+}
+
+// New creates a tokenizer with the given special tokens, or DefaultSpecialTokens if none are given
+func New(specialTokens ...string) *Tokenizer {
+	if len(specialTokens) == 0 {
+		specialTokens = DefaultSpecialTokens
+	}
+
+	t := &Tokenizer{ids: make(map[string]uint32)}
+	for _, tok := range specialTokens {
+		if _, ok := t.ids[tok]; ok || tok == "" {
+			continue
+		}
+		t.ids[tok] = uint32(numByteTokens + len(t.special))
+		t.special = append(t.special, tok)
+	}
+	t.byLength = append([]string(nil), t.special...)
+	sort.SliceStable(t.byLength, func(i, j int) bool {
+		return len(t.byLength[i]) > len(t.byLength[j])
+	})
+	return t
+}
+
+// Encode returns the token ids and token strings of str. Special tokens in str are
+// always encoded as a single token; addSpecialTokens is accepted for compatibility.
+func (t *Tokenizer) Encode(str string, addSpecialTokens bool) ([]uint32, []string) {
+	var ids []uint32
+	var tokens []string
+	for i := 0; i < len(str); {
+		if tok, ok := t.specialAt(str[i:]); ok {
+			ids = append(ids, t.ids[tok])
+			tokens = append(tokens, tok)
+			i += len(tok)
+			continue
+		}
+		ids = append(ids, uint32(str[i]))
+		tokens = append(tokens, str[i:i+1])
+		i++
+	}
+	return ids, tokens
+}
+
+// EncodeWithOffsets returns the token ids of str and the byte offsets in str of every token
+func (t *Tokenizer) EncodeWithOffsets(str string, addSpecialTokens bool) ([]uint32, []offset.Offset) {
+	ids, tokens := t.Encode(str, addSpecialTokens)
+	offsets := make([]offset.Offset, len(tokens))
+	var pos uint
+	for i, tok := range tokens {
+		offsets[i] = offset.Offset{pos, pos + uint(len(tok))}
+		pos += uint(len(tok))
+	}
+	return ids, offsets
+}
+
+// Decode returns the text of tokenIDs. Byte sequences that are not valid UTF-8 are
+// replaced with U+FFFD, like a byte-level BPE decoder, and unknown ids are skipped.
+func (t *Tokenizer) Decode(tokenIDs []uint32, skipSpecialTokens bool) string {
+	var sb strings.Builder
+	var bytes []byte
+	flush := func() {
+		sb.WriteString(strings.ToValidUTF8(string(bytes), string(utf8.RuneError)))
+		bytes = bytes[:0]
+	}
+	for _, id := range tokenIDs {
+		if id < numByteTokens {
+			bytes = append(bytes, byte(id))
+			continue
+		}
+		flush()
+		if idx := int(id - numByteTokens); idx < len(t.special) && !skipSpecialTokens {
+			sb.WriteString(t.special[idx])
+		}
+	}
+	flush()
+	return sb.String()
+}
+
+// VocabSize returns the number of tokens in the vocabulary
+func (t *Tokenizer) VocabSize() uint32 {
+	return uint32(numByteTokens + len(t.special))
+}
+
+func (t *Tokenizer) specialAt(s string) (string, bool) {
+	for _, tok := range t.byLength {
+		if strings.HasPrefix(s, tok) {
+			return tok, true
+		}
+	}
+	return "", false
+}
+
+// DecodeChunks decodes tokenIDs one token at a time the way a streaming server does,
+// holding tokens back while they decode to an incomplete UTF-8 sequence. It returns
+// the decoded chunks, each paired with the token ids it was decoded from.
+func DecodeChunks(d Decoder, tokenIDs []uint32) ([]string, [][]uint32) {
+	var chunks []string
+	var chunkIDs [][]uint32
+	var buf []uint32
+	for _, id := range tokenIDs {
+		buf = append(buf, id)
+		decoded := d.Decode(buf, false)
+		if strings.HasSuffix(decoded, string(utf8.RuneError)) {
+			continue
+		}
+		chunks = append(chunks, decoded)
+		chunkIDs = append(chunkIDs, buf)
+		buf = nil
+	}
+	if len(buf) > 0 {
+		chunks = append(chunks, d.Decode(buf, false))
+		chunkIDs = append(chunkIDs, buf)
+	}
+	return chunks, chunkIDs
+}
@@ -0,0 +1,48 @@
+package tokenizertest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/tokenizers/offset"
+)
+
+func TestTokenizer_RoundTrip(t *testing.T) {
+	tk := New()
+
+	ids, tokens := tk.Encode("<|START_RESPONSE|>hi 🌈<|END_RESPONSE|>", false)
+	require.Equal(t, []uint32{258, 'h', 'i', ' ', 0xf0, 0x9f, 0x8c, 0x88, 259}, ids)
+	require.Equal(t, "<|START_RESPONSE|>", tokens[0])
+	require.Equal(t, "<|START_RESPONSE|>hi 🌈<|END_RESPONSE|>", tk.Decode(ids, false))
+	require.Equal(t, "hi 🌈", tk.Decode(ids, true))
+	require.Equal(t, uint32(256+len(DefaultSpecialTokens)), tk.VocabSize())
+}
+
+func TestTokenizer_LongestSpecialTokenWins(t *testing.T) {
+	tk := New("<|A|>", "<|A|><|B|>")
+
+	ids, _ := tk.Encode("<|A|><|B|><|A|>", false)
+	require.Equal(t, []uint32{257, 256}, ids)
+}
+
+func TestTokenizer_EncodeWithOffsets(t *testing.T) {
+	tk := New()
+
+	str := "hi<|END_TEXT|>🌈"
+	ids, offsets := tk.EncodeWithOffsets(str, false)
+	require.Len(t, offsets, len(ids))
+	require.Equal(t, offset.Offset{2, 14}, offsets[2])
+	require.Equal(t, "<|END_TEXT|>", str[offsets[2][0]:offsets[2][1]])
+	require.Equal(t, offset.Offset{14, 15}, offsets[3])
+	require.Equal(t, uint(len(str)), offsets[len(offsets)-1][1])
+}
+
+func TestDecodeChunks(t *testing.T) {
+	tk := New()
+
+	ids, _ := tk.Encode("a🌈<|END_TEXT|>", false)
+	chunks, chunkIDs := DecodeChunks(tk, ids)
+	require.Equal(t, []string{"a", "🌈", "<|END_TEXT|>"}, chunks)
+	require.Equal(t, [][]uint32{{'a'}, {0xf0, 0x9f, 0x8c, 0x88}, {261}}, chunkIDs)
+}
@@ -0,0 +1,67 @@
+package gobindings
+
+import (
+	"fmt"
+	"slices"
+)
+
+// TemplateVersion is a built-in prompt template, rendered by RenderCMD3 or RenderCMD4
+// when the options have no Template
+type TemplateVersion int
+
+const (
+	// TemplateCmd3V1 is the Command 3 template
+	TemplateCmd3V1 TemplateVersion = iota
+	// TemplateCmd4V1 is the Command 4 template
+	TemplateCmd4V1
+)
+
+// render renders the prompt of the template with the tools and no messages
+func (v TemplateVersion) render(tools []Tool) (string, error) {
+	switch v {
+	case TemplateCmd3V1:
+		return RenderCMD3(RenderCmd3Options{AvailableTools: tools})
+	case TemplateCmd4V1:
+		return RenderCMD4(RenderCmd4Options{AvailableTools: tools})
+	default:
+		return "", fmt.Errorf("unknown template version %d", v)
+	}
+}
+
+// ToolCost is the number of tokens a tool adds to a prompt
+type ToolCost struct {
+	Name   string `json:"name"`
+	Tokens int    `json:"tokens"`
+}
+
+// EstimateToolCosts returns the cost of each of tools in a prompt of the template version:
+// the number of tokens, counted with tokenizer, the prompt with all the tools saves without
+// it. Callers over a token budget can drop the costliest tools, or those they need least,
+// before rendering.
+//
+// The costs do not add up to the tokens of the tool list: its heading and instructions are
+// shared by the tools and only saved, and counted, when the last tool is dropped.
+func EstimateToolCosts(tools []Tool, tokenizer PromptTokenizer, version TemplateVersion) ([]ToolCost, error) {
+	count := func(tools []Tool) (int, error) {
+		prompt, err := version.render(tools)
+		if err != nil {
+			return 0, fmt.Errorf("failed to render prompt: %w", err)
+		}
+		ids, _ := tokenizer.Encode(prompt, false)
+		return len(ids), nil
+	}
+
+	total, err := count(tools)
+	if err != nil {
+		return nil, err
+	}
+	costs := make([]ToolCost, len(tools))
+	for i, t := range tools {
+		without, err := count(slices.Delete(slices.Clone(tools), i, i+1))
+		if err != nil {
+			return nil, err
+		}
+		costs[i] = ToolCost{Name: t.Name, Tokens: total - without}
+	}
+	return costs, nil
+}
@@ -0,0 +1,46 @@
+package gobindings
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+	"github.com/cohere-ai/melody/gobindings/tokenizers/tokenizertest"
+)
+
+func TestEstimateToolCosts(t *testing.T) {
+	t.Parallel()
+
+	tok := tokenizertest.New()
+	params := orderedjson.New(orderedjson.WithInitialData(orderedjson.Pair{
+		Key:   "city",
+		Value: map[string]any{"type": "string", "description": "The city"},
+	}))
+	tools := []Tool{
+		{Name: "get_weather", Description: "Gets the weather", Parameters: params},
+		{Name: "search", Description: strings.Repeat("Searches the web. ", 20)},
+		{Name: "get_time", Description: "Gets the time"},
+	}
+
+	for _, version := range []TemplateVersion{TemplateCmd3V1, TemplateCmd4V1} {
+		costs, err := EstimateToolCosts(tools, tok, version)
+		require.NoError(t, err)
+		require.Len(t, costs, len(tools))
+		for i, c := range costs {
+			require.Equal(t, tools[i].Name, c.Name)
+			require.Positive(t, c.Tokens)
+		}
+		require.Greater(t, costs[1].Tokens, costs[0].Tokens)
+		require.Greater(t, costs[0].Tokens, costs[2].Tokens)
+
+		// The cost of the last tool includes the tool list
+		alone, err := EstimateToolCosts(tools[2:], tok, version)
+		require.NoError(t, err)
+		require.Greater(t, alone[0].Tokens, costs[2].Tokens)
+	}
+
+	_, err := EstimateToolCosts(tools, tok, TemplateVersion(9))
+	require.ErrorContains(t, err, "unknown template version 9")
+}
@@ -0,0 +1,142 @@
+package gobindings
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// toolCallReadiness follows the raw parameters of a tool call to find when its required
+// parameters are complete, see WithToolReadiness
+type toolCallReadiness struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Raw is the raw parameters read, the offsets of the decoder's events are offsets in it
+	Raw     string               `json:"raw,omitempty"`
+	Decoder *orderedjson.Decoder `json:"decoder,omitempty"`
+	// Depth is the nesting of the arrays and objects read, the parameters are at depth 1
+	Depth int `json:"depth,omitempty"`
+	// Key and KeyOffset are the name and the offset in Raw of the parameter being read
+	Key       string `json:"key,omitempty"`
+	KeyOffset int64  `json:"key_offset,omitempty"`
+	// Complete are the names of the complete parameters and Members their raw text
+	Complete []string `json:"complete,omitempty"`
+	Members  []string `json:"members,omitempty"`
+	// Done is set once the tool call was reported ready or its parameters are not a JSON
+	// object
+	Done bool `json:"done,omitempty"`
+}
+
+// clone returns a copy of r that reads on independently
+func (r *toolCallReadiness) clone() *toolCallReadiness {
+	c := *r
+	if r.Decoder != nil {
+		c.Decoder = r.Decoder.Clone()
+	}
+	c.Complete = slices.Clip(r.Complete)
+	c.Members = slices.Clip(r.Members)
+	return &c
+}
+
+// read reads chunk, the next part of the raw parameters
+func (r *toolCallReadiness) read(chunk string) {
+	if r.Decoder == nil {
+		r.Decoder = orderedjson.NewDecoder()
+	}
+	r.Raw += chunk
+	events, err := r.Decoder.Feed([]byte(chunk))
+	for _, ev := range events {
+		switch ev.Kind {
+		case orderedjson.BeginArray:
+			if r.Depth == 0 {
+				r.Done = true
+				return
+			}
+			r.Depth++
+		case orderedjson.BeginObject:
+			r.Depth++
+		case orderedjson.EndObject, orderedjson.EndArray:
+			r.Depth--
+			if r.Depth == 1 {
+				r.complete(ev.Offset + 1)
+			}
+		case orderedjson.Key:
+			if r.Depth == 1 {
+				r.Key, r.KeyOffset = ev.Key, ev.Offset
+			}
+		case orderedjson.Value:
+			if r.Depth == 0 {
+				r.Done = true
+				return
+			}
+			if r.Depth == 1 && !ev.Partial {
+				r.complete(ev.Offset + int64(len(ev.Raw)))
+			}
+		}
+	}
+	if err != nil {
+		r.Done = true
+	}
+}
+
+// complete records the parameter being read, which ends at end in Raw
+func (r *toolCallReadiness) complete(end int64) {
+	r.Complete = append(r.Complete, r.Key)
+	r.Members = append(r.Members, r.Raw[r.KeyOffset:end])
+}
+
+// ready returns the parameters complete so far if every required parameter is among them
+func (r *toolCallReadiness) ready(required []string) (orderedjson.Object, bool) {
+	for _, name := range required {
+		if !slices.Contains(r.Complete, name) {
+			return orderedjson.Object{}, false
+		}
+	}
+	params := orderedjson.New()
+	if err := params.UnmarshalJSON([]byte("{" + strings.Join(r.Members, ",") + "}")); err != nil {
+		return orderedjson.Object{}, false
+	}
+	return params, true
+}
+
+// reportToolReadiness sets ToolReady on the output completing the required parameters of
+// every tool call to one of the tools of WithToolReadiness
+func (f *SyncFilter) reportToolReadiness(outputs []FilterOutput) {
+	if len(f.readinessTools) == 0 {
+		return
+	}
+	for i := range outputs {
+		d := outputs[i].ToolCallDelta
+		if d == nil {
+			continue
+		}
+		r, ok := f.toolReadiness[d.Index]
+		if !ok {
+			if f.toolReadiness == nil {
+				f.toolReadiness = make(map[uint]*toolCallReadiness)
+			}
+			r = &toolCallReadiness{}
+			f.toolReadiness[d.Index] = r
+		}
+		r.ID += d.ID
+		r.Name += d.Name
+		if r.Done || d.RawParamDelta == "" {
+			continue
+		}
+		// The name of a tool call precedes its parameters
+		tool, ok := f.readinessTools[r.Name]
+		if !ok {
+			r.Done = true
+			continue
+		}
+		if r.read(d.RawParamDelta); r.Done {
+			continue
+		}
+		if params, ok := r.ready(requiredParameters(tool)); ok {
+			outputs[i].ToolReady = &FilterToolReady{Index: d.Index, ID: r.ID, Name: r.Name, Parameters: params}
+			// Only the names are kept once the tool call is ready
+			*r = toolCallReadiness{ID: r.ID, Name: r.Name, Done: true}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package gobindings
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Tracer starts the spans of the render and parse phases. It is the subset of the
+// OpenTelemetry trace API melody uses, so an otel trace.Tracer plugs in with a small adapter
+// without melody depending on otel. The context passed to Start is context.Background(),
+// an adapter parents the spans by starting them from its own context instead.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	AddEvent(name string, fields ...Field)
+	RecordError(err error)
+	End()
+}
+
+// startSpan starts a span with t, it returns nil if t is nil
+func startSpan(ctx context.Context, t Tracer, name string) (context.Context, Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	return t.Start(ctx, name)
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// traceLatencyWindow is the number of the latest writes of a filter whose latencies are
+// kept for its percentiles, so a long stream does not keep the latency of every write
+const traceLatencyWindow = 1024
+
+// filterTrace traces the lifecycle of a filter: a span from its creation to its flush, with
+// the latency percentiles of its writes, and a child span for the flush itself
+type filterTrace struct {
+	tracer Tracer
+	ctx    context.Context
+	span   Span
+	// latencies is a ring buffer of the latencies of the latest writes, the one of write
+	// number n is at n % traceLatencyWindow
+	latencies []time.Duration
+	writes    int
+}
+
+func newFilterTrace(t Tracer) *filterTrace {
+	if t == nil {
+		return nil
+	}
+	ctx, span := t.Start(context.Background(), "melody.filter")
+	return &filterTrace{tracer: t, ctx: ctx, span: span}
+}
+
+// write records the latency of a write, started at start
+func (ft *filterTrace) write(start time.Time) {
+	if ft == nil || ft.span == nil {
+		return
+	}
+	d := time.Since(start)
+	if len(ft.latencies) < traceLatencyWindow {
+		ft.latencies = append(ft.latencies, d)
+	} else {
+		ft.latencies[ft.writes%traceLatencyWindow] = d
+	}
+	ft.writes++
+}
+
+// flush starts the span of the flush, end it with endSpan
+func (ft *filterTrace) flush() Span {
+	if ft == nil || ft.span == nil {
+		return nil
+	}
+	_, span := ft.tracer.Start(ft.ctx, "melody.filter.flush")
+	return span
+}
+
+// end ends the span of the filter, recording err and the latency percentiles of the latest
+// writes. Only the first call has an effect.
+func (ft *filterTrace) end(err error) {
+	if ft == nil || ft.span == nil {
+		return
+	}
+	l := slices.Clone(ft.latencies)
+	slices.Sort(l)
+	ft.span.AddEvent("parse latency",
+		Field{Key: "writes", Value: ft.writes},
+		Field{Key: "p50", Value: percentile(l, 50)},
+		Field{Key: "p90", Value: percentile(l, 90)},
+		Field{Key: "p99", Value: percentile(l, 99)},
+	)
+	endSpan(ft.span, err)
+	ft.span = nil
+	ft.latencies = nil
+	ft.writes = 0
+}
+
+// percentile returns the p-th percentile of the sorted durations, 0 if there are none
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
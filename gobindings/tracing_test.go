@@ -0,0 +1,106 @@
+package gobindings
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTracer records the spans it starts as "name" or "parent/name"
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	name   string
+	events []string
+	err    error
+	ended  bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		name = parent.name + "/" + name
+	}
+	s := &recordedSpan{name: name}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordedSpan) AddEvent(name string, _ ...Field) { s.events = append(s.events, name) }
+func (s *recordedSpan) RecordError(err error)            { s.err = err }
+func (s *recordedSpan) End()                             { s.ended = true }
+
+func TestTracing_Render(t *testing.T) {
+	t.Parallel()
+
+	tracer := &recordingTracer{}
+	_, err := RenderFIM("a = ", "", RenderFIMOptions{Tracer: tracer})
+	require.NoError(t, err)
+	require.Equal(t, []*recordedSpan{{name: "melody.RenderFIM", ended: true}}, tracer.spans)
+}
+
+func TestTracing_Filter(t *testing.T) {
+	t.Parallel()
+
+	tracer := &recordingTracer{}
+	f := NewFilter(HandleMultiHopCmd3(), WithTracer(tracer))
+	for _, chunk := range []string{"<|START_RESPONSE|>", "Hello", "<|END_RESPONSE|>"} {
+		_, err := f.WriteDecoded(chunk, nil)
+		require.NoError(t, err)
+	}
+	_, err := f.FlushPartials()
+	require.NoError(t, err)
+	// The filter span is only ended once
+	_, err = f.FlushPartials()
+	require.NoError(t, err)
+
+	require.Equal(t, []*recordedSpan{
+		{name: "melody.filter", events: []string{"parse latency"}, ended: true},
+		{name: "melody.filter/melody.filter.flush", ended: true},
+	}, tracer.spans)
+	require.Empty(t, f.(*SyncFilter).trace.latencies)
+
+	// A stream that fails records its error on the filter span
+	tracer = &recordingTracer{}
+	f = NewFilter(HandleMultiHopCmd3(), WithMaxBufferBytes(4), WithTracer(tracer))
+	_, err = f.WriteDecoded("<|START_RESP", nil)
+	var limitErr *StreamLimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, []*recordedSpan{
+		{name: "melody.filter", events: []string{"parse latency"}, err: limitErr, ended: true},
+	}, tracer.spans)
+}
+
+func TestTracing_FilterLatencyWindow(t *testing.T) {
+	t.Parallel()
+
+	ft := newFilterTrace(&recordingTracer{})
+	start := time.Now()
+	for range traceLatencyWindow + 10 {
+		ft.write(start)
+	}
+	// Only the latencies of the latest writes are kept, the oldest are overwritten
+	require.Len(t, ft.latencies, traceLatencyWindow)
+	require.Equal(t, traceLatencyWindow+10, ft.writes)
+	require.GreaterOrEqual(t, ft.latencies[9], ft.latencies[10])
+}
+
+func TestPercentile(t *testing.T) {
+	t.Parallel()
+
+	require.Zero(t, percentile(nil, 50))
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	require.Equal(t, time.Duration(5), percentile(sorted, 50))
+	require.Equal(t, time.Duration(9), percentile(sorted, 90))
+	require.Equal(t, time.Duration(9), percentile(sorted, 99))
+	require.Equal(t, time.Duration(10), percentile(sorted, 100))
+}
@@ -1,41 +1,177 @@
 package gobindings
 
+import (
+	"strconv"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
 // TokenIDsWithLogProb pairs tokens with their log probabilities
 type TokenIDsWithLogProb struct {
-	TokenIDs []uint32
-	Logprobs []float32
+	TokenIDs []uint32  `json:"token_ids"`
+	Logprobs []float32 `json:"logprobs"`
+	// TopLogProbs has the most likely alternatives of each token, for OpenAI-style
+	// top_logprobs. Written with the tokens, they are carried to the outputs of the tokens,
+	// which then have one per token ID.
+	TopLogProbs []TopLogProbs `json:"top_logprobs,omitempty"`
 }
 
-// FilterOutput represents a partial parsed output from a model generation
+// TopLogProbs are the top-k alternatives of a sampled token, most likely first
+type TopLogProbs struct {
+	TokenIDs []uint32  `json:"token_ids"`
+	Logprobs []float32 `json:"logprobs"`
+}
+
+// FilterOutput represents a partial parsed output from a model generation. Its JSON encoding
+// is versioned, see FilterOutputSchemaVersion.
 type FilterOutput struct {
-	Text          string
-	Logprobs      TokenIDsWithLogProb
-	SearchQuery   *FilterSearchQueryDelta
-	Citations     []FilterCitation
-	ToolCallDelta *FilterToolCallDelta
-	IsPostAnswer  bool
-	IsReasoning   bool
+	Text          string                  `json:"text,omitempty"`
+	Logprobs      TokenIDsWithLogProb     `json:"logprobs,omitzero"`
+	SearchQuery   *FilterSearchQueryDelta `json:"search_query,omitempty"`
+	Citations     []FilterCitation        `json:"citations,omitempty"`
+	ToolCallDelta *FilterToolCallDelta    `json:"tool_call_delta,omitempty"`
+	IsPostAnswer  bool                    `json:"is_post_answer,omitempty"`
+	IsReasoning   bool                    `json:"is_reasoning,omitempty"`
+	// PlanIndex is the index of the thinking block of reasoning content. Agentic loops emit
+	// several thinking blocks in a completion, the citation indices of each start at 0.
+	PlanIndex uint `json:"plan_index,omitempty"`
+	// IsEcho is set on the echoed prompt tokens of a filter created WithPromptEcho
+	IsEcho bool `json:"is_echo,omitempty"`
+	// Finish is set only on the terminal output of a filter created WithFinishReason
+	Finish *FilterFinish `json:"finish,omitempty"`
+	// RelevantDocIndices and CitedDocIndices are set on the outputs of the "Relevant Documents:"
+	// and "Cited Documents:" lines of a filter created with StreamDocumentSelections, empty
+	// when a line selects no documents
+	RelevantDocIndices []uint `json:"relevant_doc_indices,omitzero"`
+	CitedDocIndices    []uint `json:"cited_doc_indices,omitzero"`
+	// Redactions are the spans of Text replaced by the transformer of a filter created
+	// WithOutputTransformer
+	Redactions []Redaction `json:"redactions,omitempty"`
+	// ToolReady is set on the output completing the required parameters of a tool call of
+	// a filter created WithToolReadiness
+	ToolReady *FilterToolReady `json:"tool_ready,omitempty"`
+	// Markdown is the markdown blocks open at the end of Text, set on the outputs with
+	// text of a filter created WithMarkdownState
+	Markdown *MarkdownState `json:"markdown,omitempty"`
+	// Language is the language of the latest text, set on the outputs with text of a filter
+	// created WithLanguageDetection
+	Language *LanguageGuess `json:"language,omitempty"`
+	// Timing is set on every output of a filter created WithLatencyStamps, and
+	// LatencySummary on the last output of its flush
+	Timing         *FilterTiming   `json:"timing,omitempty"`
+	LatencySummary *LatencySummary `json:"latency_summary,omitempty"`
+	// ModeEvent is set on the output following a switch of the mode of a filter created
+	// WithModeEvents
+	ModeEvent *FilterModeEvent `json:"mode_event,omitempty"`
+	// InvalidCitations are the citations dropped from the previous output by a filter
+	// created WithCitationValidation
+	InvalidCitations []InvalidCitation `json:"invalid_citations,omitempty"`
+	// ReasoningTokens is the number of tokens of the thinking blocks, set on the last output
+	// of the flush of a filter created WithSuppressedReasoning if there were any
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+}
+
+// InvalidCitation is a citation whose indices do not slice the emitted text to its text
+type InvalidCitation struct {
+	Citation FilterCitation `json:"citation"`
+	Reason   string         `json:"reason"`
+}
+
+// FilterModeEvent reports that a special token switched the mode of the filter
+type FilterModeEvent struct {
+	From FilterMode `json:"from"`
+	To   FilterMode `json:"to"`
+}
+
+// LanguageGuess is the detected language of text
+type LanguageGuess struct {
+	// Code is the ISO 639-1 code of the language, or LanguageUndetermined
+	Code string `json:"code"`
+	// Confidence is between 0 and 1, low for text of a few words
+	Confidence float64 `json:"confidence"`
 }
 
+// MarkdownState is the markdown blocks open at a point of the text
+type MarkdownState struct {
+	// InCodeFence is set inside a fenced code block, CodeLanguage is the language of its
+	// info string, empty if it has none
+	InCodeFence  bool   `json:"in_code_fence,omitempty"`
+	CodeLanguage string `json:"code_language,omitempty"`
+	// ListDepth is the number of nested lists, 0 outside of a list
+	ListDepth int  `json:"list_depth,omitempty"`
+	InTable   bool `json:"in_table,omitempty"`
+}
+
+// FilterToolReady reports a tool call whose required parameters are complete, so the tool
+// can be run before the end of the action
+type FilterToolReady struct {
+	Index uint   `json:"index"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	// Parameters are the parameters of the tool call complete so far, the required ones
+	// included
+	Parameters orderedjson.Object `json:"parameters"`
+}
+
+// Redaction is a span of the text of an output replaced by an output transformer, e.g. an
+// email address replaced by "[EMAIL]"
+type Redaction struct {
+	// Start and End are the byte offsets of the span in the text given to the transformer
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Replacement is the text that replaced the span
+	Replacement string `json:"replacement"`
+	// Kind is what the span was, e.g. "email" or "phone"
+	Kind string `json:"kind,omitempty"`
+}
+
+// FilterFinish reports why a filter stream ended
+type FilterFinish struct {
+	Reason FinishReason `json:"reason"`
+	// StopSequence is the stop sequence or special token that ended the stream, empty on FinishReasonFlush
+	StopSequence string `json:"stop_sequence,omitempty"`
+}
+
+// FinishReason is the reason a filter stream ended (mirrors ffi.rs CFinishReason)
+type FinishReason int32
+
+const (
+	// FinishReasonInclusiveStop is an inclusive stop sequence
+	FinishReasonInclusiveStop FinishReason = 0
+	// FinishReasonExclusiveStop is an exclusive stop sequence
+	FinishReasonExclusiveStop FinishReason = 1
+	// FinishReasonEndOfSequence is a special token that stops the filter, e.g. the end of a
+	// fill-in-the-middle completion
+	FinishReasonEndOfSequence FinishReason = 2
+	// FinishReasonFlush is a call to FlushPartials before any stop
+	FinishReasonFlush FinishReason = 3
+)
+
 // FilterSearchQueryDelta represents a change to a search query
 type FilterSearchQueryDelta struct {
-	Index uint
-	Text  string
+	Index uint   `json:"index"`
+	Text  string `json:"text"`
 }
 
 // FilterToolCallDelta represents a change to a tool call
 type FilterToolCallDelta struct {
-	Index         uint
-	ID            string
-	Name          string
-	ParamDelta    *FilterToolParameter
-	RawParamDelta string
+	Index         uint                 `json:"index"`
+	ID            string               `json:"id"`
+	Name          string               `json:"name"`
+	ParamDelta    *FilterToolParameter `json:"param_delta,omitempty"`
+	RawParamDelta string               `json:"raw_param_delta"`
+	// IDSynthesized is set when ID was generated by the filter rather than written by the
+	// model, see WithToolCallIDGenerator
+	IDSynthesized bool `json:"id_synthesized,omitempty"`
 }
 
 // FilterToolParameter represents a change to a tool parameter
 type FilterToolParameter struct {
-	Name       string
-	ValueDelta string
+	Name       string `json:"name"`
+	ValueDelta string `json:"value_delta"`
+	// Path is the path of keys from the parameter to the nested field ValueDelta belongs
+	// to, starting with Name. Only set with WithNestedParamPaths.
+	Path []string `json:"path,omitempty"`
 }
 
 // FilterCitation represents a citation parsed from a model generation
@@ -49,10 +185,145 @@ type FilterCitation struct {
 	Text       string   `json:"text"`
 	Sources    []Source `json:"sources"`
 	IsThinking bool     `json:"is_thinking"`
+	// The caller-provided IDs of the cited documents, resolved from Sources.
+	// Only populated when the filter is created with WithDocumentIDs.
+	DocumentIDs []string `json:"document_ids,omitempty"`
+	// Confidence is the probability of the tokens of the cited text, between 0 and 1. Only
+	// populated when the filter is created with WithCitationConfidence and given logprobs.
+	Confidence *float64 `json:"confidence,omitempty"`
 }
 
 // Source indicates which tool call and which tool results from that tool are being cited
 type Source struct {
 	ToolCallIndex     uint   `json:"tool_call_index"`
 	ToolResultIndices []uint `json:"tool_result_indices"`
+	// SourceName is the name of the cited tool, set instead of ToolCallIndex by citations
+	// keyed by name in the CitationSourceToolName format
+	SourceName string `json:"source_name,omitempty"`
+}
+
+// CitationIndexUnit is the unit of citation start and end indices (mirrors ffi.rs CCitationIndexUnit)
+type CitationIndexUnit int32
+
+const (
+	// CitationIndexRunes counts Unicode code points, the default
+	CitationIndexRunes CitationIndexUnit = 0
+	// CitationIndexGraphemes counts grapheme clusters, so combining characters and emoji ZWJ
+	// sequences count as one character
+	CitationIndexGraphemes CitationIndexUnit = 1
+	// CitationIndexUTF16 counts UTF-16 code units, as JavaScript string indices do
+	CitationIndexUTF16 CitationIndexUnit = 2
+	// CitationIndexBytes counts UTF-8 bytes
+	CitationIndexBytes CitationIndexUnit = 3
+)
+
+// CitationConfidence is how the logprobs of the tokens of a citation are aggregated into
+// its confidence, see WithCitationConfidence
+type CitationConfidence int32
+
+const (
+	// CitationConfidenceMean is the geometric mean of the probabilities of the tokens
+	CitationConfidenceMean CitationConfidence = 0
+	// CitationConfidenceMin is the probability of the least likely token
+	CitationConfidenceMin CitationConfidence = 1
+)
+
+// StopContext is where a conditional stop ends the stream (mirrors ffi.rs CStopContext)
+type StopContext int32
+
+const (
+	// StopContextPlainText stops only in the response text, outside of markdown code fences
+	StopContextPlainText StopContext = 0
+	// StopContextNotInAction stops anywhere but in tool actions and their parameters
+	StopContextNotInAction StopContext = 1
+	// StopContextNotInThinking stops anywhere but in the reasoning
+	StopContextNotInThinking StopContext = 2
+)
+
+// ConditionalStop is an exclusive stop sequence that only ends the stream in a context,
+// see WithConditionalStops
+type ConditionalStop struct {
+	Stop    string      `json:"stop"`
+	Context StopContext `json:"context,omitempty"`
+}
+
+// CitationSourceFormat is how the sources of Command 3 citations are keyed (mirrors ffi.rs
+// CCitationSourceFormat)
+type CitationSourceFormat int32
+
+const (
+	// CitationSourceToolIndex keys sources by tool call index, </co: 0:[2]>, the default
+	CitationSourceToolIndex CitationSourceFormat = 0
+	// CitationSourceToolName keys sources by tool name, </co: web_search:[2]>, which is set
+	// as the SourceName of the sources. Numeric keys are still tool call indices.
+	CitationSourceToolName CitationSourceFormat = 1
+)
+
+// UnicodeNormalization is the Unicode normalization form of the emitted text (mirrors
+// ffi.rs CUnicodeNormalization)
+type UnicodeNormalization int32
+
+const (
+	// UnicodeNormalizationNone emits the text as decoded, the default
+	UnicodeNormalizationNone UnicodeNormalization = 0
+	// UnicodeNormalizationNFC composes canonically equivalent sequences
+	UnicodeNormalizationNFC UnicodeNormalization = 1
+	// UnicodeNormalizationNFKC also replaces compatibility characters, e.g. the "ﬁ"
+	// ligature with "fi"
+	UnicodeNormalizationNFKC UnicodeNormalization = 2
+)
+
+// FilterMode is the parsing mode a special token switches the filter to (mirrors ffi.rs CFilterMode)
+type FilterMode int32
+
+const (
+	// FilterModePlainText outputs all text without special processing
+	FilterModePlainText FilterMode = 0
+	// FilterModeIgnore discards all text
+	FilterModeIgnore FilterMode = 1
+	// FilterModeToolAction parses tool calls
+	FilterModeToolAction FilterMode = 2
+	// FilterModeToolReason parses thinking/reasoning blocks
+	FilterModeToolReason FilterMode = 3
+	// FilterModeAnswer parses non-grounded answer text
+	FilterModeAnswer FilterMode = 4
+	// FilterModeGroundedAnswer parses grounded answer text with citations
+	FilterModeGroundedAnswer FilterMode = 5
+	// FilterModeInclusiveStop stops parsing and includes the token in the output
+	FilterModeInclusiveStop FilterMode = 6
+	// FilterModeExclusiveStop stops parsing and excludes the token from the output
+	FilterModeExclusiveStop FilterMode = 7
+	// FilterModeSearchQuery parses search queries
+	FilterModeSearchQuery FilterMode = 8
+	// FilterModeNextSearchQuery starts the next search query
+	FilterModeNextSearchQuery FilterMode = 9
+
+	// FilterModeCustom is the first mode reserved for formats registered with RegisterFormat.
+	// Sections in a custom mode are parsed by the format's HandleSection.
+	FilterModeCustom FilterMode = 256
+)
+
+var filterModeNames = [...]string{
+	FilterModePlainText:       "plain_text",
+	FilterModeIgnore:          "ignore",
+	FilterModeToolAction:      "tool_action",
+	FilterModeToolReason:      "tool_reason",
+	FilterModeAnswer:          "answer",
+	FilterModeGroundedAnswer:  "grounded_answer",
+	FilterModeInclusiveStop:   "inclusive_stop",
+	FilterModeExclusiveStop:   "exclusive_stop",
+	FilterModeSearchQuery:     "search_query",
+	FilterModeNextSearchQuery: "next_search_query",
+}
+
+// String returns the name of the mode in format descriptors, e.g. "grounded_answer", and
+// "custom_256" for a custom mode
+func (m FilterMode) String() string {
+	if m >= 0 && int(m) < len(filterModeNames) {
+		return filterModeNames[m]
+	}
+	if m >= FilterModeCustom {
+		return "custom_" + strconv.Itoa(int(m))
+	}
+	return "unknown_" + strconv.Itoa(int(m))
 }
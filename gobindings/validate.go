@@ -0,0 +1,259 @@
+package gobindings
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+// ValidationCode is the machine-readable kind of a ValidationProblem
+type ValidationCode string
+
+const (
+	// ValidationMissingToolCallID is a tool message without a ToolCallID
+	ValidationMissingToolCallID ValidationCode = "missing_tool_call_id"
+	// ValidationUnknownToolCallID is a tool message answering a tool call no earlier
+	// message made. It renders, as a tool call of its own.
+	ValidationUnknownToolCallID ValidationCode = "unknown_tool_call_id"
+	// ValidationEmptyToolCallID is a tool call without an ID
+	ValidationEmptyToolCallID ValidationCode = "empty_tool_call_id"
+	// ValidationDuplicateToolCallID is a tool call with the ID of an earlier one
+	ValidationDuplicateToolCallID ValidationCode = "duplicate_tool_call_id"
+	// ValidationMisplacedToolCalls is a tool call of a message that is not a chatbot message
+	ValidationMisplacedToolCalls ValidationCode = "misplaced_tool_calls"
+	// ValidationInvalidToolParameters is a tool call whose parameters are not a JSON value
+	ValidationInvalidToolParameters ValidationCode = "invalid_tool_parameters"
+	// ValidationUnknownTool is a tool call to a tool that is not available
+	ValidationUnknownTool ValidationCode = "unknown_tool"
+	// ValidationInvalidContentType is content of a type the role of its message does not
+	// support, e.g. thinking in a tool message or a document in a user message, or elided
+	// turns with other content or tool calls
+	ValidationInvalidContentType ValidationCode = "invalid_content_type"
+	// ValidationUnresolvedImage is an inline image without a placeholder, which renders as
+	// nothing, see images.Layout.ResolveInline
+	ValidationUnresolvedImage ValidationCode = "unresolved_image"
+	// ValidationUnknownCitationSource is a citation of a tool result that does not exist
+	ValidationUnknownCitationSource ValidationCode = "unknown_citation_source"
+	// ValidationEmptyToolName is a tool without a name
+	ValidationEmptyToolName ValidationCode = "empty_tool_name"
+	// ValidationDuplicateToolName is a tool with the name of an earlier one
+	ValidationDuplicateToolName ValidationCode = "duplicate_tool_name"
+	// ValidationReservedTemplateField is an additional template field with the name of a
+	// field the render sets, which would silently replace it
+	ValidationReservedTemplateField ValidationCode = "reserved_template_field"
+	// ValidationDisallowedTemplateField is an additional template field that is not in the
+	// allowed fields
+	ValidationDisallowedTemplateField ValidationCode = "disallowed_template_field"
+	// ValidationInvalidTemplateField is an additional template field whose value cannot be
+	// encoded as JSON, which would drop all the additional template fields
+	ValidationInvalidTemplateField ValidationCode = "invalid_template_field"
+)
+
+// ValidationProblem is a problem of the messages, tools or documents of a request found by Validate
+type ValidationProblem struct {
+	Code ValidationCode `json:"code"`
+	// MessageIndex is the index of the message with the problem, nil for a problem of a tool
+	// or template field
+	MessageIndex *int `json:"message_index,omitempty"`
+	// ToolIndex is the index of the tool with the problem, nil for a problem of a message
+	// or template field
+	ToolIndex *int `json:"tool_index,omitempty"`
+	// Field is the name of the additional template field with the problem, empty for a
+	// problem of a message or tool
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p ValidationProblem) String() string {
+	return string(p.Code) + ": " + p.Message
+}
+
+// ValidationProblems are the problems found by Validate
+type ValidationProblems []ValidationProblem
+
+// Err returns nil without problems, otherwise an error listing them that matches
+// ErrInvalidMessages
+func (ps ValidationProblems) Err() error {
+	if len(ps) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(ps))
+	for i, p := range ps {
+		msgs[i] = p.String()
+	}
+	return &Error{Kind: ErrorKindInvalidMessages, Message: strings.Join(msgs, "\n")}
+}
+
+// Validate checks that messages, tools and documents can be rendered by RenderCMD3 and
+// RenderCMD4, and returns all the problems found rather than the first render error, so a
+// request can be rejected before rendering. Tool calls are only checked against tools when
+// there are any.
+func Validate(messages []Message, tools []Tool, documents []orderedjson.Object) ValidationProblems {
+	var ps ValidationProblems
+	atMessage := func(i int, code ValidationCode, format string, args ...any) {
+		ps = append(ps, ValidationProblem{Code: code, MessageIndex: &i, Message: fmt.Sprintf("message[%d] ", i) + fmt.Sprintf(format, args...)})
+	}
+
+	toolNames := make(map[string]bool, len(tools))
+	for i, t := range tools {
+		switch {
+		case t.Name == "":
+			ps = append(ps, ValidationProblem{Code: ValidationEmptyToolName, ToolIndex: &i, Message: fmt.Sprintf("tool[%d] has no name", i)})
+		case toolNames[t.Name]:
+			ps = append(ps, ValidationProblem{Code: ValidationDuplicateToolName, ToolIndex: &i, Message: fmt.Sprintf("tool[%d] has duplicate name %q", i, t.Name)})
+		}
+		toolNames[t.Name] = true
+	}
+
+	toolCallIDs := make(map[string]bool)
+	for i, m := range messages {
+		if m.Role == RoleTool {
+			switch {
+			case m.ToolCallID == "":
+				atMessage(i, ValidationMissingToolCallID, "is a tool message without tool_call_id")
+			case !toolCallIDs[m.ToolCallID]:
+				atMessage(i, ValidationUnknownToolCallID, "answers unknown tool call %q", m.ToolCallID)
+				toolCallIDs[m.ToolCallID] = true
+			}
+		}
+		for j, c := range m.Content {
+			if !contentTypeSupported(m, c.Type) {
+				atMessage(i, ValidationInvalidContentType, "content[%d] has a content type not supported for %s messages", j, roleName(m.Role))
+			}
+			if c.Image != nil && len(c.Image.Data) > 0 && c.Image.TemplatePlaceholder == "" {
+				atMessage(i, ValidationUnresolvedImage, "content[%d] is an inline image without a placeholder", j)
+			}
+		}
+		for j, tc := range m.ToolCalls {
+			if m.Role != RoleChatbot {
+				atMessage(i, ValidationMisplacedToolCalls, "tool call[%d] is in a %s message, tool calls are only supported for chatbot messages", j, roleName(m.Role))
+			}
+			switch {
+			case tc.ID == "":
+				atMessage(i, ValidationEmptyToolCallID, "tool call[%d] has an empty id", j)
+			case toolCallIDs[tc.ID]:
+				atMessage(i, ValidationDuplicateToolCallID, "tool call[%d] has duplicate id %q", j, tc.ID)
+			}
+			toolCallIDs[tc.ID] = true
+			if strings.TrimSpace(tc.Parameters) != "" && !json.Valid([]byte(tc.Parameters)) {
+				atMessage(i, ValidationInvalidToolParameters, "tool call[%d] has parameters that are not valid JSON", j)
+			}
+			if len(tools) > 0 && !toolNames[tc.Name] {
+				atMessage(i, ValidationUnknownTool, "tool call[%d] calls unknown tool %q", j, tc.Name)
+			}
+		}
+	}
+
+	// Citations refer to the tool results of the whole conversation
+	counts := toolResultCounts(messages, documents)
+	for i, m := range messages {
+		for _, c := range m.Citations {
+			for _, s := range c.Sources {
+				if s.SourceName != "" {
+					continue
+				}
+				if s.ToolCallIndex >= uint(len(counts)) {
+					atMessage(i, ValidationUnknownCitationSource, "citation %q cites unknown tool call %d", c.Text, s.ToolCallIndex)
+					continue
+				}
+				for _, idx := range s.ToolResultIndices {
+					if idx >= uint(counts[s.ToolCallIndex]) {
+						atMessage(i, ValidationUnknownCitationSource, "citation %q cites unknown result %d of tool call %d", c.Text, idx, s.ToolCallIndex)
+					}
+				}
+			}
+		}
+	}
+	return ps
+}
+
+// reservedTemplateFields are the fields RenderCMD3 and RenderCMD4 set in the template
+// context, which replace additional template fields of the same name
+var reservedTemplateFields = map[string]bool{
+	"preamble":                      true,
+	"developer_instruction":         true,
+	"platform_instruction_override": true,
+	"messages":                      true,
+	"documents":                     true,
+	"available_tools":               true,
+	"citation_mode":                 true,
+	"safety_mode":                   true,
+	"grounding":                     true,
+	"reasoning_options":             true,
+	"skip_preamble":                 true,
+	"skip_thinking":                 true,
+	"response_prefix":               true,
+	"json_schema":                   true,
+	"json_mode":                     true,
+}
+
+// ValidateTemplateFields checks the AdditionalTemplateFields of render options, and
+// returns the fields named like a field the render sets, the fields not in allowed unless
+// it is empty, and the fields whose values cannot be encoded as JSON. Values are passed to
+// the template as their JSON encoding, so e.g. a struct is an object of its JSON fields.
+// RenderCMD3 and RenderCMD4 reject fields with problems, with AllowedTemplateFields as
+// allowed.
+func ValidateTemplateFields(fields map[string]any, allowed []string) ValidationProblems {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ps ValidationProblems
+	atField := func(name string, code ValidationCode, format string, args ...any) {
+		ps = append(ps, ValidationProblem{Code: code, Field: name, Message: fmt.Sprintf("template field %q ", name) + fmt.Sprintf(format, args...)})
+	}
+	for _, name := range names {
+		switch {
+		case reservedTemplateFields[name]:
+			atField(name, ValidationReservedTemplateField, "is reserved for the render")
+		case len(allowed) > 0 && !slices.Contains(allowed, name):
+			atField(name, ValidationDisallowedTemplateField, "is not allowed")
+		}
+		if _, err := json.Marshal(fields[name]); err != nil {
+			atField(name, ValidationInvalidTemplateField, "cannot be encoded as JSON: %v", err)
+		}
+	}
+	return ps
+}
+
+// templateFieldsErr returns the problems of ValidateTemplateFields as an error matching
+// ErrInvalidArgument, nil without problems
+func templateFieldsErr(fields map[string]any, allowed []string) error {
+	ps := ValidateTemplateFields(fields, allowed)
+	if len(ps) == 0 {
+		return nil
+	}
+	return &Error{Kind: ErrorKindInvalidArgument, Message: ps.Err().Error()}
+}
+
+// contentTypeSupported reports whether m can render content of type t. Elided turns stand
+// in for whole turns, so they must be the only content of their message.
+func contentTypeSupported(m Message, t ContentType) bool {
+	switch {
+	case m.Role == RoleTool:
+		return t == ContentText || t == ContentDocument
+	case t == ContentElidedTurns:
+		return len(m.Content) == 1 && len(m.ToolCalls) == 0
+	}
+	return t != ContentDocument
+}
+
+func roleName(r Role) string {
+	switch r {
+	case RoleSystem:
+		return "system"
+	case RoleUser:
+		return "user"
+	case RoleChatbot:
+		return "chatbot"
+	case RoleTool:
+		return "tool"
+	}
+	return fmt.Sprintf("role %d", int32(r))
+}
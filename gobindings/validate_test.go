@@ -0,0 +1,129 @@
+package gobindings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cohere-ai/melody/gobindings/orderedjson"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	params := orderedjson.New()
+	params.Set("type", "object")
+	tools := []Tool{{Name: "search", Parameters: params}, {Name: "search"}, {}}
+	messages := []Message{
+		{Role: RoleUser, Content: []Content{{Type: ContentText, Text: "Hi"}, {Type: ContentDocument, Document: orderedjson.New()}, {Type: ContentImage, Image: &Image{Data: []byte("png")}}}},
+		{Role: RoleUser, ToolCalls: []ToolCall{{ID: "u", Name: "search"}}},
+		{Role: RoleChatbot, ToolCalls: []ToolCall{
+			{ID: "0", Name: "search", Parameters: `{"q": "sky"}`},
+			{ID: "0", Name: "lookup", Parameters: `{"q": `},
+			{Name: "search"},
+		}},
+		{Role: RoleTool, ToolCallID: "0", Content: []Content{{Type: ContentText, Text: "blue"}, {Type: ContentThinking, Thinking: "hm"}}},
+		{Role: RoleTool, Content: []Content{{Type: ContentText, Text: "?"}}},
+		{Role: RoleTool, ToolCallID: "7", Content: []Content{{Type: ContentText, Text: "?"}}},
+		{Role: RoleChatbot, Content: []Content{{Type: ContentText, Text: "Blue."}}, Citations: []FilterCitation{
+			{Text: "Blue", Sources: []Source{{ToolCallIndex: 0, ToolResultIndices: []uint{0, 1}}, {ToolCallIndex: 5}}},
+		}},
+	}
+
+	ps := Validate(messages, tools, nil)
+	codes := make([]ValidationCode, len(ps))
+	at := make([]int, len(ps))
+	for i, p := range ps {
+		codes[i] = p.Code
+		if p.MessageIndex != nil {
+			at[i] = *p.MessageIndex
+		} else {
+			at[i] = -*p.ToolIndex - 1
+		}
+	}
+	require.Equal(t, []ValidationCode{
+		ValidationDuplicateToolName,
+		ValidationEmptyToolName,
+		ValidationInvalidContentType,
+		ValidationUnresolvedImage,
+		ValidationMisplacedToolCalls,
+		ValidationDuplicateToolCallID,
+		ValidationInvalidToolParameters,
+		ValidationUnknownTool,
+		ValidationEmptyToolCallID,
+		ValidationInvalidContentType,
+		ValidationMissingToolCallID,
+		ValidationUnknownToolCallID,
+		ValidationUnknownCitationSource,
+		ValidationUnknownCitationSource,
+	}, codes)
+	require.Equal(t, []int{-2, -3, 0, 0, 1, 2, 2, 2, 2, 3, 4, 5, 6, 6}, at)
+	require.Equal(t, `citation "Blue" cites unknown result 1 of tool call 0`, ps[12].Message[len("message[6] "):])
+
+	err := ps.Err()
+	require.ErrorIs(t, err, ErrInvalidMessages)
+	require.Contains(t, err.Error(), `duplicate_tool_call_id: message[2] tool call[1] has duplicate id "0"`)
+
+	// What Validate accepts renders
+	valid := []Message{messages[2], messages[3], messages[6]}
+	valid[0].ToolCalls = valid[0].ToolCalls[:1]
+	valid[1].Content = valid[1].Content[:1]
+	valid[2].Citations = nil
+	require.NoError(t, Validate(valid, tools[:1], nil).Err())
+	_, err = RenderCMD3(RenderCmd3Options{Messages: valid, AvailableTools: tools[:1]})
+	require.NoError(t, err)
+}
+
+func TestValidateTemplateFields(t *testing.T) {
+	t.Parallel()
+
+	fields := map[string]any{"role": "admin", "messages": "hi", "tone": make(chan int), "date": "today"}
+	ps := ValidateTemplateFields(fields, []string{"date", "tone"})
+	got := make([][2]string, len(ps))
+	for i, p := range ps {
+		got[i] = [2]string{p.Field, string(p.Code)}
+	}
+	require.Equal(t, [][2]string{
+		{"messages", string(ValidationReservedTemplateField)},
+		{"role", string(ValidationDisallowedTemplateField)},
+		{"tone", string(ValidationInvalidTemplateField)},
+	}, got)
+	require.Empty(t, ValidateTemplateFields(map[string]any{"role": "admin"}, nil))
+
+	_, err := RenderCMD3(RenderCmd3Options{AdditionalTemplateFields: map[string]any{"messages": "hi"}})
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	require.Contains(t, err.Error(), `reserved_template_field: template field "messages" is reserved for the render`)
+	_, err = RenderCMD4(RenderCmd4Options{AdditionalTemplateFields: map[string]any{"role": "admin"}, AllowedTemplateFields: []string{"date"}})
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestValidate_ElidedTurns(t *testing.T) {
+	t.Parallel()
+
+	elided := Content{Type: ContentElidedTurns, ElidedTurns: 3}
+	for _, tc := range []struct {
+		name    string
+		message Message
+		valid   bool
+	}{
+		{"alone", Message{Role: RoleChatbot, Content: []Content{elided}}, true},
+		{"with text", Message{Role: RoleUser, Content: []Content{elided, {Type: ContentText, Text: "Hi"}}}, false},
+		{"with tool calls", Message{Role: RoleChatbot, Content: []Content{elided}, ToolCalls: []ToolCall{{ID: "0", Name: "search"}}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Validate agrees with the render
+			ps := Validate([]Message{tc.message}, nil, nil)
+			_, err := RenderCMD3(RenderCmd3Options{Messages: []Message{tc.message}})
+			if tc.valid {
+				require.Empty(t, ps)
+				require.NoError(t, err)
+				return
+			}
+			require.Len(t, ps, 1)
+			require.Equal(t, ValidationInvalidContentType, ps[0].Code)
+			require.Error(t, err)
+		})
+	}
+}
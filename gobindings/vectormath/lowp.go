@@ -0,0 +1,302 @@
+package vectormath
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// BFloat16 is a bfloat16 number: the upper 16 bits of a float32, with 8 bits of exponent
+// and 7 of mantissa
+type BFloat16 uint16
+
+// Float8E4M3 is an 8-bit float with 4 bits of exponent and 3 of mantissa, the OCP E4M3
+// format: it has no infinities, 0x7f and 0xff are NaN and its largest value is 448
+type Float8E4M3 uint8
+
+// Float8E5M2 is an 8-bit float with 5 bits of exponent and 2 of mantissa, the OCP E5M2
+// format: it follows IEEE 754, with infinities, and its largest finite value is 57344
+type Float8E5M2 uint8
+
+// ToBF16 rounds f to the nearest bfloat16, ties to even
+func ToBF16(f float32) BFloat16 {
+	bits := math.Float32bits(f)
+	if math.IsNaN(float64(f)) {
+		// Keep NaN a quiet NaN when its payload is in the dropped bits
+		return BFloat16(bits>>16 | 0x40)
+	}
+	return BFloat16((bits + 0x7fff + (bits>>16)&1) >> 16)
+}
+
+// Float32 returns b as a float32, which is exact
+func (b BFloat16) Float32() float32 {
+	return math.Float32frombits(uint32(b) << 16)
+}
+
+// ToE4M3 rounds f to the nearest E4M3 float, ties to even. Values beyond the largest E4M3
+// value, including infinities, saturate to ±448.
+func ToE4M3(f float32) Float8E4M3 {
+	const maxCode = 0x7e // 448
+	bits := math.Float32bits(f)
+	sign := uint8(bits>>24) & 0x80
+	abs := bits &^ (1 << 31)
+	if abs > 0x7f800000 {
+		return Float8E4M3(sign | 0x7f)
+	}
+	// Infinities saturate with the values beyond the largest exponent
+	return Float8E4M3(sign | min(encodeFloat8(abs, 3, 7), maxCode))
+}
+
+// Float32 returns e as a float32, which is exact
+func (e Float8E4M3) Float32() float32 {
+	return e4m3Values[e]
+}
+
+// ToE5M2 rounds f to the nearest E5M2 float, ties to even. Values beyond the largest finite
+// E5M2 value round to infinity.
+func ToE5M2(f float32) Float8E5M2 {
+	const infCode = 0x7c
+	bits := math.Float32bits(f)
+	sign := uint8(bits>>24) & 0x80
+	abs := bits &^ (1 << 31)
+	if abs > 0x7f800000 {
+		return Float8E5M2(sign | 0x7e)
+	}
+	// Infinities round to infinity with the values beyond the largest exponent
+	return Float8E5M2(sign | min(encodeFloat8(abs, 2, 15), infCode))
+}
+
+// Float32 returns e as a float32, which is exact
+func (e Float8E5M2) Float32() float32 {
+	return e5m2Values[e]
+}
+
+// encodeFloat8 returns the code without sign of the float32 of bits, without sign and not
+// NaN, in an 8-bit float with mbits of mantissa and the exponent bias, rounded to
+// nearest, ties to even. Values beyond the largest exponent return 0x7f.
+func encodeFloat8(bits uint32, mbits int, bias int) uint8 {
+	exp := int(bits >> 23)
+	if exp == 0 {
+		// Zero or a float32 subnormal, far below the 8-bit subnormals
+		return 0
+	}
+	e := exp - 127
+	full := 1<<23 | bits&(1<<23-1)
+	if e < 1-bias {
+		// Subnormal, in steps of the smallest subnormal. Rounding up to 2^mbits steps is
+		// the code of the smallest normal.
+		shift := 23 + (1 - bias - mbits) - e
+		if shift > 24 {
+			return 0
+		}
+		return uint8(roundShift(full, shift))
+	}
+	q := roundShift(full, 23-mbits)
+	if q == 2<<mbits {
+		e++
+		q = 1 << mbits
+	}
+	if (e+bias)<<mbits > 0x7f {
+		return 0x7f
+	}
+	return uint8((e+bias)<<mbits | (int(q) - 1<<mbits))
+}
+
+// roundShift returns v / 2^shift rounded to nearest, ties to even, for v < 2^24. It does
+// not branch, as rounding up is unpredictable.
+func roundShift(v uint32, shift int) uint32 {
+	return (v + 1<<(shift-1) - 1 + (v>>shift)&1) >> shift
+}
+
+// decodeFloat8 returns the value of the code without sign of an 8-bit float with mbits of
+// mantissa and the exponent bias, ignoring the codes of NaN and infinities
+func decodeFloat8(code uint8, mbits int, bias int) float64 {
+	e := int(code) >> mbits
+	m := int(code) & (1<<mbits - 1)
+	if e == 0 {
+		return math.Ldexp(float64(m), 1-bias-mbits)
+	}
+	return math.Ldexp(float64(1<<mbits+m), e-bias-mbits)
+}
+
+var e4m3Values, e5m2Values = float8Tables()
+
+// float8Tables returns the values of every E4M3 and E5M2 code
+func float8Tables() (e4m3, e5m2 [256]float32) {
+	for code := range 256 {
+		c := uint8(code)
+		e4m3[c] = float32(decodeFloat8(c&0x7f, 3, 7))
+		e5m2[c] = float32(decodeFloat8(c&0x7f, 2, 15))
+		if c&0x7f == 0x7f {
+			e4m3[c] = float32(math.NaN())
+		}
+		switch {
+		case c&0x7f > 0x7c:
+			e5m2[c] = float32(math.NaN())
+		case c&0x7f == 0x7c:
+			e5m2[c] = float32(math.Inf(1))
+		}
+		if c&0x80 != 0 {
+			e4m3[c] = -e4m3[c]
+			e5m2[c] = -e5m2[c]
+		}
+	}
+	return e4m3, e5m2
+}
+
+// ConvertF32ToBF16 returns the values rounded to bfloat16
+func ConvertF32ToBF16(xs []float32) []BFloat16 {
+	out := make([]BFloat16, len(xs))
+	for i, x := range xs {
+		out[i] = ToBF16(x)
+	}
+	return out
+}
+
+// ConvertBF16ToF32 returns the bfloat16 values as float32
+func ConvertBF16ToF32(xs []BFloat16) []float32 {
+	out := make([]float32, len(xs))
+	for i, x := range xs {
+		out[i] = x.Float32()
+	}
+	return out
+}
+
+// EncodeE4M3 returns the values rounded to E4M3, see ToE4M3
+func EncodeE4M3(xs []float32) []Float8E4M3 {
+	out := make([]Float8E4M3, len(xs))
+	for i, x := range xs {
+		out[i] = ToE4M3(x)
+	}
+	return out
+}
+
+// DecodeE4M3 returns the E4M3 values as float32
+func DecodeE4M3(xs []Float8E4M3) []float32 {
+	out := make([]float32, len(xs))
+	for i, x := range xs {
+		out[i] = e4m3Values[x]
+	}
+	return out
+}
+
+// EncodeE5M2 returns the values rounded to E5M2, see ToE5M2
+func EncodeE5M2(xs []float32) []Float8E5M2 {
+	out := make([]Float8E5M2, len(xs))
+	for i, x := range xs {
+		out[i] = ToE5M2(x)
+	}
+	return out
+}
+
+// DecodeE5M2 returns the E5M2 values as float32
+func DecodeE5M2(xs []Float8E5M2) []float32 {
+	out := make([]float32, len(xs))
+	for i, x := range xs {
+		out[i] = e5m2Values[x]
+	}
+	return out
+}
+
+// Encoding is the number format of serialized vectors
+type Encoding int
+
+const (
+	// EncodingF32 is little-endian float32
+	EncodingF32 Encoding = iota
+	// EncodingBF16 is little-endian bfloat16
+	EncodingBF16
+	// EncodingE4M3 is E4M3 8-bit floats
+	EncodingE4M3
+	// EncodingE5M2 is E5M2 8-bit floats
+	EncodingE5M2
+)
+
+// Size returns the number of bytes of a value in the encoding, 0 for an unknown encoding
+func (enc Encoding) Size() int {
+	switch enc {
+	case EncodingF32:
+		return 4
+	case EncodingBF16:
+		return 2
+	case EncodingE4M3, EncodingE5M2:
+		return 1
+	}
+	return 0
+}
+
+// littleEndian reports whether the platform is little-endian, where float32 vectors are
+// serialized by copying their memory
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// SerializeToBytes returns the values in the encoding, rounding them to nearest
+func SerializeToBytes(xs []float32, enc Encoding) ([]byte, error) {
+	size := enc.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("unknown encoding %d", enc)
+	}
+	out := make([]byte, len(xs)*size)
+	switch enc {
+	case EncodingF32:
+		if littleEndian {
+			copy(out, unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(xs))), len(out)))
+			break
+		}
+		for i, x := range xs {
+			binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(x))
+		}
+	case EncodingBF16:
+		for i, x := range xs {
+			binary.LittleEndian.PutUint16(out[2*i:], uint16(ToBF16(x)))
+		}
+	case EncodingE4M3:
+		for i, x := range xs {
+			out[i] = uint8(ToE4M3(x))
+		}
+	case EncodingE5M2:
+		for i, x := range xs {
+			out[i] = uint8(ToE5M2(x))
+		}
+	}
+	return out, nil
+}
+
+// DeserializeFromBytes returns the values of b, serialized by SerializeToBytes in the
+// encoding
+func DeserializeFromBytes(b []byte, enc Encoding) ([]float32, error) {
+	size := enc.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("unknown encoding %d", enc)
+	}
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("%d bytes are not a whole number of %d-byte values", len(b), size)
+	}
+	out := make([]float32, len(b)/size)
+	switch enc {
+	case EncodingF32:
+		if littleEndian {
+			copy(unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(out))), len(b)), b)
+			break
+		}
+		for i := range out {
+			out[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+	case EncodingBF16:
+		for i := range out {
+			out[i] = math.Float32frombits(uint32(binary.LittleEndian.Uint16(b[2*i:])) << 16)
+		}
+	case EncodingE4M3:
+		for i, c := range b {
+			out[i] = e4m3Values[c]
+		}
+	case EncodingE5M2:
+		for i, c := range b {
+			out[i] = e5m2Values[c]
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,206 @@
+package vectormath
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLowPrecision(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, BFloat16(0x3f80), ToBF16(1))
+	require.Equal(t, BFloat16(0xc000), ToBF16(-2))
+	// Ties round to even
+	require.Equal(t, BFloat16(0x3f80), ToBF16(math.Float32frombits(0x3f808000)))
+	require.Equal(t, BFloat16(0x3f82), ToBF16(math.Float32frombits(0x3f818000)))
+	require.True(t, math.IsNaN(float64(ToBF16(float32(math.NaN())).Float32())))
+
+	require.Equal(t, Float8E4M3(0x38), ToE4M3(1))
+	require.Equal(t, Float8E4M3(0x7e), ToE4M3(448))
+	require.Equal(t, Float8E4M3(0xfe), ToE4M3(-1000))
+	require.Equal(t, Float8E4M3(0x7e), ToE4M3(float32(math.Inf(1))))
+	require.Equal(t, Float8E4M3(0x01), ToE4M3(0x1p-9))
+	require.Equal(t, Float8E4M3(0x08), ToE4M3(0x1p-6))
+	require.Equal(t, Float8E4M3(0x00), ToE4M3(0x1p-11))
+	require.True(t, math.IsNaN(float64(ToE4M3(float32(math.NaN())).Float32())))
+	require.Equal(t, float32(448), Float8E4M3(0x7e).Float32())
+	require.Equal(t, float32(-0x1p-9), Float8E4M3(0x81).Float32())
+
+	require.Equal(t, Float8E5M2(0x3c), ToE5M2(1))
+	require.Equal(t, Float8E5M2(0x7b), ToE5M2(57344))
+	require.Equal(t, Float8E5M2(0x7c), ToE5M2(61440))
+	require.Equal(t, Float8E5M2(0x01), ToE5M2(0x1p-16))
+	require.True(t, math.IsInf(float64(Float8E5M2(0xfc).Float32()), -1))
+	require.True(t, math.IsNaN(float64(ToE5M2(float32(math.NaN())).Float32())))
+
+	// Every finite code round-trips
+	for code := range 256 {
+		if f := Float8E4M3(code).Float32(); !math.IsNaN(float64(f)) && f != 0 {
+			require.Equal(t, Float8E4M3(code), ToE4M3(f))
+		}
+		if f := Float8E5M2(code).Float32(); !math.IsNaN(float64(f)) && f != 0 {
+			require.Equal(t, Float8E5M2(code), ToE5M2(f))
+		}
+	}
+
+	// Round trips are within half a unit in the last place of the format
+	xs := make([]float32, 10_000)
+	for i := range xs {
+		xs[i] = float32(rand.NormFloat64())
+	}
+	for _, c := range []struct {
+		name      string
+		roundTrip func([]float32) []float32
+		mbits     int
+		// minNormal is the smallest normal value, below it the error is absolute
+		minNormal float64
+	}{
+		{"bf16", func(xs []float32) []float32 { return ConvertBF16ToF32(ConvertF32ToBF16(xs)) }, 7, 0x1p-126},
+		{"e4m3", func(xs []float32) []float32 { return DecodeE4M3(EncodeE4M3(xs)) }, 3, 0x1p-6},
+		{"e5m2", func(xs []float32) []float32 { return DecodeE5M2(EncodeE5M2(xs)) }, 2, 0x1p-14},
+	} {
+		got := c.roundTrip(xs)
+		for i, x := range xs {
+			bound := math.Ldexp(max(math.Abs(float64(x)), c.minNormal), -c.mbits-1)
+			require.LessOrEqual(t, math.Abs(float64(got[i]-x)), bound, "%s: %v became %v", c.name, x, got[i])
+		}
+	}
+
+	for _, enc := range []Encoding{EncodingF32, EncodingBF16, EncodingE4M3, EncodingE5M2} {
+		b, err := SerializeToBytes(xs, enc)
+		require.NoError(t, err)
+		require.Len(t, b, len(xs)*enc.Size())
+		got, err := DeserializeFromBytes(b, enc)
+		require.NoError(t, err)
+		switch enc {
+		case EncodingF32:
+			require.Equal(t, xs, got)
+		case EncodingBF16:
+			require.Equal(t, ConvertBF16ToF32(ConvertF32ToBF16(xs)), got)
+		case EncodingE4M3:
+			require.Equal(t, DecodeE4M3(EncodeE4M3(xs)), got)
+		case EncodingE5M2:
+			require.Equal(t, DecodeE5M2(EncodeE5M2(xs)), got)
+		}
+	}
+	_, err := DeserializeFromBytes([]byte{1, 2, 3}, EncodingBF16)
+	require.EqualError(t, err, "3 bytes are not a whole number of 2-byte values")
+	_, err = SerializeToBytes(xs, Encoding(9))
+	require.EqualError(t, err, "unknown encoding 9")
+}
+
+// serializeReference serializes the values one at a time, as SerializeToBytes must
+func serializeReference(xs []float32, enc Encoding) []byte {
+	var out []byte
+	for _, x := range xs {
+		switch enc {
+		case EncodingF32:
+			out = binary.LittleEndian.AppendUint32(out, math.Float32bits(x))
+		case EncodingBF16:
+			out = binary.LittleEndian.AppendUint16(out, uint16(ToBF16(x)))
+		case EncodingE4M3:
+			out = append(out, uint8(ToE4M3(x)))
+		case EncodingE5M2:
+			out = append(out, uint8(ToE5M2(x)))
+		}
+	}
+	return out
+}
+
+func TestSerializeToBytes_Reference(t *testing.T) {
+	t.Parallel()
+
+	xs := []float32{0, 1, -2.5, float32(math.Inf(1)), 0x1p-130, 3.4e38, 1e-3}
+	for _, enc := range []Encoding{EncodingF32, EncodingBF16, EncodingE4M3, EncodingE5M2} {
+		want := serializeReference(xs, enc)
+		got, err := SerializeToBytes(xs, enc)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "encoding %d", enc)
+
+		values, err := DeserializeFromBytes(want, enc)
+		require.NoError(t, err)
+		for i, v := range values {
+			require.Equal(t, want[i*enc.Size():(i+1)*enc.Size()], serializeReference([]float32{v}, enc), "encoding %d", enc)
+		}
+	}
+	got, err := SerializeToBytes(nil, EncodingF32)
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+// BenchmarkSerializeToBytes measures the serialization of 4M floats
+func BenchmarkSerializeToBytes(b *testing.B) {
+	xs := make([]float32, 4<<20)
+	for i := range xs {
+		xs[i] = float32(rand.NormFloat64())
+	}
+	for _, enc := range []Encoding{EncodingF32, EncodingBF16, EncodingE4M3} {
+		b.Run(fmt.Sprintf("encoding=%d", enc), func(b *testing.B) {
+			b.SetBytes(int64(4 * len(xs)))
+			for b.Loop() {
+				if _, err := SerializeToBytes(xs, enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDeserializeFromBytes measures the deserialization of 4M floats
+func BenchmarkDeserializeFromBytes(b *testing.B) {
+	xs := make([]float32, 4<<20)
+	for i := range xs {
+		xs[i] = float32(rand.NormFloat64())
+	}
+	for _, enc := range []Encoding{EncodingF32, EncodingBF16, EncodingE4M3} {
+		data, err := SerializeToBytes(xs, enc)
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("encoding=%d", enc), func(b *testing.B) {
+			b.SetBytes(int64(4 * len(xs)))
+			for b.Loop() {
+				if _, err := DeserializeFromBytes(data, enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// nearestFloat8 returns the finite code of values nearest to x >= 0, ties to the even code
+func nearestFloat8(x float32, values *[256]float32) uint8 {
+	best, bestDiff := uint8(0), math.Inf(1)
+	for code := range 0x80 {
+		v := float64(values[code])
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		diff := math.Abs(v - float64(x))
+		if diff < bestDiff || diff == bestDiff && code%2 == 0 {
+			best, bestDiff = uint8(code), diff
+		}
+	}
+	return best
+}
+
+func TestFloat8_Nearest(t *testing.T) {
+	t.Parallel()
+
+	xs := []float32{0x1p-10, 0x3p-11, 0x1p-17, 0x3p-18, 0x1p-7 * 15, 464, 480, 1e-30}
+	for range 20_000 {
+		xs = append(xs, float32(math.Ldexp(rand.Float64(), rand.IntN(40)-24)))
+	}
+	for _, x := range xs {
+		require.Equal(t, Float8E4M3(nearestFloat8(x, &e4m3Values)), ToE4M3(x), "%v", x)
+		want := Float8E5M2(nearestFloat8(x, &e5m2Values))
+		if x >= 61440 {
+			want = 0x7c
+		}
+		require.Equal(t, want, ToE5M2(x), "%v", x)
+		require.Equal(t, 0x80|want, ToE5M2(-x), "%v", x)
+	}
+}
@@ -0,0 +1,140 @@
+package vectormath
+
+import "fmt"
+
+// Tensor2D is a row-major matrix view of a buffer, e.g. the logits of a batch of sequences
+// or a matrix of embeddings. Views made with ReshapeView, SliceRows and SliceCols share the
+// buffer rather than copying it, so writes through one view are seen by the others.
+//
+// Consecutive rows start stride values apart in the buffer, the stride is larger than the
+// number of columns in a view of some of the columns of a matrix.
+type Tensor2D[T any] struct {
+	data   []T
+	rows   int
+	cols   int
+	stride int
+}
+
+// NewTensor2D returns a rows x cols view of the first rows*cols values of data
+func NewTensor2D[T any](data []T, rows, cols int) (Tensor2D[T], error) {
+	if rows < 0 || cols < 0 {
+		return Tensor2D[T]{}, fmt.Errorf("invalid shape %dx%d", rows, cols)
+	}
+	if len(data) < rows*cols {
+		return Tensor2D[T]{}, fmt.Errorf("%d values are too few for shape %dx%d", len(data), rows, cols)
+	}
+	return Tensor2D[T]{data: data[:rows*cols], rows: rows, cols: cols, stride: cols}, nil
+}
+
+// TensorFromRows returns a matrix of a copy of the rows, which must have the same length
+func TensorFromRows[T any](rows [][]T) (Tensor2D[T], error) {
+	cols := 0
+	if len(rows) > 0 {
+		cols = len(rows[0])
+	}
+	for i, row := range rows {
+		if len(row) != cols {
+			return Tensor2D[T]{}, fmt.Errorf("row %d has %d values, row 0 has %d", i, len(row), cols)
+		}
+	}
+	return NewTensor2D(Flatten(rows), len(rows), cols)
+}
+
+// Rows returns the number of rows
+func (t Tensor2D[T]) Rows() int { return t.rows }
+
+// Cols returns the number of columns
+func (t Tensor2D[T]) Cols() int { return t.cols }
+
+// Contiguous reports whether the rows of the view follow each other in the buffer, which
+// ReshapeView requires
+func (t Tensor2D[T]) Contiguous() bool {
+	return t.stride == t.cols || t.rows <= 1
+}
+
+// At returns the value at row i and column j
+func (t Tensor2D[T]) At(i, j int) T {
+	t.check(i, j)
+	return t.data[i*t.stride+j]
+}
+
+// Set sets the value at row i and column j
+func (t Tensor2D[T]) Set(i, j int, v T) {
+	t.check(i, j)
+	t.data[i*t.stride+j] = v
+}
+
+func (t Tensor2D[T]) check(i, j int) {
+	if i < 0 || i >= t.rows || j < 0 || j >= t.cols {
+		panic(fmt.Sprintf("vectormath: index [%d, %d] out of range for shape %dx%d", i, j, t.rows, t.cols))
+	}
+}
+
+// Row returns row i, which shares the buffer
+func (t Tensor2D[T]) Row(i int) []T {
+	if i < 0 || i >= t.rows {
+		panic(fmt.Sprintf("vectormath: row %d out of range for %d rows", i, t.rows))
+	}
+	start := i * t.stride
+	return t.data[start : start+t.cols : start+t.cols]
+}
+
+// Col returns a copy of column j, whose values are not contiguous in the buffer
+func (t Tensor2D[T]) Col(j int) []T {
+	if j < 0 || j >= t.cols {
+		panic(fmt.Sprintf("vectormath: column %d out of range for %d columns", j, t.cols))
+	}
+	out := make([]T, t.rows)
+	for i := range out {
+		out[i] = t.data[i*t.stride+j]
+	}
+	return out
+}
+
+// SliceRows returns the view of rows [start, end)
+func (t Tensor2D[T]) SliceRows(start, end int) Tensor2D[T] {
+	if start < 0 || end < start || end > t.rows {
+		panic(fmt.Sprintf("vectormath: rows [%d:%d] out of range for %d rows", start, end, t.rows))
+	}
+	if start == end {
+		return Tensor2D[T]{cols: t.cols, stride: t.stride}
+	}
+	return Tensor2D[T]{data: t.data[start*t.stride : (end-1)*t.stride+t.cols], rows: end - start, cols: t.cols, stride: t.stride}
+}
+
+// SliceCols returns the view of columns [start, end) of every row
+func (t Tensor2D[T]) SliceCols(start, end int) Tensor2D[T] {
+	if start < 0 || end < start || end > t.cols {
+		panic(fmt.Sprintf("vectormath: columns [%d:%d] out of range for %d columns", start, end, t.cols))
+	}
+	if t.rows == 0 || start == end {
+		return Tensor2D[T]{rows: t.rows, stride: t.stride}
+	}
+	return Tensor2D[T]{data: t.data[start : (t.rows-1)*t.stride+end], rows: t.rows, cols: end - start, stride: t.stride}
+}
+
+// ReshapeView returns the values of the view as a rows x cols matrix sharing the buffer.
+// The shape must have as many values, and the view must be Contiguous.
+func (t Tensor2D[T]) ReshapeView(rows, cols int) (Tensor2D[T], error) {
+	if !t.Contiguous() {
+		return Tensor2D[T]{}, fmt.Errorf("cannot reshape a view of %d of %d columns without copying", t.cols, t.stride)
+	}
+	if rows < 0 || cols < 0 || rows*cols != t.rows*t.cols {
+		return Tensor2D[T]{}, fmt.Errorf("cannot reshape %dx%d to %dx%d", t.rows, t.cols, rows, cols)
+	}
+	return Tensor2D[T]{data: t.data[:rows*cols], rows: rows, cols: cols, stride: cols}, nil
+}
+
+// ToRows returns the rows, which share the buffer
+func (t Tensor2D[T]) ToRows() [][]T {
+	out := make([][]T, t.rows)
+	for i := range out {
+		out[i] = t.Row(i)
+	}
+	return out
+}
+
+// Flatten returns a copy of the values in row-major order
+func (t Tensor2D[T]) Flatten() []T {
+	return Flatten(t.ToRows())
+}
@@ -0,0 +1,57 @@
+package vectormath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTensor2D(t *testing.T) {
+	t.Parallel()
+
+	data := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	m, err := NewTensor2D(data, 3, 4)
+	require.NoError(t, err)
+	require.Equal(t, [][]int{{0, 1, 2, 3}, {4, 5, 6, 7}, {8, 9, 10, 11}}, m.ToRows())
+	require.Equal(t, []int{4, 5, 6, 7}, m.Row(1))
+	require.Equal(t, []int{2, 6, 10}, m.Col(2))
+	require.Equal(t, 9, m.At(2, 1))
+
+	// Views share the buffer
+	rows := m.SliceRows(1, 3)
+	require.Equal(t, [][]int{{4, 5, 6, 7}, {8, 9, 10, 11}}, rows.ToRows())
+	rows.Set(0, 0, 40)
+	require.Equal(t, 40, data[4])
+
+	cols := m.SliceCols(1, 3)
+	require.False(t, cols.Contiguous())
+	require.Equal(t, [][]int{{1, 2}, {5, 6}, {9, 10}}, cols.ToRows())
+	require.Equal(t, [][]int{{5, 6}}, cols.SliceRows(1, 2).ToRows())
+	require.Equal(t, []int{1, 2, 5, 6, 9, 10}, cols.Flatten())
+	_, err = cols.ReshapeView(2, 3)
+	require.EqualError(t, err, "cannot reshape a view of 2 of 4 columns without copying")
+
+	r, err := m.ReshapeView(2, 6)
+	require.NoError(t, err)
+	require.Equal(t, []int{6, 7, 8, 9, 10, 11}, r.Row(1))
+	r.Set(1, 0, 60)
+	require.Equal(t, 60, m.At(1, 2))
+	_, err = m.ReshapeView(5, 2)
+	require.EqualError(t, err, "cannot reshape 3x4 to 5x2")
+
+	_, err = NewTensor2D(data, 4, 4)
+	require.EqualError(t, err, "12 values are too few for shape 4x4")
+	require.Panics(t, func() { m.At(3, 0) })
+	require.Panics(t, func() { m.SliceCols(2, 5) })
+	require.Equal(t, 0, m.SliceRows(2, 2).Rows())
+
+	// Rows are copied into a matrix
+	src := [][]float32{{1, 2}, {3, 4}}
+	f, err := TensorFromRows(src)
+	require.NoError(t, err)
+	f.Set(0, 0, 10)
+	require.Equal(t, float32(1), src[0][0])
+	require.Equal(t, [][]float32{{10, 2}, {3, 4}}, f.ToRows())
+	_, err = TensorFromRows([][]float32{{1, 2}, {3}})
+	require.EqualError(t, err, "row 1 has 1 values, row 0 has 2")
+}
@@ -0,0 +1,217 @@
+// Package vectormath computes the softmax and the top values of logits vectors, e.g. to
+// turn the logits of a sampling step into the log probabilities written to a filter with
+// TokenIDsWithLogProb, and sums, flattens and converts embedding-sized vectors, also to
+// and from the bfloat16 and 8-bit float formats they are stored in.
+//
+// The functions are numerically stable: exponentials are taken of the values minus their
+// maximum, so large logits do not overflow. They compute in float64 and return values of
+// the type of their input. The loops over long vectors are unrolled, with independent
+// accumulators, so the compiler can pipeline them without assembly or unsafe.
+package vectormath
+
+import (
+	"container/heap"
+	"math"
+)
+
+// Float is the element type of the vectors
+type Float interface {
+	~float32 | ~float64
+}
+
+// Sum returns the sum of the values
+func Sum[F Float](xs []F) F {
+	var s0, s1, s2, s3 float64
+	i := 0
+	for ; i+4 <= len(xs); i += 4 {
+		v := xs[i : i+4 : i+4]
+		s0 += float64(v[0])
+		s1 += float64(v[1])
+		s2 += float64(v[2])
+		s3 += float64(v[3])
+	}
+	for ; i < len(xs); i++ {
+		s0 += float64(xs[i])
+	}
+	return F((s0 + s1) + (s2 + s3))
+}
+
+// Flatten returns the rows concatenated into a single vector, e.g. a matrix of embeddings
+// in row-major order
+func Flatten[F any](rows [][]F) []F {
+	n := 0
+	for _, row := range rows {
+		n += len(row)
+	}
+	out := make([]F, 0, n)
+	for _, row := range rows {
+		out = append(out, row...)
+	}
+	return out
+}
+
+// Convert returns the values converted to another float type, e.g. float64 embeddings to
+// float32
+func Convert[To, From Float](xs []From) []To {
+	out := make([]To, len(xs))
+	i := 0
+	for ; i+8 <= len(xs); i += 8 {
+		src := xs[i : i+8 : i+8]
+		dst := out[i : i+8 : i+8]
+		dst[0] = To(src[0])
+		dst[1] = To(src[1])
+		dst[2] = To(src[2])
+		dst[3] = To(src[3])
+		dst[4] = To(src[4])
+		dst[5] = To(src[5])
+		dst[6] = To(src[6])
+		dst[7] = To(src[7])
+	}
+	for ; i < len(xs); i++ {
+		out[i] = To(xs[i])
+	}
+	return out
+}
+
+// LogSumExp returns log(sum(exp(x))) of the values, -Inf for no values
+func LogSumExp[F Float](xs []F) F {
+	return F(logSumExp(xs))
+}
+
+func logSumExp[F Float](xs []F) float64 {
+	maxX := math.Inf(-1)
+	for _, x := range xs {
+		maxX = max(maxX, float64(x))
+	}
+	if math.IsInf(maxX, 0) {
+		// All values are -Inf, or one is +Inf
+		return maxX
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += math.Exp(float64(x) - maxX)
+	}
+	return maxX + math.Log(sum)
+}
+
+// Softmax returns the probabilities exp(x) / sum(exp(x)) of the values. The values that
+// are +Inf share the probability equally, the others having none, and if all the values
+// are -Inf none has any probability: Softmax returns zeros.
+func Softmax[F Float](xs []F) []F {
+	lse := logSumExp(xs)
+	out := make([]F, len(xs))
+	switch {
+	case math.IsInf(lse, 1):
+		p := 1 / float64(countPosInf(xs))
+		for i, x := range xs {
+			if math.IsInf(float64(x), 1) {
+				out[i] = F(p)
+			}
+		}
+	case math.IsInf(lse, -1):
+	default:
+		for i, x := range xs {
+			out[i] = F(math.Exp(float64(x) - lse))
+		}
+	}
+	return out
+}
+
+// LogSoftmax returns the log probabilities x - log(sum(exp(x))) of the values, which is
+// more precise than the log of Softmax for unlikely values. The infinite values are
+// handled as by Softmax: the log probabilities are -Inf if all the values are -Inf.
+func LogSoftmax[F Float](xs []F) []F {
+	lse := logSumExp(xs)
+	out := make([]F, len(xs))
+	switch {
+	case math.IsInf(lse, 1):
+		logP := -math.Log(float64(countPosInf(xs)))
+		for i, x := range xs {
+			out[i] = F(math.Inf(-1))
+			if math.IsInf(float64(x), 1) {
+				out[i] = F(logP)
+			}
+		}
+	case math.IsInf(lse, -1):
+		for i := range out {
+			out[i] = F(math.Inf(-1))
+		}
+	default:
+		for i, x := range xs {
+			out[i] = F(float64(x) - lse)
+		}
+	}
+	return out
+}
+
+// countPosInf returns the number of values that are +Inf
+func countPosInf[F Float](xs []F) int {
+	n := 0
+	for _, x := range xs {
+		if math.IsInf(float64(x), 1) {
+			n++
+		}
+	}
+	return n
+}
+
+// TopK returns the k largest values in descending order and their indices. Equal values
+// are ordered by index, and NaN values are smaller than any other. All the values are
+// returned if there are fewer than k.
+func TopK[F Float](xs []F, k int) (values []F, indices []int) {
+	k = min(k, len(xs))
+	if k <= 0 {
+		return nil, nil
+	}
+
+	// h holds the k largest values seen so far, the smallest on top
+	h := &topHeap[F]{xs: xs, indices: make([]int, 0, k)}
+	for i := range xs {
+		if len(h.indices) < k {
+			heap.Push(h, i)
+		} else if h.less(h.indices[0], i) {
+			h.indices[0] = i
+			heap.Fix(h, 0)
+		}
+	}
+
+	indices = make([]int, k)
+	values = make([]F, k)
+	for i := k - 1; i >= 0; i-- {
+		indices[i] = heap.Pop(h).(int)
+		values[i] = xs[indices[i]]
+	}
+	return values, indices
+}
+
+// topHeap is a min-heap of indices of xs, ordered by value then by descending index so
+// that the value popped first is the one ranked last
+type topHeap[F Float] struct {
+	xs      []F
+	indices []int
+}
+
+// less reports whether the value at index i ranks below the one at index j
+func (h *topHeap[F]) less(i, j int) bool {
+	a, b := float64(h.xs[i]), float64(h.xs[j])
+	switch {
+	case math.IsNaN(a):
+		return !math.IsNaN(b) || i > j
+	case math.IsNaN(b):
+		return false
+	case a != b:
+		return a < b
+	}
+	return i > j
+}
+
+func (h *topHeap[F]) Len() int           { return len(h.indices) }
+func (h *topHeap[F]) Less(i, j int) bool { return h.less(h.indices[i], h.indices[j]) }
+func (h *topHeap[F]) Swap(i, j int)      { h.indices[i], h.indices[j] = h.indices[j], h.indices[i] }
+func (h *topHeap[F]) Push(x any)         { h.indices = append(h.indices, x.(int)) }
+
+func (h *topHeap[F]) Pop() any {
+	last := h.indices[len(h.indices)-1]
+	h.indices = h.indices[:len(h.indices)-1]
+	return last
+}
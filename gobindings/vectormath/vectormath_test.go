@@ -0,0 +1,166 @@
+package vectormath
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSoftmax(t *testing.T) {
+	t.Parallel()
+
+	require.InDeltaSlice(t, []float64{0.09003057, 0.24472847, 0.66524096}, Softmax([]float64{1, 2, 3}), 1e-8)
+	// Large logits do not overflow
+	require.InDeltaSlice(t, []float32{0.5, 0.5}, Softmax([]float32{1000, 1000}), 1e-6)
+	require.InDeltaSlice(t, []float64{math.Log(0.5), math.Log(0.5)}, LogSoftmax([]float64{1000, 1000}), 1e-12)
+	// Unlikely values keep their log probability
+	require.InDelta(t, -2000, LogSoftmax([]float64{0, -2000})[1], 1e-9)
+	require.Empty(t, Softmax([]float64{}))
+
+	require.InDelta(t, 3.40760596, LogSumExp([]float64{1, 2, 3}), 1e-8)
+	require.InDelta(t, float32(1000+math.Ln2), LogSumExp([]float32{1000, 1000}), 1e-3)
+	require.True(t, math.IsInf(LogSumExp([]float64{}), -1))
+	require.True(t, math.IsInf(LogSumExp([]float64{math.Inf(-1), math.Inf(-1)}), -1))
+	require.Equal(t, []float64{0, 1}, Softmax([]float64{math.Inf(-1), 0}))
+
+	// +Inf values share the probability
+	inf := math.Inf(1)
+	require.Equal(t, []float64{0.5, 0, 0.5}, Softmax([]float64{inf, 1000, inf}))
+	require.Equal(t, []float32{0, 1}, Softmax([]float32{float32(math.Inf(-1)), float32(inf)}))
+	require.Equal(t, []float64{-math.Ln2, math.Inf(-1), -math.Ln2}, LogSoftmax([]float64{inf, 1000, inf}))
+	// All -Inf values have no probability
+	require.Equal(t, []float64{0, 0}, Softmax([]float64{-inf, -inf}))
+	require.Equal(t, []float64{-inf, -inf}, LogSoftmax([]float64{-inf, -inf}))
+}
+
+func TestTopK(t *testing.T) {
+	t.Parallel()
+
+	xs := []float32{0.1, 3, float32(math.NaN()), 2, 3, -1}
+	values, indices := TopK(xs, 3)
+	require.Equal(t, []float32{3, 3, 2}, values)
+	require.Equal(t, []int{1, 4, 3}, indices)
+
+	values, indices = TopK(xs, 10)
+	require.Equal(t, []int{1, 4, 3, 0, 5, 2}, indices)
+	require.Len(t, values, 6)
+
+	values, indices = TopK(xs, 0)
+	require.Nil(t, values)
+	require.Nil(t, indices)
+}
+
+// BenchmarkTopK measures TopK over a vocabulary-sized logits vector
+func BenchmarkTopK(b *testing.B) {
+	logits := make([]float32, 256_000)
+	for i := range logits {
+		logits[i] = rand.Float32() * 20
+	}
+	for _, k := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("k=%d", k), func(b *testing.B) {
+			for b.Loop() {
+				TopK(logits, k)
+			}
+		})
+	}
+}
+
+// BenchmarkLogSoftmax measures LogSoftmax over a vocabulary-sized logits vector
+func BenchmarkLogSoftmax(b *testing.B) {
+	logits := make([]float32, 256_000)
+	for i := range logits {
+		logits[i] = rand.Float32() * 20
+	}
+	for b.Loop() {
+		LogSoftmax(logits)
+	}
+}
+
+func TestSumFlattenConvert(t *testing.T) {
+	t.Parallel()
+
+	xs := []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10.5}
+	require.InDelta(t, float32(55.5), Sum(xs), 1e-6)
+	require.Zero(t, Sum([]float64{}))
+	// The sum is accumulated in float64
+	require.Equal(t, float32(1<<24+2), Sum([]float32{1 << 24, 1, 1}))
+
+	require.Equal(t, []int{1, 2, 3, 4}, Flatten([][]int{{1, 2}, {}, {3}, {4}}))
+	require.Empty(t, Flatten[int](nil))
+
+	require.Equal(t, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10.5}, Convert[float64](xs))
+	require.Equal(t, []float32{}, Convert[float32]([]float64{}))
+}
+
+// embeddings are vectors of the size of embeddings
+func embeddings(rows int) [][]float32 {
+	out := make([][]float32, rows)
+	for i := range out {
+		out[i] = make([]float32, 4096)
+		for j := range out[i] {
+			out[i][j] = rand.Float32()
+		}
+	}
+	return out
+}
+
+// BenchmarkSum compares Sum to a scalar loop
+func BenchmarkSum(b *testing.B) {
+	xs := embeddings(1)[0]
+	b.SetBytes(int64(4 * len(xs)))
+	b.Run("scalar", func(b *testing.B) {
+		for b.Loop() {
+			var s float64
+			for _, x := range xs {
+				s += float64(x)
+			}
+			_ = s
+		}
+	})
+	b.Run("unrolled", func(b *testing.B) {
+		for b.Loop() {
+			Sum(xs)
+		}
+	})
+}
+
+// BenchmarkFlatten compares Flatten to appending the rows to an empty slice
+func BenchmarkFlatten(b *testing.B) {
+	rows := embeddings(1000)
+	b.SetBytes(int64(4 * 4096 * len(rows)))
+	b.Run("append", func(b *testing.B) {
+		for b.Loop() {
+			var out []float32
+			for _, row := range rows {
+				out = append(out, row...)
+			}
+		}
+	})
+	b.Run("preallocated", func(b *testing.B) {
+		for b.Loop() {
+			Flatten(rows)
+		}
+	})
+}
+
+// BenchmarkConvert compares Convert to a scalar loop
+func BenchmarkConvert(b *testing.B) {
+	xs := Convert[float64](embeddings(1)[0])
+	b.SetBytes(int64(8 * len(xs)))
+	b.Run("scalar", func(b *testing.B) {
+		for b.Loop() {
+			out := make([]float32, len(xs))
+			for i, x := range xs {
+				out[i] = float32(x)
+			}
+		}
+	})
+	b.Run("chunked", func(b *testing.B) {
+		for b.Loop() {
+			Convert[float32](xs)
+		}
+	})
+}
@@ -0,0 +1,403 @@
+// Package wire is a compact encoding of filter outputs for streams with a high token rate.
+// With a chunk size of 1, most outputs carry a few bytes of text or of tool call
+// parameters, and their JSON is mostly field names. The wire encoding writes them as
+// tag-length-value records instead:
+//
+//	enc := wire.NewEncoder(w)
+//	for _, o := range outputs {
+//		if err := enc.Encode(o); err != nil {
+//			return err
+//		}
+//	}
+//
+// and a Decoder reads them back. An output is one record or more, every record but its
+// last having the continuation bit of its tag set. A record is its tag, the length of its
+// value as a uvarint and its value:
+//
+//   - TagText holds the text of the output
+//   - TagMode holds the flags and the plan index of the outputs, written only when they
+//     change from those of the previous output
+//   - TagCitation holds a citation as JSON
+//   - TagToolDelta holds a tool call delta, its index then fields of its own
+//   - TagLogprobs holds the token IDs and log probabilities of the output
+//   - TagOutput holds the whole output as JSON, for outputs with other fields
+//
+// Encoders and decoders keep the mode of the stream, so a stream is decoded from its
+// start. The encoding is binary; SSE streams carry it in base64.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+)
+
+// Tag is the type of a record
+type Tag byte
+
+const (
+	TagText Tag = iota + 1
+	TagMode
+	TagCitation
+	TagToolDelta
+	TagLogprobs
+	TagOutput
+)
+
+// tagMore is the continuation bit of a tag, set when the output has more records
+const tagMore Tag = 0x80
+
+// Flags of TagMode
+const (
+	modeReasoning byte = 1 << iota
+	modePostAnswer
+	modeEcho
+)
+
+// Fields of TagToolDelta
+const (
+	toolID byte = iota + 1
+	toolName
+	toolRawParamDelta
+	toolParamName
+	toolParamValueDelta
+	toolParamPath
+	toolIDSynthesized
+)
+
+// maxRecord is the length of the longest record value a Decoder reads
+const maxRecord = 64 << 20
+
+// mode is the flags and the plan index of an output
+type mode struct {
+	flags byte
+	plan  uint
+}
+
+func outputMode(o melody.FilterOutput) mode {
+	m := mode{plan: o.PlanIndex}
+	if o.IsReasoning {
+		m.flags |= modeReasoning
+	}
+	if o.IsPostAnswer {
+		m.flags |= modePostAnswer
+	}
+	if o.IsEcho {
+		m.flags |= modeEcho
+	}
+	return m
+}
+
+func (m mode) apply(o *melody.FilterOutput) {
+	o.IsReasoning = m.flags&modeReasoning != 0
+	o.IsPostAnswer = m.flags&modePostAnswer != 0
+	o.IsEcho = m.flags&modeEcho != 0
+	o.PlanIndex = m.plan
+}
+
+type record struct {
+	tag   Tag
+	value []byte
+}
+
+// Encoder writes filter outputs in the wire encoding
+type Encoder struct {
+	w    io.Writer
+	mode mode
+	buf  []byte
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes o as the next output of the stream
+func (e *Encoder) Encode(o melody.FilterOutput) error {
+	records, err := e.records(o)
+	if err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	for i, r := range records {
+		tag := r.tag
+		if i < len(records)-1 {
+			tag |= tagMore
+		}
+		e.buf = append(e.buf, byte(tag))
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(r.value)))
+		e.buf = append(e.buf, r.value...)
+	}
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+// records returns the records of o, a single TagOutput when it has fields without a
+// record of their own
+func (e *Encoder) records(o melody.FilterOutput) ([]record, error) {
+	if !compact(o) {
+		value, err := json.Marshal(o)
+		if err != nil {
+			return nil, fmt.Errorf("encoding output: %w", err)
+		}
+		return []record{{tag: TagOutput, value: value}}, nil
+	}
+
+	var records []record
+	if m := outputMode(o); m != e.mode {
+		value := binary.AppendUvarint([]byte{m.flags}, uint64(m.plan))
+		records = append(records, record{tag: TagMode, value: value})
+		e.mode = m
+	}
+	if len(o.Logprobs.TokenIDs) > 0 {
+		records = append(records, record{tag: TagLogprobs, value: appendLogprobs(nil, o.Logprobs)})
+	}
+	for _, c := range o.Citations {
+		value, err := json.Marshal(c)
+		if err != nil {
+			return nil, fmt.Errorf("encoding citation: %w", err)
+		}
+		records = append(records, record{tag: TagCitation, value: value})
+	}
+	if d := o.ToolCallDelta; d != nil {
+		records = append(records, record{tag: TagToolDelta, value: appendToolDelta(nil, d)})
+	}
+	if o.Text != "" || len(records) == 0 {
+		records = append(records, record{tag: TagText, value: []byte(o.Text)})
+	}
+	return records, nil
+}
+
+// compact reports whether o has only fields with records of their own
+func compact(o melody.FilterOutput) bool {
+	if len(o.Logprobs.TopLogProbs) > 0 || len(o.Logprobs.TokenIDs) != len(o.Logprobs.Logprobs) {
+		return false
+	}
+	// The records do not tell empty logprobs from none
+	if o.Logprobs.TokenIDs != nil && len(o.Logprobs.TokenIDs) == 0 {
+		return false
+	}
+	o.Text, o.Logprobs, o.Citations, o.ToolCallDelta = "", melody.TokenIDsWithLogProb{}, nil, nil
+	o.IsReasoning, o.IsPostAnswer, o.IsEcho, o.PlanIndex = false, false, false, 0
+	return reflect.ValueOf(o).IsZero()
+}
+
+func appendLogprobs(b []byte, l melody.TokenIDsWithLogProb) []byte {
+	b = binary.AppendUvarint(b, uint64(len(l.TokenIDs)))
+	for i, id := range l.TokenIDs {
+		b = binary.AppendUvarint(b, uint64(id))
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(l.Logprobs[i]))
+	}
+	return b
+}
+
+func appendToolDelta(b []byte, d *melody.FilterToolCallDelta) []byte {
+	b = binary.AppendUvarint(b, uint64(d.Index))
+	field := func(f byte, s string) {
+		if s != "" {
+			b = append(b, f)
+			b = binary.AppendUvarint(b, uint64(len(s)))
+			b = append(b, s...)
+		}
+	}
+	field(toolID, d.ID)
+	field(toolName, d.Name)
+	field(toolRawParamDelta, d.RawParamDelta)
+	if p := d.ParamDelta; p != nil {
+		// The name is written even if empty, it marks the parameter delta
+		b = append(b, toolParamName)
+		b = binary.AppendUvarint(b, uint64(len(p.Name)))
+		b = append(b, p.Name...)
+		field(toolParamValueDelta, p.ValueDelta)
+		for _, key := range p.Path {
+			b = append(b, toolParamPath)
+			b = binary.AppendUvarint(b, uint64(len(key)))
+			b = append(b, key...)
+		}
+	}
+	if d.IDSynthesized {
+		b = append(b, toolIDSynthesized, 0)
+	}
+	return b
+}
+
+// Decoder reads filter outputs in the wire encoding
+type Decoder struct {
+	r    *bufio.Reader
+	mode mode
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next output of the stream. It returns io.EOF at the end of the stream,
+// and io.ErrUnexpectedEOF if the stream ends within an output.
+func (d *Decoder) Decode() (melody.FilterOutput, error) {
+	var o melody.FilterOutput
+	for first := true; ; first = false {
+		tag, value, err := d.record()
+		if err != nil {
+			if first && errors.Is(err, io.EOF) {
+				return melody.FilterOutput{}, io.EOF
+			}
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return melody.FilterOutput{}, err
+		}
+		if err := d.read(&o, tag&^tagMore, value); err != nil {
+			return melody.FilterOutput{}, err
+		}
+		if tag&tagMore == 0 {
+			return o, nil
+		}
+	}
+}
+
+// record reads the next record. It returns io.EOF only if the stream ends before it.
+func (d *Decoder) record() (Tag, []byte, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, nil, noEOF(err)
+	}
+	if n > maxRecord {
+		return 0, nil, fmt.Errorf("record of %d bytes exceeds the maximum of %d", n, maxRecord)
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(d.r, value); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return Tag(tag), value, nil
+}
+
+// read sets the fields of the record on o
+func (d *Decoder) read(o *melody.FilterOutput, tag Tag, value []byte) error {
+	switch tag {
+	case TagText:
+		d.mode.apply(o)
+		o.Text = string(value)
+	case TagMode:
+		if len(value) == 0 {
+			return errors.New("empty mode record")
+		}
+		plan, n := binary.Uvarint(value[1:])
+		if n <= 0 {
+			return errors.New("invalid plan index in mode record")
+		}
+		d.mode = mode{flags: value[0], plan: uint(plan)}
+		d.mode.apply(o)
+	case TagCitation:
+		var c melody.FilterCitation
+		if err := json.Unmarshal(value, &c); err != nil {
+			return fmt.Errorf("decoding citation: %w", err)
+		}
+		d.mode.apply(o)
+		o.Citations = append(o.Citations, c)
+	case TagToolDelta:
+		delta, err := readToolDelta(value)
+		if err != nil {
+			return err
+		}
+		d.mode.apply(o)
+		o.ToolCallDelta = delta
+	case TagLogprobs:
+		logprobs, err := readLogprobs(value)
+		if err != nil {
+			return err
+		}
+		d.mode.apply(o)
+		o.Logprobs = logprobs
+	case TagOutput:
+		if err := json.Unmarshal(value, o); err != nil {
+			return fmt.Errorf("decoding output: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown record tag %d", tag)
+	}
+	return nil
+}
+
+func readLogprobs(b []byte) (melody.TokenIDsWithLogProb, error) {
+	invalid := errors.New("invalid logprobs record")
+	n, size := binary.Uvarint(b)
+	// A token takes 5 bytes or more
+	if size <= 0 || n > uint64(len(b))/5 {
+		return melody.TokenIDsWithLogProb{}, invalid
+	}
+	b = b[size:]
+	l := melody.TokenIDsWithLogProb{TokenIDs: make([]uint32, n), Logprobs: make([]float32, n)}
+	for i := range n {
+		id, size := binary.Uvarint(b)
+		if size <= 0 || id > math.MaxUint32 || len(b) < size+4 {
+			return melody.TokenIDsWithLogProb{}, invalid
+		}
+		l.TokenIDs[i] = uint32(id)
+		l.Logprobs[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[size:]))
+		b = b[size+4:]
+	}
+	return l, nil
+}
+
+func readToolDelta(b []byte) (*melody.FilterToolCallDelta, error) {
+	invalid := errors.New("invalid tool delta record")
+	index, size := binary.Uvarint(b)
+	if size <= 0 {
+		return nil, invalid
+	}
+	b = b[size:]
+	d := &melody.FilterToolCallDelta{Index: uint(index)}
+	for len(b) > 0 {
+		field := b[0]
+		n, size := binary.Uvarint(b[1:])
+		if size <= 0 || n > uint64(len(b)-1-size) {
+			return nil, invalid
+		}
+		s := string(b[1+size : 1+size+int(n)])
+		b = b[1+size+int(n):]
+		switch field {
+		case toolID:
+			d.ID = s
+		case toolName:
+			d.Name = s
+		case toolRawParamDelta:
+			d.RawParamDelta = s
+		case toolParamName:
+			d.ParamDelta = &melody.FilterToolParameter{Name: s}
+		case toolParamValueDelta, toolParamPath:
+			if d.ParamDelta == nil {
+				return nil, invalid
+			}
+			if field == toolParamValueDelta {
+				d.ParamDelta.ValueDelta = s
+			} else {
+				d.ParamDelta.Path = append(d.ParamDelta.Path, s)
+			}
+		case toolIDSynthesized:
+			d.IDSynthesized = true
+		default:
+			return nil, fmt.Errorf("unknown tool delta field %d", field)
+		}
+	}
+	return d, nil
+}
+
+// noEOF turns an end of stream within a record into io.ErrUnexpectedEOF
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
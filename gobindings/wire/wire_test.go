@@ -0,0 +1,112 @@
+package wire_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	melody "github.com/cohere-ai/melody/gobindings"
+	"github.com/cohere-ai/melody/gobindings/wire"
+)
+
+// runeChunks returns the runes of s as chunks, as written with a chunk size of 1
+func runeChunks(s string) []string {
+	var chunks []string
+	for _, r := range s {
+		chunks = append(chunks, string(r))
+	}
+	return chunks
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	f := melody.NewFilter(melody.HandleMultiHopCmd3(), melody.StreamToolActions(), melody.WithFinishReason())
+	var chunks []string
+	chunks = append(chunks, "<|START_THINKING|>")
+	chunks = append(chunks, runeChunks("I will check <co>the weather</co: 0:[1]>.")...)
+	chunks = append(chunks, "<|END_THINKING|>", "<|START_ACTION|>")
+	chunks = append(chunks, runeChunks(`[{"tool_call_id": "0", "tool_name": "get_weather", "parameters": {"city": "Rome"}}]`)...)
+	chunks = append(chunks, "<|END_ACTION|>")
+
+	var outputs []melody.FilterOutput
+	for i, chunk := range chunks {
+		out, err := f.WriteDecoded(chunk, &melody.TokenIDsWithLogProb{TokenIDs: []uint32{uint32(i)}, Logprobs: []float32{-0.5}})
+		require.NoError(t, err)
+		outputs = append(outputs, out...)
+	}
+	out, err := f.FlushPartials()
+	require.NoError(t, err)
+	outputs = append(outputs, out...)
+	require.NotNil(t, outputs[len(outputs)-1].Finish)
+
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	jsonSize := 0
+	for _, o := range outputs {
+		require.NoError(t, enc.Encode(o))
+		b, err := json.Marshal(o)
+		require.NoError(t, err)
+		jsonSize += len(b)
+	}
+	require.Less(t, buf.Len()*3, jsonSize)
+
+	dec := wire.NewDecoder(&buf)
+	for _, want := range outputs {
+		got, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err = dec.Decode()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestEncoder_Modes(t *testing.T) {
+	t.Parallel()
+
+	outputs := []melody.FilterOutput{
+		{Text: "a", IsReasoning: true, PlanIndex: 2},
+		{Text: "b", IsReasoning: true, PlanIndex: 2},
+		{IsReasoning: true, PlanIndex: 3},
+		{Text: "c"},
+		{Text: "d", IsPostAnswer: true, Finish: &melody.FilterFinish{Reason: melody.FinishReasonFlush}},
+		{ToolCallDelta: &melody.FilterToolCallDelta{
+			Index:         1,
+			ParamDelta:    &melody.FilterToolParameter{Name: "location", ValueDelta: "Ro", Path: []string{"location", "city"}},
+			IDSynthesized: true,
+		}},
+		{Logprobs: melody.TokenIDsWithLogProb{TokenIDs: []uint32{}, Logprobs: []float32{}}},
+	}
+
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	for _, o := range outputs {
+		require.NoError(t, enc.Encode(o))
+	}
+	dec := wire.NewDecoder(&buf)
+	for _, want := range outputs {
+		got, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+func TestDecoder_Truncated(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(melody.FilterOutput{Text: "hello", IsReasoning: true}))
+	b := buf.Bytes()
+
+	for n := 1; n < len(b); n++ {
+		_, err := wire.NewDecoder(bytes.NewReader(b[:n])).Decode()
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF, "truncated to %d bytes", n)
+	}
+
+	_, err := wire.NewDecoder(bytes.NewReader([]byte{0x7f, 0})).Decode()
+	require.ErrorContains(t, err, "unknown record tag")
+}
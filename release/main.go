@@ -45,6 +45,26 @@ func main() {
 		fmt.Println(output.Text)
 	}
 
+	// Filters take the same functional options as in the bindings
+	filter = melody.NewFilter(melody.WithExclusiveStops([]string{" STOP"}))
+	fo, err = filter.WriteDecoded("Hello STOP world", nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, output := range fo {
+		fmt.Println(output.Text)
+	}
+	// Hello
+	filter = melody.NewFilter(melody.HandleMultiHopCmd3())
+	fo, err = filter.WriteDecoded("<|START_RESPONSE|>Hello", nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, output := range fo {
+		fmt.Println(output.Text)
+	}
+	// Hello
+
 	// **********
 	// TOKENIZERS
 	// **********
@@ -62,4 +82,25 @@ func main() {
 	// [101 2829 4419 14523 2058 1996 13971 3899 102] [[CLS] brown fox jumps over the lazy dog [SEP]]
 	fmt.Println(tk.Decode([]uint32{2829, 4419, 14523, 2058, 1996, 13971, 3899}, true))
 	// brown fox jumps over the lazy dog
+
+	// Filters decode the tokens written by ID with their tokenizer
+	filter = melody.NewFilter(melody.WithTokenizer(tk))
+	for _, id := range []uint32{2829, 4419} {
+		fo, err = filter.WriteToken(id, nil)
+		if err != nil {
+			panic(err)
+		}
+		for _, output := range fo {
+			fmt.Print(output.Text)
+		}
+	}
+	fo, err = filter.FlushPartials()
+	if err != nil {
+		panic(err)
+	}
+	for _, output := range fo {
+		fmt.Print(output.Text)
+	}
+	fmt.Println()
+	// brown fox
 }
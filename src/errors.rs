@@ -23,4 +23,20 @@ pub enum MelodyError {
     /// Validation error
     #[error("Template validation error: {0}")]
     TemplateValidation(String),
+
+    /// Unknown filter option name
+    #[error("unknown filter option '{0}'")]
+    UnknownFilterOption(String),
+
+    /// Unknown output format name
+    #[error("unknown format '{0}'")]
+    UnknownFormat(String),
+
+    /// Filter state saved by a newer version of melody
+    #[error("unsupported filter state version {0}, the latest is {1}")]
+    UnsupportedFilterState(u32, u32),
+
+    /// Rollback of more tokens than the rollback window holds
+    #[error("cannot roll back {0} tokens, only the last {1} can be rolled back")]
+    RollbackOutOfWindow(usize, usize),
 }
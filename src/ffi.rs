@@ -12,7 +12,7 @@
 //! # Ownership Rules
 //!
 //! - Pointers returned by `_new` functions: **Caller owns**, must call `_free`
-//! - `CFilterOutputResult` returned by `write_decoded` and `flush_partials`: **Caller owns**, must call `melody_result_free`
+//! - `CFilterOutputResult` returned by `write_decoded`, `write_decoded_batch` and `flush_partials`: **Caller owns**, must call `melody_result_free`
 //! - Pointers passed as arguments: **Caller retains ownership**, must remain valid for call duration
 //!
 //! # Thread Safety
@@ -21,16 +21,29 @@
 //! thread at a time, or protected by external synchronization.
 //!
 
-use crate::parsing::types::{FilterCitation, FilterOutput, Source, TokenIDsWithLogProb};
-use crate::parsing::{Filter, FilterImpl, FilterOptions, new_filter};
+use crate::errors::MelodyError;
+use crate::parsing::types::{
+    CitationIndexUnit, CitationSourceFormat, ConditionalStop, FilterCitation, FilterMode,
+    FilterOutput, FinishReason, Source, StopContext, TokenIDsWithLogProb, TopLogProbs,
+    UnicodeNormalization,
+};
+use crate::parsing::{Filter, FilterImpl, FilterOptions, FilterState, describe_format, new_filter};
+use crate::templating::{
+    CitationQuality, Content, ContentType, Document, FimFamily, Grounding, Image, Message,
+    ReasoningType, RenderFimOptions, Role, SafetyMode, Tool, ToolCall, render_fim,
+};
+use crate::templating::{
+    RenderCmd3Options, RenderCmd4Options, StructuredOutputMode, build_preamble,
+    build_structured_output_section, document_index_map, render_cmd3, render_cmd4,
+};
 use crate::templating::{
-    CitationQuality, Content, ContentType, Document, Grounding, Image, Message, ReasoningType,
-    Role, SafetyMode, Tool, ToolCall,
+    register_filter, register_partial, register_tag, set_template_cache_capacity,
+    template_cache_stats,
 };
-use crate::templating::{RenderCmd3Options, RenderCmd4Options, render_cmd3, render_cmd4};
 use serde_json::{Map, Value};
+use std::collections::HashMap;
 use std::ffi::{CStr, CString};
-use std::os::raw::c_char;
+use std::os::raw::{c_char, c_void};
 use std::panic::{self, AssertUnwindSafe};
 use std::slice;
 
@@ -89,16 +102,7 @@ where
             } else {
                 "Rust panic: unknown error".to_string()
             };
-            // Use unwrap_or to handle CString::new failure (if msg contains null bytes)
-            let err = CString::new(msg)
-                .unwrap_or_else(|_| {
-                    CString::new("Rust panic: error message contained null bytes").unwrap()
-                })
-                .into_raw();
-            Box::into_raw(Box::new(CRenderResult {
-                result: std::ptr::null_mut(),
-                error: err,
-            }))
+            render_error(CErrorKind::Panic, msg)
         }
     }
 }
@@ -133,6 +137,17 @@ pub struct CFilterOutput {
     pub logprobs: *mut f32,
     /// Number of log probabilities
     pub logprobs_len: usize,
+    /// Array of the number of top alternatives of each token, null unless the tokens were
+    /// written with `melody_filter_write_decoded_with_top_logprobs`
+    pub top_logprobs_lens: *mut usize,
+    /// Number of tokens with top alternatives
+    pub top_logprobs_lens_len: usize,
+    /// Array of the token IDs of the alternatives of every token, concatenated
+    pub top_token_ids: *mut u32,
+    /// Array of the log probabilities of the alternatives (parallel to `top_token_ids`)
+    pub top_logprobs: *mut f32,
+    /// Number of alternatives of every token
+    pub top_logprobs_len: usize,
 
     /// Index of the search query (-1 if None)
     pub search_query_index: i32,
@@ -161,6 +176,44 @@ pub struct CFilterOutput {
     pub is_post_answer: bool,
     /// Whether this is reasoning/thinking content
     pub is_reasoning: bool,
+    /// Index of the thinking block of reasoning content
+    pub plan_index: usize,
+    /// Whether this is an echoed prompt token
+    pub is_echo: bool,
+
+    /// Why the stream ended, a `CFinishReason` (-1 if None)
+    pub finish_reason: i32,
+    /// Null-terminated C string containing the stop sequence that ended the stream
+    pub stop_sequence: *mut c_char,
+
+    /// Array of the indices of a "Relevant Documents:" line
+    pub relevant_doc_indices: *mut usize,
+    /// Number of relevant document indices
+    pub relevant_doc_indices_len: usize,
+    /// Whether this output is a "Relevant Documents:" line, which may list no documents
+    pub has_relevant_doc_indices: bool,
+    /// Array of the indices of a "Cited Documents:" line
+    pub cited_doc_indices: *mut usize,
+    /// Number of cited document indices
+    pub cited_doc_indices_len: usize,
+    /// Whether this output is a "Cited Documents:" line, which may list no documents
+    pub has_cited_doc_indices: bool,
+}
+
+/// C-compatible enum for finish reasons.
+///
+/// Mirrors `FinishReason`, why a filter stream ended.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CFinishReason {
+    /// An inclusive stop sequence was found.
+    InclusiveStop = 0,
+    /// An exclusive stop sequence was found.
+    ExclusiveStop = 1,
+    /// A special token mapped to a stop mode was found.
+    EndOfSequence = 2,
+    /// The filter was flushed before any stop.
+    Flush = 3,
 }
 
 /// C-compatible representation of `FilterCitation`
@@ -189,6 +242,8 @@ pub struct CSource {
     pub tool_result_indices: *mut usize,
     /// Number of tool result indices
     pub tool_result_indices_len: usize,
+    /// Name of the cited tool, null unless citing by tool name (caller must free)
+    pub source_name: *mut c_char,
 }
 
 /// C-compatible representation of an array of `FilterOutput`
@@ -216,6 +271,43 @@ pub struct CRenderResult {
     pub result: *mut c_char,
     /// Null-terminated C string containing the error (null if success)
     pub error: *mut c_char,
+    /// Kind of the error (`None` if success)
+    pub error_kind: CErrorKind,
+}
+
+/// C-compatible enum for the kinds of errors of a `CRenderResult`.
+#[repr(C)]
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum CErrorKind {
+    /// No error.
+    None = 0,
+    /// An error of no other kind.
+    Unknown = 1,
+    /// A null pointer or invalid value was passed.
+    InvalidArgument = 2,
+    /// The template could not be parsed or rendered.
+    TemplateSyntax = 3,
+    /// The messages cannot be rendered, e.g. a tool result without a tool call.
+    InvalidMessages = 4,
+    /// A JSON value, such as a tool schema or a document, could not be encoded or decoded.
+    Json = 5,
+    /// The Rust code panicked.
+    Panic = 6,
+}
+
+impl From<&MelodyError> for CErrorKind {
+    fn from(e: &MelodyError) -> Self {
+        match e {
+            MelodyError::Unknown => Self::Unknown,
+            MelodyError::JsonSerialization(_) => Self::Json,
+            MelodyError::TemplateParsing(_) => Self::TemplateSyntax,
+            MelodyError::TemplateValidation(_) => Self::InvalidMessages,
+            MelodyError::UnknownFilterOption(_)
+            | MelodyError::UnknownFormat(_)
+            | MelodyError::UnsupportedFilterState(..)
+            | MelodyError::RollbackOutOfWindow(..) => Self::InvalidArgument,
+        }
+    }
 }
 
 // ============================================================================
@@ -315,6 +407,37 @@ pub unsafe extern "C" fn melody_filter_options_handle_multi_hop(options: *mut CF
     }
 }
 
+/// Configures options for Llama 3.x chat format
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_handle_llama3_chat(options: *mut CFilterOptions) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).handle_llama3_chat();
+        }
+    }
+}
+
+/// Configures options for fill-in-the-middle completions of the given model family
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_handle_fim(
+    options: *mut CFilterOptions,
+    family: CFimFamily,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).handle_fim(map_fim_family(family));
+        }
+    }
+}
+
 /// Enables streaming of non-grounded answers
 ///
 /// # Safety
@@ -361,6 +484,170 @@ pub unsafe extern "C" fn melody_filter_options_stream_processed_params(
     }
 }
 
+/// Enables the terminal output reporting why the stream ended
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_finish_reason(options: *mut CFilterOptions) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_finish_reason();
+        }
+    }
+}
+
+/// Emits the document indices of "Relevant Documents:" and "Cited Documents:" lines
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_stream_document_selections(
+    options: *mut CFilterOptions,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).stream_document_selections();
+        }
+    }
+}
+
+/// Passes the first `prompt_token_count` tokens through as echoed prompt tokens
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_prompt_echo(
+    options: *mut CFilterOptions,
+    prompt_token_count: usize,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_prompt_echo(prompt_token_count);
+        }
+    }
+}
+
+/// Continues a response that starts with `prefix`, which is not emitted
+///
+/// # Safety
+/// - `options` must be a valid pointer returned from `melody_filter_options_new`
+/// - `prefix` must be a valid null-terminated C string
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_response_prefix(
+    options: *mut CFilterOptions,
+    prefix: *const c_char,
+) {
+    if !options.is_null() && !prefix.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let prefix_str = CStr::from_ptr(prefix).to_string_lossy().into_owned();
+            *opts = std::mem::take(opts).with_response_prefix(prefix_str);
+        }
+    }
+}
+
+/// Strips the healed text of a response prefix from the start of the completion
+///
+/// # Safety
+/// - `options` must be a valid pointer returned from `melody_filter_options_new`
+/// - `healed` must be a valid null-terminated C string
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_healed_prefix(
+    options: *mut CFilterOptions,
+    healed: *const c_char,
+) {
+    if !options.is_null() && !healed.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let healed_str = CStr::from_ptr(healed).to_string_lossy().into_owned();
+            *opts = std::mem::take(opts).with_healed_prefix(healed_str);
+        }
+    }
+}
+
+/// Drops a prefix from the start of the completion
+///
+/// # Safety
+/// - `options` must be a valid pointer returned from `melody_filter_options_new`
+/// - `prefix` must be a valid null-terminated C string
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_prefix_trim(
+    options: *mut CFilterOptions,
+    prefix: *const c_char,
+) {
+    if !options.is_null() && !prefix.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let prefix_str = CStr::from_ptr(prefix).to_string_lossy().into_owned();
+            *opts = std::mem::take(opts).with_prefix_trim(prefix_str);
+        }
+    }
+}
+
+/// Resumes a truncated response from the text and citations already emitted
+///
+/// # Safety
+/// - `options` must be a valid pointer returned from `melody_filter_options_new`
+/// - `prior_text` must be a valid null-terminated C string
+/// - `citations` must point to `citations_len` valid citations, or be null
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_resume_state(
+    options: *mut CFilterOptions,
+    prior_text: *const c_char,
+    citations: *const CFilterCitation,
+    citations_len: usize,
+) {
+    if !options.is_null() && !prior_text.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let prior_text = CStr::from_ptr(prior_text).to_string_lossy().into_owned();
+            let citations = if !citations.is_null() && citations_len > 0 {
+                slice::from_raw_parts(citations, citations_len)
+                    .iter()
+                    .map(|c| convert_ccitation(c))
+                    .collect()
+            } else {
+                Vec::new()
+            };
+            *opts = std::mem::take(opts).with_resume_state(prior_text, citations);
+        }
+    }
+}
+
+/// Enables merging of adjacent citations
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_citation_merging(options: *mut CFilterOptions) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_citation_merging();
+        }
+    }
+}
+
+/// Enables alignment of citations to sentence boundaries
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_sentence_citations(
+    options: *mut CFilterOptions,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_sentence_citations();
+        }
+    }
+}
+
 /// Sets left trimming
 ///
 /// # Safety
@@ -406,6 +693,88 @@ pub unsafe extern "C" fn melody_filter_options_with_chunk_size(
     }
 }
 
+/// Sets word boundary chunking of text with a minimum chunk length in characters
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_word_boundary_chunking(
+    options: *mut CFilterOptions,
+    min_chars: usize,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_word_boundary_chunking(min_chars);
+        }
+    }
+}
+
+/// Sets the number of tokens that can be rolled back with `melody_filter_rollback`
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_rollback_window(
+    options: *mut CFilterOptions,
+    tokens: usize,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_rollback_window(tokens);
+        }
+    }
+}
+
+/// Sets the number of bytes of emitted text a retry marked with `melody_filter_resume`
+/// may replay
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_dedup_window(
+    options: *mut CFilterOptions,
+    bytes: usize,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_dedup_window(bytes);
+        }
+    }
+}
+
+/// Splits search queries at every separator, without reading quoting and escaping
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_legacy_search_query_splitting(
+    options: *mut CFilterOptions,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).legacy_search_query_splitting();
+        }
+    }
+}
+
+/// Matches the special tokens and stops one at a time, to benchmark the matching
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_linear_token_matching(options: *mut CFilterOptions) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).linear_token_matching();
+        }
+    }
+}
+
 /// Adds inclusive stops
 ///
 /// # Safety
@@ -454,36 +823,279 @@ pub unsafe extern "C" fn melody_filter_options_with_exclusive_stops(
     }
 }
 
-/// Removes a token from the special token map
+/// C-compatible enum for the contexts of conditional stops.
+///
+/// Mirrors `StopContext`, where a conditional stop ends the stream.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CStopContext {
+    /// Only in the response text, outside of code fences.
+    PlainText = 0,
+    /// Anywhere but in tool actions.
+    NotInAction = 1,
+    /// Anywhere but in the reasoning.
+    NotInThinking = 2,
+}
+
+fn map_stop_context(c: CStopContext) -> StopContext {
+    match c {
+        CStopContext::PlainText => StopContext::PlainText,
+        CStopContext::NotInAction => StopContext::NotInAction,
+        CStopContext::NotInThinking => StopContext::NotInThinking,
+    }
+}
+
+/// Adds exclusive stops that only apply in a context
 ///
 /// # Safety
 /// `options` must be a valid pointer returned from `melody_filter_options_new`
-/// `token` must be a valid null-terminated C string
+/// `stops` must be valid null-terminated C strings
+/// `contexts` must point to `stops_len` contexts, the context of each stop
 #[unsafe(no_mangle)]
-pub unsafe extern "C" fn melody_filter_options_remove_token(
+pub unsafe extern "C" fn melody_filter_options_with_conditional_stops(
     options: *mut CFilterOptions,
-    token: *const c_char,
+    stops: *const *const c_char,
+    contexts: *const CStopContext,
+    stops_len: usize,
 ) {
-    if !options.is_null() && !token.is_null() {
+    if !options.is_null() && !stops.is_null() && !contexts.is_null() {
         unsafe {
             let opts = &mut *(options.cast::<FilterOptions>());
-            let token_str = CStr::from_ptr(token).to_string_lossy();
-            *opts = std::mem::take(opts).remove_token(&token_str);
+            let stops_slice = slice::from_raw_parts(stops, stops_len);
+            let contexts_slice = slice::from_raw_parts(contexts, stops_len);
+            let conditional_stops: Vec<ConditionalStop> = stops_slice
+                .iter()
+                .zip(contexts_slice)
+                .map(|(&s, &context)| ConditionalStop {
+                    stop: CStr::from_ptr(s).to_string_lossy().into_owned(),
+                    context: map_stop_context(context),
+                })
+                .collect();
+            *opts = std::mem::take(opts).with_conditional_stops(conditional_stops);
         }
     }
 }
 
-// ============================================================================
-// Filter FFI functions
-// ============================================================================
+/// C-compatible enum for filter modes.
+///
+/// Mirrors `FilterMode`, the mode a special token switches the filter to.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CFilterMode {
+    /// Output all text without special processing.
+    PlainText = 0,
+    /// Discard all text.
+    Ignore = 1,
+    /// Parse tool calls.
+    ToolAction = 2,
+    /// Parse thinking/reasoning blocks.
+    ToolReason = 3,
+    /// Parse non-grounded answer text.
+    Answer = 4,
+    /// Parse grounded answer text with citations.
+    GroundedAnswer = 5,
+    /// Stop and include the token in the output.
+    InclusiveStop = 6,
+    /// Stop and exclude the token from the output.
+    ExclusiveStop = 7,
+    /// Parse search queries.
+    SearchQuery = 8,
+    /// Start the next search query.
+    NextSearchQuery = 9,
+}
+
+fn map_filter_mode(m: CFilterMode) -> FilterMode {
+    match m {
+        CFilterMode::PlainText => FilterMode::PlainText,
+        CFilterMode::Ignore => FilterMode::Ignore,
+        CFilterMode::ToolAction => FilterMode::ToolAction,
+        CFilterMode::ToolReason => FilterMode::ToolReason,
+        CFilterMode::Answer => FilterMode::Answer,
+        CFilterMode::GroundedAnswer => FilterMode::GroundedAnswer,
+        CFilterMode::InclusiveStop => FilterMode::InclusiveStop,
+        CFilterMode::ExclusiveStop => FilterMode::ExclusiveStop,
+        CFilterMode::SearchQuery => FilterMode::SearchQuery,
+        CFilterMode::NextSearchQuery => FilterMode::NextSearchQuery,
+    }
+}
 
-/// Creates a new filter with the given options
+fn filter_mode_to_c(m: FilterMode) -> CFilterMode {
+    match m {
+        FilterMode::PlainText => CFilterMode::PlainText,
+        FilterMode::Ignore => CFilterMode::Ignore,
+        FilterMode::ToolAction => CFilterMode::ToolAction,
+        FilterMode::ToolReason => CFilterMode::ToolReason,
+        FilterMode::Answer => CFilterMode::Answer,
+        FilterMode::GroundedAnswer => CFilterMode::GroundedAnswer,
+        FilterMode::InclusiveStop => CFilterMode::InclusiveStop,
+        FilterMode::ExclusiveStop => CFilterMode::ExclusiveStop,
+        FilterMode::SearchQuery => CFilterMode::SearchQuery,
+        FilterMode::NextSearchQuery => CFilterMode::NextSearchQuery,
+    }
+}
+
+/// C-compatible enum for citation index units.
 ///
-/// # Safety
-/// - `options` can be null for default options, or must be a valid pointer from `melody_filter_options_new`
-/// - The returned pointer must be freed with `melody_filter_free`
-#[unsafe(no_mangle)]
-pub unsafe extern "C" fn melody_filter_new(options: *const CFilterOptions) -> *mut CFilter {
+/// Mirrors `CitationIndexUnit`, the unit of citation start and end indices.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CCitationIndexUnit {
+    /// Unicode scalar values.
+    Runes = 0,
+    /// Extended grapheme clusters.
+    Graphemes = 1,
+    /// UTF-16 code units.
+    Utf16 = 2,
+    /// UTF-8 bytes.
+    Bytes = 3,
+}
+
+fn map_citation_index_unit(u: CCitationIndexUnit) -> CitationIndexUnit {
+    match u {
+        CCitationIndexUnit::Runes => CitationIndexUnit::Runes,
+        CCitationIndexUnit::Graphemes => CitationIndexUnit::Graphemes,
+        CCitationIndexUnit::Utf16 => CitationIndexUnit::Utf16,
+        CCitationIndexUnit::Bytes => CitationIndexUnit::Bytes,
+    }
+}
+
+/// Sets the unit of citation indices
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_citation_index_unit(
+    options: *mut CFilterOptions,
+    unit: CCitationIndexUnit,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            *opts = std::mem::take(opts).with_citation_index_unit(map_citation_index_unit(unit));
+        }
+    }
+}
+
+/// C-compatible enum for citation source formats.
+///
+/// Mirrors `CitationSourceFormat`, how the sources of Command 3 citations are keyed.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CCitationSourceFormat {
+    /// Sources are keyed by tool call index.
+    ToolIndex = 0,
+    /// Sources are keyed by tool name.
+    ToolName = 1,
+}
+
+/// Sets the format of the sources of Command 3 citations
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_citation_source_format(
+    options: *mut CFilterOptions,
+    format: CCitationSourceFormat,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let format = match format {
+                CCitationSourceFormat::ToolIndex => CitationSourceFormat::ToolIndex,
+                CCitationSourceFormat::ToolName => CitationSourceFormat::ToolName,
+            };
+            *opts = std::mem::take(opts).with_citation_source_format(format);
+        }
+    }
+}
+
+/// C-compatible enum for Unicode normalization forms.
+///
+/// Mirrors `UnicodeNormalization`, the form the emitted text is normalized to.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CUnicodeNormalization {
+    /// The text is emitted as decoded.
+    None = 0,
+    /// Canonical composition.
+    Nfc = 1,
+    /// Compatibility composition.
+    Nfkc = 2,
+}
+
+/// Sets the Unicode normalization form of the emitted text
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_unicode_normalization(
+    options: *mut CFilterOptions,
+    form: CUnicodeNormalization,
+) {
+    if !options.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let form = match form {
+                CUnicodeNormalization::None => UnicodeNormalization::None,
+                CUnicodeNormalization::Nfc => UnicodeNormalization::Nfc,
+                CUnicodeNormalization::Nfkc => UnicodeNormalization::Nfkc,
+            };
+            *opts = std::mem::take(opts).with_unicode_normalization(form);
+        }
+    }
+}
+
+/// Adds or remaps a special token
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+/// `token` must be a valid null-terminated C string
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_with_special_token(
+    options: *mut CFilterOptions,
+    token: *const c_char,
+    mode: CFilterMode,
+) {
+    if !options.is_null() && !token.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let token_str = CStr::from_ptr(token).to_string_lossy().into_owned();
+            *opts = std::mem::take(opts)
+                .with_special_token_map(HashMap::from([(token_str, map_filter_mode(mode))]));
+        }
+    }
+}
+
+/// Removes a token from the special token map
+///
+/// # Safety
+/// `options` must be a valid pointer returned from `melody_filter_options_new`
+/// `token` must be a valid null-terminated C string
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_options_remove_token(
+    options: *mut CFilterOptions,
+    token: *const c_char,
+) {
+    if !options.is_null() && !token.is_null() {
+        unsafe {
+            let opts = &mut *(options.cast::<FilterOptions>());
+            let token_str = CStr::from_ptr(token).to_string_lossy();
+            *opts = std::mem::take(opts).remove_token(&token_str);
+        }
+    }
+}
+
+// ============================================================================
+// Filter FFI functions
+// ============================================================================
+
+/// Creates a new filter with the given options
+///
+/// # Safety
+/// - `options` can be null for default options, or must be a valid pointer from `melody_filter_options_new`
+/// - The returned pointer must be freed with `melody_filter_free`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_new(options: *const CFilterOptions) -> *mut CFilter {
     unsafe {
         let filter = if options.is_null() {
             Box::new(FilterImpl::new())
@@ -525,6 +1137,49 @@ pub unsafe extern "C" fn melody_filter_write_decoded(
     token_ids_len: usize,
     logprobs: *const f32,
     logprobs_len: usize,
+) -> *mut CFilterOutputResult {
+    unsafe {
+        melody_filter_write_decoded_with_top_logprobs(
+            filter,
+            decoded_token,
+            token_ids,
+            token_ids_len,
+            logprobs,
+            logprobs_len,
+            std::ptr::null(),
+            0,
+            std::ptr::null(),
+            std::ptr::null(),
+        )
+    }
+}
+
+/// Writes a decoded token to the filter with the top-k alternatives of its tokens, which
+/// are set on the outputs in `top_token_ids` and `top_logprobs`
+///
+/// The alternatives of token `i` are the next `top_lens[i]` values of `top_token_ids` and
+/// `top_logprobs`. `top_lens` has either no values or one per token ID.
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - `decoded_token` must be a valid null-terminated C string
+/// - `top_token_ids` and `top_logprobs` must point to as many values as the sum of `top_lens`
+/// - The returned `CFilterOutputResult` must be freed with `melody_result_free`
+///
+/// # Returns
+/// Returns null if inputs are invalid. Returns a `CFilterOutputResult` with an error if a panic occurs.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_write_decoded_with_top_logprobs(
+    filter: *mut CFilter,
+    decoded_token: *const c_char,
+    token_ids: *const u32,
+    token_ids_len: usize,
+    logprobs: *const f32,
+    logprobs_len: usize,
+    top_lens: *const usize,
+    top_lens_len: usize,
+    top_token_ids: *const u32,
+    top_logprobs: *const f32,
 ) -> *mut CFilterOutputResult {
     if filter.is_null() || decoded_token.is_null() {
         return std::ptr::null_mut();
@@ -534,21 +1189,27 @@ pub unsafe extern "C" fn melody_filter_write_decoded(
         let filter = &mut *(filter.cast::<FilterImpl>());
         let token_str = CStr::from_ptr(decoded_token).to_string_lossy();
 
-        let token_ids_vec = if !token_ids.is_null() && token_ids_len > 0 {
-            slice::from_raw_parts(token_ids, token_ids_len).to_vec()
-        } else {
-            Vec::new()
-        };
-
-        let logprobs_vec = if !logprobs.is_null() && logprobs_len > 0 {
-            slice::from_raw_parts(logprobs, logprobs_len).to_vec()
-        } else {
-            Vec::new()
-        };
+        let top_lens = slice_or_empty(top_lens, top_lens_len);
+        let top_len = top_lens.iter().sum();
+        let top_token_ids = slice_or_empty(top_token_ids, top_len);
+        let top_logprobs = slice_or_empty(top_logprobs, top_len);
+        let mut start = 0;
+        let top = top_lens
+            .iter()
+            .map(|&len| {
+                let alternatives = TopLogProbs {
+                    token_ids: top_token_ids[start..start + len].to_vec(),
+                    logprobs: top_logprobs[start..start + len].to_vec(),
+                };
+                start += len;
+                alternatives
+            })
+            .collect();
 
         let log_prob = TokenIDsWithLogProb {
-            token_ids: token_ids_vec,
-            logprobs: logprobs_vec,
+            token_ids: slice_or_empty(token_ids, token_ids_len).to_vec(),
+            logprobs: slice_or_empty(logprobs, logprobs_len).to_vec(),
+            top_logprobs: top,
         };
 
         let outputs = filter.write_decoded(&token_str, log_prob);
@@ -560,6 +1221,80 @@ pub unsafe extern "C" fn melody_filter_write_decoded(
     }))
 }
 
+/// Writes a batch of decoded tokens to the filter, crossing the FFI boundary once for all
+/// of them
+///
+/// The texts of the tokens are concatenated in `text`, token `i` being the next
+/// `text_lens[i]` bytes. Its token IDs and log probabilities are likewise the next
+/// `token_ids_lens[i]` values of `token_ids` and `logprobs_lens[i]` values of `logprobs`.
+/// `token_ids_lens` and `logprobs_lens` may be null if no token has any.
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - `text_lens` must point to `tokens_len` values, and `text` to as many bytes as their sum
+/// - `token_ids` and `logprobs` must point to as many values as the sum of their lengths
+/// - The returned `CFilterOutputResult` must be freed with `melody_result_free`
+///
+/// # Returns
+/// Returns null if inputs are invalid. Returns a `CFilterOutputResult` with an error if a panic occurs.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_write_decoded_batch(
+    filter: *mut CFilter,
+    text: *const c_char,
+    text_lens: *const usize,
+    tokens_len: usize,
+    token_ids: *const u32,
+    token_ids_lens: *const usize,
+    logprobs: *const f32,
+    logprobs_lens: *const usize,
+) -> *mut CFilterOutputResult {
+    if filter.is_null() || (tokens_len > 0 && text_lens.is_null()) {
+        return std::ptr::null_mut();
+    }
+
+    catch_panic_filter_result(AssertUnwindSafe(|| unsafe {
+        let filter = &mut *(filter.cast::<FilterImpl>());
+        let text_lens = slice_or_empty(text_lens, tokens_len);
+        let token_ids_lens = slice_or_empty(token_ids_lens, tokens_len);
+        let logprobs_lens = slice_or_empty(logprobs_lens, tokens_len);
+        let text = slice_or_empty(text.cast::<u8>(), text_lens.iter().sum());
+        let token_ids = slice_or_empty(token_ids, token_ids_lens.iter().sum());
+        let logprobs = slice_or_empty(logprobs, logprobs_lens.iter().sum());
+
+        let mut outputs = Vec::new();
+        let (mut text_start, mut ids_start, mut logprobs_start) = (0, 0, 0);
+        for (i, &len) in text_lens.iter().enumerate() {
+            let token = String::from_utf8_lossy(&text[text_start..text_start + len]);
+            text_start += len;
+            let ids_len = token_ids_lens.get(i).copied().unwrap_or(0);
+            let logprobs_len = logprobs_lens.get(i).copied().unwrap_or(0);
+            let log_prob = TokenIDsWithLogProb {
+                token_ids: token_ids[ids_start..ids_start + ids_len].to_vec(),
+                logprobs: logprobs[logprobs_start..logprobs_start + logprobs_len].to_vec(),
+                ..Default::default()
+            };
+            ids_start += ids_len;
+            logprobs_start += logprobs_len;
+            outputs.extend(filter.write_decoded(&token, log_prob));
+        }
+
+        let result = convert_outputs_to_c(outputs);
+        Box::into_raw(Box::new(CFilterOutputResult {
+            result,
+            error: std::ptr::null_mut(),
+        }))
+    }))
+}
+
+/// Returns the `len` values at `ptr`, or none if `ptr` is null
+unsafe fn slice_or_empty<'a, T>(ptr: *const T, len: usize) -> &'a [T] {
+    if ptr.is_null() || len == 0 {
+        &[]
+    } else {
+        unsafe { slice::from_raw_parts(ptr, len) }
+    }
+}
+
 /// Flushes any partial outputs from the filter
 ///
 /// # Safety
@@ -587,6 +1322,248 @@ pub unsafe extern "C" fn melody_filter_flush_partials(
     }))
 }
 
+/// Writes a token ID to the filter, decoded with the tokenizer. Tokens that end with an
+/// incomplete UTF-8 sequence are held back until the next ones complete it.
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - `tokenizer` must be a valid pointer returned by the tokenizer constructors
+/// - The returned `CFilterOutputResult` must be freed with `melody_result_free`
+///
+/// # Returns
+/// Returns null if inputs are invalid. Returns a `CFilterOutputResult` with an error if the
+/// token cannot be decoded or a panic occurs.
+#[cfg(feature = "tkzrs")]
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_write_token(
+    filter: *mut CFilter,
+    tokenizer: *const c_void,
+    token_id: u32,
+    logprob: f32,
+    has_logprob: bool,
+) -> *mut CFilterOutputResult {
+    if filter.is_null() || tokenizer.is_null() {
+        return std::ptr::null_mut();
+    }
+
+    catch_panic_filter_result(AssertUnwindSafe(|| unsafe {
+        let filter = &mut *(filter.cast::<FilterImpl>());
+        let tokenizer = &*(tokenizer.cast::<tokenizers::tokenizer::Tokenizer>());
+        let outputs = filter.write_token(token_id, has_logprob.then_some(logprob), |ids| {
+            tokenizer.decode(ids, false)
+        });
+        filter_result(outputs.map_err(|e| format!("failed to decode token {token_id}: {e}")))
+    }))
+}
+
+/// Flushes the tokens held back by `melody_filter_write_token`, then any partial outputs
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - `tokenizer` must be a valid pointer returned by the tokenizer constructors
+/// - The returned `CFilterOutputResult` must be freed with `melody_result_free`
+///
+/// # Returns
+/// Returns null if inputs are invalid. Returns a `CFilterOutputResult` with an error if the
+/// held back tokens cannot be decoded or a panic occurs.
+#[cfg(feature = "tkzrs")]
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_flush_tokens(
+    filter: *mut CFilter,
+    tokenizer: *const c_void,
+) -> *mut CFilterOutputResult {
+    if filter.is_null() || tokenizer.is_null() {
+        return std::ptr::null_mut();
+    }
+
+    catch_panic_filter_result(AssertUnwindSafe(|| unsafe {
+        let filter = &mut *(filter.cast::<FilterImpl>());
+        let tokenizer = &*(tokenizer.cast::<tokenizers::tokenizer::Tokenizer>());
+        let outputs = filter.flush_tokens(|ids| tokenizer.decode(ids, false));
+        filter_result(outputs.map_err(|e| format!("failed to decode tokens: {e}")))
+    }))
+}
+
+/// Converts the outputs of a filter, or its error, to a `CFilterOutputResult`
+#[cfg(feature = "tkzrs")]
+fn filter_result(outputs: Result<Vec<FilterOutput>, String>) -> *mut CFilterOutputResult {
+    let (result, error) = match outputs {
+        Ok(outputs) => (convert_outputs_to_c(outputs), std::ptr::null_mut()),
+        Err(msg) => (
+            std::ptr::null_mut(),
+            CString::new(msg)
+                .unwrap_or_else(|_| CString::new("error message contained null bytes").unwrap())
+                .into_raw(),
+        ),
+    };
+    Box::into_raw(Box::new(CFilterOutputResult { result, error }))
+}
+
+/// Returns the number of bytes the filter holds back waiting for the rest of a special token
+///
+/// # Safety
+/// `filter` must be null or a valid pointer returned from `melody_filter_new`
+///
+/// # Returns
+/// Returns 0 if filter is null.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_buffered_bytes(filter: *const CFilter) -> usize {
+    if filter.is_null() {
+        return 0;
+    }
+    unsafe { (*(filter.cast::<FilterImpl>())).buffered_bytes() }
+}
+
+/// Returns the mode the filter parses the next text in
+///
+/// # Safety
+/// `filter` must be null or a valid pointer returned from `melody_filter_new`
+///
+/// # Returns
+/// Returns `CFilterMode::PlainText` if filter is null.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_current_mode(filter: *const CFilter) -> CFilterMode {
+    if filter.is_null() {
+        return CFilterMode::PlainText;
+    }
+    unsafe { filter_mode_to_c((*(filter.cast::<FilterImpl>())).mode()) }
+}
+
+/// Saves the parsing state of the filter as JSON, see `melody_filter_restore_state`
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - The returned `CRenderResult` must be freed with `melody_render_result_free`
+///
+/// # Returns
+/// Returns null if filter is null.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_save_state(filter: *const CFilter) -> *mut CRenderResult {
+    if filter.is_null() {
+        return std::ptr::null_mut();
+    }
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let filter = unsafe { &*(filter.cast::<FilterImpl>()) };
+        let json = filter
+            .save_state()
+            .to_json()
+            .map(|b| String::from_utf8_lossy(&b).into_owned());
+        render_result(json)
+    }))
+}
+
+/// Replaces the parsing state of the filter with one saved by `melody_filter_save_state`.
+/// The filter must have been created with the options of the filter the state was saved
+/// from.
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - `state` must be a valid null-terminated C string
+/// - The returned `CRenderResult` must be freed with `melody_render_result_free`
+///
+/// # Returns
+/// Returns null if inputs are invalid, and a `CRenderResult` with a null result on success
+/// or an error if the state cannot be decoded.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_restore_state(
+    filter: *mut CFilter,
+    state: *const c_char,
+) -> *mut CRenderResult {
+    if filter.is_null() || state.is_null() {
+        return std::ptr::null_mut();
+    }
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let filter = unsafe { &mut *(filter.cast::<FilterImpl>()) };
+        let state = unsafe { CStr::from_ptr(state) };
+        let restored = FilterState::from_json(state.to_bytes()).map(|state| {
+            filter.restore_state(state);
+        });
+        match restored {
+            Ok(()) => Box::into_raw(Box::new(CRenderResult {
+                result: std::ptr::null_mut(),
+                error: std::ptr::null_mut(),
+                error_kind: CErrorKind::None,
+            })),
+            Err(e) => render_result(Err(e)),
+        }
+    }))
+}
+
+/// Rewinds the filter to its state before the last `tokens` tokens written
+///
+/// # Safety
+/// - `filter` must be a valid pointer returned from `melody_filter_new`
+/// - The returned `CRenderResult` must be freed with `melody_render_result_free`
+///
+/// # Returns
+/// Returns null if filter is null, and a `CRenderResult` with a null result on success or
+/// an error if the rollback window does not hold `tokens` tokens.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_rollback(
+    filter: *mut CFilter,
+    tokens: usize,
+) -> *mut CRenderResult {
+    if filter.is_null() {
+        return std::ptr::null_mut();
+    }
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let filter = unsafe { &mut *(filter.cast::<FilterImpl>()) };
+        match filter.rollback(tokens) {
+            Ok(()) => Box::into_raw(Box::new(CRenderResult {
+                result: std::ptr::null_mut(),
+                error: std::ptr::null_mut(),
+                error_kind: CErrorKind::None,
+            })),
+            Err(e) => render_result(Err(e)),
+        }
+    }))
+}
+
+/// Asks the filter to stop at the next sentence boundary, as if an exclusive stop matched
+///
+/// # Safety
+/// `filter` must be null or a valid pointer returned from `melody_filter_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_request_soft_stop(filter: *mut CFilter) {
+    if filter.is_null() {
+        return;
+    }
+    unsafe { (*(filter.cast::<FilterImpl>())).request_soft_stop() }
+}
+
+/// Marks a retry of the upstream stream, whose replay of the emitted text is dropped
+///
+/// # Safety
+/// `filter` must be null or a valid pointer returned from `melody_filter_new`
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_filter_resume(filter: *mut CFilter) {
+    if filter.is_null() {
+        return;
+    }
+    unsafe { (*(filter.cast::<FilterImpl>())).resume() }
+}
+
+/// Describes a built-in output format as JSON, see `describe_format`
+///
+/// # Safety
+/// - `name` must be a valid null-terminated C string
+/// - The returned `CRenderResult` must be freed with `melody_render_result_free`
+///
+/// # Returns
+/// Returns null if name is null.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_describe_format(name: *const c_char) -> *mut CRenderResult {
+    if name.is_null() {
+        return std::ptr::null_mut();
+    }
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let name = unsafe { CStr::from_ptr(name) }.to_string_lossy();
+        let json = describe_format(&name)
+            .and_then(|format| serde_json::to_string(format).map_err(Into::into));
+        render_result(json)
+    }))
+}
+
 /// Helper function to convert Rust `FilterOutput` to C representation
 ///
 /// # Safety
@@ -639,6 +1616,19 @@ unsafe fn convert_output_to_c(output: FilterOutput) -> CFilterOutput {
             std::ptr::null_mut()
         };
 
+        let top_logprobs_lens_len = output.logprobs.top_logprobs.len();
+        let (mut top_lens, mut top_ids, mut top_lps) = (Vec::new(), Vec::new(), Vec::new());
+        for top in output.logprobs.top_logprobs {
+            let len = top.token_ids.len().min(top.logprobs.len());
+            top_lens.push(len);
+            top_ids.extend_from_slice(&top.token_ids[..len]);
+            top_lps.extend_from_slice(&top.logprobs[..len]);
+        }
+        let top_logprobs_len = top_ids.len();
+        let top_logprobs_lens = boxed_or_null(top_lens);
+        let top_token_ids = boxed_or_null(top_ids);
+        let top_logprobs = boxed_or_null(top_lps);
+
         let (search_query_index, search_query_text) = if let Some(sq) = output.search_query {
             #[allow(clippy::cast_possible_truncation, clippy::cast_possible_wrap)]
             let index = sq.index.min(i32::MAX as usize) as i32;
@@ -701,6 +1691,26 @@ unsafe fn convert_output_to_c(output: FilterOutput) -> CFilterOutput {
             )
         };
 
+        let (finish_reason, stop_sequence) = if let Some(finish) = output.finish {
+            let reason = match finish.reason {
+                FinishReason::InclusiveStop => CFinishReason::InclusiveStop,
+                FinishReason::ExclusiveStop => CFinishReason::ExclusiveStop,
+                FinishReason::EndOfSequence => CFinishReason::EndOfSequence,
+                FinishReason::Flush => CFinishReason::Flush,
+            };
+            (
+                reason as i32,
+                CString::new(finish.stop_sequence).unwrap().into_raw(),
+            )
+        } else {
+            (-1, std::ptr::null_mut())
+        };
+
+        let (relevant_doc_indices, relevant_doc_indices_len, has_relevant_doc_indices) =
+            doc_indices_to_c(output.relevant_doc_indices);
+        let (cited_doc_indices, cited_doc_indices_len, has_cited_doc_indices) =
+            doc_indices_to_c(output.cited_doc_indices);
+
         CFilterOutput {
             text,
             text_len: if text.is_null() {
@@ -712,6 +1722,11 @@ unsafe fn convert_output_to_c(output: FilterOutput) -> CFilterOutput {
             token_ids_len,
             logprobs,
             logprobs_len,
+            top_logprobs_lens,
+            top_logprobs_lens_len,
+            top_token_ids,
+            top_logprobs,
+            top_logprobs_len,
             search_query_index,
             search_query_text,
             citations,
@@ -724,10 +1739,45 @@ unsafe fn convert_output_to_c(output: FilterOutput) -> CFilterOutput {
             tool_call_raw_param_delta,
             is_post_answer: output.is_post_answer,
             is_reasoning: output.is_reasoning,
+            plan_index: output.plan_index,
+            is_echo: output.is_echo,
+            finish_reason,
+            stop_sequence,
+            relevant_doc_indices,
+            relevant_doc_indices_len,
+            has_relevant_doc_indices,
+            cited_doc_indices,
+            cited_doc_indices_len,
+            has_cited_doc_indices,
         }
     }
 }
 
+/// Returns the values as a C array, or null if there are none.
+fn boxed_or_null<T>(values: Vec<T>) -> *mut T {
+    if values.is_empty() {
+        std::ptr::null_mut()
+    } else {
+        Box::into_raw(values.into_boxed_slice()).cast::<T>()
+    }
+}
+
+/// Converts document indices to a C array, its length and whether they are set.
+fn doc_indices_to_c(indices: Option<Vec<usize>>) -> (*mut usize, usize, bool) {
+    match indices {
+        Some(indices) if !indices.is_empty() => {
+            let len = indices.len();
+            (
+                Box::into_raw(indices.into_boxed_slice()).cast::<usize>(),
+                len,
+                true,
+            )
+        }
+        Some(_) => (std::ptr::null_mut(), 0, true),
+        None => (std::ptr::null_mut(), 0, false),
+    }
+}
+
 /// Converts a single `FilterCitation` to its C representation.
 ///
 /// # Safety
@@ -753,6 +1803,9 @@ unsafe fn convert_citation_to_c(citation: FilterCitation) -> CFilterCitation {
                     tool_call_index: s.tool_call_index,
                     tool_result_indices: indices,
                     tool_result_indices_len: indices_len,
+                    source_name: s.source_name.map_or(std::ptr::null_mut(), |n| {
+                        CString::new(n).unwrap().into_raw()
+                    }),
                 }
             })
             .collect();
@@ -798,6 +1851,7 @@ pub unsafe extern "C" fn melody_result_free(res: *mut CFilterOutputResult) {
 /// # Safety
 /// `arr` must be a valid pointer returned from `melody_filter_write_decoded` or `melody_filter_flush_partials`
 #[unsafe(no_mangle)]
+#[allow(clippy::too_many_lines)]
 pub unsafe extern "C" fn melody_filter_output_array_free(arr: *mut CFilterOutputArray) {
     if arr.is_null() {
         return;
@@ -832,6 +1886,9 @@ pub unsafe extern "C" fn melody_filter_output_array_free(arr: *mut CFilterOutput
                 if !output.tool_call_raw_param_delta.is_null() {
                     let _ = CString::from_raw(output.tool_call_raw_param_delta);
                 }
+                if !output.stop_sequence.is_null() {
+                    let _ = CString::from_raw(output.stop_sequence);
+                }
 
                 // Free token_ids and logprobs
                 if !output.token_ids.is_null() && output.token_ids_len > 0 {
@@ -848,6 +1905,43 @@ pub unsafe extern "C" fn melody_filter_output_array_free(arr: *mut CFilterOutput
                         output.logprobs_len,
                     );
                 }
+                if !output.top_logprobs_lens.is_null() && output.top_logprobs_lens_len > 0 {
+                    let _ = Vec::from_raw_parts(
+                        output.top_logprobs_lens,
+                        output.top_logprobs_lens_len,
+                        output.top_logprobs_lens_len,
+                    );
+                }
+                if !output.top_token_ids.is_null() && output.top_logprobs_len > 0 {
+                    let _ = Vec::from_raw_parts(
+                        output.top_token_ids,
+                        output.top_logprobs_len,
+                        output.top_logprobs_len,
+                    );
+                }
+                if !output.top_logprobs.is_null() && output.top_logprobs_len > 0 {
+                    let _ = Vec::from_raw_parts(
+                        output.top_logprobs,
+                        output.top_logprobs_len,
+                        output.top_logprobs_len,
+                    );
+                }
+
+                // Free document indices
+                if !output.relevant_doc_indices.is_null() && output.relevant_doc_indices_len > 0 {
+                    let _ = Vec::from_raw_parts(
+                        output.relevant_doc_indices,
+                        output.relevant_doc_indices_len,
+                        output.relevant_doc_indices_len,
+                    );
+                }
+                if !output.cited_doc_indices.is_null() && output.cited_doc_indices_len > 0 {
+                    let _ = Vec::from_raw_parts(
+                        output.cited_doc_indices,
+                        output.cited_doc_indices_len,
+                        output.cited_doc_indices_len,
+                    );
+                }
 
                 // Free citations
                 if !output.citations.is_null() && output.citations_len > 0 {
@@ -878,6 +1972,9 @@ pub unsafe extern "C" fn melody_filter_output_array_free(arr: *mut CFilterOutput
                                         source.tool_result_indices_len,
                                     );
                                 }
+                                if !source.source_name.is_null() {
+                                    let _ = CString::from_raw(source.source_name);
+                                }
                             }
                         }
                     }
@@ -925,6 +2022,8 @@ pub enum CContentType {
     Image = 3,
     /// Document content.
     Document = 4,
+    /// A marker for turns elided from the history.
+    ElidedTurns = 5,
 }
 
 /// C-compatible enum for citation quality.
@@ -985,6 +2084,28 @@ pub enum CReasoningType {
     Disabled = 2,
 }
 
+/// C-compatible enum for fill-in-the-middle model families.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CFimFamily {
+    /// Cohere Command models.
+    Command = 0,
+    /// Code Llama models.
+    CodeLlama = 1,
+    /// `StarCoder` models.
+    StarCoder = 2,
+}
+
+/// C-compatible enum for the kinds of structured output.
+#[repr(C)]
+#[derive(Copy, Clone)]
+pub enum CStructuredOutputMode {
+    /// Any JSON object, without a schema.
+    JsonObject = 0,
+    /// A JSON object that adheres to a schema.
+    JsonSchema = 1,
+}
+
 /// C-compatible struct for tool definitions.
 #[repr(C)]
 pub struct CTool {
@@ -1016,6 +2137,8 @@ pub struct CContent {
     pub image: *const CImage,
     /// Document as a JSON string (null if None)
     pub document_json: *const c_char,
+    /// Number of turns omitted, for elided turns content
+    pub elided_turns: usize,
 }
 
 /// C-compatible struct for tool calls.
@@ -1155,6 +2278,7 @@ fn map_content_type(t: CContentType) -> ContentType {
         CContentType::Thinking => ContentType::Thinking,
         CContentType::Image => ContentType::Image,
         CContentType::Document => ContentType::Document,
+        CContentType::ElidedTurns => ContentType::ElidedTurns,
     }
 }
 
@@ -1195,6 +2319,23 @@ fn map_reasoning_type(r: CReasoningType) -> ReasoningType {
     }
 }
 
+/// Maps a `CFimFamily` to a Rust `FimFamily`.
+fn map_fim_family(f: CFimFamily) -> FimFamily {
+    match f {
+        CFimFamily::Command => FimFamily::Command,
+        CFimFamily::CodeLlama => FimFamily::CodeLlama,
+        CFimFamily::StarCoder => FimFamily::StarCoder,
+    }
+}
+
+/// Maps a `CStructuredOutputMode` to a Rust `StructuredOutputMode`.
+fn map_structured_output_mode(m: CStructuredOutputMode) -> StructuredOutputMode {
+    match m {
+        CStructuredOutputMode::JsonObject => StructuredOutputMode::JsonObject,
+        CStructuredOutputMode::JsonSchema => StructuredOutputMode::JsonSchema,
+    }
+}
+
 /// Converts a nullable C string pointer to an Option<String>.
 unsafe fn cstr_opt(ptr: *const c_char) -> Option<String> {
     if ptr.is_null() {
@@ -1268,6 +2409,7 @@ unsafe fn convert_ccontent(content: &CContent) -> Content {
         thinking: unsafe { cstr_opt(content.thinking) },
         image,
         document,
+        elided_turns: content.elided_turns,
     }
 }
 
@@ -1293,9 +2435,20 @@ unsafe fn convert_csource(source: &CSource) -> Source {
         Vec::new()
     };
 
+    let source_name = if source.source_name.is_null() {
+        None
+    } else {
+        Some(
+            unsafe { CStr::from_ptr(source.source_name) }
+                .to_string_lossy()
+                .into_owned(),
+        )
+    };
+
     Source {
         tool_call_index: source.tool_call_index,
         tool_result_indices,
+        source_name,
     }
 }
 
@@ -1530,35 +2683,13 @@ unsafe fn convert_cmd4_options<'a>(opts: &CRenderCmd4Options) -> RenderCmd4Optio
 pub unsafe extern "C" fn melody_render_cmd3(opts: *const CRenderCmd3Options) -> *mut CRenderResult {
     catch_panic_render_result(AssertUnwindSafe(|| {
         if opts.is_null() {
-            let err = CString::new("null options pointer")
-                .unwrap_or_else(|_| CString::new("null options").unwrap())
-                .into_raw();
-            return Box::into_raw(Box::new(CRenderResult {
-                result: std::ptr::null_mut(),
-                error: err,
-            }));
+            return render_error(
+                CErrorKind::InvalidArgument,
+                "null options pointer".to_string(),
+            );
         }
         let rust_opts = unsafe { convert_cmd3_options(&*opts) };
-        match render_cmd3(&rust_opts) {
-            Ok(s) => {
-                let result = CString::new(s)
-                    .unwrap_or_else(|_| CString::new("result contained null bytes").unwrap())
-                    .into_raw();
-                Box::into_raw(Box::new(CRenderResult {
-                    result,
-                    error: std::ptr::null_mut(),
-                }))
-            }
-            Err(e) => {
-                let error = CString::new(e.to_string())
-                    .unwrap_or_else(|_| CString::new("error message contained null bytes").unwrap())
-                    .into_raw();
-                Box::into_raw(Box::new(CRenderResult {
-                    result: std::ptr::null_mut(),
-                    error,
-                }))
-            }
-        }
+        render_result(render_cmd3(&rust_opts))
     }))
 }
 
@@ -1574,35 +2705,13 @@ pub unsafe extern "C" fn melody_render_cmd3(opts: *const CRenderCmd3Options) ->
 pub unsafe extern "C" fn melody_render_cmd4(opts: *const CRenderCmd4Options) -> *mut CRenderResult {
     catch_panic_render_result(AssertUnwindSafe(|| {
         if opts.is_null() {
-            let err = CString::new("null options pointer")
-                .unwrap_or_else(|_| CString::new("null options").unwrap())
-                .into_raw();
-            return Box::into_raw(Box::new(CRenderResult {
-                result: std::ptr::null_mut(),
-                error: err,
-            }));
+            return render_error(
+                CErrorKind::InvalidArgument,
+                "null options pointer".to_string(),
+            );
         }
         let rust_opts = unsafe { convert_cmd4_options(&*opts) };
-        match render_cmd4(&rust_opts) {
-            Ok(s) => {
-                let result = CString::new(s)
-                    .unwrap_or_else(|_| CString::new("result contained null bytes").unwrap())
-                    .into_raw();
-                Box::into_raw(Box::new(CRenderResult {
-                    result,
-                    error: std::ptr::null_mut(),
-                }))
-            }
-            Err(e) => {
-                let error = CString::new(e.to_string())
-                    .unwrap_or_else(|_| CString::new("error message contained null bytes").unwrap())
-                    .into_raw();
-                Box::into_raw(Box::new(CRenderResult {
-                    result: std::ptr::null_mut(),
-                    error,
-                }))
-            }
-        }
+        render_result(render_cmd4(&rust_opts))
     }))
 }
 
@@ -1626,10 +2735,483 @@ pub unsafe extern "C" fn melody_render_result_free(res: *mut CRenderResult) {
     }
 }
 
+// ============================================================================
+// Preamble FFI functions
+// ============================================================================
+
+/// C-compatible struct for cmd3 preamble options.
+#[repr(C)]
+pub struct CPreambleOptions {
+    /// Safety mode enum
+    pub safety_mode: CSafetyMode,
+    /// Whether safety mode is set
+    pub has_safety_mode: bool,
+    /// Citation quality enum
+    pub citation_quality: CCitationQuality,
+    /// Whether citation quality is set, the tool use instructions are left out if not
+    pub has_citation_quality: bool,
+    /// Reasoning type enum
+    pub reasoning_type: CReasoningType,
+    /// Whether reasoning type is set
+    pub has_reasoning_type: bool,
+    /// Developer instruction as a null-terminated C string
+    pub dev_instruction: *const c_char,
+}
+
+/// Returns the JSON encoding of the document index map of `messages` rendered with
+/// `documents_len` documents, in a struct with result or error.
+/// # Safety
+/// `messages` must point to `messages_len` valid messages, or be null.
+/// Caller must free return value with `melody_render_result_free`.
+#[unsafe(no_mangle)]
+#[allow(clippy::missing_panics_doc)]
+pub unsafe extern "C" fn melody_document_index_map(
+    messages: *const CMessage,
+    messages_len: usize,
+    documents_len: usize,
+) -> *mut CRenderResult {
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let messages: Vec<Message> = if !messages.is_null() && messages_len > 0 {
+            unsafe { slice::from_raw_parts(messages, messages_len) }
+                .iter()
+                .map(|m| unsafe { convert_cmessage(m) })
+                .collect()
+        } else {
+            Vec::new()
+        };
+        let json = document_index_map(&messages, documents_len)
+            .and_then(|map| serde_json::to_string(&map).map_err(Into::into));
+        render_result(json)
+    }))
+}
+
+/// Converts a result to a heap-allocated `CRenderResult`.
+fn render_result(res: Result<String, MelodyError>) -> *mut CRenderResult {
+    match res {
+        Ok(s) => {
+            let result = CString::new(s)
+                .unwrap_or_else(|_| CString::new("result contained null bytes").unwrap())
+                .into_raw();
+            Box::into_raw(Box::new(CRenderResult {
+                result,
+                error: std::ptr::null_mut(),
+                error_kind: CErrorKind::None,
+            }))
+        }
+        Err(e) => render_error((&e).into(), e.to_string()),
+    }
+}
+
+/// Returns a heap-allocated `CRenderResult` with an error of the given kind.
+fn render_error(kind: CErrorKind, msg: String) -> *mut CRenderResult {
+    let error = CString::new(msg)
+        .unwrap_or_else(|_| CString::new("error message contained null bytes").unwrap())
+        .into_raw();
+    Box::into_raw(Box::new(CRenderResult {
+        result: std::ptr::null_mut(),
+        error,
+        error_kind: kind,
+    }))
+}
+
+/// Builds the cmd3 system preamble and returns a struct with result or error.
+/// # Safety
+/// Caller must free return value with `melody_render_result_free`.
+///
+/// # Returns
+/// Returns a result struct with either the preamble or an error message.
+/// If a panic occurs, returns a result struct with an error describing the panic.
+#[unsafe(no_mangle)]
+#[allow(clippy::missing_panics_doc)]
+pub unsafe extern "C" fn melody_build_preamble(
+    opts: *const CPreambleOptions,
+) -> *mut CRenderResult {
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        if opts.is_null() {
+            return render_error(
+                CErrorKind::InvalidArgument,
+                "null options pointer".to_string(),
+            );
+        }
+        let opts = unsafe { &*opts };
+        let safety_mode = opts
+            .has_safety_mode
+            .then(|| map_safety_mode(opts.safety_mode));
+        let citation_quality = opts
+            .has_citation_quality
+            .then(|| map_citation_quality(opts.citation_quality));
+        let reasoning_type = opts
+            .has_reasoning_type
+            .then(|| map_reasoning_type(opts.reasoning_type));
+        let dev_instruction = unsafe { cstr_opt(opts.dev_instruction) };
+
+        let preamble = build_preamble(
+            safety_mode.as_ref(),
+            citation_quality.as_ref(),
+            reasoning_type.as_ref(),
+            dev_instruction.as_deref(),
+        );
+        render_result(Ok(preamble))
+    }))
+}
+
+/// Builds the structured output section of a prompt and returns a struct with result or
+/// error.
+/// # Safety
+/// - `schema` must be null or a valid null-terminated C string
+/// - Caller must free return value with `melody_render_result_free`
+///
+/// # Returns
+/// Returns a result struct with either the section or an error message if the schema is
+/// invalid or unsupported.
+/// If a panic occurs, returns a result struct with an error describing the panic.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_build_structured_output_section(
+    schema: *const c_char,
+    mode: CStructuredOutputMode,
+) -> *mut CRenderResult {
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let schema = unsafe { cstr_opt(schema) };
+        render_result(build_structured_output_section(
+            schema.as_deref(),
+            map_structured_output_mode(mode),
+        ))
+    }))
+}
+
+// ============================================================================
+// Fill-in-the-middle FFI functions
+// ============================================================================
+
+/// C-compatible struct for fill-in-the-middle render options.
+#[repr(C)]
+pub struct CRenderFimOptions {
+    /// Model family enum
+    pub family: CFimFamily,
+    /// Escaped special tokens as a JSON string
+    pub escaped_special_tokens_json: *const c_char,
+}
+
+/// Renders a fill-in-the-middle prompt and returns a struct with result or error.
+/// # Safety
+/// `prefix` and `suffix` must be valid null-terminated C strings.
+/// Caller must free return value with `melody_render_result_free`.
+///
+/// # Returns
+/// Returns a result struct with either the rendered prompt or an error message.
+/// If a panic occurs, returns a result struct with an error describing the panic.
+#[unsafe(no_mangle)]
+#[allow(clippy::missing_panics_doc)]
+pub unsafe extern "C" fn melody_render_fim(
+    prefix: *const c_char,
+    suffix: *const c_char,
+    opts: *const CRenderFimOptions,
+) -> *mut CRenderResult {
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        if opts.is_null() {
+            return render_error(
+                CErrorKind::InvalidArgument,
+                "null options pointer".to_string(),
+            );
+        }
+        let opts = unsafe { &*opts };
+        let escaped_special_tokens_raw =
+            unsafe { parse_json_object(opts.escaped_special_tokens_json) };
+        let rust_opts = RenderFimOptions {
+            family: map_fim_family(opts.family),
+            escaped_special_tokens: escaped_special_tokens_raw
+                .into_iter()
+                .filter_map(|(k, v)| v.as_str().map(|s| (k, s.to_string())))
+                .collect(),
+        };
+        let prefix = unsafe { cstr_opt(prefix) }.unwrap_or_default();
+        let suffix = unsafe { cstr_opt(suffix) }.unwrap_or_default();
+
+        render_result(Ok(render_fim(&prefix, &suffix, &rust_opts)))
+    }))
+}
+
+// ============================================================================
+// Template extension FFI functions
+// ============================================================================
+
+/// Callback implementing a custom template filter or tag.
+///
+/// Receives the caller's `handle`, the filter input as JSON (`null` for tags) and
+/// the arguments as a JSON array. Returns the result as JSON, or null and sets
+/// `error`. Both returned strings must be allocated with `malloc`, they are freed
+/// by melody.
+pub type CTemplateCallback = unsafe extern "C" fn(
+    handle: usize,
+    input_json: *const c_char,
+    args_json: *const c_char,
+    error: *mut *mut c_char,
+) -> *mut c_char;
+
+unsafe extern "C" {
+    fn free(ptr: *mut c_void);
+}
+
+/// Calls a template callback and decodes its JSON result.
+fn call_template_callback(
+    callback: CTemplateCallback,
+    handle: usize,
+    input: &Value,
+    args: &[Value],
+) -> Result<Value, String> {
+    let input = CString::new(input.to_string()).map_err(|e| e.to_string())?;
+    let args = CString::new(Value::from(args.to_vec()).to_string()).map_err(|e| e.to_string())?;
+    let mut error: *mut c_char = std::ptr::null_mut();
+    unsafe {
+        let out = callback(handle, input.as_ptr(), args.as_ptr(), &raw mut error);
+        let out_str = (!out.is_null()).then(|| CStr::from_ptr(out).to_string_lossy().into_owned());
+        if !out.is_null() {
+            free(out.cast());
+        }
+        if !error.is_null() {
+            let msg = CStr::from_ptr(error).to_string_lossy().into_owned();
+            free(error.cast());
+            return Err(msg);
+        }
+        let out_str = out_str.ok_or_else(|| "template callback returned no result".to_string())?;
+        serde_json::from_str(&out_str).map_err(|e| e.to_string())
+    }
+}
+
+/// Registers a custom filter with the shared template engine.
+///
+/// # Safety
+/// `name` must be a valid null-terminated C string
+/// `callback` must remain callable with `handle` for as long as templates are rendered
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_template_register_filter(
+    name: *const c_char,
+    callback: CTemplateCallback,
+    handle: usize,
+) {
+    if name.is_null() {
+        return;
+    }
+    let name = unsafe { CStr::from_ptr(name).to_string_lossy() };
+    register_filter(&name, move |input, args| {
+        call_template_callback(callback, handle, input, args)
+    });
+}
+
+/// Registers a custom tag with the shared template engine.
+///
+/// The tag renders its result if it is a JSON string, and the JSON encoding of it otherwise.
+///
+/// # Safety
+/// `name` must be a valid null-terminated C string
+/// `callback` must remain callable with `handle` for as long as templates are rendered
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_template_register_tag(
+    name: *const c_char,
+    callback: CTemplateCallback,
+    handle: usize,
+) {
+    if name.is_null() {
+        return;
+    }
+    let name = unsafe { CStr::from_ptr(name).to_string_lossy() };
+    register_tag(&name, move |args| {
+        match call_template_callback(callback, handle, &Value::Null, args)? {
+            Value::String(s) => Ok(s),
+            v => Ok(v.to_string()),
+        }
+    });
+}
+
+/// Registers a named partial with the shared template engine.
+///
+/// # Safety
+/// - `name` and `body` must be valid null-terminated C strings
+/// - The returned `CRenderResult` must be freed with `melody_render_result_free`
+///
+/// # Returns
+/// Returns null if inputs are invalid, and a `CRenderResult` with a null result on success
+/// or an error if the body cannot be parsed.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_template_register_partial(
+    name: *const c_char,
+    body: *const c_char,
+) -> *mut CRenderResult {
+    if name.is_null() || body.is_null() {
+        return std::ptr::null_mut();
+    }
+    catch_panic_render_result(AssertUnwindSafe(|| {
+        let name = unsafe { CStr::from_ptr(name).to_string_lossy() };
+        let body = unsafe { CStr::from_ptr(body).to_string_lossy() };
+        match register_partial(&name, &body) {
+            Ok(()) => Box::into_raw(Box::new(CRenderResult {
+                result: std::ptr::null_mut(),
+                error: std::ptr::null_mut(),
+                error_kind: CErrorKind::None,
+            })),
+            Err(e) => render_result(Err(e)),
+        }
+    }))
+}
+
+// ============================================================================
+// Template cache FFI functions
+// ============================================================================
+
+/// C-compatible counters and size of the template cache.
+#[repr(C)]
+pub struct CTemplateCacheStats {
+    /// Number of compiles served from the cache
+    pub hits: u64,
+    /// Number of compiles that parsed the template
+    pub misses: u64,
+    /// Number of templates evicted from the cache
+    pub evictions: u64,
+    /// Number of templates in the cache
+    pub len: usize,
+    /// Maximum number of templates in the cache
+    pub capacity: usize,
+}
+
+/// Sets the maximum number of compiled templates kept by the template cache.
+/// A capacity of 0 disables caching.
+#[unsafe(no_mangle)]
+pub extern "C" fn melody_template_cache_set_capacity(capacity: usize) {
+    set_template_cache_capacity(capacity);
+}
+
+/// Returns the counters and size of the template cache.
+#[unsafe(no_mangle)]
+pub extern "C" fn melody_template_cache_stats() -> CTemplateCacheStats {
+    let stats = template_cache_stats();
+    CTemplateCacheStats {
+        hits: stats.hits,
+        misses: stats.misses,
+        evictions: stats.evictions,
+        len: stats.len,
+        capacity: stats.capacity,
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_render_result_error_kind() {
+        unsafe {
+            let res = melody_render_cmd3(std::ptr::null());
+            assert_eq!((*res).error_kind, CErrorKind::InvalidArgument);
+            melody_render_result_free(res);
+
+            let res = render_result(Err(MelodyError::TemplateValidation(
+                "message[0] has tool call with empty id".to_string(),
+            )));
+            assert_eq!((*res).error_kind, CErrorKind::InvalidMessages);
+            assert_eq!(
+                CStr::from_ptr((*res).error).to_str().unwrap(),
+                "Template validation error: message[0] has tool call with empty id"
+            );
+            melody_render_result_free(res);
+
+            let res = catch_panic_render_result(|| panic!("boom"));
+            assert_eq!((*res).error_kind, CErrorKind::Panic);
+            melody_render_result_free(res);
+
+            let res = render_result(Ok("prompt".to_string()));
+            assert_eq!((*res).error_kind, CErrorKind::None);
+            melody_render_result_free(res);
+        }
+    }
+
+    #[test]
+    fn test_write_decoded_batch() {
+        let options = FilterOptions::new().cmd3();
+        let tokens = ["<|START_RESPONSE|>", "Hello", " wor", "ld"];
+        let mut want = new_filter(options.clone());
+        let want: Vec<FilterOutput> = tokens
+            .iter()
+            .zip([vec![1], vec![2], vec![3, 4], vec![]])
+            .flat_map(|(token, ids)| {
+                want.write_decoded(
+                    token,
+                    TokenIDsWithLogProb {
+                        logprobs: vec![-0.5; ids.len()],
+                        token_ids: ids,
+                        ..Default::default()
+                    },
+                )
+            })
+            .collect();
+
+        let text = tokens.concat();
+        let text_lens: Vec<usize> = tokens.iter().map(|t| t.len()).collect();
+        let lens = [1, 1, 2, 0];
+        unsafe {
+            let filter = Box::into_raw(Box::new(new_filter(options))).cast::<CFilter>();
+            let res = melody_filter_write_decoded_batch(
+                filter,
+                text.as_ptr().cast(),
+                text_lens.as_ptr(),
+                tokens.len(),
+                [1, 2, 3, 4].as_ptr(),
+                lens.as_ptr(),
+                [-0.5; 4].as_ptr(),
+                lens.as_ptr(),
+            );
+            let arr = &*(*res).result;
+            let outputs = slice::from_raw_parts(arr.outputs, arr.len);
+            assert_eq!(outputs.len(), want.len());
+            for (got, want) in outputs.iter().zip(&want) {
+                assert_eq!(CStr::from_ptr(got.text).to_str().unwrap(), want.text);
+                let ids = slice_or_empty(got.token_ids.cast_const(), got.token_ids_len);
+                assert_eq!(ids, want.logprobs.token_ids);
+            }
+            melody_result_free(res);
+            melody_filter_free(filter);
+        }
+    }
+
+    #[test]
+    fn test_write_decoded_with_top_logprobs() {
+        let tokens = [("Hello", 1, [-0.1, -2.0]), (" world", 2, [-0.3, -1.5])];
+        let (mut ids, mut logprobs) = (Vec::new(), Vec::new());
+        unsafe {
+            let filter =
+                Box::into_raw(Box::new(new_filter(FilterOptions::new()))).cast::<CFilter>();
+            for (token, id, top) in tokens {
+                let token = CString::new(token).unwrap();
+                let res = melody_filter_write_decoded_with_top_logprobs(
+                    filter,
+                    token.as_ptr(),
+                    &raw const id,
+                    1,
+                    top.as_ptr(),
+                    1,
+                    [2].as_ptr(),
+                    1,
+                    [id, id + 10].as_ptr(),
+                    top.as_ptr(),
+                );
+                let arr = &*(*res).result;
+                for out in slice::from_raw_parts(arr.outputs, arr.len) {
+                    let lens = slice_or_empty(
+                        out.top_logprobs_lens.cast_const(),
+                        out.top_logprobs_lens_len,
+                    );
+                    assert_eq!(lens, vec![2; out.token_ids_len]);
+                    let len = out.top_logprobs_len;
+                    ids.extend_from_slice(slice_or_empty(out.top_token_ids.cast_const(), len));
+                    logprobs.extend_from_slice(slice_or_empty(out.top_logprobs.cast_const(), len));
+                }
+                melody_result_free(res);
+            }
+            melody_filter_free(filter);
+        }
+        assert_eq!(ids, vec![1, 11, 2, 12]);
+        assert_eq!(logprobs, vec![-0.1, -2.0, -0.3, -1.5]);
+    }
+
     #[test]
     fn test_catch_panic_filter_result_catches_panic() {
         let result_ptr = catch_panic_filter_result(|| {
@@ -1670,4 +3252,38 @@ mod tests {
             melody_result_free(result_ptr);
         }
     }
+
+    unsafe extern "C" {
+        fn strdup(s: *const c_char) -> *mut c_char;
+    }
+
+    // Echoes the arguments of a call, or fails with the handle as the message
+    unsafe extern "C" fn echo_args_callback(
+        handle: usize,
+        _input_json: *const c_char,
+        args_json: *const c_char,
+        error: *mut *mut c_char,
+    ) -> *mut c_char {
+        unsafe {
+            if handle == 0 {
+                return strdup(args_json);
+            }
+            let msg = CString::new(format!("failed {handle}")).unwrap();
+            *error = strdup(msg.as_ptr());
+            std::ptr::null_mut()
+        }
+    }
+
+    #[test]
+    fn test_call_template_callback() {
+        let args = [Value::from(1), Value::from("a")];
+        assert_eq!(
+            call_template_callback(echo_args_callback, 0, &Value::Null, &args),
+            Ok(Value::from(args.to_vec()))
+        );
+        assert_eq!(
+            call_template_callback(echo_args_callback, 7, &Value::Null, &args),
+            Err("failed 7".to_string())
+        );
+    }
 }
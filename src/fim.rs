@@ -0,0 +1,73 @@
+//! Fill-in-the-middle model families
+//!
+//! The family of a model sets the special tokens of its fill-in-the-middle prompts, which
+//! the templating module renders and the parsing module strips from the completions.
+
+use serde::Deserialize;
+
+/// Model family of a fill-in-the-middle prompt, which determines its special tokens and layout.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(try_from = "String")]
+pub enum FimFamily {
+    /// Cohere Command models.
+    #[default]
+    Command,
+    /// Code Llama models.
+    CodeLlama,
+    /// `StarCoder` models.
+    StarCoder,
+}
+
+impl TryFrom<String> for FimFamily {
+    type Error = String;
+    fn try_from(value: String) -> Result<Self, Self::Error> {
+        match value.to_ascii_lowercase().as_str() {
+            "command" => Ok(FimFamily::Command),
+            "code_llama" => Ok(FimFamily::CodeLlama),
+            "starcoder" => Ok(FimFamily::StarCoder),
+            other => Err(format!(
+                "invalid FimFamily '{other}', expected one of: command, code_llama, starcoder"
+            )),
+        }
+    }
+}
+
+/// The special tokens of a fill-in-the-middle prompt.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FimSentinels {
+    /// Starts the text before the gap.
+    pub prefix: &'static str,
+    /// Starts the text after the gap.
+    pub suffix: &'static str,
+    /// Starts the completion that fills the gap.
+    pub middle: &'static str,
+    /// Ends the completion that fills the gap.
+    pub end: &'static str,
+}
+
+impl FimFamily {
+    /// Returns the special tokens of the model family.
+    #[must_use]
+    pub fn sentinels(self) -> FimSentinels {
+        match self {
+            FimFamily::Command => FimSentinels {
+                prefix: "<|BEGINNING_OF_PREFIX_FIM_TOKEN|>",
+                suffix: "<|BEGINNING_OF_SUFFIX_FIM_TOKEN|>",
+                middle: "<|BEGINNING_OF_MIDDLE_FIM_TOKEN|>",
+                end: "<|END_OF_MIDDLE_FIM_TOKEN|>",
+            },
+            FimFamily::CodeLlama => FimSentinels {
+                prefix: "<PRE>",
+                suffix: "<SUF>",
+                middle: "<MID>",
+                end: "<EOT>",
+            },
+            FimFamily::StarCoder => FimSentinels {
+                prefix: "<fim_prefix>",
+                suffix: "<fim_suffix>",
+                middle: "<fim_middle>",
+                end: "<|endoftext|>",
+            },
+        }
+    }
+}
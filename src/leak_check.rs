@@ -0,0 +1,49 @@
+//! Allocation counting for the leak tests of the bindings
+//!
+//! With the `ffileak` feature the library counts the allocations it has not freed yet, so
+//! a binding can check that a workload gives back everything it took, e.g. that every
+//! result returned through the C API was freed.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicI64, Ordering};
+
+static LIVE_ALLOCATIONS: AtomicI64 = AtomicI64::new(0);
+
+/// The system allocator, counting the live allocations
+struct CountingAllocator;
+
+unsafe impl GlobalAlloc for CountingAllocator {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        let ptr = unsafe { System.alloc(layout) };
+        if !ptr.is_null() {
+            LIVE_ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        }
+        ptr
+    }
+
+    unsafe fn alloc_zeroed(&self, layout: Layout) -> *mut u8 {
+        let ptr = unsafe { System.alloc_zeroed(layout) };
+        if !ptr.is_null() {
+            LIVE_ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        }
+        ptr
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        unsafe { System.dealloc(ptr, layout) };
+        LIVE_ALLOCATIONS.fetch_sub(1, Ordering::Relaxed);
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        unsafe { System.realloc(ptr, layout, new_size) }
+    }
+}
+
+#[global_allocator]
+static GLOBAL: CountingAllocator = CountingAllocator;
+
+/// Returns the number of allocations of the library that were not freed yet
+#[unsafe(no_mangle)]
+pub extern "C" fn melody_live_allocations() -> i64 {
+    LIVE_ALLOCATIONS.load(Ordering::Relaxed)
+}
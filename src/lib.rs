@@ -101,6 +101,9 @@
 /// Error types for the Melody library.
 pub mod errors;
 
+/// Fill-in-the-middle model families, shared by the parsing and templating modules.
+pub mod fim;
+
 /// Parsing module for token stream processing and filtering.
 ///
 /// Contains the filter implementation, options, and types for processing
@@ -120,6 +123,14 @@ pub mod ffi;
 #[cfg(feature = "python_ffi")]
 mod python_ffi;
 
+// Counts the live allocations of the library for the leak tests of the bindings
+#[cfg(feature = "ffileak")]
+pub mod leak_check;
+
+// WebAssembly bindings for running the filter in a wasm host
+#[cfg(feature = "wasm")]
+pub mod wasm;
+
 #[cfg(feature = "tkzrs")]
 /// Tokenizer FFI bindings for cross-language tokenization support.
 ///
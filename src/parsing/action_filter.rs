@@ -6,8 +6,11 @@
 
 use crate::parsing::filter::FilterImpl;
 use crate::parsing::param_filter::ParamState;
-use crate::parsing::types::{FilterOutput, FilterToolCallDelta, FilterToolParameter};
+use crate::parsing::types::{
+    FilterOutput, FilterSearchQueryDelta, FilterToolCallDelta, FilterToolParameter,
+};
 use regex::Regex;
+use serde::{Deserialize, Serialize};
 use std::sync::LazyLock;
 
 // Compile regexes once at startup to avoid recompilation in hot path
@@ -15,6 +18,8 @@ static TOOL_CALL_ID_REGEX: LazyLock<Regex> =
     LazyLock::new(|| Regex::new(r#""tool_call_id":\s*""#).expect("Invalid tool_call_id regex"));
 static TOOL_NAME_REGEX: LazyLock<Regex> =
     LazyLock::new(|| Regex::new(r#""tool_name":\s*""#).expect("Invalid tool_name regex"));
+static LLAMA_TOOL_NAME_REGEX: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r#""name":\s*""#).expect("Invalid llama name regex"));
 static PARAM_REGEX: LazyLock<Regex> =
     LazyLock::new(|| Regex::new(r#""parameters":\s*\{\s*""#).expect("Invalid parameters regex"));
 static RAW_PARAM_REGEX: LazyLock<Regex> =
@@ -22,13 +27,20 @@ static RAW_PARAM_REGEX: LazyLock<Regex> =
 static PARAM_NAME_REGEX: LazyLock<Regex> =
     LazyLock::new(|| Regex::new(r"\s*:\s*").expect("Invalid param name regex"));
 
+/// Names of the tools whose `queries` parameter holds search queries.
+const SEARCH_TOOL_NAMES: [&str; 2] = ["search", "internet_search"];
+/// Name of the search tool parameter holding the array of queries.
+const SEARCH_QUERIES_PARAM: &str = "queries";
+/// Length of the longest JSON string escape, a surrogate pair like `\ud83c\udf08`.
+const MAX_ESCAPE_LEN: usize = 12;
+
 /// State machine modes for parsing tool call JSON.
 ///
 /// The action parser uses this state machine to track where it is in the
 /// JSON structure of a tool call. Transitions occur as specific elements
 /// are recognized.
 ///
-#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+#[derive(Debug, Copy, Clone, PartialEq, Eq, Serialize, Deserialize)]
 pub(crate) enum ActionMode {
     /// Initial state, looking for `tool_call_id` or `tool_name`
     NotStarted,
@@ -58,12 +70,14 @@ pub(crate) enum ActionMode {
 ///
 /// This structure holds all the state needed to incrementally parse
 /// tool calls from streaming JSON.
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
 pub(crate) struct FilterAction {
     /// Current parsing mode in the action state machine
     pub mode: ActionMode,
     /// Index of the current tool call being parsed
     pub cur_tool_call_index: usize,
+    /// Name of the current tool call
+    pub cur_tool_name: String,
     /// Whether to trim leading whitespace from next output
     pub trim_left: bool,
     /// Name of the parameter currently being parsed
@@ -72,6 +86,17 @@ pub(crate) struct FilterAction {
     pub cur_param_state: ParamState,
     /// Buffer for accumulating parameter value content
     pub param_value_buffer: String,
+    /// State for extracting search queries from a search tool's parameters
+    pub query_scan: SearchQueryScan,
+}
+
+/// State for extracting the strings of a search tool's `queries` array as they stream.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub(crate) struct SearchQueryScan {
+    /// Whether the scan is inside a query string
+    pub in_string: bool,
+    /// The escape sequence read so far, empty outside of one
+    pub escape: String,
 }
 
 impl FilterAction {
@@ -79,17 +104,19 @@ impl FilterAction {
         Self {
             mode: ActionMode::NotStarted,
             cur_tool_call_index: 0,
+            cur_tool_name: String::new(),
             trim_left: false,
             cur_param_name: String::new(),
             cur_param_state: ParamState::Beginning,
             param_value_buffer: String::new(),
+            query_scan: SearchQueryScan::default(),
         }
     }
 }
 
 impl FilterImpl {
     pub(crate) fn parse_actions(&mut self, s: &str) -> (Vec<FilterOutput>, usize) {
-        if s.is_empty() || s.ends_with('\\') {
+        if s.is_empty() || ends_with_unfinished_escape(s) {
             return (Vec::new(), 0);
         }
 
@@ -112,6 +139,8 @@ impl FilterImpl {
     fn handle_before_tool(&mut self, s: &str, check_call_id: bool) -> (Vec<FilterOutput>, usize) {
         let (regex, mode) = if check_call_id {
             (&*TOOL_CALL_ID_REGEX, ActionMode::ToolCallID)
+        } else if self.llama_tool_calls {
+            (&*LLAMA_TOOL_NAME_REGEX, ActionMode::ToolName)
         } else {
             (&*TOOL_NAME_REGEX, ActionMode::ToolName)
         };
@@ -146,6 +175,7 @@ impl FilterImpl {
     fn handle_in_tool_name(&mut self, s: &str) -> (Vec<FilterOutput>, usize) {
         if let Some(idx) = find_non_escaped_char(s, '"') {
             let out = self.send_tool_name_chunk(&s[..idx]);
+            self.action_metadata.cur_tool_name = s[..idx].to_string();
             self.action_metadata.mode = ActionMode::ToolNameEnd;
             let (o, r) = self.parse_actions(&s[(idx + 1)..]);
             let mut result = out;
@@ -194,7 +224,11 @@ impl FilterImpl {
             self.action_metadata.param_value_buffer.push_str(s);
             (out, s.len())
         } else {
-            let out = self.send_raw_param_chunk_without_indentation(&s[..idx]);
+            let mut out = self.send_raw_param_chunk_without_indentation(&s[..idx]);
+            if self.is_search_tool() {
+                self.action_metadata.param_value_buffer.push_str(&s[..idx]);
+                out.extend(self.send_search_queries_from_raw_params());
+            }
             self.action_metadata.param_value_buffer.clear();
             self.action_metadata.cur_tool_call_index += 1;
             self.action_metadata.mode = ActionMode::ToolEnd;
@@ -302,12 +336,12 @@ impl FilterImpl {
     }
 
     fn send_param_name_chunk(&mut self, s: &str) -> Vec<FilterOutput> {
+        self.action_metadata.cur_param_name = s.to_string();
+
         if s.is_empty() || !self.stream_tool_actions {
             return Vec::new();
         }
 
-        self.action_metadata.cur_param_name = s.to_string();
-
         vec![FilterOutput {
             tool_call_delta: Some(FilterToolCallDelta {
                 index: self.action_metadata.cur_tool_call_index,
@@ -344,11 +378,17 @@ impl FilterImpl {
             trimmed_str
         };
 
-        if trimmed_str.is_empty() || !self.stream_tool_actions {
+        if !self.stream_tool_actions {
+            return (Vec::new(), s.len());
+        }
+        if trimmed_str.is_empty() {
             return (Vec::new(), 0);
         }
 
         self.action_metadata.trim_left = false;
+        // The whitespace at the end is passed again with the next token: it is part of the
+        // value if a string continues after it
+        let consumed = s.trim_end().len();
 
         (
             vec![FilterOutput {
@@ -362,11 +402,114 @@ impl FilterImpl {
                 }),
                 ..Default::default()
             }],
-            s.len(),
+            consumed,
         )
     }
 }
 
+impl FilterImpl {
+    /// Whether the current tool call is a search tool whose queries are emitted as
+    /// search query deltas.
+    fn is_search_tool(&self) -> bool {
+        self.search_tool_queries
+            && SEARCH_TOOL_NAMES.contains(&self.action_metadata.cur_tool_name.as_str())
+    }
+
+    /// Whether the parameter value being parsed is the queries of a search tool.
+    pub(crate) fn is_search_queries_param(&self) -> bool {
+        self.is_search_tool() && self.action_metadata.cur_param_name == SEARCH_QUERIES_PARAM
+    }
+
+    /// Emits the text of the query strings in `s`, a chunk of the `queries` array of a
+    /// search tool, as search query deltas. Each string is a new search query.
+    pub(crate) fn send_search_query_chunks(&mut self, s: &str) -> Vec<FilterOutput> {
+        let mut out = Vec::new();
+        let mut text = String::new();
+
+        for c in s.chars() {
+            let scan = &mut self.action_metadata.query_scan;
+            if !scan.in_string {
+                if c == '"' {
+                    scan.in_string = true;
+                    self.next_search_query();
+                }
+                continue;
+            }
+            if !scan.escape.is_empty() || c == '\\' {
+                scan.escape.push(c);
+                if let Ok(unescaped) =
+                    serde_json::from_str::<String>(&format!("\"{}\"", scan.escape))
+                {
+                    text.push_str(&unescaped);
+                    scan.escape.clear();
+                } else if scan.escape.len() >= MAX_ESCAPE_LEN {
+                    text.push(char::REPLACEMENT_CHARACTER);
+                    scan.escape.clear();
+                }
+                continue;
+            }
+            if c == '"' {
+                scan.in_string = false;
+                out.extend(self.send_search_query_text(std::mem::take(&mut text)));
+            } else {
+                text.push(c);
+            }
+        }
+
+        out.extend(self.send_search_query_text(text));
+        out
+    }
+
+    /// Emits the queries of a search tool once its raw parameters, held in the parameter
+    /// value buffer, are complete.
+    fn send_search_queries_from_raw_params(&mut self) -> Vec<FilterOutput> {
+        let Ok(params) =
+            serde_json::from_str::<serde_json::Value>(&self.action_metadata.param_value_buffer)
+        else {
+            return Vec::new();
+        };
+        let Some(queries) = params.get(SEARCH_QUERIES_PARAM).and_then(|q| q.as_array()) else {
+            return Vec::new();
+        };
+
+        let mut out = Vec::new();
+        for query in queries.iter().filter_map(|q| q.as_str()) {
+            self.next_search_query();
+            out.extend(self.send_search_query_text(query.to_string()));
+        }
+        out
+    }
+
+    /// Moves to the next search query index if the current one has been sent.
+    fn next_search_query(&mut self) {
+        if self.sent_curr_index {
+            self.curr_search_query_idx += 1;
+            self.sent_curr_index = false;
+        }
+    }
+
+    fn send_search_query_text(&mut self, text: String) -> Vec<FilterOutput> {
+        if text.is_empty() {
+            return Vec::new();
+        }
+
+        self.sent_curr_index = true;
+        vec![FilterOutput {
+            search_query: Some(FilterSearchQueryDelta {
+                index: self.curr_search_query_idx,
+                text,
+            }),
+            ..Default::default()
+        }]
+    }
+}
+
+/// Whether `s` ends with a backslash starting an escape, rather than with an escaped
+/// backslash: the character it escapes is in the next token.
+fn ends_with_unfinished_escape(s: &str) -> bool {
+    s.bytes().rev().take_while(|&b| b == b'\\').count() % 2 == 1
+}
+
 fn find_non_escaped_char(s: &str, ch: char) -> Option<usize> {
     let bytes = s.as_bytes();
     for i in 0..bytes.len() {
@@ -389,17 +532,55 @@ fn find_non_escaped_char(s: &str, ch: char) -> Option<usize> {
 #[cfg(test)]
 mod tests {
     use super::*;
-    use crate::parsing::filter::FilterImpl;
+    use crate::parsing::filter::{Filter, FilterImpl};
+    use crate::parsing::options::FilterOptions;
+    use crate::parsing::types::TokenIDsWithLogProb;
 
     fn starting_metadata() -> FilterAction {
         FilterAction {
             mode: ActionMode::NotStarted,
             cur_tool_call_index: 0,
+            cur_tool_name: String::new(),
             trim_left: false,
             cur_param_name: String::new(),
             cur_param_state: ParamState::Beginning,
             param_value_buffer: String::new(),
+            query_scan: SearchQueryScan::default(),
+        }
+    }
+
+    #[test]
+    fn test_parse_actions_llama_sequential_tool_calls() {
+        let mut filter = FilterImpl::new();
+        filter.action_metadata = starting_metadata();
+        filter.stream_tool_actions = true;
+        filter.llama_tool_calls = true;
+
+        let completion = r#"{"name": "get_weather", "parameters": {"city": "Paris"}}; {"name": "get_time", "parameters": {"tz": "CET"}}"#;
+        let (out, _) = filter.parse_actions(completion);
+
+        let mut names = Vec::new();
+        let mut params = Vec::new();
+        for o in out {
+            let tc = o.tool_call_delta.unwrap();
+            if !tc.name.is_empty() {
+                names.push((tc.index, tc.name));
+            }
+            if !tc.raw_param_delta.is_empty() {
+                params.push((tc.index, tc.raw_param_delta));
+            }
         }
+        assert_eq!(
+            names,
+            vec![(0, "get_weather".to_string()), (1, "get_time".to_string())]
+        );
+        assert_eq!(
+            params,
+            vec![
+                (0, r#"{"city": "Paris"}"#.to_string()),
+                (1, r#"{"tz": "CET"}"#.to_string())
+            ]
+        );
     }
 
     #[test]
@@ -466,10 +647,12 @@ mod tests {
         filter.action_metadata = FilterAction {
             mode: ActionMode::ToolName,
             cur_tool_call_index: 0,
+            cur_tool_name: String::new(),
             trim_left: false,
             cur_param_name: String::new(),
             cur_param_state: ParamState::Beginning,
             param_value_buffer: String::new(),
+            query_scan: SearchQueryScan::default(),
         };
         filter.stream_tool_actions = true;
         filter.stream_processed_params = true;
@@ -529,10 +712,12 @@ mod tests {
         filter.action_metadata = FilterAction {
             mode: ActionMode::ParamName,
             cur_tool_call_index: 0,
+            cur_tool_name: String::new(),
             trim_left: false,
             cur_param_name: String::new(),
             cur_param_state: ParamState::Beginning,
             param_value_buffer: String::new(),
+            query_scan: SearchQueryScan::default(),
         };
         filter.stream_tool_actions = true;
         filter.stream_processed_params = true;
@@ -571,10 +756,12 @@ mod tests {
         filter.action_metadata = FilterAction {
             mode: ActionMode::ParamName,
             cur_tool_call_index: 0,
+            cur_tool_name: String::new(),
             trim_left: false,
             cur_param_name: String::new(),
             cur_param_state: ParamState::Beginning,
             param_value_buffer: String::new(),
+            query_scan: SearchQueryScan::default(),
         };
         filter.stream_tool_actions = true;
         filter.stream_processed_params = true;
@@ -607,6 +794,73 @@ mod tests {
         );
     }
 
+    fn param_values(chunks: &[&str]) -> Vec<(String, String)> {
+        let options = FilterOptions::new()
+            .cmd3()
+            .stream_tool_actions()
+            .stream_processed_params();
+        let mut filter = crate::parsing::new_filter(options);
+        let mut out = filter.write_decoded("<|START_ACTION|>", TokenIDsWithLogProb::new());
+        for chunk in chunks {
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        out.extend(filter.write_decoded("<|END_ACTION|>", TokenIDsWithLogProb::new()));
+        out.extend(filter.flush_partials());
+
+        let mut params: Vec<(String, String)> = Vec::new();
+        for p in out
+            .into_iter()
+            .filter_map(|o| o.tool_call_delta?.param_delta)
+        {
+            match params.last_mut() {
+                Some((name, value)) if *name == p.name => value.push_str(&p.value_delta),
+                _ => params.push((p.name, p.value_delta)),
+            }
+        }
+        params
+    }
+
+    #[test]
+    fn test_parse_actions_param_escapes() {
+        let params = |values: &[(&str, &str)]| {
+            values
+                .iter()
+                .map(|(n, v)| (n.to_string(), v.to_string()))
+                .collect::<Vec<_>>()
+        };
+        let prefix = r#"[{"tool_call_id": "0", "tool_name": "a", "parameters": "#;
+
+        // Names keep their escapes, and a basic value ends at the first comma
+        assert_eq!(
+            param_values(&[prefix, r#"{"p\"x": 1, "q": "é"}}]"#]),
+            params(&[(r#"p\"x"#, "1"), ("q", r#""é""#)])
+        );
+        assert_eq!(
+            param_values(&[prefix, r#"{"p": 1, "q\\": 2}}]"#]),
+            params(&[("p", "1"), (r#"q\\"#, "2")])
+        );
+
+        // An escaped backslash at the end of a token does not escape the next quote
+        assert_eq!(
+            param_values(&[prefix, r#"{"p": "\\"#, r#"", "q": 2}}]"#]),
+            params(&[("p", r#""\\""#), ("q", "2")])
+        );
+        assert_eq!(
+            param_values(&[prefix, r#"{"p": "x\"#, r#""y"}}]"#]),
+            params(&[("p", r#""x\"y""#)])
+        );
+
+        // Whitespace at the end of a token stays in the string
+        assert_eq!(
+            param_values(&[prefix, r#"{"p": "hello "#, r#"world" }}]"#]),
+            params(&[("p", r#""hello world""#)])
+        );
+        assert_eq!(
+            param_values(&[prefix, r#"{"p": ["x\"]", "#, r#""y"], "q": 2}}]"#]),
+            params(&[("p", r#"["x\"]", "y"]"#), ("q", "2")])
+        );
+    }
+
     #[test]
     fn test_parse_actions_whole_thing_one_tool_one_parameter() {
         let mut filter = FilterImpl::new();
@@ -715,4 +969,95 @@ mod tests {
             "{\n\"query\": \"query1\"\n}"
         );
     }
+
+    fn search_queries(options: FilterOptions, completion: &str) -> Vec<(usize, String)> {
+        let mut filter = crate::parsing::new_filter(options);
+        let mut out = Vec::new();
+        // Write a character at a time so queries and escapes are split across writes
+        for c in completion.chars() {
+            out.extend(filter.write_decoded(&c.to_string(), TokenIDsWithLogProb::new()));
+        }
+        out.extend(filter.flush_partials());
+
+        let mut queries: Vec<(usize, String)> = Vec::new();
+        for sq in out.into_iter().filter_map(|o| o.search_query) {
+            match queries.last_mut() {
+                Some((index, text)) if *index == sq.index => text.push_str(&sq.text),
+                _ => queries.push((sq.index, sq.text)),
+            }
+        }
+        queries
+    }
+
+    #[test]
+    fn test_tool_input_with_search_query() {
+        let completion = "Plan: I will search for both.\nAction: ```json\n[\n    {\n        \"tool_name\": \"search\",\n        \"parameters\": {\n            \"queries\": [\"weather in \\\"Paris\\\"\", \"caf\\u00e9s in Lyon\"]\n        }\n    },\n    {\n        \"tool_name\": \"calculator\",\n        \"parameters\": {\n            \"queries\": [\"1 + 1\"]\n        }\n    }\n]\n```";
+        let want = vec![
+            (0, "weather in \"Paris\"".to_string()),
+            (1, "cafés in Lyon".to_string()),
+        ];
+
+        let options = FilterOptions::new()
+            .handle_multi_hop()
+            .handle_search_query()
+            .stream_tool_actions();
+        assert_eq!(
+            search_queries(options.clone().stream_processed_params(), completion),
+            want
+        );
+        assert_eq!(search_queries(options, completion), want);
+
+        // Queries of the search block come first
+        let completion = format!("Search: news|||sports\n{completion}");
+        let options = FilterOptions::new()
+            .handle_multi_hop()
+            .handle_search_query()
+            .stream_processed_params();
+        assert_eq!(
+            search_queries(options, &completion),
+            vec![
+                (0, "news".to_string()),
+                (1, "sports".to_string()),
+                (2, "weather in \"Paris\"".to_string()),
+                (3, "cafés in Lyon".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_search_query_quoting() {
+        let completion = "Search: \"a|||b\" c\\|||d\ne\\\\|||f \"x\ny\"\ng\\";
+        let options = FilterOptions::new().handle_search_query();
+        assert_eq!(
+            search_queries(options.clone(), completion),
+            vec![
+                (0, "\"a|||b\" c|||d".to_string()),
+                (1, "e\\".to_string()),
+                (2, "f \"x\ny\"".to_string()),
+                (3, "g\\".to_string()),
+            ]
+        );
+
+        // A backslash before another character is kept
+        assert_eq!(
+            search_queries(options.clone(), "Search: C:\\temp"),
+            vec![(0, "C:\\temp".to_string())]
+        );
+
+        let legacy = search_queries(options.legacy_search_query_splitting(), completion);
+        assert_eq!(
+            legacy.iter().map(|(_, q)| q.as_str()).collect::<Vec<_>>(),
+            vec!["\"a", "b\" c\\", "d", "e\\\\", "f \"x", "y\"", "g\\"]
+        );
+    }
+
+    #[test]
+    fn test_tool_input_search_query_needs_search_handling() {
+        let completion = "Action: ```json\n[{\"tool_name\": \"search\", \"parameters\": {\"queries\": [\"a\"]}}]\n```";
+        let options = FilterOptions::new()
+            .handle_multi_hop()
+            .stream_tool_actions()
+            .stream_processed_params();
+        assert!(search_queries(options, completion).is_empty());
+    }
 }
@@ -7,8 +7,10 @@
 
 use crate::parsing::filter::{FilterImpl, find_partial};
 use crate::parsing::types::{
-    FilterCitation, FilterMode, FilterOutput, Source, TokenIDsWithLogProb,
+    CitationIndexUnit, CitationSourceFormat, FilterCitation, FilterMode, FilterOutput, Source,
+    TokenIDsWithLogProb,
 };
+use unicode_segmentation::UnicodeSegmentation;
 
 // Citation marker constants
 const START_FIRST_CIT: &str = "<co: ";
@@ -46,10 +48,35 @@ impl FilterImpl {
         }
 
         let send = String::from_utf8_lossy(bstr);
-        let (send, rem_right) = self.trim_space(&send);
-        let remove = bstr.len() - send.len() - rem_right;
-
+        let (raw, rem_right) = self.trim_space(&send);
+        let remove = bstr.len() - raw.len() - rem_right;
+
+        // Citation indices count the normalized text, the part held back for a partial
+        // citation is mapped back to the raw text it came from
+        let normalization = self.unicode_normalization;
+        let send = normalization.apply(&raw);
+        let text_start = self.cur_text_index;
         let (mut res_out, remove_cit) = self.parse_citations(&send, mode);
+        let remove_cit = normalization.raw_len(&raw, &send, remove_cit);
+        if self.sentence_citations {
+            let (text, cits) = res_out
+                .as_mut()
+                .map(|o| (o.text.clone(), std::mem::take(&mut o.citations)))
+                .unwrap_or_default();
+            let ready = self.align_sentence_citations(&text, text_start, cits, mode);
+            if !ready.is_empty() {
+                res_out.get_or_insert_default().citations = ready;
+            }
+        } else if self.merge_citations {
+            let cits = res_out
+                .as_mut()
+                .map(|o| std::mem::take(&mut o.citations))
+                .unwrap_or_default();
+            let ready = self.merge_streamed_citations(cits, mode);
+            if !ready.is_empty() {
+                res_out.get_or_insert_default().citations = ready;
+            }
+        }
 
         if res_out.is_none()
             || (res_out.as_ref().unwrap().text.is_empty()
@@ -59,7 +86,7 @@ impl FilterImpl {
                 return (Vec::new(), remove + remove_cit);
             }
             res_out = Some(FilterOutput {
-                text: send.clone(),
+                text: send.to_string(),
                 ..Default::default()
             });
         }
@@ -67,6 +94,9 @@ impl FilterImpl {
         let mut res_out = res_out.unwrap();
         res_out.is_post_answer = self.stream_non_grounded_answer && mode != FilterMode::ToolReason;
         res_out.is_reasoning = mode == FilterMode::ToolReason;
+        if res_out.is_reasoning {
+            res_out.plan_index = self.plan_index();
+        }
 
         // TODO revisit how to handle empty citations https://linear.app/cohereai/issue/PTS-8688/melody-align-log-probs-behavior
         if let Some(probs) = token_log_probs {
@@ -81,6 +111,173 @@ impl FilterImpl {
         (out, remove + remove_cit)
     }
 
+    /// Merges completed citations into the pending citation when citation merging is
+    /// enabled, and returns the citations that are ready to be emitted.
+    ///
+    /// The last completed citation is held back until text is emitted past its end or
+    /// the mode changes, so that an adjacent citation with the same sources arriving in
+    /// a later chunk can still be merged into it.
+    fn merge_streamed_citations(
+        &mut self,
+        citations: Vec<FilterCitation>,
+        mode: FilterMode,
+    ) -> Vec<FilterCitation> {
+        let mut ready = Vec::new();
+        let unit = self.citation_index_unit;
+        for cit in merge_adjacent_citations(citations, unit) {
+            if let Some(pending) = self.pending_citation.as_mut()
+                && try_merge_citation(pending, &cit, unit)
+            {
+                continue;
+            }
+            ready.extend(self.pending_citation.replace(cit));
+        }
+
+        if let Some(pending) = &self.pending_citation
+            && (self.cur_text_index != pending.end_index
+                || pending.is_thinking != (mode == FilterMode::ToolReason))
+        {
+            ready.extend(self.pending_citation.take());
+        }
+
+        ready.retain(|c| self.stream_tool_actions || !c.is_thinking);
+        ready
+    }
+
+    /// Aligns the citations of `text`, the text emitted from the index `text_start`, to
+    /// the sentences containing them, and returns the citations whose sentences have
+    /// ended.
+    fn align_sentence_citations(
+        &mut self,
+        text: &str,
+        text_start: usize,
+        citations: Vec<FilterCitation>,
+        mode: FilterMode,
+    ) -> Vec<FilterCitation> {
+        let is_thinking = mode == FilterMode::ToolReason;
+        let mut ready = Vec::new();
+
+        // The sentences of an answer end with it
+        if self
+            .sentence_held_citations
+            .first()
+            .is_some_and(|c| c.is_thinking != is_thinking)
+        {
+            ready = self.release_sentence_citations(true);
+        }
+
+        if self.sentence_text.is_empty() {
+            self.sentence_start_index = text_start;
+        }
+        self.sentence_text.push_str(text);
+        self.sentence_held_citations.extend(
+            citations
+                .into_iter()
+                .filter(|c| c.start_index < c.end_index),
+        );
+        ready.extend(self.release_sentence_citations(false));
+
+        ready.retain(|c| self.stream_tool_actions || !c.is_thinking);
+        ready
+    }
+
+    /// Returns the held citations expanded to their sentences, merging the citations of
+    /// the same sentences, for the sentences that have ended. The last sentence of the
+    /// text may continue in the next text unless `all` is set.
+    fn release_sentence_citations(&mut self, all: bool) -> Vec<FilterCitation> {
+        let unit = self.citation_index_unit;
+
+        // The start byte and index of every sentence, then those of the end of the text
+        let mut bounds = Vec::new();
+        let mut index = self.sentence_start_index;
+        for (byte, sentence) in self.sentence_text.split_sentence_bound_indices() {
+            bounds.push((byte, index));
+            index += str_index_len(sentence, unit);
+        }
+        bounds.push((self.sentence_text.len(), index));
+        let sentences = bounds.len() - 1;
+        if sentences == 0 {
+            return if all {
+                std::mem::take(&mut self.sentence_held_citations)
+            } else {
+                Vec::new()
+            };
+        }
+        let ended = if all { sentences } else { sentences - 1 };
+        let sentence_of = |index: usize| {
+            bounds[1..]
+                .partition_point(|&(_, end)| end <= index)
+                .min(sentences - 1)
+        };
+
+        // Citations spanning a common sentence form a group, cited by one citation
+        let mut held = std::mem::take(&mut self.sentence_held_citations);
+        held.sort_by_key(|c| c.start_index);
+        let mut groups: Vec<(usize, usize, Vec<FilterCitation>)> = Vec::new();
+        for cit in held {
+            let (first, last) = (sentence_of(cit.start_index), sentence_of(cit.end_index - 1));
+            match groups.last_mut() {
+                Some(group) if first <= group.1 => {
+                    group.1 = group.1.max(last);
+                    group.2.push(cit);
+                }
+                _ => groups.push((first, last, vec![cit])),
+            }
+        }
+
+        let mut ready = Vec::new();
+        let mut keep_from = ended;
+        for (first, last, cits) in groups {
+            if last >= ended {
+                keep_from = keep_from.min(first);
+                self.sentence_held_citations.extend(cits);
+                continue;
+            }
+            let (start_byte, start_index) = bounds[first];
+            let text = &self.sentence_text[start_byte..bounds[last + 1].0];
+            let trimmed = text.trim_start();
+            let start_index =
+                start_index + str_index_len(&text[..text.len() - trimmed.len()], unit);
+            let text = trimmed.trim_end();
+            if text.is_empty() {
+                continue;
+            }
+            ready.push(FilterCitation {
+                start_index,
+                end_index: start_index + str_index_len(text, unit),
+                text: text.to_string(),
+                sources: merge_sources(&cits),
+                is_thinking: cits[0].is_thinking,
+            });
+        }
+
+        let (keep_byte, keep_index) = bounds[keep_from];
+        self.sentence_text.drain(..keep_byte);
+        self.sentence_start_index = keep_index;
+        ready
+    }
+
+    /// Emits the citations held back for merging or for the end of their sentences, if
+    /// any. They are attached to the last output, or to a new output if there are none.
+    pub(crate) fn release_pending_citation(&mut self, out: &mut Vec<FilterOutput>) {
+        let mut cits = self.release_sentence_citations(true);
+        cits.extend(self.pending_citation.take());
+        cits.retain(|c| self.stream_tool_actions || !c.is_thinking);
+        let Some(is_thinking) = cits.first().map(|c| c.is_thinking) else {
+            return;
+        };
+        if let Some(last) = out.last_mut() {
+            last.citations.extend(cits);
+        } else {
+            out.push(FilterOutput {
+                is_reasoning: is_thinking,
+                plan_index: if is_thinking { self.plan_index() } else { 0 },
+                citations: cits,
+                ..Default::default()
+            });
+        }
+    }
+
     pub(crate) fn parse_citations(
         &mut self,
         s: &str,
@@ -92,13 +289,17 @@ impl FilterImpl {
             START_FIRST_CIT
         };
 
-        let (start_first_id, end_first_id, _) =
-            Self::find_an_element(s, start_first_citation_str, END_OF_CIT, self.cmd3_citations);
+        let (start_first_id, end_first_id, _) = Self::find_an_element(
+            s,
+            start_first_citation_str,
+            END_OF_CIT,
+            self.cmd3_citations,
+            self.citation_source_format,
+        );
 
         // No citation was found so send the plain text and remove from buffer
         if start_first_id == usize::MAX {
-            self.cur_text_index += s.chars().count();
-            self.cur_text_byte_index += s.len();
+            self.advance_text_index(s);
             return (
                 Some(FilterOutput {
                     text: s.to_string(),
@@ -114,8 +315,13 @@ impl FilterImpl {
         }
 
         // Then try to find the 'last' citation element.
-        let (start_last_id, end_last_id, docs_last) =
-            Self::find_an_element(s, START_LAST_CIT, END_OF_CIT, self.cmd3_citations);
+        let (start_last_id, end_last_id, docs_last) = Self::find_an_element(
+            s,
+            START_LAST_CIT,
+            END_OF_CIT,
+            self.cmd3_citations,
+            self.citation_source_format,
+        );
 
         // Only partial citation found so we need to wait for the complete citation.
         if start_last_id == usize::MAX || end_last_id == usize::MAX {
@@ -147,12 +353,12 @@ impl FilterImpl {
         }
 
         // We have found a whole citation, now find the indexes for the citation
-        let start_index = self.cur_text_index + s[0..start_first_id].chars().count();
+        let start_index = self.cur_text_index + self.text_index_len(&s[0..start_first_id]);
         let end_of_cit = end_last_id + 1;
         let cit_txt = &s[end_first_id + 1..start_last_id];
         let mut text = format!("{}{}", &s[..start_first_id], cit_txt);
-        self.cur_text_index += text.chars().count();
-        self.cur_text_byte_index += text.len();
+        self.advance_text_index(&text);
+        let end_index = self.cur_text_index;
 
         if let Some(start_idx) = self.cur_citation_byte_index {
             if start_idx < start_last_id {
@@ -165,7 +371,7 @@ impl FilterImpl {
 
         let mut cits = vec![FilterCitation {
             start_index,
-            end_index: start_index + cit_txt.chars().count(),
+            end_index,
             text: cit_txt.to_string(),
             sources: docs_last,
             is_thinking: mode == FilterMode::ToolReason,
@@ -196,8 +402,7 @@ impl FilterImpl {
         s: &str,
     ) -> (String, usize) {
         let text_before_citation = &s[..start_first_id];
-        self.cur_text_index += text_before_citation.chars().count();
-        self.cur_text_byte_index += text_before_citation.len();
+        self.advance_text_index(text_before_citation);
 
         let start_idx = if let Some(start_idx) = self.cur_citation_byte_index {
             // If we've already processed all of this string, return early
@@ -245,17 +450,43 @@ impl FilterImpl {
             s
         };
 
-        self.cur_text_index += txt.chars().count();
-        self.cur_text_byte_index += txt.len();
+        self.advance_text_index(txt);
 
         (txt.to_string(), txt.len())
     }
 
+    /// Returns the length of `s`, the text that follows the text counted so far, in the
+    /// configured citation index unit.
+    fn text_index_len(&self, s: &str) -> usize {
+        if self.citation_index_unit == CitationIndexUnit::Graphemes {
+            // a grapheme cluster can continue in the next chunk, e.g. an emoji ZWJ
+            // sequence, so count from the start of the last cluster
+            let joined = format!("{}{s}", self.last_grapheme);
+            return joined.graphemes(true).count() - usize::from(!self.last_grapheme.is_empty());
+        }
+        str_index_len(s, self.citation_index_unit)
+    }
+
+    /// Advances the text indices past `s`.
+    pub(crate) fn advance_text_index(&mut self, s: &str) {
+        self.cur_text_index += self.text_index_len(s);
+        self.cur_text_byte_index += s.len();
+        if self.citation_index_unit == CitationIndexUnit::Graphemes && !s.is_empty() {
+            let joined = format!("{}{s}", self.last_grapheme);
+            self.last_grapheme = joined
+                .graphemes(true)
+                .next_back()
+                .unwrap_or_default()
+                .to_string();
+        }
+    }
+
     fn find_an_element(
         s: &str,
         start: &str,
         end: &str,
         cmd3_citations: bool,
+        source_format: CitationSourceFormat,
     ) -> (usize, usize, Vec<Source>) {
         let (start_id, start_found) = find_partial(s, [start.to_string()].iter());
 
@@ -274,7 +505,7 @@ impl FilterImpl {
         let substring = &s[start_id + start.len()..start_id + 1 + end_id];
 
         let doc_indices = if cmd3_citations {
-            Self::convert_string_to_doc_indices(substring)
+            Self::convert_string_to_doc_indices(substring, source_format)
         } else {
             let int_indices = convert_string_to_int_list(substring);
             if int_indices.is_empty() {
@@ -283,6 +514,7 @@ impl FilterImpl {
                 vec![Source {
                     tool_call_index: 0,
                     tool_result_indices: int_indices,
+                    source_name: None,
                 }]
             }
         };
@@ -290,7 +522,7 @@ impl FilterImpl {
         (start_id, start_id + 1 + end_id, doc_indices)
     }
 
-    fn convert_string_to_doc_indices(s: &str) -> Vec<Source> {
+    fn convert_string_to_doc_indices(s: &str, source_format: CitationSourceFormat) -> Vec<Source> {
         let string_splits: Vec<&str> = s.trim().split(']').collect();
         let mut doc_indices = Vec::new();
 
@@ -304,12 +536,24 @@ impl FilterImpl {
                 continue;
             }
 
-            let tool_idx_str = cit_splits[0];
+            let tool_idx_str = cit_splits[0].trim();
             let result_indices_str = cit_splits[1];
 
-            let Ok(tool_index) = tool_idx_str.trim().parse::<usize>() else {
-                log::warn!("Invalid citation tool index");
-                continue;
+            // Numeric keys are tool call indices in both formats, the model may still
+            // cite a source by index when asked for names
+            let (tool_index, source_name) = match tool_idx_str.parse::<usize>() {
+                Ok(tool_index) => (tool_index, None),
+                Err(_) if source_format == CitationSourceFormat::ToolIndex => {
+                    log::warn!("Invalid citation tool index");
+                    continue;
+                }
+                Err(_) => {
+                    if !is_tool_name(tool_idx_str) {
+                        log::warn!("Invalid citation tool name");
+                        continue;
+                    }
+                    (0, Some(tool_idx_str.to_string()))
+                }
             };
 
             let mut result_indices = Vec::new();
@@ -330,6 +574,7 @@ impl FilterImpl {
             doc_indices.push(Source {
                 tool_call_index: tool_index,
                 tool_result_indices: result_indices,
+                source_name,
             });
         }
 
@@ -337,6 +582,114 @@ impl FilterImpl {
     }
 }
 
+/// Coalesces adjacent or overlapping citations that share the same sources and
+/// drops zero-length citations. Citations are expected in stream order, with indices
+/// in `unit`.
+pub(crate) fn merge_adjacent_citations(
+    citations: Vec<FilterCitation>,
+    unit: CitationIndexUnit,
+) -> Vec<FilterCitation> {
+    let mut merged: Vec<FilterCitation> = Vec::with_capacity(citations.len());
+
+    for cit in citations {
+        if cit.start_index >= cit.end_index || cit.text.is_empty() {
+            continue;
+        }
+        if let Some(last) = merged.last_mut()
+            && try_merge_citation(last, &cit, unit)
+        {
+            continue;
+        }
+        merged.push(cit);
+    }
+
+    merged
+}
+
+/// Extends `last` with `cit` if they share the same sources and `cit` starts within
+/// or directly after `last`. Returns whether the citations were merged.
+fn try_merge_citation(
+    last: &mut FilterCitation,
+    cit: &FilterCitation,
+    unit: CitationIndexUnit,
+) -> bool {
+    if last.sources != cit.sources
+        || last.is_thinking != cit.is_thinking
+        || cit.start_index < last.start_index
+        || cit.start_index > last.end_index
+    {
+        return false;
+    }
+
+    if cit.end_index > last.end_index {
+        // Only append the part of the text not already covered
+        let overlap = last.end_index - cit.start_index;
+        last.text
+            .push_str(skip_index_units(&cit.text, overlap, unit));
+        last.end_index = cit.end_index;
+    }
+    true
+}
+
+/// Returns the sources of the citations, with the results of the same source merged.
+fn merge_sources(citations: &[FilterCitation]) -> Vec<Source> {
+    let mut sources: Vec<Source> = Vec::new();
+    for source in citations.iter().flat_map(|c| &c.sources) {
+        let same = sources.iter_mut().find(|s| {
+            s.tool_call_index == source.tool_call_index && s.source_name == source.source_name
+        });
+        let Some(same) = same else {
+            sources.push(source.clone());
+            continue;
+        };
+        for idx in &source.tool_result_indices {
+            if !same.tool_result_indices.contains(idx) {
+                same.tool_result_indices.push(*idx);
+            }
+        }
+    }
+    sources
+}
+
+/// Returns the length of `s` in citation index units.
+pub(crate) fn str_index_len(s: &str, unit: CitationIndexUnit) -> usize {
+    match unit {
+        CitationIndexUnit::Runes => s.chars().count(),
+        CitationIndexUnit::Graphemes => s.graphemes(true).count(),
+        CitationIndexUnit::Utf16 => s.encode_utf16().count(),
+        CitationIndexUnit::Bytes => s.len(),
+    }
+}
+
+/// Returns `s` without its first `n` citation index units.
+fn skip_index_units(s: &str, n: usize, unit: CitationIndexUnit) -> &str {
+    let start = match unit {
+        CitationIndexUnit::Runes => s.char_indices().nth(n).map_or(s.len(), |(i, _)| i),
+        CitationIndexUnit::Graphemes => s.grapheme_indices(true).nth(n).map_or(s.len(), |(i, _)| i),
+        CitationIndexUnit::Utf16 => {
+            let mut units = 0;
+            s.char_indices()
+                .find(|(_, c)| {
+                    let skipped = units >= n;
+                    units += c.len_utf16();
+                    skipped
+                })
+                .map_or(s.len(), |(i, _)| i)
+        }
+        CitationIndexUnit::Bytes => (n.min(s.len())..=s.len())
+            .find(|&i| s.is_char_boundary(i))
+            .unwrap_or(s.len()),
+    };
+    &s[start..]
+}
+
+/// Returns whether `s` is a tool name that can key citation sources, e.g. `web_search`.
+fn is_tool_name(s: &str) -> bool {
+    !s.is_empty()
+        && s.chars()
+            .all(|c| c.is_alphanumeric() || matches!(c, '_' | '-' | '.'))
+}
+
 fn convert_string_to_int_list(s: &str) -> Vec<usize> {
     let string_indexes: Vec<&str> = s.split(',').collect();
     let mut int_arr = Vec::new();
@@ -353,7 +706,7 @@ fn convert_string_to_int_list(s: &str) -> Vec<usize> {
 #[cfg(test)]
 mod tests {
     use super::*;
-    use crate::parsing::filter::FilterImpl;
+    use crate::parsing::filter::{Filter, FilterImpl};
 
     #[test]
     fn test_handle_citations_standard_case() {
@@ -557,11 +910,272 @@ mod tests {
         assert_eq!(remove, 53);
     }
 
+    #[test]
+    fn test_process_grounded_text_merges_adjacent_citations() {
+        let mut filter = FilterImpl::new();
+        filter.cmd3_citations = true;
+        filter.merge_citations = true;
+
+        let input = "foo <co>bar</co: 0:[1]><co>baz</co: 0:[1]>";
+        let (mut out, remove) =
+            filter.process_grounded_text(input.as_bytes(), false, FilterMode::GroundedAnswer, None);
+
+        // The merged citation is held back until it can no longer be extended
+        assert_eq!(out.len(), 1);
+        assert_eq!(out[0].text, "foo barbaz");
+        assert!(out[0].citations.is_empty());
+        assert_eq!(remove, input.len());
+
+        filter.release_pending_citation(&mut out);
+        assert_eq!(
+            out[0].citations,
+            vec![FilterCitation {
+                start_index: 4,
+                end_index: 10,
+                text: "barbaz".to_string(),
+                sources: vec![Source {
+                    tool_call_index: 0,
+                    tool_result_indices: vec![1],
+                    source_name: None,
+                }],
+                is_thinking: false,
+            }]
+        );
+    }
+
+    #[test]
+    fn test_merge_citations_across_chunks() {
+        let mut filter = crate::parsing::new_filter(
+            crate::parsing::FilterOptions::new()
+                .cmd3()
+                .with_citation_merging(),
+        );
+
+        let chunks = [
+            "<|START_RESPONSE|>",
+            "foo <co>",
+            "bar",
+            "</co: 0:[1]>",
+            "<co>",
+            "baz",
+            "</co: 0:[1]>",
+            " <co>qux</co: 0:[1]>",
+            " end",
+        ];
+        let mut out = Vec::new();
+        for chunk in chunks {
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        out.extend(filter.flush_partials());
+
+        let text: String = out.iter().map(|o| o.text.as_str()).collect();
+        let cits: Vec<(usize, usize, String)> = out
+            .iter()
+            .flat_map(|o| o.citations.iter())
+            .map(|c| (c.start_index, c.end_index, c.text.clone()))
+            .collect();
+        assert_eq!(text, "foo barbaz qux end");
+        assert_eq!(
+            cits,
+            vec![(4, 10, "barbaz".to_string()), (11, 14, "qux".to_string())]
+        );
+    }
+
+    #[test]
+    fn test_sentence_citations() {
+        let mut filter = crate::parsing::new_filter(
+            crate::parsing::FilterOptions::new()
+                .cmd3()
+                .with_sentence_citations(),
+        );
+
+        let chunks = [
+            "<|START_RESPONSE|>",
+            "The <co>sky</co: 0:[1]> is ",
+            "<co>blue</co: 0:[2],1:[0]>",
+            ". Grass",
+            " is green? ",
+            "They grow 2.5 m <co>tall",
+            "</co: 0:[1]> here. Ok",
+        ];
+        let mut out = Vec::new();
+        let mut emitted_at = Vec::new();
+        for (i, chunk) in chunks.iter().enumerate() {
+            let o = filter.write_decoded(chunk, TokenIDsWithLogProb::new());
+            emitted_at.extend(o.iter().flat_map(|o| o.citations.iter()).map(|_| i));
+            out.extend(o);
+        }
+        out.extend(filter.flush_partials());
+
+        let text: String = out.iter().map(|o| o.text.as_str()).collect();
+        let cits: Vec<(usize, usize, String, Vec<Source>)> = out
+            .iter()
+            .flat_map(|o| o.citations.iter())
+            .map(|c| {
+                (
+                    c.start_index,
+                    c.end_index,
+                    c.text.clone(),
+                    c.sources.clone(),
+                )
+            })
+            .collect();
+        let source = |tool_call_index, tool_result_indices| Source {
+            tool_call_index,
+            tool_result_indices,
+            source_name: None,
+        };
+        assert_eq!(
+            text,
+            "The sky is blue. Grass is green? They grow 2.5 m tall here. Ok"
+        );
+        assert_eq!(
+            cits,
+            vec![
+                (
+                    0,
+                    16,
+                    "The sky is blue.".to_string(),
+                    vec![source(0, vec![1, 2]), source(1, vec![0])]
+                ),
+                (
+                    33,
+                    59,
+                    "They grow 2.5 m tall here.".to_string(),
+                    vec![source(0, vec![1])]
+                ),
+            ]
+        );
+        // A citation is emitted once the next sentence starts
+        assert_eq!(emitted_at, vec![3, 6]);
+    }
+
+    #[test]
+    fn test_citation_index_units() {
+        let cases = [
+            (CitationIndexUnit::Runes, (7, 11)),
+            (CitationIndexUnit::Graphemes, (5, 8)),
+            (CitationIndexUnit::Utf16, (9, 13)),
+            (CitationIndexUnit::Bytes, (15, 21)),
+        ];
+        for (unit, want) in cases {
+            let mut filter = crate::parsing::new_filter(
+                crate::parsing::FilterOptions::new()
+                    .cmd3()
+                    .with_citation_index_unit(unit),
+            );
+
+            // the ZWJ sequence is split across chunks and the citation has a combining accent
+            let chunks = [
+                "<|START_RESPONSE|>",
+                "hi \u{1F468}\u{200D}",
+                "\u{1F469} <co>",
+                "e\u{301}t\u{E9}",
+                "</co: 0:[1]>",
+            ];
+            let mut out = Vec::new();
+            for chunk in chunks {
+                out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+            }
+            out.extend(filter.flush_partials());
+
+            let cits: Vec<(usize, usize)> = out
+                .iter()
+                .flat_map(|o| o.citations.iter())
+                .map(|c| (c.start_index, c.end_index))
+                .collect();
+            assert_eq!(cits, vec![want], "unit {unit:?}");
+        }
+    }
+
+    #[test]
+    fn test_process_grounded_text_without_merging() {
+        let mut filter = FilterImpl::new();
+        filter.cmd3_citations = true;
+
+        let input = "foo <co>bar</co: 0:[1]><co>baz</co: 0:[1]>";
+        let (out, _) =
+            filter.process_grounded_text(input.as_bytes(), false, FilterMode::GroundedAnswer, None);
+
+        assert_eq!(out.len(), 1);
+        assert_eq!(out[0].citations.len(), 2);
+        assert!(filter.pending_citation.is_none());
+    }
+
+    #[test]
+    fn test_merge_adjacent_citations() {
+        let cit = |start: usize, end: usize, text: &str, doc: usize| FilterCitation {
+            start_index: start,
+            end_index: end,
+            text: text.to_string(),
+            sources: vec![Source {
+                tool_call_index: 0,
+                tool_result_indices: vec![doc],
+                source_name: None,
+            }],
+            is_thinking: false,
+        };
+
+        // Adjacent, same sources
+        assert_eq!(
+            merge_adjacent_citations(
+                vec![cit(0, 3, "bar", 1), cit(3, 6, "baz", 1)],
+                CitationIndexUnit::Runes
+            ),
+            vec![cit(0, 6, "barbaz", 1)]
+        );
+        // Overlapping, same sources
+        assert_eq!(
+            merge_adjacent_citations(
+                vec![cit(0, 4, "barb", 1), cit(3, 6, "baz", 1)],
+                CitationIndexUnit::Runes
+            ),
+            vec![cit(0, 6, "barbaz", 1)]
+        );
+        // Contained, same sources
+        assert_eq!(
+            merge_adjacent_citations(
+                vec![cit(0, 6, "barbaz", 1), cit(3, 6, "baz", 1)],
+                CitationIndexUnit::Runes
+            ),
+            vec![cit(0, 6, "barbaz", 1)]
+        );
+        // Adjacent, different sources
+        assert_eq!(
+            merge_adjacent_citations(
+                vec![cit(0, 3, "bar", 1), cit(3, 6, "baz", 2)],
+                CitationIndexUnit::Runes
+            ),
+            vec![cit(0, 3, "bar", 1), cit(3, 6, "baz", 2)]
+        );
+        // Not adjacent
+        assert_eq!(
+            merge_adjacent_citations(
+                vec![cit(0, 3, "bar", 1), cit(4, 7, "baz", 1)],
+                CitationIndexUnit::Runes
+            ),
+            vec![cit(0, 3, "bar", 1), cit(4, 7, "baz", 1)]
+        );
+        // Zero-length spans are dropped
+        assert_eq!(
+            merge_adjacent_citations(
+                vec![cit(0, 0, "", 1), cit(0, 3, "bar", 1)],
+                CitationIndexUnit::Runes
+            ),
+            vec![cit(0, 3, "bar", 1)]
+        );
+    }
+
     #[test]
     fn test_find_an_element_standard_case() {
         let input = "hello <co: 2,1> foo </co: 2,1>";
-        let (start_index, end_index, docs) =
-            FilterImpl::find_an_element(input, "<co: ", ">", false);
+        let (start_index, end_index, docs) = FilterImpl::find_an_element(
+            input,
+            "<co: ",
+            ">",
+            false,
+            CitationSourceFormat::ToolIndex,
+        );
 
         assert_eq!(start_index, 6);
         assert_eq!(end_index, 14);
@@ -573,8 +1187,13 @@ mod tests {
     #[test]
     fn test_find_an_element_no_citation() {
         let input = "hello";
-        let (start_index, end_index, docs) =
-            FilterImpl::find_an_element(input, "<co: ", ">", false);
+        let (start_index, end_index, docs) = FilterImpl::find_an_element(
+            input,
+            "<co: ",
+            ">",
+            false,
+            CitationSourceFormat::ToolIndex,
+        );
 
         assert_eq!(start_index, usize::MAX);
         assert_eq!(end_index, usize::MAX);
@@ -584,8 +1203,13 @@ mod tests {
     #[test]
     fn test_find_an_element_cmd3_two_tools() {
         let input = "<co> hello </co: 0:[1,2],1:[0]>";
-        let (start_index, end_index, docs) =
-            FilterImpl::find_an_element(input, "</co: ", ">", true);
+        let (start_index, end_index, docs) = FilterImpl::find_an_element(
+            input,
+            "</co: ",
+            ">",
+            true,
+            CitationSourceFormat::ToolIndex,
+        );
 
         assert_eq!(start_index, 11);
         assert_eq!(end_index, 30);
@@ -596,6 +1220,55 @@ mod tests {
         assert_eq!(docs[1].tool_result_indices, vec![0]);
     }
 
+    #[test]
+    fn test_find_an_element_cmd3_tool_names() {
+        let input = "<co> hello </co: web_search:[2],calc-v2:[0],bad name:[1]>";
+        let (_, _, docs) =
+            FilterImpl::find_an_element(input, "</co: ", ">", true, CitationSourceFormat::ToolName);
+
+        assert_eq!(docs.len(), 2);
+        assert_eq!(docs[0].tool_call_index, 0);
+        assert_eq!(docs[0].source_name.as_deref(), Some("web_search"));
+        assert_eq!(docs[0].tool_result_indices, vec![2]);
+        assert_eq!(docs[1].source_name.as_deref(), Some("calc-v2"));
+        assert_eq!(docs[1].tool_result_indices, vec![0]);
+
+        // Tool names are not sources in the tool index format
+        let (_, _, docs) = FilterImpl::find_an_element(
+            input,
+            "</co: ",
+            ">",
+            true,
+            CitationSourceFormat::ToolIndex,
+        );
+        assert!(docs.is_empty());
+    }
+
+    #[test]
+    fn test_find_an_element_cmd3_mixed_source_keys() {
+        let input = "<co> hello </co: web_search:[2],1:[0,3]>";
+        let (_, _, docs) =
+            FilterImpl::find_an_element(input, "</co: ", ">", true, CitationSourceFormat::ToolName);
+
+        assert_eq!(docs.len(), 2);
+        assert_eq!(docs[0].source_name.as_deref(), Some("web_search"));
+        assert_eq!(docs[0].tool_result_indices, vec![2]);
+        assert_eq!(docs[1].tool_call_index, 1);
+        assert_eq!(docs[1].source_name, None);
+        assert_eq!(docs[1].tool_result_indices, vec![0, 3]);
+
+        let (_, _, docs) = FilterImpl::find_an_element(
+            input,
+            "</co: ",
+            ">",
+            true,
+            CitationSourceFormat::ToolIndex,
+        );
+        assert_eq!(docs.len(), 1);
+        assert_eq!(docs[0].tool_call_index, 1);
+        assert_eq!(docs[0].source_name, None);
+    }
+
     #[test]
     fn test_convert_string_to_int_list() {
         assert_eq!(convert_string_to_int_list("0"), vec![0]);
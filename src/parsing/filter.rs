@@ -4,11 +4,18 @@
 //! and extracts structured information.
 
 use crate::parsing::action_filter::FilterAction;
+use crate::parsing::matcher::SequenceMatcher;
 use crate::parsing::options::FilterOptions;
+use crate::parsing::resume::ResumeOverlap;
+use crate::parsing::state::FilterState;
 use crate::parsing::types::{
-    FilterMode, FilterOutput, FilterSearchQueryDelta, TokenIDsWithLogProb,
+    CitationIndexUnit, CitationSourceFormat, FilterCitation, FilterFinish, FilterMode,
+    FilterOutput, FilterSearchQueryDelta, FinishReason, StopContext, TokenIDsWithLogProb,
+    UnicodeNormalization,
 };
-use std::collections::HashMap;
+use serde::{Deserialize, Serialize};
+use std::borrow::Cow;
+use std::collections::{HashMap, HashSet, VecDeque};
 
 /// Core trait for streaming token parsers.
 ///
@@ -32,6 +39,13 @@ use std::collections::HashMap;
 /// // Flush any buffered content at the end
 /// let final_outputs = filter.flush_partials();
 /// ```
+///
+/// # Concurrency
+///
+/// A filter is a state machine over a single token stream. `FilterImpl` is `Send`, so
+/// it can move between threads, but its methods take `&mut self` and it must not be
+/// shared without a lock. Use `new_safe_filter` for a filter that serializes calls
+/// from several threads.
 pub trait Filter {
     /// Process a decoded token and return any completed outputs.
     ///
@@ -94,6 +108,10 @@ pub struct FilterImpl {
     // Mode and special token configuration
     pub(crate) default_mode: FilterMode,
     pub(crate) special_token_map: HashMap<String, FilterMode>,
+    // The special tokens compiled for matching, and without the next search query token
+    // for outside of search blocks when search_tool_queries is set
+    pub(crate) special_tokens: SequenceMatcher,
+    pub(crate) special_tokens_outside_search: SequenceMatcher,
     pub(crate) stream_non_grounded_answer: bool,
     pub(crate) stream_tool_actions: bool,
     pub(crate) stream_processed_params: bool,
@@ -105,27 +123,212 @@ pub struct FilterImpl {
     // Citation tracking
     pub(crate) cur_text_index: usize,
     pub(crate) cur_text_byte_index: usize,
+    pub(crate) citation_index_unit: CitationIndexUnit,
+    pub(crate) citation_source_format: CitationSourceFormat,
+    pub(crate) unicode_normalization: UnicodeNormalization,
+    // Last grapheme cluster of the text counted in cur_text_index, which the next text
+    // may extend
+    pub(crate) last_grapheme: String,
     pub(crate) cur_citation_byte_index: Option<usize>,
+    pub(crate) pending_citation: Option<FilterCitation>,
+    // Text since the start of the first sentence that may still be cited, with the
+    // index of its start, and the citations held until their sentences end
+    pub(crate) sentence_text: String,
+    pub(crate) sentence_start_index: usize,
+    pub(crate) sentence_held_citations: Vec<FilterCitation>,
     pub(crate) action_metadata: FilterAction,
+    // Number of thinking blocks started, the plan index of reasoning outputs is one less
+    pub(crate) plan_blocks: usize,
 
     // Search query tracking
     pub(crate) curr_search_query_idx: usize,
     pub(crate) sent_curr_index: bool,
+    // Whether the queries of search tool calls are emitted as search query deltas, set
+    // when both search queries and tool actions are handled
+    pub(crate) search_tool_queries: bool,
+    // Quoting of the search query read, which a separator does not split in, unless
+    // legacy_search_query_splitting is set
+    pub(crate) legacy_search_query_splitting: bool,
+    pub(crate) query_quoting: QueryQuoting,
 
     // Format flags
     pub(crate) has_tool_call_id: bool,
     pub(crate) cmd3_citations: bool,
+    pub(crate) merge_citations: bool,
+    pub(crate) sentence_citations: bool,
+    pub(crate) llama_tool_calls: bool,
 
     // Chunking configuration
     pub(crate) chunk_size: usize,
+    pub(crate) word_boundary_min_chars: Option<usize>,
     pub(crate) num_tokens_in_chunk: usize,
     pub(crate) chunk_log_probs: TokenIDsWithLogProb,
+    // End of the text of each token of chunk_log_probs in the buffer, so a chunk ending
+    // at a word boundary only takes the log probs of the tokens it emits
+    pub(crate) chunk_token_ends: Vec<usize>,
 
     // Buffering state
     pub(crate) buf: Vec<u8>,
     pub(crate) partial_special_token_log_prob: TokenIDsWithLogProb,
     pub(crate) mode: FilterMode,
     pub(crate) done: bool,
+
+    // Finish reporting, stop_sequences are the stops set with the inclusive and
+    // exclusive stop options rather than special tokens
+    pub(crate) emit_finish: bool,
+    pub(crate) finished: bool,
+    pub(crate) stop_sequences: HashSet<String>,
+    // Contexts of the conditional stops, and the code fences of the text they may apply in
+    pub(crate) stop_contexts: HashMap<String, StopContext>,
+    pub(crate) code_fence: CodeFence,
+
+    // Number of echoed prompt tokens still to pass through unparsed
+    pub(crate) prompt_echo_remaining: usize,
+
+    // Document selection lines, the one being read if any
+    pub(crate) stream_document_selections: bool,
+    pub(crate) document_selection: Option<DocumentSelection>,
+
+    // Token IDs written with write_token whose text is an incomplete UTF-8 sequence
+    pub(crate) pending_tokens: TokenIDsWithLogProb,
+
+    // Answer text of a resumed response held back until its overlap with the prior
+    // text is known
+    pub(crate) resume: Option<ResumeOverlap>,
+    // Last dedup_window bytes of the answer text emitted, and the citations of it, which
+    // a retry may replay
+    pub(crate) dedup_window: usize,
+    pub(crate) emitted_tail: String,
+    pub(crate) emitted_tail_citations: Vec<FilterCitation>,
+
+    // Healed text of a response prefix the completion has yet to repeat, with the
+    // length of its start the completion repeated so far
+    pub(crate) healed_prefix: String,
+    pub(crate) healed_matched: usize,
+
+    // States before each of the last rollback_window tokens, oldest first
+    pub(crate) rollback_window: usize,
+    pub(crate) rollback_states: VecDeque<FilterState>,
+
+    // Text of the sentence emitted since a soft stop was requested, if one was
+    pub(crate) soft_stop: Option<String>,
+}
+
+/// Whether the text read is in a markdown code fence, a run of three or more backticks
+/// opening and closing one.
+#[derive(Debug, Copy, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct CodeFence {
+    open: bool,
+    // Number of backticks the text read ends with
+    backticks: usize,
+}
+
+impl CodeFence {
+    fn read(&mut self, text: &[u8]) {
+        for &b in text {
+            if b == b'`' {
+                self.backticks += 1;
+                continue;
+            }
+            if self.backticks >= 3 {
+                self.open = !self.open;
+            }
+            self.backticks = 0;
+        }
+    }
+
+    /// Returns whether a fence is open after the text read followed by `text`.
+    fn open_after(mut self, text: &str) -> bool {
+        self.read(text.as_bytes());
+        self.open != (self.backticks >= 3)
+    }
+}
+
+/// Whether the search query read is in a double-quoted segment or after a backslash, where
+/// a separator does not start the next query.
+#[derive(Debug, Copy, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct QueryQuoting {
+    quoted: bool,
+    escaped: bool,
+}
+
+impl QueryQuoting {
+    fn read(&mut self, text: &[u8]) {
+        for &b in text {
+            if self.escaped {
+                self.escaped = false;
+            } else if b == b'\\' {
+                self.escaped = true;
+            } else if b == b'"' {
+                self.quoted = !self.quoted;
+            }
+        }
+    }
+
+    /// Returns whether a separator after the text read followed by `text` starts the next
+    /// query.
+    fn separates_after(mut self, text: &str) -> bool {
+        self.read(text.as_bytes());
+        !self.quoted && !self.escaped
+    }
+
+    /// Returns `text`, read after the text read, without the backslashes escaping a
+    /// separator, a quote or a backslash.
+    fn unescape(mut self, text: &str) -> String {
+        let mut out = String::with_capacity(text.len());
+        for c in text.chars() {
+            if self.escaped {
+                if !matches!(c, '|' | '"' | '\\' | '\n') {
+                    out.push('\\');
+                }
+                out.push(c);
+                self.escaped = false;
+            } else if c == '\\' {
+                self.escaped = true;
+            } else {
+                out.push(c);
+            }
+        }
+        if self.escaped {
+            out.push('\\');
+        }
+        out
+    }
+}
+
+/// The kind of a document selection line of the multi-hop format.
+#[derive(Debug, Copy, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) enum DocumentSelection {
+    Relevant,
+    Cited,
+}
+
+impl DocumentSelection {
+    fn from_token(token: &str) -> Option<Self> {
+        match token {
+            "Relevant Documents:" => Some(Self::Relevant),
+            "Cited Documents:" => Some(Self::Cited),
+            _ => None,
+        }
+    }
+
+    /// Returns the output of a line listing the indices of the selected documents.
+    fn output(self, line: &str) -> FilterOutput {
+        let indices = line
+            .split(',')
+            .filter_map(|idx| idx.trim().parse().ok())
+            .collect();
+        match self {
+            Self::Relevant => FilterOutput {
+                relevant_doc_indices: Some(indices),
+                ..Default::default()
+            },
+            Self::Cited => FilterOutput {
+                cited_doc_indices: Some(indices),
+                ..Default::default()
+            },
+        }
+    }
 }
 
 impl FilterImpl {
@@ -135,6 +338,8 @@ impl FilterImpl {
             right_trimmed: false,
             default_mode: FilterMode::PlainText,
             special_token_map: HashMap::new(),
+            special_tokens: SequenceMatcher::default(),
+            special_tokens_outside_search: SequenceMatcher::default(),
             stream_non_grounded_answer: false,
             stream_tool_actions: false,
             stream_processed_params: false,
@@ -142,31 +347,195 @@ impl FilterImpl {
             saw_non_whitespace_in_current_line: false,
             cur_text_index: 0,
             cur_text_byte_index: 0,
+            citation_index_unit: CitationIndexUnit::Runes,
+            citation_source_format: CitationSourceFormat::ToolIndex,
+            unicode_normalization: UnicodeNormalization::None,
+            last_grapheme: String::new(),
             cur_citation_byte_index: None,
+            pending_citation: None,
+            sentence_text: String::new(),
+            sentence_start_index: 0,
+            sentence_held_citations: Vec::new(),
             action_metadata: FilterAction::new(),
+            plan_blocks: 0,
             curr_search_query_idx: 0,
             sent_curr_index: false,
+            search_tool_queries: false,
+            legacy_search_query_splitting: false,
+            query_quoting: QueryQuoting::default(),
             has_tool_call_id: false,
             cmd3_citations: false,
+            merge_citations: false,
+            sentence_citations: false,
+            llama_tool_calls: false,
             chunk_size: 1,
+            word_boundary_min_chars: None,
             num_tokens_in_chunk: 0,
             chunk_log_probs: TokenIDsWithLogProb::new(),
+            chunk_token_ends: Vec::new(),
             buf: Vec::new(),
             partial_special_token_log_prob: TokenIDsWithLogProb::new(),
             mode: FilterMode::PlainText,
             done: false,
+            emit_finish: false,
+            finished: false,
+            stop_sequences: HashSet::new(),
+            stop_contexts: HashMap::new(),
+            code_fence: CodeFence::default(),
+            prompt_echo_remaining: 0,
+            stream_document_selections: false,
+            document_selection: None,
+            pending_tokens: TokenIDsWithLogProb::new(),
+            resume: None,
+            dedup_window: 0,
+            emitted_tail: String::new(),
+            emitted_tail_citations: Vec::new(),
+            healed_prefix: String::new(),
+            healed_matched: 0,
+            rollback_window: 0,
+            rollback_states: VecDeque::new(),
+            soft_stop: None,
+        }
+    }
+
+    /// Returns the number of bytes held back waiting for the rest of a special token,
+    /// stop sequence or UTF-8 sequence.
+    #[must_use]
+    pub fn buffered_bytes(&self) -> usize {
+        self.buf.len()
+    }
+
+    /// Returns the mode the filter parses the next text in, the default mode until a
+    /// special token switches it.
+    #[must_use]
+    pub fn mode(&self) -> FilterMode {
+        self.mode
+    }
+
+    /// Writes a token ID, decoded with `decode`, and returns any completed outputs.
+    ///
+    /// Tokens whose text ends with an incomplete UTF-8 sequence, such as the first bytes
+    /// of an emoji, are held back and decoded together with the next ones. The log
+    /// probabilities of the outputs are only set if every token was written with one.
+    ///
+    /// # Errors
+    ///
+    /// Returns the error of `decode`, the token is then discarded.
+    pub fn write_token<E>(
+        &mut self,
+        token_id: u32,
+        logprob: Option<f32>,
+        decode: impl FnOnce(&[u32]) -> Result<String, E>,
+    ) -> Result<Vec<FilterOutput>, E> {
+        self.push_rollback_state();
+        self.pending_tokens.token_ids.push(token_id);
+        if let Some(logprob) = logprob {
+            self.pending_tokens.logprobs.push(logprob);
         }
+        let decoded = match decode(&self.pending_tokens.token_ids) {
+            Ok(decoded) => decoded,
+            Err(e) => {
+                self.pending_tokens.token_ids.pop();
+                if logprob.is_some() {
+                    self.pending_tokens.logprobs.pop();
+                }
+                self.rollback_states.pop_back();
+                return Err(e);
+            }
+        };
+        if decoded.ends_with(char::REPLACEMENT_CHARACTER) {
+            return Ok(Vec::new());
+        }
+        Ok(self.write_pending_tokens(&decoded))
+    }
+
+    /// Flushes the tokens held back by `write_token`, then the buffered partial outputs.
+    ///
+    /// # Errors
+    ///
+    /// Returns the error of `decode`, the held back tokens are then discarded.
+    pub fn flush_tokens<E>(
+        &mut self,
+        decode: impl FnOnce(&[u32]) -> Result<String, E>,
+    ) -> Result<Vec<FilterOutput>, E> {
+        let mut out = Vec::new();
+        if !self.pending_tokens.token_ids.is_empty() {
+            let decoded = decode(&self.pending_tokens.token_ids);
+            if decoded.is_err() {
+                self.pending_tokens = TokenIDsWithLogProb::new();
+            }
+            out = self.write_pending_tokens(&decoded?);
+        }
+        out.append(&mut self.flush_partials());
+        Ok(out)
+    }
+
+    fn write_pending_tokens(&mut self, decoded: &str) -> Vec<FilterOutput> {
+        let mut logprobs = std::mem::take(&mut self.pending_tokens);
+        if logprobs.logprobs.len() != logprobs.token_ids.len() {
+            logprobs = TokenIDsWithLogProb::new();
+        }
+        self.write_str(decoded, logprobs)
+    }
+
+    fn write_str(&mut self, decoded_token: &str, l: TokenIDsWithLogProb) -> Vec<FilterOutput> {
+        if self.prompt_echo_remaining > 0 {
+            return self.echo_prompt_token(decoded_token, l);
+        }
+        let decoded_token = self.strip_healed_prefix(decoded_token);
+        let out = self.write_text(decoded_token.as_bytes(), l);
+        let out = self.resume_outputs(out, false);
+        let out = self.soft_stop_outputs(out);
+        self.track_emitted_tail(&out);
+        out
+    }
+
+    /// Returns the token without the part of the healed prefix it repeats, see
+    /// `with_healed_prefix`. If the completion stops repeating it, the start it repeated
+    /// is returned with the token.
+    fn strip_healed_prefix<'a>(&mut self, decoded_token: &'a str) -> Cow<'a, str> {
+        if self.healed_prefix.is_empty() {
+            return Cow::Borrowed(decoded_token);
+        }
+        let rest = &self.healed_prefix[self.healed_matched..];
+        if let Some(after) = decoded_token.strip_prefix(rest) {
+            self.healed_prefix.clear();
+            self.healed_matched = 0;
+            return Cow::Borrowed(after);
+        }
+        if rest.starts_with(decoded_token) {
+            self.healed_matched += decoded_token.len();
+            return Cow::Borrowed("");
+        }
+        let repeated = self.healed_prefix[..self.healed_matched].to_string();
+        self.healed_prefix.clear();
+        self.healed_matched = 0;
+        Cow::Owned(repeated + decoded_token)
     }
 
     pub(crate) fn apply_options(mut self, options: FilterOptions) -> Self {
         self.left_trimmed = options.left_trimmed;
         self.right_trimmed = options.right_trimmed;
         self.chunk_size = options.chunk_size;
+        self.word_boundary_min_chars = options.word_boundary_min_chars;
         self.stream_non_grounded_answer = options.stream_non_grounded_answer;
         self.stream_tool_actions = options.stream_tool_actions;
         self.stream_processed_params = options.stream_processed_params;
         self.has_tool_call_id = options.has_tool_call_id;
         self.cmd3_citations = options.cmd3_citations;
+        self.merge_citations = options.merge_citations;
+        self.sentence_citations = options.sentence_citations;
+        self.citation_index_unit = options.citation_index_unit;
+        self.citation_source_format = options.citation_source_format;
+        self.unicode_normalization = options.unicode_normalization;
+        self.emit_finish = options.emit_finish;
+        self.prompt_echo_remaining = options.prompt_echo_tokens;
+        self.healed_prefix = options.healed_prefix;
+        self.llama_tool_calls = options.llama_tool_calls;
+        self.stream_document_selections = options.stream_document_selections;
+        self.rollback_window = options.rollback_window;
+        self.dedup_window = options.dedup_window;
+        self.legacy_search_query_splitting = options.legacy_search_query_splitting;
         self.default_mode = options.default_mode;
         self.mode = options.default_mode;
 
@@ -175,17 +544,61 @@ impl FilterImpl {
             self.special_token_map.insert(token.clone(), *mode);
         }
 
+        self.search_tool_queries = self.special_token_map.get("Search:")
+            == Some(&FilterMode::SearchQuery)
+            && self.special_token_map.get("Action:") == Some(&FilterMode::ToolAction);
+
         // Add inclusive stops
         for stop in options.inclusive_stops {
+            self.stop_sequences.insert(stop.clone());
             self.special_token_map
                 .insert(stop, FilterMode::InclusiveStop);
         }
 
         // Add exclusive stops
         for stop in options.exclusive_stops {
+            self.stop_sequences.insert(stop.clone());
             self.special_token_map
                 .insert(stop, FilterMode::ExclusiveStop);
         }
+        for stop in options.conditional_stops {
+            self.stop_sequences.insert(stop.stop.clone());
+            self.stop_contexts.insert(stop.stop.clone(), stop.context);
+            self.special_token_map
+                .insert(stop.stop, FilterMode::ExclusiveStop);
+        }
+
+        // The response prefix was already shown, the completion continues it
+        if !options.response_prefix.is_empty() {
+            self.advance_text_index(&options.response_prefix);
+            if !options.response_prefix.trim().is_empty() {
+                self.left_trimmed = false;
+            }
+            if self.dedup_window > 0 {
+                self.emitted_tail.clone_from(&options.response_prefix);
+                self.emitted_tail_citations = options.resume_citations.clone().unwrap_or_default();
+                self.track_emitted_tail(&[]);
+            }
+            if let Some(citations) = options.resume_citations {
+                self.resume = Some(ResumeOverlap::new(
+                    &options.response_prefix,
+                    citations,
+                    self.dedup_window,
+                ));
+            }
+        }
+
+        self.special_tokens = SequenceMatcher::new(self.special_token_map.keys())
+            .linear(options.linear_token_matching);
+        if self.search_tool_queries {
+            self.special_tokens_outside_search = SequenceMatcher::new(
+                self.special_token_map
+                    .iter()
+                    .filter(|&(_, &mode)| mode != FilterMode::NextSearchQuery)
+                    .map(|(token, _)| token),
+            )
+            .linear(options.linear_token_matching);
+        }
 
         self
     }
@@ -203,7 +616,7 @@ impl FilterImpl {
         let str = String::from_utf8_lossy(&self.buf).to_string();
 
         // If is a partial special token, we need to wait for the next token.
-        let (special_token_idx, found_seq) = find_partial(&str, &mut self.special_token_map.keys());
+        let (special_token_idx, found_seq) = self.find_special_token(&str);
         if special_token_idx != usize::MAX && found_seq.is_empty() {
             self.partial_special_token_log_prob = logprobs;
             return Vec::new();
@@ -221,23 +634,37 @@ impl FilterImpl {
                 if stop {
                     self.buf.clear();
                     self.done = true;
+                    self.release_pending_citation(&mut out);
+                    let reason = if !self.stop_sequences.contains(&found_seq) {
+                        FinishReason::EndOfSequence
+                    } else if new_mode == FilterMode::InclusiveStop {
+                        FinishReason::InclusiveStop
+                    } else {
+                        FinishReason::ExclusiveStop
+                    };
+                    self.finish(&mut out, reason, found_seq);
                     return out;
                 }
 
                 // Before the special token, process the buffer with the old mode
                 let pre_special_token = &str[..special_token_idx];
                 if !pre_special_token.is_empty() {
-                    // Take ownership temporarily to avoid clone
-                    let partial_log_prob = std::mem::take(&mut self.partial_special_token_log_prob);
+                    // The text held back for the chunk is flushed with its log probs
+                    let mut chunk_log_probs = self.take_chunk_log_probs(self.buf.len());
+                    chunk_log_probs.append(self.partial_special_token_log_prob.clone());
                     let (o, _) = self.handle_token(
                         self.mode,
                         pre_special_token.as_bytes(),
                         false,
-                        &partial_log_prob,
+                        &chunk_log_probs,
                     );
-                    // restore
-                    self.partial_special_token_log_prob = partial_log_prob;
                     out.extend(o);
+                    self.read_code_fences(pre_special_token.as_bytes());
+                }
+
+                // A document selection line without a newline ends at the special token
+                if let Some(selection) = self.document_selection.take() {
+                    out.push(selection.output(pre_special_token));
                 }
 
                 // Remove the special token and the text before
@@ -245,34 +672,116 @@ impl FilterImpl {
                 self.buf.drain(..remove_len);
 
                 // Change mode
+                if new_mode == FilterMode::ToolReason {
+                    self.start_plan_block(&mut out);
+                }
+                if new_mode != self.mode {
+                    self.code_fence = CodeFence::default();
+                }
                 self.mode = new_mode;
+                if self.stream_document_selections {
+                    self.document_selection = DocumentSelection::from_token(&found_seq);
+                }
             }
         }
 
         // Process buffer by mode
         if !self.buf.is_empty() {
             self.num_tokens_in_chunk += 1;
+            let end = self.buf.len();
+            self.chunk_token_ends
+                .extend(std::iter::repeat_n(end, logprobs.token_ids.len()));
             self.chunk_log_probs.append(logprobs);
 
-            if self.chunk_size > 1 && self.num_tokens_in_chunk < self.chunk_size {
+            let Some(chunk_len) = self.chunk_len() else {
                 return out;
-            }
+            };
 
-            let (o, remove) = self.handle_token(
-                self.mode,
-                &self.buf.clone(),
-                false,
-                &self.chunk_log_probs.clone(),
-            );
+            let chunk = self.buf[..chunk_len].to_vec();
+            let chunk_log_probs = self.take_chunk_log_probs(chunk_len);
+            let (o, remove) = self.handle_token(self.mode, &chunk, false, &chunk_log_probs);
             out.extend(o);
+            self.read_code_fences(&chunk[..remove]);
             self.buf.drain(..remove);
+            for end in &mut self.chunk_token_ends {
+                *end = end.saturating_sub(remove);
+            }
             self.num_tokens_in_chunk = 0;
-            self.chunk_log_probs = TokenIDsWithLogProb::new();
         }
 
         out
     }
 
+    /// Returns the index and the sequence of the first special token of `s`, like
+    /// `SequenceMatcher::find`, skipping the conditional stops outside of their context and
+    /// the search query separators that are quoted or escaped.
+    fn find_special_token(&self, s: &str) -> (usize, String) {
+        // With tool actions also handled, search queries are only separated in a search
+        // block so the newlines of an action aren't taken as the start of a query
+        let special_tokens = if self.search_tool_queries && self.mode != FilterMode::SearchQuery {
+            &self.special_tokens_outside_search
+        } else {
+            &self.special_tokens
+        };
+        let mut start = 0;
+        loop {
+            let (idx, seq) = special_tokens.find(&s[start..]);
+            if idx == usize::MAX {
+                return (idx, seq);
+            }
+            let idx = start + idx;
+            if seq.is_empty()
+                || (self.stop_applies(&seq, &s[..idx]) && self.separator_applies(&seq, &s[..idx]))
+            {
+                return (idx, seq);
+            }
+            // A special token may start within the stop
+            start = idx + s[idx..].chars().next().map_or(1, char::len_utf8);
+        }
+    }
+
+    /// Returns whether the special token `token`, found after the unparsed text `before`,
+    /// applies: every special token but the conditional stops outside of their context.
+    fn stop_applies(&self, token: &str, before: &str) -> bool {
+        match self.stop_contexts.get(token) {
+            None => true,
+            Some(StopContext::NotInAction) => self.mode != FilterMode::ToolAction,
+            Some(StopContext::NotInThinking) => self.mode != FilterMode::ToolReason,
+            Some(StopContext::PlainText) => {
+                self.is_response_text() && !self.code_fence.open_after(before)
+            }
+        }
+    }
+
+    /// Returns whether the special token `token`, found after the unparsed text `before`,
+    /// applies: every special token but the search query separators in a quoted segment or
+    /// after a backslash.
+    fn separator_applies(&self, token: &str, before: &str) -> bool {
+        self.legacy_search_query_splitting
+            || self.mode != FilterMode::SearchQuery
+            || self.special_token_map.get(token) != Some(&FilterMode::NextSearchQuery)
+            || self.query_quoting.separates_after(before)
+    }
+
+    /// Returns whether the filter is in the text of the response.
+    fn is_response_text(&self) -> bool {
+        matches!(
+            self.mode,
+            FilterMode::PlainText | FilterMode::Answer | FilterMode::GroundedAnswer
+        )
+    }
+
+    /// Follows the code fences of the response text parsed, for the conditional stops, and
+    /// the quoting of the search query parsed, for its separators.
+    fn read_code_fences(&mut self, text: &[u8]) {
+        if !self.stop_contexts.is_empty() && self.is_response_text() {
+            self.code_fence.read(text);
+        }
+        if !self.legacy_search_query_splitting && self.mode == FilterMode::SearchQuery {
+            self.query_quoting.read(text);
+        }
+    }
+
     fn handle_token(
         &mut self,
         mode: FilterMode,
@@ -285,6 +794,9 @@ impl FilterImpl {
                 log::error!("in stop mode but we should have already stopped");
                 (Vec::new(), 0)
             }
+            FilterMode::Ignore if self.document_selection.is_some() => {
+                self.process_document_selection(bstr, after_last_token)
+            }
             FilterMode::Ignore | FilterMode::NextSearchQuery => (Vec::new(), 0),
             FilterMode::ToolAction => {
                 let s = String::from_utf8_lossy(bstr);
@@ -293,7 +805,7 @@ impl FilterImpl {
             FilterMode::GroundedAnswer | FilterMode::ToolReason => {
                 self.process_grounded_text(bstr, after_last_token, mode, Some(token_log_probs))
             }
-            FilterMode::SearchQuery => self.process_search_query(bstr),
+            FilterMode::SearchQuery => self.process_search_query(bstr, after_last_token),
             FilterMode::Answer => {
                 if self.stream_non_grounded_answer {
                     self.process_text(bstr, Some(token_log_probs))
@@ -337,11 +849,17 @@ impl FilterImpl {
                 (out, new_mode, true, true)
             }
             FilterMode::GroundedAnswer => {
+                let mut out = Vec::new();
+                if self.sentence_citations {
+                    // The sentences of the thinking block end with it
+                    self.release_pending_citation(&mut out);
+                }
                 self.cur_text_index = 0;
+                self.last_grapheme.clear();
                 if self.stream_non_grounded_answer {
                     self.left_trimmed = true;
                 }
-                (Vec::new(), new_mode, false, true)
+                (out, new_mode, false, true)
             }
             FilterMode::ToolReason => {
                 self.left_trimmed = true;
@@ -350,10 +868,12 @@ impl FilterImpl {
             }
             FilterMode::Answer | FilterMode::SearchQuery => {
                 self.left_trimmed = true;
+                self.query_quoting = QueryQuoting::default();
                 (Vec::new(), new_mode, false, true)
             }
             FilterMode::NextSearchQuery => {
                 self.left_trimmed = true;
+                self.query_quoting = QueryQuoting::default();
                 if self.sent_curr_index {
                     self.curr_search_query_idx += 1;
                     self.sent_curr_index = false;
@@ -364,6 +884,117 @@ impl FilterImpl {
         }
     }
 
+    /// Takes the log probs of the tokens whose text ends within the first `len` bytes of
+    /// the buffer, the others stay with the rest of the chunk. A token split by a word
+    /// boundary goes with the chunk its text ends in.
+    fn take_chunk_log_probs(&mut self, len: usize) -> TokenIDsWithLogProb {
+        // The tokens of a state saved without their ends are all taken
+        if self.chunk_token_ends.len() != self.chunk_log_probs.token_ids.len() {
+            self.chunk_token_ends.clear();
+            return std::mem::take(&mut self.chunk_log_probs);
+        }
+        let taken = self
+            .chunk_token_ends
+            .iter()
+            .take_while(|&&end| end <= len)
+            .count();
+        self.chunk_token_ends.drain(..taken);
+        let rest = self.chunk_log_probs.split_off(taken);
+        std::mem::replace(&mut self.chunk_log_probs, rest)
+    }
+
+    /// Returns the length of the start of the buffer to process, or `None` while the
+    /// chunk is incomplete: the buffer up to its last word boundary after
+    /// `word_boundary_min_chars` characters for text with word boundary chunking,
+    /// otherwise the whole buffer once it holds `chunk_size` tokens. Normalized text is
+    /// processed up to its last starter, see `UnicodeNormalization::stable_len`.
+    fn chunk_len(&self) -> Option<usize> {
+        let text_mode = matches!(
+            self.mode,
+            FilterMode::PlainText
+                | FilterMode::Answer
+                | FilterMode::GroundedAnswer
+                | FilterMode::ToolReason
+        );
+        let len = match self.word_boundary_min_chars {
+            Some(min_chars) if text_mode => {
+                // An incomplete UTF-8 sequence at the end is held back
+                let text = match std::str::from_utf8(&self.buf) {
+                    Ok(text) => text,
+                    Err(e) => std::str::from_utf8(&self.buf[..e.valid_up_to()]).ok()?,
+                };
+                text.char_indices()
+                    .enumerate()
+                    .filter(|&(n, (_, c))| {
+                        n + 1 >= min_chars && (c.is_whitespace() || c.is_ascii_punctuation())
+                    })
+                    .map(|(_, (i, c))| i + c.len_utf8())
+                    .last()
+            }
+            _ if self.chunk_size > 1 && self.num_tokens_in_chunk < self.chunk_size => None,
+            _ => Some(self.buf.len()),
+        }?;
+        if !text_mode {
+            return Some(len);
+        }
+        Some(self.unicode_normalization.stable_len(&self.buf[..len])).filter(|&len| len > 0)
+    }
+
+    /// Starts a thinking block: the citation held back for merging belongs to the
+    /// previous block, and the citation indices of the new block start at 0.
+    fn start_plan_block(&mut self, out: &mut Vec<FilterOutput>) {
+        self.release_pending_citation(out);
+        self.cur_text_index = 0;
+        self.last_grapheme.clear();
+        self.plan_blocks += 1;
+    }
+
+    /// Returns the plan index of reasoning outputs, the index of the current thinking
+    /// block.
+    pub(crate) fn plan_index(&self) -> usize {
+        self.plan_blocks.saturating_sub(1)
+    }
+
+    /// Passes an echoed prompt token through without parsing it.
+    fn echo_prompt_token(
+        &mut self,
+        decoded_token: &str,
+        l: TokenIDsWithLogProb,
+    ) -> Vec<FilterOutput> {
+        self.prompt_echo_remaining = self
+            .prompt_echo_remaining
+            .saturating_sub(l.token_ids.len().max(1));
+        if decoded_token.is_empty() && l.token_ids.is_empty() {
+            return Vec::new();
+        }
+        vec![FilterOutput {
+            text: decoded_token.to_string(),
+            logprobs: l,
+            is_echo: true,
+            ..Default::default()
+        }]
+    }
+
+    /// Appends the terminal output reporting why the stream ended, once, if enabled.
+    pub(crate) fn finish(
+        &mut self,
+        out: &mut Vec<FilterOutput>,
+        reason: FinishReason,
+        stop_sequence: String,
+    ) {
+        if !self.emit_finish || self.finished {
+            return;
+        }
+        self.finished = true;
+        out.push(FilterOutput {
+            finish: Some(FilterFinish {
+                reason,
+                stop_sequence,
+            }),
+            ..Default::default()
+        });
+    }
+
     pub(crate) fn handle_inclusive_stop(
         &self,
         s: &str,
@@ -378,7 +1009,7 @@ impl FilterImpl {
             };
 
             return vec![FilterOutput {
-                text,
+                text: self.unicode_normalization.apply_owned(text),
                 ..Default::default()
             }];
         }
@@ -396,7 +1027,7 @@ impl FilterImpl {
             };
 
             return vec![FilterOutput {
-                text,
+                text: self.unicode_normalization.apply_owned(text),
                 ..Default::default()
             }];
         }
@@ -412,13 +1043,27 @@ impl FilterImpl {
         valid || bstr.len() >= limit
     }
 
-    pub(crate) fn process_search_query(&mut self, bstr: &[u8]) -> (Vec<FilterOutput>, usize) {
+    pub(crate) fn process_search_query(
+        &mut self,
+        bstr: &[u8],
+        after_last_token: bool,
+    ) -> (Vec<FilterOutput>, usize) {
         if !Self::utf8_valid_or_limit(bstr) {
             return (Vec::new(), 0);
         }
 
         let s = String::from_utf8_lossy(bstr);
-        let (send, rem_right) = self.trim_space(&s);
+        let (mut send, mut rem_right) = self.trim_space(&s);
+        if !self.legacy_search_query_splitting {
+            // A backslash ending the text waits for the character it escapes
+            let mut quoting = self.query_quoting;
+            quoting.read(&bstr[..bstr.len() - rem_right]);
+            if quoting.escaped && !after_last_token {
+                send.pop();
+                rem_right += 1;
+            }
+            send = self.query_quoting.unescape(&send);
+        }
         let mut out = Vec::new();
 
         if !send.is_empty() {
@@ -435,6 +1080,25 @@ impl FilterImpl {
         (out, bstr.len() - rem_right)
     }
 
+    /// Emits the document selection line at the start of `bstr` once it is complete,
+    /// consuming it. The rest of the text is ignored.
+    fn process_document_selection(
+        &mut self,
+        bstr: &[u8],
+        after_last_token: bool,
+    ) -> (Vec<FilterOutput>, usize) {
+        let s = String::from_utf8_lossy(bstr);
+        let end = match s.find('\n') {
+            Some(idx) => idx,
+            None if after_last_token => s.len(),
+            None => return (Vec::new(), 0),
+        };
+        let Some(selection) = self.document_selection.take() else {
+            return (Vec::new(), 0);
+        };
+        (vec![selection.output(&s[..end])], (end + 1).min(bstr.len()))
+    }
+
     pub(crate) fn process_text(
         &mut self,
         bstr: &[u8],
@@ -450,7 +1114,7 @@ impl FilterImpl {
 
         if !send.is_empty() {
             let mut output = FilterOutput {
-                text: send,
+                text: self.unicode_normalization.apply_owned(send),
                 ..Default::default()
             };
             if let Some(probs) = token_log_probs {
@@ -486,26 +1150,36 @@ impl FilterImpl {
 
 impl Filter for FilterImpl {
     fn write_decoded(&mut self, decoded_token: &str, l: TokenIDsWithLogProb) -> Vec<FilterOutput> {
-        self.write_text(decoded_token.as_bytes(), l)
+        self.push_rollback_state();
+        self.write_str(decoded_token, l)
     }
 
     fn flush_partials(&mut self) -> Vec<FilterOutput> {
         self.done = true;
+        let mut out = Vec::new();
         if !self.buf.is_empty()
             && self.mode != FilterMode::InclusiveStop
             && self.mode != FilterMode::ExclusiveStop
         {
             // Use take to avoid cloning
             let buf_copy = std::mem::take(&mut self.buf);
-            let log_prob_copy = std::mem::take(&mut self.partial_special_token_log_prob);
-            let (o, _remove) = self.handle_token(self.mode, &buf_copy, true, &log_prob_copy);
-            return o;
+            let mut log_prob_copy = self.take_chunk_log_probs(buf_copy.len());
+            log_prob_copy.append(std::mem::take(&mut self.partial_special_token_log_prob));
+            (out, _) = self.handle_token(self.mode, &buf_copy, true, &log_prob_copy);
         }
-        Vec::new()
+        out = self.resume_outputs(out, true);
+        out = self.soft_stop_outputs(out);
+        self.release_pending_citation(&mut out);
+        self.finish(&mut out, FinishReason::Flush, String::new());
+        self.track_emitted_tail(&out);
+        out
     }
 }
 
 /// Find partial returns first index in str that might match one of stop sequences.
+///
+/// It is linear in the number of stop sequences, so it is used for a few sequences and
+/// `SequenceMatcher` for the special tokens of the filter.
 pub(crate) fn find_partial<'a>(
     s: &str,
     stops: impl Iterator<Item = &'a String>,
@@ -546,7 +1220,413 @@ pub(crate) fn find_partial<'a>(
 
 #[cfg(test)]
 mod tests {
-    use crate::parsing::filter::find_partial;
+    use crate::fim::FimFamily;
+    use crate::parsing::filter::{Filter, find_partial};
+    use crate::parsing::json::{FilterConfig, output_to_json};
+    use crate::parsing::options::{FilterOptions, new_filter};
+    use crate::parsing::types::{
+        ConditionalStop, FilterFinish, FilterMode, FinishReason, StopContext, TokenIDsWithLogProb,
+    };
+    use serde::Deserialize;
+    use serde_json::Value;
+    use std::fs;
+    use std::path::Path;
+
+    #[derive(Deserialize)]
+    struct ConformanceInput {
+        #[serde(flatten)]
+        config: FilterConfig,
+        chunks: Vec<String>,
+    }
+
+    #[test]
+    fn test_conformance_corpus() {
+        let root = Path::new(file!())
+            .parent()
+            .unwrap()
+            .parent()
+            .unwrap()
+            .parent()
+            .unwrap();
+        let corpus_dir = root.join("gobindings/conformance/testdata");
+        let mut num_cases = 0;
+        for entry in fs::read_dir(&corpus_dir).unwrap() {
+            let path = entry.unwrap().path();
+            if !path.is_dir() {
+                continue;
+            }
+            let name = path.file_name().unwrap().to_string_lossy().to_string();
+            let input: ConformanceInput =
+                serde_json::from_str(&fs::read_to_string(path.join("input.json")).unwrap())
+                    .unwrap();
+            let want: Value =
+                serde_json::from_str(&fs::read_to_string(path.join("output.json")).unwrap())
+                    .unwrap();
+
+            let mut filter = new_filter(input.config.options().unwrap());
+            let mut outputs = Vec::new();
+            for chunk in &input.chunks {
+                outputs.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+            }
+            outputs.extend(filter.flush_partials());
+            let got = Value::Array(outputs.iter().map(output_to_json).collect());
+
+            assert_eq!(got, want, "Conformance case '{name}' diverged");
+            num_cases += 1;
+        }
+        assert!(num_cases > 0, "no conformance cases in {corpus_dir:?}");
+    }
+
+    #[test]
+    fn test_special_token_map_merges_with_preset() {
+        let options = FilterOptions::new().cmd3().with_special_token_map(
+            [
+                ("<|START_TOOL_CALLS|>".to_string(), FilterMode::ToolAction),
+                ("<|END_RESPONSE|>".to_string(), FilterMode::ExclusiveStop),
+            ]
+            .into_iter()
+            .collect(),
+        );
+        let mut filter = new_filter(options);
+
+        let mut text = String::new();
+        let mut tool_names = String::new();
+        for chunk in [
+            "<|START_RESPONSE|>",
+            "foo",
+            "<|END_RESPONSE|>",
+            "<|START_RESPONSE|>",
+            "bar",
+        ] {
+            for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                text.push_str(&o.text);
+            }
+        }
+        assert_eq!(text, "foo");
+
+        let mut filter = new_filter(
+            FilterOptions::new().cmd3().with_special_token_map(
+                [("<|START_TOOL_CALLS|>".to_string(), FilterMode::ToolAction)]
+                    .into_iter()
+                    .collect(),
+            ),
+        );
+        for chunk in [
+            "<|START_TOOL_CALLS|>",
+            r#"[{"tool_call_id": "0", "tool_name": "add", "parameters": {}}]"#,
+        ] {
+            for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                if let Some(tc) = o.tool_call_delta {
+                    tool_names.push_str(&tc.name);
+                }
+            }
+        }
+        assert_eq!(tool_names, "add");
+    }
+
+    #[test]
+    fn test_handle_fim_strips_sentinels() {
+        let mut filter = new_filter(FilterOptions::new().handle_fim(FimFamily::Command));
+        let mut text = String::new();
+        for chunk in [
+            "<|BEGINNING_OF_MIDDLE_FIM_TOKEN|>",
+            "c = a",
+            " + b",
+            "<|END_OF_MIDDLE_FIM_TOKEN|>",
+            "ignored",
+        ] {
+            for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                text.push_str(&o.text);
+            }
+        }
+        for o in filter.flush_partials() {
+            text.push_str(&o.text);
+        }
+        assert_eq!(text, "c = a + b");
+    }
+
+    #[test]
+    fn test_finish_reason() {
+        let finish_of = |options: FilterOptions, chunks: &[&str]| {
+            let mut filter = new_filter(options.with_finish_reason());
+            let mut out = Vec::new();
+            for chunk in chunks {
+                out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+            }
+            out.extend(filter.flush_partials());
+            let finishes: Vec<FilterFinish> = out.iter().filter_map(|o| o.finish.clone()).collect();
+            assert_eq!(finishes.len(), 1);
+            assert!(out.last().unwrap().finish.is_some());
+            (finishes[0].reason, finishes[0].stop_sequence.clone())
+        };
+
+        assert_eq!(
+            finish_of(
+                FilterOptions::new().with_inclusive_stops(vec!["STOP".to_string()]),
+                &["foo ST", "OP bar"]
+            ),
+            (FinishReason::InclusiveStop, "STOP".to_string())
+        );
+        assert_eq!(
+            finish_of(
+                FilterOptions::new().with_exclusive_stops(vec!["STOP".to_string()]),
+                &["foo STOP"]
+            ),
+            (FinishReason::ExclusiveStop, "STOP".to_string())
+        );
+        assert_eq!(
+            finish_of(
+                FilterOptions::new().handle_fim(FimFamily::Command),
+                &["c = a", "<|END_OF_MIDDLE_FIM_TOKEN|>"]
+            ),
+            (
+                FinishReason::EndOfSequence,
+                "<|END_OF_MIDDLE_FIM_TOKEN|>".to_string()
+            )
+        );
+        assert_eq!(
+            finish_of(FilterOptions::new(), &["foo"]),
+            (FinishReason::Flush, String::new())
+        );
+    }
+
+    #[test]
+    fn test_conditional_stops() {
+        let run = |options: FilterOptions, context: StopContext, chunks: &[&str]| {
+            let mut filter = new_filter(options.with_finish_reason().with_conditional_stops(vec![
+                ConditionalStop {
+                    stop: "BAD".to_string(),
+                    context,
+                },
+            ]));
+            let mut out = Vec::new();
+            for chunk in chunks {
+                out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+            }
+            out.extend(filter.flush_partials());
+            let text: String = out.iter().map(|o| o.text.as_str()).collect();
+            let finish = out.iter().find_map(|o| o.finish.clone()).unwrap();
+            (text, finish.reason)
+        };
+
+        // In code fences the stop is text
+        assert_eq!(
+            run(
+                FilterOptions::new(),
+                StopContext::PlainText,
+                &["Run ``", "`\nBA", "D\n```", " not BA", "D here"]
+            ),
+            (
+                "Run ```\nBAD\n``` not ".to_string(),
+                FinishReason::ExclusiveStop
+            )
+        );
+        assert_eq!(
+            run(
+                FilterOptions::new(),
+                StopContext::PlainText,
+                &["```BAD``` ok"]
+            ),
+            ("```BAD``` ok".to_string(), FinishReason::Flush)
+        );
+
+        // In a tool action the stop is part of the parameters
+        let (text, reason) = run(
+            FilterOptions::new().cmd3().stream_tool_actions(),
+            StopContext::NotInAction,
+            &[
+                "<|START_ACTION|>",
+                r#"[{"tool_call_id": "0", "tool_name": "run", "parameters": {"cmd": "BAD"}}]"#,
+                "<|END_ACTION|>",
+                "<|START_RESPONSE|>",
+                "Done BAD",
+            ],
+        );
+        assert_eq!(
+            (text.as_str(), reason),
+            ("Done", FinishReason::ExclusiveStop)
+        );
+
+        let (text, reason) = run(
+            FilterOptions::new().cmd3(),
+            StopContext::NotInThinking,
+            &[
+                "<|START_THINKING|>",
+                "BAD plan",
+                "<|END_THINKING|>",
+                "<|START_RESPONSE|>",
+                "ok BAD",
+            ],
+        );
+        assert_eq!(
+            (text.as_str(), reason),
+            ("BAD planok", FinishReason::ExclusiveStop)
+        );
+    }
+
+    #[test]
+    fn test_prompt_echo() {
+        let options = FilterOptions::new()
+            .cmd3()
+            .with_exclusive_stops(vec!["<|END_RESPONSE|>".to_string()])
+            .with_prompt_echo(3);
+        let mut filter = new_filter(options);
+
+        let mut echo = String::new();
+        let mut text = String::new();
+        for (chunk, ids) in [
+            ("Say <co>hi", vec![1]),
+            ("<|END_RESPONSE|>", vec![2, 3]),
+            ("<|START_RESPONSE|>", vec![4]),
+            ("hi", vec![5]),
+        ] {
+            let logprobs = TokenIDsWithLogProb {
+                logprobs: vec![0.0; ids.len()],
+                token_ids: ids,
+                ..Default::default()
+            };
+            for o in filter.write_decoded(chunk, logprobs) {
+                if o.is_echo {
+                    echo.push_str(&o.text);
+                } else {
+                    text.push_str(&o.text);
+                }
+            }
+        }
+        assert_eq!(echo, "Say <co>hi<|END_RESPONSE|>");
+        assert_eq!(text, "hi");
+    }
+
+    #[test]
+    fn test_response_prefix() {
+        let options = FilterOptions::new()
+            .cmd3()
+            .with_left_trimmed()
+            .with_response_prefix("The sky");
+        let mut filter = new_filter(options);
+
+        let mut text = String::new();
+        let mut citations = Vec::new();
+        for chunk in [" is", " <co>", "blue", "</co: 0:[1]>", "."] {
+            for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                text.push_str(&o.text);
+                citations.extend(o.citations);
+            }
+        }
+        for o in filter.flush_partials() {
+            text.push_str(&o.text);
+            citations.extend(o.citations);
+        }
+        // The leading space is kept and the indices count the prefix
+        assert_eq!(text, " is blue.");
+        assert_eq!(citations.len(), 1);
+        assert_eq!(citations[0].start_index, 11);
+        assert_eq!(citations[0].end_index, 15);
+    }
+
+    #[test]
+    fn test_stream_document_selections() {
+        let write = |options: FilterOptions, completion: &str| {
+            let mut filter = new_filter(options);
+            let mut out = Vec::new();
+            for c in completion.chars() {
+                out.extend(filter.write_decoded(&c.to_string(), TokenIDsWithLogProb::new()));
+            }
+            out.extend(filter.flush_partials());
+            out
+        };
+
+        // A line ends at a newline or the next special token
+        let completion = "Relevant Documents: 2, 5\nCited Documents: 5 Grounded answer: hi";
+        let out = write(FilterOptions::new().handle_multi_hop(), completion);
+        assert!(out.iter().all(|o| o.relevant_doc_indices.is_none()));
+        let out = write(
+            FilterOptions::new()
+                .handle_multi_hop()
+                .stream_document_selections(),
+            completion,
+        );
+        assert_eq!(out[0].relevant_doc_indices, Some(vec![2, 5]));
+        assert_eq!(out[1].cited_doc_indices, Some(vec![5]));
+        let text: String = out.iter().map(|o| o.text.as_str()).collect();
+        assert_eq!(text, " hi");
+
+        // The last line ends at the flush
+        let out = write(
+            FilterOptions::new()
+                .handle_multi_hop()
+                .stream_document_selections(),
+            "Cited Documents: None",
+        );
+        assert_eq!(out.len(), 1);
+        assert_eq!(out[0].cited_doc_indices, Some(vec![]));
+    }
+
+    #[test]
+    fn test_finish_reason_disabled() {
+        let mut filter = new_filter(FilterOptions::new());
+        let mut out = filter.write_decoded("foo", TokenIDsWithLogProb::new());
+        out.extend(filter.flush_partials());
+        assert!(out.iter().all(|o| o.finish.is_none()));
+    }
+
+    #[test]
+    fn test_healed_prefix() {
+        let options = FilterOptions::new()
+            .cmd3()
+            .with_response_prefix("The weath")
+            .with_healed_prefix("weath");
+        for (chunks, want) in [
+            (vec!["weather", " is sunny"], "er is sunny"),
+            (vec!["we", "ath", "er is sunny"], "er is sunny"),
+            (vec!["er is sunny"], "er is sunny"),
+            (vec!["we", "t"], "wet"),
+        ] {
+            let mut filter = new_filter(options.clone());
+            let mut text = String::new();
+            for chunk in &chunks {
+                for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                    text.push_str(&o.text);
+                }
+            }
+            assert_eq!(text, want, "{chunks:?}");
+        }
+    }
+
+    #[test]
+    fn test_write_token() {
+        // The emoji is split over two tokens
+        let vocab: [&[u8]; 4] = [b"<|START_RESPONSE|>", b"Hi", b"\xF0\x9F", b"\x91\x8B"];
+        let decode = |ids: &[u32]| -> Result<String, String> {
+            let mut bytes = Vec::new();
+            for &id in ids {
+                bytes.extend(
+                    *vocab
+                        .get(id as usize)
+                        .ok_or(format!("unknown token {id}"))?,
+                );
+            }
+            Ok(String::from_utf8_lossy(&bytes).into_owned())
+        };
+
+        let mut filter = new_filter(FilterOptions::new().cmd3());
+        let mut out = Vec::new();
+        for (id, logprob) in [(0, -0.1), (1, -0.2), (2, -0.3), (3, -0.4)] {
+            out.extend(filter.write_token(id, Some(logprob), decode).unwrap());
+        }
+        assert_eq!(out.len(), 2);
+        assert_eq!(out[0].text, "Hi");
+        assert_eq!(out[1].text, "👋");
+        assert_eq!(out[1].logprobs.token_ids, vec![2, 3]);
+        assert_eq!(out[1].logprobs.logprobs, vec![-0.3, -0.4]);
+
+        // A token that fails to decode is discarded
+        assert!(filter.write_token(4, None, decode).is_err());
+        assert!(filter.write_token(2, None, decode).unwrap().is_empty());
+        let out = filter.flush_tokens(decode).unwrap();
+        assert_eq!(out[0].text, "\u{FFFD}");
+        assert!(out[0].logprobs.token_ids.is_empty());
+    }
 
     #[test]
     fn test_find_partial() {
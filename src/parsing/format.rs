@@ -0,0 +1,347 @@
+//! Machine-readable descriptions of the output formats of the filter presets
+//!
+//! The presets of `FilterOptions`, e.g. `cmd3`, set the default mode and special tokens
+//! of their descriptor, so the description of a format is what the filter parses.
+
+use crate::errors::MelodyError;
+use crate::parsing::types::FilterMode;
+use serde::{Serialize, Serializer};
+
+/// The grammar of an output format: its special tokens, the sections they delimit, and
+/// the syntax of its citations and tool calls.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct FormatDescriptor {
+    /// Name of the format, as given to `describe_format`
+    pub name: &'static str,
+    /// What the output of the format is
+    pub summary: &'static str,
+    /// Mode of the text before the first special token
+    #[serde(serialize_with = "serialize_mode")]
+    pub default_mode: FilterMode,
+    /// Special tokens of the format, each switching the filter to a mode
+    pub special_tokens: &'static [FormatToken],
+    /// Sections of the output, one per mode a special token switches to
+    pub sections: &'static [FormatSection],
+    /// Syntax of the citations of the answer, if it has any
+    pub citation_syntax: Option<&'static str>,
+    /// JSON shape of the tool calls of an action section, if it has any
+    pub tool_call_shape: Option<&'static str>,
+}
+
+/// A special token of a format and the mode it switches the filter to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct FormatToken {
+    /// Text of the token, matched in the decoded output
+    pub token: &'static str,
+    /// Mode of the text after the token
+    #[serde(serialize_with = "serialize_mode")]
+    pub mode: FilterMode,
+}
+
+/// The text of a format parsed in a mode.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct FormatSection {
+    /// Mode the text of the section is parsed in
+    #[serde(serialize_with = "serialize_mode")]
+    pub mode: FilterMode,
+    /// What the text of the section is and how it is emitted
+    pub description: &'static str,
+}
+
+const fn token(token: &'static str, mode: FilterMode) -> FormatToken {
+    FormatToken { token, mode }
+}
+
+const fn section(mode: FilterMode, description: &'static str) -> FormatSection {
+    FormatSection { mode, description }
+}
+
+const CMD_CITATIONS: &str = "<co>cited text</co: tool_call_index:[result_index,...],...>";
+const CMD_TOOL_CALLS: &str =
+    r#"[{"tool_call_id": "0", "tool_name": "name", "parameters": {...}}, ...]"#;
+
+const CMD_SECTIONS: &[FormatSection] = &[
+    section(
+        FilterMode::GroundedAnswer,
+        "The response, with citations of tool results",
+    ),
+    section(
+        FilterMode::ToolReason,
+        "A thinking block, emitted as reasoning with its own citations",
+    ),
+    section(
+        FilterMode::ToolAction,
+        "A JSON array of tool calls, streamed as tool call deltas",
+    ),
+    section(FilterMode::Ignore, "Text after the end of a section"),
+];
+
+pub(crate) const CMD3: FormatDescriptor = FormatDescriptor {
+    name: "cmd3",
+    summary: "Command 3 output, delimited by special tokens",
+    default_mode: FilterMode::GroundedAnswer,
+    special_tokens: &[
+        token("<|START_RESPONSE|>", FilterMode::GroundedAnswer),
+        token("<|END_RESPONSE|>", FilterMode::Ignore),
+        token("<|START_THINKING|>", FilterMode::ToolReason),
+        token("<|END_THINKING|>", FilterMode::GroundedAnswer),
+        token("<|START_ACTION|>", FilterMode::ToolAction),
+        token("<|END_ACTION|>", FilterMode::Ignore),
+    ],
+    sections: CMD_SECTIONS,
+    citation_syntax: Some(CMD_CITATIONS),
+    tool_call_shape: Some(CMD_TOOL_CALLS),
+};
+
+pub(crate) const CMD4: FormatDescriptor = FormatDescriptor {
+    name: "cmd4",
+    summary: "Command 4 output, Command 3 with the response delimited by text tokens",
+    default_mode: FilterMode::GroundedAnswer,
+    special_tokens: &[
+        token("<|START_TEXT|>", FilterMode::GroundedAnswer),
+        token("<|END_TEXT|>", FilterMode::Ignore),
+        token("<|START_THINKING|>", FilterMode::ToolReason),
+        token("<|END_THINKING|>", FilterMode::GroundedAnswer),
+        token("<|START_ACTION|>", FilterMode::ToolAction),
+        token("<|END_ACTION|>", FilterMode::Ignore),
+    ],
+    sections: CMD_SECTIONS,
+    citation_syntax: Some(CMD_CITATIONS),
+    tool_call_shape: Some(CMD_TOOL_CALLS),
+};
+
+const MARKER_CITATIONS: &str = "<co: result_index,...>cited text</co: result_index,...>";
+
+pub(crate) const RAG: FormatDescriptor = FormatDescriptor {
+    name: "rag",
+    summary: "Retrieval augmented answers after text markers, the text before them ignored",
+    default_mode: FilterMode::Ignore,
+    special_tokens: &[
+        token("Grounded answer:", FilterMode::GroundedAnswer),
+        token("Answer:", FilterMode::Answer),
+    ],
+    sections: &[
+        section(
+            FilterMode::GroundedAnswer,
+            "The grounded answer, with citations of documents",
+        ),
+        section(
+            FilterMode::Answer,
+            "The answer without citations, emitted with stream_non_grounded_answer",
+        ),
+    ],
+    citation_syntax: Some(MARKER_CITATIONS),
+    tool_call_shape: None,
+};
+
+pub(crate) const SEARCH_QUERY: FormatDescriptor = FormatDescriptor {
+    name: "search_query",
+    summary: "Search queries after a text marker, one per line or separated by ||| outside of quotes",
+    default_mode: FilterMode::Ignore,
+    special_tokens: &[
+        token("Search:", FilterMode::SearchQuery),
+        token("|||", FilterMode::NextSearchQuery),
+        token("\n", FilterMode::NextSearchQuery),
+    ],
+    sections: &[
+        section(FilterMode::SearchQuery, "A search query"),
+        section(
+            FilterMode::NextSearchQuery,
+            "The start of the next search query",
+        ),
+    ],
+    citation_syntax: None,
+    tool_call_shape: None,
+};
+
+pub(crate) const MULTI_HOP: FormatDescriptor = FormatDescriptor {
+    name: "multi_hop",
+    summary: "Multi-hop reasoning, tool calls and answers after text markers",
+    default_mode: FilterMode::Ignore,
+    special_tokens: &[
+        token("Grounded answer:", FilterMode::GroundedAnswer),
+        token("Answer:", FilterMode::Answer),
+        token("Plan:", FilterMode::ToolReason),
+        token("Reflection:", FilterMode::ToolReason),
+        token("Action:", FilterMode::ToolAction),
+        token("Relevant Documents:", FilterMode::Ignore),
+        token("Cited Documents:", FilterMode::Ignore),
+    ],
+    sections: &[
+        section(
+            FilterMode::GroundedAnswer,
+            "The grounded answer, with citations of documents",
+        ),
+        section(
+            FilterMode::Answer,
+            "The answer without citations, emitted with stream_non_grounded_answer",
+        ),
+        section(
+            FilterMode::ToolReason,
+            "A plan or reflection, emitted as reasoning",
+        ),
+        section(
+            FilterMode::ToolAction,
+            "A JSON array of tool calls, streamed as tool call deltas",
+        ),
+        section(
+            FilterMode::Ignore,
+            "Document selection lines, emitted with stream_document_selections",
+        ),
+    ],
+    citation_syntax: Some(MARKER_CITATIONS),
+    tool_call_shape: Some(r#"[{"tool_name": "name", "parameters": {...}}, ...]"#),
+};
+
+pub(crate) const LLAMA3_CHAT: FormatDescriptor = FormatDescriptor {
+    name: "llama3_chat",
+    summary: "Llama 3.x chat turns delimited by header tokens, with Python tag tool calls",
+    default_mode: FilterMode::PlainText,
+    special_tokens: &[
+        token(
+            "<|start_header_id|>assistant<|end_header_id|>\n\n",
+            FilterMode::PlainText,
+        ),
+        token(
+            "<|start_header_id|>ipython<|end_header_id|>",
+            FilterMode::Ignore,
+        ),
+        token("<|python_tag|>", FilterMode::ToolAction),
+        token("<|eom_id|>", FilterMode::Ignore),
+        token("<|eot_id|>", FilterMode::Ignore),
+    ],
+    sections: &[
+        section(FilterMode::PlainText, "The text of an assistant turn"),
+        section(
+            FilterMode::ToolAction,
+            "Tool calls separated by ;, streamed as tool call deltas",
+        ),
+        section(
+            FilterMode::Ignore,
+            "Tool results echoed by the model and the text after the end of a turn",
+        ),
+    ],
+    citation_syntax: None,
+    tool_call_shape: Some(r#"{"name": "name", "parameters": {...}}; ..."#),
+};
+
+/// The descriptors of the built-in formats.
+const FORMATS: &[&FormatDescriptor] =
+    &[&CMD3, &CMD4, &RAG, &SEARCH_QUERY, &MULTI_HOP, &LLAMA3_CHAT];
+
+/// Returns the descriptor of a built-in format by name, e.g. `"cmd3"`, for tooling that
+/// documents what the filter parses.
+///
+/// # Errors
+///
+/// Returns `MelodyError::UnknownFormat` if no built-in format has the name.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::describe_format;
+/// use cohere_melody::parsing::types::FilterMode;
+///
+/// let cmd3 = describe_format("cmd3").unwrap();
+/// assert_eq!(cmd3.default_mode, FilterMode::GroundedAnswer);
+/// assert!(cmd3.special_tokens.iter().any(|t| t.token == "<|START_ACTION|>"));
+/// ```
+pub fn describe_format(name: &str) -> Result<&'static FormatDescriptor, MelodyError> {
+    FORMATS
+        .iter()
+        .copied()
+        .find(|f| f.name == name)
+        .ok_or_else(|| MelodyError::UnknownFormat(name.to_string()))
+}
+
+/// Returns the names of the built-in formats.
+#[must_use]
+pub fn format_names() -> Vec<&'static str> {
+    FORMATS.iter().map(|f| f.name).collect()
+}
+
+/// Returns the name of a mode in format descriptors, e.g. `"grounded_answer"`.
+#[must_use]
+pub fn mode_name(mode: FilterMode) -> &'static str {
+    match mode {
+        FilterMode::PlainText => "plain_text",
+        FilterMode::Ignore => "ignore",
+        FilterMode::ToolAction => "tool_action",
+        FilterMode::ToolReason => "tool_reason",
+        FilterMode::Answer => "answer",
+        FilterMode::GroundedAnswer => "grounded_answer",
+        FilterMode::InclusiveStop => "inclusive_stop",
+        FilterMode::ExclusiveStop => "exclusive_stop",
+        FilterMode::SearchQuery => "search_query",
+        FilterMode::NextSearchQuery => "next_search_query",
+    }
+}
+
+#[allow(clippy::trivially_copy_pass_by_ref)]
+fn serialize_mode<S: Serializer>(mode: &FilterMode, s: S) -> Result<S::Ok, S::Error> {
+    s.serialize_str(mode_name(*mode))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::parsing::options::FilterOptions;
+
+    #[test]
+    fn test_describe_format() {
+        let cmd4 = describe_format("cmd4").unwrap();
+        let json = serde_json::to_value(cmd4).unwrap();
+        assert_eq!(json["default_mode"], "grounded_answer");
+        assert_eq!(json["special_tokens"][0]["token"], "<|START_TEXT|>");
+        assert_eq!(json["special_tokens"][0]["mode"], "grounded_answer");
+        assert_eq!(json["sections"][2]["mode"], "tool_action");
+        assert!(
+            json["citation_syntax"]
+                .as_str()
+                .unwrap()
+                .starts_with("<co>")
+        );
+
+        assert!(matches!(
+            describe_format("cmd5"),
+            Err(MelodyError::UnknownFormat(name)) if name == "cmd5"
+        ));
+        assert_eq!(format_names().len(), 6);
+    }
+
+    #[test]
+    fn test_presets_match_descriptors() {
+        let presets = [
+            ("cmd3", FilterOptions::new().cmd3()),
+            ("cmd4", FilterOptions::new().cmd4()),
+            ("rag", FilterOptions::new().handle_rag()),
+            ("search_query", FilterOptions::new().handle_search_query()),
+            ("multi_hop", FilterOptions::new().handle_multi_hop()),
+            ("llama3_chat", FilterOptions::new().handle_llama3_chat()),
+        ];
+        for (name, options) in presets {
+            let format = describe_format(name).unwrap();
+            assert_eq!(options.default_mode, format.default_mode, "{name}");
+            assert_eq!(
+                options.special_token_map.len(),
+                format.special_tokens.len(),
+                "{name}"
+            );
+            for t in format.special_tokens {
+                assert_eq!(
+                    options.special_token_map.get(t.token),
+                    Some(&t.mode),
+                    "{name}"
+                );
+            }
+            // Every mode a special token switches to is a section
+            for t in format.special_tokens {
+                assert!(
+                    format.sections.iter().any(|s| s.mode == t.mode),
+                    "{name} {}",
+                    t.token
+                );
+            }
+        }
+    }
+}
@@ -0,0 +1,184 @@
+//! Language-neutral JSON encoding of filter configuration and outputs
+//!
+//! This is the protocol used where filters are driven through JSON rather than typed
+//! bindings, e.g. the WASM module and the shared conformance corpus in
+//! `gobindings/conformance/testdata`. Outputs are encoded like `conformance.Output` in the Go
+//! bindings so the two stay interchangeable.
+
+use crate::errors::MelodyError;
+use crate::parsing::options::FilterOptions;
+use crate::parsing::types::FilterOutput;
+use serde::Deserialize;
+use serde_json::{Map, Value, json};
+
+/// Filter configuration given as the names of the options to apply.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::json::FilterConfig;
+///
+/// let config: FilterConfig = serde_json::from_str(r#"{"options": ["cmd3"]}"#).unwrap();
+/// let options = config.options().unwrap();
+/// ```
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct FilterConfig {
+    /// Names of the options to apply in order, e.g. `"cmd3"` or `"stream_tool_actions"`
+    #[serde(default)]
+    pub options: Vec<String>,
+    /// Stop sequences included in the output
+    #[serde(default)]
+    pub inclusive_stops: Vec<String>,
+    /// Stop sequences excluded from the output
+    #[serde(default)]
+    pub exclusive_stops: Vec<String>,
+    /// Text dropped from the start of the completion, see `FilterOptions::with_prefix_trim`
+    #[serde(default)]
+    pub prefix_trim: String,
+}
+
+impl FilterConfig {
+    /// Builds the filter options of the configuration.
+    ///
+    /// # Errors
+    ///
+    /// Returns `MelodyError::UnknownFilterOption` if an option name is not recognized.
+    pub fn options(&self) -> Result<FilterOptions, MelodyError> {
+        let mut options = FilterOptions::new();
+        for name in &self.options {
+            options = match name.as_str() {
+                "cmd3" => options.cmd3(),
+                "cmd4" => options.cmd4(),
+                "rag" => options.handle_rag(),
+                "search_query" => options.handle_search_query(),
+                "multi_hop" => options.handle_multi_hop(),
+                "llama3_chat" => options.handle_llama3_chat(),
+                "stream_tool_actions" => options.stream_tool_actions(),
+                "stream_non_grounded_answer" => options.stream_non_grounded_answer(),
+                "stream_processed_params" => options.stream_processed_params(),
+                "stream_document_selections" => options.stream_document_selections(),
+                "citation_merging" => options.with_citation_merging(),
+                "left_trimmed" => options.with_left_trimmed(),
+                "right_trimmed" => options.with_right_trimmed(),
+                _ => return Err(MelodyError::UnknownFilterOption(name.clone())),
+            };
+        }
+        if !self.inclusive_stops.is_empty() {
+            options = options.with_inclusive_stops(self.inclusive_stops.clone());
+        }
+        if !self.exclusive_stops.is_empty() {
+            options = options.with_exclusive_stops(self.exclusive_stops.clone());
+        }
+        if !self.prefix_trim.is_empty() {
+            options = options.with_prefix_trim(self.prefix_trim.clone());
+        }
+        Ok(options)
+    }
+}
+
+/// Encodes a filter output as a JSON object, leaving out empty fields.
+///
+/// Logprobs are not encoded.
+#[must_use]
+pub fn output_to_json(o: &FilterOutput) -> Value {
+    let mut out = Map::new();
+    if !o.text.is_empty() {
+        out.insert("text".to_string(), json!(o.text));
+    }
+    if let Some(sq) = &o.search_query {
+        out.insert(
+            "search_query".to_string(),
+            json!({"index": sq.index, "text": sq.text}),
+        );
+    }
+    if !o.citations.is_empty() {
+        let cits: Vec<Value> = o
+            .citations
+            .iter()
+            .map(|c| {
+                let sources: Vec<Value> = c
+                    .sources
+                    .iter()
+                    .map(|s| {
+                        let mut source = json!({
+                            "tool_call_index": s.tool_call_index,
+                            "tool_result_indices": s.tool_result_indices,
+                        });
+                        if let Some(name) = &s.source_name {
+                            source["source_name"] = json!(name);
+                        }
+                        source
+                    })
+                    .collect();
+                json!({
+                    "start_index": c.start_index,
+                    "end_index": c.end_index,
+                    "text": c.text,
+                    "sources": sources,
+                    "is_thinking": c.is_thinking,
+                })
+            })
+            .collect();
+        out.insert("citations".to_string(), Value::Array(cits));
+    }
+    if let Some(tc) = &o.tool_call_delta {
+        let mut delta = json!({
+            "index": tc.index,
+            "id": tc.id,
+            "name": tc.name,
+            "raw_param_delta": tc.raw_param_delta,
+        });
+        if let Some(p) = &tc.param_delta {
+            delta["param_delta"] = json!({"name": p.name, "value_delta": p.value_delta});
+        }
+        out.insert("tool_call_delta".to_string(), delta);
+    }
+    if o.is_post_answer {
+        out.insert("is_post_answer".to_string(), json!(true));
+    }
+    if o.is_reasoning {
+        out.insert("is_reasoning".to_string(), json!(true));
+    }
+    if o.plan_index > 0 {
+        out.insert("plan_index".to_string(), json!(o.plan_index));
+    }
+    if let Some(indices) = &o.relevant_doc_indices {
+        out.insert("relevant_doc_indices".to_string(), json!(indices));
+    }
+    if let Some(indices) = &o.cited_doc_indices {
+        out.insert("cited_doc_indices".to_string(), json!(indices));
+    }
+    Value::Object(out)
+}
+
+/// Encodes filter outputs as a JSON array string.
+#[must_use]
+pub fn outputs_to_json(outputs: &[FilterOutput]) -> String {
+    Value::Array(outputs.iter().map(output_to_json).collect()).to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_unknown_filter_option() {
+        let config: FilterConfig = serde_json::from_str(r#"{"options": ["cmd5"]}"#).unwrap();
+        assert!(matches!(
+            config.options(),
+            Err(MelodyError::UnknownFilterOption(name)) if name == "cmd5"
+        ));
+    }
+
+    #[test]
+    fn test_prefix_trim_config() {
+        use crate::parsing::{Filter, new_filter};
+
+        let config: FilterConfig = serde_json::from_str(r#"{"prefix_trim": "A: "}"#).unwrap();
+        let mut filter = new_filter(config.options().unwrap());
+        let mut out = filter.write_decoded("A", Default::default());
+        out.extend(filter.write_decoded(": hi", Default::default()));
+        let text: String = out.iter().map(|o| o.text.as_str()).collect();
+        assert_eq!(text, "hi");
+    }
+}
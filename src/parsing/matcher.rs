@@ -0,0 +1,229 @@
+//! Aho-Corasick matching of special tokens and stop sequences.
+//!
+//! The filter looks for its special tokens in the buffer on every write, including the
+//! ones the buffer may end in the middle of. Matching them one at a time is linear in the
+//! number of tokens, which dominates with many stop sequences, so the tokens are compiled
+//! once per filter into an automaton that finds both in a single pass over the buffer.
+
+use crate::parsing::filter::find_partial;
+use std::collections::VecDeque;
+
+const ROOT: usize = 0;
+
+#[derive(Debug, Clone, Default)]
+struct Node {
+    // Transitions sorted by byte
+    next: Vec<(u8, usize)>,
+    // Node of the longest proper suffix of this node that is in the trie
+    fail: usize,
+    // Length of the prefix this node stands for
+    depth: usize,
+    // Index of the sequence ending at this node
+    output: Option<usize>,
+    // Nearest node along the fail links with an output
+    dict: Option<usize>,
+}
+
+impl Node {
+    fn child(&self, b: u8) -> Option<usize> {
+        self.next
+            .binary_search_by_key(&b, |&(k, _)| k)
+            .ok()
+            .map(|i| self.next[i].1)
+    }
+}
+
+/// Finds a set of sequences in a string, like `find_partial` but in a single pass
+/// regardless of the number of sequences.
+#[derive(Debug, Clone)]
+pub(crate) struct SequenceMatcher {
+    nodes: Vec<Node>,
+    sequences: Vec<String>,
+    // Whether the sequences are matched one at a time with find_partial instead
+    linear: bool,
+}
+
+impl Default for SequenceMatcher {
+    fn default() -> Self {
+        Self::new(std::iter::empty::<&String>())
+    }
+}
+
+impl SequenceMatcher {
+    /// Builds the automaton of the sequences, empty sequences are ignored.
+    pub(crate) fn new<'a>(sequences: impl Iterator<Item = &'a String>) -> Self {
+        let mut m = SequenceMatcher {
+            nodes: vec![Node::default()],
+            sequences: Vec::new(),
+            linear: false,
+        };
+        for seq in sequences {
+            if !seq.is_empty() {
+                m.insert(seq);
+            }
+        }
+        m.link();
+        m
+    }
+
+    /// Sets whether the sequences are matched one at a time with `find_partial`, to
+    /// benchmark the automaton against it.
+    pub(crate) fn linear(mut self, linear: bool) -> Self {
+        self.linear = linear;
+        self
+    }
+
+    fn insert(&mut self, seq: &str) {
+        let mut cur = ROOT;
+        for &b in seq.as_bytes() {
+            cur = match self.nodes[cur].next.binary_search_by_key(&b, |&(k, _)| k) {
+                Ok(i) => self.nodes[cur].next[i].1,
+                Err(i) => {
+                    let node = self.nodes.len();
+                    self.nodes.push(Node {
+                        depth: self.nodes[cur].depth + 1,
+                        ..Default::default()
+                    });
+                    self.nodes[cur].next.insert(i, (b, node));
+                    node
+                }
+            };
+        }
+        if self.nodes[cur].output.is_none() {
+            self.nodes[cur].output = Some(self.sequences.len());
+            self.sequences.push(seq.to_string());
+        }
+    }
+
+    /// Sets the fail and dictionary links breadth first, so the links of shallower nodes
+    /// are set before they are followed.
+    fn link(&mut self) {
+        let mut queue: VecDeque<usize> = self.nodes[ROOT].next.iter().map(|&(_, n)| n).collect();
+        while let Some(cur) = queue.pop_front() {
+            for i in 0..self.nodes[cur].next.len() {
+                let (b, child) = self.nodes[cur].next[i];
+                let fail = if cur == ROOT {
+                    ROOT
+                } else {
+                    self.transition(self.nodes[cur].fail, b)
+                };
+                self.nodes[child].fail = fail;
+                self.nodes[child].dict = if self.nodes[fail].output.is_some() {
+                    Some(fail)
+                } else {
+                    self.nodes[fail].dict
+                };
+                queue.push_back(child);
+            }
+        }
+    }
+
+    fn transition(&self, mut state: usize, b: u8) -> usize {
+        loop {
+            if let Some(next) = self.nodes[state].child(b) {
+                return next;
+            }
+            if state == ROOT {
+                return ROOT;
+            }
+            state = self.nodes[state].fail;
+        }
+    }
+
+    /// Returns the index and the sequence of the leftmost, then longest, whole sequence in
+    /// `s`. Without one, returns the index of the longest suffix of `s` that starts a
+    /// sequence with an empty string, or `usize::MAX` if there is none.
+    pub(crate) fn find(&self, s: &str) -> (usize, String) {
+        if self.linear {
+            return find_partial(s, self.sequences.iter());
+        }
+        let mut state = ROOT;
+        // Start and sequence of the best whole match so far
+        let mut best: Option<(usize, usize)> = None;
+        for (i, &b) in s.as_bytes().iter().enumerate() {
+            state = self.transition(state, b);
+            let end = i + 1;
+            if let Some((start, _)) = best {
+                // No match in progress can start before the best one
+                if end - self.nodes[state].depth > start {
+                    break;
+                }
+            }
+            let mut node = if self.nodes[state].output.is_some() {
+                Some(state)
+            } else {
+                self.nodes[state].dict
+            };
+            while let Some(n) = node {
+                let seq = self.nodes[n].output.unwrap_or_default();
+                let start = end - self.nodes[n].depth;
+                let better = match best {
+                    None => true,
+                    Some((best_start, best_seq)) => {
+                        start < best_start
+                            || (start == best_start
+                                && self.sequences[seq].len() > self.sequences[best_seq].len())
+                    }
+                };
+                if better {
+                    best = Some((start, seq));
+                }
+                node = self.nodes[n].dict;
+            }
+        }
+
+        if let Some((start, seq)) = best {
+            return (start, self.sequences[seq].clone());
+        }
+        if state == ROOT {
+            (usize::MAX, String::new())
+        } else {
+            (s.len() - self.nodes[state].depth, String::new())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn strings(seqs: &[&str]) -> Vec<String> {
+        seqs.iter().map(ToString::to_string).collect()
+    }
+
+    #[test]
+    fn test_sequence_matcher() {
+        let seqs = strings(&["<co: ", "</co>", "<|END_RESPONSE|>", "Answer:", "Ans"]);
+        let m = SequenceMatcher::new(seqs.iter());
+
+        assert_eq!(m.find("hello <co: 1"), (6, "<co: ".to_string()));
+        assert_eq!(m.find("hello <c"), (6, String::new()));
+        assert_eq!(m.find("hello world"), (usize::MAX, String::new()));
+        assert_eq!(m.find("An"), (0, String::new()));
+        // The leftmost match wins, then the longest at the same index
+        assert_eq!(m.find("a </co><co: "), (2, "</co>".to_string()));
+        assert_eq!(m.find("Answer: yes"), (0, "Answer:".to_string()));
+        assert_eq!(m.find("Ansbar"), (0, "Ans".to_string()));
+        assert_eq!(m.find("ÈÈ<|END_"), (4, String::new()));
+    }
+
+    #[test]
+    fn test_sequence_matcher_matches_find_partial() {
+        let seqs = strings(&["<|START_ACTION|>", "<|END_ACTION|>", "STOP", "ÈR", "\n\n"]);
+        let m = SequenceMatcher::new(seqs.iter());
+        for s in [
+            "",
+            "text",
+            "text <|START_",
+            "text <|END_ACTION|> more",
+            "ÈÈÈÈÈÈÈ",
+            "ÈÈÈÈÈÈÈR",
+            "a\n",
+            "ST",
+            "<|START_ACTION|",
+        ] {
+            assert_eq!(m.find(s), find_partial(s, seqs.iter()), "{s:?}");
+            assert_eq!(m.clone().linear(true).find(s), m.find(s), "{s:?}");
+        }
+    }
+}
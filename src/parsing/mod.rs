@@ -6,11 +6,26 @@
 mod action_filter;
 mod citations_filter;
 mod filter;
+mod format;
+mod matcher;
+mod normalize;
 mod options;
 mod param_filter;
+mod resume;
+mod safe_filter;
+mod soft_stop;
+mod state;
+
+/// Language-neutral JSON encoding of filter configuration and outputs.
+pub mod json;
 
 /// Type definitions for filter outputs, citations, and tool calls.
 pub mod types;
 
 pub use filter::*;
+pub use format::{
+    FormatDescriptor, FormatSection, FormatToken, describe_format, format_names, mode_name,
+};
 pub use options::*;
+pub use safe_filter::{SafeFilter, new_safe_filter, new_safe_filter_with_state};
+pub use state::{FILTER_STATE_VERSION, FilterState, restore_filter};
@@ -0,0 +1,189 @@
+//! Unicode normalization of the emitted text
+//!
+//! The text is normalized before its citations are parsed, so citation indices count the
+//! normalized text. The part of a chunk held back for a partial citation is mapped back
+//! to the decoded text it came from, which stays buffered. The last starter of the text
+//! and the combining marks after it are held back too, until the next starter, as marks
+//! decoded in the next token may compose with it.
+
+use crate::parsing::types::UnicodeNormalization;
+use std::borrow::Cow;
+use unicode_normalization::UnicodeNormalization as _;
+use unicode_normalization::char::canonical_combining_class;
+use unicode_normalization::{is_nfc, is_nfkc};
+
+impl UnicodeNormalization {
+    /// Returns `s` in the normalization form, borrowed if it already is.
+    pub(crate) fn apply(self, s: &str) -> Cow<'_, str> {
+        match self {
+            Self::Nfc if !is_nfc(s) => Cow::Owned(s.nfc().collect()),
+            Self::Nfkc if !is_nfkc(s) => Cow::Owned(s.nfkc().collect()),
+            _ => Cow::Borrowed(s),
+        }
+    }
+
+    /// Returns `s` in the normalization form.
+    pub(crate) fn apply_owned(self, s: String) -> String {
+        match self.apply(&s) {
+            Cow::Owned(normalized) => normalized,
+            Cow::Borrowed(_) => s,
+        }
+    }
+
+    /// Returns the length of the start of `text` to normalize before the text after it is
+    /// decoded: the text before its last starter, whose normalization may change with the
+    /// combining marks of the next token. An incomplete UTF-8 sequence at the end of `text`
+    /// comes after the last starter.
+    pub(crate) fn stable_len(self, text: &[u8]) -> usize {
+        if self == Self::None {
+            return text.len();
+        }
+        let valid = match std::str::from_utf8(text) {
+            Ok(valid) => valid,
+            Err(e) => std::str::from_utf8(&text[..e.valid_up_to()]).unwrap_or_default(),
+        };
+        valid
+            .char_indices()
+            .rev()
+            .find(|&(_, c)| canonical_combining_class(c) == 0)
+            .map_or(0, |(i, _)| i)
+    }
+
+    /// Returns the length of the start of `raw` that normalizes to the first
+    /// `normalized_len` bytes of `normalized`, the normalization of `raw`.
+    pub(crate) fn raw_len(self, raw: &str, normalized: &str, normalized_len: usize) -> usize {
+        if normalized_len == 0 || raw == normalized {
+            return normalized_len;
+        }
+        if normalized_len == normalized.len() {
+            return raw.len();
+        }
+        // Normalization only changes the text after a starter, so the start of the text
+        // ends before one
+        raw.char_indices()
+            .filter(|&(i, c)| i > 0 && canonical_combining_class(c) == 0)
+            .map(|(i, _)| i)
+            .find(|&i| self.apply(&raw[..i]).len() == normalized_len)
+            .unwrap_or_else(|| {
+                // The unnormalized rest is the same as the normalized one
+                let mut len = raw.len().saturating_sub(normalized.len() - normalized_len);
+                while !raw.is_char_boundary(len) {
+                    len -= 1;
+                }
+                len
+            })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::parsing::filter::Filter;
+    use crate::parsing::options::{FilterOptions, new_filter};
+    use crate::parsing::types::{TokenIDsWithLogProb, UnicodeNormalization};
+
+    #[test]
+    fn test_unicode_normalization() {
+        let run = |form, chunks: &[&str]| {
+            let options = FilterOptions::new().cmd3().with_unicode_normalization(form);
+            let mut filter = new_filter(options);
+            let mut out = Vec::new();
+            for chunk in chunks {
+                out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+            }
+            out.extend(filter.flush_partials());
+            let text: String = out.iter().map(|o| o.text.as_str()).collect();
+            let citations: Vec<_> = out
+                .into_iter()
+                .flat_map(|o| o.citations)
+                .map(|c| (c.start_index, c.end_index, c.text))
+                .collect();
+            (text, citations)
+        };
+
+        // The citation indices count the composed text
+        let chunks = [
+            "<|START_RESPONSE|>Cafe\u{301} ",
+            "<co>pin\u{303}a",
+            " cola\u{300}</co: 0:[1]> for \u{fb01}ve",
+        ];
+        assert_eq!(
+            run(UnicodeNormalization::Nfc, &chunks),
+            (
+                "Caf\u{e9} pi\u{f1}a col\u{e0} for \u{fb01}ve".to_string(),
+                vec![(5, 14, "pi\u{f1}a col\u{e0}".to_string())]
+            )
+        );
+        assert_eq!(run(UnicodeNormalization::Nfkc, &chunks[..1]).0, "Caf\u{e9}");
+        assert_eq!(
+            run(
+                UnicodeNormalization::Nfkc,
+                &["<|START_RESPONSE|>\u{fb01}ve"]
+            )
+            .0,
+            "five"
+        );
+        assert_eq!(
+            run(UnicodeNormalization::None, &chunks[..1]).0,
+            "Cafe\u{301}"
+        );
+    }
+
+    #[test]
+    fn test_unicode_normalization_across_tokens() {
+        let options = FilterOptions::new()
+            .cmd3()
+            .with_unicode_normalization(UnicodeNormalization::Nfc);
+        let mut filter = new_filter(options);
+        let mut texts = Vec::new();
+        for chunk in ["<|START_RESPONSE|>Cafe", "\u{301}", " au", " lait"] {
+            let out = filter.write_decoded(chunk, TokenIDsWithLogProb::new());
+            texts.push(out.into_iter().map(|o| o.text).collect::<String>());
+        }
+        texts.push(
+            filter
+                .flush_partials()
+                .into_iter()
+                .map(|o| o.text)
+                .collect(),
+        );
+        // The last starter waits for the marks of the next token
+        assert_eq!(
+            texts,
+            ["Caf", "", "\u{e9} a", "u lai", "t"].map(String::from)
+        );
+
+        // A special token ends the text, its last starter included
+        let options = FilterOptions::new()
+            .cmd3()
+            .with_unicode_normalization(UnicodeNormalization::Nfc);
+        let mut filter = new_filter(options);
+        let mut text = String::new();
+        for chunk in ["<|START_RESPONSE|>Cafe", "\u{301}", "<|END_RESPONSE|>"] {
+            for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                text.push_str(&o.text);
+            }
+        }
+        assert_eq!(text, "Caf\u{e9}");
+    }
+
+    #[test]
+    fn test_stable_len() {
+        let nfc = UnicodeNormalization::Nfc;
+        assert_eq!(nfc.stable_len(b"Cafe"), 3);
+        assert_eq!(nfc.stable_len("Cafe\u{301}".as_bytes()), 3);
+        assert_eq!(nfc.stable_len("\u{301}".as_bytes()), 0);
+        assert_eq!(nfc.stable_len(b"ab\xe2\x82"), 1);
+        assert_eq!(UnicodeNormalization::None.stable_len(b"Cafe"), 4);
+    }
+
+    #[test]
+    fn test_raw_len() {
+        let nfc = UnicodeNormalization::Nfc;
+        let raw = "e\u{301}<co";
+        let normalized = nfc.apply(raw);
+        assert_eq!(normalized, "\u{e9}<co");
+        assert_eq!(nfc.raw_len(raw, &normalized, 0), 0);
+        assert_eq!(nfc.raw_len(raw, &normalized, 2), 3);
+        assert_eq!(nfc.raw_len(raw, &normalized, normalized.len()), raw.len());
+    }
+}
@@ -2,8 +2,13 @@
 //!
 //! This module provides the `FilterOptions` builder for configuring filter behavior.
 
+use crate::fim::FimFamily;
 use crate::parsing::filter::FilterImpl;
-use crate::parsing::types::FilterMode;
+use crate::parsing::format::{self, FormatDescriptor};
+use crate::parsing::types::{
+    CitationIndexUnit, CitationSourceFormat, ConditionalStop, FilterCitation, FilterMode,
+    UnicodeNormalization,
+};
 use std::collections::HashMap;
 
 /// Configuration builder for creating filters.
@@ -31,7 +36,11 @@ pub struct FilterOptions {
     pub(crate) right_trimmed: bool,
     pub(crate) inclusive_stops: Vec<String>,
     pub(crate) exclusive_stops: Vec<String>,
+    pub(crate) conditional_stops: Vec<ConditionalStop>,
     pub(crate) chunk_size: usize,
+    pub(crate) word_boundary_min_chars: Option<usize>,
+    pub(crate) rollback_window: usize,
+    pub(crate) dedup_window: usize,
     pub(crate) special_token_map: HashMap<String, FilterMode>,
     pub(crate) default_mode: FilterMode,
     pub(crate) stream_non_grounded_answer: bool,
@@ -39,6 +48,20 @@ pub struct FilterOptions {
     pub(crate) stream_processed_params: bool,
     pub(crate) has_tool_call_id: bool,
     pub(crate) cmd3_citations: bool,
+    pub(crate) merge_citations: bool,
+    pub(crate) sentence_citations: bool,
+    pub(crate) citation_index_unit: CitationIndexUnit,
+    pub(crate) citation_source_format: CitationSourceFormat,
+    pub(crate) unicode_normalization: UnicodeNormalization,
+    pub(crate) emit_finish: bool,
+    pub(crate) prompt_echo_tokens: usize,
+    pub(crate) response_prefix: String,
+    pub(crate) healed_prefix: String,
+    pub(crate) resume_citations: Option<Vec<FilterCitation>>,
+    pub(crate) llama_tool_calls: bool,
+    pub(crate) stream_document_selections: bool,
+    pub(crate) legacy_search_query_splitting: bool,
+    pub(crate) linear_token_matching: bool,
 }
 
 impl Default for FilterOptions {
@@ -48,7 +71,11 @@ impl Default for FilterOptions {
             right_trimmed: false,
             inclusive_stops: Vec::new(),
             exclusive_stops: Vec::new(),
+            conditional_stops: Vec::new(),
             chunk_size: 1,
+            word_boundary_min_chars: None,
+            rollback_window: 0,
+            dedup_window: 0,
             special_token_map: HashMap::new(),
             default_mode: FilterMode::PlainText,
             stream_non_grounded_answer: false,
@@ -56,6 +83,20 @@ impl Default for FilterOptions {
             stream_processed_params: false,
             has_tool_call_id: false,
             cmd3_citations: false,
+            merge_citations: false,
+            sentence_citations: false,
+            citation_index_unit: CitationIndexUnit::Runes,
+            citation_source_format: CitationSourceFormat::ToolIndex,
+            unicode_normalization: UnicodeNormalization::None,
+            emit_finish: false,
+            prompt_echo_tokens: 0,
+            response_prefix: String::new(),
+            healed_prefix: String::new(),
+            resume_citations: None,
+            llama_tool_calls: false,
+            stream_document_selections: false,
+            legacy_search_query_splitting: false,
+            linear_token_matching: false,
         }
     }
 }
@@ -84,6 +125,18 @@ impl FilterOptions {
 
     // CONFIGURATION FOR BINDINGS
 
+    /// Sets the default mode and special tokens of a built-in format.
+    fn with_format(mut self, format: &FormatDescriptor) -> Self {
+        self.default_mode = format.default_mode;
+        self.special_token_map.extend(
+            format
+                .special_tokens
+                .iter()
+                .map(|t| (t.token.to_string(), t.mode)),
+        );
+        self
+    }
+
     /// Configure for Cohere Command 3 model format.
     ///
     /// Command 3 is a structured output format that uses special tokens to delimit
@@ -111,23 +164,11 @@ impl FilterOptions {
     /// ```
     #[must_use]
     pub fn cmd3(mut self) -> Self {
-        self.default_mode = FilterMode::GroundedAnswer;
+        self = self.with_format(&format::CMD3);
         self.right_trimmed = true;
         self.has_tool_call_id = true;
         self.cmd3_citations = true;
         self.stream_tool_actions = true;
-        self.special_token_map
-            .insert("<|START_RESPONSE|>".to_string(), FilterMode::GroundedAnswer);
-        self.special_token_map
-            .insert("<|END_RESPONSE|>".to_string(), FilterMode::Ignore);
-        self.special_token_map
-            .insert("<|START_THINKING|>".to_string(), FilterMode::ToolReason);
-        self.special_token_map
-            .insert("<|END_THINKING|>".to_string(), FilterMode::GroundedAnswer);
-        self.special_token_map
-            .insert("<|START_ACTION|>".to_string(), FilterMode::ToolAction);
-        self.special_token_map
-            .insert("<|END_ACTION|>".to_string(), FilterMode::Ignore);
         self
     }
 
@@ -149,23 +190,11 @@ impl FilterOptions {
     /// ```
     #[must_use]
     pub fn cmd4(mut self) -> Self {
-        self.default_mode = FilterMode::GroundedAnswer;
+        self = self.with_format(&format::CMD4);
         self.right_trimmed = true;
         self.has_tool_call_id = true;
         self.cmd3_citations = true;
         self.stream_tool_actions = true;
-        self.special_token_map
-            .insert("<|START_TEXT|>".to_string(), FilterMode::GroundedAnswer);
-        self.special_token_map
-            .insert("<|END_TEXT|>".to_string(), FilterMode::Ignore);
-        self.special_token_map
-            .insert("<|START_THINKING|>".to_string(), FilterMode::ToolReason);
-        self.special_token_map
-            .insert("<|END_THINKING|>".to_string(), FilterMode::GroundedAnswer);
-        self.special_token_map
-            .insert("<|START_ACTION|>".to_string(), FilterMode::ToolAction);
-        self.special_token_map
-            .insert("<|END_ACTION|>".to_string(), FilterMode::Ignore);
         self
     }
 
@@ -215,6 +244,33 @@ impl FilterOptions {
         self
     }
 
+    /// Add exclusive stop sequences that only halt parsing in a context.
+    ///
+    /// A conditional stop found outside of its context is parsed as the text around it.
+    /// `StopContext::PlainText` stops only apply in the response text outside of markdown
+    /// code fences, the others anywhere but in tool actions or in the reasoning.
+    ///
+    /// # Arguments
+    ///
+    /// * `stops` - Vector of stop sequences with their contexts
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::FilterOptions;
+    /// use cohere_melody::parsing::types::{ConditionalStop, StopContext};
+    ///
+    /// let options = FilterOptions::new().cmd3().with_conditional_stops(vec![ConditionalStop {
+    ///     stop: "rm -rf".to_string(),
+    ///     context: StopContext::PlainText,
+    /// }]);
+    /// ```
+    #[must_use]
+    pub fn with_conditional_stops(mut self, stops: Vec<ConditionalStop>) -> Self {
+        self.conditional_stops = stops;
+        self
+    }
+
     // INTERNAL USE OPTIONS
 
     /// Enable left trimming of whitespace from outputs.
@@ -274,6 +330,88 @@ impl FilterOptions {
         self
     }
 
+    /// Emit text in chunks that end at word boundaries, e.g. for text-to-speech.
+    ///
+    /// Answer and reasoning text is emitted up to the last whitespace or punctuation
+    /// after at least `min_chars` characters, the rest is held back until the next
+    /// boundary, together with the log probabilities of its tokens. Special tokens and
+    /// stops still flush it immediately. Replaces the chunk size for text, tool actions
+    /// and search queries are still chunked by tokens.
+    ///
+    /// # Arguments
+    ///
+    /// * `min_chars` - Minimum number of characters of a chunk
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::FilterOptions;
+    ///
+    /// let options = FilterOptions::new().cmd3().with_word_boundary_chunking(20);
+    /// ```
+    #[must_use]
+    pub fn with_word_boundary_chunking(mut self, min_chars: usize) -> Self {
+        self.word_boundary_min_chars = Some(min_chars);
+        self
+    }
+
+    /// Keep the state of the filter before each of the last `tokens` tokens, so they
+    /// can be retracted with `rollback`, e.g. when speculative decoding rejects
+    /// accepted tokens.
+    ///
+    /// # Arguments
+    ///
+    /// * `tokens` - Maximum number of tokens that can be rolled back
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    /// use cohere_melody::parsing::types::TokenIDsWithLogProb;
+    ///
+    /// let mut filter = new_filter(FilterOptions::new().with_rollback_window(4));
+    /// filter.write_decoded("Hello", TokenIDsWithLogProb::new());
+    /// filter.write_decoded(" wrld", TokenIDsWithLogProb::new());
+    /// filter.rollback(1).unwrap();
+    /// let out = filter.write_decoded(" world", TokenIDsWithLogProb::new());
+    /// assert_eq!(out[0].text, " world");
+    /// ```
+    #[must_use]
+    pub fn with_rollback_window(mut self, tokens: usize) -> Self {
+        self.rollback_window = tokens;
+        self
+    }
+
+    /// Keep the last `bytes` bytes of the answer text emitted, so an upstream retry that
+    /// replays tokens already sent does not emit them twice: after `resume`, the
+    /// leading answer text is held back until its overlap with the end of the emitted
+    /// text is known, and the overlap and the citations it repeats are dropped. The
+    /// overlap of `with_resume_state` is also searched for in the last `bytes` bytes of
+    /// the prior text rather than the last 256.
+    ///
+    /// # Arguments
+    ///
+    /// * `bytes` - Maximum number of bytes of emitted text a retry may replay
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    /// use cohere_melody::parsing::types::TokenIDsWithLogProb;
+    ///
+    /// let mut filter = new_filter(FilterOptions::new().with_dedup_window(64));
+    /// filter.write_decoded("The sky is", TokenIDsWithLogProb::new());
+    /// filter.resume();
+    /// let mut out = filter.write_decoded(" is blue", TokenIDsWithLogProb::new());
+    /// out.extend(filter.flush_partials());
+    /// assert_eq!(out[0].text, " blue");
+    /// ```
+    #[must_use]
+    pub fn with_dedup_window(mut self, bytes: usize) -> Self {
+        self.dedup_window = bytes;
+        self
+    }
+
     /// Configure for RAG (Retrieval Augmented Generation) format.
     ///
     /// This preset is for older RAG-style outputs that use text markers like
@@ -295,12 +433,8 @@ impl FilterOptions {
     /// ```
     #[must_use]
     pub fn handle_rag(mut self) -> Self {
-        self.default_mode = FilterMode::Ignore;
+        self = self.with_format(&format::RAG);
         self.right_trimmed = true;
-        self.special_token_map
-            .insert("Grounded answer:".to_string(), FilterMode::GroundedAnswer);
-        self.special_token_map
-            .insert("Answer:".to_string(), FilterMode::Answer);
         self
     }
 
@@ -326,14 +460,61 @@ impl FilterOptions {
     /// ```
     #[must_use]
     pub fn handle_search_query(mut self) -> Self {
-        self.default_mode = FilterMode::Ignore;
+        self = self.with_format(&format::SEARCH_QUERY);
         self.right_trimmed = true;
-        self.special_token_map
-            .insert("Search:".to_string(), FilterMode::SearchQuery);
-        self.special_token_map
-            .insert("|||".to_string(), FilterMode::NextSearchQuery);
-        self.special_token_map
-            .insert("\n".to_string(), FilterMode::NextSearchQuery);
+        self
+    }
+
+    /// Split search queries at every separator, as before quoting and escaping were read.
+    ///
+    /// By default a `|||` or a newline inside a double-quoted segment of a search query, or
+    /// after a backslash, does not start the next query, and the query text is emitted
+    /// unescaped: a backslash before `|`, `"`, a newline or another backslash is dropped.
+    /// The quotes are kept, as search engines read them as phrases. With this option every
+    /// separator starts the next query and the text is emitted as written.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let queries = |options: FilterOptions| {
+    ///     let mut filter = new_filter(options);
+    ///     let mut out = Vec::new();
+    ///     for token in ["Search:", " \"a", "|||", "b\"", " c\\", "|||", "d"] {
+    ///         out.extend(filter.write_decoded(token, Default::default()));
+    ///     }
+    ///     out.extend(filter.flush_partials());
+    ///     let mut queries: Vec<String> = Vec::new();
+    ///     for query in out.into_iter().filter_map(|o| o.search_query) {
+    ///         match queries.get_mut(query.index) {
+    ///             Some(text) => text.push_str(&query.text),
+    ///             None => queries.push(query.text),
+    ///         }
+    ///     }
+    ///     queries
+    /// };
+    ///
+    /// let options = FilterOptions::new().handle_search_query();
+    /// assert_eq!(queries(options.clone()), vec!["\"a|||b\" c|||d"]);
+    /// assert_eq!(
+    ///     queries(options.legacy_search_query_splitting()),
+    ///     vec!["\"a", "b\" c\\", "d"]
+    /// );
+    /// ```
+    #[must_use]
+    pub fn legacy_search_query_splitting(mut self) -> Self {
+        self.legacy_search_query_splitting = true;
+        self
+    }
+
+    /// Matches the special tokens and stops one at a time instead of in a single pass.
+    ///
+    /// The output is the same, the option only exists to benchmark the two.
+    #[doc(hidden)]
+    #[must_use]
+    pub fn linear_token_matching(mut self) -> Self {
+        self.linear_token_matching = true;
         self
     }
 
@@ -361,22 +542,65 @@ impl FilterOptions {
     /// ```
     #[must_use]
     pub fn handle_multi_hop(mut self) -> Self {
-        self.default_mode = FilterMode::Ignore;
+        self = self.with_format(&format::MULTI_HOP);
         self.right_trimmed = true;
+        self
+    }
+
+    /// Configure for fill-in-the-middle completions of the given model family.
+    ///
+    /// The completion of a prompt rendered with `render_fim` is the middle text.
+    /// Prefix, suffix and middle sentinels that the model echoes are stripped from
+    /// the output and the end sentinel stops parsing.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{FilterOptions, new_filter};
+    /// use cohere_melody::fim::FimFamily;
+    ///
+    /// let options = FilterOptions::new().handle_fim(FimFamily::Command);
+    /// let mut filter = new_filter(options);
+    /// ```
+    #[must_use]
+    pub fn handle_fim(mut self, family: FimFamily) -> Self {
+        let sentinels = family.sentinels();
+        for token in [sentinels.prefix, sentinels.suffix, sentinels.middle] {
+            self.special_token_map
+                .insert(token.to_string(), FilterMode::PlainText);
+        }
         self.special_token_map
-            .insert("Grounded answer:".to_string(), FilterMode::GroundedAnswer);
-        self.special_token_map
-            .insert("Answer:".to_string(), FilterMode::Answer);
-        self.special_token_map
-            .insert("Plan:".to_string(), FilterMode::ToolReason);
-        self.special_token_map
-            .insert("Reflection:".to_string(), FilterMode::ToolReason);
-        self.special_token_map
-            .insert("Action:".to_string(), FilterMode::ToolAction);
-        self.special_token_map
-            .insert("Relevant Documents:".to_string(), FilterMode::Ignore);
-        self.special_token_map
-            .insert("Cited Documents:".to_string(), FilterMode::Ignore);
+            .insert(sentinels.end.to_string(), FilterMode::ExclusiveStop);
+        self
+    }
+
+    /// Configure for Llama 3.x chat format.
+    ///
+    /// Llama 3 segments the conversation with header tokens and ends every turn
+    /// with `<|eot_id|>`. Tool calls follow `<|python_tag|>` as JSON objects of the
+    /// form `{"name": ..., "parameters": {...}}`, and may be chained with `;`. The
+    /// turn that contains a tool call ends with `<|eom_id|>`.
+    ///
+    /// Enables:
+    /// - Plain text parsing of assistant turns
+    /// - Tool action streaming from `<|python_tag|>` blocks
+    /// - Ignoring `ipython` tool result echoes and content after end of turn
+    /// - Right trimming
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{FilterOptions, new_filter};
+    ///
+    /// let options = FilterOptions::new().handle_llama3_chat();
+    /// let mut filter = new_filter(options);
+    /// ```
+    #[must_use]
+    pub fn handle_llama3_chat(mut self) -> Self {
+        self = self.with_format(&format::LLAMA3_CHAT);
+        self.right_trimmed = true;
+        self.stream_tool_actions = true;
+        self.llama_tool_calls = true;
         self
     }
 
@@ -441,6 +665,360 @@ impl FilterOptions {
         self
     }
 
+    /// Enable merging of adjacent citations.
+    ///
+    /// Models often emit back-to-back citations for neighbouring words that cite
+    /// the same sources. When enabled, adjacent or overlapping citations that share
+    /// the same sources are coalesced into a single citation, and zero-length
+    /// citations are dropped before they are emitted. The last completed citation is
+    /// held back until it can no longer be extended, so it may be emitted with a later
+    /// output or on `flush_partials`.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::FilterOptions;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_citation_merging();
+    /// ```
+    #[must_use]
+    pub fn with_citation_merging(mut self) -> Self {
+        self.merge_citations = true;
+        self
+    }
+
+    /// Align citations to sentence boundaries.
+    ///
+    /// Each citation is expanded to the sentence containing it, or to the sentences
+    /// it spans, using Unicode sentence segmentation, and the citations of a sentence
+    /// are merged into one citing all their sources. A citation is held back until its
+    /// last sentence ends, so it is emitted with a later output or on `flush_partials`.
+    /// It replaces `with_citation_merging`.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::FilterOptions;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_sentence_citations();
+    /// ```
+    #[must_use]
+    pub fn with_sentence_citations(mut self) -> Self {
+        self.sentence_citations = true;
+        self
+    }
+
+    /// Set the unit of citation indices.
+    ///
+    /// Citation `start_index` and `end_index` count Unicode scalar values by
+    /// default. User interfaces may need grapheme clusters, so that combining
+    /// characters and emoji ZWJ sequences count as one character, and JavaScript
+    /// consumers may need UTF-16 code units.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::FilterOptions;
+    /// use cohere_melody::parsing::types::CitationIndexUnit;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_citation_index_unit(CitationIndexUnit::Utf16);
+    /// ```
+    #[must_use]
+    pub fn with_citation_index_unit(mut self, unit: CitationIndexUnit) -> Self {
+        self.citation_index_unit = unit;
+        self
+    }
+
+    /// Set the format of the sources of Command 3 citations.
+    ///
+    /// Newer checkpoints cite sources by tool name, `</co: web_search:[2]>`, instead of
+    /// tool call index. With `CitationSourceFormat::ToolName` the name is set as the
+    /// `source_name` of the sources and their `tool_call_index` is 0, sources keyed by a
+    /// number are still read as tool call indices.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    /// use cohere_melody::parsing::types::CitationSourceFormat;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_citation_source_format(CitationSourceFormat::ToolName);
+    /// let mut filter = new_filter(options);
+    /// let out = filter.write_decoded(
+    ///     "<|START_RESPONSE|><co>Blue</co: web_search:[2]>",
+    ///     Default::default(),
+    /// );
+    /// let citation = out.iter().flat_map(|o| &o.citations).next().unwrap();
+    /// let source = &citation.sources[0];
+    /// assert_eq!(source.source_name.as_deref(), Some("web_search"));
+    /// assert_eq!(source.tool_result_indices, vec![2]);
+    /// ```
+    #[must_use]
+    pub fn with_citation_source_format(mut self, format: CitationSourceFormat) -> Self {
+        self.citation_source_format = format;
+        self
+    }
+
+    /// Set the Unicode normalization form of the emitted text.
+    ///
+    /// Models occasionally emit decomposed sequences, such as "e" followed by a combining
+    /// acute accent, which downstream matchers expecting NFC text miss. The text of the
+    /// outputs, answer and reasoning, is normalized, and citation indices count the
+    /// normalized text. The last character of the text waits for the next token, so a
+    /// combining mark decoded in a later token than its base character is composed with
+    /// it. Tool calls and search queries are not normalized.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    /// use cohere_melody::parsing::types::UnicodeNormalization;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_unicode_normalization(UnicodeNormalization::Nfc);
+    /// let mut filter = new_filter(options);
+    /// let mut text = String::new();
+    /// for token in ["<|START_RESPONSE|>Cafe", "\u{301}", "<|END_RESPONSE|>"] {
+    ///     for o in filter.write_decoded(token, Default::default()) {
+    ///         text.push_str(&o.text);
+    ///     }
+    /// }
+    /// assert_eq!(text, "Caf\u{e9}");
+    /// ```
+    #[must_use]
+    pub fn with_unicode_normalization(mut self, form: UnicodeNormalization) -> Self {
+        self.unicode_normalization = form;
+        self
+    }
+
+    /// Emit a terminal output reporting why the stream ended.
+    ///
+    /// When the filter stops on a stop sequence or special token, or
+    /// `flush_partials` is called, a last `FilterOutput` with only `finish` set is
+    /// emitted with the `FinishReason` and the matched stop sequence.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    /// use cohere_melody::parsing::types::FinishReason;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .with_exclusive_stops(vec!["\n\n".to_string()])
+    ///     .with_finish_reason();
+    /// let mut filter = new_filter(options);
+    /// let out = filter.write_decoded("Hi\n\n", Default::default());
+    /// let finish = out.last().unwrap().finish.as_ref().unwrap();
+    /// assert_eq!(finish.reason, FinishReason::ExclusiveStop);
+    /// ```
+    #[must_use]
+    pub fn with_finish_reason(mut self) -> Self {
+        self.emit_finish = true;
+        self
+    }
+
+    /// Pass the first `prompt_token_count` tokens through as echoed prompt tokens.
+    ///
+    /// When the prompt is streamed back before the completion, its tokens are
+    /// emitted unparsed, with `is_echo` set, and skip stop, citation and action
+    /// handling. Parsing starts with the first token after them. Tokens are counted
+    /// by the token IDs passed with each write, or one per write without IDs.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let options = FilterOptions::new()
+    ///     .with_exclusive_stops(vec!["STOP".to_string()])
+    ///     .with_prompt_echo(1);
+    /// let mut filter = new_filter(options);
+    /// let out = filter.write_decoded("Say STOP", Default::default());
+    /// assert!(out[0].is_echo);
+    /// assert_eq!(out[0].text, "Say STOP");
+    /// ```
+    #[must_use]
+    pub fn with_prompt_echo(mut self, prompt_token_count: usize) -> Self {
+        self.prompt_echo_tokens = prompt_token_count;
+        self
+    }
+
+    /// Emit the document indices of "Relevant Documents:" and "Cited Documents:" lines.
+    ///
+    /// The RAG and multi-hop formats list the documents the model selected before its
+    /// answer. Without this option the lines are ignored, with it each line is emitted as
+    /// an output with `relevant_doc_indices` or `cited_doc_indices` set. A line ends at a
+    /// newline or the next special token, and indices that are not numbers, like "None",
+    /// are skipped. The lines are outside of the answer, so their markers are added as
+    /// special tokens in the ignore mode unless they are already mapped.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let options = FilterOptions::new()
+    ///     .handle_multi_hop()
+    ///     .stream_document_selections();
+    /// let mut filter = new_filter(options);
+    /// let out = filter.write_decoded("Relevant Documents: 0,2\n", Default::default());
+    /// assert_eq!(out[0].relevant_doc_indices, Some(vec![0, 2]));
+    /// ```
+    #[must_use]
+    pub fn stream_document_selections(mut self) -> Self {
+        self.stream_document_selections = true;
+        for token in ["Relevant Documents:", "Cited Documents:"] {
+            self.special_token_map
+                .entry(token.to_string())
+                .or_insert(FilterMode::Ignore);
+        }
+        self
+    }
+
+    /// Continue a response that starts with `prefix`.
+    ///
+    /// When the prompt ends with the beginning of the response, e.g. a response
+    /// prefix rendered after `<|START_RESPONSE|>`, the completion continues it. The
+    /// filter then behaves as if the prefix preceded the completion: citation indices
+    /// count from the start of the prefix, and leading whitespace of the completion is
+    /// kept after a prefix that is not whitespace. The prefix itself is not emitted.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_response_prefix("The weather");
+    /// let mut filter = new_filter(options);
+    /// let out = filter.write_decoded(" is sunny", Default::default());
+    /// assert_eq!(out[0].text, " is sunny");
+    /// ```
+    #[must_use]
+    pub fn with_response_prefix(mut self, prefix: impl Into<String>) -> Self {
+        self.response_prefix = prefix.into();
+        self
+    }
+
+    /// Strip the text a healed response prefix repeats from the start of the completion.
+    ///
+    /// Token healing renders a response prefix without its last token, `healed`, so the
+    /// model is free to pick a token that continues it rather than one that splits a word.
+    /// The completion then starts by repeating `healed`, which was already shown as part
+    /// of the prefix, so it is stripped. Nothing is stripped if the completion does not
+    /// start with it. Combine it with `with_response_prefix` of the whole prefix.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_response_prefix("The weath")
+    ///     .with_healed_prefix("weath");
+    /// let mut filter = new_filter(options);
+    /// let out = filter.write_decoded("weather is sunny", Default::default());
+    /// assert_eq!(out[0].text, "er is sunny");
+    /// ```
+    #[must_use]
+    pub fn with_healed_prefix(mut self, healed: impl Into<String>) -> Self {
+        self.healed_prefix = healed.into();
+        self
+    }
+
+    /// Drop `prefix` from the start of the completion, e.g. a label the model repeats
+    /// from the prompt.
+    ///
+    /// The text is held back while it could be the prefix, and emitted as written once it
+    /// is not. It is stripped like the text of `with_healed_prefix`, which it replaces.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let mut filter = new_filter(FilterOptions::new().with_prefix_trim("Answer: "));
+    /// assert!(filter.write_decoded("Answer", Default::default()).is_empty());
+    /// let out = filter.write_decoded(": yes", Default::default());
+    /// assert_eq!(out[0].text, "yes");
+    /// ```
+    #[must_use]
+    pub fn with_prefix_trim(self, prefix: impl Into<String>) -> Self {
+        self.with_healed_prefix(prefix)
+    }
+
+    /// Resume a truncated response from the text and citations already emitted.
+    ///
+    /// The completion continues `prior_text` as it does a response prefix, so text and
+    /// citation indices count from the start of the prior text. The model may first
+    /// repeat the end of the prior text: that overlap is held back and dropped, as are
+    /// the citations of the completion that repeat one of `prior_citations`.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::{Filter, FilterOptions, new_filter};
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_resume_state("The sky is", Vec::new());
+    /// let mut filter = new_filter(options);
+    /// let mut out = filter.write_decoded(" is blue", Default::default());
+    /// out.extend(filter.flush_partials());
+    /// assert_eq!(out[0].text, " blue");
+    /// ```
+    #[must_use]
+    pub fn with_resume_state(
+        mut self,
+        prior_text: impl Into<String>,
+        prior_citations: Vec<FilterCitation>,
+    ) -> Self {
+        self.response_prefix = prior_text.into();
+        self.resume_citations = Some(prior_citations);
+        self
+    }
+
+    /// Add or remap special tokens.
+    ///
+    /// The given tokens are merged into the special token map, so they can be used
+    /// on top of a preset such as `cmd3()` to support renamed or additional section
+    /// tokens. A token that is already configured has its mode replaced.
+    ///
+    /// # Arguments
+    ///
+    /// * `token_map` - Special tokens and the mode each one switches to
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::FilterOptions;
+    /// use cohere_melody::parsing::types::FilterMode;
+    /// use std::collections::HashMap;
+    ///
+    /// let options = FilterOptions::new()
+    ///     .cmd3()
+    ///     .with_special_token_map(HashMap::from([
+    ///         ("<|START_TOOL_CALLS|>".to_string(), FilterMode::ToolAction),
+    ///         ("<|END_TOOL_CALLS|>".to_string(), FilterMode::Ignore),
+    ///     ]));
+    /// ```
+    #[must_use]
+    pub fn with_special_token_map(mut self, token_map: HashMap<String, FilterMode>) -> Self {
+        self.special_token_map.extend(token_map);
+        self
+    }
+
     /// Remove a special token from the token map.
     ///
     /// Removes a previously configured special token, preventing it from
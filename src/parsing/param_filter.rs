@@ -4,9 +4,10 @@
 //! It supports both basic types (numbers, booleans, null) and complex types
 //! (strings, objects, arrays) with proper JSON validation.
 
-use crate::parsing::action_filter::ActionMode;
-use crate::parsing::filter::{FilterImpl, find_partial};
+use crate::parsing::action_filter::{ActionMode, SearchQueryScan};
+use crate::parsing::filter::FilterImpl;
 use crate::parsing::types::FilterOutput;
+use serde::{Deserialize, Serialize};
 
 /// State machine for parsing parameter values.
 ///
@@ -19,7 +20,7 @@ use crate::parsing::types::FilterOutput;
 /// - `Beginning` → sees `{` → transitions to `ComplexType` (object)
 /// - `Beginning` → sees digit → transitions to `BasicType` (number)
 /// - `BasicType` → sees `,` or `}` → transitions to `End`
-#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+#[derive(Debug, Copy, Clone, PartialEq, Eq, Serialize, Deserialize)]
 pub(crate) enum ParamState {
     /// Initial state, haven't determined value type yet
     Beginning,
@@ -71,11 +72,10 @@ impl FilterImpl {
     }
 
     fn handle_param_value_basic_type(&mut self, s: &str) -> (Vec<FilterOutput>, usize) {
-        let (idx, _) = find_partial(s, ["}".to_string(), ",".to_string()].iter());
-
-        if idx == usize::MAX {
+        // The value ends at the first comma or brace, whichever comes first
+        let Some(idx) = s.find([',', '}']) else {
             return self.send_param_value_chunk(s);
-        }
+        };
 
         let (out, _) = self.send_param_value_chunk(&s[..idx]);
         self.action_metadata.cur_param_state = ParamState::End;
@@ -89,13 +89,20 @@ impl FilterImpl {
         let idx = find_valid_json_value(&self.action_metadata.param_value_buffer, s);
 
         if idx == usize::MAX {
-            let (out, rem) = self.send_param_value_chunk(s);
-            self.action_metadata.param_value_buffer.push_str(s);
+            let (mut out, rem) = self.send_param_value_chunk(s);
+            // Text that isn't consumed is passed again with the next token
+            self.action_metadata.param_value_buffer.push_str(&s[..rem]);
+            if self.is_search_queries_param() {
+                out.extend(self.send_search_query_chunks(&s[..rem]));
+            }
             (out, rem)
         } else {
             self.action_metadata.param_value_buffer.clear();
             self.action_metadata.cur_param_state = ParamState::End;
-            let (out, _) = self.send_param_value_chunk(&s[..idx]);
+            let (mut out, _) = self.send_param_value_chunk(&s[..idx]);
+            if self.is_search_queries_param() {
+                out.extend(self.send_search_query_chunks(&s[..idx]));
+            }
             let (o, r) = self.handle_param_value(&s[idx..]);
             let mut result = out;
             result.extend(o);
@@ -120,6 +127,7 @@ impl FilterImpl {
         self.action_metadata.param_value_buffer.clear();
         self.action_metadata.cur_param_state = ParamState::Beginning;
         self.action_metadata.cur_param_name.clear();
+        self.action_metadata.query_scan = SearchQueryScan::default();
 
         if first_char == '}' {
             self.action_metadata.mode = ActionMode::ToolEnd;
@@ -128,10 +136,11 @@ impl FilterImpl {
             self.action_metadata.mode = ActionMode::ParamValueEnd;
         }
 
-        let (o, r) = self.parse_actions(&s[idx + 1..]);
+        let end = idx + first_char.len_utf8();
+        let (o, r) = self.parse_actions(&s[end..]);
         let mut result = out;
         result.extend(o);
-        (result, r + idx + 1)
+        (result, r + end)
     }
 }
 
@@ -184,10 +193,12 @@ mod tests {
         FilterAction {
             mode: ActionMode::NotStarted,
             cur_tool_call_index: 0,
+            cur_tool_name: String::new(),
             trim_left: false,
             cur_param_name: String::new(),
             cur_param_state: ParamState::Beginning,
             param_value_buffer: String::new(),
+            query_scan: SearchQueryScan::default(),
         }
     }
 
@@ -413,4 +424,18 @@ mod tests {
         }
         assert_eq!(result, "[{\"test\",[\"}\",\"]    ,");
     }
+
+    #[test]
+    fn test_handle_param_value_end_type_multibyte() {
+        let mut filter = FilterImpl::new();
+        filter.action_metadata = starting_metadata();
+        filter.action_metadata.cur_param_state = ParamState::End;
+
+        // Used to panic slicing inside the multi-byte character
+        let input = " \u{fffd}";
+        let (_, actual_remove) = filter.handle_param_value_end_type(input);
+
+        assert_eq!(actual_remove, input.len());
+        assert_eq!(filter.action_metadata.mode, ActionMode::ParamValueEnd);
+    }
 }
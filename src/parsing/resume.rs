@@ -0,0 +1,383 @@
+//! Resumption of truncated responses
+//!
+//! A truncated answer is continued by re-prompting the model with the text it already
+//! generated. The completion may start by repeating the end of that text, the overlap
+//! window, so its leading answer text is held back until it either diverges from the
+//! end of the prior text or covers all of the overlap, and the repeated part is dropped.
+//!
+//! An upstream retry that replays tokens already sent is handled the same way, against
+//! the end of the answer text the filter emitted, see `with_dedup_window`.
+
+use crate::parsing::citations_filter::str_index_len;
+use crate::parsing::filter::FilterImpl;
+use crate::parsing::types::{FilterCitation, FilterOutput, TokenIDsWithLogProb};
+use serde::{Deserialize, Serialize};
+
+/// Maximum number of bytes at the end of the prior text the completion may repeat, without
+/// a dedup window.
+const RESUME_OVERLAP_WINDOW: usize = 256;
+
+/// The answer text of a resumed completion held back until its overlap with the prior
+/// text is known.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub(crate) struct ResumeOverlap {
+    /// End of the prior text the completion may repeat
+    window: String,
+    /// Citations of the prior text, dropped if the completion repeats them
+    prior_citations: Vec<FilterCitation>,
+    held_text: String,
+    held_logprobs: TokenIDsWithLogProb,
+    held_citations: Vec<FilterCitation>,
+    held_post_answer: bool,
+    /// Set once the overlap was dropped, the repeated citations are still dropped
+    overlap_dropped: bool,
+}
+
+impl ResumeOverlap {
+    /// Returns the overlap of a completion with the last `window` bytes of the prior text,
+    /// or the last 256 if `window` is 0.
+    pub(crate) fn new(
+        prior_text: &str,
+        prior_citations: Vec<FilterCitation>,
+        window: usize,
+    ) -> Self {
+        let window = if window == 0 {
+            RESUME_OVERLAP_WINDOW
+        } else {
+            window
+        };
+        Self {
+            window: tail(prior_text, window).to_string(),
+            prior_citations,
+            held_text: String::new(),
+            held_logprobs: TokenIDsWithLogProb::new(),
+            held_citations: Vec::new(),
+            held_post_answer: false,
+            overlap_dropped: false,
+        }
+    }
+
+    fn hold(&mut self, o: FilterOutput) {
+        self.held_text.push_str(&o.text);
+        self.held_logprobs.append(o.logprobs);
+        self.held_citations.extend(o.citations);
+        self.held_post_answer |= o.is_post_answer;
+    }
+
+    /// Returns the suffixes of the window the completion may repeat, those starting at a
+    /// word boundary so a completion is not cut in the middle of a word.
+    fn suffixes(&self) -> impl Iterator<Item = &str> {
+        let w = &self.window;
+        w.char_indices()
+            .filter(move |&(i, c)| {
+                let Some(prev) = w[..i].chars().next_back() else {
+                    return true;
+                };
+                prev.is_whitespace()
+                    || c.is_whitespace()
+                    || prev.is_alphanumeric() != c.is_alphanumeric()
+            })
+            .map(move |(i, _)| &w[i..])
+    }
+
+    /// Returns the length in bytes of the prior text the held text repeats, or `None` if
+    /// more text is needed to know it.
+    fn overlap(&self, after_last_token: bool) -> Option<usize> {
+        let held = self.held_text.as_str();
+        if !after_last_token
+            && self
+                .suffixes()
+                .any(|s| s.len() > held.len() && s.starts_with(held))
+        {
+            return None;
+        }
+        Some(
+            self.suffixes()
+                .filter(|s| held.starts_with(s))
+                .map(str::len)
+                .max()
+                .unwrap_or(0),
+        )
+    }
+}
+
+impl ResumeOverlap {
+    /// Removes the citations repeating a prior citation, and the outputs left empty.
+    fn drop_repeated_citations(&self, mut outputs: Vec<FilterOutput>) -> Vec<FilterOutput> {
+        if self.prior_citations.is_empty() {
+            return outputs;
+        }
+        for o in &mut outputs {
+            o.citations.retain(|c| !self.prior_citations.contains(c));
+        }
+        outputs.retain(|o| !is_answer_text(o) || !o.text.is_empty() || !o.citations.is_empty());
+        outputs
+    }
+}
+
+/// Returns the last `bytes` bytes of `s`, fewer if they would split a character.
+fn tail(s: &str, bytes: usize) -> &str {
+    let mut start = s.len().saturating_sub(bytes);
+    while !s.is_char_boundary(start) {
+        start += 1;
+    }
+    &s[start..]
+}
+
+/// Returns whether `o` only has answer text, which may repeat the prior text.
+fn is_answer_text(o: &FilterOutput) -> bool {
+    !o.is_reasoning
+        && !o.is_echo
+        && o.search_query.is_none()
+        && o.tool_call_delta.is_none()
+        && o.finish.is_none()
+        && o.relevant_doc_indices.is_none()
+        && o.cited_doc_indices.is_none()
+}
+
+impl FilterImpl {
+    /// Marks a retry of the upstream stream, which may start by replaying the end of the
+    /// answer text already emitted: the leading answer text written next is held back
+    /// until its overlap with the last bytes of the dedup window of the emitted text is
+    /// known, then the overlap and the citations it repeats are dropped, and the indices
+    /// of the text and citations moved back over it. It does nothing without
+    /// `with_dedup_window`, or while the overlap of a previous retry is still held back.
+    pub fn resume(&mut self) {
+        if self.dedup_window == 0 || self.done {
+            return;
+        }
+        if self.resume.as_ref().is_some_and(|r| !r.overlap_dropped) {
+            return;
+        }
+        self.resume = Some(ResumeOverlap::new(
+            &self.emitted_tail,
+            self.emitted_tail_citations.clone(),
+            self.dedup_window,
+        ));
+    }
+
+    /// Keeps the end of the answer text of the emitted outputs and the citations of it,
+    /// which a retry may replay, see `resume`.
+    pub(crate) fn track_emitted_tail(&mut self, outputs: &[FilterOutput]) {
+        if self.dedup_window == 0 {
+            return;
+        }
+        for o in outputs.iter().filter(|o| is_answer_text(o)) {
+            self.emitted_tail.push_str(&o.text);
+            self.emitted_tail_citations
+                .extend(o.citations.iter().cloned());
+        }
+        let start = self.emitted_tail.len() - tail(&self.emitted_tail, self.dedup_window).len();
+        self.emitted_tail.drain(..start);
+        let tail_start = self
+            .cur_text_index
+            .saturating_sub(str_index_len(&self.emitted_tail, self.citation_index_unit));
+        self.emitted_tail_citations
+            .retain(|c| c.end_index > tail_start);
+    }
+
+    /// Holds back the answer text of a resumed completion until its overlap with the
+    /// prior text is known, then drops the overlap. Outputs of other kinds end the
+    /// overlap. Citations repeating a prior citation are dropped.
+    pub(crate) fn resume_outputs(
+        &mut self,
+        outputs: Vec<FilterOutput>,
+        after_last_token: bool,
+    ) -> Vec<FilterOutput> {
+        let Some(resume) = self.resume.as_ref() else {
+            return outputs;
+        };
+        if resume.overlap_dropped {
+            return resume.drop_repeated_citations(outputs);
+        }
+
+        let mut out = Vec::with_capacity(outputs.len());
+        for o in outputs {
+            match self.resume.as_mut() {
+                Some(resume) if !resume.overlap_dropped && is_answer_text(&o) => {
+                    resume.hold(o);
+                    if resume.overlap(false).is_some() {
+                        self.drop_overlap(&mut out);
+                    }
+                }
+                Some(resume) if !resume.overlap_dropped => {
+                    self.drop_overlap(&mut out);
+                    out.push(o);
+                }
+                _ => out.push(o),
+            }
+        }
+        if after_last_token {
+            self.drop_overlap(&mut out);
+        }
+        match &self.resume {
+            Some(resume) if resume.overlap_dropped => resume.drop_repeated_citations(out),
+            _ => out,
+        }
+    }
+
+    /// Emits the held answer text without the part repeating the prior text, and moves
+    /// the text and citation indices back over it.
+    fn drop_overlap(&mut self, out: &mut Vec<FilterOutput>) {
+        let Some(resume) = self.resume.as_mut().filter(|r| !r.overlap_dropped) else {
+            return;
+        };
+        resume.overlap_dropped = true;
+        let overlap = resume.overlap(true).unwrap_or(0);
+        let units = str_index_len(
+            &resume.window[resume.window.len() - overlap..],
+            self.citation_index_unit,
+        );
+        self.cur_text_index = self.cur_text_index.saturating_sub(units);
+        self.cur_text_byte_index = self.cur_text_byte_index.saturating_sub(overlap);
+
+        let shift = |c: &mut FilterCitation| {
+            c.start_index = c.start_index.saturating_sub(units);
+            c.end_index = c.end_index.saturating_sub(units);
+        };
+        if let Some(pending) = self.pending_citation.as_mut() {
+            shift(pending);
+            if resume.prior_citations.contains(pending) {
+                self.pending_citation = None;
+            }
+        }
+        let mut citations = std::mem::take(&mut resume.held_citations);
+        citations.iter_mut().for_each(shift);
+
+        let text = resume.held_text[overlap..].to_string();
+        resume.held_text.clear();
+        let logprobs = std::mem::take(&mut resume.held_logprobs);
+        if text.is_empty() && citations.is_empty() {
+            return;
+        }
+        out.push(FilterOutput {
+            text,
+            logprobs,
+            citations,
+            is_post_answer: resume.held_post_answer,
+            ..Default::default()
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::parsing::types::{FilterCitation, Source, TokenIDsWithLogProb};
+    use crate::parsing::{Filter, FilterOptions, new_filter};
+
+    fn resume(
+        prior_text: &str,
+        prior_citations: Vec<FilterCitation>,
+        chunks: &[&str],
+    ) -> (String, Vec<FilterCitation>) {
+        let options = FilterOptions::new()
+            .cmd3()
+            .with_resume_state(prior_text, prior_citations);
+        let mut filter = new_filter(options);
+        let mut out = Vec::new();
+        for chunk in chunks {
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        out.extend(filter.flush_partials());
+        let text = out.iter().map(|o| o.text.as_str()).collect();
+        (text, out.into_iter().flat_map(|o| o.citations).collect())
+    }
+
+    fn citation(start_index: usize, text: &str, result: usize) -> FilterCitation {
+        FilterCitation {
+            start_index,
+            end_index: start_index + text.len(),
+            text: text.to_string(),
+            sources: vec![Source {
+                tool_call_index: 0,
+                tool_result_indices: vec![result],
+                source_name: None,
+            }],
+            is_thinking: false,
+        }
+    }
+
+    #[test]
+    fn test_resume_drops_overlap() {
+        let prior = vec![citation(11, "blue", 1)];
+        let chunks = [
+            "is ",
+            "<co>",
+            "blue",
+            "</co: 0:[1]>",
+            ". It is ",
+            "<co>",
+            "clear",
+            "</co: 0:[2]>",
+            ".",
+        ];
+        let (text, citations) = resume("The sky is blue", prior, &chunks);
+        // The repeated citation is dropped and the indices continue the prior text
+        assert_eq!(text, ". It is clear.");
+        assert_eq!(citations, vec![citation(23, "clear", 2)]);
+    }
+
+    #[test]
+    fn test_resume_keeps_diverging_text() {
+        // The completion repeats the start of " is blue" but not all of it
+        let (text, _) = resume("The sky is blue", Vec::new(), &[" is", " green"]);
+        assert_eq!(text, " is green");
+
+        // Overlaps only start at word boundaries
+        let (text, _) = resume("The sky", Vec::new(), &["y is blue"]);
+        assert_eq!(text, "y is blue");
+
+        let (text, citations) = resume("The sky", Vec::new(), &[" is <co>blue</co: 0:[1]>"]);
+        assert_eq!(text, " is blue");
+        assert_eq!(citations, vec![citation(11, "blue", 1)]);
+    }
+
+    #[test]
+    fn test_resume_after_retry() {
+        let mut filter = new_filter(FilterOptions::new().cmd3().with_dedup_window(8));
+        let mut out = Vec::new();
+        for chunk in [
+            "<|START_RESPONSE|>",
+            "The sky is ",
+            "<co>",
+            "blue",
+            "</co: 0:[1]>",
+        ] {
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        // The retry replays " is blue" with its citation, only the end of it is in the window
+        filter.resume();
+        for chunk in [
+            " is ",
+            "<co>",
+            "blue",
+            "</co: 0:[1]>",
+            ", it is ",
+            "<co>",
+            "clear",
+            "</co: 0:[2]>",
+        ] {
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        out.extend(filter.flush_partials());
+        let text: String = out.iter().map(|o| o.text.as_str()).collect();
+        let citations: Vec<_> = out.into_iter().flat_map(|o| o.citations).collect();
+        assert_eq!(text, "The sky is blue, it is clear");
+        assert_eq!(
+            citations,
+            vec![citation(11, "blue", 1), citation(23, "clear", 2)]
+        );
+
+        // Without a dedup window the retry is not deduplicated
+        let mut filter = new_filter(FilterOptions::new().cmd3());
+        let mut out = filter.write_decoded(
+            "<|START_RESPONSE|>The sky is blue",
+            TokenIDsWithLogProb::new(),
+        );
+        filter.resume();
+        out.extend(filter.write_decoded(" is blue", TokenIDsWithLogProb::new()));
+        out.extend(filter.flush_partials());
+        let text: String = out.iter().map(|o| o.text.as_str()).collect();
+        assert_eq!(text, "The sky is blue is blue");
+    }
+}
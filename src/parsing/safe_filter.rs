@@ -0,0 +1,180 @@
+//! A filter that can be shared between threads
+//!
+//! `FilterImpl` is `Send` and `Sync`, but every call takes `&mut self`, so sharing one
+//! filter between threads requires a lock. `SafeFilter` holds that lock so callers,
+//! such as the Python binding, cannot forget it. State of the caller that must follow
+//! the order of the writes, such as the tokens the Python binding records, is held
+//! under the same lock.
+
+use crate::parsing::filter::{Filter, FilterImpl};
+use crate::parsing::options::{FilterOptions, new_filter};
+use crate::parsing::types::{FilterOutput, TokenIDsWithLogProb};
+use std::sync::{Mutex, MutexGuard, PoisonError};
+
+/// A streaming filter that serializes concurrent calls.
+///
+/// Each `write_decoded` and `flush_partials` call runs under a mutex, so calls from
+/// different threads never interleave within the state machine. Calls are applied in
+/// the order the lock is acquired: callers that need a specific token order must still
+/// order their writes.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::{FilterOptions, new_safe_filter};
+/// use cohere_melody::parsing::types::TokenIDsWithLogProb;
+/// use std::sync::Arc;
+///
+/// let filter = Arc::new(new_safe_filter(FilterOptions::new()));
+/// let writer = Arc::clone(&filter);
+/// std::thread::spawn(move || writer.write_decoded("Hello", TokenIDsWithLogProb::new()))
+///     .join()
+///     .unwrap();
+/// let outputs = filter.flush_partials();
+/// ```
+pub struct SafeFilter<S = ()> {
+    inner: Mutex<Guarded<S>>,
+}
+
+/// The filter and the state of the caller, guarded by the lock of a `SafeFilter`
+struct Guarded<S> {
+    filter: FilterImpl,
+    state: S,
+}
+
+impl<S> SafeFilter<S> {
+    /// Process a decoded token and return any completed outputs, see `Filter::write_decoded`.
+    pub fn write_decoded(
+        &self,
+        decoded_token: &str,
+        prob: TokenIDsWithLogProb,
+    ) -> Vec<FilterOutput> {
+        self.lock().filter.write_decoded(decoded_token, prob)
+    }
+
+    /// Flush any buffered partial outputs, see `Filter::flush_partials`.
+    pub fn flush_partials(&self) -> Vec<FilterOutput> {
+        self.lock().filter.flush_partials()
+    }
+
+    /// Runs `f` with the filter and the state of the caller, under the lock serializing
+    /// the calls, so the state changes in the order of the writes.
+    pub fn with_state<R>(&self, f: impl FnOnce(&mut FilterImpl, &mut S) -> R) -> R {
+        let mut guarded = self.lock();
+        let Guarded { filter, state } = &mut *guarded;
+        f(filter, state)
+    }
+
+    // a panic while parsing leaves the filter in an arbitrary but memory-safe state, keep
+    // serving the following calls rather than poisoning the filter for good
+    fn lock(&self) -> MutexGuard<'_, Guarded<S>> {
+        self.inner.lock().unwrap_or_else(PoisonError::into_inner)
+    }
+}
+
+impl<S> Filter for SafeFilter<S> {
+    fn write_decoded(
+        &mut self,
+        decoded_token: &str,
+        prob: TokenIDsWithLogProb,
+    ) -> Vec<FilterOutput> {
+        self.inner
+            .get_mut()
+            .unwrap_or_else(PoisonError::into_inner)
+            .filter
+            .write_decoded(decoded_token, prob)
+    }
+
+    fn flush_partials(&mut self) -> Vec<FilterOutput> {
+        self.inner
+            .get_mut()
+            .unwrap_or_else(PoisonError::into_inner)
+            .filter
+            .flush_partials()
+    }
+}
+
+/// Creates a new filter that can be shared between threads.
+///
+/// # Arguments
+///
+/// * `options` - Configuration options for the filter
+///
+/// # Returns
+///
+/// A configured `SafeFilter` ready to process tokens
+#[must_use]
+pub fn new_safe_filter(options: FilterOptions) -> SafeFilter {
+    new_safe_filter_with_state(options, ())
+}
+
+/// Creates a new filter that can be shared between threads, holding `state` of the
+/// caller under its lock, see `SafeFilter::with_state`.
+#[must_use]
+pub fn new_safe_filter_with_state<S>(options: FilterOptions, state: S) -> SafeFilter<S> {
+    SafeFilter {
+        inner: Mutex::new(Guarded {
+            filter: new_filter(options),
+            state,
+        }),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Arc;
+
+    #[test]
+    fn test_safe_filter_concurrent_writes() {
+        let filter = Arc::new(new_safe_filter(FilterOptions::new()));
+        let handles: Vec<_> = (0..8)
+            .map(|_| {
+                let filter = Arc::clone(&filter);
+                std::thread::spawn(move || {
+                    (0..100)
+                        .flat_map(|_| filter.write_decoded("ab", TokenIDsWithLogProb::new()))
+                        .map(|o| o.text)
+                        .collect::<String>()
+                })
+            })
+            .collect();
+
+        let mut text: String = handles.into_iter().map(|h| h.join().unwrap()).collect();
+        text.extend(filter.flush_partials().into_iter().map(|o| o.text));
+        assert_eq!(text, "ab".repeat(800));
+    }
+
+    #[test]
+    fn test_safe_filter_state_follows_writes() {
+        // the tokens recorded in the state are in the order the filter emits them
+        let filter = Arc::new(new_safe_filter_with_state(
+            FilterOptions::new(),
+            (String::new(), String::new()),
+        ));
+        let handles: Vec<_> = (b'a'..b'i')
+            .map(|c| {
+                let filter = Arc::clone(&filter);
+                std::thread::spawn(move || {
+                    for _ in 0..100 {
+                        filter.with_state(|f, (written, emitted)| {
+                            let token = char::from(c).to_string();
+                            written.push_str(&token);
+                            let out = f.write_decoded(&token, TokenIDsWithLogProb::new());
+                            emitted.extend(out.into_iter().map(|o| o.text));
+                        });
+                    }
+                })
+            })
+            .collect();
+        for h in handles {
+            h.join().unwrap();
+        }
+
+        filter.with_state(|f, (written, emitted)| {
+            emitted.extend(f.flush_partials().into_iter().map(|o| o.text));
+            assert_eq!(written.len(), 800);
+            assert_eq!(emitted, written);
+        });
+    }
+}
@@ -0,0 +1,171 @@
+//! Soft stops of a stream
+//!
+//! A stream that should wind down, e.g. when moderation flags it mid-generation, is not
+//! cut mid-sentence: the text goes on until the end of the sentence being generated, and
+//! the stream then ends as if an exclusive stop sequence matched.
+
+use crate::parsing::filter::FilterImpl;
+use crate::parsing::types::{FilterOutput, FinishReason};
+use unicode_segmentation::UnicodeSegmentation;
+
+impl FilterImpl {
+    /// Asks the filter to stop at the next sentence boundary. The text is emitted until the
+    /// end of the current sentence, or of the next one if the text so far ends one, then
+    /// the stream ends as if an exclusive stop sequence matched: the rest is dropped and
+    /// the finish output, if enabled, has the reason `FinishReason::ExclusiveStop` with an
+    /// empty stop sequence. Outputs other than text, such as tool calls and search
+    /// queries, end the stream before them.
+    ///
+    /// The end of a sentence is only known once the next one starts, so the stream ends
+    /// with the first token of the next sentence, or at the flush.
+    pub fn request_soft_stop(&mut self) {
+        if !self.done && self.soft_stop.is_none() {
+            self.soft_stop = Some(String::new());
+        }
+    }
+
+    /// Returns the outputs up to the sentence boundary a soft stop ends the stream at, and
+    /// ends it there. `soft_stop` holds the text of the sentence emitted since the request.
+    pub(crate) fn soft_stop_outputs(&mut self, outputs: Vec<FilterOutput>) -> Vec<FilterOutput> {
+        let Some(sentence) = self.soft_stop.as_mut() else {
+            return outputs;
+        };
+
+        let mut out = Vec::with_capacity(outputs.len());
+        let mut outputs = outputs.into_iter();
+        let mut stopped = false;
+        for mut o in outputs.by_ref() {
+            if o.is_echo || o.finish.is_some() {
+                out.push(o);
+                continue;
+            }
+            let is_text = o.search_query.is_none()
+                && o.tool_call_delta.is_none()
+                && o.relevant_doc_indices.is_none()
+                && o.cited_doc_indices.is_none();
+            if !is_text {
+                stopped = true;
+                break;
+            }
+            if o.text.is_empty() {
+                out.push(o);
+                continue;
+            }
+
+            let start = sentence.len();
+            sentence.push_str(&o.text);
+            let boundary = sentence
+                .split_sentence_bound_indices()
+                .nth(1)
+                .map(|(byte, _)| byte);
+            match boundary {
+                // The text so far ended a sentence
+                Some(byte) if byte <= start => {
+                    stopped = true;
+                    break;
+                }
+                Some(byte) => {
+                    o.text.truncate(byte - start);
+                    o.text.truncate(o.text.trim_end().len());
+                    out.push(o);
+                    stopped = true;
+                    break;
+                }
+                None => out.push(o),
+            }
+        }
+        if !stopped {
+            return out;
+        }
+
+        // The outputs of a stop matched after the boundary are dropped with the rest
+        if outputs.any(|o| o.finish.is_some()) {
+            self.finished = false;
+        }
+        self.soft_stop = None;
+        self.buf.clear();
+        self.done = true;
+        self.release_pending_citation(&mut out);
+        self.finish(&mut out, FinishReason::ExclusiveStop, String::new());
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::parsing::filter::Filter;
+    use crate::parsing::options::{FilterOptions, new_filter};
+    use crate::parsing::types::{FilterFinish, FinishReason, TokenIDsWithLogProb};
+
+    /// Writes the chunks, requesting a soft stop before the one at `request_at`, and
+    /// returns the text and finishes of the outputs.
+    fn run(
+        options: &FilterOptions,
+        chunks: &[&str],
+        request_at: usize,
+    ) -> (String, Vec<FilterFinish>) {
+        let mut filter = new_filter(options.clone());
+        let mut out = Vec::new();
+        for (i, chunk) in chunks.iter().enumerate() {
+            if i == request_at {
+                filter.request_soft_stop();
+            }
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        out.extend(filter.flush_partials());
+        let text = out.iter().map(|o| o.text.as_str()).collect();
+        (text, out.into_iter().filter_map(|o| o.finish).collect())
+    }
+
+    #[test]
+    fn test_soft_stop() {
+        let options = FilterOptions::new().cmd3().with_finish_reason();
+        let chunks = [
+            "<|START_RESPONSE|>The sky is",
+            " blue. It",
+            " is cloudy",
+            ". Rain is likely.",
+            "<|END_RESPONSE|>",
+        ];
+        let soft_stop = FilterFinish {
+            reason: FinishReason::ExclusiveStop,
+            stop_sequence: String::new(),
+        };
+
+        assert_eq!(
+            run(&options, &chunks, 1),
+            ("The sky is blue.".to_string(), vec![soft_stop.clone()])
+        );
+        assert_eq!(
+            run(&options, &chunks, 2),
+            (
+                "The sky is blue. It is cloudy.".to_string(),
+                vec![soft_stop.clone()]
+            )
+        );
+        // The stream ends before a sentence boundary
+        let (text, finishes) = run(&options, &chunks, 4);
+        assert_eq!(text, "The sky is blue. It is cloudy. Rain is likely.");
+        assert_eq!(finishes[0].reason, FinishReason::Flush);
+
+        // A tool call ends the stream before it
+        let mut filter = new_filter(options.stream_tool_actions());
+        filter.write_decoded("<|START_RESPONSE|>Searching", TokenIDsWithLogProb::new());
+        filter.request_soft_stop();
+        filter.write_decoded(
+            "<|END_RESPONSE|><|START_ACTION|>",
+            TokenIDsWithLogProb::new(),
+        );
+        let out = filter.write_decoded(
+            "[{\"tool_call_id\": \"0\", \"tool_name\": \"search\", \"parameters\": {",
+            TokenIDsWithLogProb::new(),
+        );
+        assert_eq!(out.len(), 1);
+        assert_eq!(out[0].finish, Some(soft_stop));
+        assert!(
+            filter
+                .write_decoded("more", TokenIDsWithLogProb::new())
+                .is_empty()
+        );
+    }
+}
@@ -0,0 +1,376 @@
+//! Snapshots of the parsing state of a filter
+//!
+//! A long generation can be moved to another process by saving the state of its filter
+//! and restoring it into a filter created there with the same options. Only what the
+//! filter learned from the stream is saved, its configuration comes from the options.
+
+use crate::errors::MelodyError;
+use crate::parsing::action_filter::FilterAction;
+use crate::parsing::filter::{CodeFence, DocumentSelection, FilterImpl, QueryQuoting};
+use crate::parsing::options::{FilterOptions, new_filter};
+use crate::parsing::resume::ResumeOverlap;
+use crate::parsing::types::{FilterCitation, FilterMode, TokenIDsWithLogProb};
+use serde::{Deserialize, Serialize};
+
+/// Version of the encoding of `FilterState`, it changes whenever a field is renamed or
+/// removed so a state is never restored into a filter that would misread it.
+pub const FILTER_STATE_VERSION: u32 = 1;
+
+/// The parsing state of a filter: its buffers, mode, citation indices and the tool call
+/// being parsed.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::{Filter, FilterOptions, new_filter, restore_filter};
+/// use cohere_melody::parsing::types::TokenIDsWithLogProb;
+///
+/// let options = FilterOptions::new().cmd3();
+/// let mut filter = new_filter(options.clone());
+/// filter.write_decoded("<|START_RESPONSE|>Hello", TokenIDsWithLogProb::new());
+/// let state = filter.save_state().to_json().unwrap();
+///
+/// let mut restored = restore_filter(options, &state).unwrap();
+/// let out = restored.write_decoded(" world", TokenIDsWithLogProb::new());
+/// assert_eq!(out[0].text, " world");
+/// ```
+#[allow(clippy::struct_excessive_bools)]
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct FilterState {
+    version: u32,
+
+    left_trimmed: bool,
+    right_trimmed: bool,
+    mode: FilterMode,
+    done: bool,
+    finished: bool,
+    buf: Vec<u8>,
+    partial_special_token_log_prob: TokenIDsWithLogProb,
+    prompt_echo_remaining: usize,
+
+    raw_param_indent_length_removed: usize,
+    saw_non_whitespace_in_current_line: bool,
+
+    cur_text_index: usize,
+    cur_text_byte_index: usize,
+    last_grapheme: String,
+    cur_citation_byte_index: Option<usize>,
+    pending_citation: Option<FilterCitation>,
+    #[serde(default)]
+    sentence_text: String,
+    #[serde(default)]
+    sentence_start_index: usize,
+    #[serde(default)]
+    sentence_held_citations: Vec<FilterCitation>,
+    action_metadata: FilterAction,
+    #[serde(default)]
+    plan_blocks: usize,
+
+    curr_search_query_idx: usize,
+    sent_curr_index: bool,
+
+    num_tokens_in_chunk: usize,
+    chunk_log_probs: TokenIDsWithLogProb,
+    #[serde(default)]
+    chunk_token_ends: Vec<usize>,
+
+    document_selection: Option<DocumentSelection>,
+    #[serde(default)]
+    pending_tokens: TokenIDsWithLogProb,
+    #[serde(default)]
+    resume: Option<ResumeOverlap>,
+    #[serde(default)]
+    emitted_tail: String,
+    #[serde(default)]
+    emitted_tail_citations: Vec<FilterCitation>,
+    #[serde(default)]
+    soft_stop: Option<String>,
+    #[serde(default)]
+    healed_prefix: String,
+    #[serde(default)]
+    healed_matched: usize,
+    #[serde(default)]
+    code_fence: CodeFence,
+    #[serde(default)]
+    query_quoting: QueryQuoting,
+}
+
+impl FilterState {
+    /// Encodes the state as JSON.
+    ///
+    /// # Errors
+    ///
+    /// Returns `MelodyError::JsonSerialization` if the state cannot be encoded.
+    pub fn to_json(&self) -> Result<Vec<u8>, MelodyError> {
+        Ok(serde_json::to_vec(self)?)
+    }
+
+    /// Decodes a state encoded with `to_json`.
+    ///
+    /// # Errors
+    ///
+    /// Returns `MelodyError::JsonSerialization` if `data` is not an encoded state, and
+    /// `MelodyError::UnsupportedFilterState` if it was saved by a newer version.
+    pub fn from_json(data: &[u8]) -> Result<Self, MelodyError> {
+        // Check the version first, the fields of a newer state may not decode
+        #[derive(Deserialize)]
+        struct Versioned {
+            version: u32,
+        }
+        let Versioned { version } = serde_json::from_slice(data)?;
+        if version > FILTER_STATE_VERSION {
+            return Err(MelodyError::UnsupportedFilterState(
+                version,
+                FILTER_STATE_VERSION,
+            ));
+        }
+        Ok(serde_json::from_slice(data)?)
+    }
+}
+
+impl FilterImpl {
+    /// Returns a snapshot of the parsing state of the filter, see `restore_filter`.
+    #[must_use]
+    pub fn save_state(&self) -> FilterState {
+        FilterState {
+            version: FILTER_STATE_VERSION,
+            left_trimmed: self.left_trimmed,
+            right_trimmed: self.right_trimmed,
+            mode: self.mode,
+            done: self.done,
+            finished: self.finished,
+            buf: self.buf.clone(),
+            partial_special_token_log_prob: self.partial_special_token_log_prob.clone(),
+            prompt_echo_remaining: self.prompt_echo_remaining,
+            raw_param_indent_length_removed: self.raw_param_indent_length_removed,
+            saw_non_whitespace_in_current_line: self.saw_non_whitespace_in_current_line,
+            cur_text_index: self.cur_text_index,
+            cur_text_byte_index: self.cur_text_byte_index,
+            last_grapheme: self.last_grapheme.clone(),
+            cur_citation_byte_index: self.cur_citation_byte_index,
+            pending_citation: self.pending_citation.clone(),
+            sentence_text: self.sentence_text.clone(),
+            sentence_start_index: self.sentence_start_index,
+            sentence_held_citations: self.sentence_held_citations.clone(),
+            action_metadata: self.action_metadata.clone(),
+            plan_blocks: self.plan_blocks,
+            curr_search_query_idx: self.curr_search_query_idx,
+            sent_curr_index: self.sent_curr_index,
+            num_tokens_in_chunk: self.num_tokens_in_chunk,
+            chunk_log_probs: self.chunk_log_probs.clone(),
+            chunk_token_ends: self.chunk_token_ends.clone(),
+            document_selection: self.document_selection,
+            pending_tokens: self.pending_tokens.clone(),
+            resume: self.resume.clone(),
+            emitted_tail: self.emitted_tail.clone(),
+            emitted_tail_citations: self.emitted_tail_citations.clone(),
+            soft_stop: self.soft_stop.clone(),
+            healed_prefix: self.healed_prefix.clone(),
+            healed_matched: self.healed_matched,
+            code_fence: self.code_fence,
+            query_quoting: self.query_quoting,
+        }
+    }
+
+    /// Replaces the parsing state of the filter with a saved one. The filter should have
+    /// been created with the options of the filter the state was saved from.
+    pub fn restore_state(&mut self, state: FilterState) {
+        self.left_trimmed = state.left_trimmed;
+        self.right_trimmed = state.right_trimmed;
+        self.mode = state.mode;
+        self.done = state.done;
+        self.finished = state.finished;
+        self.buf = state.buf;
+        self.partial_special_token_log_prob = state.partial_special_token_log_prob;
+        self.prompt_echo_remaining = state.prompt_echo_remaining;
+        self.raw_param_indent_length_removed = state.raw_param_indent_length_removed;
+        self.saw_non_whitespace_in_current_line = state.saw_non_whitespace_in_current_line;
+        self.cur_text_index = state.cur_text_index;
+        self.cur_text_byte_index = state.cur_text_byte_index;
+        self.last_grapheme = state.last_grapheme;
+        self.cur_citation_byte_index = state.cur_citation_byte_index;
+        self.pending_citation = state.pending_citation;
+        self.sentence_text = state.sentence_text;
+        self.sentence_start_index = state.sentence_start_index;
+        self.sentence_held_citations = state.sentence_held_citations;
+        self.action_metadata = state.action_metadata;
+        self.plan_blocks = state.plan_blocks;
+        self.curr_search_query_idx = state.curr_search_query_idx;
+        self.sent_curr_index = state.sent_curr_index;
+        self.num_tokens_in_chunk = state.num_tokens_in_chunk;
+        self.chunk_log_probs = state.chunk_log_probs;
+        self.chunk_token_ends = state.chunk_token_ends;
+        self.document_selection = state.document_selection;
+        self.pending_tokens = state.pending_tokens;
+        self.resume = state.resume;
+        self.emitted_tail = state.emitted_tail;
+        self.emitted_tail_citations = state.emitted_tail_citations;
+        self.soft_stop = state.soft_stop;
+        self.healed_prefix = state.healed_prefix;
+        self.healed_matched = state.healed_matched;
+        self.code_fence = state.code_fence;
+        self.query_quoting = state.query_quoting;
+    }
+}
+
+impl FilterImpl {
+    /// Saves the state before a token for `rollback`, dropping the oldest state once the
+    /// rollback window is full.
+    pub(crate) fn push_rollback_state(&mut self) {
+        if self.rollback_window == 0 {
+            return;
+        }
+        if self.rollback_states.len() == self.rollback_window {
+            self.rollback_states.pop_front();
+        }
+        let state = self.save_state();
+        self.rollback_states.push_back(state);
+    }
+
+    /// Rewinds the filter to its state before the last `tokens` tokens written, e.g. when
+    /// speculative decoding retracts accepted tokens. The outputs already returned for
+    /// them are not retracted. Tokens written after a rollback can be rolled back again.
+    ///
+    /// # Errors
+    ///
+    /// Returns `MelodyError::RollbackOutOfWindow` if more tokens were asked than the
+    /// window set with `with_rollback_window` holds, or than were written.
+    pub fn rollback(&mut self, tokens: usize) -> Result<(), MelodyError> {
+        let held = self.rollback_states.len();
+        if tokens > held {
+            return Err(MelodyError::RollbackOutOfWindow(tokens, held));
+        }
+        let mut retracted = self.rollback_states.split_off(held - tokens);
+        if let Some(state) = retracted.pop_front() {
+            // A soft stop requested since is still requested
+            let soft_stop = self.soft_stop.is_some();
+            self.restore_state(state);
+            if soft_stop {
+                self.request_soft_stop();
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Creates a filter with the given options that resumes the stream of a saved state.
+///
+/// The options must be those of the filter the state was saved from. Feeding the rest of
+/// the stream to the restored filter gives the same outputs as feeding it to the original.
+///
+/// # Errors
+///
+/// Returns an error if `state` is not a state encoded with `FilterState::to_json`, or if
+/// it was saved by a newer version of melody.
+pub fn restore_filter(options: FilterOptions, state: &[u8]) -> Result<FilterImpl, MelodyError> {
+    let state = FilterState::from_json(state)?;
+    let mut filter = new_filter(options);
+    filter.restore_state(state);
+    Ok(filter)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::parsing::filter::Filter;
+    use crate::parsing::types::FilterOutput;
+
+    fn write_all(filter: &mut impl Filter, chunks: &[&str]) -> Vec<FilterOutput> {
+        let mut out = Vec::new();
+        for chunk in chunks {
+            out.extend(filter.write_decoded(chunk, TokenIDsWithLogProb::new()));
+        }
+        out
+    }
+
+    #[test]
+    fn test_restore_filter_resumes_stream() {
+        let options = FilterOptions::new().cmd3().stream_tool_actions();
+        let chunks = [
+            "<|START_RESPONSE|>",
+            "The ",
+            "<co>",
+            "sky",
+            "</co: 0:[1]>",
+            " is blue<|END_RESPONSE|><|START_ACTION|>",
+            "[{\"tool_call_id\": \"0\", \"tool_name\": \"se",
+            "arch\", \"parameters\": {\"query\": \"sk",
+            "y\"}}]<|END_ACTION|>",
+        ];
+
+        let mut filter = new_filter(options.clone());
+        let mut want = write_all(&mut filter, &chunks);
+        want.extend(filter.flush_partials());
+
+        // Split the stream at every chunk, including in the middle of a citation and
+        // of a tool call
+        for split in 0..=chunks.len() {
+            let mut filter = new_filter(options.clone());
+            let mut got = write_all(&mut filter, &chunks[..split]);
+            let state = filter.save_state().to_json().unwrap();
+
+            let mut restored = restore_filter(options.clone(), &state).unwrap();
+            got.extend(write_all(&mut restored, &chunks[split..]));
+            got.extend(restored.flush_partials());
+            assert_eq!(got, want, "split at {split}");
+        }
+    }
+
+    #[test]
+    fn test_rollback() {
+        let options = FilterOptions::new()
+            .cmd3()
+            .stream_tool_actions()
+            .with_rollback_window(3);
+        let chunks = [
+            "<|START_RESPONSE|>",
+            "The ",
+            "<co>",
+            "sky",
+            "</co: 0:[1]>",
+            " is blue<|END_RESPONSE|><|START_ACTION|>",
+            "[{\"tool_call_id\": \"0\", \"tool_name\": \"se",
+            "arch\", \"parameters\": {\"query\": \"sk",
+            "y\"}}]<|END_ACTION|>",
+        ];
+        let rejected = ["<|END_RESPONSE|>", "x\"", "<co>"];
+
+        for split in 0..=chunks.len() {
+            let mut filter = new_filter(options.clone());
+            write_all(&mut filter, &chunks[..split]);
+            let mut want = write_all(&mut filter, &chunks[split..]);
+            want.extend(filter.flush_partials());
+
+            // The rejected tokens leave no trace in the rest of the stream
+            for n in 1..=rejected.len() {
+                let mut filter = new_filter(options.clone());
+                write_all(&mut filter, &chunks[..split]);
+                write_all(&mut filter, &rejected[..n]);
+                filter.rollback(n).unwrap();
+                let mut got = write_all(&mut filter, &chunks[split..]);
+                got.extend(filter.flush_partials());
+                assert_eq!(got, want, "split at {split}, {n} rejected");
+            }
+        }
+
+        let mut filter = new_filter(options);
+        write_all(&mut filter, &chunks[..2]);
+        let err = filter.rollback(3).unwrap_err();
+        assert!(matches!(err, MelodyError::RollbackOutOfWindow(3, 2)));
+        write_all(&mut filter, &chunks[2..]);
+        let err = filter.rollback(4).unwrap_err();
+        assert!(matches!(err, MelodyError::RollbackOutOfWindow(4, 3)));
+        assert!(filter.rollback(0).is_ok());
+    }
+
+    #[test]
+    fn test_restore_filter_rejects_newer_state() {
+        let mut state = new_filter(FilterOptions::new()).save_state();
+        state.version = FILTER_STATE_VERSION + 1;
+        let data = state.to_json().unwrap();
+        let err = restore_filter(FilterOptions::new(), &data).err().unwrap();
+        assert!(matches!(err, MelodyError::UnsupportedFilterState(2, 1)));
+
+        assert!(restore_filter(FilterOptions::new(), b"{}").is_err());
+    }
+}
@@ -5,7 +5,7 @@
 
 #[cfg(feature = "python_ffi")]
 use pyo3::prelude::*;
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
 
 /// Token IDs paired with their log probabilities.
 ///
@@ -13,6 +13,9 @@ use serde::Deserialize;
 /// log probability scores from the language model. Log probabilities are useful for
 /// understanding model confidence and implementing features like token filtering.
 ///
+/// Build it with `from_tokens` rather than a struct literal, which breaks whenever a
+/// field is added, as `top_logprobs` was.
+///
 /// # Examples
 ///
 /// ```rust
@@ -21,20 +24,22 @@ use serde::Deserialize;
 /// let mut logprobs = TokenIDsWithLogProb::new();
 /// assert!(logprobs.token_ids.is_empty());
 ///
-/// let other = TokenIDsWithLogProb {
-///     token_ids: vec![1, 2, 3],
-///     logprobs: vec![-0.1, -0.2, -0.3],
-/// };
+/// let other = TokenIDsWithLogProb::from_tokens(vec![1, 2, 3], vec![-0.1, -0.2, -0.3]);
 /// logprobs.append(other);
 /// assert_eq!(logprobs.token_ids.len(), 3);
 /// ```
 #[cfg_attr(feature = "python_ffi", pyclass(get_all))]
-#[derive(Default, Debug, Clone, PartialEq)]
+#[derive(Default, Debug, Clone, PartialEq, Serialize, Deserialize)]
 pub struct TokenIDsWithLogProb {
     /// Token IDs from the model's vocabulary
     pub token_ids: Vec<u32>,
     /// Log probability scores for each token (same length as `token_ids`)
     pub logprobs: Vec<f32>,
+    /// The most likely alternatives of each token, for OpenAI-style `top_logprobs`.
+    /// Either empty or the same length as `token_ids`, if every token was written with
+    /// its alternatives.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub top_logprobs: Vec<TopLogProbs>,
 }
 
 impl TokenIDsWithLogProb {
@@ -54,16 +59,81 @@ impl TokenIDsWithLogProb {
         Self {
             token_ids: Vec::new(),
             logprobs: Vec::new(),
+            top_logprobs: Vec::new(),
+        }
+    }
+
+    /// Creates a `TokenIDsWithLogProb` of tokens and their log probabilities, without
+    /// alternatives.
+    ///
+    /// # Examples
+    ///
+    /// ```rust
+    /// use cohere_melody::parsing::types::TokenIDsWithLogProb;
+    ///
+    /// let logprobs = TokenIDsWithLogProb::from_tokens(vec![1, 2], vec![-0.1, -0.2]);
+    /// assert_eq!(logprobs.token_ids, vec![1, 2]);
+    /// assert!(logprobs.top_logprobs.is_empty());
+    /// ```
+    #[must_use]
+    pub fn from_tokens(token_ids: Vec<u32>, logprobs: Vec<f32>) -> Self {
+        Self {
+            token_ids,
+            logprobs,
+            top_logprobs: Vec::new(),
         }
     }
 
-    /// Appends another `TokenIDsWithLogProb` to this one, extending both vectors.
+    /// Sets the most likely alternatives of each token, see `top_logprobs`.
+    #[must_use]
+    pub fn with_top_logprobs(mut self, top_logprobs: Vec<TopLogProbs>) -> Self {
+        self.top_logprobs = top_logprobs;
+        self
+    }
+
+    /// Appends another `TokenIDsWithLogProb` to this one, extending its vectors.
     pub fn append(&mut self, other: TokenIDsWithLogProb) {
         self.token_ids.extend(other.token_ids);
         self.logprobs.extend(other.logprobs);
+        self.top_logprobs.extend(other.top_logprobs);
+    }
+
+    /// Splits off the tokens from index `at` on, keeping the first `at` tokens. Log
+    /// probabilities missing for some tokens are split at the same index.
+    pub(crate) fn split_off(&mut self, at: usize) -> Self {
+        let split = |len: usize| at.min(len);
+        Self {
+            token_ids: self.token_ids.split_off(split(self.token_ids.len())),
+            logprobs: self.logprobs.split_off(split(self.logprobs.len())),
+            top_logprobs: self.top_logprobs.split_off(split(self.top_logprobs.len())),
+        }
     }
 }
 
+/// The top-k alternatives of a sampled token and their log probabilities.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::types::{TokenIDsWithLogProb, TopLogProbs};
+///
+/// let logprobs = TokenIDsWithLogProb::from_tokens(vec![7], vec![-0.1]).with_top_logprobs(vec![
+///     TopLogProbs {
+///         token_ids: vec![7, 9],
+///         logprobs: vec![-0.1, -2.5],
+///     },
+/// ]);
+/// assert_eq!(logprobs.top_logprobs[0].token_ids[1], 9);
+/// ```
+#[cfg_attr(feature = "python_ffi", pyclass(get_all))]
+#[derive(Default, Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct TopLogProbs {
+    /// Token IDs of the alternatives, most likely first
+    pub token_ids: Vec<u32>,
+    /// Log probability of each alternative (same length as `token_ids`)
+    pub logprobs: Vec<f32>,
+}
+
 /// A parsed output chunk from the streaming filter.
 ///
 /// This is the primary output structure returned when processing tokens. Each call to
@@ -79,6 +149,7 @@ impl TokenIDsWithLogProb {
 /// - `tool_call_delta`: Incremental tool call updates (if parsing tool calls)
 /// - `is_post_answer`: True if this is content after an "Answer:" marker
 /// - `is_reasoning`: True if this is content from a thinking/reasoning block
+/// - `plan_index`: Index of the thinking block of reasoning content
 ///
 /// # Examples
 ///
@@ -109,6 +180,59 @@ pub struct FilterOutput {
     pub is_post_answer: bool,
     /// True if this content is from a thinking/reasoning block
     pub is_reasoning: bool,
+    /// Index of the thinking block of reasoning content, counting from 0. Agentic loops
+    /// emit several thinking blocks in a completion, the citation indices of each start
+    /// at 0.
+    pub plan_index: usize,
+    /// True if this content is an echoed prompt token rather than completion output,
+    /// see `with_prompt_echo`
+    pub is_echo: bool,
+    /// Why the stream ended, set only on the terminal output when
+    /// `with_finish_reason` is enabled
+    pub finish: Option<FilterFinish>,
+    /// Indices of the documents of a "Relevant Documents:" line, empty for "None", see
+    /// `stream_document_selections`
+    pub relevant_doc_indices: Option<Vec<usize>>,
+    /// Indices of the documents of a "Cited Documents:" line, empty for "None", see
+    /// `stream_document_selections`
+    pub cited_doc_indices: Option<Vec<usize>>,
+}
+
+/// Why a filter stream ended.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::types::{FilterFinish, FinishReason};
+///
+/// let finish = FilterFinish {
+///     reason: FinishReason::ExclusiveStop,
+///     stop_sequence: "\n\n".to_string(),
+/// };
+/// assert_eq!(finish.reason, FinishReason::ExclusiveStop);
+/// ```
+#[cfg_attr(feature = "python_ffi", pyclass(get_all))]
+#[derive(Debug, Clone, PartialEq)]
+pub struct FilterFinish {
+    /// The reason the stream ended
+    pub reason: FinishReason,
+    /// The stop sequence or special token that ended the stream, empty on `Flush`
+    pub stop_sequence: String,
+}
+
+/// Reason a filter stream ended.
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+#[cfg_attr(feature = "python_ffi", pyclass(eq, eq_int))]
+pub enum FinishReason {
+    /// An inclusive stop sequence was found
+    InclusiveStop,
+    /// An exclusive stop sequence was found
+    ExclusiveStop,
+    /// A special token mapped to a stop mode was found, e.g. the end of a
+    /// fill-in-the-middle completion
+    EndOfSequence,
+    /// `flush_partials` was called before any stop
+    Flush,
 }
 
 /// An incremental update to a search query being parsed.
@@ -213,12 +337,13 @@ pub struct FilterToolParameter {
 ///     sources: vec![Source {
 ///         tool_call_index: 0,
 ///         tool_result_indices: vec![0, 1],
+///         source_name: None,
 ///     }],
 ///     is_thinking: false,
 /// };
 /// assert_eq!(citation.text, "world");
 /// ```
-#[derive(Debug, Clone, PartialEq, Deserialize)]
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
 #[cfg_attr(feature = "python_ffi", pyclass(get_all))]
 pub struct FilterCitation {
     /// Character index where the citation starts in the overall text output.
@@ -248,16 +373,96 @@ pub struct FilterCitation {
 /// let source = Source {
 ///     tool_call_index: 0,
 ///     tool_result_indices: vec![0, 1, 2],
+///     source_name: None,
 /// };
 /// // This means the citation references results 0, 1, and 2 from tool call 0
 /// ```
-#[derive(Debug, Clone, PartialEq, Deserialize)]
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
 #[cfg_attr(feature = "python_ffi", pyclass(get_all))]
 pub struct Source {
     /// Index of the tool call that produced these results
     pub tool_call_index: usize,
     /// Indices of specific results from this tool call
     pub tool_result_indices: Vec<usize>,
+    /// Name of the cited tool, set instead of `tool_call_index` by citations keyed by
+    /// name in the `CitationSourceFormat::ToolName` format
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub source_name: Option<String>,
+}
+
+/// Unit of the citation `start_index` and `end_index` in the text output.
+#[derive(Debug, Copy, Clone, Default, PartialEq, Eq)]
+#[cfg_attr(feature = "python_ffi", pyclass(eq, eq_int))]
+pub enum CitationIndexUnit {
+    /// Unicode scalar values (Rust `char`s, Go runes)
+    #[default]
+    Runes,
+    /// Extended grapheme clusters, the characters a user perceives
+    Graphemes,
+    /// UTF-16 code units, as used by JavaScript string indices
+    Utf16,
+    /// UTF-8 bytes
+    Bytes,
+}
+
+/// Format of the sources of Command 3 citations, e.g. `0:[1,2]` in `</co: 0:[1,2]>`.
+#[derive(Debug, Copy, Clone, Default, PartialEq, Eq)]
+#[cfg_attr(feature = "python_ffi", pyclass(eq, eq_int))]
+pub enum CitationSourceFormat {
+    /// Sources are keyed by the index of the tool call, `</co: 0:[2]>`
+    #[default]
+    ToolIndex,
+    /// Sources are keyed by the name of the tool, `</co: web_search:[2]>`, which is set as
+    /// the `source_name` of the sources. Numeric keys are still read as tool call indices.
+    ToolName,
+}
+
+/// Where a conditional stop ends the stream, see `FilterOptions::with_conditional_stops`.
+#[derive(Debug, Copy, Clone, Default, PartialEq, Eq)]
+#[cfg_attr(feature = "python_ffi", pyclass(eq, eq_int))]
+pub enum StopContext {
+    /// Only in the text of the response, outside of markdown code fences
+    #[default]
+    PlainText,
+    /// Anywhere but in a tool action, the tool calls and their parameters
+    NotInAction,
+    /// Anywhere but in the reasoning
+    NotInThinking,
+}
+
+/// An exclusive stop that only ends the stream in a context, e.g. a blocked phrase that
+/// is allowed in code.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::parsing::types::{ConditionalStop, StopContext};
+///
+/// let stop = ConditionalStop {
+///     stop: "rm -rf".to_string(),
+///     context: StopContext::PlainText,
+/// };
+/// ```
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ConditionalStop {
+    /// The stop sequence, excluded from the output
+    pub stop: String,
+    /// Where the stop ends the stream
+    pub context: StopContext,
+}
+
+/// Unicode normalization form of the emitted text.
+#[derive(Debug, Copy, Clone, Default, PartialEq, Eq)]
+#[cfg_attr(feature = "python_ffi", pyclass(eq, eq_int))]
+pub enum UnicodeNormalization {
+    /// The text is emitted as decoded
+    #[default]
+    None,
+    /// Canonical composition, e.g. "e" followed by a combining acute accent becomes "é"
+    Nfc,
+    /// Compatibility composition, which also folds compatibility characters, e.g. the
+    /// ligature "ﬁ" becomes "fi"
+    Nfkc,
 }
 
 /// Parsing mode for the filter state machine.
@@ -265,7 +470,7 @@ pub struct Source {
 /// The filter uses a state machine that transitions between different modes based on
 /// special tokens encountered in the stream. Each mode determines how subsequent
 /// tokens are processed.
-#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+#[derive(Debug, Copy, Clone, PartialEq, Eq, Serialize, Deserialize)]
 #[cfg_attr(feature = "python_ffi", pyclass(eq, eq_int))]
 pub enum FilterMode {
     /// Output all text without special processing
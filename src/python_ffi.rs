@@ -3,18 +3,75 @@
 //! This module provides Python bindings using `PyO3`, allowing the Melody parser
 //! to be used directly from Python code.
 
-use crate::parsing::types::{FilterOutput, TokenIDsWithLogProb};
-use crate::parsing::{Filter, FilterImpl, FilterOptions, new_filter};
+use crate::parsing::json::FilterConfig;
+use crate::parsing::types::{
+    CitationIndexUnit, CitationSourceFormat, FilterCitation, FilterMode, FilterOutput,
+    FinishReason, TokenIDsWithLogProb, UnicodeNormalization,
+};
+use crate::parsing::{Filter, FilterImpl, FilterOptions, SafeFilter, new_safe_filter_with_state};
+use crate::templating::{RenderCmd3Options, RenderCmd4Options, render_cmd3, render_cmd4};
+use pyo3::exceptions::PyValueError;
 use pyo3::prelude::*;
+use serde_json::Value;
+use std::collections::HashMap;
+use std::sync::OnceLock;
+use tokenizers::tokenizer::Tokenizer;
+
+/// A tokenizer embedded in the module, parsed the first time a filter uses it.
+struct EmbeddedTokenizer {
+    id: &'static str,
+    bytes: &'static [u8],
+    tokenizer: OnceLock<Option<Tokenizer>>,
+}
+
+/// The tokenizers that `PyFilter.with_tokenizer` can select by ID.
+static EMBEDDED_TOKENIZERS: [EmbeddedTokenizer; 1] = [EmbeddedTokenizer {
+    id: "multilingual+255k+bos+eos+sptok+fim+agents3",
+    bytes: include_bytes!("../tokenizers/data/multilingual+255k+bos+eos+sptok+fim+agents3.json"),
+    tokenizer: OnceLock::new(),
+}];
+
+fn embedded_tokenizer(id: &str) -> PyResult<&'static Tokenizer> {
+    let embedded = EMBEDDED_TOKENIZERS
+        .iter()
+        .find(|t| t.id == id)
+        .ok_or_else(|| {
+            let ids: Vec<&str> = EMBEDDED_TOKENIZERS.iter().map(|t| t.id).collect();
+            PyValueError::new_err(format!(
+                "unknown tokenizer '{id}', expected one of: {}",
+                ids.join(", ")
+            ))
+        })?;
+    embedded
+        .tokenizer
+        .get_or_init(|| Tokenizer::from_bytes(embedded.bytes).ok())
+        .as_ref()
+        .ok_or_else(|| PyValueError::new_err(format!("failed to load tokenizer '{id}'")))
+}
 
 /// Python wrapper for the streaming filter.
 ///
 /// This class provides the main interface for parsing model outputs from Python.
 /// Create an instance with `PyFilterOptions` and then call `write_decoded` for
 /// each token as it arrives.
-#[pyclass]
+///
+/// A filter parses a single token stream. It is safe to call from several Python
+/// threads, calls are serialized, but the tokens must still be written in order.
+#[pyclass(frozen)]
 struct PyFilter {
-    inner: FilterImpl,
+    /// The filter, with the history of the tokens written to it under its lock so the
+    /// history matches the order the filter sees the tokens in
+    inner: SafeFilter<PyFilterHistory>,
+    /// Tokenizer decoding the token IDs given to `write_token`
+    tokenizer: Option<&'static Tokenizer>,
+}
+
+#[derive(Default)]
+struct PyFilterHistory {
+    /// Every decoded token written to the filter, in order
+    raw_tokens: Vec<String>,
+    /// Token IDs and log probabilities held back until they decode to complete UTF-8
+    pending: TokenIDsWithLogProb,
 }
 
 #[pymethods]
@@ -30,10 +87,30 @@ impl PyFilter {
     #[new]
     fn new(opts: &PyFilterOptions) -> Self {
         PyFilter {
-            inner: new_filter(opts.inner.clone()),
+            inner: new_safe_filter_with_state(opts.inner.clone(), PyFilterHistory::default()),
+            tokenizer: None,
         }
     }
 
+    /// Create a new filter that accepts token IDs, decoded with an embedded tokenizer.
+    ///
+    /// Args:
+    ///     opts: `PyFilterOptions` instance with desired configuration
+    ///     `tokenizer_id`: ID of the embedded tokenizer, e.g.
+    ///         "multilingual+255k+bos+eos+sptok+fim+agents3"
+    ///
+    /// Returns:
+    ///     A new `PyFilter` instance
+    ///
+    /// Raises:
+    ///     `ValueError`: If the tokenizer ID is unknown
+    #[staticmethod]
+    fn with_tokenizer(opts: &PyFilterOptions, tokenizer_id: &str) -> PyResult<Self> {
+        let mut filter = PyFilter::new(opts);
+        filter.tokenizer = Some(embedded_tokenizer(tokenizer_id)?);
+        Ok(filter)
+    }
+
     /// Process a decoded token and return any completed outputs.
     ///
     /// Args:
@@ -44,9 +121,52 @@ impl PyFilter {
     ///
     /// Note:
     ///     Log probabilities are not currently supported in the Python API
-    fn write_decoded(&mut self, decoded_token: &str) -> Vec<FilterOutput> {
-        self.inner
-            .write_decoded(decoded_token, TokenIDsWithLogProb::new())
+    fn write_decoded(&self, decoded_token: &str) -> Vec<FilterOutput> {
+        self.inner.with_state(|filter, history| {
+            write(filter, history, decoded_token, TokenIDsWithLogProb::new())
+        })
+    }
+
+    /// Process a token ID and return any completed outputs.
+    ///
+    /// Tokens that decode to an incomplete UTF-8 sequence, such as the first
+    /// bytes of an emoji, are held back until the sequence is complete.
+    ///
+    /// Args:
+    ///     `token_id`: The token ID sampled by the model
+    ///     logprob: The log probability of the token
+    ///
+    /// Returns:
+    ///     List of `FilterOutput` objects (may be empty if content is buffered)
+    ///
+    /// Raises:
+    ///     `ValueError`: If the filter was not created with `with_tokenizer`, or the
+    ///         token ID cannot be decoded
+    fn write_token(&self, token_id: u32, logprob: f32) -> PyResult<Vec<FilterOutput>> {
+        let Some(tokenizer) = self.tokenizer else {
+            return Err(PyValueError::new_err(
+                "write_token requires a filter created with with_tokenizer",
+            ));
+        };
+        self.inner.with_state(|filter, history| {
+            history.pending.token_ids.push(token_id);
+            history.pending.logprobs.push(logprob);
+            let decoded = match tokenizer.decode(&history.pending.token_ids, false) {
+                Ok(decoded) => decoded,
+                Err(e) => {
+                    history.pending.token_ids.pop();
+                    history.pending.logprobs.pop();
+                    return Err(PyValueError::new_err(format!(
+                        "failed to decode token {token_id}: {e}"
+                    )));
+                }
+            };
+            if decoded.ends_with(char::REPLACEMENT_CHARACTER) {
+                return Ok(Vec::new());
+            }
+            let logprobs = std::mem::take(&mut history.pending);
+            Ok(write(filter, history, &decoded, logprobs))
+        })
     }
 
     /// Flush any buffered partial outputs.
@@ -56,11 +176,118 @@ impl PyFilter {
     ///
     /// Returns:
     ///     List of remaining `FilterOutput` objects
-    fn flush_partials(&mut self) -> Vec<FilterOutput> {
-        self.inner.flush_partials()
+    ///
+    /// Raises:
+    ///     `ValueError`: If the token IDs held back by `write_token` cannot be
+    ///         decoded, they are then discarded and the filter is not flushed
+    fn flush_partials(&self) -> PyResult<Vec<FilterOutput>> {
+        self.inner.with_state(|filter, history| {
+            let mut out = Vec::new();
+            if let Some(tokenizer) = self.tokenizer
+                && !history.pending.token_ids.is_empty()
+            {
+                let logprobs = std::mem::take(&mut history.pending);
+                let decoded = tokenizer.decode(&logprobs.token_ids, false).map_err(|e| {
+                    PyValueError::new_err(format!(
+                        "failed to decode tokens {:?}: {e}",
+                        logprobs.token_ids
+                    ))
+                })?;
+                out = write(filter, history, &decoded, logprobs);
+            }
+            out.append(&mut filter.flush_partials());
+            Ok(out)
+        })
+    }
+
+    /// Get every decoded token written to the filter.
+    ///
+    /// Returns:
+    ///     List of the decoded tokens, in the order they were written
+    fn raw_tokens(&self) -> Vec<String> {
+        self.inner
+            .with_state(|_, history| history.raw_tokens.clone())
+    }
+
+    /// Get the full text written to the filter, before any parsing.
+    ///
+    /// Returns:
+    ///     The decoded tokens concatenated, including special tokens
+    fn accumulated_text(&self) -> String {
+        self.inner
+            .with_state(|_, history| history.raw_tokens.concat())
     }
 }
 
+/// Writes a decoded token to the filter, recording it in the history
+fn write(
+    filter: &mut FilterImpl,
+    history: &mut PyFilterHistory,
+    decoded_token: &str,
+    logprobs: TokenIDsWithLogProb,
+) -> Vec<FilterOutput> {
+    history.raw_tokens.push(decoded_token.to_string());
+    filter.write_decoded(decoded_token, logprobs)
+}
+
+/// Create a new filter that accepts token IDs, decoded with an embedded tokenizer.
+///
+/// Args:
+///     options: `PyFilterOptions` instance with desired configuration
+///     `tokenizer_id`: ID of the embedded tokenizer
+///
+/// Returns:
+///     A new `PyFilter` instance
+#[pyfunction]
+fn new_filter_with_tokenizer(options: &PyFilterOptions, tokenizer_id: &str) -> PyResult<PyFilter> {
+    PyFilter::with_tokenizer(options, tokenizer_id)
+}
+
+/// Process a token ID with a filter created by `new_filter_with_tokenizer`.
+///
+/// Args:
+///     filter: The `PyFilter` to write to
+///     `token_id`: The token ID sampled by the model
+///     logprob: The log probability of the token
+///
+/// Returns:
+///     List of `FilterOutput` objects (may be empty if content is buffered)
+#[pyfunction]
+#[allow(clippy::needless_pass_by_value)]
+fn write_token(
+    filter: PyRef<PyFilter>,
+    token_id: u32,
+    logprob: f32,
+) -> PyResult<Vec<FilterOutput>> {
+    filter.write_token(token_id, logprob)
+}
+
+/// Get every decoded token written to a filter.
+///
+/// Args:
+///     filter: The `PyFilter` to read the tokens of
+///
+/// Returns:
+///     List of the decoded tokens, in the order they were written
+#[pyfunction]
+#[allow(clippy::needless_pass_by_value)]
+fn get_raw_tokens(filter: PyRef<PyFilter>) -> Vec<String> {
+    filter.raw_tokens()
+}
+
+/// Get the full text written to a filter, before any parsing.
+///
+/// Args:
+///     filter: The `PyFilter` to read the text of
+///
+/// Returns:
+///     The decoded tokens concatenated, including special tokens
+#[pyfunction]
+#[allow(clippy::needless_pass_by_value)]
+fn get_accumulated_text(filter: PyRef<PyFilter>) -> String {
+    filter.accumulated_text()
+}
+
 /// Python wrapper for filter configuration options.
 ///
 /// This class provides a builder pattern for configuring filter behavior.
@@ -83,6 +310,29 @@ impl PyFilterOptions {
         }
     }
 
+    /// Create options from a filter configuration.
+    ///
+    /// Args:
+    ///     config: Dict with the names of the `options` to apply, e.g. `["cmd3"]`, and
+    ///         optional `inclusive_stops`, `exclusive_stops` and `prefix_trim`, in the
+    ///         shape of the conformance test `input.json` files
+    ///
+    /// Returns:
+    ///     A new `PyFilterOptions` instance
+    ///
+    /// Raises:
+    ///     `ValueError`: If the configuration is invalid or names an unknown option
+    #[staticmethod]
+    fn from_config(config: &Bound<'_, PyAny>) -> PyResult<Self> {
+        let json = dict_json(config, "filter config")?;
+        let config: FilterConfig = serde_path_to_error::deserialize(&json)
+            .map_err(|e| PyValueError::new_err(format!("invalid filter config: {e}")))?;
+        let inner = config
+            .options()
+            .map_err(|e| PyValueError::new_err(e.to_string()))?;
+        Ok(PyFilterOptions { inner })
+    }
+
     /// Configure for Cohere Command 3 model format.
     ///
     /// Enables grounded answer parsing, tool action streaming, and Command 3-style citations.
@@ -105,6 +355,152 @@ impl PyFilterOptions {
         slf
     }
 
+    /// Add or remap special tokens.
+    ///
+    /// The tokens are merged into the configured special tokens rather than
+    /// replacing them.
+    ///
+    /// Args:
+    ///     `token_map`: Dict of special token string to `FilterMode`
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_special_token_map(
+        mut slf: PyRefMut<Self>,
+        token_map: HashMap<String, FilterMode>,
+    ) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_special_token_map(token_map);
+        slf
+    }
+
+    /// Set the unit of citation start and end indices.
+    ///
+    /// Args:
+    ///     unit: `CitationIndexUnit`, runes by default
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_citation_index_unit(
+        mut slf: PyRefMut<Self>,
+        unit: CitationIndexUnit,
+    ) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_citation_index_unit(unit);
+        slf
+    }
+
+    /// Set the format of the sources of Command 3 citations.
+    ///
+    /// Args:
+    ///     format: `CitationSourceFormat`, tool call indices by default
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_citation_source_format(
+        mut slf: PyRefMut<Self>,
+        format: CitationSourceFormat,
+    ) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_citation_source_format(format);
+        slf
+    }
+
+    /// Set the Unicode normalization form of the emitted text.
+    ///
+    /// Args:
+    ///     form: `UnicodeNormalization`, the text is emitted as decoded by default
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_unicode_normalization(
+        mut slf: PyRefMut<Self>,
+        form: UnicodeNormalization,
+    ) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_unicode_normalization(form);
+        slf
+    }
+
+    /// Emit a terminal output reporting why the stream ended.
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_finish_reason(mut slf: PyRefMut<Self>) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_finish_reason();
+        slf
+    }
+
+    /// Emit the document indices of "Relevant Documents:" and "Cited Documents:" lines.
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn stream_document_selections(mut slf: PyRefMut<Self>) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).stream_document_selections();
+        slf
+    }
+
+    /// Pass the first tokens through unparsed as echoed prompt tokens.
+    ///
+    /// Args:
+    ///     prompt_token_count: Number of prompt tokens streamed before the completion
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_prompt_echo(mut slf: PyRefMut<Self>, prompt_token_count: usize) -> PyRefMut<Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_prompt_echo(prompt_token_count);
+        slf
+    }
+
+    /// Continue a response that starts with a prefix already shown to the user.
+    ///
+    /// Args:
+    ///     prefix: The beginning of the response rendered in the prompt
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_response_prefix<'a>(mut slf: PyRefMut<'a, Self>, prefix: &str) -> PyRefMut<'a, Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_response_prefix(prefix);
+        slf
+    }
+
+    /// Strip the healed text of a response prefix the completion starts by repeating.
+    ///
+    /// Args:
+    ///     healed: The last token of the prefix, left out of the rendered prompt
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_healed_prefix<'a>(mut slf: PyRefMut<'a, Self>, healed: &str) -> PyRefMut<'a, Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_healed_prefix(healed);
+        slf
+    }
+
+    /// Drop a prefix from the start of the completion, if it starts with it.
+    ///
+    /// Args:
+    ///     prefix: The text to drop, e.g. a label the model repeats from the prompt
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_prefix_trim<'a>(mut slf: PyRefMut<'a, Self>, prefix: &str) -> PyRefMut<'a, Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_prefix_trim(prefix);
+        slf
+    }
+
+    /// Resume a truncated response from the text and citations already emitted.
+    ///
+    /// Args:
+    ///     prior_text: The text of the response already emitted
+    ///     prior_citations: The citations already emitted, repeats of them are dropped
+    ///
+    /// Returns:
+    ///     Self (for method chaining)
+    fn with_resume_state<'a>(
+        mut slf: PyRefMut<'a, Self>,
+        prior_text: &str,
+        prior_citations: Vec<FilterCitation>,
+    ) -> PyRefMut<'a, Self> {
+        slf.inner = std::mem::take(&mut slf.inner).with_resume_state(prior_text, prior_citations);
+        slf
+    }
+
     /// Remove a special token from the configuration.
     ///
     /// Args:
@@ -118,9 +514,69 @@ impl PyFilterOptions {
     }
 }
 
+/// Converts a Python dict to JSON, the format the render options and filter
+/// configurations deserialize from. `what` names the dict in errors.
+fn dict_json(dict: &Bound<'_, PyAny>, what: &str) -> PyResult<Value> {
+    let dumped: String = dict
+        .py()
+        .import("json")?
+        .call_method1("dumps", (dict,))?
+        .extract()?;
+    serde_json::from_str(&dumped).map_err(|e| PyValueError::new_err(format!("invalid {what}: {e}")))
+}
+
+/// Render a Command 3 prompt.
+///
+/// Args:
+///     options: Dict of `RenderCmd3Options` fields, e.g. `messages`, `documents`
+///         and `available_tools`, in the shape of the templating test `input.json` files
+///
+/// Returns:
+///     The rendered prompt
+///
+/// Raises:
+///     `ValueError`: If the options are invalid or rendering fails
+#[pyfunction(name = "render_cmd3")]
+fn py_render_cmd3(options: &Bound<'_, PyAny>) -> PyResult<String> {
+    let json = dict_json(options, "render options")?;
+    let opts: RenderCmd3Options = serde_path_to_error::deserialize(&json)
+        .map_err(|e| PyValueError::new_err(format!("invalid render options: {e}")))?;
+    render_cmd3(&opts).map_err(|e| PyValueError::new_err(e.to_string()))
+}
+
+/// Render a Command 4 prompt.
+///
+/// Args:
+///     options: Dict of `RenderCmd4Options` fields, e.g. `messages`, `documents`
+///         and `available_tools`, in the shape of the templating test `input.json` files
+///
+/// Returns:
+///     The rendered prompt
+///
+/// Raises:
+///     `ValueError`: If the options are invalid or rendering fails
+#[pyfunction(name = "render_cmd4")]
+fn py_render_cmd4(options: &Bound<'_, PyAny>) -> PyResult<String> {
+    let json = dict_json(options, "render options")?;
+    let opts: RenderCmd4Options = serde_path_to_error::deserialize(&json)
+        .map_err(|e| PyValueError::new_err(format!("invalid render options: {e}")))?;
+    render_cmd4(&opts).map_err(|e| PyValueError::new_err(e.to_string()))
+}
+
 #[pymodule]
 fn cohere_melody(_py: Python<'_>, m: &Bound<'_, PyModule>) -> PyResult<()> {
     m.add_class::<PyFilter>()?;
     m.add_class::<PyFilterOptions>()?;
+    m.add_class::<FilterMode>()?;
+    m.add_class::<CitationIndexUnit>()?;
+    m.add_class::<CitationSourceFormat>()?;
+    m.add_class::<UnicodeNormalization>()?;
+    m.add_class::<FinishReason>()?;
+    m.add_function(wrap_pyfunction!(get_raw_tokens, m)?)?;
+    m.add_function(wrap_pyfunction!(get_accumulated_text, m)?)?;
+    m.add_function(wrap_pyfunction!(new_filter_with_tokenizer, m)?)?;
+    m.add_function(wrap_pyfunction!(write_token, m)?)?;
+    m.add_function(wrap_pyfunction!(py_render_cmd3, m)?)?;
+    m.add_function(wrap_pyfunction!(py_render_cmd4, m)?)?;
     Ok(())
 }
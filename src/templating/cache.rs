@@ -0,0 +1,284 @@
+use crate::errors::MelodyError;
+use crate::templating::extensions::parser;
+use std::collections::BTreeMap;
+use std::hash::{DefaultHasher, Hash, Hasher};
+use std::sync::{Arc, Mutex, PoisonError};
+
+/// Default number of compiled templates kept by the template cache.
+pub const DEFAULT_TEMPLATE_CACHE_CAPACITY: usize = 64;
+
+/// An event of the template cache, passed to the hook set with `set_template_cache_hook`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TemplateCacheEvent {
+    /// A compiled template was found in the cache.
+    Hit,
+    /// A template was not in the cache and was compiled.
+    Miss,
+    /// The least recently used template was evicted to make room for another.
+    Eviction,
+}
+
+/// Counters and size of the template cache.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct TemplateCacheStats {
+    /// Number of compiles served from the cache.
+    pub hits: u64,
+    /// Number of compiles that parsed the template.
+    pub misses: u64,
+    /// Number of templates evicted from the cache.
+    pub evictions: u64,
+    /// Number of templates in the cache.
+    pub len: usize,
+    /// Maximum number of templates in the cache.
+    pub capacity: usize,
+}
+
+type CacheHook = dyn Fn(TemplateCacheEvent) + Send + Sync;
+
+struct CacheEntry {
+    source: String,
+    // The parser the template was compiled with, the entry is stale once filters or tags
+    // are registered and the parser is rebuilt.
+    parser: Arc<liquid::Parser>,
+    template: Arc<liquid::Template>,
+    last_used: u64,
+}
+
+/// An LRU cache of compiled templates keyed by the hash of the template source.
+struct TemplateCache {
+    entries: BTreeMap<u64, CacheEntry>,
+    capacity: usize,
+    tick: u64,
+    stats: TemplateCacheStats,
+    hook: Option<Arc<CacheHook>>,
+}
+
+static TEMPLATE_CACHE: Mutex<TemplateCache> =
+    Mutex::new(TemplateCache::new(DEFAULT_TEMPLATE_CACHE_CAPACITY));
+
+impl TemplateCache {
+    const fn new(capacity: usize) -> Self {
+        TemplateCache {
+            entries: BTreeMap::new(),
+            capacity,
+            tick: 0,
+            stats: TemplateCacheStats {
+                hits: 0,
+                misses: 0,
+                evictions: 0,
+                len: 0,
+                capacity,
+            },
+            hook: None,
+        }
+    }
+
+    fn get(
+        &mut self,
+        key: u64,
+        source: &str,
+        parser: &Arc<liquid::Parser>,
+    ) -> Option<Arc<liquid::Template>> {
+        self.tick += 1;
+        let entry = self.entries.get_mut(&key)?;
+        if entry.source != source || !Arc::ptr_eq(&entry.parser, parser) {
+            return None;
+        }
+        entry.last_used = self.tick;
+        self.stats.hits += 1;
+        Some(Arc::clone(&entry.template))
+    }
+
+    /// Inserts a compiled template and returns the number of evicted templates.
+    fn insert(
+        &mut self,
+        key: u64,
+        source: &str,
+        parser: Arc<liquid::Parser>,
+        template: Arc<liquid::Template>,
+    ) -> usize {
+        self.stats.misses += 1;
+        if self.capacity == 0 {
+            return 0;
+        }
+        self.entries.insert(
+            key,
+            CacheEntry {
+                source: source.to_string(),
+                parser,
+                template,
+                last_used: self.tick,
+            },
+        );
+        self.evict()
+    }
+
+    /// Evicts least recently used templates until the cache is within its capacity.
+    fn evict(&mut self) -> usize {
+        let mut evicted = 0;
+        while self.entries.len() > self.capacity {
+            let Some(oldest) = self
+                .entries
+                .iter()
+                .min_by_key(|(_, e)| e.last_used)
+                .map(|(k, _)| *k)
+            else {
+                break;
+            };
+            self.entries.remove(&oldest);
+            evicted += 1;
+        }
+        self.stats.evictions += evicted as u64;
+        evicted
+    }
+
+    fn stats(&self) -> TemplateCacheStats {
+        TemplateCacheStats {
+            len: self.entries.len(),
+            capacity: self.capacity,
+            ..self.stats
+        }
+    }
+}
+
+fn lock_cache() -> std::sync::MutexGuard<'static, TemplateCache> {
+    TEMPLATE_CACHE
+        .lock()
+        .unwrap_or_else(PoisonError::into_inner)
+}
+
+fn notify(hook: Option<&Arc<CacheHook>>, event: TemplateCacheEvent, count: usize) {
+    if let Some(hook) = hook {
+        for _ in 0..count {
+            hook(event);
+        }
+    }
+}
+
+/// Compiles a template with the shared template engine.
+///
+/// Compiled templates are cached by the hash of their source, so rendering the
+/// same template again skips parsing it. `render_cmd3` and `render_cmd4` compile
+/// their templates through this cache.
+///
+/// # Errors
+///
+/// Returns a `MelodyError` if the template cannot be parsed.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::templating::compile_template;
+///
+/// let template = compile_template("Hello {{ name }}").unwrap();
+/// ```
+pub fn compile_template(source: &str) -> Result<Arc<liquid::Template>, MelodyError> {
+    let parser = parser()?;
+    let mut hasher = DefaultHasher::new();
+    source.hash(&mut hasher);
+    let key = hasher.finish();
+
+    let (cached, hook) = {
+        let mut cache = lock_cache();
+        (cache.get(key, source, &parser), cache.hook.clone())
+    };
+    if let Some(template) = cached {
+        notify(hook.as_ref(), TemplateCacheEvent::Hit, 1);
+        return Ok(template);
+    }
+
+    let template = Arc::new(parser.parse(source)?);
+    let evicted = lock_cache().insert(key, source, parser, Arc::clone(&template));
+    notify(hook.as_ref(), TemplateCacheEvent::Miss, 1);
+    notify(hook.as_ref(), TemplateCacheEvent::Eviction, evicted);
+    Ok(template)
+}
+
+/// Sets the maximum number of compiled templates kept by the template cache.
+///
+/// Least recently used templates are evicted when the cache is shrunk. A
+/// capacity of 0 disables caching.
+pub fn set_template_cache_capacity(capacity: usize) {
+    let (evicted, hook) = {
+        let mut cache = lock_cache();
+        cache.capacity = capacity;
+        (cache.evict(), cache.hook.clone())
+    };
+    notify(hook.as_ref(), TemplateCacheEvent::Eviction, evicted);
+}
+
+/// Sets a hook that is called for every hit, miss and eviction of the template cache,
+/// e.g. to export cache metrics. The hook replaces any previously set hook.
+pub fn set_template_cache_hook<F>(hook: F)
+where
+    F: Fn(TemplateCacheEvent) + Send + Sync + 'static,
+{
+    lock_cache().hook = Some(Arc::new(hook));
+}
+
+/// Returns the counters and size of the template cache.
+#[must_use]
+pub fn template_cache_stats() -> TemplateCacheStats {
+    lock_cache().stats()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn compile(cache: &mut TemplateCache, parser: &Arc<liquid::Parser>, source: &str) -> bool {
+        let key = source.len() as u64;
+        if cache.get(key, source, parser).is_some() {
+            return true;
+        }
+        let template = Arc::new(parser.parse(source).unwrap());
+        cache.insert(key, source, Arc::clone(parser), template);
+        false
+    }
+
+    #[test]
+    fn test_template_cache_hits_and_evicts_lru() {
+        let parser = parser().unwrap();
+        let mut cache = TemplateCache::new(2);
+
+        assert!(!compile(&mut cache, &parser, "a"));
+        assert!(!compile(&mut cache, &parser, "bb"));
+        assert!(compile(&mut cache, &parser, "a"));
+        // "bb" is the least recently used and is evicted
+        assert!(!compile(&mut cache, &parser, "ccc"));
+        assert!(compile(&mut cache, &parser, "a"));
+        assert!(!compile(&mut cache, &parser, "bb"));
+
+        assert_eq!(
+            cache.stats(),
+            TemplateCacheStats {
+                hits: 2,
+                misses: 4,
+                evictions: 2,
+                len: 2,
+                capacity: 2,
+            }
+        );
+    }
+
+    #[test]
+    fn test_template_cache_disabled() {
+        let parser = parser().unwrap();
+        let mut cache = TemplateCache::new(0);
+
+        assert!(!compile(&mut cache, &parser, "a"));
+        assert!(!compile(&mut cache, &parser, "a"));
+        assert_eq!(cache.stats().len, 0);
+    }
+
+    #[test]
+    fn test_template_cache_misses_on_new_parser() {
+        let parser = parser().unwrap();
+        let mut cache = TemplateCache::new(2);
+
+        assert!(!compile(&mut cache, &parser, "a"));
+        let rebuilt = Arc::new(liquid::ParserBuilder::with_stdlib().build().unwrap());
+        assert!(!compile(&mut cache, &rebuilt, "a"));
+        assert!(compile(&mut cache, &rebuilt, "a"));
+    }
+}
@@ -0,0 +1,378 @@
+use crate::errors::MelodyError;
+use liquid_core::parser::{FilterArguments, ParameterReflection};
+use liquid_core::{
+    Expression, Filter, FilterReflection, Language, ParseFilter, ParseTag, Renderable, Runtime,
+    TagReflection, TagTokenIter, ValueView,
+};
+use serde_json::Value;
+use std::fmt;
+use std::io::Write;
+use std::sync::{Arc, PoisonError, RwLock};
+
+/// A custom Liquid filter: `{{ input | name: arg1, arg2 }}`.
+///
+/// Receives the input and the positional arguments as JSON and returns the
+/// filtered value, or an error message that fails the render.
+pub type FilterFn = dyn Fn(&Value, &[Value]) -> Result<Value, String> + Send + Sync;
+
+/// A custom Liquid tag: `{% name arg1 arg2 %}`.
+///
+/// Receives the arguments as JSON and returns the text to render in place of
+/// the tag, or an error message that fails the render.
+pub type TagFn = dyn Fn(&[Value]) -> Result<String, String> + Send + Sync;
+
+/// The shared template engine used by all renders.
+///
+/// The parser is built on first use and rebuilt after a filter, tag or partial
+/// is registered, so registration is cheap but should happen before rendering.
+struct Engine {
+    filters: Vec<CustomFilter>,
+    tags: Vec<CustomTag>,
+    // The names and bodies of the partials, in order of registration
+    partials: Vec<(String, String)>,
+    parser: Option<Arc<liquid::Parser>>,
+}
+
+static ENGINE: RwLock<Engine> = RwLock::new(Engine {
+    filters: Vec::new(),
+    tags: Vec::new(),
+    partials: Vec::new(),
+    parser: None,
+});
+
+type Partials = liquid::partials::EagerCompiler<liquid::partials::InMemorySource>;
+
+/// Registers a custom Liquid filter with the shared template engine.
+///
+/// A filter registered with the name of an existing custom filter replaces it.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::templating::register_filter;
+/// use serde_json::Value;
+///
+/// register_filter("shout", |input, _args| {
+///     Ok(Value::String(input.as_str().unwrap_or_default().to_uppercase()))
+/// });
+/// ```
+pub fn register_filter<F>(name: &str, f: F)
+where
+    F: Fn(&Value, &[Value]) -> Result<Value, String> + Send + Sync + 'static,
+{
+    let mut engine = ENGINE.write().unwrap_or_else(PoisonError::into_inner);
+    engine.filters.retain(|c| c.name != name);
+    engine.filters.push(CustomFilter {
+        name: name.to_string(),
+        f: Arc::new(f),
+    });
+    engine.parser = None;
+}
+
+/// Registers a custom Liquid tag with the shared template engine.
+///
+/// A tag registered with the name of an existing custom tag replaces it.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::templating::register_tag;
+///
+/// register_tag("separator", |_args| Ok("---".to_string()));
+/// ```
+pub fn register_tag<F>(name: &str, f: F)
+where
+    F: Fn(&[Value]) -> Result<String, String> + Send + Sync + 'static,
+{
+    let mut engine = ENGINE.write().unwrap_or_else(PoisonError::into_inner);
+    engine.tags.retain(|c| c.name != name);
+    engine.tags.push(CustomTag {
+        name: name.to_string(),
+        f: Arc::new(f),
+    });
+    engine.parser = None;
+}
+
+/// Registers a named partial with the shared template engine, rendered in place
+/// of `{% include 'name' %}` with the variables of the including template.
+///
+/// Partials let template variants share their common parts, e.g. a preamble
+/// per safety mode. A partial registered with the name of an existing partial
+/// replaces it.
+///
+/// # Errors
+///
+/// Returns a `MelodyError` if the body cannot be parsed, the partial is then
+/// not registered.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::templating::register_partial;
+///
+/// register_partial("greeting", "Hello {{ name }}!").unwrap();
+/// ```
+pub fn register_partial(name: &str, body: &str) -> Result<(), MelodyError> {
+    parser()?.parse(body)?;
+    let mut engine = ENGINE.write().unwrap_or_else(PoisonError::into_inner);
+    engine.partials.retain(|(n, _)| n != name);
+    engine.partials.push((name.to_string(), body.to_string()));
+    engine.parser = None;
+    Ok(())
+}
+
+/// Returns the shared parser, building it with the registered filters, tags and partials
+/// if needed.
+pub(crate) fn parser() -> Result<Arc<liquid::Parser>, MelodyError> {
+    if let Some(parser) = &ENGINE.read().unwrap_or_else(PoisonError::into_inner).parser {
+        return Ok(Arc::clone(parser));
+    }
+
+    let mut engine = ENGINE.write().unwrap_or_else(PoisonError::into_inner);
+    if let Some(parser) = &engine.parser {
+        return Ok(Arc::clone(parser));
+    }
+    let mut builder = liquid::ParserBuilder::with_stdlib();
+    for filter in &engine.filters {
+        builder = builder.filter(filter.clone());
+    }
+    for tag in &engine.tags {
+        builder = builder.tag(tag.clone());
+    }
+    let mut partials = Partials::empty();
+    for (name, body) in &engine.partials {
+        partials.add(name, body);
+    }
+    let parser = Arc::new(builder.partials(partials).build()?);
+    engine.parser = Some(Arc::clone(&parser));
+    Ok(parser)
+}
+
+fn to_json(value: &dyn ValueView) -> liquid_core::Result<Value> {
+    serde_json::to_value(value.to_value()).map_err(|e| liquid_core::Error::with_msg(e.to_string()))
+}
+
+fn evaluate_args(args: &[Expression], runtime: &dyn Runtime) -> liquid_core::Result<Vec<Value>> {
+    args.iter()
+        .map(|a| to_json(&a.evaluate(runtime)?.into_owned()))
+        .collect()
+}
+
+#[derive(Clone)]
+struct CustomFilter {
+    name: String,
+    f: Arc<FilterFn>,
+}
+
+impl FilterReflection for CustomFilter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn description(&self) -> &'static str {
+        "Custom filter registered with melody"
+    }
+
+    fn positional_parameters(&self) -> &'static [ParameterReflection] {
+        &[]
+    }
+
+    fn keyword_parameters(&self) -> &'static [ParameterReflection] {
+        &[]
+    }
+}
+
+impl ParseFilter for CustomFilter {
+    fn parse(&self, mut args: FilterArguments<'_>) -> liquid_core::Result<Box<dyn Filter>> {
+        if args.keyword.next().is_some() {
+            return Err(liquid_core::Error::with_msg(format!(
+                "filter {} does not accept keyword arguments",
+                self.name
+            )));
+        }
+        Ok(Box::new(CustomFilterCall {
+            name: self.name.clone(),
+            f: Arc::clone(&self.f),
+            args: args.positional.collect(),
+        }))
+    }
+
+    fn reflection(&self) -> &dyn FilterReflection {
+        self
+    }
+}
+
+struct CustomFilterCall {
+    name: String,
+    f: Arc<FilterFn>,
+    args: Vec<Expression>,
+}
+
+impl fmt::Debug for CustomFilterCall {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("CustomFilterCall")
+            .field("name", &self.name)
+            .field("args", &self.args)
+            .finish_non_exhaustive()
+    }
+}
+
+impl fmt::Display for CustomFilterCall {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.name)
+    }
+}
+
+impl Filter for CustomFilterCall {
+    fn evaluate(
+        &self,
+        input: &dyn ValueView,
+        runtime: &dyn Runtime,
+    ) -> liquid_core::Result<liquid_core::Value> {
+        let input = to_json(input)?;
+        let args = evaluate_args(&self.args, runtime)?;
+        let out = (self.f)(&input, &args)
+            .map_err(|e| liquid_core::Error::with_msg(format!("filter {}: {e}", self.name)))?;
+        liquid_core::model::to_value(&out)
+    }
+}
+
+#[derive(Clone)]
+struct CustomTag {
+    name: String,
+    f: Arc<TagFn>,
+}
+
+impl TagReflection for CustomTag {
+    fn tag(&self) -> &str {
+        &self.name
+    }
+
+    fn description(&self) -> &'static str {
+        "Custom tag registered with melody"
+    }
+}
+
+impl ParseTag for CustomTag {
+    fn parse(
+        &self,
+        arguments: TagTokenIter<'_>,
+        _options: &Language,
+    ) -> liquid_core::Result<Box<dyn Renderable>> {
+        let args = arguments
+            .map(|token| token.expect_value().into_result())
+            .collect::<liquid_core::Result<Vec<_>>>()?;
+        Ok(Box::new(CustomTagCall {
+            name: self.name.clone(),
+            f: Arc::clone(&self.f),
+            args,
+        }))
+    }
+
+    fn reflection(&self) -> &dyn TagReflection {
+        self
+    }
+}
+
+struct CustomTagCall {
+    name: String,
+    f: Arc<TagFn>,
+    args: Vec<Expression>,
+}
+
+impl fmt::Debug for CustomTagCall {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("CustomTagCall")
+            .field("name", &self.name)
+            .field("args", &self.args)
+            .finish_non_exhaustive()
+    }
+}
+
+impl Renderable for CustomTagCall {
+    fn render_to(&self, writer: &mut dyn Write, runtime: &dyn Runtime) -> liquid_core::Result<()> {
+        let args = evaluate_args(&self.args, runtime)?;
+        let out = (self.f)(&args)
+            .map_err(|e| liquid_core::Error::with_msg(format!("tag {}: {e}", self.name)))?;
+        writer
+            .write_all(out.as_bytes())
+            .map_err(|e| liquid_core::Error::with_msg(format!("tag {}: {e}", self.name)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_register_filter_rebuilds_parser() {
+        let before = parser().unwrap();
+        register_filter("test_identity", |input, _args| Ok(input.clone()));
+        let after = parser().unwrap();
+        assert!(!Arc::ptr_eq(&before, &after));
+    }
+
+    #[test]
+    fn test_register_filter_replaces_existing() {
+        register_filter("test_replaced", |_input, _args| Ok(Value::Null));
+        register_filter("test_replaced", |_input, _args| Ok(Value::Bool(true)));
+        let engine = ENGINE.read().unwrap();
+        let filters: Vec<_> = engine
+            .filters
+            .iter()
+            .filter(|f| f.name == "test_replaced")
+            .collect();
+        assert_eq!(filters.len(), 1);
+        assert_eq!((filters[0].f)(&Value::Null, &[]), Ok(Value::Bool(true)));
+    }
+
+    #[test]
+    fn test_render_custom_filter_and_tag() {
+        register_filter("test_shout", |input, args| {
+            let suffix = args.first().and_then(Value::as_str).unwrap_or_default();
+            Ok(Value::String(format!(
+                "{}{suffix}",
+                input.as_str().unwrap_or_default().to_uppercase()
+            )))
+        });
+        register_tag("test_sep", |args| Ok("-".repeat(args.len())));
+
+        let template = parser()
+            .unwrap()
+            .parse("{{ 'hi' | test_shout: '!' }} {% test_sep 1 2 3 %}")
+            .unwrap();
+        let fields = serde_json::Map::new();
+        let out = template.render(&liquid::object!(&fields)).unwrap();
+        assert_eq!(out, "HI! ---");
+    }
+
+    #[test]
+    fn test_register_partial() {
+        register_partial("test_preamble", "old").unwrap();
+        let before = parser().unwrap();
+        register_partial("test_preamble", "You are {{ name }}.").unwrap();
+        assert!(!Arc::ptr_eq(&before, &parser().unwrap()));
+
+        let engine = ENGINE.read().unwrap();
+        let partials: Vec<_> = engine
+            .partials
+            .iter()
+            .filter(|(name, _)| name == "test_preamble")
+            .collect();
+        assert_eq!(partials.len(), 1);
+        assert_eq!(partials[0].1, "You are {{ name }}.");
+    }
+
+    #[test]
+    fn test_render_partial() {
+        register_partial("test_greeting", "Hello {{ name }}!").unwrap();
+        let template = parser()
+            .unwrap()
+            .parse("{% include 'test_greeting' %} Bye.")
+            .unwrap();
+        let mut fields = serde_json::Map::new();
+        fields.insert("name".to_string(), Value::String("Ada".to_string()));
+        let out = template.render(&liquid::object!(&fields)).unwrap();
+        assert_eq!(out, "Hello Ada! Bye.");
+    }
+}
@@ -0,0 +1,86 @@
+use crate::fim::FimFamily;
+use crate::templating::util::escape_special_tokens;
+use serde::Deserialize;
+use std::collections::BTreeMap;
+
+/// Options for fill-in-the-middle rendering.
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(default)]
+#[serde(deny_unknown_fields)]
+pub struct RenderFimOptions {
+    /// Model family to render the prompt for.
+    pub family: FimFamily,
+    /// Special tokens to escape in the prefix and suffix.
+    pub escaped_special_tokens: BTreeMap<String, String>,
+}
+
+/// Renders a fill-in-the-middle prompt asking the model for the text between `prefix`
+/// and `suffix`.
+///
+/// The prompt uses the prefix-suffix-middle layout of the model family, so the
+/// completion is the middle text. It ends with the family's end sentinel, which
+/// `FilterOptions::handle_fim` treats as a stop.
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::templating::{RenderFimOptions, render_fim};
+///
+/// let prompt = render_fim("def add(a, b):\n", "\n    return c\n", &RenderFimOptions::default());
+/// assert!(prompt.ends_with("<|BEGINNING_OF_MIDDLE_FIM_TOKEN|>"));
+/// ```
+#[must_use]
+pub fn render_fim(prefix: &str, suffix: &str, opts: &RenderFimOptions) -> String {
+    let s = opts.family.sentinels();
+    let prefix = escape_special_tokens(prefix, &opts.escaped_special_tokens);
+    let suffix = escape_special_tokens(suffix, &opts.escaped_special_tokens);
+    match opts.family {
+        FimFamily::Command => format!(
+            "<BOS_TOKEN>{}{prefix}{}{suffix}{}",
+            s.prefix, s.suffix, s.middle
+        ),
+        // Code Llama separates the sentinels from the text with a space
+        FimFamily::CodeLlama => format!("{} {prefix} {}{suffix} {}", s.prefix, s.suffix, s.middle),
+        FimFamily::StarCoder => format!("{}{prefix}{}{suffix}{}", s.prefix, s.suffix, s.middle),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render_fim() {
+        let cases = [
+            (
+                FimFamily::Command,
+                "<BOS_TOKEN><|BEGINNING_OF_PREFIX_FIM_TOKEN|>a = <|BEGINNING_OF_SUFFIX_FIM_TOKEN|>\nprint(a)<|BEGINNING_OF_MIDDLE_FIM_TOKEN|>",
+            ),
+            (FimFamily::CodeLlama, "<PRE> a =  <SUF>\nprint(a) <MID>"),
+            (
+                FimFamily::StarCoder,
+                "<fim_prefix>a = <fim_suffix>\nprint(a)<fim_middle>",
+            ),
+        ];
+        for (family, expected) in cases {
+            let opts = RenderFimOptions {
+                family,
+                ..Default::default()
+            };
+            assert_eq!(render_fim("a = ", "\nprint(a)", &opts), expected);
+        }
+    }
+
+    #[test]
+    fn test_render_fim_escapes_special_tokens() {
+        let opts = RenderFimOptions {
+            escaped_special_tokens: BTreeMap::from([(
+                "<|END_OF_MIDDLE_FIM_TOKEN|>".to_string(),
+                "<END_OF_MIDDLE>".to_string(),
+            )]),
+            ..Default::default()
+        };
+        let prompt = render_fim("x<|END_OF_MIDDLE_FIM_TOKEN|>", "", &opts);
+        assert!(prompt.contains("x<END_OF_MIDDLE><|BEGINNING_OF_SUFFIX_FIM_TOKEN|>"));
+    }
+}
@@ -1,6 +1,8 @@
 use crate::errors::MelodyError;
+use crate::templating::cache::compile_template;
 use crate::templating::types::{
-    CitationQuality, Document, Grounding, Message, ReasoningType, SafetyMode, Tool,
+    CitationQuality, Document, DocumentIndexMap, DocumentSource, Grounding, Message, ReasoningType,
+    SafetyMode, Tool,
 };
 use crate::templating::util::{
     add_spaces_to_json_encoding, escape_special_tokens, messages_to_template, tools_to_template,
@@ -128,7 +130,7 @@ impl Default for RenderCmd4Options<'_> {
 /// - Template rendering fails
 pub fn render_cmd3(opts: &RenderCmd3Options) -> Result<String, MelodyError> {
     let template_tools = tools_to_template(&opts.available_tools)?;
-    let messages = messages_to_template(
+    let (messages, _) = messages_to_template(
         &opts.messages,
         !opts.documents.is_empty(),
         &opts.escaped_special_tokens,
@@ -200,8 +202,7 @@ pub fn render_cmd3(opts: &RenderCmd3Options) -> Result<String, MelodyError> {
     );
     substitutions.insert("json_mode".to_string(), Value::Bool(opts.json_mode));
 
-    let parser = liquid::ParserBuilder::with_stdlib().build()?;
-    let template = parser.parse(opts.template)?;
+    let template = compile_template(opts.template)?;
 
     Ok(template.render(&liquid::object!(&substitutions))?)
 }
@@ -216,7 +217,7 @@ pub fn render_cmd3(opts: &RenderCmd3Options) -> Result<String, MelodyError> {
 /// - Template rendering fails
 pub fn render_cmd4(opts: &RenderCmd4Options) -> Result<String, MelodyError> {
     let template_tools = tools_to_template(&opts.available_tools)?;
-    let messages = messages_to_template(
+    let (messages, _) = messages_to_template(
         &opts.messages,
         !opts.documents.is_empty(),
         &opts.escaped_special_tokens,
@@ -272,12 +273,36 @@ pub fn render_cmd4(opts: &RenderCmd4Options) -> Result<String, MelodyError> {
     );
     substitutions.insert("json_mode".to_string(), Value::Bool(opts.json_mode));
 
-    let parser = liquid::ParserBuilder::with_stdlib().build()?;
-    let template = parser.parse(opts.template)?;
+    let template = compile_template(opts.template)?;
 
     Ok(template.render(&liquid::object!(&substitutions))?)
 }
 
+/// Returns the map of the documents a CMD3 or CMD4 prompt rendered from `messages` and
+/// `documents_len` documents numbers, to resolve the sources of citations to them.
+///
+/// The documents of the render options come first, under tool call index 0, followed by
+/// the documents of the tool messages under the index of their tool call.
+///
+/// # Errors
+///
+/// Returns a `MelodyError` if the messages are invalid, as rendering them would.
+pub fn document_index_map(
+    messages: &[Message],
+    documents_len: usize,
+) -> Result<DocumentIndexMap, MelodyError> {
+    let (_, mut map) = messages_to_template(messages, documents_len > 0, &BTreeMap::new())?;
+    let documents = (0..documents_len).map(|i| DocumentSource {
+        tool_call_index: 0,
+        tool_result_index: i,
+        tool_call_id: None,
+        message_index: None,
+        content_index: i,
+    });
+    map.documents.splice(0..0, documents);
+    Ok(map)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -338,4 +363,89 @@ mod tests {
             assert_eq!(expected, rendered, "Failed test: {}", test_name);
         }
     }
+
+    #[test]
+    fn test_document_index_map() {
+        let messages: Vec<Message> = serde_json::from_value(serde_json::json!([
+            {"role": "user", "content": [{"type": "text", "text": "Weather?"}]},
+            {"role": "chatbot", "tool_calls": [
+                {"id": "a", "name": "search", "parameters": "{}"},
+                {"id": "b", "name": "search", "parameters": "{}"}
+            ]},
+            {"role": "tool", "tool_call_id": "b", "content": [
+                {"type": "text", "text": "sunny"},
+                {"type": "document", "document": {"temp": 20}}
+            ]},
+            {"role": "tool", "tool_call_id": "a", "content": [{"type": "text", "text": "rain"}]}
+        ]))
+        .unwrap();
+
+        let map = document_index_map(&messages, 1).unwrap();
+        assert_eq!(map.documents.len(), 4);
+        assert_eq!(map.get(0, 0).unwrap().message_index, None);
+        // Tool calls are numbered in the order the chatbot made them
+        let source = map.get(2, 1).unwrap();
+        assert_eq!(source.tool_call_id.as_deref(), Some("b"));
+        assert_eq!(source.message_index, Some(2));
+        assert_eq!(source.content_index, 1);
+        let source = map.get(1, 0).unwrap();
+        assert_eq!(source.tool_call_id.as_deref(), Some("a"));
+        assert_eq!(source.message_index, Some(3));
+        assert!(map.get(1, 1).is_none());
+    }
+
+    #[test]
+    fn test_messages_to_template_citation_order() {
+        let messages: Vec<Message> = serde_json::from_value(serde_json::json!([
+            {"role": "user", "content": [{"type": "text", "text": "Weather?"}]},
+            {"role": "chatbot", "content": [{"type": "text", "text": "It is sunny."}], "citations": [{
+                "start_index": 6,
+                "end_index": 11,
+                "text": "sunny",
+                "sources": [
+                    {"tool_call_index": 2, "tool_result_indices": [0]},
+                    {"tool_call_index": 0, "tool_result_indices": [1]},
+                    {"tool_call_index": 1, "tool_result_indices": [3]},
+                    {"tool_call_index": 0, "tool_result_indices": [2]}
+                ],
+                "is_thinking": false
+            }]}
+        ]))
+        .unwrap();
+
+        // The tools are in the order they are first cited on every render
+        for _ in 0..20 {
+            let (template, _) = messages_to_template(&messages, false, &BTreeMap::new()).unwrap();
+            assert_eq!(
+                template[1]["content"][0]["data"],
+                "It is <co>sunny</co: 2:[0],0:[1,2],1:[3]>."
+            );
+        }
+    }
+
+    #[test]
+    fn test_messages_to_template_elided_turns() {
+        let messages: Vec<Message> = serde_json::from_value(serde_json::json!([
+            {"role": "user", "content": [{"type": "text", "text": "Hi"}]},
+            {"role": "chatbot", "content": [{"type": "elided_turns", "elided_turns": 4}]},
+            {"role": "user", "content": [{"type": "elided_turns", "elided_turns": 1}]}
+        ]))
+        .unwrap();
+
+        let (template, _) = messages_to_template(&messages, false, &BTreeMap::new()).unwrap();
+        // The markers are system turns of text
+        assert_eq!(template[1]["role"], "SYSTEM");
+        assert_eq!(template[1]["content"][0]["type"], "text");
+        assert_eq!(template[1]["content"][0]["data"], "[4 messages omitted]");
+        assert_eq!(template[2]["content"][0]["data"], "[1 message omitted]");
+
+        let messages: Vec<Message> = serde_json::from_value(serde_json::json!([
+            {"role": "user", "content": [
+                {"type": "elided_turns", "elided_turns": 2},
+                {"type": "text", "text": "Hi"}
+            ]}
+        ]))
+        .unwrap();
+        assert!(messages_to_template(&messages, false, &BTreeMap::new()).is_err());
+    }
 }
@@ -3,12 +3,26 @@
 //! This module provides functionality to render prompts with support for
 //! messages, tools, documents, and various configuration options.
 
+mod cache;
+mod extensions;
+mod fim;
 mod lib;
+mod preamble;
+mod structured_output;
 
 /// Type definitions for templating structures like messages, roles, and content.
 pub mod types;
 
 mod util;
 
+pub use crate::fim::{FimFamily, FimSentinels};
+pub use cache::{
+    DEFAULT_TEMPLATE_CACHE_CAPACITY, TemplateCacheEvent, TemplateCacheStats, compile_template,
+    set_template_cache_capacity, set_template_cache_hook, template_cache_stats,
+};
+pub use extensions::{FilterFn, TagFn, register_filter, register_partial, register_tag};
+pub use fim::{RenderFimOptions, render_fim};
 pub use lib::*;
+pub use preamble::build_preamble;
+pub use structured_output::{StructuredOutputMode, build_structured_output_section};
 pub use types::*;
@@ -0,0 +1,214 @@
+use crate::errors::MelodyError;
+use serde_json::Value;
+
+// The structured output instructions, kept in sync with the json_mode blocks of
+// templates/cmd3-v1.tmpl and templates/cmd4-v1.tmpl.
+
+const JSON_OBJECT_INSTRUCTION: &str = "When generating JSON objects, do not generate block markers. Generate an object directly without prefixing with ```json. Return only the JSON and nothing else.";
+
+const JSON_SCHEMA_INTRO: &str = "\nYour output should adhere to the following json schema:\n";
+
+/// The keywords of the JSON schemas the models are trained to follow.
+const SUPPORTED_KEYWORDS: &[&str] = &[
+    "$schema",
+    "$id",
+    "$ref",
+    "$defs",
+    "definitions",
+    "title",
+    "description",
+    "type",
+    "properties",
+    "required",
+    "additionalProperties",
+    "items",
+    "enum",
+    "const",
+    "anyOf",
+    "format",
+    "pattern",
+    "default",
+    "examples",
+    "nullable",
+];
+
+/// Kind of structured output a prompt asks the model for.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum StructuredOutputMode {
+    /// Any JSON object, without a schema.
+    #[default]
+    JsonObject,
+    /// A JSON object that adheres to a schema.
+    JsonSchema,
+}
+
+/// Builds the structured output section of a prompt: the instructions that
+/// `render_cmd3` and `render_cmd4` render with `json_mode`, followed by the schema
+/// in `JsonSchema` mode.
+///
+/// The schema is validated and minified, so that prompts do not depend on its
+/// whitespace. Only the keywords the models are trained to follow are accepted:
+/// `type`, `properties`, `required`, `additionalProperties`, `items`, `enum`,
+/// `const`, `anyOf`, `format`, `pattern`, references with `$ref`, `$defs` and
+/// `definitions`, and annotations such as `title` and `description`.
+///
+/// # Errors
+///
+/// Returns a `MelodyError` if:
+/// - `mode` is `JsonSchema` and the schema is missing, or `JsonObject` and it is not
+/// - The schema is not a JSON object
+/// - The schema uses an unsupported keyword, e.g. `minimum` or `oneOf`
+///
+/// # Examples
+///
+/// ```rust
+/// use cohere_melody::templating::{StructuredOutputMode, build_structured_output_section};
+///
+/// let schema = r#"{"type": "object", "properties": {"name": {"type": "string"}}}"#;
+/// let section = build_structured_output_section(Some(schema), StructuredOutputMode::JsonSchema).unwrap();
+/// assert!(section.ends_with(r#"{"type":"object","properties":{"name":{"type":"string"}}}"#));
+/// ```
+pub fn build_structured_output_section(
+    schema: Option<&str>,
+    mode: StructuredOutputMode,
+) -> Result<String, MelodyError> {
+    let schema = schema.filter(|s| !s.trim().is_empty());
+    let mut out = String::from(JSON_OBJECT_INSTRUCTION);
+    match (mode, schema) {
+        (StructuredOutputMode::JsonObject, None) => {}
+        (StructuredOutputMode::JsonObject, Some(_)) => {
+            return Err(MelodyError::TemplateValidation(
+                "a json schema requires the json_schema structured output mode".to_string(),
+            ));
+        }
+        (StructuredOutputMode::JsonSchema, None) => {
+            return Err(MelodyError::TemplateValidation(
+                "the json_schema structured output mode requires a json schema".to_string(),
+            ));
+        }
+        (StructuredOutputMode::JsonSchema, Some(schema)) => {
+            let schema: Value = serde_json::from_str(schema)?;
+            validate_schema(&schema, "#")?;
+            out.push_str(JSON_SCHEMA_INTRO);
+            out.push_str(&serde_json::to_string(&schema)?);
+        }
+    }
+    Ok(out)
+}
+
+/// Checks that `schema`, found at the JSON pointer `path`, and its subschemas use only
+/// supported keywords.
+fn validate_schema(schema: &Value, path: &str) -> Result<(), MelodyError> {
+    let Value::Object(schema) = schema else {
+        // true and false are schemas accepting anything and nothing
+        if schema.is_boolean() && path != "#" {
+            return Ok(());
+        }
+        return Err(MelodyError::TemplateValidation(format!(
+            "json schema at {path} must be an object"
+        )));
+    };
+    for (keyword, value) in schema {
+        if !SUPPORTED_KEYWORDS.contains(&keyword.as_str()) {
+            return Err(MelodyError::TemplateValidation(format!(
+                "unsupported json schema keyword '{keyword}' at {path}"
+            )));
+        }
+        let path = pointer(path, keyword);
+        match (keyword.as_str(), value) {
+            ("properties" | "$defs" | "definitions", Value::Object(schemas)) => {
+                for (name, schema) in schemas {
+                    validate_schema(schema, &pointer(&path, name))?;
+                }
+            }
+            ("anyOf" | "items", Value::Array(schemas)) => {
+                for (i, schema) in schemas.iter().enumerate() {
+                    validate_schema(schema, &pointer(&path, &i.to_string()))?;
+                }
+            }
+            ("items" | "additionalProperties", schema) => validate_schema(schema, &path)?,
+            _ => {}
+        }
+    }
+    Ok(())
+}
+
+/// Appends `token` to the JSON pointer `path`.
+fn pointer(path: &str, token: &str) -> String {
+    format!("{path}/{}", token.replace('~', "~0").replace('/', "~1"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_build_structured_output_section() {
+        let section = build_structured_output_section(None, StructuredOutputMode::JsonObject);
+        assert_eq!(section.unwrap(), JSON_OBJECT_INSTRUCTION);
+
+        let schema = r#"{
+            "type": "object",
+            "properties": {
+                "city": {"type": "string", "description": "The city"},
+                "tags": {"type": "array", "items": {"enum": ["a", "b"]}}
+            },
+            "required": ["city"],
+            "additionalProperties": false
+        }"#;
+        let section =
+            build_structured_output_section(Some(schema), StructuredOutputMode::JsonSchema)
+                .unwrap();
+        assert_eq!(
+            section,
+            format!(
+                "{JSON_OBJECT_INSTRUCTION}\nYour output should adhere to the following json schema:\n{}",
+                r#"{"type":"object","properties":{"city":{"type":"string","description":"The city"},"tags":{"type":"array","items":{"enum":["a","b"]}}},"required":["city"],"additionalProperties":false}"#
+            )
+        );
+    }
+
+    #[test]
+    fn test_build_structured_output_section_errors() {
+        let cases = [
+            (
+                None,
+                StructuredOutputMode::JsonSchema,
+                "requires a json schema",
+            ),
+            (
+                Some(r#"{"type": "object"}"#),
+                StructuredOutputMode::JsonObject,
+                "requires the json_schema",
+            ),
+            (
+                Some("[1, 2]"),
+                StructuredOutputMode::JsonSchema,
+                "at # must be an object",
+            ),
+            (Some("{"), StructuredOutputMode::JsonSchema, "JSON"),
+            (
+                Some(r#"{"properties": {"age": {"type": "integer", "minimum": 0}}}"#),
+                StructuredOutputMode::JsonSchema,
+                "unsupported json schema keyword 'minimum' at #/properties/age",
+            ),
+            (
+                Some(r#"{"anyOf": [{"type": "string"}, {"oneOf": []}]}"#),
+                StructuredOutputMode::JsonSchema,
+                "'oneOf' at #/anyOf/1",
+            ),
+            (
+                Some(r#"{"$defs": {"a/b": {"items": 1}}}"#),
+                StructuredOutputMode::JsonSchema,
+                "at #/$defs/a~1b/items must be an object",
+            ),
+        ];
+        for (schema, mode, expected) in cases {
+            let err = build_structured_output_section(schema, mode).unwrap_err();
+            assert!(
+                err.to_string().contains(expected),
+                "{schema:?}: {err} does not contain {expected}"
+            );
+        }
+    }
+}
@@ -3,7 +3,7 @@
 //! This module contains types for representing messages, roles, content,
 //! and various configuration options used in prompt rendering.
 
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
 use serde_json::{Map, Value};
 
 use crate::parsing::types::FilterCitation;
@@ -68,6 +68,9 @@ pub enum ContentType {
     Image,
     /// Document content.
     Document,
+    /// A marker for turns elided from the history to fit the context, rendered as a system
+    /// turn saying how many were omitted.
+    ElidedTurns,
 }
 
 impl TryFrom<String> for ContentType {
@@ -79,8 +82,9 @@ impl TryFrom<String> for ContentType {
             "thinking" => Ok(ContentType::Thinking),
             "image" => Ok(ContentType::Image),
             "document" => Ok(ContentType::Document),
+            "elided_turns" => Ok(ContentType::ElidedTurns),
             other => Err(format!(
-                "invalid ContentType '{other}', expected one of: unknown, text, thinking, image, document"
+                "invalid ContentType '{other}', expected one of: unknown, text, thinking, image, document, elided_turns"
             )),
         }
     }
@@ -269,6 +273,9 @@ pub struct Content {
     pub image: Option<Image>,
     /// Document content as JSON (for document type).
     pub document: Option<Map<String, Value>>,
+    /// Number of turns omitted (for `elided_turns` type).
+    #[serde(default)]
+    pub elided_turns: usize,
 }
 
 /// A tool call made by the model.
@@ -301,3 +308,41 @@ pub struct Message {
     #[serde(default)]
     pub citations: Vec<FilterCitation>,
 }
+
+/// Where a document numbered by a rendered template comes from.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct DocumentSource {
+    /// Index of the tool call the template numbers the document under, the
+    /// `tool_call_index` of citation sources.
+    pub tool_call_index: usize,
+    /// Index of the document among the results of the tool call, one of the
+    /// `tool_result_indices` of citation sources.
+    pub tool_result_index: usize,
+    /// ID of the tool call, `None` for the documents given with the render options.
+    pub tool_call_id: Option<String>,
+    /// Index of the tool message in the messages, `None` for the documents given with the
+    /// render options.
+    pub message_index: Option<usize>,
+    /// Index of the document in the content of the tool message, or in the documents
+    /// given with the render options.
+    pub content_index: usize,
+}
+
+/// Maps the documents numbered by a rendered template back to the messages and documents
+/// they come from, so citation sources can be resolved to the original tool outputs.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct DocumentIndexMap {
+    /// The documents in the order they are rendered.
+    pub documents: Vec<DocumentSource>,
+}
+
+impl DocumentIndexMap {
+    /// Returns the source of the document a citation refers to by its tool call and tool
+    /// result indices.
+    #[must_use]
+    pub fn get(&self, tool_call_index: usize, tool_result_index: usize) -> Option<&DocumentSource> {
+        self.documents.iter().find(|d| {
+            d.tool_call_index == tool_call_index && d.tool_result_index == tool_result_index
+        })
+    }
+}
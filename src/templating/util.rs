@@ -1,8 +1,10 @@
 use crate::errors::MelodyError;
 use crate::parsing::types::FilterCitation;
-use crate::templating::types::{ContentType, Message, Role, Tool, ToolCall};
+use crate::templating::types::{
+    ContentType, DocumentIndexMap, DocumentSource, Message, Role, Tool, ToolCall,
+};
 use serde_json::{Map, Value, to_string};
-use std::collections::{BTreeMap, HashMap};
+use std::collections::BTreeMap;
 
 pub(crate) fn add_spaces_to_json_encoding(input: &str) -> String {
     let mut b = String::with_capacity(input.len());
@@ -229,17 +231,24 @@ fn add_citation_insert_pair(
         end: false,
         id: String::new(),
     };
-    let mut citation_id_map: HashMap<usize, Vec<usize>> = HashMap::new();
+    // Sources cite tools by name in the tool-name citation format, by index otherwise. The
+    // results are grouped by tool in the order the tools are first cited, so the prompt
+    // is the same on every render.
+    let mut results_by_tool: Vec<(String, Vec<usize>)> = Vec::new();
     for source in &citation.sources {
-        citation_id_map
-            .entry(source.tool_call_index)
-            .or_default()
-            .extend_from_slice(&source.tool_result_indices);
+        let key = source
+            .source_name
+            .clone()
+            .unwrap_or_else(|| source.tool_call_index.to_string());
+        match results_by_tool.iter_mut().find(|(tool, _)| *tool == key) {
+            Some((_, result_ids)) => result_ids.extend_from_slice(&source.tool_result_indices),
+            None => results_by_tool.push((key, source.tool_result_indices.clone())),
+        }
     }
     let mut citation_ids = Vec::new();
-    for (tool_call_idx, result_ids) in citation_id_map {
+    for (tool, result_ids) in results_by_tool {
         let citation_id = format!(
-            "{tool_call_idx}:[{}]",
+            "{tool}:[{}]",
             result_ids
                 .iter()
                 .map(ToString::to_string)
@@ -257,14 +266,24 @@ fn add_citation_insert_pair(
     citation_inserts.extend([insrt_start, insrt_end]);
 }
 
-// Convert messages to template
+/// Returns the marker standing in for `n` turns elided from the history.
+fn elided_turns_marker(n: usize) -> String {
+    if n == 1 {
+        "[1 message omitted]".to_string()
+    } else {
+        format!("[{n} messages omitted]")
+    }
+}
+
+// Convert messages to template, along with the map of the documents of their tool results
 #[allow(clippy::too_many_lines)] //TODO: Refactor this function to reduce its length.
 pub(crate) fn messages_to_template(
     messages: &[Message],
     docs_present: bool,
     special_token_map: &BTreeMap<String, String>,
-) -> Result<Vec<Value>, MelodyError> {
+) -> Result<(Vec<Value>, DocumentIndexMap), MelodyError> {
     let mut template_messages: Vec<TemplateMessage> = Vec::new();
+    let mut document_map = DocumentIndexMap::default();
     let mut running_tool_call_idx = usize::from(docs_present);
     let mut tool_call_id_to_tool_result_idx = BTreeMap::new();
     let mut tool_call_id_to_prompt_id = BTreeMap::new();
@@ -318,6 +337,8 @@ pub(crate) fn messages_to_template(
                         m.tool_results[tool_result_idx]
                             .documents
                             .push(escape_special_tokens(&rendered_obj, special_token_map));
+                    } else {
+                        continue;
                     }
                 } else if content_item.content_type == ContentType::Document {
                     if let Some(ref obj) = content_item.document {
@@ -325,17 +346,38 @@ pub(crate) fn messages_to_template(
                         m.tool_results[tool_result_idx]
                             .documents
                             .push(escape_special_tokens(&rendered_obj, special_token_map));
+                    } else {
+                        continue;
                     }
                 } else {
                     return Err(MelodyError::TemplateValidation(format!(
                         "tool message[{i}].content[{j}] invalid content type"
                     )));
                 }
+                document_map.documents.push(DocumentSource {
+                    tool_call_index: tool_call_template_id,
+                    tool_result_index: m.tool_results[tool_result_idx].documents.len() - 1,
+                    tool_call_id: Some(tool_call_id.clone()),
+                    message_index: Some(i),
+                    content_index: j,
+                });
             }
 
             continue;
         }
 
+        // The marker of elided turns stands in for turns of any role, it is framed as a system
+        // turn so the model never reads it as its own or the user's words
+        let elided = msg
+            .content
+            .iter()
+            .any(|c| c.content_type == ContentType::ElidedTurns);
+        if elided && (msg.content.len() > 1 || !msg.tool_calls.is_empty()) {
+            return Err(MelodyError::TemplateValidation(format!(
+                "message[{i}] has elided turns with other content or tool calls"
+            )));
+        }
+
         let mut template_msg_content = Vec::new();
         for (j, content_item) in msg.content.iter().enumerate() {
             let mut citation_inserts = Vec::<CitationInsertInfo>::new();
@@ -416,6 +458,12 @@ pub(crate) fn messages_to_template(
                             .unwrap_or_default(),
                     });
                 }
+                ContentType::ElidedTurns => {
+                    template_msg_content.push(TemplateContent {
+                        content_type: "text".to_string(),
+                        data: elided_turns_marker(content_item.elided_turns),
+                    });
+                }
                 ContentType::Unknown => {}
             }
         }
@@ -444,12 +492,13 @@ pub(crate) fn messages_to_template(
             rendered_tool_calls.push(rendered_tool_call);
         }
 
+        let role = if elided { &Role::System } else { &msg.role };
         template_messages.push(TemplateMessage {
-            role: msg.role.as_str().to_string(),
+            role: role.as_str().to_string(),
             tool_calls: rendered_tool_calls,
             content: template_msg_content,
             tool_results: vec![],
         });
     }
-    Ok(message_to_map(&template_messages))
+    Ok((message_to_map(&template_messages), document_map))
 }
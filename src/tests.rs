@@ -60,6 +60,7 @@ mod tests {
         let logprobs = TokenIDsWithLogProb {
             token_ids: vec![1, 2, 3],
             logprobs: vec![0.1, 0.2, 0.3],
+            ..Default::default()
         };
         let (outputs, _remove) = filter.process_grounded_text(
             input.as_bytes(),
@@ -163,6 +164,7 @@ mod tests {
         let logprobs = TokenIDsWithLogProb {
             token_ids: vec![1, 2, 3],
             logprobs: vec![0.1, 0.2, 0.3],
+            ..Default::default()
         };
 
         let (outputs, _) = filter.process_text(text.as_bytes(), Some(&logprobs));
@@ -178,7 +180,7 @@ mod tests {
         let mut filter = FilterImpl::new();
         filter.curr_search_query_idx = 0;
 
-        let (outputs, remove) = filter.process_search_query(b"test query");
+        let (outputs, remove) = filter.process_search_query(b"test query", false);
 
         assert_eq!(outputs.len(), 1);
         assert!(outputs[0].search_query.is_some());
@@ -211,11 +213,13 @@ mod tests {
         let mut logprobs1 = TokenIDsWithLogProb {
             token_ids: vec![1, 2],
             logprobs: vec![0.1, 0.2],
+            ..Default::default()
         };
 
         let logprobs2 = TokenIDsWithLogProb {
             token_ids: vec![3, 4],
             logprobs: vec![0.3, 0.4],
+            ..Default::default()
         };
 
         logprobs1.append(logprobs2);
@@ -283,6 +287,7 @@ mod tests {
             likelihoods_chunks.push(TokenIDsWithLogProb {
                 token_ids: buffer.clone(),
                 logprobs: likelihood_buffer.clone(),
+                ..Default::default()
             });
             buffer.clear();
             likelihood_buffer.clear();
@@ -472,10 +477,12 @@ mod tests {
                     Source {
                         tool_call_index: 0,
                         tool_result_indices: vec![1, 2],
+                        source_name: None,
                     },
                     Source {
                         tool_call_index: 1,
                         tool_result_indices: vec![3, 4],
+                        source_name: None,
                     },
                 ],
                 is_thinking: false,
@@ -502,6 +509,7 @@ mod tests {
                     sources: vec![Source {
                         tool_call_index: 0,
                         tool_result_indices: vec![1],
+                        source_name: None,
                     }],
                     is_thinking: true,
                 },
@@ -513,10 +521,12 @@ mod tests {
                         Source {
                             tool_call_index: 0,
                             tool_result_indices: vec![1, 2],
+                            source_name: None,
                         },
                         Source {
                             tool_call_index: 1,
                             tool_result_indices: vec![3, 4],
+                            source_name: None,
                         },
                     ],
                     is_thinking: false,
@@ -545,6 +555,7 @@ mod tests {
                 sources: vec![Source {
                     tool_call_index: 1,
                     tool_result_indices: vec![1],
+                    source_name: None,
                 }],
                 is_thinking: false,
             }],
@@ -694,6 +705,73 @@ plt.ylabel('Number of Climbers')
         })
     }
 
+    #[test]
+    fn test_filter_word_boundary_chunking() {
+        let mut filter = FilterImpl::new()
+            .apply_options(FilterOptions::new().cmd3().with_word_boundary_chunking(6));
+        let chunks = [
+            "<|START_RESPONSE|>",
+            "The",
+            " s",
+            "ky",
+            " is",
+            " <co>",
+            "bl",
+            "ue",
+            "</co: 0:[1]>",
+            " to",
+            "day",
+            "<|END_RESPONSE|>",
+        ];
+        let mut texts = Vec::new();
+        let mut citations = Vec::new();
+        for chunk in chunks {
+            for o in filter.write_decoded(chunk, TokenIDsWithLogProb::new()) {
+                texts.push(o.text);
+                citations.extend(o.citations);
+            }
+        }
+        // Chunks end at the last boundary after 6 characters, or at a special token. The
+        // trailing whitespace of answer text is held back until more text follows.
+        assert_eq!(texts, vec!["The sky", " is ", "blue", " today"]);
+        assert_eq!(citations.len(), 1);
+        assert_eq!(citations[0].text, "blue");
+    }
+
+    #[test]
+    fn test_filter_word_boundary_chunking_logprobs() {
+        let mut filter = FilterImpl::new()
+            .apply_options(FilterOptions::new().cmd3().with_word_boundary_chunking(6));
+        let chunks = [
+            "<|START_RESPONSE|>",
+            "Hello",
+            " wor",
+            "ld",
+            " and",
+            " mo",
+            "re",
+            "<|END_RESPONSE|>",
+        ];
+        let mut outputs = Vec::new();
+        for (i, chunk) in (0u32..).zip(chunks) {
+            let logprobs = TokenIDsWithLogProb {
+                token_ids: vec![i],
+                logprobs: vec![-0.5 * (i + 1) as f32],
+                top_logprobs: Vec::new(),
+            };
+            for o in filter.write_decoded(chunk, logprobs) {
+                outputs.push((o.text, o.logprobs.token_ids, o.logprobs.logprobs));
+            }
+        }
+        // A held back word keeps the log probs of its tokens until it is emitted
+        let texts: Vec<_> = outputs.iter().map(|(text, _, _)| text.as_str()).collect();
+        let token_ids: Vec<_> = outputs.iter().map(|(_, ids, _)| ids.clone()).collect();
+        assert_eq!(texts, vec!["Hello", " world", " and more"]);
+        assert_eq!(token_ids, vec![vec![1], vec![2, 3], vec![4, 5, 6]]);
+        let total: f32 = outputs.iter().flat_map(|(_, _, lps)| lps).sum();
+        assert!((total - -0.5 * (2 + 3 + 4 + 5 + 6 + 7) as f32).abs() < 1e-6);
+    }
+
     #[test]
     fn test_filter_command3_tool_multiple_calls_chunk_size() {
         run_filter_test(FilterTestCase {
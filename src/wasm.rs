@@ -0,0 +1,234 @@
+//! WebAssembly bindings for the parsing filter
+//!
+//! This module exports a small C ABI meant to be called from a WebAssembly host, e.g.
+//! an Envoy wasm filter, a browser demo or a Go program embedding a wasm runtime. It
+//! has no dependency on tokenizers, so the crate builds for `wasm32-wasip1` with
+//!
+//! ```text
+//! cargo rustc --release --target wasm32-wasip1 --no-default-features --features wasm --crate-type cdylib
+//! ```
+//!
+//! Everything crosses the boundary as UTF-8 JSON in linear memory:
+//!
+//! - The filter configuration is a `FilterConfig`, e.g. `{"options": ["cmd3"]}`
+//! - Outputs are a JSON array of objects encoded by `output_to_json`
+//!
+//! # Memory Management
+//!
+//! The host writes its inputs into buffers from `melody_wasm_alloc` and frees them
+//! with `melody_wasm_free`. Output buffers are owned by the host and must also be
+//! freed with `melody_wasm_free`, passing the length written to `out_len`.
+//!
+//! # Thread Safety
+//!
+//! Filter instances are NOT thread-safe, which is not a concern for single-threaded
+//! wasm hosts.
+
+use crate::parsing::json::{FilterConfig, outputs_to_json};
+use crate::parsing::types::{FilterOutput, TokenIDsWithLogProb};
+use crate::parsing::{Filter, FilterImpl, new_filter};
+use std::panic::{self, AssertUnwindSafe};
+use std::slice;
+
+/// Allocates `len` bytes of memory for the host to write an input into.
+#[unsafe(no_mangle)]
+pub extern "C" fn melody_wasm_alloc(len: usize) -> *mut u8 {
+    Box::into_raw(vec![0; len].into_boxed_slice()).cast()
+}
+
+/// Frees memory returned by `melody_wasm_alloc` or an output of this module.
+///
+/// # Safety
+///
+/// `ptr` must come from `melody_wasm_alloc(len)` or be an output of this module with
+/// `len` written to its `out_len`, and must not be used after this call.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_wasm_free(ptr: *mut u8, len: usize) {
+    if ptr.is_null() {
+        return;
+    }
+    unsafe {
+        drop(Box::from_raw(slice::from_raw_parts_mut(ptr, len)));
+    }
+}
+
+/// Creates a filter from a JSON `FilterConfig`.
+///
+/// Returns null if the configuration is not valid UTF-8 JSON or names an unknown
+/// option.
+///
+/// # Safety
+///
+/// `config` must point to `config_len` readable bytes.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_wasm_filter_new(
+    config: *const u8,
+    config_len: usize,
+) -> *mut FilterImpl {
+    let config = unsafe { read_bytes(config, config_len) };
+    let options = panic::catch_unwind(|| {
+        serde_json::from_slice::<FilterConfig>(config)
+            .ok()?
+            .options()
+            .ok()
+    });
+    match options {
+        Ok(Some(options)) => Box::into_raw(Box::new(new_filter(options))),
+        _ => std::ptr::null_mut(),
+    }
+}
+
+/// Frees a filter created with `melody_wasm_filter_new`.
+///
+/// # Safety
+///
+/// `filter` must come from `melody_wasm_filter_new` and must not be used after this
+/// call.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_wasm_filter_free(filter: *mut FilterImpl) {
+    if !filter.is_null() {
+        unsafe {
+            drop(Box::from_raw(filter));
+        }
+    }
+}
+
+/// Writes decoded text to the filter and returns its outputs as a JSON array.
+///
+/// The length of the output is written to `out_len`. Returns null, with `out_len`
+/// set to 0, if the filter is null, the text is not valid UTF-8 or the filter panics.
+///
+/// # Safety
+///
+/// `filter` must come from `melody_wasm_filter_new`, `text` must point to `text_len`
+/// readable bytes and `out_len` must be writable.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_wasm_filter_write_decoded(
+    filter: *mut FilterImpl,
+    text: *const u8,
+    text_len: usize,
+    out_len: *mut usize,
+) -> *mut u8 {
+    let text = unsafe { read_bytes(text, text_len) };
+    unsafe {
+        with_filter(filter, out_len, |f| {
+            std::str::from_utf8(text)
+                .ok()
+                .map(|text| f.write_decoded(text, TokenIDsWithLogProb::new()))
+        })
+    }
+}
+
+/// Flushes the partial outputs held by the filter and returns them as a JSON array.
+///
+/// The length of the output is written to `out_len`. Returns null, with `out_len`
+/// set to 0, if the filter is null or panics.
+///
+/// # Safety
+///
+/// `filter` must come from `melody_wasm_filter_new` and `out_len` must be writable.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn melody_wasm_filter_flush_partials(
+    filter: *mut FilterImpl,
+    out_len: *mut usize,
+) -> *mut u8 {
+    unsafe { with_filter(filter, out_len, |f| Some(f.flush_partials())) }
+}
+
+unsafe fn read_bytes<'a>(ptr: *const u8, len: usize) -> &'a [u8] {
+    if ptr.is_null() || len == 0 {
+        return &[];
+    }
+    unsafe { slice::from_raw_parts(ptr, len) }
+}
+
+/// Runs `f` on the filter and hands the JSON encoding of its outputs to the host.
+unsafe fn with_filter<F>(filter: *mut FilterImpl, out_len: *mut usize, f: F) -> *mut u8
+where
+    F: FnOnce(&mut FilterImpl) -> Option<Vec<FilterOutput>>,
+{
+    if out_len.is_null() {
+        return std::ptr::null_mut();
+    }
+    unsafe {
+        *out_len = 0;
+    }
+    if filter.is_null() {
+        return std::ptr::null_mut();
+    }
+
+    let filter = unsafe { &mut *filter };
+    let Ok(Some(outputs)) = panic::catch_unwind(AssertUnwindSafe(|| f(filter))) else {
+        return std::ptr::null_mut();
+    };
+
+    let json = outputs_to_json(&outputs).into_bytes().into_boxed_slice();
+    unsafe {
+        *out_len = json.len();
+    }
+    Box::into_raw(json).cast()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::{Value, json};
+
+    unsafe fn take_output(ptr: *mut u8, len: usize) -> Value {
+        assert!(!ptr.is_null());
+        let out = serde_json::from_slice(unsafe { slice::from_raw_parts(ptr, len) }).unwrap();
+        unsafe { melody_wasm_free(ptr, len) };
+        out
+    }
+
+    #[test]
+    fn test_wasm_filter() {
+        let config = br#"{"options": ["cmd3"]}"#;
+        let filter = unsafe { melody_wasm_filter_new(config.as_ptr(), config.len()) };
+        assert!(!filter.is_null());
+
+        let mut out_len = 0;
+        let mut outputs = Vec::new();
+        for chunk in ["<|START_RESPONSE|>", "Hello", " world"] {
+            let ptr = unsafe {
+                melody_wasm_filter_write_decoded(
+                    filter,
+                    chunk.as_ptr(),
+                    chunk.len(),
+                    &raw mut out_len,
+                )
+            };
+            outputs.push(unsafe { take_output(ptr, out_len) });
+        }
+        let ptr = unsafe { melody_wasm_filter_flush_partials(filter, &raw mut out_len) };
+        outputs.push(unsafe { take_output(ptr, out_len) });
+        unsafe { melody_wasm_filter_free(filter) };
+
+        assert_eq!(
+            outputs,
+            vec![
+                json!([]),
+                json!([{"text": "Hello"}]),
+                json!([{"text": " world"}]),
+                json!([])
+            ]
+        );
+    }
+
+    #[test]
+    fn test_wasm_filter_invalid_input() {
+        let config = br#"{"options": ["cmd5"]}"#;
+        assert!(unsafe { melody_wasm_filter_new(config.as_ptr(), config.len()) }.is_null());
+
+        let config = b"{}";
+        let filter = unsafe { melody_wasm_filter_new(config.as_ptr(), config.len()) };
+        let mut out_len = 1;
+        let text = [0xff_u8];
+        let ptr = unsafe {
+            melody_wasm_filter_write_decoded(filter, text.as_ptr(), text.len(), &raw mut out_len)
+        };
+        assert!(ptr.is_null());
+        assert_eq!(out_len, 0);
+        unsafe { melody_wasm_filter_free(filter) };
+    }
+}
@@ -1,5 +1,18 @@
+import json
+from pathlib import Path
+
 import pytest
-from cohere_melody import PyFilter, PyFilterOptions
+from cohere_melody import (
+    FilterMode,
+    PyFilter,
+    PyFilterOptions,
+    get_accumulated_text,
+    get_raw_tokens,
+    new_filter_with_tokenizer,
+    render_cmd3,
+    render_cmd4,
+    write_token,
+)
 
 
 def test_simple_filter():
@@ -15,3 +28,180 @@ def test_simple_filter():
     fo = f.write_decoded("<|START_RESPONSE|>This is the final response.")
     assert fo[0].text == "This is the final response."
     assert fo[0].is_reasoning == False
+
+
+def test_special_token_map():
+    opts = PyFilterOptions().cmd3().with_special_token_map(
+        {"<|START_ANSWER|>": FilterMode.GroundedAnswer}
+    )
+    f = PyFilter(opts)
+    fo = f.write_decoded("<|START_ANSWER|>Renamed section.")
+    assert fo[0].text == "Renamed section."
+    assert fo[0].is_reasoning == False
+
+
+def test_raw_tokens_and_accumulated_text():
+    f = PyFilter(PyFilterOptions().cmd3())
+    tokens = ["<|START_RESPONSE|>", "Hello", " world", "<|END_RESPONSE|>"]
+    for token in tokens:
+        f.write_decoded(token)
+    f.flush_partials()
+
+    assert get_raw_tokens(f) == tokens
+    assert get_accumulated_text(f) == "<|START_RESPONSE|>Hello world<|END_RESPONSE|>"
+    assert f.raw_tokens() == tokens
+
+
+def test_write_token():
+    f = new_filter_with_tokenizer(
+        PyFilterOptions().cmd3(), "multilingual+255k+bos+eos+sptok+fim+agents3"
+    )
+    write_token(f, 255019, -0.1)  # <|START_THINKING|>
+    fo = write_token(f, 4184, -0.2)  # This
+    assert fo[0].text == "This"
+    assert fo[0].is_reasoning == True
+
+    # the rainbow emoji is split over three tokens and held back until it is complete
+    assert write_token(f, 11254, -0.3) == []
+    assert write_token(f, 242, -0.4) == []
+    fo = write_token(f, 238, -0.5)
+    assert fo[0].text == " 🌈"
+    assert fo[0].logprobs.token_ids == [11254, 242, 238]
+
+
+def test_write_token_unknown_tokenizer():
+    with pytest.raises(ValueError):
+        PyFilter.with_tokenizer(PyFilterOptions().cmd3(), "unknown")
+
+
+CONFORMANCE_TESTS = Path(__file__).parent / "conformance"
+
+# The fields of the output classes in the language-neutral encoding of the conformance
+# corpus, and the ones it leaves out. A field missing from both is not converted.
+ENCODED_FIELDS = {
+    "FilterOutput": {
+        "text",
+        "search_query",
+        "citations",
+        "tool_call_delta",
+        "is_post_answer",
+        "is_reasoning",
+        "plan_index",
+        "relevant_doc_indices",
+        "cited_doc_indices",
+    },
+    "FilterSearchQueryDelta": {"index", "text"},
+    "FilterCitation": {"start_index", "end_index", "text", "sources", "is_thinking"},
+    "Source": {"tool_call_index", "tool_result_indices", "source_name"},
+    "FilterToolCallDelta": {"index", "id", "name", "param_delta", "raw_param_delta"},
+    "FilterToolParameter": {"name", "value_delta"},
+}
+NOT_ENCODED_FIELDS = {"FilterOutput": {"logprobs", "is_echo", "finish"}}
+
+
+def check_fields(obj):
+    name = type(obj).__name__
+    fields = {f for f in dir(type(obj)) if not f.startswith("_")}
+    assert fields == ENCODED_FIELDS[name] | NOT_ENCODED_FIELDS.get(name, set()), name
+
+
+def output_to_json(o):
+    """Encodes a FilterOutput like output_to_json in src/parsing/json.rs"""
+    check_fields(o)
+    out = {}
+    if o.text:
+        out["text"] = o.text
+    if o.search_query is not None:
+        check_fields(o.search_query)
+        out["search_query"] = {
+            "index": o.search_query.index,
+            "text": o.search_query.text,
+        }
+    if o.citations:
+        out["citations"] = []
+        for c in o.citations:
+            check_fields(c)
+            sources = []
+            for s in c.sources:
+                check_fields(s)
+                source = {
+                    "tool_call_index": s.tool_call_index,
+                    "tool_result_indices": s.tool_result_indices,
+                }
+                if s.source_name is not None:
+                    source["source_name"] = s.source_name
+                sources.append(source)
+            out["citations"].append(
+                {
+                    "start_index": c.start_index,
+                    "end_index": c.end_index,
+                    "text": c.text,
+                    "sources": sources,
+                    "is_thinking": c.is_thinking,
+                }
+            )
+    if o.tool_call_delta is not None:
+        tc = o.tool_call_delta
+        check_fields(tc)
+        delta = {
+            "index": tc.index,
+            "id": tc.id,
+            "name": tc.name,
+            "raw_param_delta": tc.raw_param_delta,
+        }
+        if tc.param_delta is not None:
+            check_fields(tc.param_delta)
+            delta["param_delta"] = {
+                "name": tc.param_delta.name,
+                "value_delta": tc.param_delta.value_delta,
+            }
+        out["tool_call_delta"] = delta
+    if o.is_post_answer:
+        out["is_post_answer"] = True
+    if o.is_reasoning:
+        out["is_reasoning"] = True
+    if o.plan_index > 0:
+        out["plan_index"] = o.plan_index
+    if o.relevant_doc_indices is not None:
+        out["relevant_doc_indices"] = o.relevant_doc_indices
+    if o.cited_doc_indices is not None:
+        out["cited_doc_indices"] = o.cited_doc_indices
+    return out
+
+
+@pytest.mark.parametrize(
+    "case", sorted(p.name for p in CONFORMANCE_TESTS.iterdir() if p.is_dir())
+)
+def test_conformance(case):
+    # The corpus is also run by the Rust and Go tests, so the outputs must match across
+    # the bindings
+    config = json.loads((CONFORMANCE_TESTS / case / "input.json").read_text())
+    f = PyFilter(PyFilterOptions.from_config(config))
+    outputs = []
+    for chunk in config["chunks"]:
+        outputs.extend(f.write_decoded(chunk))
+    outputs.extend(f.flush_partials())
+    want = json.loads((CONFORMANCE_TESTS / case / "output.json").read_text())
+    assert [output_to_json(o) for o in outputs] == want
+
+
+def test_filter_options_from_unknown_config():
+    with pytest.raises(ValueError):
+        PyFilterOptions.from_config({"options": ["unknown"]})
+
+
+TEMPLATING_TESTS = Path(__file__).parent / "templating"
+
+
+@pytest.mark.parametrize(
+    "render,version", [(render_cmd3, "cmd3"), (render_cmd4, "cmd4")]
+)
+def test_render(render, version):
+    case = TEMPLATING_TESTS / version / "one_message"
+    options = json.loads((case / "input.json").read_text())
+    assert render(options) == (case / "output.txt").read_text()
+
+
+def test_render_invalid_options():
+    with pytest.raises(ValueError):
+        render_cmd3({"unknown_field": True})